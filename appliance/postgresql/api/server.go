@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/martini-contrib/render"
@@ -37,6 +38,7 @@ func main() {
 	m.Map(db)
 
 	r.Post("/databases", createDatabase)
+	r.Delete("/databases/:id", dropDatabase)
 	r.Get("/ping", ping)
 
 	port := os.Getenv("PORT")
@@ -103,6 +105,51 @@ func createDatabase(db *postgres.DB, r render.Render) {
 	})
 }
 
+// dropDatabase removes a database and its user, the id is the
+// "<username>:<database>" suffix of the resource ID returned by
+// createDatabase. Removing a database which does not exist is not an error so
+// that the request can be retried.
+func dropDatabase(db *postgres.DB, params martini.Params, w http.ResponseWriter) {
+	id := strings.SplitN(params["id"], ":", 2)
+	if len(id) != 2 || !validIdentifier(id[0]) || !validIdentifier(id[1]) {
+		w.WriteHeader(404)
+		return
+	}
+	username, database := id[0], id[1]
+
+	// terminate existing connections, otherwise the database cannot be dropped
+	if _, err := db.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1", database); err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	if _, err := db.Exec(fmt.Sprintf(`DROP DATABASE IF EXISTS "%s"`, database)); err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	if _, err := db.Exec(fmt.Sprintf(`DROP USER IF EXISTS "%s"`, username)); err != nil {
+		log.Println(err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// validIdentifier reports whether s looks like one of the random hex names
+// generated by createDatabase, so that it is safe to interpolate into SQL.
+func validIdentifier(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 func ping(db *postgres.DB, w http.ResponseWriter) {
 	if _, err := db.Exec("SELECT 1"); err != nil {
 		log.Println(err)
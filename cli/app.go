@@ -18,14 +18,51 @@ Create an application in Flynn.
 `)
 
 	register("delete", runDelete, `
-usage: flynn delete
+usage: flynn delete [-f]
 
 Delete Flynn app.
+
+Protected apps, and apps with routes, scaled up formations, resources or
+cron jobs, are only deleted (along with those objects) after a second
+confirmation, or with --force.
+
+Deleted apps can be restored with 'flynn undelete' for a time set by the
+controller, seven days by default. After that, resources which no other app
+uses are deprovisioned by their provider.
+
+Options:
+   -f, --force  also delete the app's routes, formations, resources and cron jobs
+`)
+
+	register("undelete", runUndelete, `
+usage: flynn undelete <app>
+
+Restore a deleted app, by ID or name, along with the routes, formations,
+resources, cron jobs and log drains that were deleted with it.
+`)
+	register("transfer", runTransfer, `
+usage: flynn transfer <token-id>
+       flynn transfer --accept
+       flynn transfer --cancel
+
+Transfer ownership of the app to another auth token.
+
+The app is owned by the new token once its holder accepts the transfer with
+'flynn transfer --accept', until then the transfer can be cancelled or
+declined with 'flynn transfer --cancel'.
+
+Options:
+   --accept  accept the transfer of the app
+   --cancel  cancel or decline the transfer of the app
 `)
 	register("apps", runApps, `
-usage: flynn apps
+usage: flynn apps [-l <selector>]
 
 List flynn apps.
+
+Options:
+   -l, --selector <selector>  only list apps with matching labels, for
+                              example "env=production,team!=search"
 `)
 }
 
@@ -46,22 +83,26 @@ func runCreate(args *docopt.Args, client *controller.Client) error {
 func runDelete(args *docopt.Args, client *controller.Client) error {
 	appName := mustApp()
 
-	fmt.Printf("Are you sure you want to delete the app %q? (yes/no): ", appName)
-loop:
-	for {
-		var answer string
-		fmt.Scanln(&answer)
-		switch answer {
-		case "y", "yes":
-			break loop
-		case "n", "no":
+	if !promptYesNo(fmt.Sprintf("Are you sure you want to delete the app %q?", appName)) {
+		return nil
+	}
+
+	force := args.Bool["--force"]
+	err := client.DeleteApp(appName, force)
+	if e, ok := err.(ct.ValidationError); ok && !force {
+		question := "Delete the app along with them?"
+		if e.Field == "protected" {
+			fmt.Printf("The %s is protected, deleting it may break the cluster.\n", appName)
+			question = "Delete the protected app along with its routes, formations, resources and cron jobs?"
+		} else {
+			fmt.Printf("The %s\n", e.Message)
+		}
+		if !promptYesNo(question) {
 			return nil
-		default:
-			fmt.Print("Please type 'yes' or 'no': ")
 		}
+		err = client.DeleteApp(appName, true)
 	}
-
-	if err := client.DeleteApp(appName); err != nil {
+	if err != nil {
 		return err
 	}
 
@@ -75,8 +116,51 @@ loop:
 	return nil
 }
 
+func runUndelete(args *docopt.Args, client *controller.Client) error {
+	app, err := client.UndeleteApp(args.String["<app>"])
+	if err == controller.ErrNotFound {
+		return fmt.Errorf("No deleted app named %s can be restored", args.String["<app>"])
+	} else if err != nil {
+		return err
+	}
+	log.Printf("Restored %s", app.Name)
+	return nil
+}
+
+func runTransfer(args *docopt.Args, client *controller.Client) error {
+	appName := mustApp()
+	switch {
+	case args.Bool["--accept"]:
+		if _, err := client.AcceptAppTransfer(appName); err != nil {
+			return err
+		}
+		log.Printf("Accepted the transfer of %s", appName)
+	case args.Bool["--cancel"]:
+		err := client.CancelAppTransfer(appName)
+		if err == controller.ErrNotFound {
+			return fmt.Errorf("%s is not being transferred", appName)
+		} else if err != nil {
+			return err
+		}
+		log.Printf("Cancelled the transfer of %s", appName)
+	default:
+		to := args.String["<token-id>"]
+		if _, err := client.TransferApp(appName, to); err != nil {
+			return err
+		}
+		log.Printf("Started the transfer of %s to %s, it must be accepted with 'flynn transfer --accept'", appName, to)
+	}
+	return nil
+}
+
 func runApps(args *docopt.Args, client *controller.Client) error {
-	apps, err := client.AppList()
+	var apps []*ct.App
+	var err error
+	if selector := args.String["--selector"]; selector != "" {
+		apps, err = client.AppListSelector(selector)
+	} else {
+		apps, err = client.AppList()
+	}
 	if err != nil {
 		return err
 	}
@@ -90,3 +174,20 @@ func runApps(args *docopt.Args, client *controller.Client) error {
 	}
 	return nil
 }
+
+// promptYesNo asks the question until the answer is yes or no.
+func promptYesNo(question string) bool {
+	fmt.Printf("%s (yes/no): ", question)
+	for {
+		var answer string
+		fmt.Scanln(&answer)
+		switch answer {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		default:
+			fmt.Print("Please type 'yes' or 'no': ")
+		}
+	}
+}
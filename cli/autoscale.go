@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func init() {
+	register("autoscale", runAutoscale, `
+usage: flynn autoscale
+       flynn autoscale set [--min <min>] --max <max> --target <target> <type>
+       flynn autoscale remove <type>
+
+Manage autoscaling of process types.
+
+The controller scales each process type with a policy between the minimum
+and maximum number of jobs so that each job serves about the target number
+of HTTP requests per second.
+
+Options:
+   --min <min>        minimum number of jobs [default: 1]
+   --max <max>        maximum number of jobs
+   --target <target>  target requests per second per job
+
+Commands:
+   With no arguments, shows a list of autoscale policies.
+
+   set     sets the autoscale policy of a process type
+   remove  stops autoscaling a process type
+
+Examples:
+
+   $ flynn autoscale set --min 2 --max 10 --target 50 web
+`)
+}
+
+func runAutoscale(args *docopt.Args, client *controller.Client) error {
+	switch {
+	case args.Bool["set"]:
+		return runAutoscaleSet(args, client)
+	case args.Bool["remove"]:
+		return client.DeleteAutoscalePolicy(mustApp(), args.String["<type>"])
+	}
+
+	list, err := client.AutoscalePolicyList(mustApp())
+	if err != nil {
+		return err
+	}
+	w := tabWriter()
+	defer w.Flush()
+	listRec(w, "TYPE", "MIN", "MAX", "METRIC", "TARGET")
+	for _, p := range list {
+		listRec(w, p.ProcessType, p.Min, p.Max, p.Metric, strconv.FormatFloat(p.Target, 'g', -1, 64))
+	}
+	return nil
+}
+
+func runAutoscaleSet(args *docopt.Args, client *controller.Client) error {
+	policy := &ct.AutoscalePolicy{AppID: mustApp(), ProcessType: args.String["<type>"]}
+	var err error
+	if policy.Min, err = strconv.Atoi(args.String["--min"]); err != nil {
+		return err
+	}
+	if policy.Max, err = strconv.Atoi(args.String["--max"]); err != nil {
+		return err
+	}
+	if policy.Target, err = strconv.ParseFloat(args.String["--target"], 64); err != nil {
+		return err
+	}
+	if err := client.PutAutoscalePolicy(policy); err != nil {
+		return err
+	}
+	log.Printf("Autoscaling %s between %d and %d jobs.", policy.ProcessType, policy.Min, policy.Max)
+	return nil
+}
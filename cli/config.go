@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func init() {
+	register("config", runConfig, `
+usage: flynn config
+       flynn config set [-r] <var>=<val>...
+       flynn config unset [-r] <var>...
+
+Manage app config vars.
+
+Config vars are merged over the env of the app's release when jobs are
+started, so they can be changed without creating a release. Jobs which are
+already running keep their env unless --restart is given.
+
+Options:
+   -r, --restart  create a copy of the current release to restart jobs
+
+Commands:
+   With no arguments, shows a list of config vars.
+
+   set    sets the value of one or more config vars
+   unset  deletes one or more config vars
+
+Examples:
+
+   $ flynn config set --restart DATABASE_PASSWORD=secret
+`)
+}
+
+func runConfig(args *docopt.Args, client *controller.Client) error {
+	update := &ct.EnvUpdate{NewRelease: args.Bool["--restart"]}
+	switch {
+	case args.Bool["set"]:
+		pairs := args.All["<var>=<val>"].([]string)
+		update.Set = make(map[string]string, len(pairs))
+		for _, s := range pairs {
+			v := strings.SplitN(s, "=", 2)
+			if len(v) != 2 {
+				return fmt.Errorf("invalid var format: %q", s)
+			}
+			update.Set[v[0]] = v[1]
+		}
+	case args.Bool["unset"]:
+		update.Unset = args.All["<var>"].([]string)
+	default:
+		env, err := client.GetAppEnv(mustApp())
+		if err != nil {
+			return err
+		}
+		vars := make([]string, 0, len(env.Env))
+		for k, v := range env.Env {
+			vars = append(vars, k+"="+v)
+		}
+		sort.Strings(vars)
+		for _, v := range vars {
+			fmt.Println(v)
+		}
+		return nil
+	}
+
+	env, err := client.UpdateAppEnv(mustApp(), update)
+	if err != nil {
+		return err
+	}
+	if env.ReleaseID != "" {
+		log.Printf("Created release %s.", env.ReleaseID)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func init() {
+	register("cron", runCron, `
+usage: flynn cron
+       flynn cron add [-t <type>] [-p <policy>] <schedule> [--] [<command>...]
+       flynn cron remove <id>
+       flynn cron runs <id>
+
+Manage jobs which run on a schedule.
+
+Schedules are five field cron expressions (minute, hour, day of month,
+month and day of week) in UTC, or one of @hourly, @daily, @weekly, @monthly
+and @yearly. Jobs run with the app's current release.
+
+Options:
+   -t, --type <type>      process type of the release to run
+   -p, --policy <policy>  what to do if the previous job is still running:
+                          allow, forbid (skip the run) or replace [default: allow]
+
+Commands:
+   With no arguments, shows a list of cron jobs.
+
+   add     adds a cron job which runs <command>, or the process type's command
+   remove  removes a cron job
+   runs    shows the recent runs of a cron job
+
+Examples:
+
+   $ flynn cron add "0 3 * * *" -- bin/cleanup --days 30
+
+   $ flynn cron add -t worker -p forbid "*/10 * * * *"
+`)
+}
+
+func runCron(args *docopt.Args, client *controller.Client) error {
+	switch {
+	case args.Bool["add"]:
+		return runCronAdd(args, client)
+	case args.Bool["remove"]:
+		return client.DeleteCronJob(mustApp(), args.String["<id>"])
+	case args.Bool["runs"]:
+		return runCronRuns(args, client)
+	}
+
+	list, err := client.CronJobList(mustApp())
+	if err != nil {
+		return err
+	}
+	w := tabWriter()
+	defer w.Flush()
+	listRec(w, "ID", "SCHEDULE", "TYPE", "COMMAND", "POLICY", "LAST SCHEDULED")
+	for _, cj := range list {
+		var last string
+		if cj.LastScheduledAt != nil {
+			last = cj.LastScheduledAt.Local().Format(time.RFC822)
+		}
+		listRec(w, cj.ID, cj.Schedule, cj.ProcessType, strings.Join(cj.Cmd, " "), cj.ConcurrencyPolicy, last)
+	}
+	return nil
+}
+
+func runCronAdd(args *docopt.Args, client *controller.Client) error {
+	cj := &ct.CronJob{
+		AppID:             mustApp(),
+		Schedule:          args.String["<schedule>"],
+		ProcessType:       args.String["--type"],
+		Cmd:               args.All["<command>"].([]string),
+		ConcurrencyPolicy: args.String["--policy"],
+	}
+	if err := client.CreateCronJob(cj); err != nil {
+		return err
+	}
+	log.Printf("Created cron job %s.", cj.ID)
+	return nil
+}
+
+func runCronRuns(args *docopt.Args, client *controller.Client) error {
+	runs, err := client.CronJobRunList(mustApp(), args.String["<id>"])
+	if err != nil {
+		return err
+	}
+	w := tabWriter()
+	defer w.Flush()
+	listRec(w, "SCHEDULED", "STATUS", "JOB", "ERROR")
+	for _, run := range runs {
+		listRec(w, run.ScheduledAt.Local().Format(time.RFC822), run.Status, run.JobID, run.Error)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func init() {
+	register("drain", runDrain, `
+usage: flynn drain
+       flynn drain add [-u <username>] [-p <password>] <url>
+       flynn drain remove <id>
+
+Manage log drains, which the output of the app's jobs is forwarded to as
+syslog messages.
+
+Drain URLs are syslog://host:port, syslog+tls://host:port or https:// URLs.
+Jobs which start after a drain is added or removed use the new drains.
+
+Options:
+   -u, --username <username>  username sent to https drains with basic auth
+   -p, --password <password>  password sent to https drains with basic auth
+
+Commands:
+   With no arguments, shows a list of log drains.
+
+   add     adds a log drain
+   remove  removes a log drain
+
+Examples:
+
+   $ flynn drain add syslog+tls://logs.example.com:6514
+
+   $ flynn drain add -u user -p secret https://logs.example.com/drain
+`)
+}
+
+func runDrain(args *docopt.Args, client *controller.Client) error {
+	switch {
+	case args.Bool["add"]:
+		drain := &ct.LogDrain{
+			AppID:    mustApp(),
+			URL:      args.String["<url>"],
+			Username: args.String["--username"],
+			Password: args.String["--password"],
+		}
+		if err := client.CreateLogDrain(drain); err != nil {
+			return err
+		}
+		log.Printf("Created log drain %s.", drain.ID)
+		return nil
+	case args.Bool["remove"]:
+		return client.DeleteLogDrain(mustApp(), args.String["<id>"])
+	}
+
+	drains, err := client.LogDrainList(mustApp())
+	if err != nil {
+		return err
+	}
+	w := tabWriter()
+	defer w.Flush()
+	listRec(w, "ID", "URL", "CREATED")
+	for _, d := range drains {
+		listRec(w, d.ID, d.URL, d.CreatedAt.Local().Format(time.RFC822))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/heroku/hk/term"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func init() {
+	cmd := register("exec", runExec, `
+usage: flynn exec <job> <command> [<argument>...]
+
+Run a command in the container of a running job, for example a shell to
+debug it. The command runs alongside the job's process with the job's
+environment, and exits without affecting the job.
+
+Examples:
+
+   $ flynn exec host1-0a4f7c9e2b8d4e6f9a1c3b5d7e9f0a2b bash
+   $ flynn exec host1-0a4f7c9e2b8d4e6f9a1c3b5d7e9f0a2b env
+`)
+	cmd.optsFirst = true
+}
+
+func runExec(args *docopt.Args, client *controller.Client) error {
+	req := &ct.JobExec{
+		Cmd: append([]string{args.String["<command>"]}, args.All["<argument>"].([]string)...),
+		TTY: term.IsTerminal(os.Stdin) && term.IsTerminal(os.Stdout),
+	}
+	if req.TTY {
+		cols, err := term.Cols()
+		if err != nil {
+			return err
+		}
+		lines, err := term.Lines()
+		if err != nil {
+			return err
+		}
+		req.Columns = cols
+		req.Lines = lines
+		req.Env = map[string]string{
+			"COLUMNS": strconv.Itoa(cols),
+			"LINES":   strconv.Itoa(lines),
+			"TERM":    os.Getenv("TERM"),
+		}
+	}
+	rwc, err := client.ExecJob(mustApp(), args.String["<job>"], req)
+	if err != nil {
+		return err
+	}
+	return runAttached(rwc, req.TTY)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+)
+
+func init() {
+	register("export", runExport, `
+usage: flynn export [-f <file>]
+
+Export the cluster's apps, artifacts, releases, formations, providers,
+resources and routes as a tar archive of JSON files, for backups or moving
+apps to another cluster.
+
+The archive contains resource credentials, so it should be stored securely.
+
+Options:
+   -f, --file <file>  file to write the archive to (defaults to stdout)
+
+Examples:
+
+   $ flynn export -f flynn-backup.tar
+`)
+}
+
+func runExport(args *docopt.Args, client *controller.Client) error {
+	var dest io.Writer = os.Stdout
+	if name := args.String["--file"]; name != "" {
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dest = f
+	}
+
+	export, err := client.Export()
+	if err != nil {
+		return err
+	}
+	defer export.Close()
+	_, err = io.Copy(dest, export)
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+)
+
+func init() {
+	register("gc", runGC, `
+usage: flynn gc [-k <count>] [-c]
+
+Delete old releases of an app along with their formations and artifacts.
+Releases that are in use are never deleted.
+
+With --cluster, old releases of all apps are deleted, along with artifacts
+that are not used by any release and the files of deleted artifacts and
+releases in the blobstore.
+
+Options:
+  -k, --keep <count>  number of recent releases to keep (defaults to the controller's setting)
+  -c, --cluster       collect all apps and unused artifacts
+`)
+}
+
+func runGC(args *docopt.Args, client *controller.Client) error {
+	var keep int
+	if s := args.String["--keep"]; s != "" {
+		var err error
+		keep, err = strconv.Atoi(s)
+		if err != nil || keep < 1 {
+			return fmt.Errorf("invalid keep count %q", s)
+		}
+	}
+	if args.Bool["--cluster"] {
+		res, err := client.GC(keep)
+		if err != nil {
+			return err
+		}
+		for _, id := range res.DeletedReleases {
+			fmt.Println("release", id)
+		}
+		for _, id := range res.DeletedArtifacts {
+			fmt.Println("artifact", id)
+		}
+		for _, u := range res.DeletedBlobs {
+			fmt.Println("file", u)
+		}
+		log.Printf("Deleted %d releases, %d artifacts and %d files.", len(res.DeletedReleases), len(res.DeletedArtifacts), len(res.DeletedBlobs))
+		return nil
+	}
+	res, err := client.GCApp(mustApp(), keep)
+	if err != nil {
+		return err
+	}
+	for _, id := range res.DeletedReleases {
+		fmt.Println(id)
+	}
+	log.Printf("Deleted %d releases.", len(res.DeletedReleases))
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func init() {
+	register("import", runImport, `
+usage: flynn import [--overwrite] [-f <file>]
+
+Import a cluster export created with 'flynn export', recreating its apps,
+artifacts, releases, formations, providers, resources and routes with the
+same IDs.
+
+Objects which already exist are skipped unless --overwrite is given, in which
+case they are replaced with the exported version.
+
+Options:
+   -f, --file <file>  file to read the archive from (defaults to stdin)
+   --overwrite        overwrite existing objects rather than skipping them
+
+Examples:
+
+   $ FLYNN_CLUSTER=staging flynn export | FLYNN_CLUSTER=production flynn import
+`)
+}
+
+func runImport(args *docopt.Args, client *controller.Client) error {
+	var src io.Reader = os.Stdin
+	if name := args.String["--file"]; name != "" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+	conflicts := ct.ImportConflictSkip
+	if args.Bool["--overwrite"] {
+		conflicts = ct.ImportConflictOverwrite
+	}
+
+	res, err := client.Import(src, conflicts)
+	if err != nil {
+		return err
+	}
+	types := make(map[string]struct{})
+	for _, counts := range []map[string]int{res.Created, res.Updated, res.Skipped} {
+		for typ := range counts {
+			types[typ] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(types))
+	for typ := range types {
+		sorted = append(sorted, typ)
+	}
+	sort.Strings(sorted)
+
+	w := tabWriter()
+	defer w.Flush()
+	listRec(w, "TYPE", "CREATED", "UPDATED", "SKIPPED")
+	for _, typ := range sorted {
+		listRec(w, typ, res.Created[typ], res.Updated[typ], res.Skipped[typ])
+	}
+	log.Printf("Imported %d objects.", sum(res.Created)+sum(res.Updated))
+	return nil
+}
+
+func sum(counts map[string]int) int {
+	var n int
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
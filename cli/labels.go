@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+)
+
+func init() {
+	register("labels", runLabels, `usage: flynn labels
+       flynn labels set <key>=<val>...
+       flynn labels unset <key>...
+
+Manage app labels.
+
+Labels are used to select groups of apps, for example with
+"flynn apps -l env=production".
+
+Commands:
+   With no arguments, shows a list of labels.
+
+   set    Sets value of one or more labels.
+   unset  Deletes one or more labels.
+`)
+}
+
+func runLabels(args *docopt.Args, client *controller.Client) error {
+	if args.Bool["set"] {
+		pairs := args.All["<key>=<val>"].([]string)
+		labels := make(map[string]*string, len(pairs))
+		for _, s := range pairs {
+			v := strings.SplitN(s, "=", 2)
+			if len(v) != 2 {
+				return fmt.Errorf("invalid label format: %q", s)
+			}
+			labels[v[0]] = &v[1]
+		}
+		return setLabels(client, labels)
+	} else if args.Bool["unset"] {
+		keys := args.All["<key>"].([]string)
+		labels := make(map[string]*string, len(keys))
+		for _, k := range keys {
+			labels[k] = nil
+		}
+		return setLabels(client, labels)
+	}
+
+	app, err := client.GetApp(mustApp())
+	if err != nil {
+		return err
+	}
+	labels := make([]string, 0, len(app.Labels))
+	for k, v := range app.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		fmt.Println(l)
+	}
+	return nil
+}
+
+// setLabels updates the app's labels, removing those with a nil value.
+func setLabels(client *controller.Client, changes map[string]*string) error {
+	app, err := client.GetApp(mustApp())
+	if err != nil {
+		return err
+	}
+	labels := make(map[string]string, len(app.Labels)+len(changes))
+	for k, v := range app.Labels {
+		labels[k] = v
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(labels, k)
+		} else {
+			labels[k] = *v
+		}
+	}
+	if _, err := client.UpdateApp(app.ID, &controller.AppUpdate{Labels: labels, ETag: app.ETag}); err != nil {
+		return err
+	}
+	log.Printf("Updated labels of %s.", app.Name)
+	return nil
+}
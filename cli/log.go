@@ -15,6 +15,9 @@ usage: flynn log [options] <job>
 
 Stream log for a specific job.
 
+If the log does not update when following, a proxy may be buffering the
+response. Set FLYNN_LONG_POLL=1 to poll for new output instead.
+
 Options:
     -s, --split-stderr  send stderr lines to stderr
     -f, --follow        stream new lines after printing log buffer
@@ -37,18 +37,32 @@ Commands:
    cluster             manage clusters
    create              create an app
    delete              delete an app
+   undelete            restore a deleted app
+   transfer            transfer ownership of an app
    apps                list apps
    ps                  list jobs
    kill                kill a job
    log                 get job log
    scale               change formation
+   autoscale           manage autoscaling
    run                 run a job
+   exec                run a command in a running job
    env                 manage env variables
+   config              manage app config vars
    route               manage routes
+   cron                manage scheduled jobs
+   drain               manage log drains
+   quota               manage app quotas
    provider            manage resource providers
-   resource            provision a new resource
+   resource            manage resources for the app
    key                 manage SSH public keys
    release             add a docker image release
+   rollback            roll back to a previous release
+   promote             deploy the release to another app
+   gc                  delete old releases
+   export              export cluster state
+   import              import cluster state
+   status              show controller health
    version             show flynn version
 
 See 'flynn help <command>' for more information on a specific command.
@@ -148,6 +162,11 @@ func runCommand(name string, args []string) (err error) {
 		if err != nil {
 			log.Fatal(err)
 		}
+		// long-poll instead of streaming when a proxy between the CLI and
+		// the controller buffers responses
+		if os.Getenv("FLYNN_LONG_POLL") != "" {
+			client.SetLongPoll(true)
+		}
 
 		return f(parsedArgs, client)
 	case func(*docopt.Args) error:
@@ -2,6 +2,7 @@ package main
 
 import (
 	"sort"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/controller/client"
@@ -9,13 +10,25 @@ import (
 )
 
 func init() {
-	register("ps", runPs, `usage: flynn ps
+	register("ps", runPs, `usage: flynn ps [-s] [<job>]
 
 List flynn jobs.
+
+With <job>, shows the job's details including the host running it, its
+exit status and how many times its process has been restarted.
+
+Options:
+  -s, --summary  show the desired and actual number of jobs of each process type
 `)
 }
 
 func runPs(args *docopt.Args, client *controller.Client) error {
+	if id := args.String["<job>"]; id != "" {
+		return runPsJob(id, client)
+	}
+	if args.Bool["--summary"] {
+		return runPsSummary(client)
+	}
 	jobs, err := client.JobList(mustApp())
 	if err != nil {
 		return err
@@ -42,6 +55,69 @@ func runPs(args *docopt.Args, client *controller.Client) error {
 	return nil
 }
 
+func runPsSummary(client *controller.Client) error {
+	processes, err := client.AppProcesses(mustApp())
+	if err != nil {
+		return err
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+
+	listRec(w, "TYPE", "DESIRED", "RUNNING", "PENDING", "CRASHED", "STATUS")
+	for _, p := range processes {
+		status := "converging"
+		if p.Converged() {
+			status = "converged"
+		}
+		listRec(w, p.Type, p.Desired, p.Running, p.Pending, p.Crashed, status)
+	}
+	return nil
+}
+
+func runPsJob(id string, client *controller.Client) error {
+	job, err := client.GetJob(mustApp(), id)
+	if err != nil {
+		return err
+	}
+	if job.Type == "" {
+		job.Type = "run"
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+	listRec(w, "ID:", job.ID)
+	listRec(w, "Type:", job.Type)
+	listRec(w, "Release:", job.ReleaseID)
+	listRec(w, "State:", job.State)
+	listRec(w, "Host:", job.HostID)
+	listRec(w, "Restarts:", job.Restarts)
+	if job.CrashLoop {
+		listRec(w, "Crash Loop:", "yes")
+	}
+	if job.CreatedAt != nil {
+		listRec(w, "Created:", job.CreatedAt.Local().Format(time.RFC822))
+	}
+	if job.HostError != "" {
+		listRec(w, "Host Error:", job.HostError)
+		return nil
+	}
+	listRec(w, "Host Status:", job.HostStatus)
+	if job.StartedAt != nil {
+		listRec(w, "Started:", job.StartedAt.Local().Format(time.RFC822))
+	}
+	if job.EndedAt != nil {
+		listRec(w, "Ended:", job.EndedAt.Local().Format(time.RFC822))
+	}
+	if job.ExitStatus != nil {
+		listRec(w, "Exit Status:", *job.ExitStatus)
+	}
+	if job.Error != "" {
+		listRec(w, "Error:", job.Error)
+	}
+	return nil
+}
+
 type jobsByType []*ct.Job
 
 func (p jobsByType) Len() int           { return len(p) }
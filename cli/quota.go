@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+)
+
+func init() {
+	register("quota", runQuota, `
+usage: flynn quota
+       flynn quota set [--jobs <jobs>] [--memory <memory>] [--routes <routes>]
+
+Manage the quota of the app, which limits the jobs, memory and routes it can
+use. A limit of 0 is unlimited.
+
+Scaling the app over its quota or adding routes beyond it fails, but an app
+which is over a lowered quota keeps running and can still be scaled down.
+Process types must have a memory limit to be scaled up if the app has a
+memory quota.
+
+Options:
+   --jobs <jobs>      maximum number of jobs of all process types
+   --memory <memory>  maximum memory of all jobs in MiB
+   --routes <routes>  maximum number of routes
+
+Commands:
+   With no arguments, shows the quota.
+
+   set  sets the given limits, leaving the others unchanged
+
+Examples:
+
+   $ flynn quota set --jobs 10 --memory 4096
+`)
+}
+
+func runQuota(args *docopt.Args, client *controller.Client) error {
+	quota, err := client.GetAppQuota(mustApp())
+	if err != nil {
+		return err
+	}
+	if !args.Bool["set"] {
+		w := tabWriter()
+		defer w.Flush()
+		listRec(w, "JOBS", "MEMORY", "ROUTES")
+		listRec(w, quotaLimit(quota.MaxJobs, ""), quotaLimit(quota.MaxMemory, " MiB"), quotaLimit(quota.MaxRoutes, ""))
+		return nil
+	}
+
+	for flag, limit := range map[string]*int{
+		"--jobs":   &quota.MaxJobs,
+		"--memory": &quota.MaxMemory,
+		"--routes": &quota.MaxRoutes,
+	} {
+		if s := args.String[flag]; s != "" {
+			if *limit, err = strconv.Atoi(s); err != nil {
+				return err
+			}
+		}
+	}
+	if err := client.UpdateAppQuota(mustApp(), quota); err != nil {
+		return err
+	}
+	log.Printf("Updated the quota of %s.", mustApp())
+	return nil
+}
+
+func quotaLimit(n int, unit string) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(n) + unit
+}
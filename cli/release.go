@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/controller/client"
@@ -14,18 +17,131 @@ import (
 func init() {
 	register("release", runRelease, `
 usage: flynn release add [-t <type>] [-f <file>] <uri>
+       flynn release show [-d <release>] [-r] [<id>]
 
 Manage app releases.
 
 Options:
-   -t <type>          type of the release. Currently only 'docker' is supported. [default: docker]
-   -f, --file <file>  release configuration file
+   -t <type>               type of the release. Currently only 'docker' is supported. [default: docker]
+   -f, --file <file>       release configuration file
+   -d, --diff <release>    show the changes from <release> instead of the release
+   -r, --redact            leave env values out of the changes
 Commands:
    add   add a new release
+   show  show a release, which defaults to the app's current release
 `)
+
+	register("releases", runReleases, `
+usage: flynn releases [<id>]
+
+List the releases of an app, including the commit, time and user of the
+build that created them.
+
+With <id>, shows the release's metadata and annotations.
+`)
+
+	register("rollback", runRollback, `
+usage: flynn rollback [<release>]
+
+Roll the app back to a release, which defaults to the release the app had
+before its current release. The app's processes are moved to the release in
+a single step, which is recorded as a deployment.
+`)
+
+	register("promote", runPromote, `
+usage: flynn promote [-s <strategy>] [-u <vars>] <target> [<var>=<val>...]
+
+Deploy a copy of the app's current release to the target app. The copy uses
+the same artifacts and process types, so promoting from staging to
+production does not rebuild the app. Variables given as <var>=<val> are set
+in the copied release's env.
+
+Options:
+   -s, --strategy <strategy>  deployment strategy of the target app
+   -u, --unset <vars>         comma separated env variables to remove from the copy
+`)
+}
+
+func runPromote(args *docopt.Args, client *controller.Client) error {
+	p := &ct.Promotion{
+		TargetAppID: args.String["<target>"],
+		Strategy:    args.String["--strategy"],
+	}
+	if pairs := args.All["<var>=<val>"].([]string); len(pairs) > 0 {
+		p.Env = make(map[string]string, len(pairs))
+		for _, s := range pairs {
+			v := strings.SplitN(s, "=", 2)
+			if len(v) != 2 {
+				return fmt.Errorf("invalid var format: %q", s)
+			}
+			p.Env[v[0]] = v[1]
+		}
+	}
+	if unset := args.String["--unset"]; unset != "" {
+		p.UnsetEnv = strings.Split(unset, ",")
+	}
+	d, err := client.PromoteApp(mustApp(), p)
+	if err != nil {
+		return err
+	}
+	log.Printf("Created release %s of %s, deployment %s started.", d.NewReleaseID, p.TargetAppID, d.ID)
+	return nil
+}
+
+func runRollback(args *docopt.Args, client *controller.Client) error {
+	d, err := client.RollbackApp(mustApp(), args.String["<release>"])
+	if err != nil {
+		return err
+	}
+	log.Printf("Rolled back from release %s to %s.", d.OldReleaseID, d.NewReleaseID)
+	return nil
+}
+
+func runReleases(args *docopt.Args, client *controller.Client) error {
+	releases, err := client.AppReleaseList(mustApp())
+	if err != nil {
+		return err
+	}
+
+	if id := args.String["<id>"]; id != "" {
+		for _, r := range releases {
+			if r.ID != id {
+				continue
+			}
+			keys := make([]string, 0, len(r.Meta))
+			for k := range r.Meta {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Printf("%s=%s\n", k, r.Meta[k])
+			}
+			return nil
+		}
+		return fmt.Errorf("release %s not found", id)
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+	listRec(w, "ID", "CREATED", "COMMIT", "BUILT BY")
+	for _, r := range releases {
+		var created string
+		if r.CreatedAt != nil {
+			created = r.CreatedAt.Local().Format(time.RFC822)
+		}
+		commit := r.Meta[ct.ReleaseMetaGitCommit]
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+		listRec(w, r.ID, created, commit, r.Meta[ct.ReleaseMetaBuildUser])
+	}
+	return nil
 }
 
 func runRelease(args *docopt.Args, client *controller.Client) error {
+	if args.Bool["show"] {
+		return runReleaseShow(args, client)
+	}
 	if args.Bool["add"] {
 		if args.String["-t"] == "docker" {
 			return runReleaseAddDocker(args, client)
@@ -36,6 +152,86 @@ func runRelease(args *docopt.Args, client *controller.Client) error {
 	return fmt.Errorf("Top-level command not implemented.")
 }
 
+func runReleaseShow(args *docopt.Args, client *controller.Client) error {
+	id := args.String["<id>"]
+	if id == "" {
+		release, err := client.GetAppRelease(mustApp())
+		if err != nil {
+			return err
+		}
+		id = release.ID
+	}
+	if from := args.String["--diff"]; from != "" {
+		diff, err := client.ReleaseDiff(mustApp(), from, id, args.Bool["--redact"])
+		if err != nil {
+			return err
+		}
+		printReleaseDiff(diff)
+		return nil
+	}
+
+	release, err := client.GetRelease(id)
+	if err != nil {
+		return err
+	}
+	w := tabWriter()
+	defer w.Flush()
+	listRec(w, "ID:", release.ID)
+	listRec(w, "Artifacts:", strings.Join(release.ArtifactIDs, ", "))
+	if release.CreatedAt != nil {
+		listRec(w, "Created:", release.CreatedAt.Local().Format(time.RFC822))
+	}
+	keys := make([]string, 0, len(release.Env))
+	for k := range release.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		listRec(w, "Env:", k+"="+release.Env[k])
+	}
+	types := make([]string, 0, len(release.Processes))
+	for t := range release.Processes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		listRec(w, "Process:", t, strings.Join(release.Processes[t].Cmd, " "))
+	}
+	return nil
+}
+
+var diffSigns = map[string]string{
+	ct.DiffAdded:   "+",
+	ct.DiffRemoved: "-",
+	ct.DiffChanged: "~",
+}
+
+func printReleaseDiff(diff *ct.ReleaseDiff) {
+	if diff.ArtifactsChanged {
+		fmt.Println("~ artifacts")
+	}
+	for _, c := range diff.Env {
+		line := diffSigns[c.Op] + " env " + c.Key
+		switch {
+		case c.OldValue == "" && c.NewValue == "":
+		case c.Op == ct.DiffAdded:
+			line += "=" + c.NewValue
+		case c.Op == ct.DiffRemoved:
+			line += "=" + c.OldValue
+		default:
+			line += fmt.Sprintf("=%s -> %s", c.OldValue, c.NewValue)
+		}
+		fmt.Println(line)
+	}
+	for _, c := range diff.Processes {
+		line := diffSigns[c.Op] + " process " + c.Type
+		if len(c.Fields) > 0 {
+			line += " (" + strings.Join(c.Fields, ", ") + ")"
+		}
+		fmt.Println(line)
+	}
+}
+
 func runReleaseAddDocker(args *docopt.Args, client *controller.Client) error {
 	release := &ct.Release{}
 	if args.String["--file"] != "" {
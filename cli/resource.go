@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
 	"github.com/flynn/flynn/controller/client"
@@ -11,25 +12,64 @@ import (
 
 func init() {
 	register("resource", runResource, `
-usage: flynn resource add <provider>
+usage: flynn resource
+       flynn resource add <provider>
+       flynn resource remove <id>
 
 Manage resources for the app.
 
 Commands:
-   add  provisions a new resource for the app using <provider>.
+   With no arguments, shows a list of resources attached to the app.
+
+   add     provisions a new resource for the app using <provider>.
+   remove  deprovisions a resource and removes its variables from the
+           app's environment.
 `)
 }
 
 func runResource(args *docopt.Args, client *controller.Client) error {
-	if args.Bool["add"] {
+	switch {
+	case args.Bool["add"]:
 		return runResourceAdd(args, client)
+	case args.Bool["remove"]:
+		return runResourceRemove(args, client)
+	}
+
+	resources, err := client.AppResourceList(mustApp())
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("Top-level command not implemented.")
+	w := tabWriter()
+	defer w.Flush()
+
+	listRec(w, "ID", "PROVIDER", "CREATED")
+	for _, r := range resources {
+		provider := r.ProviderName
+		if provider == "" {
+			provider = r.ProviderID
+		}
+		var created string
+		if r.CreatedAt != nil {
+			created = r.CreatedAt.Local().Format(time.RFC822)
+		}
+		listRec(w, r.ID, provider, created)
+	}
+	return nil
 }
 
 func runResourceAdd(args *docopt.Args, client *controller.Client) error {
 	provider := args.String["<provider>"]
 
+	// check the provider is up before provisioning so that a down provider
+	// results in a useful error rather than a generic server error, older
+	// controllers without the status endpoint are skipped.
+	status, err := client.ProviderStatus(provider)
+	if err == nil && !status.Reachable {
+		return fmt.Errorf("Provider %s is unavailable: %s", provider, status.Error)
+	} else if err != nil && err != controller.ErrNotFound {
+		return err
+	}
+
 	res, err := client.ProvisionResource(&ct.ResourceReq{ProviderID: provider, Apps: []string{mustApp()}})
 	if err != nil {
 		return err
@@ -50,3 +90,48 @@ func runResourceAdd(args *docopt.Args, client *controller.Client) error {
 
 	return nil
 }
+
+func runResourceRemove(args *docopt.Args, client *controller.Client) error {
+	id := args.String["<id>"]
+	resources, err := client.AppResourceList(mustApp())
+	if err != nil {
+		return err
+	}
+	var res *ct.Resource
+	for _, r := range resources {
+		if r.ID == id {
+			res = r
+			break
+		}
+	}
+	if res == nil {
+		return fmt.Errorf("No resource %s attached to the app.", id)
+	}
+
+	if err := client.DeleteResource(res.ProviderID, res.ID); err != nil {
+		return err
+	}
+
+	// only unset variables which still have the values set by the resource
+	release, err := client.GetAppRelease(mustApp())
+	if err != nil && err != controller.ErrNotFound {
+		return err
+	}
+	env := make(map[string]*string)
+	for k, v := range res.Env {
+		if release != nil && release.Env[k] == v {
+			env[k] = nil
+		}
+	}
+	if len(env) == 0 {
+		log.Printf("Deleted resource %s.", res.ID)
+		return nil
+	}
+
+	releaseID, err := setEnv(client, "", env)
+	if err != nil {
+		return err
+	}
+	log.Printf("Deleted resource %s and created release %s.", res.ID, releaseID)
+	return nil
+}
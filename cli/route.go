@@ -17,8 +17,8 @@ import (
 func init() {
 	register("route", runRoute, `
 usage: flynn route
-       flynn route add http [-s <service>] [-c <tls-cert> -k <tls-key>] [--sticky] <domain>
-       flynn route add tcp [-s <service>]
+       flynn route add http [-s <service>] [-c <tls-cert> -k <tls-key>] [--sticky] [--drain-timeout <seconds>] <domain>
+       flynn route add tcp [-s <service>] [--drain-timeout <seconds>]
        flynn route remove <id>
 
 Manage routes for application.
@@ -28,6 +28,7 @@ Options:
    -c, --tls-cert <tls-cert>  path to PEM encoded certificate for TLS, - for stdin (http only)
    -k, --tls-key <tls-key>    path to PEM encoded private key for TLS, - for stdin (http only)
    --sticky                   enable cookie-based sticky routing (http only)
+   --drain-timeout <seconds>  time given to requests in flight when the route is removed or replaced
 
 Commands:
    With no arguments, shows a list of routes.
@@ -87,19 +88,35 @@ func runRoute(args *docopt.Args, client *controller.Client) error {
 	return nil
 }
 
+// parseDrainTimeout returns the --drain-timeout option, which is zero if it
+// is not set so that the router's default is used.
+func parseDrainTimeout(args *docopt.Args) (int, error) {
+	s := args.String["--drain-timeout"]
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid drain timeout %q", s)
+	}
+	return n, nil
+}
+
 func runRouteAddTCP(args *docopt.Args, client *controller.Client) error {
 	service := args.String["--service"]
 	if service == "" {
 		service = mustApp() + "-web"
 	}
+	drainTimeout, err := parseDrainTimeout(args)
+	if err != nil {
+		return err
+	}
 
-	hr := &router.TCPRoute{Service: service}
-	r := hr.ToRoute()
-	if err := client.CreateRoute(mustApp(), r); err != nil {
+	hr, err := client.CreateTCPRoute(mustApp(), &router.TCPRoute{Service: service, DrainTimeout: drainTimeout})
+	if err != nil {
 		return err
 	}
-	hr = r.TCPRoute()
-	fmt.Printf("%s listening on port %d\n", r.ID, hr.Port)
+	fmt.Printf("%s listening on port %d\n", hr.ID, hr.Port)
 	return nil
 }
 
@@ -111,13 +128,15 @@ func runRouteAddHTTP(args *docopt.Args, client *controller.Client) error {
 	if service == "" {
 		service = mustApp() + "-web"
 	}
+	drainTimeout, err := parseDrainTimeout(args)
+	if err != nil {
+		return err
+	}
 
 	tlsCertPath := args.String["--tls-cert"]
 	tlsKeyPath := args.String["--tls-key"]
 	if tlsCertPath != "" && tlsKeyPath != "" {
 		var stdin []byte
-		var err error
-
 		if tlsCertPath == "-" || tlsKeyPath == "-" {
 			stdin, err = ioutil.ReadAll(os.Stdin)
 			if err != nil {
@@ -137,18 +156,18 @@ func runRouteAddHTTP(args *docopt.Args, client *controller.Client) error {
 		return errors.New("Both the TLS certificate AND private key need to be specified")
 	}
 
-	hr := &router.HTTPRoute{
-		Service: service,
-		Domain:  args.String["<domain>"],
-		TLSCert: string(tlsCert),
-		TLSKey:  string(tlsKey),
-		Sticky:  args.Bool["sticky"],
-	}
-	route := hr.ToRoute()
-	if err := client.CreateRoute(mustApp(), route); err != nil {
+	hr, err := client.CreateHTTPRoute(mustApp(), &router.HTTPRoute{
+		Service:      service,
+		Domain:       args.String["<domain>"],
+		TLSCert:      string(tlsCert),
+		TLSKey:       string(tlsKey),
+		Sticky:       args.Bool["sticky"],
+		DrainTimeout: drainTimeout,
+	})
+	if err != nil {
 		return err
 	}
-	fmt.Println(route.ID)
+	fmt.Println(hr.ID)
 	return nil
 }
 
@@ -87,38 +87,51 @@ func runRun(args *docopt.Args, client *controller.Client) error {
 	if err != nil {
 		return err
 	}
+	return runAttached(rwc, req.TTY)
+}
+
+// runAttached connects the terminal to a job or command using the attach
+// protocol on rwc, and exits with its exit status.
+func runAttached(rwc io.ReadWriteCloser, tty bool) error {
 	defer rwc.Close()
 	attachClient := cluster.NewAttachClient(rwc)
 
-	if req.TTY {
+	if tty {
 		if err := term.MakeRaw(os.Stdin); err != nil {
 			return err
 		}
 		defer term.Restore(os.Stdin)
+		// the job's TTY is resized whenever the terminal is, which sends
+		// SIGWINCH to the job's foreground process
 		go func() {
-			ch := make(chan os.Signal)
+			ch := make(chan os.Signal, 1)
 			signal.Notify(ch, SIGWINCH)
-			<-ch
-			height, err := term.Lines()
-			if err != nil {
-				return
-			}
-			width, err := term.Cols()
-			if err != nil {
-				return
+			for range ch {
+				height, err := term.Lines()
+				if err != nil {
+					continue
+				}
+				width, err := term.Cols()
+				if err != nil {
+					continue
+				}
+				attachClient.ResizeTTY(uint16(height), uint16(width))
 			}
-			attachClient.ResizeTTY(uint16(height), uint16(width))
-			attachClient.Signal(int(SIGWINCH))
 		}()
 	}
 
+	// signals are forwarded to the job as they would be to a local
+	// process, and a job which doesn't exit within 10 seconds of SIGTERM is
+	// killed
 	go func() {
-		ch := make(chan os.Signal)
+		ch := make(chan os.Signal, 1)
 		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-		sig := <-ch
-		attachClient.Signal(int(sig.(syscall.Signal)))
-		time.Sleep(10 * time.Second)
-		attachClient.Signal(int(syscall.SIGKILL))
+		for sig := range ch {
+			attachClient.Signal(int(sig.(syscall.Signal)))
+			if sig == syscall.SIGTERM {
+				time.AfterFunc(10*time.Second, func() { attachClient.Signal(int(syscall.SIGKILL)) })
+			}
+		}
 	}()
 	go func() {
 		io.Copy(attachClient, os.Stdin)
@@ -128,7 +141,7 @@ func runRun(args *docopt.Args, client *controller.Client) error {
 	if err != nil {
 		return err
 	}
-	if req.TTY {
+	if tty {
 		term.Restore(os.Stdin)
 	}
 	os.Exit(exitStatus)
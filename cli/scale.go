@@ -13,12 +13,16 @@ import (
 
 func init() {
 	register("scale", runScale, `
-usage: flynn scale [-r <release>] <type>=<qty>...
+usage: flynn scale [-r <release>] [-f] <type>=<qty>...
 
 Scale changes the number of jobs for each process type in a release.
 
+Process types of protected apps, such as the apps which make up the
+cluster, are only scaled down to zero with --force.
+
 Options:
   -r, --release <release>  id of release to scale (defaults to current app release)
+  -f, --force              scale process types of a protected app to zero
 
 Example:
 
@@ -47,6 +51,7 @@ func runScale(args *docopt.Args, client *controller.Client) error {
 			AppID:     mustApp(),
 			ReleaseID: scaleRelease,
 			Processes: make(map[string]int),
+			StateHash: ct.FormationStateHash(nil, nil),
 		}
 	} else if err != nil {
 		return err
@@ -67,5 +72,16 @@ func runScale(args *docopt.Args, client *controller.Client) error {
 		formation.Processes[arg[:i]] = val
 	}
 
-	return client.PutFormation(formation)
+	put := client.PutFormation
+	if args.Bool["--force"] {
+		put = client.PutFormationForce
+	}
+	// the formation's state hash makes the update fail if the release is
+	// scaled by someone else before it is applied
+	if err := put(formation); err == controller.ErrConflict || err == controller.ErrPreconditionFailed {
+		return errors.New("The formation was changed by another request, check it and try again")
+	} else if err != nil {
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+)
+
+func init() {
+	register("stats", runStats, `usage: flynn stats [<job>...]
+
+Show the resource usage of the app's running jobs, or of the given jobs.
+
+CPU is the percentage of one CPU used over the last second, NET I/O and
+BLOCK I/O are the totals received/sent and read/written since the job started.
+DISK is the size of the files written to the filesystem of jobs with a disk
+quota.
+
+Example:
+
+	$ flynn stats
+	ID                                                                     TYPE  CPU    MEMORY / LIMIT       NET I/O            BLOCK I/O      DISK / QUOTA
+	ca5e8e7e-fc9b-4ab5-a9e3-c38c3e4e7b24-7a2d6e50fe9a4e1fa8d4b0c4a4c7b2a1  web   2.50%  24.0 MiB / 1.0 GiB  1.2 MiB / 3.4 MiB  0 B / 4.0 KiB  8.0 KiB / 512.0 MiB
+`)
+}
+
+func runStats(args *docopt.Args, client *controller.Client) error {
+	app := mustApp()
+	ids := args.All["<job>"].([]string)
+	jobTypes := make(map[string]string, len(ids))
+	if len(ids) == 0 {
+		jobs, err := client.JobList(app)
+		if err != nil {
+			return err
+		}
+		sort.Sort(jobsByType(jobs))
+		for _, j := range jobs {
+			if j.State != "up" {
+				continue
+			}
+			ids = append(ids, j.ID)
+			jobTypes[j.ID] = jobType(j)
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+	}
+
+	// CPU usage is a counter, so it is sampled twice to calculate the
+	// percentage used
+	before, err := jobStats(client, app, ids)
+	if err != nil {
+		return err
+	}
+	time.Sleep(time.Second)
+	after, err := jobStats(client, app, ids)
+	if err != nil {
+		return err
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+	listRec(w, "ID", "TYPE", "CPU", "MEMORY / LIMIT", "NET I/O", "BLOCK I/O", "DISK / QUOTA")
+	for i, id := range ids {
+		a, b := after[i], before[i]
+		var cpu float64
+		if elapsed := a.Time.Sub(b.Time); elapsed > 0 && a.CPU.UsageNanoseconds >= b.CPU.UsageNanoseconds {
+			cpu = float64(a.CPU.UsageNanoseconds-b.CPU.UsageNanoseconds) / float64(elapsed) * 100
+		}
+		listRec(w,
+			id,
+			jobTypes[id],
+			fmt.Sprintf("%.2f%%", cpu),
+			formatBytes(a.Memory.Usage)+" / "+formatMemoryLimit(a.Memory.Limit),
+			formatBytes(a.Network.RxBytes)+" / "+formatBytes(a.Network.TxBytes),
+			formatBytes(a.BlockIO.ReadBytes)+" / "+formatBytes(a.BlockIO.WriteBytes),
+			formatDisk(a.Disk),
+		)
+	}
+	return nil
+}
+
+func jobStats(client *controller.Client, app string, ids []string) ([]*host.JobStats, error) {
+	stats := make([]*host.JobStats, len(ids))
+	for i, id := range ids {
+		s, err := client.JobStats(app, id)
+		if err != nil {
+			return nil, fmt.Errorf("error getting the stats of job %s: %s", id, err)
+		}
+		stats[i] = s
+	}
+	return stats, nil
+}
+
+func jobType(j *ct.Job) string {
+	if j.Type == "" {
+		return "run"
+	}
+	return j.Type
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
+
+// formatMemoryLimit formats the memory limit of a cgroup, which is near the
+// maximum int64 if the job has no limit.
+func formatMemoryLimit(n uint64) string {
+	if n == 0 || n >= 1<<60 {
+		return "unlimited"
+	}
+	return formatBytes(n)
+}
+
+func formatDisk(s host.DiskStats) string {
+	if s.Limit == 0 {
+		return "-"
+	}
+	return formatBytes(s.Usage) + " / " + formatBytes(s.Limit)
+}
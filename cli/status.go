@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func init() {
+	register("status", runStatus, `
+usage: flynn status
+
+Show the result of the controller's health checks, which check its database
+connection and replication, its schema version and its registration in
+discoverd. The command fails if any check fails.
+`)
+}
+
+func runStatus(args *docopt.Args, client *controller.Client) error {
+	health, err := client.GetHealth()
+	if err != nil {
+		return err
+	}
+
+	w := tabWriter()
+	listRec(w, "CHECK", "STATUS", "MESSAGE")
+	for _, c := range health.Checks {
+		listRec(w, c.Name, c.Status, c.Message)
+	}
+	w.Flush()
+
+	if health.Status == ct.HealthFailed {
+		return errors.New("the controller is unhealthy")
+	}
+	return nil
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
@@ -17,40 +21,68 @@ import (
 type AppRepo struct {
 	router        routerc.Client
 	defaultDomain string
+	// retention is how long deleted apps can be restored.
+	retention time.Duration
 
 	db *DB
 }
 
 func NewAppRepo(db *DB, defaultDomain string, router routerc.Client) *AppRepo {
-	return &AppRepo{db: db, defaultDomain: defaultDomain, router: router}
+	return &AppRepo{db: db, defaultDomain: defaultDomain, router: router, retention: defaultAppRetention}
 }
 
 var appNamePattern = regexp.MustCompile(`^[a-z\d]+(-[a-z\d]+)*$`)
 
 func (r *AppRepo) Add(data interface{}) error {
 	app := data.(*ct.App)
+	if err := insertApp(r.db, app); err != nil {
+		return err
+	}
+	r.createDefaultRoute(app)
+	return nil
+}
+
+// AddAs creates the app, which is owned by the auth token which created it
+// unless another owner is given.
+func (r *AppRepo) AddAs(data interface{}, actor string) error {
+	app := data.(*ct.App)
+	if app.Owner == "" && strings.HasPrefix(actor, "token:") {
+		app.Owner = strings.TrimPrefix(actor, "token:")
+	}
+	return r.Add(app)
+}
+
+func insertApp(db rowQueryer, app *ct.App) error {
 	if app.Name == "" {
 		var nameID uint32
-		if err := r.db.QueryRow("SELECT nextval('name_ids')").Scan(&nameID); err != nil {
+		if err := db.QueryRow("SELECT nextval('name_ids')").Scan(&nameID); err != nil {
 			return err
 		}
 		app.Name = name.Get(nameID)
 	}
 	if len(app.Name) > 100 || !appNamePattern.MatchString(app.Name) {
-		return ct.ValidationError{Field: "name", Message: "is invalid"}
+		return ct.ValidationError{Field: "name", Code: ct.ValidationCodeInvalidFormat, Message: fmt.Sprintf("must match %s", appNamePattern)}
 	}
 	if app.ID == "" {
 		app.ID = random.UUID()
 	}
-	var meta hstore.Hstore
-	if len(app.Meta) > 0 {
-		meta.Map = make(map[string]sql.NullString, len(app.Meta))
-		for k, v := range app.Meta {
-			meta.Map[k] = sql.NullString{String: v, Valid: true}
+	var owner *string
+	if app.Owner != "" {
+		if err := checkTokenExists(db, "owner", app.Owner); err != nil {
+			return err
 		}
+		app.Owner = cleanUUID(app.Owner)
+		owner = &app.Owner
 	}
-	err := r.db.QueryRow("INSERT INTO apps (app_id, name, protected, meta) VALUES ($1, $2, $3, $4) RETURNING created_at, updated_at", app.ID, app.Name, app.Protected, meta).Scan(&app.CreatedAt, &app.UpdatedAt)
+	err := db.QueryRow("INSERT INTO apps (app_id, name, protected, meta, labels, owner_id) VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at, updated_at, version", app.ID, app.Name, app.Protected, stringHstore(app.Meta), stringHstore(app.Labels), owner).Scan(&app.CreatedAt, &app.UpdatedAt, &app.Version)
 	app.ID = cleanUUID(app.ID)
+	if err != nil {
+		return err
+	}
+	return createEvent(db, app.ID, ct.EventTypeApp, app.ID, app)
+}
+
+func (r *AppRepo) createDefaultRoute(app *ct.App) {
 	if !app.Protected && r.defaultDomain != "" {
 		route := (&router.HTTPRoute{
 			Domain:  fmt.Sprintf("%s.%s", app.Name, r.defaultDomain),
@@ -61,23 +93,102 @@ func (r *AppRepo) Add(data interface{}) error {
 			log.Printf("Error creating default route for %s: %s", app.Name, err)
 		}
 	}
-	return err
 }
 
+// AddComplete creates the app, artifact, release and formation in data in a
+// single transaction, the app's release is set to the new release.
+func (r *AppRepo) AddComplete(data *ct.AppComplete) error {
+	if data.App == nil {
+		return ct.ValidationError{Field: "app", Message: "must be set"}
+	}
+	if data.Formation != nil && data.Release == nil {
+		return ct.ValidationError{Field: "release", Message: "must be set when creating a formation"}
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := insertApp(tx, data.App); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if data.Artifact != nil {
+		if err := findOrInsertArtifact(tx, data.Artifact); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if data.Release != nil {
+		if data.Artifact != nil {
+			data.Release.ArtifactID = data.Artifact.ID
+		}
+		if err := insertRelease(tx, data.Release); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := updateAppRelease(tx, data.App.ID, data.Release.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if data.Formation != nil {
+		data.Formation.AppID = data.App.ID
+		data.Formation.ReleaseID = data.Release.ID
+		if err := insertFormation(tx, data.Formation); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	r.createDefaultRoute(data.App)
+	return nil
+}
+
+// stringHstore converts m to an hstore, an empty map is stored as NULL.
+func stringHstore(m map[string]string) hstore.Hstore {
+	var h hstore.Hstore
+	if len(m) > 0 {
+		h.Map = make(map[string]sql.NullString, len(m))
+		for k, v := range m {
+			h.Map[k] = sql.NullString{String: v, Valid: true}
+		}
+	}
+	return h
+}
+
+func hstoreStrings(h hstore.Hstore) map[string]string {
+	if len(h.Map) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(h.Map))
+	for k, v := range h.Map {
+		m[k] = v.String
+	}
+	return m
+}
+
+const appColumns = "app_id, name, protected, meta, labels, created_at, updated_at, version, maintenance, maintenance_started_at, maintenance_ended_at, owner_id, pending_owner_id"
+
 func scanApp(s Scanner) (*ct.App, error) {
 	app := &ct.App{}
-	var meta hstore.Hstore
-	err := s.Scan(&app.ID, &app.Name, &app.Protected, &meta, &app.CreatedAt, &app.UpdatedAt)
+	var meta, labels hstore.Hstore
+	var owner, pendingOwner *string
+	err := s.Scan(&app.ID, &app.Name, &app.Protected, &meta, &labels, &app.CreatedAt, &app.UpdatedAt, &app.Version, &app.Maintenance, &app.MaintenanceStartedAt, &app.MaintenanceEndedAt, &owner, &pendingOwner)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
-	if len(meta.Map) > 0 {
-		app.Meta = make(map[string]string, len(meta.Map))
-		for k, v := range meta.Map {
-			app.Meta[k] = v.String
-		}
-	}
+	app.Meta = hstoreStrings(meta)
+	app.Labels = hstoreStrings(labels)
 	app.ID = cleanUUID(app.ID)
+	if owner != nil {
+		app.Owner = cleanUUID(*owner)
+	}
+	if pendingOwner != nil {
+		app.PendingOwner = cleanUUID(*pendingOwner)
+	}
 	return app, err
 }
 
@@ -89,7 +200,7 @@ type rowQueryer interface {
 
 func selectApp(db rowQueryer, id string, update bool) (*ct.App, error) {
 	var row Scanner
-	query := "SELECT app_id, name, protected, meta, created_at, updated_at FROM apps WHERE deleted_at IS NULL AND "
+	query := "SELECT " + appColumns + " FROM apps WHERE deleted_at IS NULL AND "
 	var suffix string
 	if update {
 		suffix = " FOR UPDATE"
@@ -116,6 +227,14 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 		tx.Rollback()
 		return nil, err
 	}
+	if v, ok := data["version"]; ok && v != nil {
+		// the app row is locked, so the version cannot change before the
+		// update is committed
+		if version, ok := v.(float64); !ok || int64(version) != app.Version {
+			tx.Rollback()
+			return nil, ErrConflict
+		}
+	}
 
 	for k, v := range data {
 		switch k {
@@ -132,14 +251,35 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 				}
 				app.Protected = protected
 			}
+		case "maintenance":
+			maintenance, ok := v.(bool)
+			if !ok {
+				tx.Rollback()
+				return nil, fmt.Errorf("controller: expected bool, got %T", v)
+			}
+			if app.Maintenance != maintenance {
+				// the start of maintenance mode clears the end of the previous
+				// one, so both timestamps are only set once it is over
+				query := "UPDATE apps SET maintenance = true, maintenance_started_at = now(), maintenance_ended_at = NULL, updated_at = now() WHERE app_id = $1 RETURNING maintenance_started_at, maintenance_ended_at"
+				if !maintenance {
+					query = "UPDATE apps SET maintenance = false, maintenance_ended_at = now(), updated_at = now() WHERE app_id = $1 RETURNING maintenance_started_at, maintenance_ended_at"
+				}
+				if err := tx.QueryRow(query, app.ID).Scan(&app.MaintenanceStartedAt, &app.MaintenanceEndedAt); err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+				app.Maintenance = maintenance
+				if err := r.setRoutesMaintenance(app); err != nil {
+					tx.Rollback()
+					return nil, err
+				}
+			}
 		case "meta":
 			data, ok := v.(map[string]interface{})
 			if !ok {
 				tx.Rollback()
 				return nil, fmt.Errorf("controller: expected map[string]interface{}, got %T", v)
 			}
-			var meta hstore.Hstore
-			meta.Map = make(map[string]sql.NullString, len(data))
 			app.Meta = make(map[string]string, len(data))
 			for k, v := range data {
 				s, ok := v.(string)
@@ -147,53 +287,311 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 					tx.Rollback()
 					return nil, fmt.Errorf("controller: expected string, got %T", v)
 				}
-				meta.Map[k] = sql.NullString{String: s, Valid: true}
 				app.Meta[k] = s
 			}
-			if _, err := tx.Exec("UPDATE apps SET meta = $2, updated_at = now() WHERE app_id = $1", app.ID, meta); err != nil {
+			if _, err := tx.Exec("UPDATE apps SET meta = $2, updated_at = now() WHERE app_id = $1", app.ID, stringHstore(app.Meta)); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		case "labels":
+			data, ok := v.(map[string]interface{})
+			if !ok {
+				tx.Rollback()
+				return nil, fmt.Errorf("controller: expected map[string]interface{}, got %T", v)
+			}
+			app.Labels = make(map[string]string, len(data))
+			for k, v := range data {
+				s, ok := v.(string)
+				if !ok {
+					tx.Rollback()
+					return nil, fmt.Errorf("controller: expected string, got %T", v)
+				}
+				app.Labels[k] = s
+			}
+			if _, err := tx.Exec("UPDATE apps SET labels = $2, updated_at = now() WHERE app_id = $1", app.ID, stringHstore(app.Labels)); err != nil {
 				tx.Rollback()
 				return nil, err
 			}
 		}
 	}
 
+	if err := tx.QueryRow("UPDATE apps SET version = version + 1 WHERE app_id = $1 RETURNING version, updated_at", app.ID).Scan(&app.Version, &app.UpdatedAt); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := createEvent(tx, app.ID, ct.EventTypeApp, app.ID, app); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 	return app, tx.Commit()
 }
 
-func (r *AppRepo) Remove(id string) error {
-	tx, err := r.db.Begin()
+// setRoutesMaintenance updates the app's HTTP routes so the router serves
+// its maintenance page while the app is in maintenance mode.
+func (r *AppRepo) setRoutesMaintenance(app *ct.App) error {
+	routes, err := r.router.ListRoutes(routeParentRef(app))
 	if err != nil {
 		return err
 	}
+	for _, route := range routes {
+		if route.Type != "http" {
+			continue
+		}
+		httpRoute := route.HTTPRoute()
+		if httpRoute.Maintenance == app.Maintenance {
+			continue
+		}
+		httpRoute.Maintenance = app.Maintenance
+		if err := r.router.SetRoute(httpRoute.ToRoute()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes the app, it refuses to delete a protected app or an app
+// which has routes, scaled up formations, resources or cron jobs. The app's
+// log drains are always deleted with it.
+func (r *AppRepo) Remove(id string) error {
+	return r.remove(id, false)
+}
 
-	if !idPattern.MatchString(id) {
-		app, err := selectApp(r.db, id, false)
+// RemoveForce deletes the app, even if it is protected, along with its
+// routes, formations, resources and cron jobs. Resources which are not used
+// by other apps are deleted, and are deprovisioned by their provider once the
+// app can no longer be restored (see PurgeTombstones), as deprovisioning
+// them now would leave an undeleted app without its data.
+func (r *AppRepo) RemoveForce(id string) error {
+	return r.remove(id, true)
+}
+
+// appDependents are the objects which belong to an app and are deleted with
+// it.
+type appDependents struct {
+	routes     []*router.Route
+	formations []*ct.Formation
+	resources  []string
+	cronJobs   []string
+}
+
+// blocking returns descriptions of the dependents which prevent the app
+// being deleted without force. Formations which are not scaled up do not.
+func (d *appDependents) blocking() []string {
+	var res []string
+	if len(d.routes) > 0 {
+		ids := make([]string, len(d.routes))
+		for i, route := range d.routes {
+			ids[i] = route.ID
+		}
+		res = append(res, "routes "+strings.Join(ids, ", "))
+	}
+	var releases []string
+	for _, f := range d.formations {
+		if len(f.Processes) > 0 {
+			releases = append(releases, f.ReleaseID)
+		}
+	}
+	if len(releases) > 0 {
+		res = append(res, "formations of releases "+strings.Join(releases, ", "))
+	}
+	if len(d.resources) > 0 {
+		res = append(res, "resources "+strings.Join(d.resources, ", "))
+	}
+	if len(d.cronJobs) > 0 {
+		res = append(res, "cron jobs "+strings.Join(d.cronJobs, ", "))
+	}
+	return res
+}
+
+func (r *AppRepo) dependents(tx *dbTx, app *ct.App) (*appDependents, error) {
+	d := &appDependents{}
+	routes, err := r.router.ListRoutes(routeParentRef(app))
+	if err != nil {
+		return nil, err
+	}
+	d.routes = routes
+
+	rows, err := tx.Query("SELECT "+formationColumns+" FROM formations WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at", app.ID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		f, err := scanFormation(rows)
 		if err != nil {
-			return err
+			rows.Close()
+			return nil, err
+		}
+		d.formations = append(d.formations, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, q := range []struct {
+		query string
+		ids   *[]string
+	}{
+		{"SELECT resource_id FROM app_resources WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at", &d.resources},
+		{"SELECT cron_job_id FROM cron_jobs WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at", &d.cronJobs},
+	} {
+		rows, err := tx.Query(q.query, app.ID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			*q.ids = append(*q.ids, cleanUUID(id))
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
 		}
-		id = app.ID
 	}
-	_, err = tx.Exec("UPDATE apps SET deleted_at = now() WHERE app_id = $1 AND deleted_at IS NULL", id)
+	return d, nil
+}
+
+func (r *AppRepo) remove(id string, force bool) error {
+	tx, err := r.db.Begin()
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
-	_, err = tx.Exec("UPDATE formations SET deleted_at = now(), processes = NULL, updated_at = now() WHERE app_id = $1 AND deleted_at IS NULL", id)
+	app, err := selectApp(tx, id, true)
+	if err == ErrNotFound {
+		tx.Rollback()
+		return nil
+	} else if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if app.Protected && !force {
+		tx.Rollback()
+		return ct.ValidationError{Field: "protected", Message: "app is protected, use force to delete it"}
+	}
+	d, err := r.dependents(tx, app)
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
-	_, err = tx.Exec("UPDATE app_resources SET deleted_at = now() WHERE app_id = $1 AND deleted_at IS NULL", id)
+	if blocking := d.blocking(); len(blocking) > 0 && !force {
+		tx.Rollback()
+		return ct.ValidationError{Message: fmt.Sprintf("app has %s, use force to delete them", strings.Join(blocking, "; "))}
+	}
+
+	tombstone, err := json.Marshal(newAppTombstone(d))
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
+	if _, err := tx.Exec("UPDATE apps SET deleted_at = now(), tombstone = $2 WHERE app_id = $1", app.ID, tombstone); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := createEvent(tx, app.ID, ct.EventTypeAppDeletion, app.ID, &ct.App{ID: app.ID, Name: app.Name}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, f := range d.formations {
+		if _, err := tx.Exec("UPDATE formations SET deleted_at = now(), processes = NULL, updated_at = now() WHERE app_id = $1 AND release_id = $2", app.ID, f.ReleaseID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		f.Processes = nil
+		if err := createEvent(tx, app.ID, ct.EventTypeFormation, app.ID+":"+f.ReleaseID, f); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// resources left without apps get the app's deleted_at time, which is
+	// how PurgeTombstones finds them to deprovision
+	for _, resourceID := range d.resources {
+		if _, err := tx.Exec("UPDATE app_resources SET deleted_at = now() WHERE app_id = $1 AND resource_id = $2 AND deleted_at IS NULL", app.ID, resourceID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("UPDATE resources SET deleted_at = now() WHERE resource_id = $1 AND deleted_at IS NULL AND NOT EXISTS (SELECT 1 FROM app_resources WHERE resource_id = $1 AND deleted_at IS NULL)", resourceID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := createEvent(tx, app.ID, ct.EventTypeResourceDeletion, resourceID, &ct.Resource{ID: resourceID, Apps: []string{app.ID}}); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, cronJobID := range d.cronJobs {
+		if _, err := tx.Exec("UPDATE cron_jobs SET deleted_at = now() WHERE cron_job_id = $1", cronJobID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := createEvent(tx, app.ID, ct.EventTypeCronJobDeletion, cronJobID, &ct.CronJob{ID: cronJobID, AppID: app.ID}); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE log_drains SET deleted_at = now() WHERE app_id = $1 AND deleted_at IS NULL", app.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// routes are deleted last so that a failure leaves the app in place to
+	// be deleted again, rather than orphaning the remaining routes
+	for _, route := range d.routes {
+		if err := r.router.DeleteRoute(route.ID); err != nil && err != routerc.ErrNotFound {
+			tx.Rollback()
+			return err
+		}
+		if err := createEvent(tx, app.ID, ct.EventTypeRouteDeletion, route.ID, route); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 	return tx.Commit()
 }
 
 func (r *AppRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT app_id, name, protected, meta, created_at, updated_at FROM apps WHERE deleted_at IS NULL ORDER BY created_at DESC")
+	return r.listSelector(nil, &listQuery{sort: "created_at", desc: true})
+}
+
+// ListQuery lists the apps matching the label selector in the selector
+// query parameter, sorted and filtered by the list parameters (apps can be
+// sorted by name, created_at or updated_at).
+func (r *AppRepo) ListQuery(query url.Values) (interface{}, error) {
+	sel, err := ct.ParseLabelSelector(query.Get("selector"))
+	if err != nil {
+		return nil, ct.ValidationError{Field: "selector", Message: err.Error()}
+	}
+	q, err := parseListQuery(query, "name", "created_at", "updated_at")
+	if err != nil {
+		return nil, err
+	}
+	return r.listSelector(sel, q)
+}
+
+func (r *AppRepo) listSelector(sel ct.LabelSelector, q *listQuery) ([]*ct.App, error) {
+	query := "SELECT " + appColumns + " FROM apps WHERE deleted_at IS NULL"
+	var args []interface{}
+	query += q.where("name", &args)
+	for _, req := range sel {
+		args = append(args, req.Key)
+		key := fmt.Sprintf("$%d", len(args))
+		switch req.Op {
+		case ct.LabelOpEquals:
+			args = append(args, req.Value)
+			query += fmt.Sprintf(" AND labels -> %s = $%d", key, len(args))
+		case ct.LabelOpNotEquals:
+			args = append(args, req.Value)
+			query += fmt.Sprintf(" AND (labels -> %s) IS DISTINCT FROM $%d", key, len(args))
+		case ct.LabelOpExists:
+			query += fmt.Sprintf(" AND exist(labels, %s)", key)
+		case ct.LabelOpNotExists:
+			query += fmt.Sprintf(" AND NOT COALESCE(exist(labels, %s), false)", key)
+		}
+	}
+	rows, err := r.db.Query(query+q.orderBy(), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -210,10 +608,40 @@ func (r *AppRepo) List() (interface{}, error) {
 }
 
 func (r *AppRepo) SetRelease(appID string, releaseID string) error {
-	return r.db.Exec("UPDATE apps SET release_id = $2, updated_at = now() WHERE app_id = $1", appID, releaseID)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := updateAppRelease(tx, appID, releaseID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateAppRelease sets the current release of the app and records an
+// app_release event, db should be a transaction as the app row is locked to
+// read its previous release.
+func updateAppRelease(db rowQueryer, appID, releaseID string) error {
+	var prevID *string
+	if err := db.QueryRow("SELECT release_id FROM apps WHERE app_id = $1 FOR UPDATE", appID).Scan(&prevID); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return err
+	}
+	var updated string
+	if err := db.QueryRow("UPDATE apps SET release_id = $2, updated_at = now(), version = version + 1 WHERE app_id = $1 RETURNING app_id", appID, releaseID).Scan(&updated); err != nil {
+		return err
+	}
+	e := &ct.AppReleaseEvent{ReleaseID: cleanUUID(releaseID)}
+	if prevID != nil {
+		e.PrevReleaseID = cleanUUID(*prevID)
+	}
+	return createEvent(db, appID, ct.EventTypeAppRelease, appID, e)
 }
 
 func (r *AppRepo) GetRelease(id string) (*ct.Release, error) {
-	row := r.db.QueryRow("SELECT r.release_id, r.artifact_id, r.data, r.created_at FROM apps a JOIN releases r USING (release_id) WHERE a.app_id = $1", id)
+	row := r.db.QueryRow("SELECT "+releaseColumns+" FROM releases WHERE release_id = (SELECT release_id FROM apps WHERE app_id = $1)", id)
 	return scanRelease(row)
 }
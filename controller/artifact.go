@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"net/url"
+	"regexp"
+
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
 	ct "github.com/flynn/flynn/controller/types"
@@ -15,42 +19,148 @@ func NewArtifactRepo(db *DB) *ArtifactRepo {
 	return &ArtifactRepo{db}
 }
 
+// validateArtifact checks the size and checksum of the artifact. If the
+// checksum is not set it is taken from the image ID in the URI, which docker
+// artifacts created by the receiver include.
+func validateArtifact(a *ct.Artifact) error {
+	if a.Size < 0 {
+		return ct.ValidationError{Field: "size", Message: "must not be negative"}
+	}
+	if a.SHA256 == "" {
+		if u, err := url.Parse(a.URI); err == nil && checksumPattern.MatchString(u.Query().Get("id")) {
+			a.SHA256 = u.Query().Get("id")
+		}
+	}
+	return nil
+}
+
+var checksumPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
 func (r *ArtifactRepo) Add(data interface{}) error {
 	a := data.(*ct.Artifact)
-	// TODO: actually validate
+	if err := validateArtifact(a); err != nil {
+		return err
+	}
 	if a.ID == "" {
 		a.ID = random.UUID()
 	}
-	err := r.db.QueryRow("INSERT INTO artifacts (artifact_id, type, uri) VALUES ($1, $2, $3) RETURNING created_at",
-		a.ID, a.Type, a.URI).Scan(&a.CreatedAt)
+	err := r.db.QueryRow("INSERT INTO artifacts (artifact_id, type, uri, size, sha256) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		a.ID, a.Type, a.URI, nullInt64(a.Size), nullString(a.SHA256)).Scan(&a.CreatedAt)
 	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
-		err = r.db.QueryRow("SELECT artifact_id, created_at FROM artifacts WHERE type = $1 AND uri = $2",
-			a.Type, a.URI).Scan(&a.ID, &a.CreatedAt)
-		if err != nil {
-			return err
+		err = mergeArtifact(r.db, a)
+	}
+	a.ID = cleanUUID(a.ID)
+	return err
+}
+
+// findOrInsertArtifact is like Add but can be used in a transaction, where a
+// failed insert would abort the transaction.
+func findOrInsertArtifact(db rowQueryer, a *ct.Artifact) error {
+	if err := validateArtifact(a); err != nil {
+		return err
+	}
+	err := mergeArtifact(db, a)
+	if err == ErrNotFound {
+		if a.ID == "" {
+			a.ID = random.UUID()
 		}
+		err = db.QueryRow("INSERT INTO artifacts (artifact_id, type, uri, size, sha256) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+			a.ID, a.Type, a.URI, nullInt64(a.Size), nullString(a.SHA256)).Scan(&a.CreatedAt)
 	}
 	a.ID = cleanUUID(a.ID)
 	return err
 }
 
+// mergeArtifact loads the existing artifact with the same type and URI into
+// a. The existing artifact's size and checksum are filled in from a if they
+// are not set, a checksum which differs from the existing one is an error.
+func mergeArtifact(db rowQueryer, a *ct.Artifact) error {
+	existing, err := scanArtifact(db.QueryRow("SELECT artifact_id, type, uri, size, sha256, created_at FROM artifacts WHERE type = $1 AND uri = $2 AND deleted_at IS NULL",
+		a.Type, a.URI))
+	if err != nil {
+		return err
+	}
+	if a.SHA256 != "" && existing.SHA256 != "" && a.SHA256 != existing.SHA256 {
+		return ct.ValidationError{Field: "sha256", Message: fmt.Sprintf("does not match the checksum of existing artifact %s", existing.ID)}
+	}
+	if (a.Size != 0 && existing.Size == 0) || (a.SHA256 != "" && existing.SHA256 == "") {
+		var size *int64
+		var sha256 *string
+		err := db.QueryRow("UPDATE artifacts SET size = COALESCE(size, $2), sha256 = COALESCE(sha256, $3) WHERE artifact_id = $1 RETURNING size, sha256",
+			existing.ID, nullInt64(a.Size), nullString(a.SHA256)).Scan(&size, &sha256)
+		if err != nil {
+			return err
+		}
+		existing.Size, existing.SHA256 = derefInt64(size), derefString(sha256)
+	}
+	*a = *existing
+	return nil
+}
+
+func nullInt64(n int64) *int64 {
+	if n == 0 {
+		return nil
+	}
+	return &n
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func derefInt64(n *int64) int64 {
+	if n == nil {
+		return 0
+	}
+	return *n
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
 func scanArtifact(s Scanner) (*ct.Artifact, error) {
 	artifact := &ct.Artifact{}
-	err := s.Scan(&artifact.ID, &artifact.Type, &artifact.URI, &artifact.CreatedAt)
+	var size *int64
+	var sha256 *string
+	err := s.Scan(&artifact.ID, &artifact.Type, &artifact.URI, &size, &sha256, &artifact.CreatedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
 	artifact.ID = cleanUUID(artifact.ID)
+	artifact.Size, artifact.SHA256 = derefInt64(size), derefString(sha256)
 	return artifact, err
 }
 
 func (r *ArtifactRepo) Get(id string) (interface{}, error) {
-	row := r.db.QueryRow("SELECT artifact_id, type, uri, created_at FROM artifacts WHERE artifact_id = $1 AND deleted_at IS NULL", id)
+	row := r.db.QueryRow("SELECT artifact_id, type, uri, size, sha256, created_at FROM artifacts WHERE artifact_id = $1 AND deleted_at IS NULL", id)
 	return scanArtifact(row)
 }
 
 func (r *ArtifactRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT artifact_id, type, uri, created_at FROM artifacts WHERE deleted_at IS NULL ORDER BY created_at DESC")
+	return r.list(&listQuery{sort: "created_at", desc: true})
+}
+
+// ListQuery lists the artifacts sorted and filtered by the list parameters,
+// artifacts can be sorted by created_at, type, uri or size.
+func (r *ArtifactRepo) ListQuery(query url.Values) (interface{}, error) {
+	q, err := parseListQuery(query, "created_at", "type", "uri", "size")
+	if err != nil {
+		return nil, err
+	}
+	return r.list(q)
+}
+
+func (r *ArtifactRepo) list(q *listQuery) ([]*ct.Artifact, error) {
+	var args []interface{}
+	where := q.where("", &args)
+	rows, err := r.db.Query("SELECT artifact_id, type, uri, size, sha256, created_at FROM artifacts WHERE deleted_at IS NULL"+where+q.orderBy(), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -63,5 +173,46 @@ func (r *ArtifactRepo) List() (interface{}, error) {
 		}
 		artifacts = append(artifacts, artifact)
 	}
+	return artifacts, rows.Err()
+}
+
+// ReleaseArtifacts returns the artifacts of the release in order, the first
+// is the release's primary artifact.
+func (r *ArtifactRepo) ReleaseArtifacts(release *ct.Release) ([]*ct.Artifact, error) {
+	ids := release.ArtifactIDs
+	if len(ids) == 0 {
+		ids = []string{release.ArtifactID}
+	}
+	artifacts := make([]*ct.Artifact, len(ids))
+	for i, id := range ids {
+		data, err := r.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		artifacts[i] = data.(*ct.Artifact)
+	}
 	return artifacts, nil
 }
+
+// Remove deletes the artifact, it refuses to delete an artifact which is used
+// by a release.
+func (r *ArtifactRepo) Remove(id string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	var releaseID string
+	err = tx.QueryRow("SELECT release_id FROM release_artifacts JOIN releases USING (release_id) WHERE release_artifacts.artifact_id = $1 AND deleted_at IS NULL LIMIT 1", id).Scan(&releaseID)
+	if err == nil {
+		tx.Rollback()
+		return ct.ValidationError{Message: fmt.Sprintf("artifact is used by release %s", cleanUUID(releaseID))}
+	} else if err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE artifacts SET deleted_at = now() WHERE artifact_id = $1 AND deleted_at IS NULL", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// actorHeader is set on authenticated requests to the credential used, so
+// that the audit log can record who made the request.
+const actorHeader = "Flynn-Auth-Actor"
+
+// maxAuditBody is the largest object recorded in an audit log entry, larger
+// objects are omitted.
+const maxAuditBody = 64 * 1024
+
+type AuditRepo struct {
+	db *DB
+}
+
+func NewAuditRepo(db *DB) *AuditRepo {
+	return &AuditRepo{db}
+}
+
+// nullJSON returns nil for an empty document so that it is stored as NULL.
+func nullJSON(data json.RawMessage) *string {
+	if len(data) == 0 {
+		return nil
+	}
+	s := string(data)
+	return &s
+}
+
+func (r *AuditRepo) Add(e *ct.AuditEntry) error {
+	return r.db.QueryRow("INSERT INTO audit_log (actor, method, path, status, object_type, object_id, before, after) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING audit_id, created_at",
+		e.Actor, e.Method, e.Path, e.Status, e.ObjectType, e.ObjectID, nullJSON(e.Before), nullJSON(e.After)).Scan(&e.ID, &e.CreatedAt)
+}
+
+func scanAuditEntry(s Scanner) (*ct.AuditEntry, error) {
+	e := &ct.AuditEntry{}
+	var before, after *string
+	if err := s.Scan(&e.ID, &e.Actor, &e.Method, &e.Path, &e.Status, &e.ObjectType, &e.ObjectID, &before, &after, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+	if before != nil {
+		e.Before = json.RawMessage(*before)
+	}
+	if after != nil {
+		e.After = json.RawMessage(*after)
+	}
+	return e, nil
+}
+
+// auditFilter limits the entries returned by AuditRepo.List, zero fields
+// are ignored.
+type auditFilter struct {
+	actor      string
+	objectType string
+	objectID   string
+	beforeID   int64
+	since      time.Time
+	until      time.Time
+	count      int
+}
+
+// List returns the entries matching the filter, most recent first.
+func (r *AuditRepo) List(f *auditFilter) ([]*ct.AuditEntry, error) {
+	query := "SELECT audit_id, actor, method, path, status, object_type, object_id, before, after, created_at FROM audit_log WHERE true"
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+cond, len(args))
+	}
+	if f.actor != "" {
+		add("actor = $%d", f.actor)
+	}
+	if f.objectType != "" {
+		add("object_type = $%d", f.objectType)
+	}
+	if f.objectID != "" {
+		add("object_id = $%d", f.objectID)
+	}
+	if f.beforeID > 0 {
+		add("audit_id < $%d", f.beforeID)
+	}
+	if !f.since.IsZero() {
+		add("created_at >= $%d", f.since)
+	}
+	if !f.until.IsZero() {
+		add("created_at < $%d", f.until)
+	}
+	query += " ORDER BY audit_id DESC"
+	if f.count > 0 {
+		args = append(args, f.count)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*ct.AuditEntry{}
+	for rows.Next() {
+		e, err := scanAuditEntry(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// auditObject returns the type and ID of the object a request path refers
+// to, for example "formations" and the release ID for
+// /apps/:app/formations/:release. Objects created by a request to a
+// collection are identified by the ID in the response, other requests to a
+// path below an object, such as /apps/:app/env, refer to that object.
+func auditObject(path string, after json.RawMessage) (typ, id string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	n := len(parts)
+	if n%2 == 0 {
+		return parts[n-2], parts[n-1]
+	}
+	var obj struct {
+		ID interface{} `json:"id"`
+	}
+	if json.Unmarshal(after, &obj) == nil && obj.ID != nil {
+		return parts[n-1], fmt.Sprint(obj.ID)
+	}
+	if n >= 3 {
+		return parts[n-3], parts[n-2]
+	}
+	return parts[n-1], ""
+}
+
+// auditSecretFields are removed from recorded objects, they contain the
+// secrets of auth tokens and webhooks.
+var auditSecretFields = []string{"token", "secret"}
+
+// jsonObject returns data if it is a JSON object, so that only single
+// objects and not collections are recorded. Secret fields are removed.
+func jsonObject(data []byte) json.RawMessage {
+	data = bytes.TrimSpace(data)
+	var v map[string]interface{}
+	if len(data) == 0 || data[0] != '{' || json.Unmarshal(data, &v) != nil {
+		return nil
+	}
+	var removed bool
+	for _, f := range auditSecretFields {
+		if _, ok := v[f]; ok {
+			delete(v, f)
+			removed = true
+		}
+	}
+	if removed {
+		data, _ = json.Marshal(v)
+	}
+	return json.RawMessage(data)
+}
+
+// auditResponseWriter keeps a copy of the response body for the audit log.
+type auditResponseWriter struct {
+	martini.ResponseWriter
+	body bytes.Buffer
+
+	// skip is set if the body is not recorded because it is too large or
+	// the connection was hijacked.
+	skip bool
+}
+
+func (w *auditResponseWriter) Write(p []byte) (int, error) {
+	if !w.skip && w.body.Len()+len(p) <= maxAuditBody {
+		w.body.Write(p)
+	} else {
+		w.body.Reset()
+		w.skip = true
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *auditResponseWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func (w *auditResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.skip = true
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+// jsonBody returns the response body if it is a JSON object.
+func (w *auditResponseWriter) jsonBody() json.RawMessage {
+	if w.skip || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		return nil
+	}
+	return jsonObject(w.body.Bytes())
+}
+
+// auditRecorder records the response to the GET request made for the state
+// of an object before it is changed.
+type auditRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *auditRecorder) Header() http.Header { return r.header }
+
+func (r *auditRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *auditRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(200)
+	if r.body.Len()+len(p) > maxAuditBody {
+		return 0, fmt.Errorf("audit: object is larger than %d bytes", maxAuditBody)
+	}
+	return r.body.Write(p)
+}
+
+func (r *auditRecorder) CloseNotify() <-chan bool { return make(chan bool) }
+
+// auditState returns the JSON object returned by a GET request for path, or
+// nil if there is no object at the path.
+func auditState(h http.Handler, path string) json.RawMessage {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("Accept", "application/json")
+	rec := &auditRecorder{header: make(http.Header)}
+	h.ServeHTTP(rec, req)
+	if rec.status != 200 || !strings.HasPrefix(rec.header.Get("Content-Type"), "application/json") {
+		return nil
+	}
+	return jsonObject(rec.body.Bytes())
+}
+
+// auditHandler returns a middleware which records requests which change
+// objects in the audit log. The state of the object before the request is
+// read by making a GET request for the same path to h.
+func auditHandler(repo *AuditRepo, h http.Handler) martini.Handler {
+	return func(c martini.Context, res http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST", "PUT", "PATCH", "DELETE":
+		default:
+			c.Next()
+			return
+		}
+		e := &ct.AuditEntry{
+			Actor:  req.Header.Get(actorHeader),
+			Method: req.Method,
+			Path:   req.URL.Path,
+			Before: auditState(h, req.URL.Path),
+		}
+		w := &auditResponseWriter{ResponseWriter: res.(martini.ResponseWriter)}
+		c.MapTo(w, (*http.ResponseWriter)(nil))
+		c.Next()
+
+		e.Status = w.Status()
+		e.After = w.jsonBody()
+		e.ObjectType, e.ObjectID = auditObject(e.Path, e.After)
+		if err := repo.Add(e); err != nil {
+			log.Printf("audit: error recording %s %s: %s", e.Method, e.Path, err)
+		}
+	}
+}
+
+func listAudit(req *http.Request, repo *AuditRepo, r ResponseHelper) {
+	f := &auditFilter{
+		actor:      req.FormValue("actor"),
+		objectType: req.FormValue("object_type"),
+		objectID:   req.FormValue("object_id"),
+		count:      100,
+	}
+	if v := req.FormValue("before_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			r.Error(ct.ValidationError{Field: "before_id", Message: "is invalid"})
+			return
+		}
+		f.beforeID = id
+	}
+	if v := req.FormValue("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			r.Error(ct.ValidationError{Field: "count", Message: "is invalid"})
+			return
+		}
+		f.count = n
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &f.since}, {"until", &f.until}} {
+		v := req.FormValue(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			r.Error(ct.ValidationError{Field: p.name, Message: "must be an RFC3339 timestamp"})
+			return
+		}
+		*p.t = t
+	}
+	entries, err := repo.List(f)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, entries)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (s *S) TestAuditLog(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "audit-log"})
+	_, err := s.Post("/apps/"+app.ID, map[string]interface{}{"meta": map[string]string{"owner": "ops"}}, &ct.App{})
+	c.Assert(err, IsNil)
+
+	var entries []*ct.AuditEntry
+	_, err = s.Get("/audit?object_type=apps&object_id="+app.ID, &entries)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+
+	update := entries[0]
+	c.Assert(update.Actor, Equals, "key")
+	c.Assert(update.Method, Equals, "POST")
+	c.Assert(update.Path, Equals, "/apps/"+app.ID)
+	c.Assert(update.Status, Equals, 200)
+	var before, after ct.App
+	c.Assert(json.Unmarshal(update.Before, &before), IsNil)
+	c.Assert(json.Unmarshal(update.After, &after), IsNil)
+	c.Assert(before.Meta, IsNil)
+	c.Assert(after.Meta, DeepEquals, map[string]string{"owner": "ops"})
+
+	// objects created by posting to a collection are identified by the
+	// response
+	create := entries[1]
+	c.Assert(create.Path, Equals, "/apps")
+	c.Assert(create.Before, IsNil)
+	c.Assert(create.After, NotNil)
+
+	// requests which fail are recorded with their status
+	res, err := s.Delete("/apps/" + app.ID + "/formations/00000000-0000-0000-0000-000000000000")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 404)
+	_, err = s.Get("/audit?count=1", &entries)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Status, Equals, 404)
+	c.Assert(entries[0].ObjectType, Equals, "formations")
+
+	_, err = s.Get("/audit?count=1&before_id="+strconv.FormatInt(entries[0].ID, 10), &entries)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].ID, Equals, update.ID)
+
+	res, _ = s.Get("/audit?count=x", &entries)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+type AuditSuite struct{}
+
+var _ = Suite(&AuditSuite{})
+
+func (AuditSuite) TestAuditObject(c *C) {
+	for _, t := range []struct {
+		path, after string
+		typ, id     string
+	}{
+		{path: "/apps/foo", typ: "apps", id: "foo"},
+		{path: "/apps/foo/formations/bar", typ: "formations", id: "bar"},
+		{path: "/apps", after: `{"id": "foo"}`, typ: "apps", id: "foo"},
+		{path: "/apps/foo/cron_jobs/bar/runs", after: `{"id": 12}`, typ: "runs", id: "12"},
+		{path: "/apps/foo/env", after: `{"env": {}}`, typ: "apps", id: "foo"},
+		{path: "/keys", typ: "keys"},
+	} {
+		typ, id := auditObject(t.path, json.RawMessage(t.after))
+		c.Assert(typ, Equals, t.typ, Commentf("%s", t.path))
+		c.Assert(id, Equals, t.id, Commentf("%s", t.path))
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+type AuthTokenRepo struct {
+	db *DB
+}
+
+func NewAuthTokenRepo(db *DB) *AuthTokenRepo {
+	return &AuthTokenRepo{db}
+}
+
+// hashToken returns the hash of a token secret which is stored in place of
+// the secret.
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func splitList(s *string) []string {
+	if s == nil || *s == "" {
+		return nil
+	}
+	return strings.Split(*s, ",")
+}
+
+// Add creates the token with a new secret, which is set in t.Token. Apps
+// given by name are replaced with their IDs.
+func (r *AuthTokenRepo) Add(t *ct.AuthToken) error {
+	if t.Name == "" {
+		return ct.ValidationError{Field: "name", Message: "must be set"}
+	}
+	if len(t.Scopes) == 0 {
+		return ct.ValidationError{Field: "scopes", Message: "must be set"}
+	}
+	for _, s := range t.Scopes {
+		switch s {
+		case ct.TokenScopeAdmin, ct.TokenScopeRead, ct.TokenScopeDeploy:
+		default:
+			return ct.ValidationError{Field: "scopes", Message: "must be admin, read or deploy"}
+		}
+	}
+	for i, id := range t.Apps {
+		app, err := selectApp(r.db, id, false)
+		if err == ErrNotFound {
+			return ct.ValidationError{Field: "apps", Message: "app " + id + " does not exist"}
+		} else if err != nil {
+			return err
+		}
+		t.Apps[i] = app.ID
+	}
+	var apps *string
+	if len(t.Apps) > 0 {
+		s := strings.Join(t.Apps, ",")
+		apps = &s
+	}
+
+	t.ID = random.UUID()
+	t.Token = random.Hex(20)
+	return r.db.QueryRow("INSERT INTO auth_tokens (token_id, name, token_hash, scopes, app_ids) VALUES ($1, $2, $3, $4, $5) RETURNING created_at",
+		t.ID, t.Name, hashToken(t.Token), strings.Join(t.Scopes, ","), apps).Scan(&t.CreatedAt)
+}
+
+const authTokenColumns = "token_id, name, scopes, app_ids, created_at"
+
+func scanAuthToken(s Scanner) (*ct.AuthToken, error) {
+	t := &ct.AuthToken{}
+	var scopes string
+	var apps *string
+	if err := s.Scan(&t.ID, &t.Name, &scopes, &apps, &t.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	t.ID = cleanUUID(t.ID)
+	t.Scopes = splitList(&scopes)
+	t.Apps = splitList(apps)
+	return t, nil
+}
+
+func (r *AuthTokenRepo) List() ([]*ct.AuthToken, error) {
+	rows, err := r.db.Query("SELECT " + authTokenColumns + " FROM auth_tokens WHERE deleted_at IS NULL ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	tokens := []*ct.AuthToken{}
+	for rows.Next() {
+		t, err := scanAuthToken(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// Lookup returns the token with the secret, ErrNotFound is returned if there
+// is no such token or it has been revoked.
+func (r *AuthTokenRepo) Lookup(secret string) (*ct.AuthToken, error) {
+	return scanAuthToken(r.db.QueryRow("SELECT "+authTokenColumns+" FROM auth_tokens WHERE token_hash = $1 AND deleted_at IS NULL", hashToken(secret)))
+}
+
+// Remove revokes the token.
+func (r *AuthTokenRepo) Remove(id string) error {
+	if !idPattern.MatchString(id) {
+		return ErrNotFound
+	}
+	var found bool
+	err := r.db.QueryRow("WITH revoked AS (UPDATE auth_tokens SET deleted_at = now() WHERE token_id = $1 AND deleted_at IS NULL RETURNING 1) SELECT EXISTS (SELECT 1 FROM revoked)", id).Scan(&found)
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// authorizer authenticates requests made with either the controller key,
+// which allows all requests, or an auth token.
+type authorizer struct {
+	key    string
+	tokens *AuthTokenRepo
+}
+
+// authorize returns the actor which made the request, or the status to
+// respond with if the request is not allowed.
+func (a *authorizer) authorize(req *http.Request) (actor string, status int) {
+	_, password, _ := parseBasicAuth(req.Header)
+	if password == "" && strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		password = req.URL.Query().Get("key")
+	}
+	if len(password) == len(a.key) && subtle.ConstantTimeCompare([]byte(password), []byte(a.key)) == 1 {
+		return "key", 0
+	}
+	if password == "" || a.tokens == nil {
+		return "", 401
+	}
+	t, err := a.tokens.Lookup(password)
+	if err == ErrNotFound {
+		return "", 401
+	} else if err != nil {
+		log.Println("auth: error looking up token:", err)
+		return "", 500
+	}
+	allowed, err := a.allowed(t, req)
+	if err != nil {
+		log.Println("auth: error checking token:", err)
+		return "", 500
+	}
+	if !allowed {
+		return "", 403
+	}
+	return "token:" + t.ID, 0
+}
+
+// allowed returns whether the token's scopes and apps allow the request.
+func (a *authorizer) allowed(t *ct.AuthToken, req *http.Request) (bool, error) {
+	if t.HasScope(ct.TokenScopeAdmin) {
+		return true, nil
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch parts[0] {
+	case "auth_tokens", "webhooks", "export", "import", "gc":
+		// tokens, webhooks and exports expose credentials and events of
+		// all apps, imports can overwrite any of them and garbage
+		// collection deletes releases of all apps
+		return false, nil
+	}
+	if parts[0] == "apps" && len(parts) >= 3 && parts[2] == "transfer" {
+		return a.transferAllowed(t, req.Method, parts)
+	}
+	read := req.Method == "GET" || req.Method == "HEAD"
+
+	if len(t.Apps) > 0 {
+		switch parts[0] {
+		case "apps":
+			if len(parts) < 2 {
+				return false, nil
+			}
+			ok, err := a.tokenApp(t, parts[1])
+			if err != nil || !ok {
+				return false, err
+			}
+			// the target of a promotion is in the request body, so it
+			// cannot be checked against the token's apps here
+			if len(parts) == 3 && parts[2] == "promote" {
+				return false, nil
+			}
+		case "artifacts", "releases":
+			// artifacts and releases do not belong to an app, so they
+			// can only be created or read by ID
+			if read && len(parts) != 2 || !read && len(parts) != 1 {
+				return false, nil
+			}
+			if read && parts[0] == "releases" {
+				ok, err := a.tokenRelease(t, parts[1])
+				if err != nil || !ok {
+					return false, err
+				}
+			}
+		case "cluster", "ca-cert", "schemas":
+		default:
+			return false, nil
+		}
+	}
+
+	if read {
+		return t.HasScope(ct.TokenScopeRead) || t.HasScope(ct.TokenScopeDeploy), nil
+	}
+	return t.HasScope(ct.TokenScopeDeploy) && deployRequest(req.Method, parts), nil
+}
+
+// tokenApp returns whether the app with the given ID or name is one of the
+// token's apps, or is owned by the token.
+func (a *authorizer) tokenApp(t *ct.AuthToken, id string) (bool, error) {
+	app, err := selectApp(a.tokens.db, id, false)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if app.Owner == t.ID {
+		return true, nil
+	}
+	for _, appID := range t.Apps {
+		if appID == app.ID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// tokenRelease returns whether the release is or was used by one of the
+// token's apps, either as its current release, in a formation or in a
+// deployment.
+func (a *authorizer) tokenRelease(t *ct.AuthToken, id string) (bool, error) {
+	rows, err := a.tokens.db.Query("SELECT app_id FROM apps WHERE release_id = $1 UNION SELECT app_id FROM formations WHERE release_id = $1 UNION SELECT app_id FROM deployments WHERE old_release_id = $1 OR new_release_id = $1", id)
+	if invalidUUID(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var appIDs []string
+	for rows.Next() {
+		var appID string
+		if err := rows.Scan(&appID); err != nil {
+			rows.Close()
+			return false, err
+		}
+		appIDs = append(appIDs, cleanUUID(appID))
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	for _, appID := range appIDs {
+		if ok, err := a.tokenApp(t, appID); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// deployRequest returns whether the request is one allowed by the deploy
+// scope.
+func deployRequest(method string, parts []string) bool {
+	switch {
+	case method == "POST" && len(parts) == 1:
+		return parts[0] == "artifacts" || parts[0] == "releases"
+	case parts[0] != "apps" || len(parts) < 3:
+		return false
+	case method == "PUT" && len(parts) == 3:
+		return parts[2] == "release"
+	case method == "POST" && len(parts) == 3:
+		return parts[2] == "deploy" || parts[2] == "rollback" || parts[2] == "promote"
+	case method == "PUT" && len(parts) == 4:
+		return parts[2] == "formations"
+	}
+	return false
+}
+
+func createAuthToken(t ct.AuthToken, repo *AuthTokenRepo, r ResponseHelper) {
+	if err := repo.Add(&t); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &t)
+}
+
+func listAuthTokens(repo *AuthTokenRepo, r ResponseHelper) {
+	tokens, err := repo.List()
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, tokens)
+}
+
+func deleteAuthToken(params martini.Params, repo *AuthTokenRepo, r ResponseHelper) {
+	if err := repo.Remove(params["auth_tokens_id"]); err != nil {
+		r.Error(err)
+		return
+	}
+	r.WriteHeader(200)
+}
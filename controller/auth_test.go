@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// tokenStatus returns the status of a request made with the token secret.
+func (s *S) tokenStatus(c *C, secret, method, path string, in interface{}) int {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		c.Assert(err, IsNil)
+	}
+	req, err := http.NewRequest(method, s.srv.URL+path, bytes.NewReader(body))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("", secret)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func (s *S) TestAuthTokens(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "auth-tokens"})
+	other := s.createTestApp(c, &ct.App{Name: "auth-tokens-other"})
+
+	res, _ := s.Post("/auth_tokens", &ct.AuthToken{Name: "bad", Scopes: []string{"write"}}, &ct.AuthToken{})
+	c.Assert(res.StatusCode, Equals, 400)
+	res, _ = s.Post("/auth_tokens", &ct.AuthToken{Name: "bad", Scopes: []string{"read"}, Apps: []string{"auth-tokens-missing"}}, &ct.AuthToken{})
+	c.Assert(res.StatusCode, Equals, 400)
+
+	read := &ct.AuthToken{}
+	_, err := s.Post("/auth_tokens", &ct.AuthToken{Name: "dashboard", Scopes: []string{ct.TokenScopeRead}}, read)
+	c.Assert(err, IsNil)
+	c.Assert(read.Token, Not(Equals), "")
+
+	deploy := &ct.AuthToken{}
+	_, err = s.Post("/auth_tokens", &ct.AuthToken{Name: "ci", Scopes: []string{ct.TokenScopeDeploy}, Apps: []string{app.Name}}, deploy)
+	c.Assert(err, IsNil)
+	c.Assert(deploy.Apps, DeepEquals, []string{app.ID})
+
+	// read tokens can only make read requests
+	c.Assert(s.tokenStatus(c, read.Token, "GET", "/apps", nil), Equals, 200)
+	c.Assert(s.tokenStatus(c, read.Token, "POST", "/apps", &ct.App{}), Equals, 403)
+	c.Assert(s.tokenStatus(c, read.Token, "GET", "/auth_tokens", nil), Equals, 403)
+	c.Assert(s.tokenStatus(c, read.Token, "GET", "/export", nil), Equals, 403)
+	c.Assert(s.tokenStatus(c, read.Token, "POST", "/import", nil), Equals, 403)
+	c.Assert(s.tokenStatus(c, read.Token, "GET", "/metrics", nil), Equals, 200)
+
+	// deploy tokens can deploy their apps
+	c.Assert(s.tokenStatus(c, deploy.Token, "GET", "/apps/"+app.Name, nil), Equals, 200)
+	c.Assert(s.tokenStatus(c, deploy.Token, "GET", "/apps/"+other.ID, nil), Equals, 403)
+	c.Assert(s.tokenStatus(c, deploy.Token, "GET", "/apps", nil), Equals, 403)
+	c.Assert(s.tokenStatus(c, deploy.Token, "GET", "/metrics", nil), Equals, 403)
+	c.Assert(s.tokenStatus(c, deploy.Token, "POST", "/apps/"+app.ID+"/promote", &ct.Promotion{TargetAppID: other.ID}), Equals, 403)
+	c.Assert(s.tokenStatus(c, deploy.Token, "POST", "/artifacts", &ct.Artifact{Type: "docker", URI: "docker://foo/bar"}), Equals, 200)
+	c.Assert(s.tokenStatus(c, deploy.Token, "DELETE", "/apps/"+app.ID, nil), Equals, 403)
+
+	// releases can only be read if they belong to the token's apps
+	release := s.createTestRelease(c, &ct.Release{})
+	s.setAppRelease(c, app.ID, release.ID)
+	otherRelease := s.createTestRelease(c, &ct.Release{})
+	s.setAppRelease(c, other.ID, otherRelease.ID)
+	c.Assert(s.tokenStatus(c, deploy.Token, "GET", "/releases/"+release.ID, nil), Equals, 200)
+	c.Assert(s.tokenStatus(c, deploy.Token, "GET", "/releases/"+otherRelease.ID, nil), Equals, 403)
+	c.Assert(s.tokenStatus(c, deploy.Token, "GET", "/releases/foo", nil), Equals, 403)
+
+	// the token is recorded in the audit log
+	var entries []*ct.AuditEntry
+	_, err = s.Get("/audit?count=1&object_type=artifacts", &entries)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Actor, Equals, "token:"+deploy.ID)
+
+	var list []*ct.AuthToken
+	_, err = s.Get("/auth_tokens", &list)
+	c.Assert(err, IsNil)
+	for _, t := range list {
+		c.Assert(t.Token, Equals, "")
+	}
+
+	res, err = s.Delete("/auth_tokens/" + read.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(s.tokenStatus(c, read.Token, "GET", "/apps", nil), Equals, 401)
+	res, err = s.Delete("/auth_tokens/" + read.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+type AuthSuite struct{}
+
+var _ = Suite(&AuthSuite{})
+
+func (AuthSuite) TestDeployRequest(c *C) {
+	for _, t := range []struct {
+		method, path string
+		allowed      bool
+	}{
+		{"POST", "/artifacts", true},
+		{"POST", "/releases", true},
+		{"PUT", "/apps/foo/release", true},
+		{"POST", "/apps/foo/deploy", true},
+		{"POST", "/apps/foo/rollback", true},
+		{"POST", "/apps/foo/promote", true},
+		{"PUT", "/apps/foo/formations/bar", true},
+		{"POST", "/apps", false},
+		{"DELETE", "/apps/foo", false},
+		{"POST", "/apps/foo/jobs", false},
+		{"POST", "/apps/foo/undelete", false},
+		{"DELETE", "/apps/foo/formations/bar", false},
+		{"PUT", "/formations", false},
+		{"POST", "/keys", false},
+	} {
+		parts := strings.Split(strings.Trim(t.path, "/"), "/")
+		c.Assert(deployRequest(t.method, parts), Equals, t.allowed, Commentf("%s %s", t.method, t.path))
+	}
+}
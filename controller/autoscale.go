@@ -0,0 +1,293 @@
+package main
+
+import (
+	"log"
+	"math"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+	routerc "github.com/flynn/flynn/router/client"
+)
+
+// autoscaleTolerance is how far the measured metric may be from the target,
+// as a fraction of the target, before a process type is scaled. It stops
+// formations flapping when the metric hovers around the target.
+const autoscaleTolerance = 0.1
+
+type AutoscaleRepo struct {
+	db *DB
+}
+
+func NewAutoscaleRepo(db *DB) *AutoscaleRepo {
+	return &AutoscaleRepo{db}
+}
+
+// Put creates or replaces the app's policy for the process type.
+func (r *AutoscaleRepo) Put(p *ct.AutoscalePolicy) error {
+	if p.Metric == "" {
+		p.Metric = ct.AutoscaleMetricRequests
+	}
+	switch {
+	case p.Metric != ct.AutoscaleMetricRequests:
+		return ct.ValidationError{Field: "metric", Message: "must be " + ct.AutoscaleMetricRequests}
+	case p.Min < 0:
+		return ct.ValidationError{Field: "min", Message: "must not be negative"}
+	case p.Max < 1 || p.Max < p.Min:
+		return ct.ValidationError{Field: "max", Message: "must be at least 1 and not less than min"}
+	case p.Target <= 0:
+		return ct.ValidationError{Field: "target", Message: "must be positive"}
+	}
+	err := r.db.QueryRow("INSERT INTO autoscale_policies (app_id, process_type, min_count, max_count, metric, target) VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at, updated_at",
+		p.AppID, p.ProcessType, p.Min, p.Max, p.Metric, p.Target).Scan(&p.CreatedAt, &p.UpdatedAt)
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		err = r.db.QueryRow("UPDATE autoscale_policies SET min_count = $3, max_count = $4, metric = $5, target = $6, updated_at = now() WHERE app_id = $1 AND process_type = $2 RETURNING created_at, updated_at",
+			p.AppID, p.ProcessType, p.Min, p.Max, p.Metric, p.Target).Scan(&p.CreatedAt, &p.UpdatedAt)
+	}
+	return err
+}
+
+func scanAutoscalePolicy(s Scanner) (*ct.AutoscalePolicy, error) {
+	p := &ct.AutoscalePolicy{}
+	err := s.Scan(&p.AppID, &p.ProcessType, &p.Min, &p.Max, &p.Metric, &p.Target, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	p.AppID = cleanUUID(p.AppID)
+	return p, nil
+}
+
+// List returns the policies of the app, or of all apps if appID is empty.
+func (r *AutoscaleRepo) List(appID string) ([]*ct.AutoscalePolicy, error) {
+	query := "SELECT app_id, process_type, min_count, max_count, metric, target, created_at, updated_at FROM autoscale_policies"
+	var args []interface{}
+	if appID != "" {
+		query += " WHERE app_id = $1"
+		args = append(args, appID)
+	}
+	rows, err := r.db.Query(query+" ORDER BY process_type", args...)
+	if err != nil {
+		return nil, err
+	}
+	list := []*ct.AutoscalePolicy{}
+	for rows.Next() {
+		p, err := scanAutoscalePolicy(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+func (r *AutoscaleRepo) Remove(appID, processType string) error {
+	var found bool
+	err := r.db.QueryRow("WITH deleted AS (DELETE FROM autoscale_policies WHERE app_id = $1 AND process_type = $2 RETURNING 1) SELECT EXISTS (SELECT 1 FROM deleted)", appID, processType).Scan(&found)
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// metricSource measures an autoscaling metric.
+type metricSource interface {
+	// Sample collects the data the metric is calculated from, it is called
+	// once each time policies are evaluated.
+	Sample(now time.Time) error
+
+	// Value returns the metric for the app's process type, which currently
+	// has jobs jobs, as a value per job. ok is false if there is not enough
+	// data to calculate it.
+	Value(app *ct.App, processType string, jobs int) (v float64, ok bool)
+}
+
+// requestRate calculates the rate of requests routed to each process type
+// from the request counts reported by the router. The router routes
+// requests for a process type to the service "<app name>-<type>".
+type requestRate struct {
+	router routerc.Client
+
+	prev, cur     map[string]uint64
+	prevAt, curAt time.Time
+}
+
+func (s *requestRate) Sample(now time.Time) error {
+	stats, err := s.router.ServiceStats()
+	if err != nil {
+		s.cur = nil
+		return err
+	}
+	s.prev, s.prevAt = s.cur, s.curAt
+	s.cur, s.curAt = make(map[string]uint64, len(stats)), now
+	for _, st := range stats {
+		s.cur[st.Service] = st.Requests
+	}
+	return nil
+}
+
+func (s *requestRate) Value(app *ct.App, processType string, jobs int) (float64, bool) {
+	if s.prev == nil || s.cur == nil {
+		return 0, false
+	}
+	elapsed := s.curAt.Sub(s.prevAt).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	service := app.Name + "-" + processType
+	cur := s.cur[service]
+	prev := s.prev[service]
+	if cur < prev {
+		// the router's counts were reset
+		prev = 0
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+	return float64(cur-prev) / elapsed / float64(jobs), true
+}
+
+// autoscaler adjusts the formations of apps' current releases according to
+// their autoscale policies.
+type autoscaler struct {
+	repo        *AutoscaleRepo
+	apps        *AppRepo
+	formations  *FormationRepo
+	deployments *DeploymentRepo
+	metrics     map[string]metricSource
+}
+
+// Run evaluates all policies every interval.
+func (a *autoscaler) Run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := a.runOnce(now); err != nil {
+			log.Println("autoscale: error evaluating policies:", err)
+		}
+	}
+}
+
+func (a *autoscaler) runOnce(now time.Time) error {
+	sampled := make(map[string]bool, len(a.metrics))
+	for name, m := range a.metrics {
+		if err := m.Sample(now); err != nil {
+			log.Printf("autoscale: error sampling %s: %s", name, err)
+			continue
+		}
+		sampled[name] = true
+	}
+	list, err := a.repo.List("")
+	if err != nil {
+		return err
+	}
+	for _, p := range list {
+		if !sampled[p.Metric] {
+			continue
+		}
+		if err := a.scale(p); err != nil {
+			log.Printf("autoscale: error scaling %s of app %s: %s", p.ProcessType, p.AppID, err)
+		}
+	}
+	return nil
+}
+
+// scale sets the number of jobs of the policy's process type, leaving it
+// alone while the app is being deployed.
+func (a *autoscaler) scale(p *ct.AutoscalePolicy) error {
+	deploying, err := a.deployments.inProgress(p.AppID)
+	if err != nil || deploying {
+		return err
+	}
+	data, err := a.apps.Get(p.AppID)
+	if err == ErrNotFound {
+		// the app has been deleted
+		return nil
+	} else if err != nil {
+		return err
+	}
+	app := data.(*ct.App)
+	release, err := a.apps.GetRelease(app.ID)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, ok := release.Processes[p.ProcessType]; !ok {
+		return nil
+	}
+	f, err := a.formations.Get(app.ID, release.ID)
+	if err == ErrNotFound {
+		f = &ct.Formation{AppID: app.ID, ReleaseID: release.ID}
+	} else if err != nil {
+		return err
+	}
+
+	current := f.Processes[p.ProcessType]
+	desired := current
+	if v, ok := a.metrics[p.Metric].Value(app, p.ProcessType, current); ok {
+		desired = desiredJobs(current, v, p.Target)
+	}
+	if desired < p.Min {
+		desired = p.Min
+	} else if desired > p.Max {
+		desired = p.Max
+	}
+	if desired == current {
+		return nil
+	}
+
+	procs := make(map[string]int, len(f.Processes)+1)
+	for typ, n := range f.Processes {
+		procs[typ] = n
+	}
+	procs[p.ProcessType] = desired
+	f.Processes = procs
+	if err := a.formations.Add(f); err != nil {
+		return err
+	}
+	log.Printf("autoscale: scaled %s of app %s from %d to %d", p.ProcessType, app.Name, current, desired)
+	return nil
+}
+
+// desiredJobs returns the number of jobs needed to bring a per job metric
+// with the given value across current jobs to target.
+func desiredJobs(current int, value, target float64) int {
+	if math.Abs(value-target) <= target*autoscaleTolerance {
+		return current
+	}
+	if current < 1 {
+		current = 1
+	}
+	return int(math.Ceil(float64(current) * value / target))
+}
+
+func putAutoscalePolicy(app *ct.App, params martini.Params, p ct.AutoscalePolicy, repo *AutoscaleRepo, r ResponseHelper) {
+	p.AppID = app.ID
+	p.ProcessType = params["process_type"]
+	if err := repo.Put(&p); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &p)
+}
+
+func listAutoscalePolicies(app *ct.App, repo *AutoscaleRepo, r ResponseHelper) {
+	list, err := repo.List(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, list)
+}
+
+func deleteAutoscalePolicy(app *ct.App, params martini.Params, repo *AutoscaleRepo, r ResponseHelper) {
+	if err := repo.Remove(app.ID, params["process_type"]); err != nil {
+		r.Error(err)
+		return
+	}
+	r.WriteHeader(200)
+}
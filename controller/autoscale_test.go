@@ -0,0 +1,89 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	routerc "github.com/flynn/flynn/router/client"
+)
+
+func (s *S) TestAutoscale(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "autoscale"})
+	release := s.createTestRelease(c, &ct.Release{
+		Processes: map[string]ct.ProcessType{"web": {}, "worker": {}},
+	})
+	s.setAppRelease(c, app.ID, release.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2, "worker": 1}})
+
+	res, _ := s.Put("/apps/"+app.ID+"/autoscale/web", &ct.AutoscalePolicy{Min: 3, Max: 2, Target: 10}, &ct.AutoscalePolicy{})
+	c.Assert(res.StatusCode, Equals, 400)
+
+	policy := &ct.AutoscalePolicy{}
+	_, err := s.Put("/apps/"+app.ID+"/autoscale/web", &ct.AutoscalePolicy{Min: 1, Max: 5, Target: 10}, policy)
+	c.Assert(err, IsNil)
+	c.Assert(policy.ProcessType, Equals, "web")
+	c.Assert(policy.Metric, Equals, ct.AutoscaleMetricRequests)
+
+	var list []*ct.AutoscalePolicy
+	_, err = s.Get("/apps/"+app.ID+"/autoscale", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+
+	var scaler *autoscaler
+	var router *fakeRouter
+	s.m.Invoke(func(a *autoscaler, r routerc.Client) {
+		scaler = a
+		router = r.(*fakeRouter)
+	})
+	assertProcs := func(expected map[string]int) {
+		f := &ct.Formation{}
+		_, err := s.Get(formationPath(app.ID, release.ID), f)
+		c.Assert(err, IsNil)
+		c.Assert(f.Processes, DeepEquals, expected)
+	}
+
+	// 60 requests per second across 2 jobs scales web up to 6 jobs, which
+	// is capped at the maximum of 5
+	now := time.Now()
+	c.Assert(scaler.runOnce(now), IsNil)
+	router.addRequests("autoscale-web", 600)
+	c.Assert(scaler.runOnce(now.Add(10*time.Second)), IsNil)
+	assertProcs(map[string]int{"web": 5, "worker": 1})
+
+	// a rate close to the target doesn't change the formation
+	router.addRequests("autoscale-web", 520)
+	c.Assert(scaler.runOnce(now.Add(20*time.Second)), IsNil)
+	assertProcs(map[string]int{"web": 5, "worker": 1})
+
+	// no traffic scales down to the minimum
+	c.Assert(scaler.runOnce(now.Add(30*time.Second)), IsNil)
+	assertProcs(map[string]int{"web": 1, "worker": 1})
+
+	res, err = s.Delete("/apps/" + app.ID + "/autoscale/web")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Delete("/apps/" + app.ID + "/autoscale/web")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+type AutoscaleSuite struct{}
+
+var _ = Suite(&AutoscaleSuite{})
+
+func (AutoscaleSuite) TestDesiredJobs(c *C) {
+	for _, t := range []struct {
+		current       int
+		value, target float64
+		desired       int
+	}{
+		{current: 2, value: 30, target: 10, desired: 6},
+		{current: 4, value: 2.5, target: 10, desired: 1},
+		{current: 3, value: 10.5, target: 10, desired: 3},
+		{current: 0, value: 25, target: 10, desired: 3},
+		{current: 3, value: 0, target: 10, desired: 0},
+	} {
+		c.Assert(desiredJobs(t.current, t.value, t.target), Equals, t.desired, Commentf("%+v", t))
+	}
+}
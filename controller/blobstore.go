@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/resource"
+)
+
+// blobStore deletes the files of garbage collected artifacts and releases.
+type blobStore interface {
+	// Owns returns whether the URL is a file in the blobstore.
+	Owns(u string) bool
+	// Delete deletes the file at the URL, deleting a file which does not
+	// exist is not an error.
+	Delete(u string) error
+}
+
+var errNoBlobstore = errors.New("blobstore: no instances are running")
+
+// discoverdBlobStore finds the blobstore with discoverd. Files are stored
+// at the address of the instance which received them, but all instances
+// share their storage, so any instance can delete them.
+type discoverdBlobStore struct {
+	dc     resource.DiscoverdClient
+	client *http.Client
+
+	mtx sync.Mutex
+	set discoverd.ServiceSet
+}
+
+func (b *discoverdBlobStore) addrs() []string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.set == nil {
+		set, err := b.dc.NewServiceSet("blobstore")
+		if err != nil {
+			return nil
+		}
+		b.set = set
+	}
+	return b.set.Addrs()
+}
+
+func (b *discoverdBlobStore) Owns(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Scheme != "http" {
+		return false
+	}
+	if parsed.Host == "blobstore" || parsed.Host == "blobstore.discoverd" {
+		return true
+	}
+	for _, addr := range b.addrs() {
+		if parsed.Host == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *discoverdBlobStore) Delete(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	addrs := b.addrs()
+	if len(addrs) == 0 {
+		return errNoBlobstore
+	}
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s%s", addrs[0], parsed.Path), nil)
+	if err != nil {
+		return err
+	}
+	res, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 404 {
+		return fmt.Errorf("blobstore: unexpected status %d deleting %s", res.StatusCode, parsed.Path)
+	}
+	return nil
+}
@@ -3,27 +3,36 @@ package controller
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
+	"compress/gzip"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/controller/utils"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/discoverd/client/dialer"
+	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/pinned"
+	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/rpcplus"
 	"github.com/flynn/flynn/router/types"
 )
 
-func NewClient(uri, key string) (*Client, error) {
+// NewClient creates a client for the controller at uri, which defaults to
+// discovering the controller using discoverd. The transport is configured
+// using DefaultTransportConfig and opts.
+func NewClient(uri, key string, opts ...Option) (*Client, error) {
 	if uri == "" {
 		uri = "discoverd+http://flynn-controller"
 	}
@@ -31,34 +40,47 @@ func NewClient(uri, key string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	conf := newTransportConfig(opts)
 	c := &Client{
-		url:  uri,
-		addr: u.Host,
-		http: http.DefaultClient,
-		key:  key,
+		url:   uri,
+		addr:  u.Host,
+		key:   key,
+		retry: DefaultRetryPolicy,
 	}
 	if u.Scheme == "discoverd+http" {
 		if err := discoverd.Connect(""); err != nil {
 			return nil, err
 		}
-		dialer := dialer.New(discoverd.DefaultClient, nil)
+		dialer := dialer.New(discoverd.DefaultClient, conf.dialer().Dial)
 		c.dial = dialer.Dial
 		c.dialClose = dialer
-		c.http = &http.Client{Transport: &http.Transport{Dial: c.dial}}
+		c.http = &http.Client{Transport: conf.transport(c.dial)}
 		u.Scheme = "http"
 		c.url = u.String()
+	} else {
+		t := conf.transport(conf.dialer().Dial)
+		t.Proxy = http.ProxyFromEnvironment
+		c.http = &http.Client{Transport: t}
 	}
 	return c, nil
 }
 
-func NewClientWithPin(uri, key string, pin []byte) (*Client, error) {
+// NewClientWithPin creates a client that connects to the controller at uri
+// using TLS, verifying the server's leaf certificate against pin (the SHA256
+// digest of the DER encoded certificate) rather than the system CA store.
+func NewClientWithPin(uri, key string, pin []byte, opts ...Option) (*Client, error) {
+	if len(pin) != sha256.Size {
+		return nil, errors.New("controller: invalid certificate pin")
+	}
 	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
+	conf := newTransportConfig(opts)
 	c := &Client{
-		dial: (&pinned.Config{Pin: pin}).Dial,
-		key:  key,
+		dial:  (&pinned.Config{Pin: pin, Config: conf.TLSConfig, Dialer: conf.dialer()}).Dial,
+		key:   key,
+		retry: DefaultRetryPolicy,
 	}
 	if _, port, _ := net.SplitHostPort(u.Host); port == "" {
 		u.Host += ":443"
@@ -66,7 +88,10 @@ func NewClientWithPin(uri, key string, pin []byte) (*Client, error) {
 	c.addr = u.Host
 	u.Scheme = "http"
 	c.url = u.String()
-	c.http = &http.Client{Transport: &http.Transport{Dial: c.dial}}
+	// TLS is handled by the pinned dialer, so the transport sees plain HTTP
+	t := conf.transport(c.dial)
+	t.TLSClientConfig = nil
+	c.http = &http.Client{Transport: t}
 	return c, nil
 }
 
@@ -76,6 +101,11 @@ type Client struct {
 	addr string
 	http *http.Client
 
+	retry      RetryPolicy
+	middleware []Middleware
+	limiter    *limiter
+	longPoll   bool
+
 	dial      rpcplus.DialFunc
 	dialClose io.Closer
 }
@@ -89,12 +119,21 @@ func (c *Client) Close() error {
 
 var ErrNotFound = errors.New("controller: not found")
 
+// ErrPreconditionFailed is returned when updating an object that has been
+// modified since it was retrieved.
+var ErrPreconditionFailed = errors.New("controller: precondition failed")
+
+// ErrConflict is returned when updating an object with a version which is no
+// longer its current version because it has been modified concurrently.
+var ErrConflict = errors.New("controller: version conflict")
+
 func toJSON(v interface{}) (io.Reader, error) {
 	data, err := json.Marshal(v)
 	return bytes.NewBuffer(data), err
 }
 
 func (c *Client) rawReq(method, path string, header http.Header, in, out interface{}) (*http.Response, error) {
+	var data []byte
 	var payload io.Reader
 	switch v := in.(type) {
 	case io.Reader:
@@ -102,12 +141,66 @@ func (c *Client) rawReq(method, path string, header http.Header, in, out interfa
 	case nil:
 	default:
 		var err error
-		payload, err = toJSON(in)
+		data, err = json.Marshal(in)
 		if err != nil {
 			return nil, err
 		}
+		// compress large payloads, responses are decompressed
+		// transparently by the http package
+		if len(data) >= gzipMinSize {
+			if data, err = gzipData(data); err != nil {
+				return nil, err
+			}
+			if header == nil {
+				header = make(http.Header)
+			}
+			header.Set("Content-Encoding", "gzip")
+		}
 	}
 
+	var retry *retryAttempt
+	// streamed bodies can't be replayed, so only retry JSON payloads
+	keyed := header.Get(idempotencyKeyHeader) != ""
+	if (idempotent(method) || keyed) && payload == nil {
+		retry = c.retry.start()
+	}
+	for {
+		if data != nil {
+			payload = bytes.NewReader(data)
+		}
+		res, err := c.doReq(method, path, header, payload, out)
+		// a conflict for a keyed request means an earlier attempt is
+		// still being handled, retrying returns its response
+		temporary := temporaryErr(res, err) || keyed && err == ErrConflict
+		if retry == nil || !temporary || !retry.Next() {
+			return res, err
+		}
+	}
+}
+
+// gzipMinSize is the size above which JSON request bodies are compressed.
+const gzipMinSize = 1024
+
+func gzipData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Client) doReq(method, path string, header http.Header, payload io.Reader, out interface{}) (*http.Response, error) {
+	if c.limiter != nil {
+		release, err := c.limiter.acquire()
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
 	req, err := http.NewRequest(method, c.url+path, payload)
 	if err != nil {
 		return nil, err
@@ -120,7 +213,7 @@ func (c *Client) rawReq(method, path string, header http.Header, in, out interfa
 	}
 	req.Header = header
 	req.SetBasicAuth("", c.key)
-	res, err := c.http.Do(req)
+	res, err := c.do(req, path)
 	if err != nil {
 		return nil, err
 	}
@@ -128,6 +221,14 @@ func (c *Client) rawReq(method, path string, header http.Header, in, out interfa
 		res.Body.Close()
 		return res, ErrNotFound
 	}
+	if res.StatusCode == 412 {
+		res.Body.Close()
+		return res, ErrPreconditionFailed
+	}
+	if res.StatusCode == 409 {
+		res.Body.Close()
+		return res, ErrConflict
+	}
 	if res.StatusCode == 400 {
 		var body ct.ValidationError
 		defer res.Body.Close()
@@ -136,6 +237,15 @@ func (c *Client) rawReq(method, path string, header http.Header, in, out interfa
 		}
 		return res, body
 	}
+	if res.StatusCode == 403 {
+		// quota errors have a body, unauthorized tokens do not
+		var body ct.QuotaError
+		err := json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+		if err == nil && body.Quota != "" {
+			return res, body
+		}
+	}
 	if res.StatusCode != 200 {
 		res.Body.Close()
 		return res, &url.Error{
@@ -152,7 +262,10 @@ func (c *Client) rawReq(method, path string, header http.Header, in, out interfa
 }
 
 func (c *Client) send(method, path string, in, out interface{}) error {
-	_, err := c.rawReq(method, path, nil, in, out)
+	res, err := c.rawReq(method, path, nil, in, out)
+	if err == nil && out == nil {
+		res.Body.Close()
+	}
 	return err
 }
 
@@ -164,6 +277,47 @@ func (c *Client) post(path string, in, out interface{}) error {
 	return c.send("POST", path, in, out)
 }
 
+// idempotencyKeyHeader is the header the controller uses to recognise
+// retried create requests.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// postIdempotent is like post but sends a new idempotency key, so that the
+// request can be retried without creating the object twice.
+func (c *Client) postIdempotent(path string, in, out interface{}) error {
+	header := http.Header{idempotencyKeyHeader: []string{random.UUID()}}
+	res, err := c.rawReq("POST", path, header, in, out)
+	if err == nil && out == nil {
+		res.Body.Close()
+	}
+	return err
+}
+
+// getETag is like get but also returns the ETag of the response.
+func (c *Client) getETag(path string, out interface{}) (string, error) {
+	res, err := c.rawReq("GET", path, nil, nil, out)
+	if err != nil {
+		return "", err
+	}
+	return res.Header.Get("ETag"), nil
+}
+
+// sendIfMatch is like send but makes the request conditional on etag (if
+// set), the ETag of the response is returned.
+func (c *Client) sendIfMatch(method, path, etag string, in, out interface{}) (string, error) {
+	var header http.Header
+	if etag != "" {
+		header = http.Header{"If-Match": []string{etag}}
+	}
+	res, err := c.rawReq(method, path, header, in, out)
+	if err != nil {
+		return "", err
+	}
+	if out == nil {
+		res.Body.Close()
+	}
+	return res.Header.Get("ETag"), nil
+}
+
 func (c *Client) get(path string, out interface{}) error {
 	_, err := c.rawReq("GET", path, nil, nil, out)
 	return err
@@ -180,7 +334,14 @@ func (c *Client) delete(path string) error {
 type FormationUpdates struct {
 	Chan <-chan *ct.ExpandedFormation
 
-	conn net.Conn
+	conn io.Closer
+}
+
+// NewFormationUpdates returns updates that are read from ch, closer is called
+// when the updates are closed. It is used by other implementations of
+// Interface.
+func NewFormationUpdates(ch <-chan *ct.ExpandedFormation, closer io.Closer) *FormationUpdates {
+	return &FormationUpdates{Chan: ch, conn: closer}
 }
 
 func (u *FormationUpdates) Close() error {
@@ -190,29 +351,30 @@ func (u *FormationUpdates) Close() error {
 	return u.conn.Close()
 }
 
+// StreamFormations sends formations updated since the given time, followed
+// by an empty formation once the existing formations have been sent and then
+// each formation as it changes. The returned error is set once the updates
+// channel is closed.
 func (c *Client) StreamFormations(since *time.Time) (*FormationUpdates, *error) {
 	if since == nil {
 		s := time.Unix(0, 0)
 		since = &s
 	}
-	dial := c.dial
-	if dial == nil {
-		dial = net.Dial
-	}
 	ch := make(chan *ct.ExpandedFormation)
-	conn, err := dial("tcp", c.addr)
+	in := make(chan *ct.ExpandedFormation)
+	stream, err := c.Stream("GET", "/formations?since="+url.QueryEscape(since.UTC().Format(time.RFC3339Nano)), in)
 	if err != nil {
 		close(ch)
-		return &FormationUpdates{ch, conn}, &err
+		return &FormationUpdates{Chan: ch}, &err
 	}
-	header := make(http.Header)
-	header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(":"+c.key)))
-	client, err := rpcplus.NewHTTPClient(conn, rpcplus.DefaultRPCPath, header)
-	if err != nil {
+	go func() {
+		for f := range in {
+			ch <- f
+		}
+		err = stream.Err()
 		close(ch)
-		return &FormationUpdates{ch, conn}, &err
-	}
-	return &FormationUpdates{ch, conn}, &client.StreamGo("Controller.StreamFormations", since, ch).Error
+	}()
+	return &FormationUpdates{Chan: ch, conn: stream}, &err
 }
 
 func (c *Client) CreateArtifact(artifact *ct.Artifact) error {
@@ -220,21 +382,73 @@ func (c *Client) CreateArtifact(artifact *ct.Artifact) error {
 }
 
 func (c *Client) CreateRelease(release *ct.Release) error {
-	return c.post("/releases", release, release)
+	return c.postIdempotent("/releases", release, release)
 }
 
 func (c *Client) CreateApp(app *ct.App) error {
-	return c.post("/apps", app, app)
+	return c.postIdempotent("/apps", app, app)
+}
+
+// CreateAppComplete creates the app, artifact, release and formation in a
+// single transaction so that a failure doesn't leave a partially created
+// app. artifact and formation may be nil, and the IDs of the created objects
+// are set on the arguments.
+func (c *Client) CreateAppComplete(app *ct.App, artifact *ct.Artifact, release *ct.Release, formation *ct.Formation) error {
+	data := &ct.AppComplete{App: app, Artifact: artifact, Release: release, Formation: formation}
+	return c.postIdempotent("/app_complete", data, data)
 }
 
-func (c *Client) DeleteApp(appID string) error {
-	return c.delete(fmt.Sprintf("/apps/%s", appID))
+// DeleteApp deletes the app. If force is false, the controller refuses to
+// delete a protected app, or an app with routes, scaled up formations,
+// resources or cron jobs, otherwise they are deleted along with the app.
+// Resources which no other app uses are deprovisioned once the app's
+// retention window has passed and it can no longer be restored.
+func (c *Client) DeleteApp(appID string, force bool) error {
+	path := fmt.Sprintf("/apps/%s", appID)
+	if force {
+		path += "?force=true"
+	}
+	return c.delete(path)
+}
+
+// UndeleteApp restores a deleted app along with the formations, resources,
+// cron jobs, log drains and routes deleted with it. Apps can only be
+// restored within the controller's retention window.
+func (c *Client) UndeleteApp(appID string) (*ct.App, error) {
+	app := &ct.App{}
+	return app, c.post(fmt.Sprintf("/apps/%s/undelete", appID), nil, app)
+}
+
+// TransferApp offers the app to the auth token with the ID to, which becomes
+// the app's owner once it accepts with AcceptAppTransfer.
+func (c *Client) TransferApp(appID, to string) (*ct.App, error) {
+	app := &ct.App{}
+	return app, c.post(fmt.Sprintf("/apps/%s/transfer", appID), &ct.AppTransfer{To: to}, app)
+}
+
+// AcceptAppTransfer makes the pending owner of the app its owner, it must be
+// called with the pending owner's token.
+func (c *Client) AcceptAppTransfer(appID string) (*ct.App, error) {
+	app := &ct.App{}
+	return app, c.post(fmt.Sprintf("/apps/%s/transfer/accept", appID), nil, app)
+}
+
+// CancelAppTransfer cancels or declines the transfer of the app.
+func (c *Client) CancelAppTransfer(appID string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/transfer", appID))
 }
 
 func (c *Client) CreateProvider(provider *ct.Provider) error {
 	return c.post("/providers", provider, provider)
 }
 
+// ProviderStatus asks the controller to probe the provider, an unreachable
+// provider is not an error and is instead reported in the returned status.
+func (c *Client) ProviderStatus(providerID string) (*ct.ProviderStatus, error) {
+	status := &ct.ProviderStatus{}
+	return status, c.get(fmt.Sprintf("/providers/%s/status", providerID), status)
+}
+
 func (c *Client) ProvisionResource(req *ct.ResourceReq) (*ct.Resource, error) {
 	if req.ProviderID == "" {
 		return nil, errors.New("controller: missing provider id")
@@ -244,18 +458,86 @@ func (c *Client) ProvisionResource(req *ct.ResourceReq) (*ct.Resource, error) {
 	return res, err
 }
 
+// PutResource creates or updates the resource, if resource.ETag is set the
+// update fails with ErrPreconditionFailed if the resource has been modified,
+// and if resource.Version is set it fails with ErrConflict.
 func (c *Client) PutResource(resource *ct.Resource) error {
 	if resource.ID == "" || resource.ProviderID == "" {
 		return errors.New("controller: missing id and/or provider id")
 	}
-	return c.put(fmt.Sprintf("/providers/%s/resources/%s", resource.ProviderID, resource.ID), resource, resource)
+	etag, err := c.sendIfMatch("PUT", fmt.Sprintf("/providers/%s/resources/%s", resource.ProviderID, resource.ID), resource.ETag, resource, resource)
+	resource.ETag = etag
+	return err
+}
+
+func (c *Client) GetResource(providerID, resourceID string) (*ct.Resource, error) {
+	res := &ct.Resource{}
+	etag, err := c.getETag(fmt.Sprintf("/providers/%s/resources/%s", providerID, resourceID), res)
+	res.ETag = etag
+	return res, err
+}
+
+// DeleteResource asks the provider to deprovision the resource, which is only
+// deleted once the provider has confirmed.
+func (c *Client) DeleteResource(providerID, resourceID string) error {
+	return c.delete(fmt.Sprintf("/providers/%s/resources/%s", providerID, resourceID))
+}
+
+// AddResourceApp binds the resource to the app so that it can be shared with
+// other apps, the updated resource is returned.
+func (c *Client) AddResourceApp(providerID, resourceID, appID string) (*ct.Resource, error) {
+	res := &ct.Resource{}
+	return res, c.put(fmt.Sprintf("/providers/%s/resources/%s/apps/%s", providerID, resourceID, appID), nil, res)
+}
+
+// RemoveResourceApp unbinds the resource from the app, the updated resource
+// is returned. Unbinding the last app deprovisions and deletes the resource.
+func (c *Client) RemoveResourceApp(providerID, resourceID, appID string) (*ct.Resource, error) {
+	res := &ct.Resource{}
+	return res, c.send("DELETE", fmt.Sprintf("/providers/%s/resources/%s/apps/%s", providerID, resourceID, appID), nil, res)
+}
+
+// AppResourceList returns the resources bound to the app, most recently
+// created first.
+func (c *Client) AppResourceList(appID string) ([]*ct.Resource, error) {
+	var resources []*ct.Resource
+	return resources, c.get(fmt.Sprintf("/apps/%s/resources", appID), &resources)
 }
 
+// PutFormation creates or updates the formation, if formation.ETag is set the
+// update fails with ErrPreconditionFailed if the formation has been modified,
+// and if formation.StateHash is set (as it is in formations returned by the
+// controller) it fails with ErrConflict if the formation has been scaled.
 func (c *Client) PutFormation(formation *ct.Formation) error {
+	return c.putFormation(formation, "")
+}
+
+// PutFormationForce is like PutFormation but also scales process types of a
+// protected app down to zero, which PutFormation refuses to do.
+func (c *Client) PutFormationForce(formation *ct.Formation) error {
+	return c.putFormation(formation, "?force=true")
+}
+
+func (c *Client) putFormation(formation *ct.Formation, query string) error {
 	if formation.AppID == "" || formation.ReleaseID == "" {
 		return errors.New("controller: missing app id and/or release id")
 	}
-	return c.put(fmt.Sprintf("/apps/%s/formations/%s", formation.AppID, formation.ReleaseID), formation, formation)
+	etag, err := c.sendIfMatch("PUT", fmt.Sprintf("/apps/%s/formations/%s%s", formation.AppID, formation.ReleaseID, query), formation.ETag, formation, formation)
+	formation.ETag = etag
+	return err
+}
+
+// UpdateFormations sets the process counts of the formations in the batch,
+// either all of them are updated or none are. The updated formations are
+// returned in the order of the batch. With force, process types of protected
+// apps can be scaled down to zero.
+func (c *Client) UpdateFormations(batch []*ct.FormationScale, force bool) ([]*ct.Formation, error) {
+	path := "/formations"
+	if force {
+		path += "?force=true"
+	}
+	var formations []*ct.Formation
+	return formations, c.put(path, &ct.FormationBatch{Formations: batch}, &formations)
 }
 
 func (c *Client) PutJob(job *ct.Job) error {
@@ -265,19 +547,73 @@ func (c *Client) PutJob(job *ct.Job) error {
 	return c.put(fmt.Sprintf("/apps/%s/jobs/%s", job.AppID, job.ID), job, job)
 }
 
+// DeleteJob stops the job by asking the host it is running on to kill it.
 func (c *Client) DeleteJob(appID, jobID string) error {
 	return c.delete(fmt.Sprintf("/apps/%s/jobs/%s", appID, jobID))
 }
 
+// SignalJob sends the signal sig to the job via the host it is running on.
+func (c *Client) SignalJob(appID, jobID string, sig int) error {
+	return c.post(fmt.Sprintf("/apps/%s/jobs/%s/signal/%d", appID, jobID, sig), nil, nil)
+}
+
+// SetAppRelease sets the current release of the app, carrying over the
+// process counts of the app's formation if it only has one.
 func (c *Client) SetAppRelease(appID, releaseID string) error {
 	return c.put(fmt.Sprintf("/apps/%s/release", appID), &ct.Release{ID: releaseID}, nil)
 }
 
+// GetAppRelease returns the current release of the app, ErrNotFound is
+// returned if no release has been set.
 func (c *Client) GetAppRelease(appID string) (*ct.Release, error) {
 	release := &ct.Release{}
 	return release, c.get(fmt.Sprintf("/apps/%s/release", appID), release)
 }
 
+// AppReleaseList returns the releases that have been used by the app, most
+// recent first.
+func (c *Client) AppReleaseList(appID string) ([]*ct.Release, error) {
+	var releases []*ct.Release
+	return releases, c.get(fmt.Sprintf("/apps/%s/releases", appID), &releases)
+}
+
+// ReleaseDiff returns the env and process changes between the releases from
+// and to, leaving out env values if redact is set.
+func (c *Client) ReleaseDiff(appID, from, to string, redact bool) (*ct.ReleaseDiff, error) {
+	path := fmt.Sprintf("/apps/%s/releases/%s/diff/%s", appID, from, to)
+	if redact {
+		path += "?redact=true"
+	}
+	diff := &ct.ReleaseDiff{}
+	return diff, c.get(path, diff)
+}
+
+// GetAppEnv returns the app level environment of the app.
+func (c *Client) GetAppEnv(appID string) (*ct.AppEnv, error) {
+	env := &ct.AppEnv{}
+	return env, c.get(fmt.Sprintf("/apps/%s/env", appID), env)
+}
+
+// UpdateAppEnv sets and unsets variables of the app level environment,
+// returning the resulting environment and the ID of the release created if
+// update.NewRelease is set.
+func (c *Client) UpdateAppEnv(appID string, update *ct.EnvUpdate) (*ct.AppEnv, error) {
+	env := &ct.AppEnv{}
+	return env, c.post(fmt.Sprintf("/apps/%s/env", appID), update, env)
+}
+
+// GetAppQuota returns the quota of the app, zero fields are unlimited.
+func (c *Client) GetAppQuota(appID string) (*ct.AppQuota, error) {
+	quota := &ct.AppQuota{}
+	return quota, c.get(fmt.Sprintf("/apps/%s/quota", appID), quota)
+}
+
+// UpdateAppQuota replaces the quota of the app. Requests which would take
+// the app over its quota fail with a ct.QuotaError.
+func (c *Client) UpdateAppQuota(appID string, quota *ct.AppQuota) error {
+	return c.put(fmt.Sprintf("/apps/%s/quota", appID), quota, quota)
+}
+
 func (c *Client) RouteList(appID string) ([]*router.Route, error) {
 	var routes []*router.Route
 	return routes, c.get(fmt.Sprintf("/apps/%s/routes", appID), &routes)
@@ -292,13 +628,58 @@ func (c *Client) CreateRoute(appID string, route *router.Route) error {
 	return c.post(fmt.Sprintf("/apps/%s/routes", appID), route, route)
 }
 
+// CreateHTTPRoute creates an HTTP route for the app and returns the created
+// route, including the fields populated by the router.
+func (c *Client) CreateHTTPRoute(appID string, route *router.HTTPRoute) (*router.HTTPRoute, error) {
+	r := route.ToRoute()
+	if err := c.CreateRoute(appID, r); err != nil {
+		return nil, err
+	}
+	return r.HTTPRoute(), nil
+}
+
+// CreateTCPRoute creates a TCP route for the app and returns the created
+// route, including the port allocated by the router if none was specified.
+func (c *Client) CreateTCPRoute(appID string, route *router.TCPRoute) (*router.TCPRoute, error) {
+	r := route.ToRoute()
+	if err := c.CreateRoute(appID, r); err != nil {
+		return nil, err
+	}
+	return r.TCPRoute(), nil
+}
+
 func (c *Client) DeleteRoute(appID string, routeID string) error {
 	return c.delete(fmt.Sprintf("/apps/%s/routes/%s", appID, routeID))
 }
 
 func (c *Client) GetFormation(appID, releaseID string) (*ct.Formation, error) {
 	formation := &ct.Formation{}
-	return formation, c.get(fmt.Sprintf("/apps/%s/formations/%s", appID, releaseID), formation)
+	etag, err := c.getETag(fmt.Sprintf("/apps/%s/formations/%s", appID, releaseID), formation)
+	formation.ETag = etag
+	return formation, err
+}
+
+// DeleteFormation deletes the formation. If force is false, the controller
+// refuses to delete a formation of a protected app which has jobs.
+func (c *Client) DeleteFormation(appID, releaseID string, force bool) error {
+	path := fmt.Sprintf("/apps/%s/formations/%s", appID, releaseID)
+	if force {
+		path += "?force=true"
+	}
+	return c.delete(path)
+}
+
+func (c *Client) FormationList(appID string) ([]*ct.Formation, error) {
+	var formations []*ct.Formation
+	return formations, c.get(fmt.Sprintf("/apps/%s/formations", appID), &formations)
+}
+
+// AppProcesses returns the desired number of jobs of each of the app's
+// process types along with the number running, starting and recently
+// crashed.
+func (c *Client) AppProcesses(appID string) ([]*ct.ProcessStatus, error) {
+	var processes []*ct.ProcessStatus
+	return processes, c.get(fmt.Sprintf("/apps/%s/processes", appID), &processes)
 }
 
 func (c *Client) GetRelease(releaseID string) (*ct.Release, error) {
@@ -311,59 +692,464 @@ func (c *Client) GetArtifact(artifactID string) (*ct.Artifact, error) {
 	return artifact, c.get(fmt.Sprintf("/artifacts/%s", artifactID), artifact)
 }
 
+// DeleteRelease deletes the release, the controller refuses to delete the
+// current release of an app. If cascade is false, a release with formations
+// is not deleted, otherwise the formations are deleted along with the
+// release's artifact if no other release uses it.
+func (c *Client) DeleteRelease(releaseID string, cascade bool) error {
+	path := fmt.Sprintf("/releases/%s", releaseID)
+	if cascade {
+		path += "?cascade=true"
+	}
+	return c.delete(path)
+}
+
+// DeleteArtifact deletes the artifact, the controller refuses to delete an
+// artifact that is used by a release.
+func (c *Client) DeleteArtifact(artifactID string) error {
+	return c.delete(fmt.Sprintf("/artifacts/%s", artifactID))
+}
+
 func (c *Client) GetApp(appID string) (*ct.App, error) {
 	app := &ct.App{}
-	return app, c.get(fmt.Sprintf("/apps/%s", appID), app)
+	etag, err := c.getETag(fmt.Sprintf("/apps/%s", appID), app)
+	app.ETag = etag
+	return app, err
 }
 
-type sseDecoder struct {
-	*bufio.Reader
+// AppUpdate lists the changes made to an app by UpdateApp, nil fields are
+// left unchanged.
+type AppUpdate struct {
+	Protected   *bool
+	Maintenance *bool
+	Meta        map[string]string
+	Labels      map[string]string
+
+	// ETag, if set, makes the update fail with ErrPreconditionFailed if the
+	// app has been modified since it was retrieved, and Version, if set,
+	// makes it fail with ErrConflict.
+	ETag    string
+	Version int64
 }
 
-// Decode finds the next "data" field and decodes it into v
-func (dec *sseDecoder) Decode(v interface{}) error {
-	for {
-		line, err := dec.ReadBytes('\n')
-		if err != nil {
-			return err
-		}
-		if bytes.HasPrefix(line, []byte("data: ")) {
-			data := bytes.TrimPrefix(line, []byte("data: "))
-			return json.Unmarshal(data, v)
-		}
+// UpdateApp applies the update to the app and returns the updated app.
+func (c *Client) UpdateApp(appID string, update *AppUpdate) (*ct.App, error) {
+	if appID == "" {
+		return nil, errors.New("controller: missing id")
+	}
+	data := make(map[string]interface{})
+	if update.Protected != nil {
+		data["protected"] = *update.Protected
+	}
+	if update.Maintenance != nil {
+		data["maintenance"] = *update.Maintenance
+	}
+	if update.Version != 0 {
+		data["version"] = update.Version
+	}
+	if update.Meta != nil {
+		data["meta"] = update.Meta
+	}
+	if update.Labels != nil {
+		data["labels"] = update.Labels
+	}
+	app := &ct.App{}
+	etag, err := c.sendIfMatch("POST", fmt.Sprintf("/apps/%s", appID), update.ETag, data, app)
+	if err != nil {
+		return nil, err
 	}
+	app.ETag = etag
+	return app, nil
 }
 
 type JobEventStream struct {
 	Events chan *ct.JobEvent
-	body   io.ReadCloser
+	stream Stream
+}
+
+// NewJobEventStream returns a stream of the events sent to events by stream.
+// It is used by other implementations of Interface.
+func NewJobEventStream(events chan *ct.JobEvent, stream Stream) *JobEventStream {
+	return &JobEventStream{Events: events, stream: stream}
 }
 
 func (s *JobEventStream) Close() {
-	s.body.Close()
+	s.stream.Close()
 }
 
 func (c *Client) StreamJobEvents(appID string) (*JobEventStream, error) {
-	res, err := c.rawReq("GET", fmt.Sprintf("/apps/%s/jobs", appID), http.Header{"Accept": []string{"text/event-stream"}}, nil, nil)
+	events := make(chan *ct.JobEvent)
+	stream, err := c.Stream("GET", fmt.Sprintf("/apps/%s/jobs", appID), events)
 	if err != nil {
 		return nil, err
 	}
-	stream := &JobEventStream{Events: make(chan *ct.JobEvent), body: res.Body}
-	go func() {
-		defer close(stream.Events)
-		dec := &sseDecoder{bufio.NewReader(stream.body)}
+	return &JobEventStream{Events: events, stream: stream}, nil
+}
+
+func (c *Client) CreateDeployment(deployment *ct.Deployment) error {
+	if deployment.AppID == "" || deployment.NewReleaseID == "" {
+		return errors.New("controller: missing app id and/or new release id")
+	}
+	return c.postIdempotent(fmt.Sprintf("/apps/%s/deploy", deployment.AppID), deployment, deployment)
+}
+
+func (c *Client) GetDeployment(appID, deploymentID string) (*ct.Deployment, error) {
+	deployment := &ct.Deployment{}
+	return deployment, c.get(fmt.Sprintf("/apps/%s/deployments/%s", appID, deploymentID), deployment)
+}
+
+// RollbackApp returns the app to the release, or to the release it had before
+// its current release if releaseID is empty. The returned deployment records
+// the rollback.
+func (c *Client) RollbackApp(appID, releaseID string) (*ct.Deployment, error) {
+	deployment := &ct.Deployment{}
+	return deployment, c.post(fmt.Sprintf("/apps/%s/rollback", appID), &ct.Rollback{ReleaseID: releaseID}, deployment)
+}
+
+// PromoteApp deploys a copy of the app's current release to the promotion's
+// target app, returning the deployment to the target app.
+func (c *Client) PromoteApp(appID string, promotion *ct.Promotion) (*ct.Deployment, error) {
+	deployment := &ct.Deployment{}
+	return deployment, c.postIdempotent(fmt.Sprintf("/apps/%s/promote", appID), promotion, deployment)
+}
+
+// PutAutoscalePolicy creates or replaces the policy which scales the app's
+// process type.
+func (c *Client) PutAutoscalePolicy(policy *ct.AutoscalePolicy) error {
+	if policy.AppID == "" || policy.ProcessType == "" {
+		return errors.New("controller: missing app id and/or process type")
+	}
+	return c.put(fmt.Sprintf("/apps/%s/autoscale/%s", policy.AppID, policy.ProcessType), policy, policy)
+}
+
+func (c *Client) AutoscalePolicyList(appID string) ([]*ct.AutoscalePolicy, error) {
+	var policies []*ct.AutoscalePolicy
+	return policies, c.get(fmt.Sprintf("/apps/%s/autoscale", appID), &policies)
+}
+
+func (c *Client) DeleteAutoscalePolicy(appID, processType string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/autoscale/%s", appID, processType))
+}
+
+// CreateCronJob creates a cron job which runs a one-off job of the app's
+// current release on the cron job's schedule.
+func (c *Client) CreateCronJob(cronJob *ct.CronJob) error {
+	if cronJob.AppID == "" {
+		return errors.New("controller: missing app id")
+	}
+	return c.post(fmt.Sprintf("/apps/%s/cron_jobs", cronJob.AppID), cronJob, cronJob)
+}
+
+func (c *Client) CronJobList(appID string) ([]*ct.CronJob, error) {
+	var cronJobs []*ct.CronJob
+	return cronJobs, c.get(fmt.Sprintf("/apps/%s/cron_jobs", appID), &cronJobs)
+}
+
+func (c *Client) GetCronJob(appID, cronJobID string) (*ct.CronJob, error) {
+	cronJob := &ct.CronJob{}
+	return cronJob, c.get(fmt.Sprintf("/apps/%s/cron_jobs/%s", appID, cronJobID), cronJob)
+}
+
+func (c *Client) DeleteCronJob(appID, cronJobID string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/cron_jobs/%s", appID, cronJobID))
+}
+
+// CronJobRunList returns the runs of the cron job, most recent first.
+func (c *Client) CronJobRunList(appID, cronJobID string) ([]*ct.CronJobRun, error) {
+	var runs []*ct.CronJobRun
+	return runs, c.get(fmt.Sprintf("/apps/%s/cron_jobs/%s/runs", appID, cronJobID), &runs)
+}
+
+// CreateLogDrain adds a log drain to the app, the output of the app's jobs
+// which start after it is added is forwarded to it.
+func (c *Client) CreateLogDrain(drain *ct.LogDrain) error {
+	if drain.AppID == "" {
+		return errors.New("controller: missing app id")
+	}
+	return c.post(fmt.Sprintf("/apps/%s/log_drains", drain.AppID), drain, drain)
+}
+
+func (c *Client) LogDrainList(appID string) ([]*ct.LogDrain, error) {
+	var drains []*ct.LogDrain
+	return drains, c.get(fmt.Sprintf("/apps/%s/log_drains", appID), &drains)
+}
+
+func (c *Client) GetLogDrain(appID, drainID string) (*ct.LogDrain, error) {
+	drain := &ct.LogDrain{}
+	return drain, c.get(fmt.Sprintf("/apps/%s/log_drains/%s", appID, drainID), drain)
+}
+
+func (c *Client) DeleteLogDrain(appID, drainID string) error {
+	return c.delete(fmt.Sprintf("/apps/%s/log_drains/%s", appID, drainID))
+}
+
+// StreamDeployment sends events for the given deployment to ch until the
+// deployment finishes or the stream is closed, ch is closed when the stream
+// ends.
+func (c *Client) StreamDeployment(appID, deploymentID string, ch chan<- *ct.DeploymentEvent) (Stream, error) {
+	return c.Stream("GET", fmt.Sprintf("/apps/%s/deployments/%s", appID, deploymentID), ch)
+}
+
+// ListEventsOptions filters the events returned by ListEvents.
+type ListEventsOptions struct {
+	// AppID limits events to those for the given app.
+	AppID string
+
+	// ObjectTypes limits events to those for the given object types.
+	ObjectTypes []string
+
+	// SinceID limits events to those after the event with the given ID.
+	SinceID int64
+
+	// Since and Until limit events to those created in the time range,
+	// zero times are ignored.
+	Since time.Time
+	Until time.Time
+
+	// Count is the maximum number of events to return, the controller
+	// defaults to 100.
+	Count int
+}
+
+// ListEvents returns the events matching opts, most recent first.
+func (c *Client) ListEvents(opts ListEventsOptions) ([]*ct.Event, error) {
+	query := url.Values{}
+	if opts.AppID != "" {
+		query.Set("app_id", opts.AppID)
+	}
+	if len(opts.ObjectTypes) > 0 {
+		query.Set("object_types", strings.Join(opts.ObjectTypes, ","))
+	}
+	if opts.SinceID > 0 {
+		query.Set("since_id", strconv.FormatInt(opts.SinceID, 10))
+	}
+	if !opts.Since.IsZero() {
+		query.Set("since", opts.Since.Format(time.RFC3339Nano))
+	}
+	if !opts.Until.IsZero() {
+		query.Set("until", opts.Until.Format(time.RFC3339Nano))
+	}
+	if opts.Count > 0 {
+		query.Set("count", strconv.Itoa(opts.Count))
+	}
+	var events []*ct.Event
+	return events, c.get("/events?"+query.Encode(), &events)
+}
+
+// AuditLogOptions filters the entries returned by AuditLog.
+type AuditLogOptions struct {
+	// Actor limits entries to requests made with the given credential.
+	Actor string
+
+	// ObjectType and ObjectID limit entries to requests which changed the
+	// given object.
+	ObjectType string
+	ObjectID   string
+
+	// BeforeID limits entries to those before the entry with the given ID,
+	// it is used to page through the log.
+	BeforeID int64
+
+	// Since and Until limit entries to those recorded in the time range,
+	// zero times are ignored.
+	Since time.Time
+	Until time.Time
+
+	// Count is the maximum number of entries to return, the controller
+	// defaults to 100.
+	Count int
+}
+
+// AuditLog returns the audit log entries matching opts, most recent first.
+func (c *Client) AuditLog(opts AuditLogOptions) ([]*ct.AuditEntry, error) {
+	query := url.Values{}
+	if opts.Actor != "" {
+		query.Set("actor", opts.Actor)
+	}
+	if opts.ObjectType != "" {
+		query.Set("object_type", opts.ObjectType)
+	}
+	if opts.ObjectID != "" {
+		query.Set("object_id", opts.ObjectID)
+	}
+	if opts.BeforeID > 0 {
+		query.Set("before_id", strconv.FormatInt(opts.BeforeID, 10))
+	}
+	if !opts.Since.IsZero() {
+		query.Set("since", opts.Since.Format(time.RFC3339Nano))
+	}
+	if !opts.Until.IsZero() {
+		query.Set("until", opts.Until.Format(time.RFC3339Nano))
+	}
+	if opts.Count > 0 {
+		query.Set("count", strconv.Itoa(opts.Count))
+	}
+	var entries []*ct.AuditEntry
+	return entries, c.get("/audit?"+query.Encode(), &entries)
+}
+
+// StreamEventsOptions filters the events sent by StreamEvents.
+type StreamEventsOptions struct {
+	// AppID limits events to those for the given app.
+	AppID string
+
+	// ObjectTypes limits events to those for the given object types (for
+	// example ct.EventTypeJob).
+	ObjectTypes []string
+
+	// Since is the ID of the last event seen, only later events are sent.
+	Since int64
+}
+
+// StreamEvents sends events matching opts to ch until the stream is closed,
+// ch is closed when the stream ends. If the connection to the controller is
+// lost the stream reconnects and resumes after the last event received.
+func (c *Client) StreamEvents(opts StreamEventsOptions, ch chan<- *ct.Event) (Stream, error) {
+	if c.longPoll {
+		return c.pollEvents(opts, ch)
+	}
+	stream := &eventStream{c: c, opts: opts, ch: ch, done: make(chan struct{})}
+	if err := stream.connect(); err != nil {
+		return nil, err
+	}
+	go stream.run()
+	return stream, nil
+}
+
+var errStreamClosed = errors.New("controller: stream closed")
+
+type eventStream struct {
+	c    *Client
+	opts StreamEventsOptions
+	ch   chan<- *ct.Event
+
+	mtx    sync.Mutex
+	body   io.ReadCloser
+	closed bool
+	done   chan struct{}
+	err    error
+}
+
+func (s *eventStream) connect() error {
+	if s.isClosed() {
+		return errStreamClosed
+	}
+	query := url.Values{}
+	if s.opts.AppID != "" {
+		query.Set("app_id", s.opts.AppID)
+	}
+	if len(s.opts.ObjectTypes) > 0 {
+		query.Set("object_types", strings.Join(s.opts.ObjectTypes, ","))
+	}
+	header := http.Header{"Accept": []string{"text/event-stream"}}
+	if s.opts.Since > 0 {
+		header.Set("Last-Event-Id", strconv.FormatInt(s.opts.Since, 10))
+	}
+	path := "/events"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	res, err := s.c.rawReq("GET", path, header, nil, nil)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		res.Body.Close()
+		return errStreamClosed
+	}
+	s.body = res.Body
+	return nil
+}
+
+func (s *eventStream) run() {
+	defer close(s.ch)
+	var reconnect *retryAttempt
+	for {
+		s.mtx.Lock()
+		body := s.body
+		s.mtx.Unlock()
+
+		dec := &sseDecoder{bufio.NewReader(body)}
 		for {
-			event := &ct.JobEvent{}
+			event := &ct.Event{}
 			if err := dec.Decode(event); err != nil {
-				return
+				break
 			}
-			stream.Events <- event
+			s.opts.Since = event.ID
+			s.ch <- event
+			reconnect = nil
 		}
-	}()
-	return stream, nil
+		body.Close()
+
+		// the connection was closed or lost, wait before reconnecting so
+		// that a controller or proxy which closes the stream straight away
+		// is not hammered with requests, the delay is reset once an event
+		// is received
+		if reconnect == nil {
+			reconnect = s.reconnectAttempt()
+		}
+		select {
+		case <-time.After(reconnect.jitteredDelay()):
+			reconnect.backoff()
+		case <-s.done:
+			return
+		}
+
+		// reconnect unless Close was called (connection retries are
+		// handled by the client's retry policy)
+		if err := s.connect(); err != nil {
+			if err != errStreamClosed {
+				s.mtx.Lock()
+				s.err = err
+				s.mtx.Unlock()
+			}
+			return
+		}
+	}
+}
+
+// reconnectAttempt returns the delays between reconnects, which follow the
+// client's retry policy without its MaxElapsed limit, as the stream
+// reconnects until it is closed.
+func (s *eventStream) reconnectAttempt() *retryAttempt {
+	p := s.c.retry
+	if p.InitialDelay <= 0 {
+		p.InitialDelay = DefaultRetryPolicy.InitialDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	return &retryAttempt{policy: p, start: time.Now(), delay: p.InitialDelay}
+}
+
+func (s *eventStream) isClosed() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.closed
+}
+
+func (s *eventStream) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	return s.body.Close()
+}
+
+func (s *eventStream) Err() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.err
 }
 
 func (c *Client) GetJobLog(appID, jobID string, tail bool) (io.ReadCloser, error) {
+	if c.longPoll {
+		return c.pollJobLog(appID, jobID, tail)
+	}
 	path := fmt.Sprintf("/apps/%s/jobs/%s/log", appID, jobID)
 	if tail {
 		path += "?tail=true"
@@ -375,30 +1161,180 @@ func (c *Client) GetJobLog(appID, jobID string, tail bool) (io.ReadCloser, error
 	return res.Body, nil
 }
 
+// GetAppLog returns a stream of the combined output of the app's jobs, the
+// stream consists of JSON encoded ct.AppLogLine values ordered by the time
+// they were written. If lines is greater than zero only that many existing
+// lines are returned, and if follow is true the stream continues with new
+// output as it is written.
+func (c *Client) GetAppLog(appID string, lines int, follow bool) (io.ReadCloser, error) {
+	query := url.Values{}
+	if lines > 0 {
+		query.Set("lines", strconv.Itoa(lines))
+	}
+	if follow {
+		query.Set("follow", "true")
+	}
+	path := fmt.Sprintf("/apps/%s/log", appID)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	res, err := c.rawReq("GET", path, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// GCApp deletes the app's releases other than the keep most recent ones,
+// along with their formations and artifacts. Releases in use are never
+// deleted, and if keep is zero the controller's default is used.
+func (c *Client) GCApp(appID string, keep int) (*ct.AppGCResult, error) {
+	path := fmt.Sprintf("/apps/%s/gc", appID)
+	if keep > 0 {
+		path += "?keep=" + strconv.Itoa(keep)
+	}
+	res := &ct.AppGCResult{}
+	return res, c.post(path, nil, res)
+}
+
+// GC deletes the releases of all apps other than the keep most recent ones,
+// artifacts which are no longer used and the blobstore files of deleted
+// artifacts and releases. If keep is zero the controller's default is used.
+func (c *Client) GC(keep int) (*ct.GCResult, error) {
+	path := "/gc"
+	if keep > 0 {
+		path += "?keep=" + strconv.Itoa(keep)
+	}
+	res := &ct.GCResult{}
+	return res, c.post(path, nil, res)
+}
+
+// GetClusterInfo returns the controller version, default route domain and
+// supported API features.
+func (c *Client) GetClusterInfo() (*ct.ClusterInfo, error) {
+	info := &ct.ClusterInfo{}
+	return info, c.get("/cluster", info)
+}
+
+// GetCACert returns the PEM encoded CA certificate used to verify the
+// controller's TLS certificate, ErrNotFound is returned if the controller
+// was not configured with one.
+func (c *Client) GetCACert() ([]byte, error) {
+	res, err := c.rawReq("GET", "/ca-cert", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+// GetHealth runs the controller's health checks. A controller which fails
+// them responds with a 503 status, which is not an error as the result
+// explains the failure.
+func (c *Client) GetHealth() (*ct.Health, error) {
+	req, err := http.NewRequest("GET", c.url+"/health", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(req, "/health")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 503 {
+		return nil, &url.Error{
+			Op:  req.Method,
+			URL: req.URL.String(),
+			Err: fmt.Errorf("controller: unexpected status %d", res.StatusCode),
+		}
+	}
+	health := &ct.Health{}
+	return health, json.NewDecoder(res.Body).Decode(health)
+}
+
+// Export returns a tar archive of the cluster's apps, artifacts, releases,
+// formations, providers, resources and routes. Each is a JSON array in a
+// file named after it, for example apps.json, with apps encoded as
+// ct.ExportedApp. The controller's objects are a consistent snapshot, routes
+// are read from the router afterwards.
+func (c *Client) Export() (io.ReadCloser, error) {
+	res, err := c.rawReq("GET", "/export", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Import recreates the objects of an archive returned by Export, keeping
+// their IDs. conflicts is one of the ct.ImportConflict policies and decides
+// what happens to objects which already exist, it defaults to skipping them.
+func (c *Client) Import(archive io.Reader, conflicts string) (*ct.ImportResult, error) {
+	path := "/import"
+	if conflicts != "" {
+		path += "?conflicts=" + url.QueryEscape(conflicts)
+	}
+	header := http.Header{"Content-Type": []string{"application/x-tar"}}
+	res := &ct.ImportResult{}
+	if _, err := c.rawReq("POST", path, header, archive, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RunJobAttached runs a one-off job in the app and returns a connection that
+// speaks the attach protocol, stdin is written to the connection and the
+// job's output is read from it.
 func (c *Client) RunJobAttached(appID string, job *ct.NewJob) (utils.ReadWriteCloser, error) {
 	data, err := toJSON(job)
 	if err != nil {
 		return nil, err
 	}
 	req, err := http.NewRequest("POST", fmt.Sprintf("%s/apps/%s/jobs", c.url, appID), data)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/vnd.flynn.attach")
 	req.SetBasicAuth("", c.key)
-	var dial rpcplus.DialFunc
-	if c.dial != nil {
-		dial = c.dial
+	res, rwc, err := utils.HijackRequest(req, c.dial)
+	if err != nil {
+		if res != nil {
+			res.Body.Close()
+		}
+		return nil, err
 	}
-	res, rwc, err := utils.HijackRequest(req, dial)
+	return rwc, nil
+}
+
+// ExecJob runs a command in the container of one of the app's running jobs
+// and returns a connection that speaks the attach protocol, like
+// RunJobAttached.
+func (c *Client) ExecJob(appID, jobID string, exec *ct.JobExec) (utils.ReadWriteCloser, error) {
+	data, err := toJSON(exec)
 	if err != nil {
-		res.Body.Close()
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/apps/%s/jobs/%s/exec", c.url, appID, jobID), data)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/vnd.flynn.attach")
+	req.SetBasicAuth("", c.key)
+	res, rwc, err := utils.HijackRequest(req, c.dial)
+	if err != nil {
+		if res != nil {
+			res.Body.Close()
+		}
 		return nil, err
 	}
 	return rwc, nil
 }
 
+// RunJobDetached runs a one-off job in the app without attaching to it.
 func (c *Client) RunJobDetached(appID string, req *ct.NewJob) (*ct.Job, error) {
 	job := &ct.Job{}
-	return job, c.post(fmt.Sprintf("/apps/%s/jobs", appID), req, job)
+	return job, c.postIdempotent(fmt.Sprintf("/apps/%s/jobs", appID), req, job)
 }
 
 func (c *Client) JobList(appID string) ([]*ct.Job, error) {
@@ -406,11 +1342,30 @@ func (c *Client) JobList(appID string) ([]*ct.Job, error) {
 	return jobs, c.get(fmt.Sprintf("/apps/%s/jobs", appID), &jobs)
 }
 
+// GetJob returns the job along with its state on the host running it.
+func (c *Client) GetJob(appID, jobID string) (*ct.JobDetail, error) {
+	job := &ct.JobDetail{}
+	return job, c.get(fmt.Sprintf("/apps/%s/jobs/%s", appID, jobID), job)
+}
+
+// JobStats returns the resource usage of a running job.
+func (c *Client) JobStats(appID, jobID string) (*host.JobStats, error) {
+	stats := &host.JobStats{}
+	return stats, c.get(fmt.Sprintf("/apps/%s/jobs/%s/stats", appID, jobID), stats)
+}
+
 func (c *Client) AppList() ([]*ct.App, error) {
 	var apps []*ct.App
 	return apps, c.get("/apps", &apps)
 }
 
+// AppListSelector returns the apps whose labels match the label selector,
+// for example "env=production,team=payments" (see ct.ParseLabelSelector).
+func (c *Client) AppListSelector(selector string) ([]*ct.App, error) {
+	var apps []*ct.App
+	return apps, c.get("/apps?selector="+url.QueryEscape(selector), &apps)
+}
+
 func (c *Client) KeyList() ([]*ct.Key, error) {
 	var keys []*ct.Key
 	return keys, c.get("/keys", &keys)
@@ -425,6 +1380,54 @@ func (c *Client) DeleteKey(id string) error {
 	return c.delete("/keys/" + strings.Replace(id, ":", "", -1))
 }
 
+// AuthTokenList returns the tokens which have not been revoked, without
+// their secrets.
+func (c *Client) AuthTokenList() ([]*ct.AuthToken, error) {
+	var tokens []*ct.AuthToken
+	return tokens, c.get("/auth_tokens", &tokens)
+}
+
+// CreateAuthToken creates the token, setting token.Token to the secret used
+// to authenticate with it.
+func (c *Client) CreateAuthToken(token *ct.AuthToken) error {
+	return c.post("/auth_tokens", token, token)
+}
+
+// DeleteAuthToken revokes the token.
+func (c *Client) DeleteAuthToken(id string) error {
+	return c.delete("/auth_tokens/" + id)
+}
+
+// CreateWebhook creates the webhook, setting webhook.Secret to the key used
+// to sign its requests if it was not set.
+func (c *Client) CreateWebhook(webhook *ct.Webhook) error {
+	return c.post("/webhooks", webhook, webhook)
+}
+
+// WebhookList returns the webhooks, without their secrets.
+func (c *Client) WebhookList() ([]*ct.Webhook, error) {
+	var webhooks []*ct.Webhook
+	return webhooks, c.get("/webhooks", &webhooks)
+}
+
+func (c *Client) GetWebhook(id string) (*ct.Webhook, error) {
+	webhook := &ct.Webhook{}
+	return webhook, c.get("/webhooks/"+id, webhook)
+}
+
+// DeleteWebhook deletes the webhook, deliveries which have not been sent
+// are failed.
+func (c *Client) DeleteWebhook(id string) error {
+	return c.delete("/webhooks/" + id)
+}
+
+// WebhookDeliveryList returns the webhook's most recent deliveries, newest
+// first.
+func (c *Client) WebhookDeliveryList(id string) ([]*ct.WebhookDelivery, error) {
+	var deliveries []*ct.WebhookDelivery
+	return deliveries, c.get(fmt.Sprintf("/webhooks/%s/deliveries", id), &deliveries)
+}
+
 func (c *Client) ProviderList() ([]*ct.Provider, error) {
 	var providers []*ct.Provider
 	return providers, c.get("/providers", &providers)
@@ -0,0 +1,588 @@
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/pinned"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+func newTestClient(c *C, h http.Handler) (*Client, *httptest.Server) {
+	srv := httptest.NewServer(h)
+	client, err := NewClient(srv.URL, "test")
+	c.Assert(err, IsNil)
+	return client, srv
+}
+
+func (S) TestRetryIdempotent(c *C) {
+	var requests int32
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(503)
+			return
+		}
+		w.Write([]byte(`{"id":"foo"}`))
+	}))
+	defer srv.Close()
+	client.SetRetryPolicy(RetryPolicy{MaxElapsed: time.Second, InitialDelay: time.Millisecond, Jitter: 0.5})
+
+	app, err := client.GetApp("foo")
+	c.Assert(err, IsNil)
+	c.Assert(app.ID, Equals, "foo")
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(3))
+}
+
+func (S) TestRetryNonIdempotent(c *C) {
+	var requests int32
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(503)
+	}))
+	defer srv.Close()
+	client.SetRetryPolicy(RetryPolicy{MaxElapsed: time.Second, InitialDelay: time.Millisecond})
+
+	c.Assert(client.CreateArtifact(&ct.Artifact{}), NotNil)
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(1))
+}
+
+func (S) TestRetryIdempotencyKey(c *C) {
+	var keys []string
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		switch len(keys) {
+		case 1:
+			w.WriteHeader(503)
+		case 2:
+			// the first attempt is still being handled
+			w.WriteHeader(409)
+		default:
+			w.Write([]byte(`{"id":"foo"}`))
+		}
+	}))
+	defer srv.Close()
+	client.SetRetryPolicy(RetryPolicy{MaxElapsed: time.Second, InitialDelay: time.Millisecond})
+
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	c.Assert(app.ID, Equals, "foo")
+	c.Assert(keys, HasLen, 3)
+	c.Assert(keys[0], Not(Equals), "")
+	c.Assert(keys[1], Equals, keys[0])
+	c.Assert(keys[2], Equals, keys[0])
+
+	// each call uses a new key
+	c.Assert(client.CreateApp(&ct.App{}), IsNil)
+	c.Assert(keys[3], Not(Equals), keys[0])
+}
+
+func (S) TestRetryMaxElapsed(c *C) {
+	var requests int32
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(502)
+	}))
+	defer srv.Close()
+	client.SetRetryPolicy(RetryPolicy{MaxElapsed: 50 * time.Millisecond, InitialDelay: 10 * time.Millisecond})
+
+	_, err := client.GetApp("foo")
+	c.Assert(err, NotNil)
+	n := atomic.LoadInt32(&requests)
+	c.Assert(n > 1 && n < 10, Equals, true, Commentf("requests: %d", n))
+}
+
+func (S) TestStreamDeployment(c *C) {
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.URL.Path, Equals, "/apps/foo/deployments/bar")
+		c.Assert(r.Header.Get("Accept"), Equals, "text/event-stream")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(":\n\ndata: {\"deployment\":\"bar\",\"status\":\"running\"}\n\ndata: {\"deployment\":\"bar\",\"status\":\"complete\"}\n\n"))
+	}))
+	defer srv.Close()
+
+	events := make(chan *ct.DeploymentEvent)
+	stream, err := client.StreamDeployment("foo", "bar", events)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	var statuses []string
+	for e := range events {
+		c.Assert(e.DeploymentID, Equals, "bar")
+		statuses = append(statuses, e.Status)
+	}
+	c.Assert(statuses, DeepEquals, []string{"running", "complete"})
+	c.Assert(stream.Err(), IsNil)
+}
+
+func (S) TestAppRelease(c *C) {
+	var release string
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.URL.Path, Equals, "/apps/foo/release")
+		switch r.Method {
+		case "PUT":
+			var data map[string]string
+			c.Assert(json.NewDecoder(r.Body).Decode(&data), IsNil)
+			release = data["id"]
+		case "GET":
+			if release == "" {
+				w.WriteHeader(404)
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(&ct.Release{ID: release})
+	}))
+	defer srv.Close()
+
+	_, err := client.GetAppRelease("foo")
+	c.Assert(err, Equals, ErrNotFound)
+	c.Assert(client.SetAppRelease("foo", "bar"), IsNil)
+	r, err := client.GetAppRelease("foo")
+	c.Assert(err, IsNil)
+	c.Assert(r.ID, Equals, "bar")
+}
+
+func (S) TestUpdateAppOnlySendsSetFields(c *C) {
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.URL.Path, Equals, "/apps/foo")
+		c.Assert(r.Header.Get("If-Match"), Equals, `"1"`)
+		var data map[string]interface{}
+		c.Assert(json.NewDecoder(r.Body).Decode(&data), IsNil)
+		c.Assert(data, DeepEquals, map[string]interface{}{"labels": map[string]interface{}{"a": "b"}})
+		w.Header().Set("ETag", `"2"`)
+		w.Write([]byte(`{"id":"foo","protected":true,"labels":{"a":"b"}}`))
+	}))
+	defer srv.Close()
+
+	app, err := client.UpdateApp("foo", &AppUpdate{Labels: map[string]string{"a": "b"}, ETag: `"1"`})
+	c.Assert(err, IsNil)
+	c.Assert(app.Protected, Equals, true)
+	c.Assert(app.ETag, Equals, `"2"`)
+}
+
+func (S) TestStreamEventsResume(c *C) {
+	var requests int32
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.URL.Path, Equals, "/events")
+		c.Assert(r.URL.Query().Get("app_id"), Equals, "foo")
+		c.Assert(r.URL.Query().Get("object_types"), Equals, "job,formation")
+		w.Header().Set("Content-Type", "text/event-stream")
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			c.Assert(r.Header.Get("Last-Event-Id"), Equals, "")
+			w.Write([]byte("id: 1\ndata: {\"id\":1,\"object_type\":\"job\"}\n\n"))
+		case 2:
+			c.Assert(r.Header.Get("Last-Event-Id"), Equals, "1")
+			w.Write([]byte("id: 2\ndata: {\"id\":2,\"object_type\":\"formation\"}\n\n"))
+			w.(http.Flusher).Flush()
+			<-w.(http.CloseNotifier).CloseNotify()
+		}
+	}))
+	defer srv.Close()
+
+	events := make(chan *ct.Event)
+	stream, err := client.StreamEvents(StreamEventsOptions{AppID: "foo", ObjectTypes: []string{"job", "formation"}}, events)
+	c.Assert(err, IsNil)
+
+	e := <-events
+	c.Assert(e.ID, Equals, int64(1))
+	e = <-events
+	c.Assert(e.ID, Equals, int64(2))
+	c.Assert(e.ObjectType, Equals, "formation")
+
+	stream.Close()
+	for range events {
+	}
+	c.Assert(stream.Err(), IsNil)
+}
+
+func (S) TestStreamEventsReconnectBackoff(c *C) {
+	var requests int32
+	connected := make(chan time.Time, 10)
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connected <- time.Now()
+		w.Header().Set("Content-Type", "text/event-stream")
+		switch atomic.AddInt32(&requests, 1) {
+		case 4:
+			w.Write([]byte("id: 1\ndata: {\"id\":1,\"object_type\":\"job\"}\n\n"))
+		case 6:
+			w.(http.Flusher).Flush()
+			<-w.(http.CloseNotifier).CloseNotify()
+		}
+	}))
+	defer srv.Close()
+	client.SetRetryPolicy(RetryPolicy{MaxElapsed: time.Second, InitialDelay: 10 * time.Millisecond, MaxDelay: 200 * time.Millisecond})
+
+	events := make(chan *ct.Event)
+	stream, err := client.StreamEvents(StreamEventsOptions{}, events)
+	c.Assert(err, IsNil)
+	e := <-events
+	c.Assert(e.ID, Equals, int64(1))
+
+	times := make([]time.Time, 6)
+	for i := range times {
+		times[i] = <-connected
+	}
+	// streams closed without any events are reconnected with increasing
+	// delays, which are reset once an event is received
+	for i, min := range []time.Duration{10, 20, 40, 10, 20} {
+		c.Assert(times[i+1].Sub(times[i]) >= min*time.Millisecond, Equals, true, Commentf("reconnect %d", i+1))
+	}
+	c.Assert(times[4].Sub(times[3]) < 80*time.Millisecond, Equals, true)
+
+	stream.Close()
+	for range events {
+	}
+	c.Assert(stream.Err(), IsNil)
+}
+
+func (S) TestStreamEventsLongPoll(c *C) {
+	var requests int32
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.URL.Path, Equals, "/events")
+		c.Assert(r.Header.Get("Accept"), Equals, ct.LongPollMediaType)
+		c.Assert(r.URL.Query().Get("app_id"), Equals, "foo")
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			c.Assert(r.URL.Query().Get("since_id"), Equals, "")
+			c.Assert(r.URL.Query().Get("timeout"), Equals, "0")
+			w.Header().Set("Last-Event-Id", "5")
+			w.Write([]byte(`[]`))
+		case 2:
+			c.Assert(r.URL.Query().Get("since_id"), Equals, "5")
+			c.Assert(r.URL.Query().Get("timeout"), Equals, "")
+			w.Header().Set("Last-Event-Id", "7")
+			w.Write([]byte(`[{"id":6,"object_type":"job"},{"id":7,"object_type":"formation"}]`))
+		default:
+			c.Assert(r.URL.Query().Get("since_id"), Equals, "7")
+			w.Header().Set("Last-Event-Id", "7")
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer srv.Close()
+	client.SetLongPoll(true)
+
+	events := make(chan *ct.Event)
+	stream, err := client.StreamEvents(StreamEventsOptions{AppID: "foo"}, events)
+	c.Assert(err, IsNil)
+
+	e := <-events
+	c.Assert(e.ID, Equals, int64(6))
+	e = <-events
+	c.Assert(e.ID, Equals, int64(7))
+	c.Assert(e.ObjectType, Equals, "formation")
+
+	stream.Close()
+	for range events {
+	}
+	c.Assert(stream.Err(), IsNil)
+}
+
+func (S) TestGetJobLogLongPoll(c *C) {
+	var requests int32
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.URL.Path, Equals, "/apps/foo/jobs/bar/log")
+		c.Assert(r.Header.Get("Accept"), Equals, ct.LongPollMediaType)
+		c.Assert(r.URL.Query().Get("tail"), Equals, "true")
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			c.Assert(r.URL.Query().Get("since"), Equals, "")
+			w.Write([]byte(`{"lines":[{"stream":"stdout","timestamp":"2015-01-01T00:00:01Z","message":"one\n"}]}`))
+		case 2:
+			c.Assert(r.URL.Query().Get("since"), Equals, "2015-01-01T00:00:01Z")
+			w.Write([]byte(`{"lines":[{"stream":"stderr","timestamp":"2015-01-01T00:00:02Z","message":"two\n"}],"eof":true}`))
+		}
+	}))
+	defer srv.Close()
+	client.SetLongPoll(true)
+
+	rc, err := client.GetJobLog("foo", "bar", true)
+	c.Assert(err, IsNil)
+	defer rc.Close()
+	var stdout, stderr bytes.Buffer
+	attachClient := cluster.NewAttachClient(struct {
+		io.Writer
+		io.ReadCloser
+	}{nil, rc})
+	_, err = attachClient.Receive(&stdout, &stderr)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(stdout.String(), Equals, "one\n")
+	c.Assert(stderr.String(), Equals, "two\n")
+	c.Assert(atomic.LoadInt32(&requests), Equals, int32(2))
+}
+
+func (S) TestStreamFormations(c *C) {
+	since := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.URL.Path, Equals, "/formations")
+		c.Assert(r.URL.Query().Get("since"), Equals, "2015-01-01T00:00:00Z")
+		c.Assert(r.Header.Get("Accept"), Equals, "text/event-stream")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(":\n"))
+		w.Write([]byte("data: {\"app\":{\"id\":\"foo\"},\"release\":{\"id\":\"bar\"},\"processes\":{\"web\":1}}\n\n"))
+		w.Write([]byte("data: {}\n\n"))
+	}))
+	defer srv.Close()
+
+	updates, err := client.StreamFormations(&since)
+	var formations []*ct.ExpandedFormation
+	for f := range updates.Chan {
+		formations = append(formations, f)
+	}
+	c.Assert(*err, IsNil)
+	c.Assert(formations, HasLen, 2)
+	c.Assert(formations[0].App.ID, Equals, "foo")
+	c.Assert(formations[0].Processes, DeepEquals, map[string]int{"web": 1})
+	c.Assert(formations[1].App, IsNil)
+	c.Assert(updates.Close(), IsNil)
+}
+
+func (S) TestPinnedClient(c *C) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"foo"}`))
+	}))
+	defer srv.Close()
+	pin := sha256.Sum256(srv.TLS.Certificates[0].Certificate[0])
+
+	_, err := NewClientWithPin(srv.URL, "test", pin[:4])
+	c.Assert(err, NotNil)
+
+	client, err := NewClientWithPin(srv.URL, "test", pin[:])
+	c.Assert(err, IsNil)
+	app, err := client.GetApp("foo")
+	c.Assert(err, IsNil)
+	c.Assert(app.ID, Equals, "foo")
+
+	pin[0]++
+	client, err = NewClientWithPin(srv.URL, "test", pin[:])
+	c.Assert(err, IsNil)
+	start := time.Now()
+	_, err = client.GetApp("foo")
+	c.Assert(err, NotNil)
+	c.Assert(err.(*url.Error).Err, Equals, pinned.ErrPinFailure)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+type testMiddleware struct {
+	requests []*RequestInfo
+}
+
+func (m *testMiddleware) BeforeRequest(req *http.Request) {
+	req.Header.Set("X-Test", "foo")
+}
+
+func (m *testMiddleware) AfterRequest(info *RequestInfo) {
+	m.requests = append(m.requests, info)
+}
+
+func (S) TestMiddleware(c *C) {
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Header.Get("X-Test"), Equals, "foo")
+		if r.URL.Path == "/apps/bar" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{"id":"foo"}`))
+	}))
+	defer srv.Close()
+	m := &testMiddleware{}
+	client.Use(m)
+
+	_, err := client.GetApp("foo")
+	c.Assert(err, IsNil)
+	_, err = client.GetApp("bar")
+	c.Assert(err, Equals, ErrNotFound)
+
+	c.Assert(m.requests, HasLen, 2)
+	c.Assert(m.requests[0].Method, Equals, "GET")
+	c.Assert(m.requests[0].Path, Equals, "/apps/foo")
+	c.Assert(m.requests[0].StatusCode, Equals, 200)
+	c.Assert(m.requests[1].Path, Equals, "/apps/bar")
+	c.Assert(m.requests[1].StatusCode, Equals, 404)
+}
+
+func (S) TestLimitInFlight(c *C) {
+	block := make(chan struct{})
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		w.Write([]byte(`{"id":"foo"}`))
+	}))
+	defer srv.Close()
+	client.SetLimits(Limits{MaxInFlight: 1, MaxWait: 20 * time.Millisecond})
+
+	done := make(chan error)
+	go func() {
+		_, err := client.GetApp("foo")
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_, err := client.GetApp("foo")
+	c.Assert(err, Equals, ErrRateLimited)
+
+	close(block)
+	c.Assert(<-done, IsNil)
+	_, err = client.GetApp("foo")
+	c.Assert(err, IsNil)
+}
+
+func (S) TestLimitRate(c *C) {
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"foo"}`))
+	}))
+	defer srv.Close()
+	client.SetLimits(Limits{Rate: 100, Burst: 2})
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, err := client.GetApp("foo")
+		c.Assert(err, IsNil)
+	}
+	// the first two requests use the burst, the remaining four are spaced
+	// 10ms apart
+	c.Assert(time.Since(start) >= 35*time.Millisecond, Equals, true)
+
+	client.SetLimits(Limits{Rate: 1, MaxWait: time.Millisecond})
+	_, err := client.GetApp("foo")
+	c.Assert(err, IsNil)
+	_, err = client.GetApp("foo")
+	c.Assert(err, Equals, ErrRateLimited)
+}
+
+func (S) TestStream(c *C) {
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Header.Get("Accept"), Equals, "text/event-stream")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(":\n\nid: 1\nevent: up\ndata: {\"id\":\"foo\",\ndata: \"state\":\"up\"}\n\n:\ndata:{\"id\":\"bar\"}\r\n\r\n"))
+	}))
+	defer srv.Close()
+
+	_, err := client.Stream("GET", "/jobs", make(chan ct.Job))
+	c.Assert(err, NotNil)
+
+	jobs := make(chan *ct.Job)
+	stream, err := client.Stream("GET", "/jobs", jobs)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	var list []*ct.Job
+	for job := range jobs {
+		list = append(list, job)
+	}
+	c.Assert(stream.Err(), IsNil)
+	c.Assert(list, DeepEquals, []*ct.Job{{ID: "foo", State: "up"}, {ID: "bar"}})
+}
+
+func (S) TestGzipRequest(c *C) {
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var release ct.Release
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			body, err := gzip.NewReader(r.Body)
+			c.Assert(err, IsNil)
+			c.Assert(json.NewDecoder(body).Decode(&release), IsNil)
+		} else {
+			c.Assert(json.NewDecoder(r.Body).Decode(&release), IsNil)
+			c.Assert(len(release.Env["FOO"]) < gzipMinSize, Equals, true)
+		}
+		release.ID = "foo"
+		json.NewEncoder(w).Encode(&release)
+	}))
+	defer srv.Close()
+
+	for _, size := range []int{10, 2 * gzipMinSize} {
+		release := &ct.Release{Env: map[string]string{"FOO": strings.Repeat("a", size)}}
+		c.Assert(client.CreateRelease(release), IsNil)
+		c.Assert(release.ID, Equals, "foo")
+		c.Assert(release.Env["FOO"], HasLen, size)
+	}
+}
+
+func (S) TestFormationIfMatch(c *C) {
+	const etag = `"v1"`
+	var current = etag
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("ETag", current)
+			json.NewEncoder(w).Encode(&ct.Formation{AppID: "app", ReleaseID: "release"})
+		case "PUT":
+			if r.Header.Get("If-Match") != current {
+				w.WriteHeader(412)
+				return
+			}
+			current = `"v2"`
+			w.Header().Set("ETag", current)
+			json.NewEncoder(w).Encode(&ct.Formation{AppID: "app", ReleaseID: "release"})
+		}
+	}))
+	defer srv.Close()
+
+	formation, err := client.GetFormation("app", "release")
+	c.Assert(err, IsNil)
+	c.Assert(formation.ETag, Equals, etag)
+	stale := *formation
+
+	c.Assert(client.PutFormation(formation), IsNil)
+	c.Assert(formation.ETag, Equals, `"v2"`)
+
+	// a second editor using the original ETag must not clobber the update
+	c.Assert(client.PutFormation(&stale), Equals, ErrPreconditionFailed)
+}
+
+func (S) TestTransportOptions(c *C) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"foo"}`))
+	}))
+	defer srv.Close()
+
+	// the test server's certificate is self-signed, so requests fail
+	// unless the TLS config trusts it
+	client, err := NewClient(srv.URL, "test", WithDialTimeout(time.Second))
+	c.Assert(err, IsNil)
+	client.SetRetryPolicy(RetryPolicy{})
+	_, err = client.GetApp("foo")
+	c.Assert(err, NotNil)
+
+	cert, err := x509.ParseCertificate(srv.TLS.Certificates[0].Certificate[0])
+	c.Assert(err, IsNil)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client, err = NewClient(srv.URL, "test", WithTLSConfig(&tls.Config{RootCAs: pool}), WithMaxIdleConns(2))
+	c.Assert(err, IsNil)
+	t := client.http.Transport.(*http.Transport)
+	c.Assert(t.MaxIdleConnsPerHost, Equals, 2)
+	app, err := client.GetApp("foo")
+	c.Assert(err, IsNil)
+	c.Assert(app.ID, Equals, "foo")
+}
+
+func (S) TestValidationError(c *C) {
+	client, srv := newTestClient(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"field":"name","code":"invalid_format","message":"must match ^[a-z]+$"}`))
+	}))
+	defer srv.Close()
+
+	err := client.CreateApp(&ct.App{Name: "Foo"})
+	c.Assert(err, DeepEquals, ct.ValidationError{Field: "name", Code: ct.ValidationCodeInvalidFormat, Message: "must match ^[a-z]+$"})
+	c.Assert(err.Error(), Equals, "name: must match ^[a-z]+$")
+}
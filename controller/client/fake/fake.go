@@ -0,0 +1,2732 @@
+// Package fake provides an in-memory implementation of the controller client
+// so that consumers of the client can be tested without a running controller.
+package fake
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/code.google.com/p/go.crypto/ssh"
+	"github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/controller/name"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/cron"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/types"
+)
+
+// ErrNotSupported is returned by operations that need a running cluster,
+// such as attaching to jobs and reading their logs.
+var ErrNotSupported = errors.New("fake: operation not supported")
+
+var appNamePattern = regexp.MustCompile(`^[a-z\d]+(-[a-z\d]+)*$`)
+
+type formationKey struct {
+	appID, releaseID string
+}
+
+type autoscaleKey struct {
+	appID, processType string
+}
+
+// Client is an in-memory implementation of controller.Interface. Objects are
+// copied when they are stored and returned, and the streams returned by the
+// client are sent changes as they are made, so they behave like those of the
+// real client.
+type Client struct {
+	// ClusterInfo is returned by GetClusterInfo.
+	ClusterInfo ct.ClusterInfo
+
+	// CACert is returned by GetCACert, controller.ErrNotFound is returned
+	// if it is empty.
+	CACert []byte
+
+	// Health is returned by GetHealth.
+	Health ct.Health
+
+	mtx         sync.RWMutex
+	apps        map[string]*ct.App
+	appReleases map[string]string
+	appHistory  map[string][]string
+	appEnv      map[string]map[string]string
+	appQuotas   map[string]ct.AppQuota
+	artifacts   map[string]*ct.Artifact
+	releases    map[string]*ct.Release
+	formations  map[formationKey]*ct.Formation
+	jobs        map[string]*ct.Job
+	deployments map[string]*ct.Deployment
+	cronJobs    map[string]*ct.CronJob
+	logDrains   map[string]*ct.LogDrain
+	autoscale   map[autoscaleKey]*ct.AutoscalePolicy
+	providers   map[string]*ct.Provider
+	resources   map[string]*ct.Resource
+	routes      map[string]*router.Route
+	keys        map[string]*ct.Key
+	authTokens  map[string]*ct.AuthToken
+	webhooks    map[string]*ct.Webhook
+	etags       map[string]string
+	deleted     []*deletedApp
+	events      []*ct.Event
+	nameID      uint32
+	version     int64
+
+	subscribers map[*subscriber]struct{}
+}
+
+var _ controller.Interface = (*Client)(nil)
+
+// New returns a client with no objects.
+func New() *Client {
+	return &Client{
+		ClusterInfo: ct.ClusterInfo{Version: "dev"},
+		Health:      ct.Health{Status: ct.HealthOK},
+		apps:        make(map[string]*ct.App),
+		appReleases: make(map[string]string),
+		appHistory:  make(map[string][]string),
+		appEnv:      make(map[string]map[string]string),
+		appQuotas:   make(map[string]ct.AppQuota),
+		artifacts:   make(map[string]*ct.Artifact),
+		releases:    make(map[string]*ct.Release),
+		formations:  make(map[formationKey]*ct.Formation),
+		jobs:        make(map[string]*ct.Job),
+		deployments: make(map[string]*ct.Deployment),
+		cronJobs:    make(map[string]*ct.CronJob),
+		logDrains:   make(map[string]*ct.LogDrain),
+		autoscale:   make(map[autoscaleKey]*ct.AutoscalePolicy),
+		providers:   make(map[string]*ct.Provider),
+		resources:   make(map[string]*ct.Resource),
+		routes:      make(map[string]*router.Route),
+		keys:        make(map[string]*ct.Key),
+		authTokens:  make(map[string]*ct.AuthToken),
+		webhooks:    make(map[string]*ct.Webhook),
+		etags:       make(map[string]string),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+func now() *time.Time {
+	t := time.Now()
+	return &t
+}
+
+// checkETag returns controller.ErrPreconditionFailed if etag is set and does
+// not match the current ETag of the object with key k.
+func (c *Client) checkETag(k, etag string) error {
+	if etag != "" && etag != c.etags[k] {
+		return controller.ErrPreconditionFailed
+	}
+	return nil
+}
+
+// touch assigns a new ETag to the object with key k.
+func (c *Client) touch(k string) string {
+	c.version++
+	etag := fmt.Sprintf(`"%d"`, c.version)
+	c.etags[k] = etag
+	return etag
+}
+
+func (c *Client) GetClusterInfo() (*ct.ClusterInfo, error) {
+	info := c.ClusterInfo
+	return &info, nil
+}
+
+func (c *Client) GetCACert() ([]byte, error) {
+	if len(c.CACert) == 0 {
+		return nil, controller.ErrNotFound
+	}
+	return c.CACert, nil
+}
+
+func (c *Client) GetHealth() (*ct.Health, error) {
+	health := c.Health
+	return &health, nil
+}
+
+func (c *Client) Export() (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *Client) Import(archive io.Reader, conflicts string) (*ct.ImportResult, error) {
+	return nil, ErrNotSupported
+}
+
+// app returns the app with the given ID or name, the caller must hold c.mtx.
+func (c *Client) app(id string) (*ct.App, error) {
+	if app, ok := c.apps[id]; ok {
+		return app, nil
+	}
+	for _, app := range c.apps {
+		if app.Name == id {
+			return app, nil
+		}
+	}
+	return nil, controller.ErrNotFound
+}
+
+func (c *Client) AppList() ([]*ct.App, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	apps := make([]*ct.App, 0, len(c.apps))
+	for _, app := range c.apps {
+		a := *app
+		apps = append(apps, &a)
+	}
+	sort.Sort(sort.Reverse(appsByCreatedAt(apps)))
+	return apps, nil
+}
+
+// AppListSelector returns the apps whose labels match the selector.
+func (c *Client) AppListSelector(selector string) ([]*ct.App, error) {
+	sel, err := ct.ParseLabelSelector(selector)
+	if err != nil {
+		return nil, ct.ValidationError{Field: "selector", Message: err.Error()}
+	}
+	apps, _ := c.AppList()
+	matched := make([]*ct.App, 0, len(apps))
+	for _, app := range apps {
+		if sel.Matches(app.Labels) {
+			matched = append(matched, app)
+		}
+	}
+	return matched, nil
+}
+
+// validateLabels checks labels against the patterns used by the controller.
+func validateLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if !ct.LabelKeyPattern.MatchString(k) || !ct.LabelValuePattern.MatchString(v) {
+			return ct.ValidationError{Field: "labels." + k, Code: ct.ValidationCodeInvalidFormat, Message: "is invalid"}
+		}
+	}
+	return nil
+}
+
+type appsByCreatedAt []*ct.App
+
+func (a appsByCreatedAt) Len() int           { return len(a) }
+func (a appsByCreatedAt) Less(i, j int) bool { return a[i].CreatedAt.Before(*a[j].CreatedAt) }
+func (a appsByCreatedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func (c *Client) GetApp(appID string) (*ct.App, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	a := *app
+	a.ETag = c.etags["app:"+app.ID]
+	return &a, nil
+}
+
+func (c *Client) CreateApp(app *ct.App) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.createApp(app)
+}
+
+func (c *Client) createApp(app *ct.App) error {
+	if app.Name == "" {
+		c.nameID++
+		app.Name = name.Get(c.nameID)
+	}
+	if len(app.Name) > 100 || !appNamePattern.MatchString(app.Name) {
+		return ct.ValidationError{Field: "name", Code: ct.ValidationCodeInvalidFormat, Message: fmt.Sprintf("must match %s", appNamePattern)}
+	}
+	if _, err := c.app(app.Name); err == nil {
+		return ct.ValidationError{Field: "name", Message: "is already taken"}
+	}
+	if err := validateLabels(app.Labels); err != nil {
+		return err
+	}
+	if _, ok := c.authTokens[app.Owner]; app.Owner != "" && !ok {
+		return ct.ValidationError{Field: "owner", Message: "is not an auth token"}
+	}
+	if app.ID == "" {
+		app.ID = random.UUID()
+	}
+	app.CreatedAt = now()
+	app.UpdatedAt = app.CreatedAt
+	app.Version = 1
+	app.ETag = c.touch("app:" + app.ID)
+	a := *app
+	c.apps[app.ID] = &a
+	c.addEvent(app.ID, ct.EventTypeApp, app.ID, &a)
+	return nil
+}
+
+func (c *Client) CreateAppComplete(app *ct.App, artifact *ct.Artifact, release *ct.Release, formation *ct.Formation) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if app == nil {
+		return ct.ValidationError{Field: "app", Message: "must be set"}
+	}
+	if formation != nil && release == nil {
+		return ct.ValidationError{Field: "release", Message: "must be set to create a formation"}
+	}
+	if err := c.createApp(app); err != nil {
+		return err
+	}
+	if artifact != nil {
+		c.createArtifact(artifact)
+	}
+	if release != nil {
+		if artifact != nil {
+			release.ArtifactID = artifact.ID
+		}
+		if err := c.createRelease(release); err != nil {
+			return err
+		}
+		c.setAppRelease(app.ID, release.ID)
+	}
+	if formation != nil {
+		formation.AppID = app.ID
+		formation.ReleaseID = release.ID
+		c.putFormation(formation)
+	}
+	return nil
+}
+
+func (c *Client) UpdateApp(appID string, update *controller.AppUpdate) (*ct.App, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	existing, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkETag("app:"+existing.ID, update.ETag); err != nil {
+		return nil, err
+	}
+	if update.Version != 0 && update.Version != existing.Version {
+		return nil, controller.ErrConflict
+	}
+	if err := validateLabels(update.Labels); err != nil {
+		return nil, err
+	}
+	if update.Protected != nil {
+		existing.Protected = *update.Protected
+	}
+	if update.Maintenance != nil && *update.Maintenance != existing.Maintenance {
+		existing.Maintenance = *update.Maintenance
+		if existing.Maintenance {
+			existing.MaintenanceStartedAt = now()
+			existing.MaintenanceEndedAt = nil
+		} else {
+			existing.MaintenanceEndedAt = now()
+		}
+		for id, route := range c.routes {
+			if route.ParentRef == routeParentRef(existing.ID) && route.Type == "http" {
+				c.routes[id] = maintenanceRoute(route, existing.Maintenance)
+			}
+		}
+	}
+	if update.Meta != nil {
+		existing.Meta = update.Meta
+	}
+	if update.Labels != nil {
+		existing.Labels = update.Labels
+	}
+	existing.UpdatedAt = now()
+	existing.Version++
+	app := *existing
+	app.ETag = c.touch("app:" + existing.ID)
+	c.addEvent(existing.ID, ct.EventTypeApp, existing.ID, existing)
+	return &app, nil
+}
+
+func (c *Client) DeleteApp(appID string, force bool) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return err
+	}
+
+	if app.Protected && !force {
+		return ct.ValidationError{Field: "protected", Message: "app is protected, use force to delete it"}
+	}
+
+	var routes, resources, cronJobs, blocking []string
+	for id, route := range c.routes {
+		if route.ParentRef == routeParentRef(app.ID) {
+			routes = append(routes, id)
+		}
+	}
+	for id, resource := range c.resources {
+		for _, a := range resource.Apps {
+			if a == app.ID {
+				resources = append(resources, id)
+			}
+		}
+	}
+	for id, cronJob := range c.cronJobs {
+		if cronJob.AppID == app.ID {
+			cronJobs = append(cronJobs, id)
+		}
+	}
+	if len(routes) > 0 {
+		blocking = append(blocking, "routes")
+	}
+	for k, f := range c.formations {
+		if k.appID == app.ID && len(f.Processes) > 0 {
+			blocking = append(blocking, "formations")
+			break
+		}
+	}
+	if len(resources) > 0 {
+		blocking = append(blocking, "resources")
+	}
+	if len(cronJobs) > 0 {
+		blocking = append(blocking, "cron jobs")
+	}
+	if len(blocking) > 0 && !force {
+		return ct.ValidationError{Message: fmt.Sprintf("app has %s, use force to delete them", strings.Join(blocking, "; "))}
+	}
+
+	d := &deletedApp{
+		app:       app,
+		releaseID: c.appReleases[app.ID],
+		env:       c.appEnv[app.ID],
+		resources: make(map[string]*ct.Resource, len(resources)),
+	}
+	if quota, ok := c.appQuotas[app.ID]; ok {
+		d.quota = &quota
+	}
+	for k, f := range c.formations {
+		if k.appID == app.ID {
+			d.formations = append(d.formations, f)
+		}
+	}
+	for _, id := range resources {
+		resource := *c.resources[id]
+		d.resources[id] = &resource
+	}
+	for _, id := range cronJobs {
+		d.cronJobs = append(d.cronJobs, c.cronJobs[id])
+	}
+	for _, drain := range c.logDrains {
+		if drain.AppID == app.ID {
+			d.logDrains = append(d.logDrains, drain)
+		}
+	}
+	for _, id := range routes {
+		d.routes = append(d.routes, c.routes[id])
+	}
+	c.deleted = append(c.deleted, d)
+
+	delete(c.apps, app.ID)
+	delete(c.appReleases, app.ID)
+	delete(c.appEnv, app.ID)
+	delete(c.appQuotas, app.ID)
+	delete(c.etags, "app:"+app.ID)
+	for id, drain := range c.logDrains {
+		if drain.AppID == app.ID {
+			delete(c.logDrains, id)
+		}
+	}
+	c.addEvent(app.ID, ct.EventTypeAppDeletion, app.ID, &ct.App{ID: app.ID, Name: app.Name})
+	for k := range c.formations {
+		if k.appID == app.ID {
+			c.deleteFormation(k)
+		}
+	}
+	for _, id := range resources {
+		resource := c.resources[id]
+		resource.Apps = removeString(resource.Apps, app.ID)
+		if len(resource.Apps) == 0 {
+			delete(c.resources, id)
+		}
+		c.addEvent(app.ID, ct.EventTypeResourceDeletion, id, &ct.Resource{ID: id, Apps: []string{app.ID}})
+	}
+	for _, id := range cronJobs {
+		delete(c.cronJobs, id)
+		c.addEvent(app.ID, ct.EventTypeCronJobDeletion, id, &ct.CronJob{ID: id, AppID: app.ID})
+	}
+	for _, id := range routes {
+		route := c.routes[id]
+		delete(c.routes, id)
+		c.addEvent(app.ID, ct.EventTypeRouteDeletion, id, route)
+	}
+	return nil
+}
+
+// deletedApp holds a deleted app and the objects deleted with it, so that
+// it can be restored.
+type deletedApp struct {
+	app        *ct.App
+	releaseID  string
+	env        map[string]string
+	quota      *ct.AppQuota
+	formations []*ct.Formation
+	resources  map[string]*ct.Resource
+	cronJobs   []*ct.CronJob
+	logDrains  []*ct.LogDrain
+	routes     []*router.Route
+}
+
+// UndeleteApp restores the most recently deleted app with the ID or name,
+// the fake keeps deleted apps indefinitely.
+func (c *Client) UndeleteApp(appID string) (*ct.App, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	i := len(c.deleted) - 1
+	for ; i >= 0; i-- {
+		if a := c.deleted[i].app; a.ID == appID || a.Name == appID {
+			break
+		}
+	}
+	if i < 0 {
+		return nil, controller.ErrNotFound
+	}
+	d := c.deleted[i]
+	if _, err := c.app(d.app.Name); err == nil {
+		return nil, ct.ValidationError{Field: "name", Message: "is used by another app"}
+	}
+	c.deleted = append(c.deleted[:i], c.deleted[i+1:]...)
+
+	app := d.app
+	app.UpdatedAt = now()
+	app.Version++
+	app.ETag = c.touch("app:" + app.ID)
+	c.apps[app.ID] = app
+	if d.releaseID != "" {
+		c.appReleases[app.ID] = d.releaseID
+	}
+	if d.env != nil {
+		c.appEnv[app.ID] = d.env
+	}
+	if d.quota != nil {
+		c.appQuotas[app.ID] = *d.quota
+	}
+	c.addEvent(app.ID, ct.EventTypeApp, app.ID, app)
+	for _, f := range d.formations {
+		c.putFormation(f)
+	}
+	for id, resource := range d.resources {
+		if existing, ok := c.resources[id]; ok {
+			existing.Apps = append(existing.Apps, app.ID)
+		} else {
+			c.resources[id] = resource
+		}
+	}
+	for _, cronJob := range d.cronJobs {
+		c.cronJobs[cronJob.ID] = cronJob
+	}
+	for _, drain := range d.logDrains {
+		c.logDrains[drain.ID] = drain
+	}
+	for _, route := range d.routes {
+		c.routes[route.ID] = route
+	}
+	res := *app
+	return &res, nil
+}
+
+// updateOwner calls fn with the app after check accepts it, and records the
+// change. The fake does not know which token makes a request, so callers are
+// not checked against the app's owners.
+func (c *Client) updateOwner(appID string, check func(*ct.App) error, fn func(*ct.App)) (*ct.App, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	if err := check(app); err != nil {
+		return nil, err
+	}
+	fn(app)
+	app.UpdatedAt = now()
+	app.Version++
+	app.ETag = c.touch("app:" + app.ID)
+	a := *app
+	c.addEvent(app.ID, ct.EventTypeApp, app.ID, &a)
+	res := *app
+	return &res, nil
+}
+
+func (c *Client) TransferApp(appID, to string) (*ct.App, error) {
+	return c.updateOwner(appID, func(app *ct.App) error {
+		if _, ok := c.authTokens[to]; !ok {
+			return ct.ValidationError{Field: "to", Message: "is not an auth token"}
+		}
+		if app.Owner == to {
+			return ct.ValidationError{Field: "to", Message: "already owns the app"}
+		}
+		return nil
+	}, func(app *ct.App) {
+		app.PendingOwner = to
+	})
+}
+
+func (c *Client) AcceptAppTransfer(appID string) (*ct.App, error) {
+	return c.updateOwner(appID, func(app *ct.App) error {
+		if app.PendingOwner == "" {
+			return ct.ValidationError{Message: "app is not being transferred"}
+		}
+		if _, ok := c.authTokens[app.PendingOwner]; !ok {
+			return ct.ValidationError{Field: "pending_owner", Message: "is not an auth token"}
+		}
+		return nil
+	}, func(app *ct.App) {
+		app.Owner = app.PendingOwner
+		app.PendingOwner = ""
+	})
+}
+
+func (c *Client) CancelAppTransfer(appID string) error {
+	_, err := c.updateOwner(appID, func(app *ct.App) error {
+		if app.PendingOwner == "" {
+			return controller.ErrNotFound
+		}
+		return nil
+	}, func(app *ct.App) {
+		app.PendingOwner = ""
+	})
+	return err
+}
+
+func (c *Client) GetAppRelease(appID string) (*ct.Release, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	release, ok := c.releases[c.appReleases[app.ID]]
+	if !ok {
+		return nil, controller.ErrNotFound
+	}
+	r := *release
+	return &r, nil
+}
+
+func (c *Client) SetAppRelease(appID, releaseID string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.releases[releaseID]; !ok {
+		return ct.ValidationError{Message: fmt.Sprintf("could not find release with ID %s", releaseID)}
+	}
+	c.setAppRelease(app.ID, releaseID)
+	c.moveFormation(app.ID, releaseID)
+	return nil
+}
+
+// moveFormation carries over the process counts and limits of the app's only
+// formation to the release, the caller must hold c.mtx.
+func (c *Client) moveFormation(appID, releaseID string) {
+	var formations []*ct.Formation
+	for k, f := range c.formations {
+		if k.appID == appID {
+			formations = append(formations, f)
+		}
+	}
+	if len(formations) == 1 && formations[0].ReleaseID != releaseID {
+		old := formations[0]
+		c.putFormation(&ct.Formation{AppID: appID, ReleaseID: releaseID, Processes: old.Processes, Limits: old.Limits, Constraints: old.Constraints})
+		c.deleteFormation(formationKey{appID, old.ReleaseID})
+	}
+}
+
+func (c *Client) GetAppEnv(appID string) (*ct.AppEnv, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	return &ct.AppEnv{Env: copyEnv(c.appEnv[app.ID])}, nil
+}
+
+func (c *Client) UpdateAppEnv(appID string, update *ct.EnvUpdate) (*ct.AppEnv, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	for k := range update.Set {
+		if k == "" || strings.Contains(k, "=") {
+			return nil, ct.ValidationError{Field: "set", Message: "names must not be empty or contain ="}
+		}
+	}
+	var release *ct.Release
+	if update.NewRelease {
+		current, ok := c.releases[c.appReleases[app.ID]]
+		if !ok {
+			return nil, ct.ValidationError{Field: "new_release", Message: "app has no release to copy"}
+		}
+		r := *current
+		release = &r
+	}
+
+	env := copyEnv(c.appEnv[app.ID])
+	for k, v := range update.Set {
+		env[k] = v
+	}
+	for _, k := range update.Unset {
+		delete(env, k)
+	}
+	c.appEnv[app.ID] = env
+	app.Version++
+	c.touchFormations(app.ID)
+
+	res := &ct.AppEnv{Env: copyEnv(env)}
+	if release != nil {
+		release.ID = ""
+		if err := c.createRelease(release); err != nil {
+			return nil, err
+		}
+		c.setAppRelease(app.ID, release.ID)
+		c.moveFormation(app.ID, release.ID)
+		res.ReleaseID = release.ID
+	}
+	return res, nil
+}
+
+func (c *Client) GetAppQuota(appID string) (*ct.AppQuota, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	quota := c.appQuotas[app.ID]
+	return &quota, nil
+}
+
+func (c *Client) UpdateAppQuota(appID string, quota *ct.AppQuota) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return err
+	}
+	for field, v := range map[string]int{ct.QuotaJobs: quota.MaxJobs, ct.QuotaMemory: quota.MaxMemory, ct.QuotaRoutes: quota.MaxRoutes} {
+		if v < 0 {
+			return ct.ValidationError{Field: field, Message: "must not be negative"}
+		}
+	}
+	c.appQuotas[app.ID] = *quota
+	app.Version++
+	return nil
+}
+
+// formationUsage returns the jobs and memory used by the formation.
+func formationUsage(f *ct.Formation, release *ct.Release) (jobs, memory int) {
+	for typ, n := range f.Processes {
+		if n > 0 {
+			jobs += n
+			memory += n * release.Processes[typ].ResourceLimits.Merge(f.Limits[typ]).Memory
+		}
+	}
+	return
+}
+
+// checkFormationQuota checks the formation against the app's job and memory
+// quotas as the controller does, the caller must hold c.mtx.
+func (c *Client) checkFormationQuota(formation *ct.Formation, release *ct.Release) error {
+	quota := c.appQuotas[formation.AppID]
+	if quota.MaxJobs == 0 && quota.MaxMemory == 0 {
+		return nil
+	}
+	var currentJobs, currentMemory int
+	jobs, memory := formationUsage(formation, release)
+	for k, f := range c.formations {
+		if k.appID != formation.AppID {
+			continue
+		}
+		j, m := formationUsage(f, c.releases[k.releaseID])
+		currentJobs += j
+		currentMemory += m
+		if k.releaseID != formation.ReleaseID {
+			jobs += j
+			memory += m
+		}
+	}
+	if quota.MaxJobs > 0 && jobs > quota.MaxJobs && jobs > currentJobs {
+		return ct.QuotaError{Quota: ct.QuotaJobs, Limit: quota.MaxJobs, Message: fmt.Sprintf("app would run %d jobs, its quota is %d", jobs, quota.MaxJobs)}
+	}
+	if quota.MaxMemory == 0 {
+		return nil
+	}
+	prev := c.formations[formationKey{formation.AppID, formation.ReleaseID}]
+	for typ, n := range formation.Processes {
+		if n <= 0 || prev != nil && n <= prev.Processes[typ] {
+			continue
+		}
+		if release.Processes[typ].ResourceLimits.Merge(formation.Limits[typ]).Memory == 0 {
+			return ct.QuotaError{Quota: ct.QuotaMemory, Limit: quota.MaxMemory, Message: fmt.Sprintf("process type %q must have a memory limit, the app has a memory quota", typ)}
+		}
+	}
+	if memory > quota.MaxMemory && memory > currentMemory {
+		return ct.QuotaError{Quota: ct.QuotaMemory, Limit: quota.MaxMemory, Message: fmt.Sprintf("app would use %d MiB of memory, its quota is %d MiB", memory, quota.MaxMemory)}
+	}
+	return nil
+}
+
+func copyEnv(env map[string]string) map[string]string {
+	res := make(map[string]string, len(env))
+	for k, v := range env {
+		res[k] = v
+	}
+	return res
+}
+
+// AppReleaseList returns the releases that have been the app's current
+// release, most recent first.
+func (c *Client) AppReleaseList(appID string) ([]*ct.Release, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	history := c.appHistory[app.ID]
+	releases := make([]*ct.Release, 0, len(history))
+	for i := len(history) - 1; i >= 0; i-- {
+		if release, ok := c.releases[history[i]]; ok {
+			r := *release
+			releases = append(releases, &r)
+		}
+	}
+	return releases, nil
+}
+
+func (c *Client) setAppRelease(appID, releaseID string) {
+	if app, ok := c.apps[appID]; ok {
+		app.Version++
+	}
+	c.addEvent(appID, ct.EventTypeAppRelease, appID, &ct.AppReleaseEvent{PrevReleaseID: c.appReleases[appID], ReleaseID: releaseID})
+	c.appReleases[appID] = releaseID
+	c.addAppHistory(appID, releaseID)
+}
+
+// addAppHistory records that the release has been used by the app, for
+// garbage collection.
+func (c *Client) addAppHistory(appID, releaseID string) {
+	for _, id := range c.appHistory[appID] {
+		if id == releaseID {
+			return
+		}
+	}
+	c.appHistory[appID] = append(c.appHistory[appID], releaseID)
+}
+
+// GCApp deletes the app's releases other than the keep most recent ones,
+// releases which are current or scaled up are kept. If keep is zero, ten
+// releases are kept.
+func (c *Client) GCApp(appID string, keep int) (*ct.AppGCResult, error) {
+	if keep <= 0 {
+		keep = 10
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	return c.gcApp(app, keep), nil
+}
+
+func (c *Client) gcApp(app *ct.App, keep int) *ct.AppGCResult {
+	var releases []*ct.Release
+	for _, id := range c.appHistory[app.ID] {
+		if release, ok := c.releases[id]; ok {
+			releases = append(releases, release)
+		}
+	}
+	sort.Sort(sort.Reverse(releasesByCreatedAt(releases)))
+	res := &ct.AppGCResult{DeletedReleases: []string{}}
+	if len(releases) <= keep {
+		return res
+	}
+outer:
+	for _, release := range releases[keep:] {
+		for k, f := range c.formations {
+			if k.releaseID != release.ID {
+				continue
+			}
+			for _, n := range f.Processes {
+				if n > 0 {
+					continue outer
+				}
+			}
+		}
+		if err := c.deleteRelease(release, true); err != nil {
+			continue
+		}
+		res.DeletedReleases = append(res.DeletedReleases, release.ID)
+	}
+	return res
+}
+
+// GC deletes the releases of all apps other than the keep most recent ones,
+// and artifacts which are not used by any release. There is no blobstore, so
+// no files are deleted. If keep is zero, ten releases are kept.
+func (c *Client) GC(keep int) (*ct.GCResult, error) {
+	if keep <= 0 {
+		keep = 10
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	res := &ct.GCResult{DeletedReleases: []string{}, DeletedArtifacts: []string{}, DeletedBlobs: []string{}}
+	for _, app := range c.apps {
+		res.DeletedReleases = append(res.DeletedReleases, c.gcApp(app, keep).DeletedReleases...)
+	}
+	used := make(map[string]bool)
+	for _, r := range c.releases {
+		for _, id := range releaseArtifactIDs(r) {
+			used[id] = true
+		}
+	}
+	for id := range c.artifacts {
+		if !used[id] {
+			delete(c.artifacts, id)
+			res.DeletedArtifacts = append(res.DeletedArtifacts, id)
+		}
+	}
+	return res, nil
+}
+
+type releasesByCreatedAt []*ct.Release
+
+func (r releasesByCreatedAt) Len() int           { return len(r) }
+func (r releasesByCreatedAt) Less(i, j int) bool { return r[i].CreatedAt.Before(*r[j].CreatedAt) }
+func (r releasesByCreatedAt) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+func (c *Client) GetAppLog(appID string, lines int, follow bool) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *Client) GetArtifact(artifactID string) (*ct.Artifact, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	artifact, ok := c.artifacts[artifactID]
+	if !ok {
+		return nil, controller.ErrNotFound
+	}
+	a := *artifact
+	return &a, nil
+}
+
+func (c *Client) CreateArtifact(artifact *ct.Artifact) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.createArtifact(artifact)
+	return nil
+}
+
+func (c *Client) createArtifact(artifact *ct.Artifact) {
+	// artifacts are unique by type and URI
+	for _, a := range c.artifacts {
+		if a.Type == artifact.Type && a.URI == artifact.URI {
+			*artifact = *a
+			return
+		}
+	}
+	if artifact.ID == "" {
+		artifact.ID = random.UUID()
+	}
+	artifact.CreatedAt = now()
+	a := *artifact
+	c.artifacts[artifact.ID] = &a
+}
+
+func (c *Client) DeleteArtifact(artifactID string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.artifacts[artifactID]; !ok {
+		return controller.ErrNotFound
+	}
+	for _, release := range c.releases {
+		for _, id := range releaseArtifactIDs(release) {
+			if id == artifactID {
+				return ct.ValidationError{Message: "artifact is in use by a release"}
+			}
+		}
+	}
+	delete(c.artifacts, artifactID)
+	return nil
+}
+
+func (c *Client) ReleaseDiff(appID, from, to string, redact bool) (*ct.ReleaseDiff, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if _, err := c.app(appID); err != nil {
+		return nil, err
+	}
+	var releases [2]*ct.Release
+	for i, id := range []string{from, to} {
+		release, ok := c.releases[id]
+		if !ok {
+			return nil, controller.ErrNotFound
+		}
+		releases[i] = release
+	}
+	return ct.DiffReleases(releases[0], releases[1], redact), nil
+}
+
+func (c *Client) GetRelease(releaseID string) (*ct.Release, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	release, ok := c.releases[releaseID]
+	if !ok {
+		return nil, controller.ErrNotFound
+	}
+	r := *release
+	return &r, nil
+}
+
+func (c *Client) CreateRelease(release *ct.Release) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.createRelease(release)
+}
+
+// releaseArtifactIDs returns the IDs of all the artifacts of the release.
+func releaseArtifactIDs(release *ct.Release) []string {
+	if len(release.ArtifactIDs) == 0 && release.ArtifactID != "" {
+		return []string{release.ArtifactID}
+	}
+	return release.ArtifactIDs
+}
+
+func (c *Client) createRelease(release *ct.Release) error {
+	switch {
+	case len(release.ArtifactIDs) == 0:
+		release.ArtifactIDs = releaseArtifactIDs(release)
+	case release.ArtifactID == "":
+		release.ArtifactID = release.ArtifactIDs[0]
+	case release.ArtifactID != release.ArtifactIDs[0]:
+		return ct.ValidationError{Field: "artifacts", Message: "must start with the release artifact"}
+	}
+	for _, id := range release.ArtifactIDs {
+		if _, ok := c.artifacts[id]; !ok {
+			return ct.ValidationError{Field: "artifact", Message: "does not exist"}
+		}
+	}
+	for typ, t := range release.Processes {
+		for _, id := range t.Artifacts {
+			var found bool
+			for _, releaseArtifact := range release.ArtifactIDs {
+				found = found || id == releaseArtifact
+			}
+			if !found {
+				return ct.ValidationError{Field: "processes." + typ + ".artifacts", Message: fmt.Sprintf("%s is not an artifact of the release", id)}
+			}
+		}
+	}
+	if release.ID == "" {
+		release.ID = random.UUID()
+	}
+	release.CreatedAt = now()
+	release.Version = 1
+	r := *release
+	c.releases[release.ID] = &r
+	c.addEvent("", ct.EventTypeRelease, release.ID, &r)
+	return nil
+}
+
+func (c *Client) DeleteRelease(releaseID string, cascade bool) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	release, ok := c.releases[releaseID]
+	if !ok {
+		return controller.ErrNotFound
+	}
+	return c.deleteRelease(release, cascade)
+}
+
+func (c *Client) deleteRelease(release *ct.Release, cascade bool) error {
+	releaseID := release.ID
+	for _, id := range c.appReleases {
+		if id == releaseID {
+			return ct.ValidationError{Message: "release is the current release of an app"}
+		}
+	}
+	for k := range c.formations {
+		if k.releaseID != releaseID {
+			continue
+		}
+		if !cascade {
+			return ct.ValidationError{Message: "release has a formation, use cascade to delete it"}
+		}
+		c.deleteFormation(k)
+	}
+	delete(c.releases, releaseID)
+	if !cascade {
+		return nil
+	}
+	used := make(map[string]bool)
+	for _, r := range c.releases {
+		for _, id := range releaseArtifactIDs(r) {
+			used[id] = true
+		}
+	}
+	for _, id := range releaseArtifactIDs(release) {
+		if !used[id] {
+			delete(c.artifacts, id)
+		}
+	}
+	return nil
+}
+
+func (c *Client) FormationList(appID string) ([]*ct.Formation, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	var formations []*ct.Formation
+	for k, formation := range c.formations {
+		if k.appID == app.ID {
+			f := *formation
+			formations = append(formations, &f)
+		}
+	}
+	return formations, nil
+}
+
+func (c *Client) GetFormation(appID, releaseID string) (*ct.Formation, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	formation, ok := c.formations[formationKey{app.ID, releaseID}]
+	if !ok {
+		return nil, controller.ErrNotFound
+	}
+	f := *formation
+	f.ETag = c.etags[formationETagKey(f.AppID, f.ReleaseID)]
+	return &f, nil
+}
+
+func formationETagKey(appID, releaseID string) string {
+	return "formation:" + appID + ":" + releaseID
+}
+
+func (c *Client) PutFormation(formation *ct.Formation) error {
+	return c.updateFormation(formation, false)
+}
+
+// PutFormationForce is like PutFormation but scales down a protected app.
+func (c *Client) PutFormationForce(formation *ct.Formation) error {
+	return c.updateFormation(formation, true)
+}
+
+func (c *Client) updateFormation(formation *ct.Formation, force bool) error {
+	if formation.AppID == "" || formation.ReleaseID == "" {
+		return errors.New("controller: missing app id and/or release id")
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(formation.AppID)
+	if err != nil {
+		return err
+	}
+	release, ok := c.releases[formation.ReleaseID]
+	if !ok {
+		return controller.ErrNotFound
+	}
+	formation.AppID = app.ID
+	if err := c.checkETag(formationETagKey(app.ID, release.ID), formation.ETag); err != nil {
+		return err
+	}
+	if formation.StateHash != "" {
+		current := ct.FormationStateHash(nil, nil)
+		if existing, ok := c.formations[formationKey{app.ID, release.ID}]; ok {
+			current = ct.FormationStateHash(existing.Processes, existing.Limits)
+		}
+		if formation.StateHash != current {
+			return controller.ErrConflict
+		}
+	}
+	for typ := range formation.Limits {
+		if _, ok := release.Processes[typ]; !ok {
+			return ct.ValidationError{Field: "limits." + typ, Message: "is not a process type of the release"}
+		}
+	}
+	for typ := range formation.Constraints {
+		if _, ok := release.Processes[typ]; !ok {
+			return ct.ValidationError{Field: "constraints." + typ, Message: "is not a process type of the release"}
+		}
+	}
+	if app.Protected && !force {
+		if err := checkProtectedScale(c.formations[formationKey{app.ID, release.ID}], formation.Processes); err != nil {
+			return err
+		}
+	}
+	if err := c.checkFormationQuota(formation, release); err != nil {
+		return err
+	}
+	c.putFormation(formation)
+	return nil
+}
+
+// putFormation stores the formation and notifies subscribers, the caller
+// must hold c.mtx.
+// UpdateFormations checks every formation of the batch before updating any.
+func (c *Client) UpdateFormations(batch []*ct.FormationScale, force bool) ([]*ct.Formation, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	formations := make([]*ct.Formation, len(batch))
+	seen := make(map[string]bool, len(batch))
+	for i, s := range batch {
+		field := fmt.Sprintf("formations[%d]", i)
+		app, err := c.app(s.AppID)
+		if err != nil {
+			return nil, ct.ValidationError{Field: field + ".app", Message: "app not found"}
+		}
+		if seen[app.ID] {
+			return nil, ct.ValidationError{Field: field + ".app", Message: "is already in the batch"}
+		}
+		seen[app.ID] = true
+		release, ok := c.releases[s.ReleaseID]
+		if !ok {
+			return nil, ct.ValidationError{Field: field + ".release", Message: "release not found"}
+		}
+		for typ := range s.Processes {
+			if _, ok := release.Processes[typ]; !ok {
+				return nil, ct.ValidationError{Field: field + ".processes." + typ, Message: "is not a process type of the release"}
+			}
+		}
+		current := c.formations[formationKey{app.ID, release.ID}]
+		f := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: make(map[string]int)}
+		if current != nil {
+			f.Limits = current.Limits
+			f.Constraints = current.Constraints
+			for typ, n := range current.Processes {
+				f.Processes[typ] = n
+			}
+		}
+		for typ, n := range s.Processes {
+			if n == 0 {
+				delete(f.Processes, typ)
+			} else {
+				f.Processes[typ] = n
+			}
+		}
+		if app.Protected && !force {
+			if err := checkProtectedScale(current, f.Processes); err != nil {
+				e := err.(ct.ValidationError)
+				e.Field = field + "." + e.Field
+				return nil, e
+			}
+		}
+		if err := c.checkFormationQuota(f, release); err != nil {
+			return nil, err
+		}
+		formations[i] = f
+	}
+	for _, f := range formations {
+		c.putFormation(f)
+	}
+	return formations, nil
+}
+
+func (c *Client) putFormation(formation *ct.Formation) {
+	k := formationKey{formation.AppID, formation.ReleaseID}
+	formation.UpdatedAt = now()
+	if existing, ok := c.formations[k]; ok {
+		formation.CreatedAt = existing.CreatedAt
+	} else {
+		formation.CreatedAt = formation.UpdatedAt
+	}
+	formation.ETag = c.touch(formationETagKey(k.appID, k.releaseID))
+	formation.StateHash = ct.FormationStateHash(formation.Processes, formation.Limits)
+	f := *formation
+	c.formations[k] = &f
+	c.addAppHistory(k.appID, k.releaseID)
+	c.addEvent(f.AppID, ct.EventTypeFormation, f.AppID+":"+f.ReleaseID, &f)
+	c.publish(c.expandFormation(&f))
+}
+
+func (c *Client) DeleteFormation(appID, releaseID string, force bool) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return err
+	}
+	k := formationKey{app.ID, releaseID}
+	f, ok := c.formations[k]
+	if !ok {
+		return controller.ErrNotFound
+	}
+	if app.Protected && !force {
+		if err := checkProtectedScale(f, nil); err != nil {
+			return err
+		}
+	}
+	c.deleteFormation(k)
+	return nil
+}
+
+// checkProtectedScale returns an error if the processes scale a process type
+// of the protected app's current formation which has jobs to zero.
+func checkProtectedScale(current *ct.Formation, procs map[string]int) error {
+	if current == nil {
+		return nil
+	}
+	for typ, n := range current.Processes {
+		if n > 0 && procs[typ] == 0 {
+			return ct.ValidationError{Field: "processes." + typ, Message: "unable to scale to zero, app is protected, use force to scale it down"}
+		}
+	}
+	return nil
+}
+
+// deleteFormation removes the formation and notifies subscribers, the
+// caller must hold c.mtx.
+func (c *Client) deleteFormation(k formationKey) {
+	f := c.formations[k]
+	delete(c.formations, k)
+	delete(c.etags, formationETagKey(k.appID, k.releaseID))
+	deleted := &ct.Formation{AppID: k.appID, ReleaseID: k.releaseID, CreatedAt: f.CreatedAt, UpdatedAt: now()}
+	c.addEvent(k.appID, ct.EventTypeFormation, k.appID+":"+k.releaseID, deleted)
+	c.publish(c.expandFormation(deleted))
+}
+
+func (c *Client) expandFormation(f *ct.Formation) *ct.ExpandedFormation {
+	ef := &ct.ExpandedFormation{Processes: f.Processes, Limits: f.Limits, Constraints: f.Constraints, UpdatedAt: *f.UpdatedAt}
+	if env := c.appEnv[f.AppID]; len(env) > 0 {
+		ef.AppEnv = copyEnv(env)
+	}
+	ef.LogDrains = c.appLogDrains(f.AppID)
+	if app, ok := c.apps[f.AppID]; ok {
+		a := *app
+		ef.App = &a
+	} else {
+		ef.App = &ct.App{ID: f.AppID}
+	}
+	if release, ok := c.releases[f.ReleaseID]; ok {
+		r := *release
+		ef.Release = &r
+		for _, id := range releaseArtifactIDs(release) {
+			if artifact, ok := c.artifacts[id]; ok {
+				a := *artifact
+				ef.Artifacts = append(ef.Artifacts, &a)
+			}
+		}
+		if len(ef.Artifacts) > 0 && ef.Artifacts[0].ID == release.ArtifactID {
+			ef.Artifact = ef.Artifacts[0]
+		}
+	}
+	return ef
+}
+
+// StreamFormations sends existing formations updated after since followed by
+// an empty formation, then sends formations as they change. Deleted
+// formations are sent without processes.
+func (c *Client) StreamFormations(since *time.Time) (*controller.FormationUpdates, *error) {
+	ch := make(chan *ct.ExpandedFormation)
+	var err error
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	sub := c.subscribe(func(v interface{}, done <-chan struct{}) bool {
+		f, ok := v.(*ct.ExpandedFormation)
+		if !ok {
+			return true
+		}
+		select {
+		case ch <- f:
+			return true
+		case <-done:
+			return false
+		}
+	}, func() { close(ch) })
+	for _, f := range c.formations {
+		if since == nil || f.UpdatedAt.After(*since) {
+			sub.send(c.expandFormation(f))
+		}
+	}
+	sub.send(&ct.ExpandedFormation{})
+	return controller.NewFormationUpdates(ch, sub), &err
+}
+
+// GetJob returns the job, the fake has no hosts so only the fields recorded
+// by the controller are set.
+func (c *Client) GetJob(appID, jobID string) (*ct.JobDetail, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	job, ok := c.jobs[jobID]
+	if !ok || job.AppID != app.ID {
+		return nil, controller.ErrNotFound
+	}
+	detail := &ct.JobDetail{Job: *job}
+	detail.HostID, _, _ = cluster.ParseJobID(job.ID)
+	for _, j := range c.jobs {
+		if j.AppID == job.AppID && j.ReleaseID == job.ReleaseID && j.Type == job.Type && j.State == "crashed" && j.CreatedAt.Before(*job.CreatedAt) {
+			detail.Restarts++
+		}
+	}
+	return detail, nil
+}
+
+// AppProcesses returns the desired number of jobs of each of the app's
+// process types, the fake has no hosts so jobs recorded as up are counted as
+// running.
+func (c *Client) AppProcesses(appID string) ([]*ct.ProcessStatus, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]*ct.ProcessStatus)
+	status := func(typ string) *ct.ProcessStatus {
+		s, ok := statuses[typ]
+		if !ok {
+			s = &ct.ProcessStatus{Type: typ}
+			statuses[typ] = s
+		}
+		return s
+	}
+	for k, f := range c.formations {
+		if k.appID != app.ID {
+			continue
+		}
+		for typ, n := range f.Processes {
+			status(typ).Desired += n
+		}
+	}
+	crashedSince := time.Now().Add(-10 * time.Minute)
+	for _, job := range c.jobs {
+		if job.AppID != app.ID || job.Type == "" {
+			continue
+		}
+		switch job.State {
+		case "up":
+			status(job.Type).Running++
+		case "starting":
+			status(job.Type).Pending++
+		case "crashed":
+			if job.UpdatedAt.After(crashedSince) {
+				status(job.Type).Crashed++
+			}
+		}
+	}
+	types := make([]string, 0, len(statuses))
+	for typ := range statuses {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	res := make([]*ct.ProcessStatus, len(types))
+	for i, typ := range types {
+		res[i] = statuses[typ]
+	}
+	return res, nil
+}
+
+func (c *Client) JobList(appID string) ([]*ct.Job, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*ct.Job
+	for _, job := range c.jobs {
+		if job.AppID == app.ID {
+			j := *job
+			jobs = append(jobs, &j)
+		}
+	}
+	return jobs, nil
+}
+
+func (c *Client) PutJob(job *ct.Job) error {
+	if job.ID == "" || job.AppID == "" {
+		return errors.New("controller: missing job id and/or app id")
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(job.AppID)
+	if err != nil {
+		return err
+	}
+	job.AppID = app.ID
+	c.putJob(job)
+	return nil
+}
+
+func (c *Client) putJob(job *ct.Job) {
+	job.UpdatedAt = now()
+	if existing, ok := c.jobs[job.ID]; ok {
+		job.CreatedAt = existing.CreatedAt
+	} else {
+		job.CreatedAt = job.UpdatedAt
+	}
+	j := *job
+	c.jobs[job.ID] = &j
+	id := c.addEvent(j.AppID, ct.EventTypeJob, j.ID, &j)
+	c.publish(&ct.JobEvent{Job: j, ID: id, JobID: j.ID})
+}
+
+// DeleteJob marks the job as stopped.
+func (c *Client) DeleteJob(appID, jobID string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	job, err := c.job(appID, jobID)
+	if err != nil {
+		return err
+	}
+	j := *job
+	j.State = "down"
+	c.putJob(&j)
+	return nil
+}
+
+func (c *Client) job(appID, jobID string) (*ct.Job, error) {
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	job, ok := c.jobs[jobID]
+	if !ok || job.AppID != app.ID {
+		return nil, controller.ErrNotFound
+	}
+	return job, nil
+}
+
+// SignalJob checks the job exists, signals are not delivered anywhere.
+func (c *Client) SignalJob(appID, jobID string, sig int) error {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	_, err := c.job(appID, jobID)
+	return err
+}
+
+// RunJobDetached records a job in the starting state.
+func (c *Client) RunJobDetached(appID string, req *ct.NewJob) (*ct.Job, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.releases[req.ReleaseID]; !ok {
+		return nil, ct.ValidationError{Field: "release", Message: "does not exist"}
+	}
+	job := &ct.Job{
+		ID:        random.UUID(),
+		AppID:     app.ID,
+		ReleaseID: req.ReleaseID,
+		State:     "starting",
+		Cmd:       req.Cmd,
+	}
+	c.putJob(job)
+	return job, nil
+}
+
+func (c *Client) RunJobAttached(appID string, job *ct.NewJob) (utils.ReadWriteCloser, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *Client) ExecJob(appID, jobID string, exec *ct.JobExec) (utils.ReadWriteCloser, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *Client) GetJobLog(appID, jobID string, tail bool) (io.ReadCloser, error) {
+	return nil, ErrNotSupported
+}
+
+func (c *Client) StreamJobEvents(appID string) (*controller.JobEventStream, error) {
+	events := make(chan *ct.JobEvent)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	sub := c.subscribe(func(v interface{}, done <-chan struct{}) bool {
+		e, ok := v.(*ct.JobEvent)
+		if !ok || e.AppID != app.ID {
+			return true
+		}
+		select {
+		case events <- e:
+			return true
+		case <-done:
+			return false
+		}
+	}, func() { close(events) })
+	return controller.NewJobEventStream(events, sub), nil
+}
+
+// CreateDeployment completes the deployment immediately, moving the
+// processes of the app's current release to the new release.
+func (c *Client) CreateDeployment(deployment *ct.Deployment) error {
+	if deployment.AppID == "" || deployment.NewReleaseID == "" {
+		return errors.New("controller: missing app id and/or new release id")
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.createDeployment(deployment)
+}
+
+func (c *Client) createDeployment(deployment *ct.Deployment) error {
+	app, err := c.app(deployment.AppID)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.releases[deployment.NewReleaseID]; !ok {
+		return ct.ValidationError{Field: "new_release", Message: "does not exist"}
+	}
+	if deployment.NewReleaseID == c.appReleases[app.ID] {
+		return ct.ValidationError{Field: "new_release", Message: "is already the current release"}
+	}
+	switch deployment.Strategy {
+	case "":
+		deployment.Strategy = ct.DeployStrategyAllAtOnce
+	case ct.DeployStrategyAllAtOnce, ct.DeployStrategyOneByOne:
+	case ct.DeployStrategyCanary:
+		if deployment.CanaryPercent < 1 || deployment.CanaryPercent > 100 {
+			return ct.ValidationError{Field: "canary_percent", Message: "must be between 1 and 100"}
+		}
+	default:
+		return ct.ValidationError{Field: "strategy", Code: ct.ValidationCodeInvalidFormat, Message: "must be one of all-at-once, canary, one-by-one"}
+	}
+	if deployment.DeployTimeout < 0 {
+		return ct.ValidationError{Field: "deploy_timeout", Message: "must not be negative"}
+	} else if deployment.DeployTimeout == 0 {
+		deployment.DeployTimeout = ct.DefaultDeployTimeout
+	}
+	for typ, n := range deployment.ProcessTimeouts {
+		if n < 0 {
+			return ct.ValidationError{Field: "process_timeouts." + typ, Message: "must not be negative"}
+		}
+	}
+	deployment.ID = random.UUID()
+	deployment.AppID = app.ID
+	deployment.OldReleaseID = c.appReleases[app.ID]
+	if old, ok := c.formations[formationKey{app.ID, deployment.OldReleaseID}]; ok {
+		if deployment.Processes == nil {
+			deployment.Processes = old.Processes
+		}
+		c.deleteFormation(formationKey{app.ID, old.ReleaseID})
+	}
+	c.putFormation(&ct.Formation{AppID: app.ID, ReleaseID: deployment.NewReleaseID, Processes: deployment.Processes})
+	c.setAppRelease(app.ID, deployment.NewReleaseID)
+	deployment.Status = ct.DeploymentStatusComplete
+	deployment.CreatedAt = now()
+	deployment.FinishedAt = deployment.CreatedAt
+	d := *deployment
+	c.deployments[d.ID] = &d
+	return nil
+}
+
+func (c *Client) GetDeployment(appID, deploymentID string) (*ct.Deployment, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	deployment, ok := c.deployments[deploymentID]
+	if !ok || deployment.AppID != app.ID {
+		return nil, controller.ErrNotFound
+	}
+	d := *deployment
+	return &d, nil
+}
+
+// StreamDeployment sends the final event of the deployment, deployments are
+// completed when they are created.
+func (c *Client) StreamDeployment(appID, deploymentID string, ch chan<- *ct.DeploymentEvent) (controller.Stream, error) {
+	d, err := c.GetDeployment(appID, deploymentID)
+	if err != nil {
+		return nil, err
+	}
+	sub := newSubscriber(func(v interface{}, done <-chan struct{}) bool {
+		select {
+		case ch <- v.(*ct.DeploymentEvent):
+		case <-done:
+		}
+		// the deployment has finished, so end the stream
+		return false
+	}, func() { close(ch) })
+	sub.send(&ct.DeploymentEvent{
+		DeploymentID: d.ID,
+		ReleaseID:    d.NewReleaseID,
+		Status:       d.Status,
+		CreatedAt:    d.FinishedAt,
+	})
+	return sub, nil
+}
+
+// RollbackApp moves the processes of the app's current release to the
+// release, defaulting to the app's previous release, and records a completed
+// deployment.
+func (c *Client) RollbackApp(appID, releaseID string) (*ct.Deployment, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	current := c.appReleases[app.ID]
+	if current == "" {
+		return nil, ct.ValidationError{Field: "app", Message: "has no release to roll back"}
+	}
+	if releaseID == "" {
+		for i := len(c.events) - 1; i >= 0; i-- {
+			e := c.events[i]
+			if e.AppID != app.ID || e.ObjectType != ct.EventTypeAppRelease {
+				continue
+			}
+			var data ct.AppReleaseEvent
+			json.Unmarshal(e.Data, &data)
+			releaseID = data.PrevReleaseID
+			break
+		}
+		if releaseID == "" {
+			return nil, ct.ValidationError{Field: "release", Message: "must be set as the app has no previous release"}
+		}
+	}
+	release, ok := c.releases[releaseID]
+	if !ok {
+		return nil, ct.ValidationError{Field: "release", Message: "does not exist"}
+	}
+	if releaseID == current {
+		return nil, ct.ValidationError{Field: "release", Message: "is already the current release"}
+	}
+	d := &ct.Deployment{
+		ID:           random.UUID(),
+		AppID:        app.ID,
+		OldReleaseID: current,
+		NewReleaseID: releaseID,
+		Strategy:     ct.DeployStrategyRollback,
+		Status:       ct.DeploymentStatusComplete,
+		Processes:    make(map[string]int),
+		CreatedAt:    now(),
+	}
+	d.FinishedAt = d.CreatedAt
+	if old, ok := c.formations[formationKey{app.ID, current}]; ok {
+		for typ, n := range old.Processes {
+			if _, ok := release.Processes[typ]; ok {
+				d.Processes[typ] = n
+			}
+		}
+		c.deleteFormation(formationKey{app.ID, current})
+		c.putFormation(&ct.Formation{AppID: app.ID, ReleaseID: releaseID, Processes: d.Processes, Limits: old.Limits, Constraints: old.Constraints})
+	}
+	c.setAppRelease(app.ID, releaseID)
+	c.deployments[d.ID] = d
+	res := *d
+	return &res, nil
+}
+
+// PromoteApp copies the app's current release to the target app and
+// completes a deployment of the copy.
+func (c *Client) PromoteApp(appID string, promotion *ct.Promotion) (*ct.Deployment, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	source, ok := c.releases[c.appReleases[app.ID]]
+	if !ok {
+		return nil, ct.ValidationError{Field: "app", Message: "has no release to promote"}
+	}
+	target, err := c.app(promotion.TargetAppID)
+	if err == controller.ErrNotFound {
+		return nil, ct.ValidationError{Field: "target", Message: "does not exist"}
+	} else if err != nil {
+		return nil, err
+	}
+	if target.ID == app.ID {
+		return nil, ct.ValidationError{Field: "target", Message: "must not be the source app"}
+	}
+
+	release := &ct.Release{
+		ArtifactID:  source.ArtifactID,
+		ArtifactIDs: append([]string(nil), source.ArtifactIDs...),
+		Env:         make(map[string]string, len(source.Env)+len(promotion.Env)),
+		Processes:   source.Processes,
+		Meta:        make(map[string]string, len(source.Meta)+2),
+	}
+	for k, v := range source.Env {
+		release.Env[k] = v
+	}
+	for _, k := range promotion.UnsetEnv {
+		delete(release.Env, k)
+	}
+	for k, v := range promotion.Env {
+		release.Env[k] = v
+	}
+	for k, v := range source.Meta {
+		release.Meta[k] = v
+	}
+	release.Meta[ct.ReleaseMetaPromotedFrom] = app.ID
+	release.Meta[ct.ReleaseMetaPromotedRelease] = source.ID
+	if err := c.createRelease(release); err != nil {
+		return nil, err
+	}
+	d := &ct.Deployment{
+		AppID:           target.ID,
+		NewReleaseID:    release.ID,
+		Strategy:        promotion.Strategy,
+		CanaryPercent:   promotion.CanaryPercent,
+		DeployTimeout:   promotion.DeployTimeout,
+		ProcessTimeouts: promotion.ProcessTimeouts,
+		Processes:       promotion.Processes,
+	}
+	return d, c.createDeployment(d)
+}
+
+// PutAutoscalePolicy stores the policy, the fake does not scale formations.
+func (c *Client) PutAutoscalePolicy(policy *ct.AutoscalePolicy) error {
+	if policy.AppID == "" || policy.ProcessType == "" {
+		return errors.New("controller: missing app id and/or process type")
+	}
+	if policy.Metric == "" {
+		policy.Metric = ct.AutoscaleMetricRequests
+	}
+	switch {
+	case policy.Metric != ct.AutoscaleMetricRequests:
+		return ct.ValidationError{Field: "metric", Message: "must be " + ct.AutoscaleMetricRequests}
+	case policy.Min < 0:
+		return ct.ValidationError{Field: "min", Message: "must not be negative"}
+	case policy.Max < 1 || policy.Max < policy.Min:
+		return ct.ValidationError{Field: "max", Message: "must be at least 1 and not less than min"}
+	case policy.Target <= 0:
+		return ct.ValidationError{Field: "target", Message: "must be positive"}
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(policy.AppID)
+	if err != nil {
+		return err
+	}
+	policy.AppID = app.ID
+	k := autoscaleKey{app.ID, policy.ProcessType}
+	policy.CreatedAt = now()
+	if old, ok := c.autoscale[k]; ok {
+		policy.CreatedAt = old.CreatedAt
+	}
+	policy.UpdatedAt = now()
+	p := *policy
+	c.autoscale[k] = &p
+	return nil
+}
+
+func (c *Client) AutoscalePolicyList(appID string) ([]*ct.AutoscalePolicy, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	list := []*ct.AutoscalePolicy{}
+	for k, policy := range c.autoscale {
+		if k.appID == app.ID {
+			p := *policy
+			list = append(list, &p)
+		}
+	}
+	sort.Sort(policiesByProcessType(list))
+	return list, nil
+}
+
+type policiesByProcessType []*ct.AutoscalePolicy
+
+func (p policiesByProcessType) Len() int           { return len(p) }
+func (p policiesByProcessType) Less(i, j int) bool { return p[i].ProcessType < p[j].ProcessType }
+func (p policiesByProcessType) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func (c *Client) DeleteAutoscalePolicy(appID, processType string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return err
+	}
+	k := autoscaleKey{app.ID, processType}
+	if _, ok := c.autoscale[k]; !ok {
+		return controller.ErrNotFound
+	}
+	delete(c.autoscale, k)
+	return nil
+}
+
+// CreateCronJob stores the cron job, the fake does not run cron jobs so they
+// never have any runs.
+func (c *Client) CreateCronJob(cronJob *ct.CronJob) error {
+	if cronJob.AppID == "" {
+		return errors.New("controller: missing app id")
+	}
+	if _, err := cron.Parse(cronJob.Schedule); err != nil {
+		return ct.ValidationError{Field: "schedule", Message: err.Error()}
+	}
+	if cronJob.ProcessType == "" && len(cronJob.Cmd) == 0 {
+		return ct.ValidationError{Field: "cmd", Message: "must be set if process_type is not"}
+	}
+	switch cronJob.ConcurrencyPolicy {
+	case "":
+		cronJob.ConcurrencyPolicy = ct.CronConcurrencyAllow
+	case ct.CronConcurrencyAllow, ct.CronConcurrencyForbid, ct.CronConcurrencyReplace:
+	default:
+		return ct.ValidationError{Field: "concurrency_policy", Message: "must be one of allow, forbid, replace"}
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(cronJob.AppID)
+	if err != nil {
+		return err
+	}
+	cronJob.ID = random.UUID()
+	cronJob.AppID = app.ID
+	cronJob.LastScheduledAt = nil
+	cronJob.CreatedAt = now()
+	cj := *cronJob
+	c.cronJobs[cj.ID] = &cj
+	return nil
+}
+
+type cronJobsByCreatedAt []*ct.CronJob
+
+func (a cronJobsByCreatedAt) Len() int           { return len(a) }
+func (a cronJobsByCreatedAt) Less(i, j int) bool { return a[i].CreatedAt.Before(*a[j].CreatedAt) }
+func (a cronJobsByCreatedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func (c *Client) CronJobList(appID string) ([]*ct.CronJob, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	list := []*ct.CronJob{}
+	for _, cronJob := range c.cronJobs {
+		if cronJob.AppID == app.ID {
+			cj := *cronJob
+			list = append(list, &cj)
+		}
+	}
+	sort.Sort(cronJobsByCreatedAt(list))
+	return list, nil
+}
+
+// cronJob returns the cron job if it belongs to the app. The caller must
+// hold c.mtx.
+func (c *Client) cronJob(appID, cronJobID string) (*ct.CronJob, error) {
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	cronJob, ok := c.cronJobs[cronJobID]
+	if !ok || cronJob.AppID != app.ID {
+		return nil, controller.ErrNotFound
+	}
+	return cronJob, nil
+}
+
+func (c *Client) GetCronJob(appID, cronJobID string) (*ct.CronJob, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	cronJob, err := c.cronJob(appID, cronJobID)
+	if err != nil {
+		return nil, err
+	}
+	cj := *cronJob
+	return &cj, nil
+}
+
+func (c *Client) DeleteCronJob(appID, cronJobID string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	cronJob, err := c.cronJob(appID, cronJobID)
+	if err != nil {
+		return err
+	}
+	delete(c.cronJobs, cronJob.ID)
+	return nil
+}
+
+func (c *Client) CronJobRunList(appID, cronJobID string) ([]*ct.CronJobRun, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if _, err := c.cronJob(appID, cronJobID); err != nil {
+		return nil, err
+	}
+	return []*ct.CronJobRun{}, nil
+}
+
+func (c *Client) CreateLogDrain(drain *ct.LogDrain) error {
+	if drain.AppID == "" {
+		return errors.New("controller: missing app id")
+	}
+	u, err := url.Parse(drain.URL)
+	if err != nil || u.Host == "" {
+		return ct.ValidationError{Field: "url", Code: ct.ValidationCodeInvalidFormat, Message: "is not a valid URL"}
+	}
+	switch u.Scheme {
+	case "syslog", "syslog+tls":
+		if drain.Username != "" || drain.Password != "" {
+			return ct.ValidationError{Field: "username", Message: "is only supported by https drains"}
+		}
+	case "https":
+	default:
+		return ct.ValidationError{Field: "url", Code: ct.ValidationCodeInvalidFormat, Message: "scheme must be one of syslog, syslog+tls, https"}
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(drain.AppID)
+	if err != nil {
+		return err
+	}
+	drain.ID = random.UUID()
+	drain.AppID = app.ID
+	drain.CreatedAt = now()
+	d := *drain
+	c.logDrains[d.ID] = &d
+	c.touchFormations(app.ID)
+	return nil
+}
+
+type logDrainsByCreatedAt []*ct.LogDrain
+
+func (a logDrainsByCreatedAt) Len() int           { return len(a) }
+func (a logDrainsByCreatedAt) Less(i, j int) bool { return a[i].CreatedAt.Before(*a[j].CreatedAt) }
+func (a logDrainsByCreatedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// appLogDrains returns copies of the app's log drains. The caller must hold
+// c.mtx.
+func (c *Client) appLogDrains(appID string) []*ct.LogDrain {
+	var list []*ct.LogDrain
+	for _, drain := range c.logDrains {
+		if drain.AppID == appID {
+			d := *drain
+			list = append(list, &d)
+		}
+	}
+	sort.Sort(logDrainsByCreatedAt(list))
+	return list
+}
+
+func (c *Client) LogDrainList(appID string) ([]*ct.LogDrain, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	list := c.appLogDrains(app.ID)
+	if list == nil {
+		list = []*ct.LogDrain{}
+	}
+	return list, nil
+}
+
+// logDrain returns the log drain if it belongs to the app. The caller must
+// hold c.mtx.
+func (c *Client) logDrain(appID, drainID string) (*ct.LogDrain, error) {
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	drain, ok := c.logDrains[drainID]
+	if !ok || drain.AppID != app.ID {
+		return nil, controller.ErrNotFound
+	}
+	return drain, nil
+}
+
+func (c *Client) GetLogDrain(appID, drainID string) (*ct.LogDrain, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	drain, err := c.logDrain(appID, drainID)
+	if err != nil {
+		return nil, err
+	}
+	d := *drain
+	return &d, nil
+}
+
+func (c *Client) DeleteLogDrain(appID, drainID string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	drain, err := c.logDrain(appID, drainID)
+	if err != nil {
+		return err
+	}
+	delete(c.logDrains, drain.ID)
+	c.touchFormations(drain.AppID)
+	return nil
+}
+
+// touchFormations publishes the app's formations so that watchers see
+// changes to the app which apply to its jobs. The caller must hold c.mtx.
+func (c *Client) touchFormations(appID string) {
+	for k, f := range c.formations {
+		if k.appID == appID {
+			f.UpdatedAt = now()
+			c.publish(c.expandFormation(f))
+		}
+	}
+}
+
+// addEvent records an event for the object and publishes it, returning its
+// ID. The caller must hold c.mtx.
+func (c *Client) addEvent(appID, objectType, objectID string, data interface{}) int64 {
+	encoded, _ := json.Marshal(data)
+	e := &ct.Event{
+		ID:         int64(len(c.events) + 1),
+		AppID:      appID,
+		ObjectType: objectType,
+		ObjectID:   objectID,
+		Data:       encoded,
+		CreatedAt:  now(),
+	}
+	c.events = append(c.events, e)
+	c.publish(e)
+	return e.ID
+}
+
+func matchEvent(opts controller.StreamEventsOptions, e *ct.Event) bool {
+	if opts.AppID != "" && e.AppID != opts.AppID {
+		return false
+	}
+	if len(opts.ObjectTypes) == 0 {
+		return true
+	}
+	for _, t := range opts.ObjectTypes {
+		if e.ObjectType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// ListEvents returns the events matching opts, most recent first.
+func (c *Client) ListEvents(opts controller.ListEventsOptions) ([]*ct.Event, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	count := opts.Count
+	if count <= 0 {
+		count = 100
+	}
+	match := controller.StreamEventsOptions{AppID: opts.AppID, ObjectTypes: opts.ObjectTypes}
+	events := []*ct.Event{}
+	for i := len(c.events) - 1; i >= 0 && len(events) < count; i-- {
+		e := c.events[i]
+		if e.ID <= opts.SinceID || !matchEvent(match, e) {
+			continue
+		}
+		if !opts.Since.IsZero() && e.CreatedAt.Before(opts.Since) {
+			continue
+		}
+		if !opts.Until.IsZero() && !e.CreatedAt.Before(opts.Until) {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// AuditLog returns no entries, as the fake does not record requests.
+func (c *Client) AuditLog(opts controller.AuditLogOptions) ([]*ct.AuditEntry, error) {
+	return []*ct.AuditEntry{}, nil
+}
+
+// StreamEvents sends events after opts.Since that match opts, followed by
+// new events as they are recorded.
+func (c *Client) StreamEvents(opts controller.StreamEventsOptions, ch chan<- *ct.Event) (controller.Stream, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	sub := c.subscribe(func(v interface{}, done <-chan struct{}) bool {
+		e, ok := v.(*ct.Event)
+		if !ok || !matchEvent(opts, e) {
+			return true
+		}
+		select {
+		case ch <- e:
+			return true
+		case <-done:
+			return false
+		}
+	}, func() { close(ch) })
+	if opts.Since > 0 && opts.Since < int64(len(c.events)) {
+		for _, e := range c.events[opts.Since:] {
+			sub.send(e)
+		}
+	}
+	return sub, nil
+}
+
+func (c *Client) ProviderList() ([]*ct.Provider, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	var providers []*ct.Provider
+	for _, provider := range c.providers {
+		p := *provider
+		providers = append(providers, &p)
+	}
+	return providers, nil
+}
+
+func (c *Client) CreateProvider(provider *ct.Provider) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, p := range c.providers {
+		if p.Name == provider.Name {
+			return ct.ValidationError{Field: "name", Message: "is already taken"}
+		}
+	}
+	if provider.ID == "" {
+		provider.ID = random.UUID()
+	}
+	provider.CreatedAt = now()
+	provider.UpdatedAt = provider.CreatedAt
+	p := *provider
+	c.providers[p.ID] = &p
+	return nil
+}
+
+func (c *Client) provider(id string) (*ct.Provider, error) {
+	if p, ok := c.providers[id]; ok {
+		return p, nil
+	}
+	for _, p := range c.providers {
+		if p.Name == id {
+			return p, nil
+		}
+	}
+	return nil, controller.ErrNotFound
+}
+
+// ProviderStatus reports that the provider is reachable, the provider is not
+// contacted.
+func (c *Client) ProviderStatus(providerID string) (*ct.ProviderStatus, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	provider, err := c.provider(providerID)
+	if err != nil {
+		return nil, err
+	}
+	return &ct.ProviderStatus{ProviderID: provider.ID, Reachable: true, CheckedAt: *now()}, nil
+}
+
+// ProvisionResource creates a resource with an empty environment, the
+// provider is not contacted.
+func (c *Client) ProvisionResource(req *ct.ResourceReq) (*ct.Resource, error) {
+	if req.ProviderID == "" {
+		return nil, errors.New("controller: missing provider id")
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	provider, err := c.provider(req.ProviderID)
+	if err != nil {
+		return nil, err
+	}
+	resource := &ct.Resource{
+		ID:           random.UUID(),
+		ProviderID:   provider.ID,
+		ProviderName: provider.Name,
+		Env:          make(map[string]string),
+		Version:      1,
+	}
+	for _, id := range req.Apps {
+		app, err := c.app(id)
+		if err != nil {
+			return nil, err
+		}
+		resource.Apps = append(resource.Apps, app.ID)
+	}
+	resource.CreatedAt = now()
+	resource.ETag = c.touch("resource:" + resource.ID)
+	r := *resource
+	c.resources[r.ID] = &r
+	return resource, nil
+}
+
+func (c *Client) resource(providerID, resourceID string) (*ct.Resource, error) {
+	provider, err := c.provider(providerID)
+	if err != nil {
+		return nil, err
+	}
+	resource, ok := c.resources[resourceID]
+	if !ok || resource.ProviderID != provider.ID {
+		return nil, controller.ErrNotFound
+	}
+	return resource, nil
+}
+
+func (c *Client) GetResource(providerID, resourceID string) (*ct.Resource, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	resource, err := c.resource(providerID, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	r := *resource
+	r.ETag = c.etags["resource:"+r.ID]
+	return &r, nil
+}
+
+func (c *Client) PutResource(resource *ct.Resource) error {
+	if resource.ID == "" || resource.ProviderID == "" {
+		return errors.New("controller: missing id and/or provider id")
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	provider, err := c.provider(resource.ProviderID)
+	if err != nil {
+		return err
+	}
+	resource.ProviderID = provider.ID
+	resource.ProviderName = provider.Name
+	if existing, ok := c.resources[resource.ID]; ok {
+		if err := c.checkETag("resource:"+resource.ID, resource.ETag); err != nil {
+			return err
+		}
+		if resource.Version != 0 && resource.Version != existing.Version {
+			return controller.ErrConflict
+		}
+		existing.ExternalID = resource.ExternalID
+		existing.Env = resource.Env
+		existing.Version++
+		*resource = *existing
+	} else {
+		if resource.ETag != "" {
+			return controller.ErrPreconditionFailed
+		}
+		if resource.Version != 0 {
+			return controller.ErrConflict
+		}
+		resource.CreatedAt = now()
+		resource.Version = 1
+		r := *resource
+		c.resources[r.ID] = &r
+	}
+	resource.ETag = c.touch("resource:" + resource.ID)
+	return nil
+}
+
+// DeleteResource deletes the resource and unbinds it from its apps, the
+// provider is not contacted.
+func (c *Client) DeleteResource(providerID, resourceID string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	resource, err := c.resource(providerID, resourceID)
+	if err != nil {
+		return err
+	}
+	delete(c.resources, resource.ID)
+	delete(c.etags, "resource:"+resource.ID)
+	for _, appID := range resource.Apps {
+		c.addEvent(appID, ct.EventTypeResourceDeletion, resource.ID, resource)
+	}
+	return nil
+}
+
+func (c *Client) AddResourceApp(providerID, resourceID, appID string) (*ct.Resource, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	resource, err := c.resource(providerID, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	resource.Apps = append(removeString(resource.Apps, app.ID), app.ID)
+	resource.Version++
+	c.touch("resource:" + resource.ID)
+	r := *resource
+	return &r, nil
+}
+
+func (c *Client) RemoveResourceApp(providerID, resourceID, appID string) (*ct.Resource, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	resource, err := c.resource(providerID, resourceID)
+	if err != nil {
+		return nil, err
+	}
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	apps := removeString(resource.Apps, app.ID)
+	if len(apps) == len(resource.Apps) {
+		return nil, controller.ErrNotFound
+	}
+	resource.Apps = apps
+	resource.Version++
+	c.touch("resource:" + resource.ID)
+	r := *resource
+	return &r, nil
+}
+
+type resourcesByCreatedAt []*ct.Resource
+
+func (a resourcesByCreatedAt) Len() int           { return len(a) }
+func (a resourcesByCreatedAt) Less(i, j int) bool { return a[i].CreatedAt.Before(*a[j].CreatedAt) }
+func (a resourcesByCreatedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func (c *Client) AppResourceList(appID string) ([]*ct.Resource, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	var list []*ct.Resource
+	for _, resource := range c.resources {
+		for _, id := range resource.Apps {
+			if id == app.ID {
+				r := *resource
+				list = append(list, &r)
+				break
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(resourcesByCreatedAt(list)))
+	return list, nil
+}
+
+func removeString(s []string, v string) []string {
+	res := make([]string, 0, len(s))
+	for _, x := range s {
+		if x != v {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+func routeParentRef(appID string) string {
+	return "controller/apps/" + appID
+}
+
+func (c *Client) RouteList(appID string) ([]*router.Route, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	var routes []*router.Route
+	for _, route := range c.routes {
+		if route.ParentRef == routeParentRef(app.ID) {
+			r := *route
+			routes = append(routes, &r)
+		}
+	}
+	return routes, nil
+}
+
+func (c *Client) GetRoute(appID string, routeID string) (*router.Route, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return nil, err
+	}
+	route, ok := c.routes[routeID]
+	if !ok || route.ParentRef != routeParentRef(app.ID) {
+		return nil, controller.ErrNotFound
+	}
+	r := *route
+	return &r, nil
+}
+
+func (c *Client) CreateRoute(appID string, route *router.Route) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return err
+	}
+	if route.Config == nil {
+		return router.ErrNoConfig
+	}
+	if quota := c.appQuotas[app.ID]; quota.MaxRoutes > 0 {
+		var n int
+		for _, r := range c.routes {
+			if r.ParentRef == routeParentRef(app.ID) {
+				n++
+			}
+		}
+		if n >= quota.MaxRoutes {
+			return ct.QuotaError{Quota: ct.QuotaRoutes, Limit: quota.MaxRoutes, Message: fmt.Sprintf("app has %d routes, its quota is %d", n, quota.MaxRoutes)}
+		}
+	}
+	route.ID = route.Type + "/" + random.UUID()
+	route.ParentRef = routeParentRef(app.ID)
+	route.CreatedAt = now()
+	route.UpdatedAt = route.CreatedAt
+	if app.Maintenance && route.Type == "http" {
+		*route = *maintenanceRoute(route, true)
+	}
+	r := *route
+	c.routes[r.ID] = &r
+	return nil
+}
+
+// maintenanceRoute returns a copy of the HTTP route with maintenance mode set
+// to on, as the controller sets it on the routes of apps in maintenance.
+func maintenanceRoute(route *router.Route, on bool) *router.Route {
+	r := route.HTTPRoute()
+	r.Maintenance = on
+	return r.ToRoute()
+}
+
+func (c *Client) CreateHTTPRoute(appID string, route *router.HTTPRoute) (*router.HTTPRoute, error) {
+	r := route.ToRoute()
+	if err := c.CreateRoute(appID, r); err != nil {
+		return nil, err
+	}
+	return r.HTTPRoute(), nil
+}
+
+func (c *Client) CreateTCPRoute(appID string, route *router.TCPRoute) (*router.TCPRoute, error) {
+	r := route.ToRoute()
+	if err := c.CreateRoute(appID, r); err != nil {
+		return nil, err
+	}
+	return r.TCPRoute(), nil
+}
+
+func (c *Client) DeleteRoute(appID string, routeID string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	app, err := c.app(appID)
+	if err != nil {
+		return err
+	}
+	route, ok := c.routes[routeID]
+	if !ok || route.ParentRef != routeParentRef(app.ID) {
+		return controller.ErrNotFound
+	}
+	delete(c.routes, routeID)
+	return nil
+}
+
+func (c *Client) KeyList() ([]*ct.Key, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	var keys []*ct.Key
+	for _, key := range c.keys {
+		k := *key
+		keys = append(keys, &k)
+	}
+	return keys, nil
+}
+
+func (c *Client) CreateKey(pubKey string) (*ct.Key, error) {
+	if pubKey == "" {
+		return nil, errors.New("controller: key must not be blank")
+	}
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return nil, err
+	}
+	digest := md5.Sum(key.Marshal())
+	k := &ct.Key{
+		ID:        hex.EncodeToString(digest[:]),
+		Key:       string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key))),
+		Comment:   comment,
+		CreatedAt: now(),
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if existing, ok := c.keys[k.ID]; ok {
+		k = existing
+	}
+	c.keys[k.ID] = k
+	res := *k
+	return &res, nil
+}
+
+func (c *Client) DeleteKey(id string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	id = strings.Replace(id, ":", "", -1)
+	if _, ok := c.keys[id]; !ok {
+		return controller.ErrNotFound
+	}
+	delete(c.keys, id)
+	return nil
+}
+
+func (c *Client) AuthTokenList() ([]*ct.AuthToken, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	tokens := make(authTokensByCreatedAt, 0, len(c.authTokens))
+	for _, token := range c.authTokens {
+		t := *token
+		tokens = append(tokens, &t)
+	}
+	sort.Sort(tokens)
+	return tokens, nil
+}
+
+func (c *Client) CreateAuthToken(token *ct.AuthToken) error {
+	if token.Name == "" {
+		return ct.ValidationError{Field: "name", Message: "must be set"}
+	}
+	if len(token.Scopes) == 0 {
+		return ct.ValidationError{Field: "scopes", Message: "must be set"}
+	}
+	for _, s := range token.Scopes {
+		switch s {
+		case ct.TokenScopeAdmin, ct.TokenScopeRead, ct.TokenScopeDeploy:
+		default:
+			return ct.ValidationError{Field: "scopes", Message: "must be admin, read or deploy"}
+		}
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for i, id := range token.Apps {
+		app, err := c.app(id)
+		if err != nil {
+			return ct.ValidationError{Field: "apps", Message: "app " + id + " does not exist"}
+		}
+		token.Apps[i] = app.ID
+	}
+	token.ID = random.UUID()
+	token.Token = random.Hex(20)
+	token.CreatedAt = now()
+	t := *token
+	t.Token = ""
+	c.authTokens[t.ID] = &t
+	return nil
+}
+
+func (c *Client) DeleteAuthToken(id string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.authTokens[id]; !ok {
+		return controller.ErrNotFound
+	}
+	delete(c.authTokens, id)
+	return nil
+}
+
+// authTokensByCreatedAt sorts tokens most recent first.
+type authTokensByCreatedAt []*ct.AuthToken
+
+func (t authTokensByCreatedAt) Len() int           { return len(t) }
+func (t authTokensByCreatedAt) Less(i, j int) bool { return t[i].CreatedAt.After(*t[j].CreatedAt) }
+func (t authTokensByCreatedAt) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// CreateWebhook stores the webhook, the fake does not send webhooks so
+// there are never any deliveries.
+func (c *Client) CreateWebhook(webhook *ct.Webhook) error {
+	if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ct.ValidationError{Field: "url", Message: "must be an http or https URL"}
+	}
+	for _, e := range webhook.Events {
+		switch e {
+		case ct.WebhookEventDeploy, ct.WebhookEventScale, ct.WebhookEventCrash:
+		default:
+			return ct.ValidationError{Field: "events", Message: "must be deploy, scale or crash"}
+		}
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if webhook.AppID != "" {
+		app, err := c.app(webhook.AppID)
+		if err != nil {
+			return ct.ValidationError{Field: "app", Message: "app " + webhook.AppID + " does not exist"}
+		}
+		webhook.AppID = app.ID
+	}
+	if webhook.Secret == "" {
+		webhook.Secret = random.Hex(20)
+	}
+	webhook.ID = random.UUID()
+	webhook.CreatedAt = now()
+	w := *webhook
+	w.Secret = ""
+	c.webhooks[w.ID] = &w
+	return nil
+}
+
+func (c *Client) WebhookList() ([]*ct.Webhook, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	list := make(webhooksByCreatedAt, 0, len(c.webhooks))
+	for _, webhook := range c.webhooks {
+		w := *webhook
+		list = append(list, &w)
+	}
+	sort.Sort(list)
+	return list, nil
+}
+
+func (c *Client) GetWebhook(id string) (*ct.Webhook, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	webhook, ok := c.webhooks[id]
+	if !ok {
+		return nil, controller.ErrNotFound
+	}
+	w := *webhook
+	return &w, nil
+}
+
+func (c *Client) DeleteWebhook(id string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.webhooks[id]; !ok {
+		return controller.ErrNotFound
+	}
+	delete(c.webhooks, id)
+	return nil
+}
+
+func (c *Client) WebhookDeliveryList(id string) ([]*ct.WebhookDelivery, error) {
+	if _, err := c.GetWebhook(id); err != nil {
+		return nil, err
+	}
+	return []*ct.WebhookDelivery{}, nil
+}
+
+// webhooksByCreatedAt sorts webhooks oldest first.
+type webhooksByCreatedAt []*ct.Webhook
+
+func (w webhooksByCreatedAt) Len() int           { return len(w) }
+func (w webhooksByCreatedAt) Less(i, j int) bool { return w[i].CreatedAt.Before(*w[j].CreatedAt) }
+func (w webhooksByCreatedAt) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
+
+// Close closes all streams returned by the client.
+func (c *Client) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for sub := range c.subscribers {
+		sub.Close()
+	}
+	return nil
+}
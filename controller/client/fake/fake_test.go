@@ -0,0 +1,932 @@
+package fake
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/router/types"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+func (S) TestApps(c *C) {
+	client := New()
+	app := &ct.App{Name: "foo"}
+	c.Assert(client.CreateApp(app), IsNil)
+	c.Assert(app.ID, Not(Equals), "")
+	c.Assert(client.CreateApp(&ct.App{Name: "foo"}), FitsTypeOf, ct.ValidationError{})
+
+	gotApp, err := client.GetApp("foo")
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.ID, Equals, app.ID)
+
+	// a stale ETag is rejected
+	protected := true
+	updated, err := client.UpdateApp(gotApp.ID, &controller.AppUpdate{Protected: &protected, ETag: gotApp.ETag})
+	c.Assert(err, IsNil)
+	c.Assert(updated.Protected, Equals, true)
+	_, err = client.UpdateApp(gotApp.ID, &controller.AppUpdate{Meta: map[string]string{"foo": "bar"}, ETag: gotApp.ETag})
+	c.Assert(err, Equals, controller.ErrPreconditionFailed)
+
+	// fields which are not set are left unchanged
+	updated, err = client.UpdateApp(app.ID, &controller.AppUpdate{Labels: map[string]string{"foo": "bar"}})
+	c.Assert(err, IsNil)
+	c.Assert(updated.Protected, Equals, true)
+	c.Assert(updated.Labels, DeepEquals, map[string]string{"foo": "bar"})
+
+	// the app is now protected, so is only deleted with force
+	c.Assert(client.DeleteApp(app.ID, false), FitsTypeOf, ct.ValidationError{})
+	c.Assert(client.DeleteApp(app.ID, true), IsNil)
+	_, err = client.GetApp(app.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (S) TestAppMaintenance(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	route, err := client.CreateHTTPRoute(app.ID, &router.HTTPRoute{Domain: "example.com", Service: "foo-web"})
+	c.Assert(err, IsNil)
+	c.Assert(route.Maintenance, Equals, false)
+
+	maintenance := true
+	app, err = client.UpdateApp(app.ID, &controller.AppUpdate{Maintenance: &maintenance})
+	c.Assert(err, IsNil)
+	c.Assert(app.MaintenanceStartedAt, NotNil)
+	c.Assert(app.MaintenanceEndedAt, IsNil)
+	routes, err := client.RouteList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].HTTPRoute().Maintenance, Equals, true)
+
+	// routes added during maintenance are also in maintenance mode
+	route, err = client.CreateHTTPRoute(app.ID, &router.HTTPRoute{Domain: "example.org", Service: "foo-web"})
+	c.Assert(err, IsNil)
+	c.Assert(route.Maintenance, Equals, true)
+
+	maintenance = false
+	app, err = client.UpdateApp(app.ID, &controller.AppUpdate{Maintenance: &maintenance})
+	c.Assert(err, IsNil)
+	c.Assert(app.MaintenanceEndedAt, NotNil)
+	routes, err = client.RouteList(app.ID)
+	c.Assert(err, IsNil)
+	for _, r := range routes {
+		c.Assert(r.HTTPRoute().Maintenance, Equals, false)
+	}
+}
+
+func (S) TestVersionConflict(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	c.Assert(app.Version, Equals, int64(1))
+	protected := true
+	updated, err := client.UpdateApp(app.ID, &controller.AppUpdate{Protected: &protected, Version: app.Version})
+	c.Assert(err, IsNil)
+	c.Assert(updated.Version, Equals, int64(2))
+	_, err = client.UpdateApp(app.ID, &controller.AppUpdate{Protected: &protected, Version: app.Version})
+	c.Assert(err, Equals, controller.ErrConflict)
+
+	provider := &ct.Provider{Name: "pg", URL: "http://pg"}
+	c.Assert(client.CreateProvider(provider), IsNil)
+	resource, err := client.ProvisionResource(&ct.ResourceReq{ProviderID: provider.ID})
+	c.Assert(err, IsNil)
+	staleResource := *resource
+	staleResource.ETag = ""
+	_, err = client.AddResourceApp(provider.ID, resource.ID, app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(client.PutResource(&staleResource), Equals, controller.ErrConflict)
+}
+
+func (S) TestProtectedApp(c *C) {
+	client := New()
+	app := &ct.App{Protected: true}
+	release := &ct.Release{Processes: map[string]ct.ProcessType{"web": {}, "worker": {}}}
+	c.Assert(client.CreateAppComplete(app, &ct.Artifact{Type: "docker", URI: "docker://foo"}, release, &ct.Formation{Processes: map[string]int{"web": 1}}), IsNil)
+
+	f := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"worker": 1}}
+	c.Assert(client.PutFormation(f), FitsTypeOf, ct.ValidationError{})
+	c.Assert(client.DeleteFormation(app.ID, release.ID, false), FitsTypeOf, ct.ValidationError{})
+	f.ETag = ""
+	c.Assert(client.PutFormationForce(f), IsNil)
+	c.Assert(client.DeleteFormation(app.ID, release.ID, true), IsNil)
+
+	// a new formation scales nothing down, so may leave types at zero
+	f = &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}}
+	c.Assert(client.PutFormation(f), IsNil)
+
+	err := client.DeleteApp(app.ID, false)
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	c.Assert(err.(ct.ValidationError).Field, Equals, "protected")
+	c.Assert(client.DeleteApp(app.ID, true), IsNil)
+}
+
+func (S) TestDeleteAppForce(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	_, err := client.CreateHTTPRoute(app.ID, &router.HTTPRoute{Domain: "example.com", Service: "foo-web"})
+	c.Assert(err, IsNil)
+	c.Assert(client.CreateCronJob(&ct.CronJob{AppID: app.ID, Schedule: "@hourly", Cmd: []string{"true"}}), IsNil)
+	provider := &ct.Provider{Name: "pg", URL: "http://pg"}
+	c.Assert(client.CreateProvider(provider), IsNil)
+	resource, err := client.ProvisionResource(&ct.ResourceReq{ProviderID: provider.ID, Apps: []string{app.ID}})
+	c.Assert(err, IsNil)
+
+	err = client.DeleteApp(app.ID, false)
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	c.Assert(err.(ct.ValidationError).Message, Equals, "app has routes; resources; cron jobs, use force to delete them")
+
+	c.Assert(client.DeleteApp(app.ID, true), IsNil)
+	_, err = client.GetResource(provider.ID, resource.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	events, err := client.ListEvents(controller.ListEventsOptions{AppID: app.ID})
+	c.Assert(err, IsNil)
+	types := make(map[string]bool)
+	for _, e := range events {
+		types[e.ObjectType] = true
+	}
+	for _, typ := range []string{ct.EventTypeAppDeletion, ct.EventTypeRouteDeletion, ct.EventTypeResourceDeletion, ct.EventTypeCronJobDeletion} {
+		c.Assert(types[typ], Equals, true, Commentf("missing %s event", typ))
+	}
+}
+
+func (S) TestUndeleteApp(c *C) {
+	client := New()
+	app := &ct.App{Name: "undelete"}
+	c.Assert(client.CreateAppComplete(app, &ct.Artifact{Type: "docker", URI: "docker://foo"}, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}}, &ct.Formation{Processes: map[string]int{"web": 2}}), IsNil)
+	route, err := client.CreateHTTPRoute(app.ID, &router.HTTPRoute{Domain: "example.com", Service: "undelete-web"})
+	c.Assert(err, IsNil)
+	c.Assert(client.CreateCronJob(&ct.CronJob{AppID: app.ID, Schedule: "@hourly", Cmd: []string{"true"}}), IsNil)
+	c.Assert(client.DeleteApp(app.ID, true), IsNil)
+
+	_, err = client.UndeleteApp("missing")
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	// the name cannot be restored while another app has it
+	other := &ct.App{Name: "undelete"}
+	c.Assert(client.CreateApp(other), IsNil)
+	_, err = client.UndeleteApp(app.Name)
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	c.Assert(client.DeleteApp(other.ID, false), IsNil)
+
+	restored, err := client.UndeleteApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(restored.Name, Equals, "undelete")
+	release, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	f, err := client.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(f.Processes, DeepEquals, map[string]int{"web": 2})
+	routes, err := client.RouteList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].ID, Equals, route.ID)
+	cronJobs, err := client.CronJobList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(cronJobs, HasLen, 1)
+
+	// the app is only restored once
+	_, err = client.UndeleteApp(app.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (S) TestAppTransfer(c *C) {
+	client := New()
+	alice := &ct.AuthToken{Name: "alice", Scopes: []string{ct.TokenScopeDeploy}}
+	bob := &ct.AuthToken{Name: "bob", Scopes: []string{ct.TokenScopeDeploy}}
+	c.Assert(client.CreateAuthToken(alice), IsNil)
+	c.Assert(client.CreateAuthToken(bob), IsNil)
+
+	c.Assert(client.CreateApp(&ct.App{Name: "transfer", Owner: "missing"}), FitsTypeOf, ct.ValidationError{})
+	app := &ct.App{Name: "transfer", Owner: alice.ID}
+	c.Assert(client.CreateApp(app), IsNil)
+
+	_, err := client.AcceptAppTransfer(app.ID)
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	c.Assert(client.CancelAppTransfer(app.ID), Equals, controller.ErrNotFound)
+	_, err = client.TransferApp(app.ID, "missing")
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	_, err = client.TransferApp(app.ID, alice.ID)
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+
+	// a declined transfer leaves the owner unchanged
+	updated, err := client.TransferApp(app.ID, bob.ID)
+	c.Assert(err, IsNil)
+	c.Assert(updated.PendingOwner, Equals, bob.ID)
+	c.Assert(client.CancelAppTransfer(app.ID), IsNil)
+	updated, err = client.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(updated.Owner, Equals, alice.ID)
+	c.Assert(updated.PendingOwner, Equals, "")
+
+	_, err = client.TransferApp(app.Name, bob.ID)
+	c.Assert(err, IsNil)
+	updated, err = client.AcceptAppTransfer(app.Name)
+	c.Assert(err, IsNil)
+	c.Assert(updated.Owner, Equals, bob.ID)
+	c.Assert(updated.PendingOwner, Equals, "")
+	c.Assert(updated.Version > app.Version, Equals, true)
+}
+
+func (S) TestAppResourceList(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	other := &ct.App{}
+	c.Assert(client.CreateApp(other), IsNil)
+	provider := &ct.Provider{Name: "pg", URL: "http://pg"}
+	c.Assert(client.CreateProvider(provider), IsNil)
+	resource, err := client.ProvisionResource(&ct.ResourceReq{ProviderID: provider.ID, Apps: []string{app.ID}})
+	c.Assert(err, IsNil)
+	_, err = client.ProvisionResource(&ct.ResourceReq{ProviderID: provider.ID, Apps: []string{other.ID}})
+	c.Assert(err, IsNil)
+
+	list, err := client.AppResourceList(app.Name)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, resource.ID)
+	c.Assert(list[0].ProviderName, Equals, "pg")
+	c.Assert(list[0].CreatedAt, NotNil)
+
+	_, err = client.RemoveResourceApp(provider.ID, resource.ID, app.ID)
+	c.Assert(err, IsNil)
+	list, err = client.AppResourceList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+}
+
+func (S) TestDeleteResource(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	provider := &ct.Provider{Name: "pg", URL: "http://pg"}
+	c.Assert(client.CreateProvider(provider), IsNil)
+	resource, err := client.ProvisionResource(&ct.ResourceReq{ProviderID: provider.ID, Apps: []string{app.ID}})
+	c.Assert(err, IsNil)
+
+	c.Assert(client.DeleteResource(provider.Name, resource.ID), IsNil)
+	_, err = client.GetResource(provider.ID, resource.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	c.Assert(client.DeleteResource(provider.ID, resource.ID), Equals, controller.ErrNotFound)
+
+	events, err := client.ListEvents(controller.ListEventsOptions{AppID: app.ID, ObjectTypes: []string{ct.EventTypeResourceDeletion}})
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].ObjectID, Equals, resource.ID)
+}
+
+func (S) TestAppListSelector(c *C) {
+	client := New()
+	prod := &ct.App{Name: "prod", Labels: map[string]string{"env": "production", "team": "payments"}}
+	c.Assert(client.CreateApp(prod), IsNil)
+	c.Assert(client.CreateApp(&ct.App{Name: "staging", Labels: map[string]string{"env": "staging"}}), IsNil)
+	c.Assert(client.CreateApp(&ct.App{Name: "bad", Labels: map[string]string{"Env": "x"}}), FitsTypeOf, ct.ValidationError{})
+
+	apps, err := client.AppListSelector("env=production,team=payments")
+	c.Assert(err, IsNil)
+	c.Assert(apps, HasLen, 1)
+	c.Assert(apps[0].ID, Equals, prod.ID)
+
+	apps, err = client.AppListSelector("env,!team")
+	c.Assert(err, IsNil)
+	c.Assert(apps, HasLen, 1)
+	c.Assert(apps[0].Name, Equals, "staging")
+
+	_, err = client.AppListSelector("env=a b")
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+}
+
+func (S) TestAppReleaseList(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	first := &ct.Release{Meta: map[string]string{ct.ReleaseMetaGitCommit: "abc"}}
+	second := &ct.Release{}
+	for _, r := range []*ct.Release{first, second} {
+		c.Assert(client.CreateRelease(r), IsNil)
+		c.Assert(client.SetAppRelease(app.ID, r.ID), IsNil)
+	}
+
+	releases, err := client.AppReleaseList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(releases, HasLen, 2)
+	c.Assert(releases[0].ID, Equals, second.ID)
+	c.Assert(releases[1].Meta[ct.ReleaseMetaGitCommit], Equals, "abc")
+}
+
+func (S) TestGetJob(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	crashed := &ct.Job{ID: "host1-job1", AppID: app.ID, ReleaseID: "r1", Type: "web", State: "crashed"}
+	c.Assert(client.PutJob(crashed), IsNil)
+	job := &ct.Job{ID: "host1-job2", AppID: app.ID, ReleaseID: "r1", Type: "web", State: "up"}
+	c.Assert(client.PutJob(job), IsNil)
+
+	detail, err := client.GetJob(app.ID, job.ID)
+	c.Assert(err, IsNil)
+	c.Assert(detail.HostID, Equals, "host1")
+	c.Assert(detail.State, Equals, "up")
+	c.Assert(detail.Restarts, Equals, 1)
+
+	_, err = client.GetJob(app.ID, "host1-job3")
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (S) TestAutoscalePolicies(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+
+	err := client.PutAutoscalePolicy(&ct.AutoscalePolicy{AppID: app.ID, ProcessType: "web", Min: 2, Max: 1, Target: 10})
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+
+	web := &ct.AutoscalePolicy{AppID: app.ID, ProcessType: "web", Min: 1, Max: 4, Target: 10}
+	c.Assert(client.PutAutoscalePolicy(web), IsNil)
+	c.Assert(web.Metric, Equals, ct.AutoscaleMetricRequests)
+	api := &ct.AutoscalePolicy{AppID: app.ID, ProcessType: "api", Max: 2, Target: 5}
+	c.Assert(client.PutAutoscalePolicy(api), IsNil)
+
+	list, err := client.AutoscalePolicyList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, DeepEquals, []*ct.AutoscalePolicy{api, web})
+
+	c.Assert(client.DeleteAutoscalePolicy(app.ID, "api"), IsNil)
+	c.Assert(client.DeleteAutoscalePolicy(app.ID, "api"), Equals, controller.ErrNotFound)
+}
+
+func (S) TestAppEnv(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+
+	_, err := client.UpdateAppEnv(app.ID, &ct.EnvUpdate{Set: map[string]string{"A": "1"}, NewRelease: true})
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+
+	release := &ct.Release{Env: map[string]string{"A": "0", "B": "2"}}
+	c.Assert(client.CreateRelease(release), IsNil)
+	c.Assert(client.SetAppRelease(app.ID, release.ID), IsNil)
+	c.Assert(client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}}), IsNil)
+
+	env, err := client.UpdateAppEnv(app.ID, &ct.EnvUpdate{Set: map[string]string{"A": "1", "C": "3"}})
+	c.Assert(err, IsNil)
+	c.Assert(env.Env, DeepEquals, map[string]string{"A": "1", "C": "3"})
+	c.Assert(env.ReleaseID, Equals, "")
+
+	env, err = client.UpdateAppEnv(app.ID, &ct.EnvUpdate{Unset: []string{"C"}, NewRelease: true})
+	c.Assert(err, IsNil)
+	c.Assert(env.Env, DeepEquals, map[string]string{"A": "1"})
+	c.Assert(env.ReleaseID, Not(Equals), release.ID)
+	current, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, env.ReleaseID)
+	c.Assert(current.Env, DeepEquals, release.Env)
+	f, err := client.GetFormation(app.ID, current.ID)
+	c.Assert(err, IsNil)
+	c.Assert(f.Processes, DeepEquals, map[string]int{"web": 1})
+
+	env, err = client.GetAppEnv(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(env.Env, DeepEquals, map[string]string{"A": "1"})
+}
+
+func (S) TestCronJobs(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+
+	err := client.CreateCronJob(&ct.CronJob{AppID: app.ID, Schedule: "* * *", Cmd: []string{"true"}})
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	err = client.CreateCronJob(&ct.CronJob{AppID: app.ID, Schedule: "@daily"})
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+
+	cronJob := &ct.CronJob{AppID: app.ID, Schedule: "*/5 * * * *", ProcessType: "worker"}
+	c.Assert(client.CreateCronJob(cronJob), IsNil)
+	c.Assert(cronJob.ConcurrencyPolicy, Equals, ct.CronConcurrencyAllow)
+
+	list, err := client.CronJobList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, DeepEquals, []*ct.CronJob{cronJob})
+	runs, err := client.CronJobRunList(app.ID, cronJob.ID)
+	c.Assert(err, IsNil)
+	c.Assert(runs, HasLen, 0)
+
+	c.Assert(client.DeleteCronJob(app.ID, cronJob.ID), IsNil)
+	_, err = client.GetCronJob(app.ID, cronJob.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (S) TestLogDrains(c *C) {
+	client := New()
+	app := &ct.App{}
+	artifact := &ct.Artifact{Type: "docker", URI: "docker://foo"}
+	release := &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}}
+	c.Assert(client.CreateAppComplete(app, artifact, release, &ct.Formation{Processes: map[string]int{"web": 1}}), IsNil)
+
+	for _, d := range []*ct.LogDrain{
+		{AppID: app.ID, URL: "ftp://logs.example.com"},
+		{AppID: app.ID, URL: "syslog://logs.example.com:514", Password: "secret"},
+	} {
+		c.Assert(client.CreateLogDrain(d), FitsTypeOf, ct.ValidationError{})
+	}
+
+	updates, _ := client.StreamFormations(nil)
+	defer updates.Close()
+	<-updates.Chan
+	<-updates.Chan
+
+	drain := &ct.LogDrain{AppID: app.ID, URL: "https://logs.example.com/drain", Username: "user", Password: "secret"}
+	c.Assert(client.CreateLogDrain(drain), IsNil)
+	c.Assert(drain.ID, Not(Equals), "")
+	list, err := client.LogDrainList(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, DeepEquals, []*ct.LogDrain{drain})
+
+	// the app's formations are updated with the drain
+	f := <-updates.Chan
+	c.Assert(f.LogDrains, DeepEquals, []*ct.LogDrain{drain})
+
+	c.Assert(client.DeleteLogDrain(app.ID, drain.ID), IsNil)
+	_, err = client.GetLogDrain(app.ID, drain.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	f = <-updates.Chan
+	c.Assert(f.LogDrains, HasLen, 0)
+}
+
+func (S) TestAppQuota(c *C) {
+	client := New()
+	app := &ct.App{}
+	artifact := &ct.Artifact{Type: "docker", URI: "docker://foo"}
+	release := &ct.Release{Processes: map[string]ct.ProcessType{
+		"web":    {ResourceLimits: ct.ResourceLimits{Memory: 256}},
+		"worker": {},
+	}}
+	c.Assert(client.CreateAppComplete(app, artifact, release, &ct.Formation{Processes: map[string]int{"web": 2}}), IsNil)
+
+	quota, err := client.GetAppQuota(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(quota, DeepEquals, &ct.AppQuota{})
+	c.Assert(client.UpdateAppQuota(app.ID, &ct.AppQuota{MaxJobs: -1}), FitsTypeOf, ct.ValidationError{})
+	c.Assert(client.UpdateAppQuota(app.ID, &ct.AppQuota{MaxJobs: 3, MaxMemory: 1024, MaxRoutes: 1}), IsNil)
+
+	for _, t := range []struct {
+		processes map[string]int
+		limits    map[string]ct.ResourceLimits
+		quota     string
+	}{
+		{processes: map[string]int{"web": 4}, quota: ct.QuotaJobs},
+		{processes: map[string]int{"web": 2, "worker": 1}, quota: ct.QuotaMemory},
+		{processes: map[string]int{"web": 2}, limits: map[string]ct.ResourceLimits{"web": {Memory: 1024}}, quota: ct.QuotaMemory},
+		{processes: map[string]int{"web": 3}},
+		{processes: map[string]int{"web": 2, "worker": 1}, limits: map[string]ct.ResourceLimits{"worker": {Memory: 128}}},
+	} {
+		err := client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: t.processes, Limits: t.limits})
+		if t.quota == "" {
+			c.Assert(err, IsNil)
+			continue
+		}
+		c.Assert(err, FitsTypeOf, ct.QuotaError{})
+		c.Assert(err.(ct.QuotaError).Quota, Equals, t.quota)
+	}
+
+	// an app over a lowered quota can still scale down
+	c.Assert(client.UpdateAppQuota(app.ID, &ct.AppQuota{MaxJobs: 1}), IsNil)
+	c.Assert(client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}}), IsNil)
+
+	c.Assert(client.UpdateAppQuota(app.ID, &ct.AppQuota{MaxRoutes: 1}), IsNil)
+	_, err = client.CreateHTTPRoute(app.ID, &router.HTTPRoute{Domain: "example.com", Service: "foo-web"})
+	c.Assert(err, IsNil)
+	_, err = client.CreateHTTPRoute(app.ID, &router.HTTPRoute{Domain: "example.org", Service: "foo-web"})
+	c.Assert(err, FitsTypeOf, ct.QuotaError{})
+}
+
+func (S) TestFormations(c *C) {
+	client := New()
+	app := &ct.App{}
+	artifact := &ct.Artifact{Type: "docker", URI: "docker://foo"}
+	release := &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}}
+	c.Assert(client.CreateAppComplete(app, artifact, release, &ct.Formation{Processes: map[string]int{"web": 1}}), IsNil)
+
+	updates, _ := client.StreamFormations(nil)
+	defer updates.Close()
+	f := <-updates.Chan
+	c.Assert(f.App.ID, Equals, app.ID)
+	c.Assert(f.Artifact.ID, Equals, artifact.ID)
+	c.Assert(f.Processes, DeepEquals, map[string]int{"web": 1})
+	c.Assert(<-updates.Chan, DeepEquals, &ct.ExpandedFormation{})
+
+	// setting the release moves the processes to the new release
+	newRelease := &ct.Release{ArtifactID: artifact.ID}
+	c.Assert(client.CreateRelease(newRelease), IsNil)
+	c.Assert(client.SetAppRelease(app.ID, newRelease.ID), IsNil)
+	for _, expected := range []struct {
+		release   string
+		processes map[string]int
+	}{
+		{newRelease.ID, map[string]int{"web": 1}},
+		{release.ID, nil},
+	} {
+		select {
+		case f := <-updates.Chan:
+			c.Assert(f.Release.ID, Equals, expected.release)
+			c.Assert(f.Processes, DeepEquals, expected.processes)
+		case <-time.After(time.Second):
+			c.Fatal("timed out waiting for formation")
+		}
+	}
+
+	updates.Close()
+	for range updates.Chan {
+	}
+}
+
+func (S) TestFormationStateHash(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	release := &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}}
+	c.Assert(client.CreateRelease(release), IsNil)
+
+	formation := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}, StateHash: "foo"}
+	c.Assert(client.PutFormation(formation), Equals, controller.ErrConflict)
+	formation.StateHash = ct.FormationStateHash(nil, nil)
+	c.Assert(client.PutFormation(formation), IsNil)
+
+	// two updates based on the same state only succeed once, ETags are
+	// cleared so that only the state hash is checked
+	first, err := client.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	second, err := client.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	first.ETag, second.ETag = "", ""
+	first.Processes = map[string]int{"web": 2}
+	c.Assert(client.PutFormation(first), IsNil)
+	second.Processes = map[string]int{"web": 3}
+	c.Assert(client.PutFormation(second), Equals, controller.ErrConflict)
+
+	got, err := client.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.Processes, DeepEquals, map[string]int{"web": 2})
+	c.Assert(got.StateHash, Equals, first.StateHash)
+}
+
+func (S) TestUpdateFormations(c *C) {
+	client := New()
+	release := &ct.Release{Processes: map[string]ct.ProcessType{"web": {}, "worker": {}}}
+	c.Assert(client.CreateRelease(release), IsNil)
+	app := &ct.App{Name: "batch"}
+	c.Assert(client.CreateApp(app), IsNil)
+	c.Assert(client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2, "worker": 1}}), IsNil)
+	protected := &ct.App{Name: "batch-protected", Protected: true}
+	c.Assert(client.CreateApp(protected), IsNil)
+	c.Assert(client.PutFormation(&ct.Formation{AppID: protected.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}}), IsNil)
+
+	// nothing is updated if any formation of the batch is invalid
+	for _, batch := range [][]*ct.FormationScale{
+		{{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 0}}, {AppID: "missing", ReleaseID: release.ID}},
+		{{AppID: app.ID, ReleaseID: release.ID}, {AppID: app.Name, ReleaseID: release.ID}},
+		{{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"missing": 1}}},
+		{{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 0}}, {AppID: protected.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 0}}},
+	} {
+		_, err := client.UpdateFormations(batch, false)
+		c.Assert(err, FitsTypeOf, ct.ValidationError{})
+		c.Assert(err.(ct.ValidationError).Field, Matches, `formations\[[01]\]\..*`)
+	}
+	f, err := client.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(f.Processes, DeepEquals, map[string]int{"web": 2, "worker": 1})
+
+	// process types which are left out keep their counts
+	formations, err := client.UpdateFormations([]*ct.FormationScale{
+		{AppID: app.Name, ReleaseID: release.ID, Processes: map[string]int{"web": 0}},
+		{AppID: protected.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 0}},
+	}, true)
+	c.Assert(err, IsNil)
+	c.Assert(formations, HasLen, 2)
+	c.Assert(formations[0].AppID, Equals, app.ID)
+	f, err = client.GetFormation(app.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(f.Processes, DeepEquals, map[string]int{"worker": 1})
+	f, err = client.GetFormation(protected.ID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(f.Processes, DeepEquals, map[string]int{})
+}
+
+func (S) TestFormationConstraints(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	release := &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}}
+	c.Assert(client.CreateRelease(release), IsNil)
+
+	formation := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}}
+	formation.Constraints = map[string]ct.PlacementConstraints{"worker": {SpreadBy: "zone"}}
+	c.Assert(client.PutFormation(formation), FitsTypeOf, ct.ValidationError{})
+
+	formation.Constraints = map[string]ct.PlacementConstraints{"web": {SpreadBy: "zone"}}
+	c.Assert(client.PutFormation(formation), IsNil)
+	updates, _ := client.StreamFormations(nil)
+	defer updates.Close()
+	f := <-updates.Chan
+	c.Assert(f.Constraints, DeepEquals, formation.Constraints)
+}
+
+func (S) TestReleaseArtifacts(c *C) {
+	client := New()
+	base := &ct.Artifact{Type: "docker", URI: "docker://base"}
+	slug := &ct.Artifact{Type: "docker", URI: "docker://slug"}
+	c.Assert(client.CreateArtifact(base), IsNil)
+	c.Assert(client.CreateArtifact(slug), IsNil)
+
+	c.Assert(client.CreateRelease(&ct.Release{ArtifactIDs: []string{base.ID, "missing"}}), FitsTypeOf, ct.ValidationError{})
+	c.Assert(client.CreateRelease(&ct.Release{
+		ArtifactIDs: []string{base.ID},
+		Processes:   map[string]ct.ProcessType{"web": {Artifacts: []string{slug.ID}}},
+	}), FitsTypeOf, ct.ValidationError{})
+
+	release := &ct.Release{ArtifactIDs: []string{base.ID, slug.ID}}
+	c.Assert(client.CreateRelease(release), IsNil)
+	c.Assert(release.ArtifactID, Equals, base.ID)
+	c.Assert(client.DeleteArtifact(slug.ID), FitsTypeOf, ct.ValidationError{})
+
+	c.Assert(client.DeleteRelease(release.ID, true), IsNil)
+	_, err := client.GetArtifact(slug.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (S) TestRollbackApp(c *C) {
+	client := New()
+	app := &ct.App{}
+	release := &ct.Release{Processes: map[string]ct.ProcessType{"web": {}, "worker": {}}}
+	c.Assert(client.CreateAppComplete(app, &ct.Artifact{Type: "docker", URI: "docker://foo"}, release, &ct.Formation{Processes: map[string]int{"web": 1}}), IsNil)
+
+	_, err := client.RollbackApp(app.ID, "")
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+
+	newRelease := &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}}
+	c.Assert(client.CreateRelease(newRelease), IsNil)
+	c.Assert(client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1, "worker": 2}}), IsNil)
+	c.Assert(client.CreateDeployment(&ct.Deployment{AppID: app.ID, NewReleaseID: newRelease.ID, Processes: map[string]int{"web": 3}}), IsNil)
+
+	d, err := client.RollbackApp(app.ID, "")
+	c.Assert(err, IsNil)
+	c.Assert(d.Strategy, Equals, ct.DeployStrategyRollback)
+	c.Assert(d.OldReleaseID, Equals, newRelease.ID)
+	c.Assert(d.NewReleaseID, Equals, release.ID)
+	c.Assert(d.Processes, DeepEquals, map[string]int{"web": 3})
+	current, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release.ID)
+
+	_, err = client.RollbackApp(app.ID, release.ID)
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+}
+
+func (S) TestPromoteApp(c *C) {
+	client := New()
+	staging := &ct.App{Name: "staging"}
+	c.Assert(client.CreateApp(staging), IsNil)
+	_, err := client.PromoteApp(staging.ID, &ct.Promotion{TargetAppID: "production"})
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+
+	artifact := &ct.Artifact{Type: "docker", URI: "docker://foo"}
+	release := &ct.Release{Env: map[string]string{"A": "1", "DEBUG": "true"}, Processes: map[string]ct.ProcessType{"web": {}}}
+	c.Assert(client.CreateArtifact(artifact), IsNil)
+	release.ArtifactID = artifact.ID
+	c.Assert(client.CreateRelease(release), IsNil)
+	c.Assert(client.SetAppRelease(staging.ID, release.ID), IsNil)
+
+	production := &ct.App{Name: "production"}
+	c.Assert(client.CreateAppComplete(production, &ct.Artifact{Type: "docker", URI: "docker://bar"}, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}}, &ct.Formation{Processes: map[string]int{"web": 2}}), IsNil)
+
+	_, err = client.PromoteApp(staging.ID, &ct.Promotion{TargetAppID: "missing"})
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	_, err = client.PromoteApp(staging.ID, &ct.Promotion{TargetAppID: staging.Name})
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+
+	d, err := client.PromoteApp(staging.Name, &ct.Promotion{TargetAppID: production.Name, Env: map[string]string{"A": "2"}, UnsetEnv: []string{"DEBUG"}})
+	c.Assert(err, IsNil)
+	c.Assert(d.AppID, Equals, production.ID)
+	c.Assert(d.Processes, DeepEquals, map[string]int{"web": 2})
+	promoted, err := client.GetAppRelease(production.ID)
+	c.Assert(err, IsNil)
+	c.Assert(promoted.ID, Equals, d.NewReleaseID)
+	c.Assert(promoted.ArtifactID, Equals, artifact.ID)
+	c.Assert(promoted.Env, DeepEquals, map[string]string{"A": "2"})
+	c.Assert(promoted.Meta[ct.ReleaseMetaPromotedRelease], Equals, release.ID)
+	current, err := client.GetAppRelease(staging.ID)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release.ID)
+}
+
+func (S) TestEvents(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	release := &ct.Release{}
+	c.Assert(client.CreateRelease(release), IsNil)
+
+	job := &ct.Job{ID: "job1", AppID: app.ID, ReleaseID: release.ID, State: "starting"}
+	c.Assert(client.PutJob(job), IsNil)
+
+	events := make(chan *ct.Event)
+	stream, err := client.StreamEvents(controller.StreamEventsOptions{ObjectTypes: []string{ct.EventTypeJob}}, events)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	// the stream is not blocked by an unread channel
+	job.State = "up"
+	c.Assert(client.PutJob(job), IsNil)
+	c.Assert(client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID}), IsNil)
+	job.State = "down"
+	c.Assert(client.PutJob(job), IsNil)
+
+	for _, state := range []string{"up", "down"} {
+		select {
+		case e := <-events:
+			c.Assert(e.ObjectID, Equals, job.ID)
+			c.Assert(string(e.Data), Matches, `.*"state":"`+state+`".*`)
+		case <-time.After(time.Second):
+			c.Fatal("timed out waiting for event")
+		}
+	}
+
+	// replaying from an ID returns later events
+	replay := make(chan *ct.Event)
+	stream, err = client.StreamEvents(controller.StreamEventsOptions{Since: 1}, replay)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+	e := <-replay
+	c.Assert(e.ID, Equals, int64(2))
+}
+
+func (S) TestListEvents(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	release := &ct.Release{}
+	c.Assert(client.CreateRelease(release), IsNil)
+	c.Assert(client.SetAppRelease(app.ID, release.ID), IsNil)
+
+	events, err := client.ListEvents(controller.ListEventsOptions{AppID: app.ID})
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[0].ObjectType, Equals, ct.EventTypeAppRelease)
+	c.Assert(string(events[0].Data), Matches, `.*"release":"`+release.ID+`".*`)
+	c.Assert(events[1].ObjectType, Equals, ct.EventTypeApp)
+
+	events, err = client.ListEvents(controller.ListEventsOptions{ObjectTypes: []string{ct.EventTypeRelease}, Count: 1})
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	c.Assert(events[0].ObjectID, Equals, release.ID)
+
+	events, err = client.ListEvents(controller.ListEventsOptions{Until: *app.CreatedAt})
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 0)
+}
+
+func (S) TestGCApp(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	var releases []*ct.Release
+	for i := 0; i < 3; i++ {
+		release := &ct.Release{}
+		c.Assert(client.CreateRelease(release), IsNil)
+		c.Assert(client.SetAppRelease(app.ID, release.ID), IsNil)
+		releases = append(releases, release)
+		time.Sleep(time.Millisecond)
+	}
+
+	res, err := client.GCApp(app.ID, 1)
+	c.Assert(err, IsNil)
+	c.Assert(res.DeletedReleases, HasLen, 2)
+	_, err = client.GetRelease(releases[0].ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	_, err = client.GetRelease(releases[2].ID)
+	c.Assert(err, IsNil)
+}
+
+func (S) TestReleaseDiff(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	from := &ct.Release{Env: map[string]string{"FOO": "1"}, Processes: map[string]ct.ProcessType{"web": {Cmd: []string{"web"}}}}
+	c.Assert(client.CreateRelease(from), IsNil)
+	to := &ct.Release{Env: map[string]string{"FOO": "2"}, Processes: map[string]ct.ProcessType{"web": {Cmd: []string{"web", "-v"}}}}
+	c.Assert(client.CreateRelease(to), IsNil)
+
+	diff, err := client.ReleaseDiff(app.ID, from.ID, to.ID, true)
+	c.Assert(err, IsNil)
+	c.Assert(diff.Env, DeepEquals, []*ct.EnvChange{{Key: "FOO", Op: ct.DiffChanged}})
+	c.Assert(diff.Processes, DeepEquals, []*ct.ProcessChange{{Type: "web", Op: ct.DiffChanged, Fields: []string{"cmd"}}})
+	_, err = client.ReleaseDiff(app.ID, from.ID, "missing", false)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
+
+func (S) TestAppProcesses(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	release := &ct.Release{}
+	c.Assert(client.CreateRelease(release), IsNil)
+	c.Assert(client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}}), IsNil)
+	for i, state := range []string{"up", "up", "crashed", "down"} {
+		c.Assert(client.PutJob(&ct.Job{ID: "host-job" + strconv.Itoa(i), AppID: app.ID, ReleaseID: release.ID, Type: "web", State: state}), IsNil)
+	}
+
+	list, err := client.AppProcesses(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(list, DeepEquals, []*ct.ProcessStatus{{Type: "web", Desired: 2, Running: 2, Crashed: 1}})
+	c.Assert(list[0].Converged(), Equals, true)
+}
+
+func (S) TestGC(c *C) {
+	client := New()
+	app := &ct.App{}
+	c.Assert(client.CreateApp(app), IsNil)
+	var releases []*ct.Release
+	for i := 0; i < 2; i++ {
+		artifact := &ct.Artifact{Type: "docker", URI: "docker://gc-" + strconv.Itoa(i)}
+		c.Assert(client.CreateArtifact(artifact), IsNil)
+		release := &ct.Release{ArtifactID: artifact.ID}
+		c.Assert(client.CreateRelease(release), IsNil)
+		c.Assert(client.SetAppRelease(app.ID, release.ID), IsNil)
+		releases = append(releases, release)
+		time.Sleep(time.Millisecond)
+	}
+	unused := &ct.Artifact{Type: "docker", URI: "docker://gc-unused"}
+	c.Assert(client.CreateArtifact(unused), IsNil)
+
+	res, err := client.GC(1)
+	c.Assert(err, IsNil)
+	c.Assert(res.DeletedReleases, DeepEquals, []string{releases[0].ID})
+	c.Assert(res.DeletedArtifacts, DeepEquals, []string{unused.ID})
+	_, err = client.GetArtifact(unused.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	_, err = client.GetArtifact(releases[1].ArtifactID)
+	c.Assert(err, IsNil)
+}
+
+func (S) TestAuthTokens(c *C) {
+	client := New()
+	app := &ct.App{Name: "tokens"}
+	c.Assert(client.CreateApp(app), IsNil)
+
+	err := client.CreateAuthToken(&ct.AuthToken{Name: "ci", Scopes: []string{"write"}})
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	err = client.CreateAuthToken(&ct.AuthToken{Name: "ci", Scopes: []string{ct.TokenScopeDeploy}, Apps: []string{"missing"}})
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+
+	token := &ct.AuthToken{Name: "ci", Scopes: []string{ct.TokenScopeDeploy}, Apps: []string{app.Name}}
+	c.Assert(client.CreateAuthToken(token), IsNil)
+	c.Assert(token.Token, Not(Equals), "")
+	c.Assert(token.Apps, DeepEquals, []string{app.ID})
+
+	list, err := client.AuthTokenList()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Token, Equals, "")
+
+	c.Assert(client.DeleteAuthToken(token.ID), IsNil)
+	c.Assert(client.DeleteAuthToken(token.ID), Equals, controller.ErrNotFound)
+}
+
+func (S) TestWebhooks(c *C) {
+	client := New()
+	app := &ct.App{Name: "webhooks"}
+	c.Assert(client.CreateApp(app), IsNil)
+
+	err := client.CreateWebhook(&ct.Webhook{URL: "ftp://example.com"})
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	err = client.CreateWebhook(&ct.Webhook{URL: "https://example.com", Events: []string{"release"}})
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+
+	webhook := &ct.Webhook{URL: "https://example.com/hook", Events: []string{ct.WebhookEventDeploy}, AppID: app.Name}
+	c.Assert(client.CreateWebhook(webhook), IsNil)
+	c.Assert(webhook.Secret, Not(Equals), "")
+	c.Assert(webhook.AppID, Equals, app.ID)
+
+	list, err := client.WebhookList()
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Secret, Equals, "")
+
+	deliveries, err := client.WebhookDeliveryList(webhook.ID)
+	c.Assert(err, IsNil)
+	c.Assert(deliveries, HasLen, 0)
+
+	c.Assert(client.DeleteWebhook(webhook.ID), IsNil)
+	_, err = client.GetWebhook(webhook.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+}
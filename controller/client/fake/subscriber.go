@@ -0,0 +1,91 @@
+package fake
+
+import "sync"
+
+// subscriber delivers published values to a stream in order, without
+// blocking the publisher while the stream's channel is not being read.
+type subscriber struct {
+	// deliver sends v to the stream, it returns false if the stream
+	// should end.
+	deliver func(v interface{}, done <-chan struct{}) bool
+
+	mtx    sync.Mutex
+	queue  []interface{}
+	notify chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newSubscriber starts delivering values, finish is called once the stream
+// ends.
+func newSubscriber(deliver func(interface{}, <-chan struct{}) bool, finish func()) *subscriber {
+	s := &subscriber{
+		deliver: deliver,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go s.run(finish)
+	return s
+}
+
+func (s *subscriber) run(finish func()) {
+	defer finish()
+	for {
+		s.mtx.Lock()
+		if len(s.queue) == 0 {
+			s.mtx.Unlock()
+			select {
+			case <-s.notify:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		v := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mtx.Unlock()
+		if !s.deliver(v, s.done) {
+			return
+		}
+	}
+}
+
+func (s *subscriber) send(v interface{}) {
+	s.mtx.Lock()
+	s.queue = append(s.queue, v)
+	s.mtx.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscriber) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *subscriber) Err() error {
+	return nil
+}
+
+// subscribe registers a stream that is sent published values, the caller
+// must hold c.mtx.
+func (c *Client) subscribe(deliver func(interface{}, <-chan struct{}) bool, finish func()) *subscriber {
+	var sub *subscriber
+	sub = newSubscriber(deliver, func() {
+		c.mtx.Lock()
+		delete(c.subscribers, sub)
+		c.mtx.Unlock()
+		finish()
+	})
+	c.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// publish sends v to all streams, the caller must hold c.mtx.
+func (c *Client) publish(v interface{}) {
+	for sub := range c.subscribers {
+		sub.send(v)
+	}
+}
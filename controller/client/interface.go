@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"io"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/router/types"
+)
+
+// Interface is the set of controller operations implemented by Client, it
+// allows consumers to substitute another implementation (for example the
+// in-memory client in the fake package) in tests.
+type Interface interface {
+	GetClusterInfo() (*ct.ClusterInfo, error)
+	GetCACert() ([]byte, error)
+	GetHealth() (*ct.Health, error)
+	Export() (io.ReadCloser, error)
+	Import(archive io.Reader, conflicts string) (*ct.ImportResult, error)
+
+	AppList() ([]*ct.App, error)
+	AppListSelector(selector string) ([]*ct.App, error)
+	GetApp(appID string) (*ct.App, error)
+	CreateApp(app *ct.App) error
+	CreateAppComplete(app *ct.App, artifact *ct.Artifact, release *ct.Release, formation *ct.Formation) error
+	UpdateApp(appID string, update *AppUpdate) (*ct.App, error)
+	DeleteApp(appID string, force bool) error
+	UndeleteApp(appID string) (*ct.App, error)
+	TransferApp(appID, to string) (*ct.App, error)
+	AcceptAppTransfer(appID string) (*ct.App, error)
+	CancelAppTransfer(appID string) error
+	GetAppRelease(appID string) (*ct.Release, error)
+	SetAppRelease(appID, releaseID string) error
+	AppReleaseList(appID string) ([]*ct.Release, error)
+	ReleaseDiff(appID, from, to string, redact bool) (*ct.ReleaseDiff, error)
+	GetAppEnv(appID string) (*ct.AppEnv, error)
+	UpdateAppEnv(appID string, update *ct.EnvUpdate) (*ct.AppEnv, error)
+	GetAppQuota(appID string) (*ct.AppQuota, error)
+	UpdateAppQuota(appID string, quota *ct.AppQuota) error
+	GetAppLog(appID string, lines int, follow bool) (io.ReadCloser, error)
+	GCApp(appID string, keep int) (*ct.AppGCResult, error)
+	GC(keep int) (*ct.GCResult, error)
+
+	GetArtifact(artifactID string) (*ct.Artifact, error)
+	CreateArtifact(artifact *ct.Artifact) error
+	DeleteArtifact(artifactID string) error
+
+	GetRelease(releaseID string) (*ct.Release, error)
+	CreateRelease(release *ct.Release) error
+	DeleteRelease(releaseID string, cascade bool) error
+
+	FormationList(appID string) ([]*ct.Formation, error)
+	GetFormation(appID, releaseID string) (*ct.Formation, error)
+	PutFormation(formation *ct.Formation) error
+	PutFormationForce(formation *ct.Formation) error
+	UpdateFormations(batch []*ct.FormationScale, force bool) ([]*ct.Formation, error)
+	DeleteFormation(appID, releaseID string, force bool) error
+	StreamFormations(since *time.Time) (*FormationUpdates, *error)
+	AppProcesses(appID string) ([]*ct.ProcessStatus, error)
+
+	JobList(appID string) ([]*ct.Job, error)
+	GetJob(appID, jobID string) (*ct.JobDetail, error)
+	PutJob(job *ct.Job) error
+	DeleteJob(appID, jobID string) error
+	SignalJob(appID, jobID string, sig int) error
+	RunJobDetached(appID string, req *ct.NewJob) (*ct.Job, error)
+	RunJobAttached(appID string, job *ct.NewJob) (utils.ReadWriteCloser, error)
+	ExecJob(appID, jobID string, exec *ct.JobExec) (utils.ReadWriteCloser, error)
+	GetJobLog(appID, jobID string, tail bool) (io.ReadCloser, error)
+	StreamJobEvents(appID string) (*JobEventStream, error)
+
+	CreateDeployment(deployment *ct.Deployment) error
+	GetDeployment(appID, deploymentID string) (*ct.Deployment, error)
+	RollbackApp(appID, releaseID string) (*ct.Deployment, error)
+	PromoteApp(appID string, promotion *ct.Promotion) (*ct.Deployment, error)
+	StreamDeployment(appID, deploymentID string, ch chan<- *ct.DeploymentEvent) (Stream, error)
+
+	PutAutoscalePolicy(policy *ct.AutoscalePolicy) error
+	AutoscalePolicyList(appID string) ([]*ct.AutoscalePolicy, error)
+	DeleteAutoscalePolicy(appID, processType string) error
+
+	CreateCronJob(cronJob *ct.CronJob) error
+	CronJobList(appID string) ([]*ct.CronJob, error)
+	GetCronJob(appID, cronJobID string) (*ct.CronJob, error)
+	DeleteCronJob(appID, cronJobID string) error
+	CronJobRunList(appID, cronJobID string) ([]*ct.CronJobRun, error)
+	CreateLogDrain(drain *ct.LogDrain) error
+	LogDrainList(appID string) ([]*ct.LogDrain, error)
+	GetLogDrain(appID, drainID string) (*ct.LogDrain, error)
+	DeleteLogDrain(appID, drainID string) error
+
+	ListEvents(opts ListEventsOptions) ([]*ct.Event, error)
+	AuditLog(opts AuditLogOptions) ([]*ct.AuditEntry, error)
+	StreamEvents(opts StreamEventsOptions, ch chan<- *ct.Event) (Stream, error)
+
+	ProviderList() ([]*ct.Provider, error)
+	CreateProvider(provider *ct.Provider) error
+	ProviderStatus(providerID string) (*ct.ProviderStatus, error)
+	ProvisionResource(req *ct.ResourceReq) (*ct.Resource, error)
+	GetResource(providerID, resourceID string) (*ct.Resource, error)
+	PutResource(resource *ct.Resource) error
+	DeleteResource(providerID, resourceID string) error
+	AddResourceApp(providerID, resourceID, appID string) (*ct.Resource, error)
+	RemoveResourceApp(providerID, resourceID, appID string) (*ct.Resource, error)
+	AppResourceList(appID string) ([]*ct.Resource, error)
+
+	RouteList(appID string) ([]*router.Route, error)
+	GetRoute(appID string, routeID string) (*router.Route, error)
+	CreateRoute(appID string, route *router.Route) error
+	CreateHTTPRoute(appID string, route *router.HTTPRoute) (*router.HTTPRoute, error)
+	CreateTCPRoute(appID string, route *router.TCPRoute) (*router.TCPRoute, error)
+	DeleteRoute(appID string, routeID string) error
+
+	KeyList() ([]*ct.Key, error)
+	CreateKey(pubKey string) (*ct.Key, error)
+	DeleteKey(id string) error
+
+	AuthTokenList() ([]*ct.AuthToken, error)
+	CreateAuthToken(token *ct.AuthToken) error
+	DeleteAuthToken(id string) error
+
+	CreateWebhook(webhook *ct.Webhook) error
+	WebhookList() ([]*ct.Webhook, error)
+	GetWebhook(id string) (*ct.Webhook, error)
+	DeleteWebhook(id string) error
+	WebhookDeliveryList(id string) ([]*ct.WebhookDelivery, error)
+
+	Close() error
+}
+
+var _ Interface = (*Client)(nil)
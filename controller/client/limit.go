@@ -0,0 +1,116 @@
+package controller
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when a request can't be sent within the
+// client's limits before Limits.MaxWait has elapsed.
+var ErrRateLimited = errors.New("controller: request rate limited")
+
+// Limits restricts the rate and concurrency of requests made by a client, it
+// is intended for bulk tooling that would otherwise overwhelm the controller.
+// Requests that exceed the limits are queued until they can be sent.
+type Limits struct {
+	// MaxInFlight is the maximum number of concurrent requests, a request is
+	// in flight until its response has been decoded (or until the response
+	// headers are received for streaming requests). Zero means unlimited.
+	MaxInFlight int
+
+	// Rate is the sustained number of requests per second, with bursts of up
+	// to Burst requests. Zero means unlimited.
+	Rate  float64
+	Burst int
+
+	// MaxWait is the maximum time a request is queued before failing with
+	// ErrRateLimited. Zero means requests wait indefinitely.
+	MaxWait time.Duration
+}
+
+// SetLimits sets the limits applied to requests made by the client, it is not
+// safe to call while requests are being made.
+func (c *Client) SetLimits(l Limits) {
+	if l.MaxInFlight <= 0 && l.Rate <= 0 {
+		c.limiter = nil
+		return
+	}
+	c.limiter = newLimiter(l)
+}
+
+type limiter struct {
+	Limits
+	inFlight chan struct{}
+
+	mtx    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(l Limits) *limiter {
+	if l.Burst < 1 {
+		l.Burst = 1
+	}
+	lim := &limiter{Limits: l, tokens: float64(l.Burst), last: time.Now()}
+	if l.MaxInFlight > 0 {
+		lim.inFlight = make(chan struct{}, l.MaxInFlight)
+	}
+	return lim
+}
+
+// acquire blocks until a request may be sent, the returned function must be
+// called once the request has completed.
+func (l *limiter) acquire() (func(), error) {
+	var deadline time.Time
+	if l.MaxWait > 0 {
+		deadline = time.Now().Add(l.MaxWait)
+	}
+	if l.Rate > 0 {
+		if err := l.take(deadline); err != nil {
+			return nil, err
+		}
+	}
+	if l.inFlight == nil {
+		return func() {}, nil
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(deadline.Sub(time.Now()))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case l.inFlight <- struct{}{}:
+		return func() { <-l.inFlight }, nil
+	case <-timeout:
+		return nil, ErrRateLimited
+	}
+}
+
+// take removes a token from the bucket, sleeping until one is available.
+func (l *limiter) take(deadline time.Time) error {
+	l.mtx.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.Rate
+	if max := float64(l.Burst); l.tokens > max {
+		l.tokens = max
+	}
+	l.last = now
+
+	var delay time.Duration
+	if l.tokens < 1 {
+		delay = time.Duration((1 - l.tokens) / l.Rate * float64(time.Second))
+	}
+	if !deadline.IsZero() && now.Add(delay).After(deadline) {
+		l.mtx.Unlock()
+		return ErrRateLimited
+	}
+	// reserve the token now so that queued requests are spaced out
+	l.tokens--
+	l.mtx.Unlock()
+
+	time.Sleep(delay)
+	return nil
+}
@@ -0,0 +1,187 @@
+package controller
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+)
+
+// SetLongPoll enables or disables long-polling, which StreamEvents and
+// GetJobLog use instead of streaming responses when enabled. It should be
+// enabled when the controller is behind a proxy that buffers responses.
+func (c *Client) SetLongPoll(enabled bool) {
+	c.longPoll = enabled
+}
+
+func longPollHeader() http.Header {
+	return http.Header{"Accept": []string{ct.LongPollMediaType}}
+}
+
+// pollEvents is the long-poll implementation of StreamEvents. The first poll
+// is made with a zero timeout so that errors are returned immediately and
+// the position of the stream is known before returning.
+func (c *Client) pollEvents(opts StreamEventsOptions, ch chan<- *ct.Event) (Stream, error) {
+	p := &eventPoll{c: c, opts: opts, ch: ch}
+	events, err := p.poll(0)
+	if err != nil {
+		return nil, err
+	}
+	go p.run(events)
+	return p, nil
+}
+
+type eventPoll struct {
+	c    *Client
+	opts StreamEventsOptions
+	ch   chan<- *ct.Event
+
+	mtx    sync.Mutex
+	closed bool
+	err    error
+}
+
+// poll requests the events after opts.Since, a negative timeout uses the
+// controller's default.
+func (p *eventPoll) poll(timeout int) ([]*ct.Event, error) {
+	query := url.Values{}
+	if p.opts.AppID != "" {
+		query.Set("app_id", p.opts.AppID)
+	}
+	if len(p.opts.ObjectTypes) > 0 {
+		query.Set("object_types", strings.Join(p.opts.ObjectTypes, ","))
+	}
+	if p.opts.Since > 0 {
+		query.Set("since_id", strconv.FormatInt(p.opts.Since, 10))
+	}
+	if timeout >= 0 {
+		query.Set("timeout", strconv.Itoa(timeout))
+	}
+	var events []*ct.Event
+	res, err := p.c.rawReq("GET", "/events?"+query.Encode(), longPollHeader(), nil, &events)
+	if err != nil {
+		return nil, err
+	}
+	if id, err := strconv.ParseInt(res.Header.Get("Last-Event-Id"), 10, 64); err == nil {
+		p.opts.Since = id
+	} else if len(events) > 0 {
+		p.opts.Since = events[len(events)-1].ID
+	}
+	return events, nil
+}
+
+func (p *eventPoll) run(events []*ct.Event) {
+	defer close(p.ch)
+	for {
+		for _, e := range events {
+			p.ch <- e
+		}
+		if p.isClosed() {
+			return
+		}
+		var err error
+		if events, err = p.poll(-1); err != nil {
+			p.mtx.Lock()
+			if !p.closed {
+				p.err = err
+			}
+			p.mtx.Unlock()
+			return
+		}
+		if p.isClosed() {
+			return
+		}
+	}
+}
+
+func (p *eventPoll) isClosed() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.closed
+}
+
+// Close stops polling, the channel is closed once any request in progress
+// has completed.
+func (p *eventPoll) Close() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *eventPoll) Err() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.err
+}
+
+// pollJobLog is the long-poll implementation of GetJobLog, the returned
+// stream is encoded using the attach protocol so that callers can read it
+// in the same way as a streamed log.
+func (c *Client) pollJobLog(appID, jobID string, tail bool) (io.ReadCloser, error) {
+	path := fmt.Sprintf("/apps/%s/jobs/%s/log", appID, jobID)
+	poll := func(since time.Time, timeout int) (*ct.JobLogPoll, error) {
+		query := url.Values{}
+		if tail {
+			query.Set("tail", "true")
+		}
+		if !since.IsZero() {
+			query.Set("since", since.Format(time.RFC3339Nano))
+		}
+		if timeout >= 0 {
+			query.Set("timeout", strconv.Itoa(timeout))
+		}
+		res := &ct.JobLogPoll{}
+		_, err := c.rawReq("GET", path+"?"+query.Encode(), longPollHeader(), nil, res)
+		return res, err
+	}
+
+	res, err := poll(time.Time{}, 0)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		var since time.Time
+		for {
+			for _, line := range res.Lines {
+				if err := writeAttachData(pw, line); err != nil {
+					return
+				}
+				since = line.Timestamp
+			}
+			if res.EOF {
+				pw.Close()
+				return
+			}
+			if res, err = poll(since, -1); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr, nil
+}
+
+// writeAttachData writes the log line to w as an attach protocol data frame.
+func writeAttachData(w io.Writer, line *ct.AppLogLine) error {
+	var stream byte = 1
+	if line.Stream == "stderr" {
+		stream = 2
+	}
+	frame := make([]byte, 6, 6+len(line.Message))
+	frame[0] = host.AttachData
+	frame[1] = stream
+	binary.BigEndian.PutUint32(frame[2:], uint32(len(line.Message)))
+	frame = append(frame, line.Message...)
+	_, err := w.Write(frame)
+	return err
+}
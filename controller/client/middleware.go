@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"net/http"
+	"time"
+)
+
+// Middleware is called before and after each HTTP request made by the client,
+// it can be used to add logging, metrics or tracing to requests.
+type Middleware interface {
+	// BeforeRequest is called with each request before it is sent, it may
+	// modify the request (for example to add headers).
+	BeforeRequest(req *http.Request)
+
+	// AfterRequest is called once the response headers have been received or
+	// the request has failed.
+	AfterRequest(info *RequestInfo)
+}
+
+// RequestInfo describes a completed request.
+type RequestInfo struct {
+	Method string
+	Path   string
+
+	// StatusCode is the status code of the response, it is zero if no
+	// response was received.
+	StatusCode int
+
+	// Duration is the time taken to receive the response headers, streaming
+	// responses may continue after this.
+	Duration time.Duration
+
+	// Err is the error returned by the HTTP client, if any.
+	Err error
+}
+
+// Use adds m to the middleware called for each request, middleware is called
+// in the order it was added. Use is not safe to call while requests are being
+// made.
+func (c *Client) Use(m Middleware) {
+	c.middleware = append(c.middleware, m)
+}
+
+func (c *Client) do(req *http.Request, path string) (*http.Response, error) {
+	if len(c.middleware) == 0 {
+		return c.http.Do(req)
+	}
+	for _, m := range c.middleware {
+		m.BeforeRequest(req)
+	}
+	start := time.Now()
+	res, err := c.http.Do(req)
+	info := &RequestInfo{
+		Method:   req.Method,
+		Path:     path,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	if res != nil {
+		info.StatusCode = res.StatusCode
+	}
+	for _, m := range c.middleware {
+		m.AfterRequest(info)
+	}
+	return res, err
+}
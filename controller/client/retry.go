@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/flynn/flynn/pkg/pinned"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+// RetryPolicy controls how requests are retried when the controller is
+// temporarily unavailable, for example while a new leader is being elected.
+// Only idempotent requests (GET, HEAD, PUT and DELETE) and create requests
+// sent with an idempotency key are retried.
+type RetryPolicy struct {
+	// MaxElapsed is the maximum total time spent retrying a request, a zero
+	// value disables retries.
+	MaxElapsed time.Duration
+
+	// InitialDelay is the delay before the first retry, it is doubled after
+	// each subsequent attempt up to MaxDelay.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+
+	// Jitter is the fraction (between 0 and 1) of each delay that is
+	// randomized to avoid many clients retrying in lockstep.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is the retry policy used by clients returned from
+// NewClient and NewClientWithPin.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxElapsed:   30 * time.Second,
+	InitialDelay: 100 * time.Millisecond,
+	MaxDelay:     5 * time.Second,
+	Jitter:       0.5,
+}
+
+// SetRetryPolicy changes the retry policy used for requests made by the
+// client.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retry = p
+}
+
+func (p RetryPolicy) start() *retryAttempt {
+	if p.MaxElapsed <= 0 {
+		return nil
+	}
+	return &retryAttempt{policy: p, start: time.Now(), delay: p.InitialDelay}
+}
+
+type retryAttempt struct {
+	policy RetryPolicy
+	start  time.Time
+	delay  time.Duration
+}
+
+// Next sleeps until the next attempt should be made, it returns false without
+// sleeping if the policy's MaxElapsed would be exceeded.
+func (a *retryAttempt) Next() bool {
+	delay := a.jitteredDelay()
+	if time.Since(a.start)+delay > a.policy.MaxElapsed {
+		return false
+	}
+	time.Sleep(delay)
+	a.backoff()
+	return true
+}
+
+// jitteredDelay returns the delay before the next attempt with the policy's
+// jitter applied.
+func (a *retryAttempt) jitteredDelay() time.Duration {
+	delay := a.delay
+	if j := a.policy.Jitter; j > 0 && delay > 0 {
+		if j > 1 {
+			j = 1
+		}
+		spread := time.Duration(float64(delay) * j)
+		delay = delay - spread + time.Duration(random.Math.Int63n(int64(spread)+1))
+	}
+	return delay
+}
+
+// backoff doubles the delay before the next attempt, up to MaxDelay.
+func (a *retryAttempt) backoff() {
+	a.delay *= 2
+	if a.delay > a.policy.MaxDelay && a.policy.MaxDelay > 0 {
+		a.delay = a.policy.MaxDelay
+	}
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// temporaryErr reports whether a request failed in a way that is likely to
+// succeed if retried, either because the connection failed or because the
+// controller (or a proxy in front of it) is temporarily unavailable.
+func temporaryErr(res *http.Response, err error) bool {
+	if err == nil {
+		return false
+	}
+	if res == nil {
+		e, ok := err.(*url.Error)
+		// a certificate pin mismatch will not be fixed by retrying
+		return ok && e.Err != pinned.ErrPinFailure
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
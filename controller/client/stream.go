@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// Stream is an open stream of events from the controller.
+type Stream interface {
+	Close() error
+	Err() error
+}
+
+// Stream makes a request to path which responds with a stream of server-sent
+// events, the data of each event is decoded as JSON into a new value and sent
+// to v, which must be a channel of pointers (for example chan *ct.Job). v is
+// closed when the stream ends, Err should then be checked to see if the
+// stream ended because of an error.
+func (c *Client) Stream(method, path string, v interface{}) (Stream, error) {
+	ch := reflect.ValueOf(v)
+	if t := ch.Type(); t.Kind() != reflect.Chan || t.ChanDir()&reflect.SendDir == 0 || t.Elem().Kind() != reflect.Ptr {
+		return nil, errors.New("controller: stream requires a chan of pointers")
+	}
+	res, err := c.rawReq(method, path, http.Header{"Accept": []string{"text/event-stream"}}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	stream := &sseStream{body: res.Body}
+	go stream.decode(ch)
+	return stream, nil
+}
+
+type sseStream struct {
+	body io.ReadCloser
+
+	mtx sync.Mutex
+	err error
+}
+
+func (s *sseStream) decode(ch reflect.Value) {
+	defer ch.Close()
+	dec := &sseDecoder{bufio.NewReader(s.body)}
+	elem := ch.Type().Elem().Elem()
+	for {
+		v := reflect.New(elem)
+		if err := dec.Decode(v.Interface()); err != nil {
+			if err != io.EOF {
+				s.mtx.Lock()
+				s.err = err
+				s.mtx.Unlock()
+			}
+			return
+		}
+		ch.Send(v)
+	}
+}
+
+func (s *sseStream) Close() error {
+	return s.body.Close()
+}
+
+func (s *sseStream) Err() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.err
+}
+
+type sseDecoder struct {
+	*bufio.Reader
+}
+
+// Decode reads the next event that has data and decodes the data into v.
+// Comments (which the controller sends as heartbeats) and other fields are
+// ignored, multiple data lines are joined with newlines.
+func (dec *sseDecoder) Decode(v interface{}) error {
+	var data []byte
+	for {
+		line, err := dec.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			if len(data) > 0 {
+				return json.Unmarshal(data, v)
+			}
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("data:")) {
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" "))...)
+		}
+	}
+}
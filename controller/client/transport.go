@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TransportConfig tunes the HTTP transport used to connect to the
+// controller.
+type TransportConfig struct {
+	// MaxIdleConnsPerHost is the number of idle connections kept open to the
+	// controller for reuse, a negative value disables connection reuse.
+	MaxIdleConnsPerHost int
+
+	// KeepAlive is the TCP keep-alive period of connections, a zero value
+	// disables keep-alives.
+	KeepAlive time.Duration
+
+	// DialTimeout is the maximum time to wait for a connection to be
+	// established, a zero value means no timeout.
+	DialTimeout time.Duration
+
+	// TLSHandshakeTimeout is the maximum time to wait for a TLS handshake, a
+	// zero value means no timeout.
+	TLSHandshakeTimeout time.Duration
+
+	// TLSConfig is used for https URLs, and as the base configuration of
+	// clients created with NewClientWithPin.
+	TLSConfig *tls.Config
+}
+
+// DefaultTransportConfig is tuned for long-lived clients such as the
+// scheduler, which make frequent requests and hold streams open: idle
+// connections are kept for reuse and dead peers are detected using TCP
+// keep-alives.
+var DefaultTransportConfig = TransportConfig{
+	MaxIdleConnsPerHost: 16,
+	KeepAlive:           30 * time.Second,
+	DialTimeout:         10 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+}
+
+// Option changes the transport configuration of a client, it is passed to
+// NewClient or NewClientWithPin.
+type Option func(*TransportConfig)
+
+// WithMaxIdleConns sets the number of idle connections kept for reuse.
+func WithMaxIdleConns(n int) Option {
+	return func(c *TransportConfig) { c.MaxIdleConnsPerHost = n }
+}
+
+// WithKeepAlive sets the TCP keep-alive period, zero disables keep-alives.
+func WithKeepAlive(d time.Duration) Option {
+	return func(c *TransportConfig) { c.KeepAlive = d }
+}
+
+// WithDialTimeout sets the connection timeout, zero disables the timeout.
+func WithDialTimeout(d time.Duration) Option {
+	return func(c *TransportConfig) { c.DialTimeout = d }
+}
+
+// WithTLSConfig sets the TLS configuration.
+func WithTLSConfig(conf *tls.Config) Option {
+	return func(c *TransportConfig) { c.TLSConfig = conf }
+}
+
+// WithTransportConfig replaces the whole transport configuration.
+func WithTransportConfig(conf TransportConfig) Option {
+	return func(c *TransportConfig) { *c = conf }
+}
+
+func newTransportConfig(opts []Option) *TransportConfig {
+	conf := DefaultTransportConfig
+	for _, opt := range opts {
+		opt(&conf)
+	}
+	return &conf
+}
+
+func (c *TransportConfig) dialer() *net.Dialer {
+	return &net.Dialer{Timeout: c.DialTimeout, KeepAlive: c.KeepAlive}
+}
+
+func (c *TransportConfig) transport(dial func(network, addr string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		Dial:                dial,
+		TLSClientConfig:     c.TLSConfig,
+		TLSHandshakeTimeout: c.TLSHandshakeTimeout,
+		MaxIdleConnsPerHost: c.MaxIdleConnsPerHost,
+		DisableKeepAlives:   c.MaxIdleConnsPerHost < 0,
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// Version is the controller version, it is set at build time using
+// -ldflags "-X main.Version <version>".
+var Version = "dev"
+
+// features are the optional API features supported by this controller.
+var features = []string{
+	"app_complete",
+	"app_log",
+	"deployments",
+	"events",
+	"gzip",
+	"health",
+	"if_match",
+	"job_signal",
+	"long_poll",
+	"metrics",
+}
+
+type clusterConfig struct {
+	domain string
+	caCert []byte
+}
+
+func getClusterInfo(conf *clusterConfig, r ResponseHelper) {
+	r.JSON(200, &ct.ClusterInfo{
+		Version:  Version,
+		Domain:   conf.domain,
+		Features: features,
+	})
+}
+
+func getCACert(conf *clusterConfig, w http.ResponseWriter, r ResponseHelper) {
+	if len(conf.caCert) == 0 {
+		r.Error(ErrNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.WriteHeader(200)
+	w.Write(conf.caCert)
+}
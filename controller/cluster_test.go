@@ -0,0 +1,22 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/flynn/flynn/controller/client"
+)
+
+var testCACert = []byte("-----BEGIN CERTIFICATE-----\ntest\n-----END CERTIFICATE-----\n")
+
+func (s *S) TestClusterInfo(c *C) {
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+
+	info, err := client.GetClusterInfo()
+	c.Assert(err, IsNil)
+	c.Assert(info.Version, Equals, Version)
+	c.Assert(info.Features, DeepEquals, features)
+
+	cert, err := client.GetCACert()
+	c.Assert(err, IsNil)
+	c.Assert(cert, DeepEquals, testCACert)
+}
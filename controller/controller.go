@@ -1,7 +1,6 @@
 package main
 
 import (
-	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -10,6 +9,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -69,7 +69,43 @@ func main() {
 		log.Fatal(err)
 	}
 
-	handler, _ := appHandler(handlerConfig{db: db, cc: cc, sc: sc, dc: discoverd.DefaultClient, key: os.Getenv("AUTH_KEY")})
+	gcInterval := time.Hour
+	if s := os.Getenv("GC_INTERVAL"); s != "" {
+		if gcInterval, err = time.ParseDuration(s); err != nil {
+			log.Fatalln("error parsing GC_INTERVAL:", err)
+		}
+	}
+	gcKeep := defaultGCKeep
+	if s := os.Getenv("GC_KEEP_RELEASES"); s != "" {
+		if gcKeep, err = strconv.Atoi(s); err != nil {
+			log.Fatalln("error parsing GC_KEEP_RELEASES:", err)
+		}
+	}
+
+	appRetention := defaultAppRetention
+	if s := os.Getenv("APP_RETENTION"); s != "" {
+		if appRetention, err = time.ParseDuration(s); err != nil {
+			log.Fatalln("error parsing APP_RETENTION:", err)
+		}
+	}
+
+	handler, _ := appHandler(handlerConfig{
+		db:                db,
+		cc:                cc,
+		sc:                sc,
+		dc:                discoverd.DefaultClient,
+		port:              port,
+		key:               os.Getenv("AUTH_KEY"),
+		domain:            os.Getenv("DEFAULT_ROUTE_DOMAIN"),
+		caCert:            []byte(os.Getenv("CA_CERT")),
+		gcInterval:        gcInterval,
+		gcKeep:            gcKeep,
+		cronInterval:      time.Minute,
+		autoscaleInterval: 30 * time.Second,
+		webhookInterval:   5 * time.Second,
+		appRetention:      appRetention,
+		reapInterval:      time.Hour,
+	})
 	log.Fatal(http.ListenAndServe(addr, handler))
 }
 
@@ -85,6 +121,41 @@ type handlerConfig struct {
 	sc  routerc.Client
 	dc  *discoverd.Client
 	key string
+
+	// port is the port the controller listens on, it is used to check
+	// that the controller is registered in discoverd.
+	port string
+
+	// domain is the default route domain for new apps.
+	domain string
+	// caCert is the PEM encoded certificate used to verify the controller's
+	// TLS certificate, it is served at /ca-cert if set.
+	caCert []byte
+
+	// gcInterval is how often old releases of all apps, unused artifacts
+	// and the blobstore files of deleted artifacts and releases are garbage
+	// collected, a zero value disables scheduled collection. gcKeep is the
+	// number of recent releases kept for each app.
+	gcInterval time.Duration
+	gcKeep     int
+
+	// cronInterval is how often cron jobs are checked for runs which are
+	// due, a zero value disables running cron jobs.
+	cronInterval time.Duration
+
+	// autoscaleInterval is how often autoscale policies are evaluated, a
+	// zero value disables autoscaling.
+	autoscaleInterval time.Duration
+
+	// webhookInterval is how often events are queued for webhooks and due
+	// deliveries are sent, a zero value disables sending webhooks.
+	webhookInterval time.Duration
+
+	// appRetention is how long deleted apps can be restored, it defaults
+	// to defaultAppRetention. The tombstones of apps deleted longer ago are
+	// purged every reapInterval, a zero value disables purging.
+	appRetention time.Duration
+	reapInterval time.Duration
 }
 
 type ResponseHelper interface {
@@ -102,13 +173,23 @@ func (r *responseHelper) Error(err error) {
 	switch err.(type) {
 	case ct.ValidationError:
 		r.JSON(400, err)
+	case ct.QuotaError:
+		r.JSON(403, err)
 	case *json.SyntaxError, *json.UnmarshalTypeError:
-		r.JSON(400, ct.ValidationError{Message: "The provided JSON input is invalid"})
+		r.JSON(400, ct.ValidationError{Code: ct.ValidationCodeInvalidJSON, Message: "The provided JSON input is invalid"})
 	default:
 		if err == ErrNotFound {
 			r.WriteHeader(404)
 			return
 		}
+		if err == ErrPreconditionFailed {
+			r.WriteHeader(412)
+			return
+		}
+		if err == ErrConflict {
+			r.WriteHeader(409)
+			return
+		}
 		log.Println(err)
 		r.JSON(500, struct{}{})
 	}
@@ -122,76 +203,222 @@ func appHandler(c handlerConfig) (http.Handler, *martini.Martini) {
 	r := martini.NewRouter()
 	m := martini.New()
 	m.Map(log.New(os.Stdout, "[controller] ", log.LstdFlags|log.Lmicroseconds))
+	d := NewDB(c.db)
+	metrics := newMetrics(d)
+	m.Map(metrics)
+	m.Use(metricsHandler(metrics))
 	m.Use(martini.Logger())
 	m.Use(martini.Recovery())
+
+	auditRepo := NewAuditRepo(d)
+	// replayed responses are not audited again
+	m.Use(idempotencyHandler(NewIdempotencyRepo(d)))
+	m.Use(auditHandler(auditRepo, m))
 	m.Use(render.Renderer())
 	m.Use(responseHelperHandler)
 	m.Action(r.Handle)
 
-	d := NewDB(c.db)
-
 	providerRepo := NewProviderRepo(d)
 	keyRepo := NewKeyRepo(d)
 	resourceRepo := NewResourceRepo(d)
-	appRepo := NewAppRepo(d, os.Getenv("DEFAULT_ROUTE_DOMAIN"), c.sc)
+	appRepo := NewAppRepo(d, c.domain, c.sc)
+	if c.appRetention > 0 {
+		appRepo.retention = c.appRetention
+	}
 	artifactRepo := NewArtifactRepo(d)
 	releaseRepo := NewReleaseRepo(d)
 	jobRepo := NewJobRepo(d)
 	formationRepo := NewFormationRepo(d, appRepo, releaseRepo, artifactRepo)
+	eventRepo := NewEventRepo(d)
+	deploymentRepo := NewDeploymentRepo(d)
+	cronRepo := NewCronRepo(d)
+	autoscaleRepo := NewAutoscaleRepo(d)
 	m.Map(resourceRepo)
 	m.Map(appRepo)
 	m.Map(artifactRepo)
 	m.Map(releaseRepo)
 	m.Map(jobRepo)
 	m.Map(formationRepo)
+	m.Map(eventRepo)
+	m.Map(deploymentRepo)
+	m.Map(cronRepo)
+	m.Map(autoscaleRepo)
+	m.Map(auditRepo)
+	authTokenRepo := NewAuthTokenRepo(d)
+	m.Map(authTokenRepo)
+	dr := &deployer{repo: deploymentRepo, apps: appRepo, formations: formationRepo, jobs: jobRepo}
+	m.Map(dr)
+	go func() {
+		if err := dr.Recover(); err != nil {
+			log.Printf("deployer: unable to recover deployments: %s", err)
+		}
+	}()
+	m.Map(&clusterConfig{domain: c.domain, caCert: c.caCert})
+	gcConf := &gcConfig{keep: c.gcKeep, grace: defaultGCGrace}
+	if gcConf.keep <= 0 {
+		gcConf.keep = defaultGCKeep
+	}
+	m.Map(gcConf)
+	gc := &garbageCollector{conf: gcConf, apps: appRepo, releases: releaseRepo, artifacts: artifactRepo, db: d}
+	if c.dc != nil {
+		gc.blobs = &discoverdBlobStore{dc: c.dc, client: &http.Client{Timeout: 30 * time.Second}}
+	}
+	m.Map(gc)
+	if c.gcInterval > 0 {
+		go scheduleGC(c.gcInterval, gc)
+	}
+	crons := &cronRunner{repo: cronRepo, apps: appRepo, artifacts: artifactRepo, cl: c.cc}
+	m.Map(crons)
+	if c.cronInterval > 0 {
+		go crons.Run(c.cronInterval)
+	}
+	scaler := &autoscaler{
+		repo:        autoscaleRepo,
+		apps:        appRepo,
+		formations:  formationRepo,
+		deployments: deploymentRepo,
+		metrics: map[string]metricSource{
+			ct.AutoscaleMetricRequests: &requestRate{router: c.sc},
+		},
+	}
+	m.Map(scaler)
+	if c.autoscaleInterval > 0 {
+		go scaler.Run(c.autoscaleInterval)
+	}
+	webhookRepo := NewWebhookRepo(d, eventRepo)
+	m.Map(webhookRepo)
+	webhooks := &webhookSender{repo: webhookRepo, client: &http.Client{Timeout: webhookTimeout}}
+	m.Map(webhooks)
+	if c.webhookInterval > 0 {
+		go webhooks.Run(c.webhookInterval)
+	}
+	if c.reapInterval > 0 {
+		go scheduleTombstoneReaper(c.reapInterval, appRepo, resourceDeprovisioner(providerRepo, c.dc))
+	}
+	health := &healthChecker{db: d, service: "flynn-controller", port: c.port}
+	if c.dc != nil {
+		health.dc = c.dc
+	}
+	m.Map(health)
 	m.Map(c.dc)
 	m.MapTo(c.cc, (*clusterClient)(nil))
 	m.MapTo(c.sc, (*routerc.Client)(nil))
 	m.MapTo(c.dc, (*resource.DiscoverdClient)(nil))
 
 	getAppMiddleware := crud("apps", ct.App{}, appRepo, r)
+	r.Post("/app_complete", validateBody("app_complete"), binding.Bind(ct.AppComplete{}), createAppComplete)
 	getReleaseMiddleware := crud("releases", ct.Release{}, releaseRepo, r)
 	getProviderMiddleware := crud("providers", ct.Provider{}, providerRepo, r)
 	crud("artifacts", ct.Artifact{}, artifactRepo, r)
 	crud("keys", ct.Key{}, keyRepo, r)
 
-	r.Put("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getReleaseMiddleware, binding.Bind(ct.Formation{}), putFormation)
+	r.Put("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getReleaseMiddleware, validateBody("formations"), binding.Bind(ct.Formation{}), putFormation)
 	r.Get("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getFormationMiddleware, getFormation)
 	r.Delete("/apps/:apps_id/formations/:releases_id", getAppMiddleware, getFormationMiddleware, deleteFormation)
 	r.Get("/apps/:apps_id/formations", getAppMiddleware, listFormations)
+	r.Get("/apps/:apps_id/processes", getAppMiddleware, getAppProcesses)
+	r.Get("/formations", streamFormations)
+	r.Put("/formations", validateBody("formation_batches"), binding.Bind(ct.FormationBatch{}), putFormations)
 
-	r.Post("/apps/:apps_id/jobs", getAppMiddleware, binding.Bind(ct.NewJob{}), runJob)
-	r.Put("/apps/:apps_id/jobs/:jobs_id", getAppMiddleware, binding.Bind(ct.Job{}), putJob)
+	r.Post("/apps/:apps_id/jobs", getAppMiddleware, validateBody("new_jobs"), binding.Bind(ct.NewJob{}), runJob)
+	r.Put("/apps/:apps_id/jobs/:jobs_id", getAppMiddleware, validateBody("jobs"), binding.Bind(ct.Job{}), putJob)
 	r.Get("/apps/:apps_id/jobs", getAppMiddleware, listJobs)
+	r.Get("/apps/:apps_id/jobs/:jobs_id", getAppMiddleware, getJob)
 	r.Delete("/apps/:apps_id/jobs/:jobs_id", getAppMiddleware, connectHostMiddleware, killJob)
+	r.Post("/apps/:apps_id/jobs/:jobs_id/signal/:signal", getAppMiddleware, connectHostMiddleware, signalJob)
 	r.Get("/apps/:apps_id/jobs/:jobs_id/log", getAppMiddleware, connectHostMiddleware, jobLog)
-
-	r.Put("/apps/:apps_id/release", getAppMiddleware, binding.Bind(releaseID{}), setAppRelease)
+	r.Get("/apps/:apps_id/jobs/:jobs_id/stats", getAppMiddleware, connectHostMiddleware, jobStats)
+	r.Post("/apps/:apps_id/jobs/:jobs_id/exec", getAppMiddleware, validateBody("job_execs"), binding.Bind(ct.JobExec{}), connectHostMiddleware, execJob)
+	r.Get("/apps/:apps_id/log", getAppMiddleware, appLog)
+	r.Post("/apps/:apps_id/gc", getAppMiddleware, appGC)
+
+	r.Post("/apps/:apps_id/deploy", getAppMiddleware, validateBody("deployments"), binding.Bind(ct.Deployment{}), createDeployment)
+	r.Post("/apps/:apps_id/rollback", getAppMiddleware, validateBody("rollbacks"), binding.Bind(ct.Rollback{}), rollbackApp)
+	r.Post("/apps/:apps_id/undelete", undeleteApp)
+	r.Post("/apps/:apps_id/transfer", getAppMiddleware, validateBody("app_transfers"), binding.Bind(ct.AppTransfer{}), startAppTransfer)
+	r.Post("/apps/:apps_id/transfer/accept", getAppMiddleware, acceptAppTransfer)
+	r.Delete("/apps/:apps_id/transfer", getAppMiddleware, cancelAppTransfer)
+	r.Post("/apps/:apps_id/promote", getAppMiddleware, validateBody("promotions"), binding.Bind(ct.Promotion{}), promoteApp)
+	r.Get("/apps/:apps_id/deployments/:deployments_id", getAppMiddleware, getDeploymentMiddleware, getDeployment)
+
+	r.Post("/apps/:apps_id/cron_jobs", getAppMiddleware, validateBody("cron_jobs"), binding.Bind(ct.CronJob{}), createCronJob)
+	r.Get("/apps/:apps_id/cron_jobs", getAppMiddleware, listCronJobs)
+	r.Get("/apps/:apps_id/cron_jobs/:cron_jobs_id", getAppMiddleware, getCronJobMiddleware, getCronJob)
+	r.Delete("/apps/:apps_id/cron_jobs/:cron_jobs_id", getAppMiddleware, getCronJobMiddleware, deleteCronJob)
+	r.Get("/apps/:apps_id/cron_jobs/:cron_jobs_id/runs", getAppMiddleware, getCronJobMiddleware, listCronJobRuns)
+
+	r.Post("/apps/:apps_id/log_drains", getAppMiddleware, validateBody("log_drains"), binding.Bind(ct.LogDrain{}), createLogDrain)
+	r.Get("/apps/:apps_id/log_drains", getAppMiddleware, listLogDrains)
+	r.Get("/apps/:apps_id/log_drains/:log_drains_id", getAppMiddleware, getLogDrainMiddleware, getLogDrain)
+	r.Delete("/apps/:apps_id/log_drains/:log_drains_id", getAppMiddleware, getLogDrainMiddleware, deleteLogDrain)
+
+	r.Put("/apps/:apps_id/autoscale/:process_type", getAppMiddleware, validateBody("autoscale_policies"), binding.Bind(ct.AutoscalePolicy{}), putAutoscalePolicy)
+	r.Get("/apps/:apps_id/autoscale", getAppMiddleware, listAutoscalePolicies)
+	r.Delete("/apps/:apps_id/autoscale/:process_type", getAppMiddleware, deleteAutoscalePolicy)
+
+	r.Get("/apps/:apps_id/env", getAppMiddleware, getAppEnv)
+	r.Post("/apps/:apps_id/env", getAppMiddleware, validateBody("app_env"), binding.Bind(ct.EnvUpdate{}), updateAppEnv)
+
+	r.Get("/apps/:apps_id/quota", getAppMiddleware, getAppQuota)
+	r.Put("/apps/:apps_id/quota", getAppMiddleware, validateBody("app_quota"), binding.Bind(ct.AppQuota{}), setAppQuota)
+
+	r.Put("/apps/:apps_id/release", getAppMiddleware, validateBody("app_releases"), binding.Bind(releaseID{}), setAppRelease)
 	r.Get("/apps/:apps_id/release", getAppMiddleware, getAppRelease)
+	r.Get("/apps/:apps_id/releases", getAppMiddleware, listAppReleases)
+	r.Get("/apps/:apps_id/releases/:from/diff/:to", getAppMiddleware, diffAppReleases)
 
-	r.Post("/providers/:providers_id/resources", getProviderMiddleware, binding.Bind(ct.ResourceReq{}), resourceServerMiddleware, provisionResource)
+	r.Post("/providers/:providers_id/resources", getProviderMiddleware, validateBody("resource_reqs"), binding.Bind(ct.ResourceReq{}), resourceServerMiddleware, provisionResource)
+	r.Get("/providers/:providers_id/status", getProviderMiddleware, getProviderStatus)
 	r.Get("/providers/:providers_id/resources", getProviderMiddleware, getProviderResources)
 	r.Get("/providers/:providers_id/resources/:resources_id", getProviderMiddleware, getResourceMiddleware, getResource)
-	r.Put("/providers/:providers_id/resources/:resources_id", getProviderMiddleware, binding.Bind(ct.Resource{}), putResource)
+	r.Put("/providers/:providers_id/resources/:resources_id", getProviderMiddleware, validateBody("resources"), binding.Bind(ct.Resource{}), putResource)
+	r.Delete("/providers/:providers_id/resources/:resources_id", getProviderMiddleware, getResourceMiddleware, resourceServerMiddleware, deleteResource)
+	r.Put("/providers/:providers_id/resources/:resources_id/apps/:apps_id", getProviderMiddleware, getResourceMiddleware, getAppMiddleware, addResourceApp)
+	r.Delete("/providers/:providers_id/resources/:resources_id/apps/:apps_id", getProviderMiddleware, getResourceMiddleware, getAppMiddleware, removeResourceApp)
 	r.Get("/apps/:apps_id/resources", getAppMiddleware, getAppResources)
 
-	r.Post("/apps/:apps_id/routes", getAppMiddleware, binding.Bind(router.Route{}), createRoute)
+	r.Post("/apps/:apps_id/routes", getAppMiddleware, validateBody("routes"), binding.Bind(router.Route{}), createRoute)
 	r.Get("/apps/:apps_id/routes", getAppMiddleware, getRouteList)
 	r.Get("/apps/:apps_id/routes/:routes_type/:routes_id", getAppMiddleware, getRouteMiddleware, getRoute)
 	r.Delete("/apps/:apps_id/routes/:routes_type/:routes_id", getAppMiddleware, getRouteMiddleware, deleteRoute)
 
-	return rpcMuxHandler(m, rpcHandler(formationRepo), c.key), m
+	r.Get("/schemas", getSchemas)
+	r.Get("/schemas/:schemas_id", getSchema)
+
+	r.Get("/events", streamEvents)
+	r.Get("/audit", listAudit)
+
+	r.Post("/auth_tokens", validateBody("auth_tokens"), binding.Bind(ct.AuthToken{}), createAuthToken)
+	r.Get("/auth_tokens", listAuthTokens)
+	r.Delete("/auth_tokens/:auth_tokens_id", deleteAuthToken)
+
+	r.Post("/webhooks", validateBody("webhooks"), binding.Bind(ct.Webhook{}), createWebhook)
+	r.Get("/webhooks", listWebhooks)
+	r.Get("/webhooks/:webhooks_id", getWebhookMiddleware, getWebhook)
+	r.Delete("/webhooks/:webhooks_id", getWebhookMiddleware, deleteWebhook)
+	r.Get("/webhooks/:webhooks_id/deliveries", getWebhookMiddleware, listWebhookDeliveries)
+
+	r.Get("/cluster", getClusterInfo)
+	r.Get("/export", exportCluster)
+	r.Post("/import", importCluster)
+	r.Get("/ca-cert", getCACert)
+	r.Get("/metrics", getMetrics)
+	r.Get("/health", getHealth)
+	r.Post("/gc", clusterGC)
+
+	return rpcMuxHandler(m, rpcHandler(formationRepo), &authorizer{key: c.key, tokens: authTokenRepo}), m
 }
 
-func rpcMuxHandler(main http.Handler, rpch http.Handler, authKey string) http.Handler {
+func rpcMuxHandler(main http.Handler, rpch http.Handler, auth *authorizer) http.Handler {
 	corsHandler := cors.Allow(&cors.Options{
 		AllowAllOrigins:  true,
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"},
-		AllowHeaders:     []string{"Authorization", "Accept", "Content-Type", "If-Match", "If-None-Match"},
-		ExposeHeaders:    []string{"ETag"},
+		AllowHeaders:     []string{"Authorization", "Accept", "Content-Type", "If-Match", "If-None-Match", idempotencyKeyHeader},
+		ExposeHeaders:    []string{"ETag", idempotentReplayedHeader},
 		AllowCredentials: true,
 		MaxAge:           time.Hour,
 	})
+	main = gzipHandler(main)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		corsHandler(w, r)
@@ -199,14 +426,17 @@ func rpcMuxHandler(main http.Handler, rpch http.Handler, authKey string) http.Ha
 			w.WriteHeader(200)
 			return
 		}
-		_, password, _ := parseBasicAuth(r.Header)
-		if password == "" && strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
-			password = r.URL.Query().Get("key")
+		// load balancers check the health without credentials
+		if r.URL.Path == "/health" && r.Method == "GET" {
+			main.ServeHTTP(w, r)
+			return
 		}
-		if len(password) != len(authKey) || subtle.ConstantTimeCompare([]byte(password), []byte(authKey)) != 1 {
-			w.WriteHeader(401)
+		actor, status := auth.authorize(r)
+		if status != 0 {
+			w.WriteHeader(status)
 			return
 		}
+		r.Header.Set(actorHeader, actor)
 		if r.URL.Path == rpcplus.DefaultRPCPath {
 			rpch.ServeHTTP(w, r)
 		} else {
@@ -215,21 +445,66 @@ func rpcMuxHandler(main http.Handler, rpch http.Handler, authKey string) http.Ha
 	})
 }
 
-func putFormation(formation ct.Formation, app *ct.App, release *ct.Release, repo *FormationRepo, r ResponseHelper) {
+func putFormation(req *http.Request, w http.ResponseWriter, formation ct.Formation, app *ct.App, release *ct.Release, repo *FormationRepo, r ResponseHelper) {
 	formation.AppID = app.ID
 	formation.ReleaseID = release.ID
-	if app.Protected {
-		for typ := range release.Processes {
-			if formation.Processes[typ] == 0 {
-				r.Error(ct.ValidationError{Message: "unable to scale to zero, app is protected"})
-				return
-			}
+	if req.Header.Get("If-Match") != "" {
+		var current interface{}
+		if f, err := repo.Get(app.ID, release.ID); err == nil {
+			current = f
+		} else if err != ErrNotFound {
+			r.Error(err)
+			return
 		}
+		if err := checkIfMatch(req, current); err != nil {
+			r.Error(err)
+			return
+		}
+	}
+	for typ, l := range formation.Limits {
+		field := joinField("limits", typ)
+		if _, ok := release.Processes[typ]; !ok {
+			r.Error(ct.ValidationError{Field: field, Message: "is not a process type of the release"})
+			return
+		}
+		if err := validateLimits(field, l); err != nil {
+			r.Error(err)
+			return
+		}
+	}
+	for typ, c := range formation.Constraints {
+		field := joinField("constraints", typ)
+		if _, ok := release.Processes[typ]; !ok {
+			r.Error(ct.ValidationError{Field: field, Message: "is not a process type of the release"})
+			return
+		}
+		if err := validateConstraints(field, c); err != nil {
+			r.Error(err)
+			return
+		}
+	}
+	if app.Protected && req.FormValue("force") != "true" {
+		current, err := repo.Get(app.ID, release.ID)
+		if err != nil && err != ErrNotFound {
+			r.Error(err)
+			return
+		}
+		if err := checkProtectedScale(current, formation.Processes); err != nil {
+			r.Error(err)
+			return
+		}
+	}
+	if err := repo.checkQuota(&formation, release); err != nil {
+		r.Error(err)
+		return
 	}
 	if err := repo.Add(&formation); err != nil {
 		r.Error(err)
 		return
 	}
+	if f, err := repo.Get(app.ID, release.ID); err == nil {
+		setETag(w, f)
+	}
 	r.JSON(200, &formation)
 }
 
@@ -242,11 +517,43 @@ func getFormationMiddleware(c martini.Context, app *ct.App, params martini.Param
 	c.Map(formation)
 }
 
-func getFormation(formation *ct.Formation, r ResponseHelper) {
+func getFormation(formation *ct.Formation, w http.ResponseWriter, r ResponseHelper) {
+	setETag(w, formation)
 	r.JSON(200, formation)
 }
 
-func deleteFormation(formation *ct.Formation, repo *FormationRepo, r ResponseHelper) {
+func putFormations(req *http.Request, batch ct.FormationBatch, repo *FormationRepo, r ResponseHelper) {
+	formations, err := repo.UpdateBatch(batch.Formations, req.FormValue("force") == "true")
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, formations)
+}
+
+// checkProtectedScale returns an error if the processes scale any process
+// type of the protected app's current formation which has jobs to zero, as
+// the app's jobs are needed by the cluster. Protected apps are only scaled
+// down to zero with the force parameter.
+func checkProtectedScale(current *ct.Formation, procs map[string]int) error {
+	if current == nil {
+		return nil
+	}
+	for typ, n := range current.Processes {
+		if n > 0 && procs[typ] == 0 {
+			return ct.ValidationError{Field: joinField("processes", typ), Message: "unable to scale to zero, app is protected, use force to scale it down"}
+		}
+	}
+	return nil
+}
+
+func deleteFormation(req *http.Request, app *ct.App, formation *ct.Formation, repo *FormationRepo, r ResponseHelper) {
+	if app.Protected && req.FormValue("force") != "true" {
+		if err := checkProtectedScale(formation, nil); err != nil {
+			r.Error(err)
+			return
+		}
+	}
 	err := repo.Remove(formation.AppID, formation.ReleaseID)
 	if err != nil {
 		r.Error(err)
@@ -282,30 +589,38 @@ func setAppRelease(app *ct.App, rid releaseID, apps *AppRepo, releases *ReleaseR
 	release := rel.(*ct.Release)
 	apps.SetRelease(app.ID, release.ID)
 
-	// TODO: use transaction/lock
-	fs, err := formations.List(app.ID)
-	if err != nil {
+	if err := moveFormation(formations, app.ID, release.ID); err != nil {
 		r.Error(err)
 		return
 	}
-	if len(fs) == 1 && fs[0].ReleaseID != release.ID {
-		if err := formations.Add(&ct.Formation{
-			AppID:     app.ID,
-			ReleaseID: release.ID,
-			Processes: fs[0].Processes,
-		}); err != nil {
-			r.Error(err)
-			return
-		}
-		if err := formations.Remove(app.ID, fs[0].ReleaseID); err != nil {
-			r.Error(err)
-			return
-		}
-	}
 
 	r.JSON(200, release)
 }
 
+// moveFormation replaces the app's formation with one for the release if the
+// app has a single formation, so that the app's processes keep running when
+// its release is changed.
+func moveFormation(formations *FormationRepo, appID, releaseID string) error {
+	// TODO: use transaction/lock
+	fs, err := formations.List(appID)
+	if err != nil {
+		return err
+	}
+	if len(fs) != 1 || fs[0].ReleaseID == releaseID {
+		return nil
+	}
+	if err := formations.Add(&ct.Formation{
+		AppID:       appID,
+		ReleaseID:   releaseID,
+		Processes:   fs[0].Processes,
+		Limits:      fs[0].Limits,
+		Constraints: fs[0].Constraints,
+	}); err != nil {
+		return err
+	}
+	return formations.Remove(appID, fs[0].ReleaseID)
+}
+
 func getAppRelease(app *ct.App, apps *AppRepo, r ResponseHelper) {
 	release, err := apps.GetRelease(app.ID)
 	if err != nil {
@@ -326,14 +641,56 @@ func resourceServerMiddleware(c martini.Context, p *ct.Provider, dc resource.Dis
 	server.Close()
 }
 
-func putResource(p *ct.Provider, params martini.Params, resource ct.Resource, repo *ResourceRepo, r ResponseHelper) {
+// getProviderStatus probes the provider, an unreachable provider is reported
+// in the response body rather than as an error so that clients can display
+// the reason.
+func getProviderStatus(p *ct.Provider, dc resource.DiscoverdClient, r ResponseHelper) {
+	status := &ct.ProviderStatus{ProviderID: p.ID, CheckedAt: time.Now().UTC()}
+	server, err := resource.NewServerWithDiscoverd(p.URL, dc)
+	if err == nil {
+		var s *resource.Status
+		s, err = server.Status()
+		if s != nil {
+			status.Addr = s.Addr
+			status.Latency = s.Latency
+		}
+		server.Close()
+	}
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Reachable = true
+	}
+	r.JSON(200, status)
+}
+
+func putResource(req *http.Request, w http.ResponseWriter, p *ct.Provider, params martini.Params, resource ct.Resource, repo *ResourceRepo, r ResponseHelper) {
 	resource.ID = params["resources_id"]
 	resource.ProviderID = p.ID
+	if req.Header.Get("If-Match") != "" {
+		var current interface{}
+		if res, err := repo.Get(resource.ID); err == nil {
+			current = res
+		} else if err != ErrNotFound {
+			r.Error(err)
+			return
+		}
+		if err := checkIfMatch(req, current); err != nil {
+			r.Error(err)
+			return
+		}
+	}
 	if err := repo.Add(&resource); err != nil {
 		r.Error(err)
 		return
 	}
-	r.JSON(200, &resource)
+	res, err := repo.Get(resource.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	setETag(w, res)
+	r.JSON(200, res)
 }
 
 func provisionResource(rs *resource.Server, p *ct.Provider, req ct.ResourceReq, repo *ResourceRepo, r ResponseHelper) {
@@ -350,10 +707,11 @@ func provisionResource(rs *resource.Server, p *ct.Provider, req ct.ResourceReq,
 	}
 
 	res := &ct.Resource{
-		ProviderID: p.ID,
-		ExternalID: data.ID,
-		Env:        data.Env,
-		Apps:       req.Apps,
+		ProviderID:   p.ID,
+		ProviderName: p.Name,
+		ExternalID:   data.ID,
+		Env:          data.Env,
+		Apps:         req.Apps,
 	}
 	if err := repo.Add(res); err != nil {
 		// TODO: attempt to "rollback" provisioning
@@ -363,6 +721,28 @@ func provisionResource(rs *resource.Server, p *ct.Provider, req ct.ResourceReq,
 	r.JSON(200, res)
 }
 
+// deleteResource asks the provider to deprovision the resource and only
+// removes it once the provider has confirmed, so that a failed request can be
+// retried. Resources without an external ID were never provisioned by the
+// provider and are just removed.
+func deleteResource(p *ct.Provider, res *ct.Resource, rs *resource.Server, repo *ResourceRepo, r ResponseHelper) {
+	if res.ProviderID != p.ID {
+		r.Error(ErrNotFound)
+		return
+	}
+	if res.ExternalID != "" {
+		if err := rs.Deprovision(res.ExternalID); err != nil {
+			r.Error(err)
+			return
+		}
+	}
+	if err := repo.Remove(res); err != nil {
+		r.Error(err)
+		return
+	}
+	r.WriteHeader(200)
+}
+
 func getResourceMiddleware(c martini.Context, params martini.Params, repo *ResourceRepo, r ResponseHelper) {
 	resource, err := repo.Get(params["resources_id"])
 	if err != nil {
@@ -372,7 +752,63 @@ func getResourceMiddleware(c martini.Context, params martini.Params, repo *Resou
 	c.Map(resource)
 }
 
-func getResource(resource *ct.Resource, r ResponseHelper) {
+func getResource(resource *ct.Resource, w http.ResponseWriter, r ResponseHelper) {
+	setETag(w, resource)
+	r.JSON(200, resource)
+}
+
+func createAppComplete(data ct.AppComplete, repo *AppRepo, r ResponseHelper) {
+	if err := repo.AddComplete(&data); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &data)
+}
+
+func addResourceApp(resource *ct.Resource, app *ct.App, repo *ResourceRepo, r ResponseHelper) {
+	if err := repo.AddApp(resource.ID, app.ID); err != nil {
+		r.Error(err)
+		return
+	}
+	getUpdatedResource(resource.ID, repo, r)
+}
+
+// removeResourceApp unbinds the resource from the app, the resource is
+// deprovisioned and deleted along with its last binding and is then returned
+// without any apps.
+func removeResourceApp(p *ct.Provider, res *ct.Resource, app *ct.App, dc resource.DiscoverdClient, repo *ResourceRepo, r ResponseHelper) {
+	if res.ProviderID != p.ID {
+		r.Error(ErrNotFound)
+		return
+	}
+	deleted, err := repo.RemoveApp(res, app.ID, func() error {
+		if res.ExternalID == "" {
+			return nil
+		}
+		server, err := resource.NewServerWithDiscoverd(p.URL, dc)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+		return server.Deprovision(res.ExternalID)
+	})
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if deleted {
+		r.JSON(200, res)
+		return
+	}
+	getUpdatedResource(res.ID, repo, r)
+}
+
+func getUpdatedResource(id string, repo *ResourceRepo, r ResponseHelper) {
+	resource, err := repo.Get(id)
+	if err != nil {
+		r.Error(err)
+		return
+	}
 	r.JSON(200, resource)
 }
 
@@ -3,13 +3,16 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
 	_ "github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
@@ -17,8 +20,12 @@ import (
 	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
 	tu "github.com/flynn/flynn/controller/testutils"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/random"
 	"github.com/flynn/flynn/pkg/rpcplus"
+	routerc "github.com/flynn/flynn/router/client"
+	"github.com/flynn/flynn/router/types"
 )
 
 // Hook gocheck up to the "go test" runner
@@ -66,7 +73,7 @@ func (s *S) SetUpSuite(c *C) {
 	dbw := testDBWrapper{DB: db, dsn: dsn}
 
 	s.cc = tu.NewFakeCluster()
-	handler, m := appHandler(handlerConfig{db: dbw, cc: s.cc, sc: newFakeRouter(), key: "test"})
+	handler, m := appHandler(handlerConfig{db: dbw, cc: s.cc, sc: newFakeRouter(), key: "test", caCert: testCACert})
 	s.m = m
 	s.srv = httptest.NewServer(handler)
 }
@@ -219,6 +226,113 @@ func (s *S) TestUpdateApp(c *C) {
 	c.Assert(res.StatusCode, Equals, 200)
 	c.Assert(gotApp.Protected, Equals, false)
 	c.Assert(gotApp.Meta, DeepEquals, meta)
+
+	labels := map[string]string{"env": "production"}
+	res, err = s.Post("/apps/"+app.ID, map[string]interface{}{"labels": labels}, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(gotApp.Labels, DeepEquals, labels)
+	c.Assert(gotApp.Meta, DeepEquals, meta)
+}
+
+func (s *S) TestUpdateAppIfMatch(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "update-app-if-match"})
+
+	res, err := s.Get("/apps/"+app.ID, &ct.App{})
+	c.Assert(err, IsNil)
+	etag := res.Header.Get("ETag")
+	c.Assert(etag, Not(Equals), "")
+
+	update := func(etag string) *http.Response {
+		buf, err := json.Marshal(map[string]bool{"protected": true})
+		c.Assert(err, IsNil)
+		req, err := http.NewRequest("POST", s.srv.URL+"/apps/"+app.ID, bytes.NewReader(buf))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", etag)
+		req.SetBasicAuth("", authKey)
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		return res
+	}
+
+	res = update(etag)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("ETag"), Not(Equals), etag)
+
+	// the app has changed, so the original ETag no longer matches
+	res = update(etag)
+	c.Assert(res.StatusCode, Equals, 412)
+}
+
+func (s *S) TestAppMaintenance(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-maintenance"})
+	s.createTestRoute(c, app.ID, (&router.HTTPRoute{Domain: "maintenance.example.com", Service: "app-maintenance-web"}).ToRoute())
+
+	gotApp := &ct.App{}
+	res, err := s.Put("/apps/"+app.ID, map[string]interface{}{"maintenance": true}, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(gotApp.Maintenance, Equals, true)
+	c.Assert(gotApp.MaintenanceStartedAt, NotNil)
+	c.Assert(gotApp.MaintenanceEndedAt, IsNil)
+
+	var routes []*router.Route
+	_, err = s.Get("/apps/"+app.ID+"/routes", &routes)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	c.Assert(routes[0].HTTPRoute().Maintenance, Equals, true)
+
+	// routes created during maintenance are in maintenance mode
+	route := s.createTestRoute(c, app.ID, (&router.HTTPRoute{Domain: "maintenance.example.org", Service: "app-maintenance-web"}).ToRoute())
+	c.Assert(route.HTTPRoute().Maintenance, Equals, true)
+
+	res, err = s.Put("/apps/"+app.ID, map[string]interface{}{"maintenance": false}, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(gotApp.Maintenance, Equals, false)
+	c.Assert(gotApp.MaintenanceStartedAt, NotNil)
+	c.Assert(gotApp.MaintenanceEndedAt, NotNil)
+	c.Assert(gotApp.MaintenanceEndedAt.Before(*gotApp.MaintenanceStartedAt), Equals, false)
+
+	_, err = s.Get("/apps/"+app.ID+"/routes", &routes)
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 2)
+	for _, r := range routes {
+		c.Assert(r.HTTPRoute().Maintenance, Equals, false)
+	}
+}
+
+func (s *S) TestUpdateAppVersion(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "update-app-version"})
+	c.Assert(app.Version, Equals, int64(1))
+
+	gotApp := &ct.App{}
+	res, err := s.Post("/apps/"+app.ID, map[string]interface{}{"protected": true, "version": app.Version}, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(gotApp.Version, Equals, int64(2))
+
+	// a second update based on the original version is rejected
+	res, _ = s.Post("/apps/"+app.ID, map[string]interface{}{"protected": false, "version": app.Version}, &ct.App{})
+	c.Assert(res.StatusCode, Equals, 409)
+	res, err = s.Get("/apps/"+app.ID, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Protected, Equals, true)
+
+	// updates without a version are not checked
+	res, err = s.Post("/apps/"+app.ID, map[string]interface{}{"protected": false}, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(gotApp.Version, Equals, int64(3))
+
+	release := s.createTestRelease(c, &ct.Release{})
+	c.Assert(release.Version, Equals, int64(1))
+	s.setAppRelease(c, app.ID, release.ID)
+	_, err = s.Get("/apps/"+app.ID, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Version, Equals, int64(4))
 }
 
 func (s *S) TestDeleteApp(c *C) {
@@ -240,6 +354,160 @@ func (s *S) TestDeleteApp(c *C) {
 	}
 }
 
+func (s *S) TestDeleteAppForce(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "delete-app-force"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+	route := s.createTestRoute(c, app.ID, (&router.TCPRoute{Service: "delete-app-force"}).ToRoute())
+	cronJob := &ct.CronJob{}
+	_, err := s.Post("/apps/"+app.ID+"/cron_jobs", &ct.CronJob{Schedule: "@hourly", ProcessType: "web"}, cronJob)
+	c.Assert(err, IsNil)
+
+	// the app is not deleted while it has dependent objects
+	res, err := s.Delete("/apps/" + app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+	var e ct.ValidationError
+	c.Assert(json.NewDecoder(res.Body).Decode(&e), IsNil)
+	res.Body.Close()
+	c.Assert(strings.Contains(e.Message, route.ID), Equals, true)
+	c.Assert(strings.Contains(e.Message, release.ID), Equals, true)
+	c.Assert(strings.Contains(e.Message, cronJob.ID), Equals, true)
+
+	res, err = s.Delete("/apps/" + app.ID + "?force=true")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, _ = s.Get("/apps/"+app.ID, &ct.App{})
+	c.Assert(res.StatusCode, Equals, 404)
+	s.m.Invoke(func(rc routerc.Client) {
+		_, err := rc.GetRoute(route.ID)
+		c.Assert(err, Equals, routerc.ErrNotFound)
+	})
+	var events []*ct.Event
+	_, err = s.Get("/events?app_id="+app.ID, &events)
+	c.Assert(err, IsNil)
+	types := make(map[string]int)
+	for _, e := range events {
+		types[e.ObjectType]++
+	}
+	c.Assert(types[ct.EventTypeAppDeletion], Equals, 1)
+	c.Assert(types[ct.EventTypeRouteDeletion], Equals, 1)
+	c.Assert(types[ct.EventTypeCronJobDeletion], Equals, 1)
+}
+
+func (s *S) TestUndeleteApp(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "undelete-app"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}})
+	s.setAppRelease(c, app.ID, release.ID)
+	route := s.createTestRoute(c, app.ID, (&router.TCPRoute{Service: "undelete-app"}).ToRoute())
+	cronJob := &ct.CronJob{}
+	_, err := s.Post("/apps/"+app.ID+"/cron_jobs", &ct.CronJob{Schedule: "@hourly", ProcessType: "web"}, cronJob)
+	c.Assert(err, IsNil)
+
+	res, err := s.Delete("/apps/" + app.ID + "?force=true")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	// the name cannot be restored while another app has it
+	other := s.createTestApp(c, &ct.App{Name: "undelete-app"})
+	res, _ = s.Post("/apps/"+app.Name+"/undelete", nil, &ct.App{})
+	c.Assert(res.StatusCode, Equals, 400)
+	_, err = s.Delete("/apps/" + other.ID)
+	c.Assert(err, IsNil)
+
+	// the most recently deleted app with the name is restored
+	restored := &ct.App{}
+	_, err = s.Post("/apps/"+app.ID+"/undelete", nil, restored)
+	c.Assert(err, IsNil)
+	c.Assert(restored.ID, Equals, app.ID)
+	formation := &ct.Formation{}
+	_, err = s.Get(formationPath(app.ID, release.ID), formation)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+	current := &ct.Release{}
+	_, err = s.Get("/apps/"+app.ID+"/release", current)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release.ID)
+	_, err = s.Get("/apps/"+app.ID+"/cron_jobs/"+cronJob.ID, &ct.CronJob{})
+	c.Assert(err, IsNil)
+	s.m.Invoke(func(rc routerc.Client) {
+		_, err := rc.GetRoute(route.ID)
+		c.Assert(err, IsNil)
+	})
+
+	// the app is only restored once
+	res, _ = s.Post("/apps/"+app.ID+"/undelete", nil, &ct.App{})
+	c.Assert(res.StatusCode, Equals, 404)
+
+	// apps deleted longer ago than the retention window can't be restored,
+	// and their tombstones are purged
+	_, err = s.Delete("/apps/" + app.ID + "?force=true")
+	c.Assert(err, IsNil)
+	s.m.Invoke(func(apps *AppRepo) {
+		apps.retention = 0
+		defer func() { apps.retention = defaultAppRetention }()
+		res, _ = s.Post("/apps/"+app.ID+"/undelete", nil, &ct.App{})
+		c.Assert(res.StatusCode, Equals, 400)
+		n, err := apps.PurgeTombstones(func(*ct.Resource) error { return nil })
+		c.Assert(err, IsNil)
+		c.Assert(n >= 1, Equals, true)
+	})
+	res, _ = s.Post("/apps/"+app.ID+"/undelete", nil, &ct.App{})
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestPurgeTombstoneDeprovisionsResources(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "purge-tombstone"})
+	other := s.createTestApp(c, &ct.App{Name: "purge-tombstone-other"})
+	orphaned, _ := s.provisionTestResource(c, "purge-tombstone", []string{app.ID})
+	shared, _ := s.provisionTestResource(c, "purge-tombstone-shared", []string{app.ID, other.ID})
+
+	res, err := s.Delete("/apps/" + app.ID + "?force=true")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	s.m.Invoke(func(apps *AppRepo) {
+		apps.retention = 0
+		defer func() { apps.retention = defaultAppRetention }()
+
+		var deprovisioned []string
+		purge := func(fail bool) error {
+			deprovisioned = nil
+			_, err := apps.PurgeTombstones(func(r *ct.Resource) error {
+				// ignore the apps deleted by other tests
+				if r.ID != orphaned.ID && r.ID != shared.ID {
+					return nil
+				}
+				deprovisioned = append(deprovisioned, r.ExternalID)
+				if fail {
+					return errors.New("deprovision failed")
+				}
+				return nil
+			})
+			return err
+		}
+
+		// the tombstone is kept if the provider fails to deprovision the
+		// resource, so that it is retried
+		c.Assert(purge(true), NotNil)
+		c.Assert(deprovisioned, DeepEquals, []string{orphaned.ExternalID})
+
+		// the resource still used by another app is not deprovisioned
+		c.Assert(purge(false), IsNil)
+		c.Assert(deprovisioned, DeepEquals, []string{orphaned.ExternalID})
+
+		// the resource is only deprovisioned once
+		c.Assert(purge(false), IsNil)
+		c.Assert(deprovisioned, HasLen, 0)
+	})
+
+	out := &ct.Resource{}
+	_, err = s.Get(fmt.Sprintf("/providers/%s/resources/%s", shared.ProviderID, shared.ID), out)
+	c.Assert(err, IsNil)
+	c.Assert(out.Apps, DeepEquals, []string{other.ID})
+}
+
 func (s *S) TestRecreateApp(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "recreate-app"})
 
@@ -265,21 +533,50 @@ func (s *S) TestProtectedApp(c *C) {
 		Processes: map[string]ct.ProcessType{"web": {}, "worker": {}},
 	})
 
+	// process types with jobs are only scaled to zero with force, the
+	// first formation scales nothing down so may leave types at zero
 	path := formationPath(app.ID, release.ID)
 	for _, t := range []struct {
 		procs  map[string]int
+		force  bool
 		status int
 	}{
-		{nil, 400},
-		{map[string]int{"web": 1}, 400},
-		{map[string]int{"worker": 1, "web": 0}, 400},
-		{map[string]int{"worker": 1, "web": 1}, 200},
+		{map[string]int{"web": 0, "worker": 0}, false, 200},
+		{map[string]int{"web": 1}, false, 200},
+		{map[string]int{"worker": 1, "web": 1}, false, 200},
+		{map[string]int{"web": 2, "worker": 0}, false, 400},
+		{map[string]int{"web": 0, "worker": 1}, false, 400},
+		{map[string]int{"web": 0, "worker": 1}, true, 200},
+		{map[string]int{"web": 0, "worker": 2}, false, 200},
+		{nil, false, 400},
 	} {
-		res, err := s.Put(path, &ct.Formation{Processes: t.procs}, nil)
+		p := path
+		if t.force {
+			p += "?force=true"
+		}
+		res, err := s.Put(p, &ct.Formation{Processes: t.procs}, nil)
 		c.Assert(err, IsNil)
 		res.Body.Close()
-		c.Assert(res.StatusCode, Equals, t.status)
+		c.Assert(res.StatusCode, Equals, t.status, Commentf("%v force=%t", t.procs, t.force))
 	}
+	res, err := s.Delete(path)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	// protected apps are only deleted with force
+	res, err = s.Delete("/apps/" + app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+	var e ct.ValidationError
+	c.Assert(json.NewDecoder(res.Body).Decode(&e), IsNil)
+	res.Body.Close()
+	c.Assert(e.Field, Equals, "protected")
+	res, err = s.Delete(path + "?force=true")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Delete("/apps/" + app.ID + "?force=true")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
 }
 
 func (s *S) createTestArtifact(c *C, in *ct.Artifact) *ct.Artifact {
@@ -317,7 +614,7 @@ func (s *S) TestCreateArtifact(c *C) {
 }
 
 func (s *S) createTestRelease(c *C, in *ct.Release) *ct.Release {
-	if in.ArtifactID == "" {
+	if in.ArtifactID == "" && len(in.ArtifactIDs) == 0 {
 		in.ArtifactID = s.createTestArtifact(c, &ct.Artifact{}).ID
 	}
 	out := &ct.Release{}
@@ -354,6 +651,151 @@ func (s *S) TestCreateRelease(c *C) {
 	}
 }
 
+func (s *S) TestReleaseArtifacts(c *C) {
+	base := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "https://example.com/base"})
+	slug := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "https://example.com/slug"})
+	sidecar := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "https://example.com/sidecar"})
+
+	release := s.createTestRelease(c, &ct.Release{
+		ArtifactIDs: []string{base.ID, slug.ID, sidecar.ID},
+		Processes: map[string]ct.ProcessType{
+			"web":    {},
+			"worker": {Artifacts: []string{sidecar.ID, base.ID}},
+		},
+	})
+	c.Assert(release.ArtifactID, Equals, base.ID)
+	c.Assert(release.ArtifactIDs, DeepEquals, []string{base.ID, slug.ID, sidecar.ID})
+	got := &ct.Release{}
+	_, err := s.Get("/releases/"+release.ID, got)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, release)
+
+	app := s.createTestApp(c, &ct.App{Name: "release-artifacts"})
+	s.setAppRelease(c, app.ID, release.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID})
+	var f *ct.ExpandedFormation
+	s.m.Invoke(func(repo *FormationRepo) {
+		formation, err := repo.Get(app.ID, release.ID)
+		c.Assert(err, IsNil)
+		f, err = repo.expandFormation(formation)
+		c.Assert(err, IsNil)
+	})
+	c.Assert(f.Artifact.ID, Equals, base.ID)
+	c.Assert(f.Artifacts, HasLen, 3)
+
+	web := utils.JobConfig(f, "web")
+	c.Assert(web.Artifact.URI, Equals, base.URI)
+	c.Assert(web.Artifacts, DeepEquals, []host.Artifact{{Type: "docker", URI: slug.URI}, {Type: "docker", URI: sidecar.URI}})
+	worker := utils.JobConfig(f, "worker")
+	c.Assert(worker.Artifact.URI, Equals, sidecar.URI)
+	c.Assert(worker.Artifacts, DeepEquals, []host.Artifact{{Type: "docker", URI: base.URI}})
+
+	// artifacts used by a release can't be deleted
+	res, err := s.Delete("/artifacts/" + slug.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	// the first artifact must be the release artifact
+	res, _ = s.Post("/releases", &ct.Release{ArtifactID: slug.ID, ArtifactIDs: []string{base.ID, slug.ID}}, &ct.Release{})
+	c.Assert(res.StatusCode, Equals, 400)
+	// process types can only select artifacts of the release
+	res, _ = s.Post("/releases", &ct.Release{
+		ArtifactIDs: []string{base.ID},
+		Processes:   map[string]ct.ProcessType{"web": {Artifacts: []string{slug.ID}}},
+	}, &ct.Release{})
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestCreateAppComplete(c *C) {
+	in := &ct.AppComplete{
+		App:       &ct.App{Name: "app-complete"},
+		Artifact:  &ct.Artifact{Type: "docker", URI: "docker://app-complete"},
+		Release:   &ct.Release{Env: map[string]string{"FOO": "BAR"}},
+		Formation: &ct.Formation{Processes: map[string]int{"web": 1}},
+	}
+	out := &ct.AppComplete{}
+	res, err := s.Post("/app_complete", in, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(out.App.ID, Not(Equals), "")
+	c.Assert(out.Release.ArtifactID, Equals, out.Artifact.ID)
+	c.Assert(out.Formation.AppID, Equals, out.App.ID)
+	c.Assert(out.Formation.ReleaseID, Equals, out.Release.ID)
+
+	release := &ct.Release{}
+	res, err = s.Get("/apps/"+out.App.ID+"/release", release)
+	c.Assert(err, IsNil)
+	c.Assert(release.ID, Equals, out.Release.ID)
+
+	// a failure part way through should not leave the app behind
+	in = &ct.AppComplete{
+		App:     &ct.App{Name: "app-complete-fail"},
+		Release: &ct.Release{ArtifactID: random.UUID()},
+	}
+	res, err = s.Post("/app_complete", in, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Not(Equals), 200)
+	res, err = s.Get("/apps/app-complete-fail", &ct.App{})
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestDeleteRelease(c *C) {
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://delete-release"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	app := s.createTestApp(c, &ct.App{Name: "delete-release"})
+	s.setAppRelease(c, app.ID, release.ID)
+
+	res, err := s.Delete("/artifacts/" + artifact.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	res, err = s.Delete("/releases/" + release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	s.setAppRelease(c, app.ID, s.createTestRelease(c, &ct.Release{}).ID)
+	res, err = s.Delete("/releases/" + release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Get("/releases/"+release.ID, &ct.Release{})
+	c.Assert(res.StatusCode, Equals, 404)
+
+	res, err = s.Delete("/artifacts/" + artifact.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Get("/artifacts/"+artifact.ID, &ct.Artifact{})
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestDeleteReleaseCascade(c *C) {
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://delete-release-cascade"})
+	release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	other := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+	app := s.createTestApp(c, &ct.App{Name: "delete-release-cascade"})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+
+	// the formation depends on the release
+	res, err := s.Delete("/releases/" + release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	res, err = s.Delete("/releases/" + release.ID + "?cascade=true")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Get(formationPath(app.ID, release.ID), &ct.Formation{})
+	c.Assert(res.StatusCode, Equals, 404)
+
+	// the artifact is still used by the other release
+	res, err = s.Get("/artifacts/"+artifact.ID, &ct.Artifact{})
+	c.Assert(res.StatusCode, Equals, 200)
+
+	res, err = s.Delete("/releases/" + other.ID + "?cascade=true")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Get("/artifacts/"+artifact.ID, &ct.Artifact{})
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
 func (s *S) TestCreateFormation(c *C) {
 	for i, useName := range []bool{false, true} {
 		release := s.createTestRelease(c, &ct.Release{})
@@ -385,6 +827,181 @@ func (s *S) TestCreateFormation(c *C) {
 	}
 }
 
+func (s *S) TestFormationStateHash(c *C) {
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	app := s.createTestApp(c, &ct.App{Name: "formation-state-hash"})
+	path := formationPath(app.ID, release.ID)
+
+	// a formation which does not exist has the hash of an empty formation
+	res, err := s.Put(path, &ct.Formation{Processes: map[string]int{"web": 1}, StateHash: "foo"}, &ct.Formation{})
+	c.Assert(res.StatusCode, Equals, 409)
+	first := &ct.Formation{}
+	res, err = s.Put(path, &ct.Formation{Processes: map[string]int{"web": 1}, StateHash: ct.FormationStateHash(nil, nil)}, first)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(first.StateHash, Equals, ct.FormationStateHash(map[string]int{"web": 1}, nil))
+
+	// two updates based on the same state only succeed once
+	got := &ct.Formation{}
+	_, err = s.Get(path, got)
+	c.Assert(err, IsNil)
+	c.Assert(got.StateHash, Equals, first.StateHash)
+	res, err = s.Put(path, &ct.Formation{Processes: map[string]int{"web": 2}, StateHash: got.StateHash}, &ct.Formation{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Put(path, &ct.Formation{Processes: map[string]int{"web": 3}, StateHash: got.StateHash}, &ct.Formation{})
+	c.Assert(res.StatusCode, Equals, 409)
+	_, err = s.Get(path, got)
+	c.Assert(err, IsNil)
+	c.Assert(got.Processes, DeepEquals, map[string]int{"web": 2})
+
+	// updates without a state hash are unconditional
+	res, err = s.Put(path, &ct.Formation{Processes: map[string]int{"web": 4}}, &ct.Formation{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+}
+
+func (s *S) TestFormationConstraints(c *C) {
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"db": {}, "web": {}}})
+	app := s.createTestApp(c, &ct.App{Name: "formation-constraints"})
+	path := formationPath(app.ID, release.ID)
+
+	for _, t := range []struct {
+		constraints map[string]ct.PlacementConstraints
+		field       string
+	}{
+		{map[string]ct.PlacementConstraints{"worker": {SpreadBy: "zone"}}, "constraints.worker"},
+		{map[string]ct.PlacementConstraints{"db": {HostTags: map[string]string{"": "ssd"}}}, "constraints.db.host_tags"},
+		{map[string]ct.PlacementConstraints{"db": {HostTags: map[string]string{ct.HostVolumesMetadata: "pg"}}}, "constraints.db.host_tags.volumes"},
+		{map[string]ct.PlacementConstraints{"db": {Volumes: []string{"pg,backups"}}}, "constraints.db.volumes"},
+	} {
+		res, err := s.Put(path, &ct.Formation{Processes: map[string]int{"web": 1}, Constraints: t.constraints}, nil)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+		var e ct.ValidationError
+		c.Assert(json.NewDecoder(res.Body).Decode(&e), IsNil)
+		res.Body.Close()
+		c.Assert(e.Field, Equals, t.field)
+	}
+
+	constraints := map[string]ct.PlacementConstraints{
+		"db":  {HostTags: map[string]string{"disk": "ssd"}, Volumes: []string{"pg"}},
+		"web": {SpreadBy: "zone"},
+	}
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"db": 1, "web": 2}, Constraints: constraints})
+	got := &ct.Formation{}
+	_, err := s.Get(path, got)
+	c.Assert(err, IsNil)
+	c.Assert(got.Constraints, DeepEquals, constraints)
+
+	// the constraints are kept when the app's processes move to a new release
+	newRelease := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"db": {}, "web": {}}})
+	_, err = s.Put("/apps/"+app.ID+"/release", &ct.Release{ID: newRelease.ID}, &ct.Release{})
+	c.Assert(err, IsNil)
+	_, err = s.Get(formationPath(app.ID, newRelease.ID), got)
+	c.Assert(err, IsNil)
+	c.Assert(got.Constraints, DeepEquals, constraints)
+}
+
+func (s *S) TestFormationLimits(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "formation-limits"})
+	release := &ct.Release{Processes: map[string]ct.ProcessType{
+		"web": {ResourceLimits: ct.ResourceLimits{CPU: 1}},
+	}}
+	res, _ := s.Post("/releases", release, &ct.Release{})
+	c.Assert(res.StatusCode, Equals, 400)
+
+	release = s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{
+		"web":    {ResourceLimits: ct.ResourceLimits{Memory: 512, CPU: 512}},
+		"worker": {},
+	}})
+	path := formationPath(app.ID, release.ID)
+
+	res, _ = s.Put(path, &ct.Formation{Limits: map[string]ct.ResourceLimits{"clock": {Memory: 64}}}, &ct.Formation{})
+	c.Assert(res.StatusCode, Equals, 400)
+	res, _ = s.Put(path, &ct.Formation{Limits: map[string]ct.ResourceLimits{"web": {MaxFD: -1}}}, &ct.Formation{})
+	c.Assert(res.StatusCode, Equals, 400)
+
+	res, _ = s.Put(path, &ct.Formation{Limits: map[string]ct.ResourceLimits{"web": {Disk: 1}}}, &ct.Formation{})
+	c.Assert(res.StatusCode, Equals, 400)
+	res, _ = s.Put(path, &ct.Formation{Limits: map[string]ct.ResourceLimits{"web": {MaxProcs: 8}}}, &ct.Formation{})
+	c.Assert(res.StatusCode, Equals, 400)
+
+	limits := map[string]ct.ResourceLimits{"web": {Memory: 1024, MaxFD: 4096, MaxProcs: 256, MaxCore: 64, Disk: 512, NetworkEgress: 100}}
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}, Limits: limits})
+	f := &ct.Formation{}
+	_, err := s.Get(path, f)
+	c.Assert(err, IsNil)
+	c.Assert(f.Limits, DeepEquals, limits)
+
+	// the formation's limits override the release's
+	var job *host.Job
+	s.m.Invoke(func(repo *FormationRepo) {
+		ef, err := repo.Get(app.ID, release.ID)
+		c.Assert(err, IsNil)
+		expanded, err := repo.expandFormation(ef)
+		c.Assert(err, IsNil)
+		job = utils.JobConfig(expanded, "web")
+	})
+	c.Assert(job.Resources, DeepEquals, host.JobResources{Memory: 1024 * 1024, CPUShares: 512, MaxFD: 4096, MaxProcs: 256, MaxCore: 64 << 20, Disk: 512 << 20, EgressRate: 100000000})
+}
+
+func (s *S) TestAppEnv(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-env"})
+
+	env := &ct.AppEnv{}
+	_, err := s.Get("/apps/"+app.ID+"/env", env)
+	c.Assert(err, IsNil)
+	c.Assert(env.Env, DeepEquals, map[string]string{})
+
+	res, _ := s.Post("/apps/"+app.ID+"/env", &ct.EnvUpdate{Set: map[string]string{"A": "1"}, NewRelease: true}, env)
+	c.Assert(res.StatusCode, Equals, 400)
+
+	release := s.createTestRelease(c, &ct.Release{
+		Env:       map[string]string{"A": "0", "B": "2"},
+		Processes: map[string]ct.ProcessType{"web": {Env: map[string]string{"A": "web", "C": "web"}}},
+	})
+	s.setAppRelease(c, app.ID, release.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+
+	_, err = s.Post("/apps/"+app.ID+"/env", &ct.EnvUpdate{Set: map[string]string{"A": "1", "D": "4"}}, env)
+	c.Assert(err, IsNil)
+	c.Assert(env.Env, DeepEquals, map[string]string{"A": "1", "D": "4"})
+	c.Assert(env.ReleaseID, Equals, "")
+
+	// the app env is merged over the release and process type env
+	var job *host.Job
+	s.m.Invoke(func(repo *FormationRepo) {
+		f, err := repo.Get(app.ID, release.ID)
+		c.Assert(err, IsNil)
+		expanded, err := repo.expandFormation(f)
+		c.Assert(err, IsNil)
+		job = utils.JobConfig(expanded, "web")
+	})
+	c.Assert(job.Config.Env["A"], Equals, "1")
+	c.Assert(job.Config.Env["B"], Equals, "2")
+	c.Assert(job.Config.Env["C"], Equals, "web")
+	c.Assert(job.Config.Env["D"], Equals, "4")
+
+	// a new release restarts the formation with the new env
+	env = &ct.AppEnv{}
+	_, err = s.Post("/apps/"+app.ID+"/env", &ct.EnvUpdate{Unset: []string{"D"}, NewRelease: true}, env)
+	c.Assert(err, IsNil)
+	c.Assert(env.Env, DeepEquals, map[string]string{"A": "1"})
+	c.Assert(env.ReleaseID, Not(Equals), "")
+	c.Assert(env.ReleaseID, Not(Equals), release.ID)
+
+	current := &ct.Release{}
+	_, err = s.Get("/apps/"+app.ID+"/release", current)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, env.ReleaseID)
+	c.Assert(current.Env, DeepEquals, release.Env)
+	f := &ct.Formation{}
+	_, err = s.Get(formationPath(app.ID, current.ID), f)
+	c.Assert(err, IsNil)
+	c.Assert(f.Processes, DeepEquals, map[string]int{"web": 1})
+}
+
 func (s *S) createTestFormation(c *C, formation *ct.Formation) *ct.Formation {
 	path := formationPath(formation.AppID, formation.ReleaseID)
 	formation.AppID = ""
@@ -421,6 +1038,50 @@ func (s *S) TestDeleteFormation(c *C) {
 	}
 }
 
+func (s *S) TestUpdateFormations(c *C) {
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}, "worker": {}}})
+	app := s.createTestApp(c, &ct.App{Name: "update-formations"})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2, "worker": 1}})
+	protected := s.createTestApp(c, &ct.App{Name: "update-formations-protected", Protected: true})
+	s.createTestFormation(c, &ct.Formation{AppID: protected.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+
+	// nothing is updated if any formation of the batch is invalid
+	for _, batch := range [][]*ct.FormationScale{
+		{{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 0}}, {AppID: "update-formations-missing", ReleaseID: release.ID, Processes: map[string]int{}}},
+		{{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{}}, {AppID: app.Name, ReleaseID: release.ID, Processes: map[string]int{}}},
+		{{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"missing": 1}}},
+		{{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 0}}, {AppID: protected.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 0}}},
+	} {
+		res, err := s.Put("/formations", &ct.FormationBatch{Formations: batch}, nil)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+	f := &ct.Formation{}
+	_, err := s.Get(formationPath(app.ID, release.ID), f)
+	c.Assert(err, IsNil)
+	c.Assert(f.Processes, DeepEquals, map[string]int{"web": 2, "worker": 1})
+
+	// process types which are left out keep their counts
+	var formations []*ct.Formation
+	res, err := s.Put("/formations?force=true", &ct.FormationBatch{Formations: []*ct.FormationScale{
+		{AppID: app.Name, ReleaseID: release.ID, Processes: map[string]int{"web": 0}},
+		{AppID: protected.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 0}},
+	}}, &formations)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(formations, HasLen, 2)
+	c.Assert(formations[0].AppID, Equals, app.ID)
+	f = &ct.Formation{}
+	_, err = s.Get(formationPath(app.ID, release.ID), f)
+	c.Assert(err, IsNil)
+	c.Assert(f.Processes, DeepEquals, map[string]int{"worker": 1})
+	f = &ct.Formation{}
+	_, err = s.Get(formationPath(protected.ID, release.ID), f)
+	c.Assert(err, IsNil)
+	c.Assert(f.Processes, DeepEquals, map[string]int{})
+}
+
 func (s *S) TestCreateKey(c *C) {
 	in := &ct.Key{Key: "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC5r1JfsAYIFi86KBa7C5nqKo+BLMJk29+5GsjelgBnCmn4J/QxOrVtovNcntoRLUCRwoHEMHzs3Tc6+PdswIxpX1l3YC78kgdJe6LVb962xUgP6xuxauBNRO7tnh9aPGyLbjl9j7qZAcn2/ansG1GBVoX1GSB58iBsVDH18DdVzlGwrR4OeNLmRQj8kuJEuKOoKEkW55CektcXjV08K3QSQID7aRNHgDpGGgp6XDi0GhIMsuDUGHAdPGZnqYZlxuUFaCW2hK6i1UkwnQCCEv/9IUFl2/aqVep2iX/ynrIaIsNKm16o0ooZ1gCHJEuUKRPUXhZUXqkRXqqHd3a4CUhH jonathan@titanous.com"}
 	out := s.createTestKey(c, in)
@@ -497,6 +1158,78 @@ func (s *S) TestAppList(c *C) {
 	c.Assert(list[0].ID, Not(Equals), "")
 }
 
+func (s *S) TestAppListSelector(c *C) {
+	prod := s.createTestApp(c, &ct.App{Name: "selector-prod", Labels: map[string]string{"env": "production", "team": "payments"}})
+	staging := s.createTestApp(c, &ct.App{Name: "selector-staging", Labels: map[string]string{"env": "staging", "team": "payments"}})
+	s.createTestApp(c, &ct.App{Name: "selector-none"})
+
+	for _, t := range []struct {
+		selector string
+		expected []string
+	}{
+		{"env=production,team=payments", []string{prod.ID}},
+		{"team=payments,env!=production", []string{staging.ID}},
+		{"team", []string{staging.ID, prod.ID}},
+		{"team=search", []string{}},
+	} {
+		var list []*ct.App
+		res, err := s.Get("/apps?selector="+url.QueryEscape(t.selector), &list)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 200)
+		ids := make([]string, 0, len(list))
+		for _, app := range list {
+			if strings.HasPrefix(app.Name, "selector-") {
+				ids = append(ids, app.ID)
+			}
+		}
+		c.Assert(ids, DeepEquals, t.expected, Commentf("selector %q", t.selector))
+	}
+
+	var list []*ct.App
+	res, err := s.Get("/apps?selector=!selector-none", &list)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, err = s.Get("/apps?selector="+url.QueryEscape("env=a b"), &list)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestListSortFilter(c *C) {
+	b := s.createTestApp(c, &ct.App{Name: "sort-filter-b"})
+	a := s.createTestApp(c, &ct.App{Name: "sort-filter-a"})
+	s.createTestApp(c, &ct.App{Name: "sort-filter_c"})
+
+	var list []*ct.App
+	_, err := s.Get("/apps?name_prefix=sort-filter-&sort=name", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].ID, Equals, a.ID)
+	c.Assert(list[1].ID, Equals, b.ID)
+
+	_, err = s.Get("/apps?name_prefix=sort-filter-&sort=name&direction=desc", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].ID, Equals, b.ID)
+
+	_, err = s.Get("/apps?name_prefix=sort-filter&created_after="+url.QueryEscape(b.CreatedAt.Format(time.RFC3339Nano)), &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[1].ID, Equals, a.ID)
+
+	artifact := s.createTestArtifact(c, &ct.Artifact{})
+	var artifacts []*ct.Artifact
+	_, err = s.Get("/artifacts?created_after="+url.QueryEscape(artifact.CreatedAt.Add(-time.Millisecond).Format(time.RFC3339Nano)), &artifacts)
+	c.Assert(err, IsNil)
+	c.Assert(artifacts, HasLen, 1)
+	c.Assert(artifacts[0].ID, Equals, artifact.ID)
+
+	res, _ := s.Get("/apps?sort=protected", &list)
+	c.Assert(res.StatusCode, Equals, 400)
+	res, _ = s.Get("/releases?sort=created_at&direction=up", &[]*ct.Release{})
+	c.Assert(res.StatusCode, Equals, 400)
+	res, _ = s.Get("/releases?created_after=yesterday", &[]*ct.Release{})
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
 func (s *S) TestReleaseList(c *C) {
 	s.createTestRelease(c, &ct.Release{})
 
@@ -509,6 +1242,78 @@ func (s *S) TestReleaseList(c *C) {
 	c.Assert(list[0].ID, Not(Equals), "")
 }
 
+func (s *S) TestAppReleaseList(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-release-list"})
+	meta := map[string]string{ct.ReleaseMetaGitCommit: "f1d2d2f924e986ac86fdf7b36c94bcdf32beec15", "note": "hotfix"}
+	first := s.createTestRelease(c, &ct.Release{Meta: meta})
+	s.setAppRelease(c, app.ID, first.ID)
+	second := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: second.ID})
+	s.createTestRelease(c, &ct.Release{})
+
+	var list []*ct.Release
+	res, err := s.Get("/apps/"+app.ID+"/releases", &list)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].ID, Equals, second.ID)
+	c.Assert(list[1].ID, Equals, first.ID)
+	c.Assert(list[1].Meta, DeepEquals, meta)
+}
+
+func (s *S) TestReleaseDiff(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "release-diff"})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://release-diff"})
+	from := s.createTestRelease(c, &ct.Release{
+		ArtifactID: artifact.ID,
+		Env:        map[string]string{"KEEP": "1", "REMOVE": "2", "CHANGE": "3"},
+		Processes: map[string]ct.ProcessType{
+			"web":    {Cmd: []string{"start", "web"}},
+			"worker": {Cmd: []string{"start", "worker"}},
+			"clock":  {Cmd: []string{"start", "clock"}},
+		},
+	})
+	to := s.createTestRelease(c, &ct.Release{
+		ArtifactID: artifact.ID,
+		Env:        map[string]string{"KEEP": "1", "CHANGE": "4", "ADD": "5"},
+		Processes: map[string]ct.ProcessType{
+			"web":    {Cmd: []string{"start", "web"}, Env: map[string]string{"PORT": "80"}},
+			"worker": {Cmd: []string{"start", "worker"}},
+			"admin":  {Cmd: []string{"start", "admin"}},
+		},
+	})
+
+	path := fmt.Sprintf("/apps/%s/releases/%s/diff/%s", app.ID, from.ID, to.ID)
+	diff := &ct.ReleaseDiff{}
+	_, err := s.Get(path, diff)
+	c.Assert(err, IsNil)
+	c.Assert(diff.From, Equals, from.ID)
+	c.Assert(diff.To, Equals, to.ID)
+	c.Assert(diff.ArtifactsChanged, Equals, false)
+	c.Assert(diff.Env, DeepEquals, []*ct.EnvChange{
+		{Key: "ADD", Op: ct.DiffAdded, NewValue: "5"},
+		{Key: "CHANGE", Op: ct.DiffChanged, OldValue: "3", NewValue: "4"},
+		{Key: "REMOVE", Op: ct.DiffRemoved, OldValue: "2"},
+	})
+	c.Assert(diff.Processes, DeepEquals, []*ct.ProcessChange{
+		{Type: "admin", Op: ct.DiffAdded},
+		{Type: "clock", Op: ct.DiffRemoved},
+		{Type: "web", Op: ct.DiffChanged, Fields: []string{"env"}},
+	})
+
+	diff = &ct.ReleaseDiff{}
+	_, err = s.Get(path+"?redact=true", diff)
+	c.Assert(err, IsNil)
+	c.Assert(diff.Env, DeepEquals, []*ct.EnvChange{
+		{Key: "ADD", Op: ct.DiffAdded},
+		{Key: "CHANGE", Op: ct.DiffChanged},
+		{Key: "REMOVE", Op: ct.DiffRemoved},
+	})
+
+	res, err := s.Get(fmt.Sprintf("/apps/%s/releases/%s/diff/%s", app.ID, from.ID, random.UUID()), diff)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
 func (s *S) TestKeyList(c *C) {
 	s.createTestKey(c, &ct.Key{Key: "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQCqE9AJti/17eigkIhA7+6TF9rdTVxjPv80UxIT6ELaNPHegqib5m94Wab4UoZAGtBPLKJs9o8LRO3H29X5q5eXCU5mwx4qQhcMEYkILWj0Y1T39Xi2RI3jiWcTsphAAYmy+uT2Nt740OK1FaQxfdzYx4cjsjtb8L82e35BkJE2TdjXWkeHxZWDZxMlZXme56jTNsqB2OuC0gfbAbrjSCkolvK1RJbBZSSBgKQrYXiyYjjLfcw2O0ZAKPBeS8ckVf6PO8s/+azZzJZ0Kl7YGHYEX3xRi6sJS0gsI4Y6+sddT1zT5kh0Bg3C8cKnZ1NiVXLH0pPKz68PhjWhwpOVUehD"})
 
@@ -530,6 +1335,31 @@ func (s *S) TestKeyList(c *C) {
 	c.Assert(list, HasLen, 0)
 }
 
+func (s *S) TestArtifactChecksum(c *C) {
+	sum := strings.Repeat("a", 64)
+	out := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "https://example.com/checksum?id=" + sum, Size: 1024})
+	c.Assert(out.SHA256, Equals, sum)
+	c.Assert(out.Size, Equals, int64(1024))
+
+	// creating the same artifact with a different checksum fails
+	res, _ := s.Post("/artifacts", &ct.Artifact{Type: "docker", URI: out.URI, SHA256: strings.Repeat("b", 64)}, &ct.Artifact{})
+	c.Assert(res.StatusCode, Equals, 400)
+
+	// a missing checksum is filled in
+	in := &ct.Artifact{Type: "docker", URI: "https://example.com/checksum"}
+	first := s.createTestArtifact(c, in)
+	c.Assert(first.SHA256, Equals, "")
+	in.SHA256 = sum
+	second := s.createTestArtifact(c, in)
+	c.Assert(second.ID, Equals, first.ID)
+	c.Assert(second.SHA256, Equals, sum)
+
+	res, _ = s.Post("/artifacts", &ct.Artifact{Type: "docker", URI: "https://example.com/invalid", SHA256: "abc"}, &ct.Artifact{})
+	c.Assert(res.StatusCode, Equals, 400)
+	res, _ = s.Post("/artifacts", &ct.Artifact{Type: "docker", URI: "https://example.com/invalid", Size: -1}, &ct.Artifact{})
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
 func (s *S) TestArtifactList(c *C) {
 	s.createTestArtifact(c, &ct.Artifact{})
 
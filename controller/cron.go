@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/cron"
+)
+
+var cronConcurrencyPolicies = map[string]bool{
+	ct.CronConcurrencyAllow:   true,
+	ct.CronConcurrencyForbid:  true,
+	ct.CronConcurrencyReplace: true,
+}
+
+type CronRepo struct {
+	db *DB
+}
+
+func NewCronRepo(db *DB) *CronRepo {
+	return &CronRepo{db}
+}
+
+const cronJobColumns = "cron_job_id, app_id, schedule, process_type, cmd, concurrency_policy, last_scheduled_at, created_at"
+
+func (r *CronRepo) Add(cj *ct.CronJob) error {
+	if _, err := cron.Parse(cj.Schedule); err != nil {
+		return ct.ValidationError{Field: "schedule", Message: err.Error()}
+	}
+	if cj.ProcessType == "" && len(cj.Cmd) == 0 {
+		return ct.ValidationError{Field: "cmd", Message: "must be set if process_type is not"}
+	}
+	if cj.ConcurrencyPolicy == "" {
+		cj.ConcurrencyPolicy = ct.CronConcurrencyAllow
+	}
+	if !cronConcurrencyPolicies[cj.ConcurrencyPolicy] {
+		return ct.ValidationError{Field: "concurrency_policy", Message: "must be one of allow, forbid, replace"}
+	}
+	var procType, cmd *string
+	if cj.ProcessType != "" {
+		procType = &cj.ProcessType
+	}
+	if len(cj.Cmd) > 0 {
+		data, err := json.Marshal(cj.Cmd)
+		if err != nil {
+			return err
+		}
+		s := string(data)
+		cmd = &s
+	}
+	err := r.db.QueryRow("INSERT INTO cron_jobs (app_id, schedule, process_type, cmd, concurrency_policy) VALUES ($1, $2, $3, $4, $5) RETURNING cron_job_id, created_at",
+		cj.AppID, cj.Schedule, procType, cmd, cj.ConcurrencyPolicy).Scan(&cj.ID, &cj.CreatedAt)
+	cj.ID = cleanUUID(cj.ID)
+	return err
+}
+
+func scanCronJob(s Scanner) (*ct.CronJob, error) {
+	cj := &ct.CronJob{}
+	var procType, cmd *string
+	err := s.Scan(&cj.ID, &cj.AppID, &cj.Schedule, &procType, &cmd, &cj.ConcurrencyPolicy, &cj.LastScheduledAt, &cj.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	cj.ID = cleanUUID(cj.ID)
+	cj.AppID = cleanUUID(cj.AppID)
+	if procType != nil {
+		cj.ProcessType = *procType
+	}
+	if cmd != nil {
+		if err := json.Unmarshal([]byte(*cmd), &cj.Cmd); err != nil {
+			return nil, err
+		}
+	}
+	return cj, nil
+}
+
+func (r *CronRepo) Get(id string) (*ct.CronJob, error) {
+	row := r.db.QueryRow("SELECT "+cronJobColumns+" FROM cron_jobs WHERE cron_job_id = $1 AND deleted_at IS NULL", id)
+	return scanCronJob(row)
+}
+
+// List returns the cron jobs of the app, or of all apps if appID is empty.
+func (r *CronRepo) List(appID string) ([]*ct.CronJob, error) {
+	query := "SELECT " + cronJobColumns + " FROM cron_jobs WHERE deleted_at IS NULL"
+	var args []interface{}
+	if appID != "" {
+		query += " AND app_id = $1"
+		args = append(args, appID)
+	}
+	rows, err := r.db.Query(query+" ORDER BY created_at", args...)
+	if err != nil {
+		return nil, err
+	}
+	list := []*ct.CronJob{}
+	for rows.Next() {
+		cj, err := scanCronJob(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, cj)
+	}
+	return list, rows.Err()
+}
+
+func (r *CronRepo) Remove(id string) error {
+	return r.db.Exec("UPDATE cron_jobs SET deleted_at = now() WHERE cron_job_id = $1 AND deleted_at IS NULL", id)
+}
+
+const cronJobRunColumns = "run_id, cron_job_id, scheduled_at, job_id, status, error, created_at"
+
+func scanCronJobRun(s Scanner) (*ct.CronJobRun, error) {
+	run := &ct.CronJobRun{}
+	var jobID, errMsg *string
+	err := s.Scan(&run.ID, &run.CronJobID, &run.ScheduledAt, &jobID, &run.Status, &errMsg, &run.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	run.CronJobID = cleanUUID(run.CronJobID)
+	if jobID != nil {
+		run.JobID = *jobID
+	}
+	if errMsg != nil {
+		run.Error = *errMsg
+	}
+	return run, nil
+}
+
+// ListRuns returns the runs of the cron job, most recent first.
+func (r *CronRepo) ListRuns(cronJobID string) ([]*ct.CronJobRun, error) {
+	rows, err := r.db.Query("SELECT "+cronJobRunColumns+" FROM cron_job_runs WHERE cron_job_id = $1 ORDER BY scheduled_at DESC", cronJobID)
+	if err != nil {
+		return nil, err
+	}
+	runs := []*ct.CronJobRun{}
+	for rows.Next() {
+		run, err := scanCronJobRun(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// claimRun records a pending run of the cron job scheduled at the given time
+// and advances the cron job's last_scheduled_at. Runs are unique per
+// scheduled time, so if another controller has already claimed the run, nil
+// is returned.
+func (r *CronRepo) claimRun(cj *ct.CronJob, scheduledAt time.Time) (*ct.CronJobRun, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	run := &ct.CronJobRun{CronJobID: cj.ID, ScheduledAt: &scheduledAt, Status: ct.CronRunPending}
+	err = tx.QueryRow("INSERT INTO cron_job_runs (cron_job_id, scheduled_at, status) VALUES ($1, $2, $3) RETURNING run_id, created_at",
+		run.CronJobID, scheduledAt, run.Status).Scan(&run.ID, &run.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE cron_jobs SET last_scheduled_at = $2 WHERE cron_job_id = $1", cj.ID, scheduledAt); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	cj.LastScheduledAt = &scheduledAt
+	return run, nil
+}
+
+func (r *CronRepo) finishRun(run *ct.CronJobRun) error {
+	var jobID, errMsg *string
+	if run.JobID != "" {
+		jobID = &run.JobID
+	}
+	if run.Error != "" {
+		errMsg = &run.Error
+	}
+	return r.db.Exec("UPDATE cron_job_runs SET status = $2, job_id = $3, error = $4 WHERE run_id = $1", run.ID, run.Status, jobID, errMsg)
+}
+
+// lastStartedRun returns the most recent run of the cron job which started
+// a job, or nil if there is none.
+func (r *CronRepo) lastStartedRun(cronJobID string) (*ct.CronJobRun, error) {
+	row := r.db.QueryRow("SELECT "+cronJobRunColumns+" FROM cron_job_runs WHERE cron_job_id = $1 AND status = $2 ORDER BY scheduled_at DESC LIMIT 1", cronJobID, ct.CronRunStarted)
+	run, err := scanCronJobRun(row)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return run, err
+}
+
+// lastDue returns the most recent time the schedule was due after from and
+// not after now, or the zero time if it was not due. Runs which were missed
+// while no controller was running are not made up.
+func lastDue(s *cron.Schedule, from, now time.Time) time.Time {
+	var due time.Time
+	for next := s.Next(from); !next.IsZero() && !next.After(now); next = s.Next(next) {
+		due = next
+	}
+	return due
+}
+
+// cronRunner starts the jobs of cron jobs which are due.
+type cronRunner struct {
+	repo      *CronRepo
+	apps      *AppRepo
+	artifacts *ArtifactRepo
+	cl        clusterClient
+}
+
+// Run checks for due cron jobs every interval.
+func (c *cronRunner) Run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := c.runDue(now); err != nil {
+			log.Println("cron: error running cron jobs:", err)
+		}
+	}
+}
+
+func (c *cronRunner) runDue(now time.Time) error {
+	list, err := c.repo.List("")
+	if err != nil {
+		return err
+	}
+	for _, cj := range list {
+		s, err := cron.Parse(cj.Schedule)
+		if err != nil {
+			log.Printf("cron: cron job %s has an invalid schedule: %s", cj.ID, err)
+			continue
+		}
+		from := *cj.CreatedAt
+		if cj.LastScheduledAt != nil {
+			from = *cj.LastScheduledAt
+		}
+		due := lastDue(s, from.UTC(), now.UTC())
+		if due.IsZero() {
+			continue
+		}
+		run, err := c.repo.claimRun(cj, due)
+		if err != nil {
+			log.Printf("cron: error claiming run of cron job %s: %s", cj.ID, err)
+			continue
+		}
+		if run == nil {
+			continue
+		}
+		c.start(cj, run)
+		if err := c.repo.finishRun(run); err != nil {
+			log.Printf("cron: error recording run of cron job %s: %s", cj.ID, err)
+		}
+	}
+	return nil
+}
+
+// start applies the cron job's concurrency policy and starts a job for the
+// run, recording the outcome in run.
+func (c *cronRunner) start(cj *ct.CronJob, run *ct.CronJobRun) {
+	if cj.ConcurrencyPolicy != ct.CronConcurrencyAllow {
+		prev, err := c.activeJob(cj)
+		if err != nil {
+			run.Status, run.Error = ct.CronRunFailed, err.Error()
+			return
+		}
+		if prev != "" {
+			if cj.ConcurrencyPolicy == ct.CronConcurrencyForbid {
+				run.Status, run.Error = ct.CronRunSkipped, fmt.Sprintf("job %s is still running", prev)
+				return
+			}
+			if err := c.stopJob(prev); err != nil {
+				run.Status, run.Error = ct.CronRunFailed, fmt.Sprintf("error stopping job %s: %s", prev, err)
+				return
+			}
+		}
+	}
+	jobID, err := c.launch(cj)
+	if err != nil {
+		run.Status, run.Error = ct.CronRunFailed, err.Error()
+		return
+	}
+	run.Status, run.JobID = ct.CronRunStarted, jobID
+}
+
+// activeJob returns the ID of the job started by the cron job's previous run
+// if it is still running.
+func (c *cronRunner) activeJob(cj *ct.CronJob) (string, error) {
+	prev, err := c.repo.lastStartedRun(cj.ID)
+	if err != nil || prev == nil {
+		return "", err
+	}
+	hostID, jobID, err := cluster.ParseJobID(prev.JobID)
+	if err != nil {
+		return "", nil
+	}
+	detail := &ct.JobDetail{}
+	if err := getHostJob(c.cl, hostID, jobID, detail); err != nil {
+		// the job is gone if its host is
+		return "", nil
+	}
+	switch detail.HostStatus {
+	case host.StatusStarting.String(), host.StatusRunning.String():
+		return prev.JobID, nil
+	}
+	return "", nil
+}
+
+func (c *cronRunner) stopJob(id string) error {
+	hostID, jobID, err := cluster.ParseJobID(id)
+	if err != nil {
+		return err
+	}
+	h, err := c.cl.DialHost(hostID)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	return h.StopJob(jobID)
+}
+
+// launch starts a one-off job of the app's current release for the cron job.
+func (c *cronRunner) launch(cj *ct.CronJob) (string, error) {
+	data, err := c.apps.Get(cj.AppID)
+	if err != nil {
+		return "", err
+	}
+	app := data.(*ct.App)
+	release, err := c.apps.GetRelease(app.ID)
+	if err == ErrNotFound {
+		return "", fmt.Errorf("app %s has no release", app.Name)
+	} else if err != nil {
+		return "", err
+	}
+	artifacts, err := c.artifacts.ReleaseArtifacts(release)
+	if err != nil {
+		return "", err
+	}
+	appEnv, err := c.apps.Env(app.ID)
+	if err != nil {
+		return "", err
+	}
+	drains, err := c.apps.LogDrains(app.ID)
+	if err != nil {
+		return "", err
+	}
+
+	var proc ct.ProcessType
+	if cj.ProcessType != "" {
+		var ok bool
+		if proc, ok = release.Processes[cj.ProcessType]; !ok {
+			return "", fmt.Errorf("release %s has no %s process type", release.ID, cj.ProcessType)
+		}
+	}
+	if len(cj.Cmd) > 0 {
+		proc.Cmd = cj.Cmd
+	}
+	job := newOneOffJob(app, release, utils.ProcessArtifacts(artifacts, proc), proc.Entrypoint, proc.Cmd, proc.Env, appEnv)
+	job.Metadata["flynn-controller.cron_job"] = cj.ID
+	job.LogDrains = utils.HostLogDrains(drains)
+
+	hostID, err := randomHost(c.cl)
+	if err != nil {
+		return "", err
+	}
+	if _, err := c.cl.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{hostID: {job}}}); err != nil {
+		return "", fmt.Errorf("schedule failed: %s", err)
+	}
+	return hostID + "-" + job.ID, nil
+}
+
+func createCronJob(app *ct.App, cj ct.CronJob, repo *CronRepo, r ResponseHelper) {
+	cj.AppID = app.ID
+	if err := repo.Add(&cj); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &cj)
+}
+
+func listCronJobs(app *ct.App, repo *CronRepo, r ResponseHelper) {
+	list, err := repo.List(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, list)
+}
+
+func getCronJobMiddleware(c martini.Context, app *ct.App, params martini.Params, repo *CronRepo, r ResponseHelper) {
+	cj, err := repo.Get(params["cron_jobs_id"])
+	if err == nil && cj.AppID != app.ID {
+		err = ErrNotFound
+	}
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	c.Map(cj)
+}
+
+func getCronJob(cj *ct.CronJob, r ResponseHelper) {
+	r.JSON(200, cj)
+}
+
+func deleteCronJob(cj *ct.CronJob, repo *CronRepo, r ResponseHelper) {
+	if err := repo.Remove(cj.ID); err != nil {
+		r.Error(err)
+		return
+	}
+	r.WriteHeader(200)
+}
+
+func listCronJobRuns(cj *ct.CronJob, repo *CronRepo, r ResponseHelper) {
+	runs, err := repo.ListRuns(cj.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, runs)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	tu "github.com/flynn/flynn/controller/testutils"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func (s *S) TestCronJobs(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "cron-jobs"})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/bar"})
+	release := s.createTestRelease(c, &ct.Release{
+		ArtifactID: artifact.ID,
+		Env:        map[string]string{"RELEASE": "true"},
+		Processes: map[string]ct.ProcessType{
+			"worker": {Cmd: []string{"work"}, Env: map[string]string{"WORKER": "true"}},
+		},
+	})
+	s.setAppRelease(c, app.ID, release.ID)
+
+	hostID := random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	s.cc.SetHosts(map[string]host.Host{hostID: {}})
+	s.cc.SetHostClient(hostID, hc)
+
+	res, _ := s.Post("/apps/"+app.ID+"/cron_jobs", &ct.CronJob{Schedule: "61 * * * *", ProcessType: "worker"}, &ct.CronJob{})
+	c.Assert(res.StatusCode, Equals, 400)
+
+	cronJob := &ct.CronJob{}
+	_, err := s.Post("/apps/"+app.ID+"/cron_jobs", &ct.CronJob{
+		Schedule:          "*/5 * * * *",
+		ProcessType:       "worker",
+		ConcurrencyPolicy: ct.CronConcurrencyForbid,
+	}, cronJob)
+	c.Assert(err, IsNil)
+	c.Assert(cronJob.ID, Not(Equals), "")
+
+	var list []*ct.CronJob
+	_, err = s.Get("/apps/"+app.ID+"/cron_jobs", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Schedule, Equals, "*/5 * * * *")
+
+	var runner *cronRunner
+	s.m.Invoke(func(r *cronRunner) { runner = r })
+
+	// the first run starts a job of the process type
+	now := cronJob.CreatedAt.Add(10 * time.Minute)
+	c.Assert(runner.runDue(now), IsNil)
+	c.Assert(runner.runDue(now), IsNil)
+	var runs []*ct.CronJobRun
+	_, err = s.Get("/apps/"+app.ID+"/cron_jobs/"+cronJob.ID+"/runs", &runs)
+	c.Assert(err, IsNil)
+	c.Assert(runs, HasLen, 1)
+	c.Assert(runs[0].Status, Equals, ct.CronRunStarted)
+
+	jobs := s.cc.GetHost(hostID).Jobs
+	c.Assert(jobs, HasLen, 1)
+	job := jobs[0]
+	c.Assert(runs[0].JobID, Equals, hostID+"-"+job.ID)
+	c.Assert(job.Metadata["flynn-controller.cron_job"], Equals, cronJob.ID)
+	c.Assert(job.Config.Cmd, DeepEquals, []string{"work"})
+	c.Assert(job.Config.Env, DeepEquals, map[string]string{"RELEASE": "true", "WORKER": "true"})
+
+	// the next run is skipped while the job is running
+	hc.SetJob(job.ID, &host.ActiveJob{Job: job, Status: host.StatusRunning})
+	c.Assert(runner.runDue(now.Add(5*time.Minute)), IsNil)
+	_, err = s.Get("/apps/"+app.ID+"/cron_jobs/"+cronJob.ID+"/runs", &runs)
+	c.Assert(err, IsNil)
+	c.Assert(runs, HasLen, 2)
+	c.Assert(runs[0].Status, Equals, ct.CronRunSkipped)
+	c.Assert(s.cc.GetHost(hostID).Jobs, HasLen, 1)
+
+	// once it has finished a new job is started
+	hc.SetJob(job.ID, &host.ActiveJob{Job: job, Status: host.StatusDone})
+	c.Assert(runner.runDue(now.Add(10*time.Minute)), IsNil)
+	_, err = s.Get("/apps/"+app.ID+"/cron_jobs/"+cronJob.ID+"/runs", &runs)
+	c.Assert(err, IsNil)
+	c.Assert(runs, HasLen, 3)
+	c.Assert(runs[0].Status, Equals, ct.CronRunStarted)
+	_, _, err = cluster.ParseJobID(runs[0].JobID)
+	c.Assert(err, IsNil)
+	c.Assert(runs[0].JobID, Not(Equals), runs[2].JobID)
+
+	res, err = s.Delete("/apps/" + app.ID + "/cron_jobs/" + cronJob.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, _ = s.Get("/apps/"+app.ID+"/cron_jobs/"+cronJob.ID, &ct.CronJob{})
+	c.Assert(res.StatusCode, Equals, 404)
+}
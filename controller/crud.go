@@ -2,10 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
 )
 
 type Repository interface {
@@ -14,10 +19,114 @@ type Repository interface {
 	List() (interface{}, error)
 }
 
+// QueryLister is implemented by repositories which can filter lists using
+// query parameters, it is used for list requests with a query string.
+type QueryLister interface {
+	ListQuery(url.Values) (interface{}, error)
+}
+
+// listQuery is the sorting and filtering of a list request, parsed from the
+// sort, direction, name_prefix and created_after query parameters.
+type listQuery struct {
+	sort         string
+	desc         bool
+	namePrefix   string
+	createdAfter *time.Time
+}
+
+// parseListQuery parses the list parameters of query, sortFields are the
+// columns which the list can be sorted by. Lists are sorted by created_at
+// unless sort is set, and direction defaults to desc for timestamps and asc
+// for other fields.
+func parseListQuery(query url.Values, sortFields ...string) (*listQuery, error) {
+	q := &listQuery{sort: "created_at", namePrefix: query.Get("name_prefix")}
+	if s := query.Get("sort"); s != "" {
+		q.sort = ""
+		for _, f := range sortFields {
+			if s == f {
+				q.sort = f
+				break
+			}
+		}
+		if q.sort == "" {
+			return nil, ct.ValidationError{Field: "sort", Message: "must be one of " + strings.Join(sortFields, ", ")}
+		}
+	}
+	switch query.Get("direction") {
+	case "":
+		q.desc = strings.HasSuffix(q.sort, "_at")
+	case "asc":
+	case "desc":
+		q.desc = true
+	default:
+		return nil, ct.ValidationError{Field: "direction", Message: "must be asc or desc"}
+	}
+	if s := query.Get("created_after"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, ct.ValidationError{Field: "created_after", Message: "must be an RFC 3339 timestamp"}
+		}
+		q.createdAfter = &t
+	}
+	return q, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// where returns the SQL conditions of the filters, each starting with AND,
+// appending their values to args. nameColumn is the column matched by
+// name_prefix, which is ignored if it is empty.
+func (q *listQuery) where(nameColumn string, args *[]interface{}) string {
+	var sql string
+	if q.namePrefix != "" && nameColumn != "" {
+		*args = append(*args, likeEscaper.Replace(q.namePrefix)+"%")
+		sql += fmt.Sprintf(" AND %s LIKE $%d", nameColumn, len(*args))
+	}
+	if q.createdAfter != nil {
+		*args = append(*args, *q.createdAfter)
+		sql += fmt.Sprintf(" AND created_at > $%d", len(*args))
+	}
+	return sql
+}
+
+// orderBy returns the ORDER BY clause of the list, rows with equal sort
+// values are ordered newest first.
+func (q *listQuery) orderBy() string {
+	dir := "ASC"
+	if q.desc {
+		dir = "DESC"
+	}
+	sql := fmt.Sprintf(" ORDER BY %s %s", q.sort, dir)
+	if q.sort != "created_at" {
+		sql += ", created_at DESC"
+	}
+	return sql
+}
+
+// ActorAdder is implemented by repositories which record the actor which
+// created an object, it is used instead of Add for create requests.
+type ActorAdder interface {
+	AddAs(thing interface{}, actor string) error
+}
+
 type Remover interface {
 	Remove(string) error
 }
 
+// CascadeRemover is implemented by repositories that can also remove the
+// objects which depend on an object, it is used for DELETE requests with
+// the cascade=true query parameter.
+type CascadeRemover interface {
+	RemoveCascade(string) error
+}
+
+// ForceRemover is implemented by repositories that refuse to remove an
+// object which others depend on unless forced, it is used for DELETE
+// requests with the force=true query parameter.
+type ForceRemover interface {
+	RemoveForce(string) error
+}
+
 type Updater interface {
 	Update(string, map[string]interface{}) (interface{}, error)
 }
@@ -28,14 +137,22 @@ func crud(resource string, example interface{}, repo Repository, r martini.Route
 	prefix := "/" + resource
 
 	r.Post(prefix, func(req *http.Request, r ResponseHelper) {
-		thing := reflect.New(resourceType).Interface()
-		err := json.NewDecoder(req.Body).Decode(thing)
+		data, err := readValidBody(req, resource, false)
 		if err != nil {
 			r.Error(err)
 			return
 		}
+		thing := reflect.New(resourceType).Interface()
+		if err := json.Unmarshal(data, thing); err != nil {
+			r.Error(err)
+			return
+		}
 
-		err = repo.Add(thing)
+		if adder, ok := repo.(ActorAdder); ok {
+			err = adder.AddAs(thing, req.Header.Get(actorHeader))
+		} else {
+			err = repo.Add(thing)
+		}
 		if err != nil {
 			r.Error(err)
 			return
@@ -53,12 +170,20 @@ func crud(resource string, example interface{}, repo Repository, r martini.Route
 	}
 
 	singletonPath := prefix + "/:" + resource + "_id"
-	r.Get(singletonPath, lookup, func(c martini.Context, r ResponseHelper) {
-		r.JSON(200, c.Get(resourcePtr).Interface())
+	r.Get(singletonPath, lookup, func(c martini.Context, w http.ResponseWriter, r ResponseHelper) {
+		thing := c.Get(resourcePtr).Interface()
+		setETag(w, thing)
+		r.JSON(200, thing)
 	})
 
-	r.Get(prefix, func(r ResponseHelper) {
-		list, err := repo.List()
+	r.Get(prefix, func(req *http.Request, r ResponseHelper) {
+		var list interface{}
+		var err error
+		if lister, ok := repo.(QueryLister); ok && req.URL.RawQuery != "" {
+			list, err = lister.ListQuery(req.URL.Query())
+		} else {
+			list, err = repo.List()
+		}
 		if err != nil {
 			r.Error(err)
 			return
@@ -67,8 +192,15 @@ func crud(resource string, example interface{}, repo Repository, r martini.Route
 	})
 
 	if remover, ok := repo.(Remover); ok {
-		r.Delete(singletonPath, lookup, func(params martini.Params, r ResponseHelper) {
-			if err := remover.Remove(params[resource+"_id"]); err != nil {
+		r.Delete(singletonPath, lookup, func(params martini.Params, req *http.Request, r ResponseHelper) {
+			remove := remover.Remove
+			if cascader, ok := repo.(CascadeRemover); ok && req.FormValue("cascade") == "true" {
+				remove = cascader.RemoveCascade
+			}
+			if forcer, ok := repo.(ForceRemover); ok && req.FormValue("force") == "true" {
+				remove = forcer.RemoveForce
+			}
+			if err := remove(params[resource+"_id"]); err != nil {
 				r.Error(err)
 				return
 			}
@@ -76,19 +208,36 @@ func crud(resource string, example interface{}, repo Repository, r martini.Route
 	}
 
 	if updater, ok := repo.(Updater); ok {
-		r.Post(singletonPath, func(params martini.Params, req *http.Request, r ResponseHelper) {
+		update := func(c martini.Context, params martini.Params, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
+			if err := checkIfMatch(req, c.Get(resourcePtr).Interface()); err != nil {
+				r.Error(err)
+				return
+			}
+			body, err := readValidBody(req, resource, true)
+			if err != nil {
+				r.Error(err)
+				return
+			}
 			var data map[string]interface{}
-			if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+			if err := json.Unmarshal(body, &data); err != nil {
 				r.Error(err)
 				return
 			}
-			app, err := updater.Update(params[resource+"_id"], data)
+			thing, err := updater.Update(params[resource+"_id"], data)
 			if err != nil {
 				r.Error(err)
 				return
 			}
-			r.JSON(200, app)
-		})
+			// respond with the stored representation so the ETag matches
+			// later GET requests
+			if updated, err := repo.Get(params[resource+"_id"]); err == nil {
+				thing = updated
+			}
+			setETag(w, thing)
+			r.JSON(200, thing)
+		}
+		r.Post(singletonPath, lookup, update)
+		r.Put(singletonPath, lookup, update)
 	}
 
 	return lookup
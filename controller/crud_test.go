@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/url"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+type ListQuerySuite struct{}
+
+var _ = Suite(&ListQuerySuite{})
+
+func (ListQuerySuite) TestParseListQuery(c *C) {
+	for _, t := range []struct {
+		query   string
+		orderBy string
+		where   string
+		args    int
+		field   string
+	}{
+		{query: "", orderBy: " ORDER BY created_at DESC"},
+		{query: "sort=name", orderBy: " ORDER BY name ASC, created_at DESC"},
+		{query: "sort=name&direction=desc", orderBy: " ORDER BY name DESC, created_at DESC"},
+		{query: "sort=updated_at", orderBy: " ORDER BY updated_at DESC, created_at DESC"},
+		{query: "direction=asc", orderBy: " ORDER BY created_at ASC"},
+		{query: "name_prefix=foo", orderBy: " ORDER BY created_at DESC", where: " AND name LIKE $1", args: 1},
+		{query: "name_prefix=foo&created_after=2014-10-01T00:00:00Z", orderBy: " ORDER BY created_at DESC", where: " AND name LIKE $1 AND created_at > $2", args: 2},
+		{query: "sort=id", field: "sort"},
+		{query: "direction=up", field: "direction"},
+		{query: "created_after=2014-10-01", field: "created_after"},
+	} {
+		values, _ := url.ParseQuery(t.query)
+		q, err := parseListQuery(values, "name", "created_at", "updated_at")
+		if t.field != "" {
+			c.Assert(err, FitsTypeOf, ct.ValidationError{}, Commentf("%s", t.query))
+			c.Assert(err.(ct.ValidationError).Field, Equals, t.field, Commentf("%s", t.query))
+			continue
+		}
+		c.Assert(err, IsNil, Commentf("%s", t.query))
+		c.Assert(q.orderBy(), Equals, t.orderBy, Commentf("%s", t.query))
+		var args []interface{}
+		c.Assert(q.where("name", &args), Equals, t.where, Commentf("%s", t.query))
+		c.Assert(args, HasLen, t.args, Commentf("%s", t.query))
+	}
+}
+
+func (ListQuerySuite) TestNamePrefixEscaped(c *C) {
+	q, err := parseListQuery(url.Values{"name_prefix": {`a_b%c\`}})
+	c.Assert(err, IsNil)
+	var args []interface{}
+	q.where("name", &args)
+	c.Assert(args, DeepEquals, []interface{}{`a\_b\%c\\%`})
+
+	// name_prefix is ignored by lists without names
+	args = nil
+	c.Assert(q.where("", &args), Equals, "")
+}
@@ -107,13 +107,18 @@ type rowErrFixer struct {
 
 func (f rowErrFixer) Scan(args ...interface{}) error {
 	err := f.s.Scan(args...)
-	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "invalid_text_representation" && e.File == "uuid.c" && e.Routine == "string_to_uuid" {
-		// invalid input syntax for uuid
+	if invalidUUID(err) {
 		err = sql.ErrNoRows
 	}
 	return err
 }
 
+// invalidUUID returns whether err is an invalid input syntax for uuid error.
+func invalidUUID(err error) bool {
+	e, ok := err.(*pq.Error)
+	return ok && e.Code.Name() == "invalid_text_representation" && e.File == "uuid.c" && e.Routine == "string_to_uuid"
+}
+
 func cleanUUID(u string) string {
 	return strings.Replace(u, "-", "", -1)
 }
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// deployer executes deployments in the background, replacing the jobs of an
+// app's old release with jobs of the new release according to the
+// deployment's strategy. Progress is recorded as deployment events.
+type deployer struct {
+	repo       *DeploymentRepo
+	apps       *AppRepo
+	formations *FormationRepo
+	jobs       *JobRepo
+}
+
+// Start executes the deployment in a new goroutine.
+func (dr *deployer) Start(d *ct.Deployment) {
+	go dr.run(d)
+}
+
+func (dr *deployer) run(d *ct.Deployment) {
+	// the lock is held while the deployment runs so that Recover can tell it
+	// apart from deployments of controllers which have stopped
+	lock, _, err := dr.repo.lock(d.ID, true)
+	if err != nil {
+		log.Printf("deployer: unable to lock deployment %s: %s", d.ID, err)
+		return
+	}
+	defer lock.Rollback()
+	// the deployment may have been recovered before the lock was taken
+	if current, err := dr.repo.Get(d.ID); err != nil || current.FinishedAt != nil {
+		return
+	}
+
+	status, errMsg := ct.DeploymentStatusComplete, ""
+	if err := dr.deploy(d); err != nil {
+		log.Printf("deployer: deployment %s of app %s failed: %s", d.ID, d.AppID, err)
+		status, errMsg = ct.DeploymentStatusFailed, err.Error()
+	}
+	if err := dr.repo.SetStatus(d, status, errMsg); err != nil {
+		log.Printf("deployer: unable to set status of deployment %s: %s", d.ID, err)
+	}
+}
+
+func (dr *deployer) deploy(d *ct.Deployment) error {
+	if err := dr.repo.SetStatus(d, ct.DeploymentStatusRunning, ""); err != nil {
+		return err
+	}
+
+	// watch for job events before scaling so that none are missed
+	w, err := dr.watchJobs(d)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	s := &deployState{dr: dr, d: d, w: w, orig: make(map[string]int), old: make(map[string]int), new: make(map[string]int)}
+	if d.OldReleaseID != "" {
+		f, err := dr.formations.Get(d.AppID, d.OldReleaseID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if f != nil {
+			for typ, n := range f.Processes {
+				s.orig[typ] = n
+				s.old[typ] = n
+			}
+			s.limits = f.Limits
+			s.constraints = f.Constraints
+		}
+	}
+	if err := dr.repo.setOldProcesses(d.ID, s.orig); err != nil {
+		return err
+	}
+
+	switch d.Strategy {
+	case ct.DeployStrategyOneByOne:
+		err = s.oneByOne()
+	case ct.DeployStrategyCanary:
+		err = s.canary()
+	default:
+		err = s.allAtOnce()
+	}
+	if err == nil && d.OldReleaseID != "" {
+		err = dr.formations.Remove(d.AppID, d.OldReleaseID)
+	}
+	if err == nil {
+		err = dr.apps.SetRelease(d.AppID, d.NewReleaseID)
+	}
+	if err != nil {
+		return s.rollback(err)
+	}
+	return nil
+}
+
+// Recover finishes the deployments which were left unfinished by
+// controllers that stopped while running them, so they no longer block the
+// app's deployments. Deployments which had started are rolled back to the
+// old release's processes unless the app was already moved to the new
+// release. Deployments still being run by another controller are skipped.
+func (dr *deployer) Recover() error {
+	list, err := dr.repo.listUnfinished()
+	if err != nil {
+		return err
+	}
+	for _, d := range list {
+		if err := dr.recover(d.ID); err != nil {
+			log.Printf("deployer: unable to recover deployment %s of app %s: %s", d.ID, d.AppID, err)
+		}
+	}
+	return nil
+}
+
+var errDeployInterrupted = errors.New("controller stopped during the deployment")
+
+func (dr *deployer) recover(id string) error {
+	lock, locked, err := dr.repo.lock(id, false)
+	if err != nil {
+		return err
+	}
+	defer lock.Rollback()
+	if !locked {
+		return nil
+	}
+	d, err := dr.repo.Get(id)
+	if err != nil {
+		return err
+	}
+	if d.FinishedAt != nil {
+		return nil
+	}
+	if d.Status == ct.DeploymentStatusPending {
+		return dr.repo.SetStatus(d, ct.DeploymentStatusFailed, errDeployInterrupted.Error())
+	}
+
+	// the app's release is changed by the last step of a deployment
+	release, err := dr.apps.GetRelease(d.AppID)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if release != nil && release.ID == d.NewReleaseID {
+		return dr.repo.SetStatus(d, ct.DeploymentStatusComplete, "")
+	}
+
+	s := &deployState{dr: dr, d: d}
+	if s.orig, err = dr.repo.oldProcesses(d.ID); err != nil {
+		return err
+	}
+	// the old formation is removed by the deployment once it has been
+	// scaled down, in which case the new formation has the same limits
+	for _, releaseID := range []string{d.OldReleaseID, d.NewReleaseID} {
+		f, err := dr.formations.Get(d.AppID, releaseID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if f != nil {
+			s.limits = f.Limits
+			s.constraints = f.Constraints
+			break
+		}
+	}
+	err = s.rollback(errDeployInterrupted)
+	log.Printf("deployer: deployment %s of app %s failed: %s", d.ID, d.AppID, err)
+	return dr.repo.SetStatus(d, ct.DeploymentStatusFailed, err.Error())
+}
+
+// deployState tracks the processes of the old and new release while a
+// strategy is executed, orig holds the processes of the old release before
+// the deployment started. The old formation's resource limits and placement
+// constraints are kept for both releases.
+type deployState struct {
+	dr          *deployer
+	d           *ct.Deployment
+	w           *jobWatcher
+	orig        map[string]int
+	old         map[string]int
+	new         map[string]int
+	limits      map[string]ct.ResourceLimits
+	constraints map[string]ct.PlacementConstraints
+}
+
+func (s *deployState) scale(releaseID string, procs map[string]int) error {
+	f := &ct.Formation{AppID: s.d.AppID, ReleaseID: releaseID, Processes: make(map[string]int, len(procs)), Limits: s.limits, Constraints: s.constraints}
+	for typ, n := range procs {
+		f.Processes[typ] = n
+	}
+	return s.dr.formations.Add(f)
+}
+
+// scaleNew scales the new release to procs and waits for the jobs to be up.
+func (s *deployState) scaleNew(procs map[string]int) error {
+	for typ, n := range procs {
+		s.new[typ] = n
+	}
+	if err := s.scale(s.d.NewReleaseID, s.new); err != nil {
+		return err
+	}
+	return s.w.WaitFor(s.new, s.timeouts(s.new))
+}
+
+// timeouts returns how long the jobs of each of the given process types have
+// to come up, using the deployment's DeployTimeout for any type without its
+// own entry in ProcessTimeouts.
+func (s *deployState) timeouts(procs map[string]int) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration, len(procs))
+	for typ := range procs {
+		n := s.d.ProcessTimeouts[typ]
+		if n == 0 {
+			n = s.d.DeployTimeout
+		}
+		timeouts[typ] = time.Duration(n) * time.Second
+	}
+	return timeouts
+}
+
+// rollback restores the app's previous release after the deployment failed
+// with cause, scaling the old release back to its original processes and
+// removing the new release's formation. The returned error describes both
+// the cause and the outcome of the rollback.
+func (s *deployState) rollback(cause error) error {
+	if s.d.OldReleaseID == "" {
+		return cause
+	}
+	if err := s.dr.repo.SetStatus(s.d, ct.DeploymentStatusRollingBack, cause.Error()); err != nil {
+		return fmt.Errorf("%s (rollback failed: %s)", cause, err)
+	}
+	// the app's release is only changed by the last step of a deployment,
+	// so only the formations need to be restored
+	var err error
+	if len(s.orig) > 0 {
+		err = s.scale(s.d.OldReleaseID, s.orig)
+	}
+	if err == nil {
+		if err = s.dr.formations.Remove(s.d.AppID, s.d.NewReleaseID); err == ErrNotFound {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s (rollback failed: %s)", cause, err)
+	}
+	return fmt.Errorf("%s (rolled back to release %s)", cause, s.d.OldReleaseID)
+}
+
+func (s *deployState) allAtOnce() error {
+	if err := s.scaleNew(s.d.Processes); err != nil {
+		return err
+	}
+	if len(s.old) == 0 {
+		return nil
+	}
+	for typ := range s.old {
+		s.old[typ] = 0
+	}
+	return s.scale(s.d.OldReleaseID, s.old)
+}
+
+func (s *deployState) oneByOne() error {
+	types := make([]string, 0, len(s.d.Processes))
+	for typ := range s.d.Processes {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		for i := 1; i <= s.d.Processes[typ]; i++ {
+			if err := s.scaleNew(map[string]int{typ: i}); err != nil {
+				return err
+			}
+			if s.old[typ] > 0 {
+				s.old[typ]--
+				if err := s.scale(s.d.OldReleaseID, s.old); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return s.allAtOnce()
+}
+
+func (s *deployState) canary() error {
+	canaries := make(map[string]int, len(s.d.Processes))
+	for typ, n := range s.d.Processes {
+		c := (n*s.d.CanaryPercent + 99) / 100
+		if c < 1 {
+			c = 1
+		}
+		canaries[typ] = c
+	}
+	if err := s.scaleNew(canaries); err != nil {
+		return err
+	}
+	return s.allAtOnce()
+}
+
+// jobWatcher tracks the state of the jobs of a deployment's new release by
+// listening for the app's job events.
+type jobWatcher struct {
+	d        *ct.Deployment
+	repo     *DeploymentRepo
+	jobs     *JobRepo
+	listener *pq.Listener
+	states   map[string]*ct.JobEvent
+}
+
+func (dr *deployer) watchJobs(d *ct.Deployment) (*jobWatcher, error) {
+	connected := make(chan error, 1)
+	listener := pq.NewListener(dr.repo.db.DSN(), 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		var res error
+		switch ev {
+		case pq.ListenerEventConnected:
+		case pq.ListenerEventConnectionAttemptFailed:
+			res = err
+		default:
+			return
+		}
+		select {
+		case connected <- res:
+		default:
+		}
+	})
+	if err := listener.Listen("job_events:" + formatUUID(d.AppID)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := <-connected; err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &jobWatcher{
+		d:        d,
+		repo:     dr.repo,
+		jobs:     dr.jobs,
+		listener: listener,
+		states:   make(map[string]*ct.JobEvent),
+	}, nil
+}
+
+// up returns the number of jobs of the given type which are up.
+func (w *jobWatcher) up(typ string) int {
+	var n int
+	for _, e := range w.states {
+		if e.Type == typ && e.State == "up" {
+			n++
+		}
+	}
+	return n
+}
+
+// WaitFor waits until the number of up jobs of the new release is at least
+// expected for each process type, an error is returned if a job crashes or
+// the jobs of a type are not up within that type's entry in timeouts.
+func (w *jobWatcher) WaitFor(expected map[string]int, timeouts map[string]time.Duration) error {
+	start := time.Now()
+	for {
+		// wait until the earliest deadline of the types which are not up yet
+		var next time.Time
+		for typ, n := range expected {
+			if w.up(typ) >= n {
+				continue
+			}
+			if deadline := start.Add(timeouts[typ]); next.IsZero() || deadline.Before(next) {
+				next = deadline
+			}
+		}
+		if next.IsZero() {
+			return nil
+		}
+
+		var n *pq.Notification
+		timer := time.NewTimer(next.Sub(time.Now()))
+		select {
+		case n = <-w.listener.Notify:
+			timer.Stop()
+		case <-timer.C:
+			return w.timeoutError(expected, timeouts, time.Since(start))
+		}
+		if n == nil {
+			continue
+		}
+		id, err := strconv.ParseInt(n.Extra, 10, 64)
+		if err != nil {
+			return err
+		}
+		e, err := w.jobs.getEvent(id)
+		if err != nil {
+			return err
+		}
+		if e.ReleaseID != w.d.NewReleaseID {
+			continue
+		}
+		w.states[e.JobID] = e
+		if err := w.repo.AddEvent(&ct.DeploymentEvent{
+			DeploymentID: w.d.ID,
+			ReleaseID:    e.ReleaseID,
+			Status:       ct.DeploymentStatusRunning,
+			JobType:      e.Type,
+			JobState:     e.State,
+		}); err != nil {
+			return err
+		}
+		if e.State == "crashed" {
+			return fmt.Errorf("%s job %s crashed", e.Type, e.JobID)
+		}
+	}
+}
+
+// timeoutError lists the process types which did not have the expected
+// number of jobs up within their timeout after waiting for elapsed.
+func (w *jobWatcher) timeoutError(expected map[string]int, timeouts map[string]time.Duration, elapsed time.Duration) error {
+	types := make([]string, 0, len(expected))
+	for typ := range expected {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	var timeout time.Duration
+	var reasons []string
+	for _, typ := range types {
+		if up := w.up(typ); up < expected[typ] && timeouts[typ] <= elapsed {
+			reasons = append(reasons, fmt.Sprintf("%s: %d of %d jobs up", typ, up, expected[typ]))
+			if timeouts[typ] > timeout {
+				timeout = timeouts[typ]
+			}
+		}
+	}
+	return fmt.Errorf("timed out after %s waiting for jobs (%s)", timeout, strings.Join(reasons, ", "))
+}
+
+func (w *jobWatcher) Close() error {
+	return w.listener.Close()
+}
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+type DeploymentRepo struct {
+	db *DB
+}
+
+func NewDeploymentRepo(db *DB) *DeploymentRepo {
+	return &DeploymentRepo{db}
+}
+
+// Add creates the deployment with a pending status, a ValidationError is
+// returned if the app already has a deployment in progress.
+func (r *DeploymentRepo) Add(d *ct.Deployment) error {
+	var oldReleaseID *string
+	if d.OldReleaseID != "" {
+		oldReleaseID = &d.OldReleaseID
+	}
+	d.Status = ct.DeploymentStatusPending
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow("INSERT INTO deployments (app_id, old_release_id, new_release_id, strategy, canary_percent, deploy_timeout, process_timeouts, status, processes) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING deployment_id, created_at",
+		d.AppID, oldReleaseID, d.NewReleaseID, d.Strategy, d.CanaryPercent, d.DeployTimeout, procsHstore(d.ProcessTimeouts), d.Status, procsHstore(d.Processes)).Scan(&d.ID, &d.CreatedAt)
+	if err != nil {
+		tx.Rollback()
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+			err = ct.ValidationError{Field: "app", Message: "already has a deployment in progress"}
+		}
+		return err
+	}
+	d.ID = cleanUUID(d.ID)
+	if err := insertDeploymentEvent(tx, &ct.DeploymentEvent{DeploymentID: d.ID, Status: d.Status}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := createEvent(tx, d.AppID, ct.EventTypeDeployment, d.ID, d); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Rollback returns the app to a previous release in a single transaction,
+// moving the processes of the current formation to the release and recording
+// a completed deployment. If releaseID is empty the app is returned to the
+// release it had before its current release.
+func (r *DeploymentRepo) Rollback(appID, releaseID string) (*ct.Deployment, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	d, err := rollback(tx, appID, releaseID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return d, tx.Commit()
+}
+
+func rollback(tx *dbTx, appID, releaseID string) (*ct.Deployment, error) {
+	// lock the app so that its release can't change during the rollback
+	var currentID *string
+	if err := tx.QueryRow("SELECT release_id FROM apps WHERE app_id = $1 AND deleted_at IS NULL FOR UPDATE", appID).Scan(&currentID); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	if currentID == nil {
+		return nil, ct.ValidationError{Field: "app", Message: "has no release to roll back"}
+	}
+	d := &ct.Deployment{
+		AppID:        appID,
+		OldReleaseID: cleanUUID(*currentID),
+		NewReleaseID: releaseID,
+		Strategy:     ct.DeployStrategyRollback,
+		Status:       ct.DeploymentStatusComplete,
+	}
+
+	if d.NewReleaseID == "" {
+		var data *string
+		err := tx.QueryRow("SELECT data FROM events WHERE app_id = $1 AND object_type = $2 ORDER BY event_id DESC LIMIT 1", appID, ct.EventTypeAppRelease).Scan(&data)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		var e ct.AppReleaseEvent
+		if data != nil {
+			if err := json.Unmarshal([]byte(*data), &e); err != nil {
+				return nil, err
+			}
+		}
+		if e.PrevReleaseID == "" {
+			return nil, ct.ValidationError{Field: "release", Message: "must be set as the app has no previous release"}
+		}
+		d.NewReleaseID = e.PrevReleaseID
+	}
+	release, err := scanRelease(tx.QueryRow("SELECT "+releaseColumns+" FROM releases WHERE release_id = $1 AND deleted_at IS NULL", d.NewReleaseID))
+	if err == ErrNotFound {
+		err = ct.ValidationError{Field: "release", Message: "does not exist"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.NewReleaseID = release.ID
+	if d.NewReleaseID == d.OldReleaseID {
+		return nil, ct.ValidationError{Field: "release", Message: "is already the current release"}
+	}
+
+	var inProgress bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM deployments WHERE app_id = $1 AND finished_at IS NULL)", appID).Scan(&inProgress); err != nil {
+		return nil, err
+	}
+	if inProgress {
+		return nil, ct.ValidationError{Field: "app", Message: "already has a deployment in progress"}
+	}
+
+	// move the processes of the current formation to the release, dropping
+	// any types that the release doesn't have
+	d.Processes = make(map[string]int)
+	f, err := scanFormation(tx.QueryRow("SELECT "+formationColumns+" FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, d.OldReleaseID))
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	if f != nil {
+		for typ, n := range f.Processes {
+			if _, ok := release.Processes[typ]; ok {
+				d.Processes[typ] = n
+			}
+		}
+		if err := upsertFormation(tx, &ct.Formation{AppID: appID, ReleaseID: release.ID, Processes: d.Processes, Limits: f.Limits, Constraints: f.Constraints}); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec("UPDATE formations SET deleted_at = now(), processes = NULL, updated_at = now() WHERE app_id = $1 AND release_id = $2", appID, d.OldReleaseID); err != nil {
+			return nil, err
+		}
+	}
+	if err := updateAppRelease(tx, appID, release.ID); err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow("INSERT INTO deployments (app_id, old_release_id, new_release_id, strategy, canary_percent, deploy_timeout, process_timeouts, status, processes, finished_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, now()) RETURNING deployment_id, created_at, finished_at",
+		d.AppID, d.OldReleaseID, d.NewReleaseID, d.Strategy, d.CanaryPercent, d.DeployTimeout, procsHstore(d.ProcessTimeouts), d.Status, procsHstore(d.Processes)).Scan(&d.ID, &d.CreatedAt, &d.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	d.ID = cleanUUID(d.ID)
+	if err := insertDeploymentEvent(tx, &ct.DeploymentEvent{DeploymentID: d.ID, ReleaseID: d.NewReleaseID, Status: d.Status}); err != nil {
+		return nil, err
+	}
+	if err := createEvent(tx, appID, ct.EventTypeDeployment, d.ID, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func scanDeployment(s Scanner) (*ct.Deployment, error) {
+	d := &ct.Deployment{}
+	var oldReleaseID *string
+	var procs, timeouts hstore.Hstore
+	err := s.Scan(&d.ID, &d.AppID, &oldReleaseID, &d.NewReleaseID, &d.Strategy, &d.CanaryPercent, &d.DeployTimeout, &timeouts, &d.Status, &procs, &d.CreatedAt, &d.FinishedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	d.ID = cleanUUID(d.ID)
+	d.AppID = cleanUUID(d.AppID)
+	d.NewReleaseID = cleanUUID(d.NewReleaseID)
+	if oldReleaseID != nil {
+		d.OldReleaseID = cleanUUID(*oldReleaseID)
+	}
+	d.Processes = make(map[string]int, len(procs.Map))
+	for k, v := range procs.Map {
+		if n, _ := strconv.Atoi(v.String); n > 0 {
+			d.Processes[k] = n
+		}
+	}
+	if len(timeouts.Map) > 0 {
+		d.ProcessTimeouts = make(map[string]int, len(timeouts.Map))
+		for k, v := range timeouts.Map {
+			if n, _ := strconv.Atoi(v.String); n > 0 {
+				d.ProcessTimeouts[k] = n
+			}
+		}
+	}
+	return d, nil
+}
+
+const deploymentColumns = "deployment_id, app_id, old_release_id, new_release_id, strategy, canary_percent, deploy_timeout, process_timeouts, status, processes, created_at, finished_at"
+
+func (r *DeploymentRepo) Get(id string) (*ct.Deployment, error) {
+	row := r.db.QueryRow("SELECT "+deploymentColumns+" FROM deployments WHERE deployment_id = $1", id)
+	return scanDeployment(row)
+}
+
+// listUnfinished returns the deployments of all apps which have not
+// finished, oldest first.
+func (r *DeploymentRepo) listUnfinished() ([]*ct.Deployment, error) {
+	rows, err := r.db.Query("SELECT " + deploymentColumns + " FROM deployments WHERE finished_at IS NULL ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	var list []*ct.Deployment
+	for rows.Next() {
+		d, err := scanDeployment(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+// lock takes an advisory lock on the deployment which is held until the
+// returned transaction ends. If wait is false and the lock is held by
+// another connection, false is returned instead of waiting for it.
+func (r *DeploymentRepo) lock(id string, wait bool) (*dbTx, bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	locked := true
+	if wait {
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext('deployment:' || $1))", id)
+	} else {
+		err = tx.QueryRow("SELECT pg_try_advisory_xact_lock(hashtext('deployment:' || $1))", id).Scan(&locked)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, false, err
+	}
+	return tx, locked, nil
+}
+
+// setOldProcesses records the processes of the old release before the
+// deployment started, so that they can be restored if the deployment is
+// interrupted.
+func (r *DeploymentRepo) setOldProcesses(id string, procs map[string]int) error {
+	return r.db.Exec("UPDATE deployments SET old_processes = $2 WHERE deployment_id = $1", id, procsHstore(procs))
+}
+
+// oldProcesses returns the processes recorded by setOldProcesses, nil is
+// returned if none were recorded.
+func (r *DeploymentRepo) oldProcesses(id string) (map[string]int, error) {
+	var procs hstore.Hstore
+	if err := r.db.QueryRow("SELECT old_processes FROM deployments WHERE deployment_id = $1", id).Scan(&procs); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	if procs.Map == nil {
+		return nil, nil
+	}
+	res := make(map[string]int, len(procs.Map))
+	for k, v := range procs.Map {
+		if n, _ := strconv.Atoi(v.String); n > 0 {
+			res[k] = n
+		}
+	}
+	return res, nil
+}
+
+// inProgress reports whether the app has a deployment which has not
+// finished.
+func (r *DeploymentRepo) inProgress(appID string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRow("SELECT EXISTS (SELECT 1 FROM deployments WHERE app_id = $1 AND finished_at IS NULL)", appID).Scan(&exists)
+	return exists, err
+}
+
+// SetStatus updates the status of the deployment and records an event, the
+// deployment is marked as finished if the status is complete or failed.
+func (r *DeploymentRepo) SetStatus(d *ct.Deployment, status, errMsg string) error {
+	finished := status == ct.DeploymentStatusComplete || status == ct.DeploymentStatusFailed
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.QueryRow("UPDATE deployments SET status = $2, finished_at = CASE WHEN $3 THEN now() END WHERE deployment_id = $1 RETURNING finished_at", d.ID, status, finished).Scan(&d.FinishedAt); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return err
+	}
+	d.Status = status
+	if err := insertDeploymentEvent(tx, &ct.DeploymentEvent{DeploymentID: d.ID, Status: status, Error: errMsg}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := createEvent(tx, d.AppID, ct.EventTypeDeployment, d.ID, d); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddEvent records an event for the deployment, which is sent to clients
+// streaming the deployment.
+func (r *DeploymentRepo) AddEvent(e *ct.DeploymentEvent) error {
+	return insertDeploymentEvent(r.db, e)
+}
+
+func insertDeploymentEvent(db rowQueryer, e *ct.DeploymentEvent) error {
+	var releaseID *string
+	if e.ReleaseID != "" {
+		releaseID = &e.ReleaseID
+	}
+	return db.QueryRow("INSERT INTO deployment_events (deployment_id, release_id, status, job_type, job_state, error) VALUES ($1, $2, $3, $4, $5, $6) RETURNING event_id, created_at",
+		e.DeploymentID, releaseID, e.Status, e.JobType, e.JobState, e.Error).Scan(&e.ID, &e.CreatedAt)
+}
+
+func scanDeploymentEvent(s Scanner) (*ct.DeploymentEvent, error) {
+	e := &ct.DeploymentEvent{}
+	var releaseID, jobType, jobState, errMsg *string
+	err := s.Scan(&e.ID, &e.DeploymentID, &releaseID, &e.Status, &jobType, &jobState, &errMsg, &e.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	e.DeploymentID = cleanUUID(e.DeploymentID)
+	if releaseID != nil {
+		e.ReleaseID = cleanUUID(*releaseID)
+	}
+	if jobType != nil {
+		e.JobType = *jobType
+	}
+	if jobState != nil {
+		e.JobState = *jobState
+	}
+	if errMsg != nil {
+		e.Error = *errMsg
+	}
+	return e, nil
+}
+
+// listEvents returns the events of the deployment after sinceID, oldest
+// first.
+func (r *DeploymentRepo) listEvents(deploymentID string, sinceID int64) ([]*ct.DeploymentEvent, error) {
+	rows, err := r.db.Query("SELECT event_id, deployment_id, release_id, status, job_type, job_state, error, created_at FROM deployment_events WHERE deployment_id = $1 AND event_id > $2 ORDER BY event_id", deploymentID, sinceID)
+	if err != nil {
+		return nil, err
+	}
+	var events []*ct.DeploymentEvent
+	for rows.Next() {
+		e, err := scanDeploymentEvent(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (r *DeploymentRepo) getEvent(id int64) (*ct.DeploymentEvent, error) {
+	row := r.db.QueryRow("SELECT event_id, deployment_id, release_id, status, job_type, job_state, error, created_at FROM deployment_events WHERE event_id = $1", id)
+	return scanDeploymentEvent(row)
+}
+
+var deployStrategies = map[string]bool{
+	ct.DeployStrategyAllAtOnce: true,
+	ct.DeployStrategyOneByOne:  true,
+	ct.DeployStrategyCanary:    true,
+}
+
+func createDeployment(app *ct.App, d ct.Deployment, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, dr *deployer, r ResponseHelper) {
+	data, err := releases.Get(d.NewReleaseID)
+	if err == ErrNotFound {
+		err = ct.ValidationError{Field: "new_release", Message: "does not exist"}
+	}
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if err := validateDeployStrategy(&d); err != nil {
+		r.Error(err)
+		return
+	}
+	if err := startDeployment(app, &d, data.(*ct.Release), apps, formations, dr); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &d)
+}
+
+// validateDeployStrategy checks the deployment's strategy options, setting
+// the defaults for any which are unset.
+func validateDeployStrategy(d *ct.Deployment) error {
+	if d.Strategy == "" {
+		d.Strategy = ct.DeployStrategyAllAtOnce
+	}
+	if !deployStrategies[d.Strategy] {
+		names := make([]string, 0, len(deployStrategies))
+		for name := range deployStrategies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return ct.ValidationError{Field: "strategy", Code: ct.ValidationCodeInvalidFormat, Message: "must be one of " + strings.Join(names, ", ")}
+	}
+	if d.Strategy == ct.DeployStrategyCanary && (d.CanaryPercent < 1 || d.CanaryPercent > 100) {
+		return ct.ValidationError{Field: "canary_percent", Message: "must be between 1 and 100"}
+	}
+	if d.DeployTimeout < 0 {
+		return ct.ValidationError{Field: "deploy_timeout", Message: "must not be negative"}
+	} else if d.DeployTimeout == 0 {
+		d.DeployTimeout = ct.DefaultDeployTimeout
+	}
+	for typ, n := range d.ProcessTimeouts {
+		if n < 0 {
+			return ct.ValidationError{Field: joinField("process_timeouts", typ), Message: "must not be negative"}
+		}
+	}
+	return nil
+}
+
+// startDeployment records a deployment of the release to the app and starts
+// it, the deployment's strategy options must already be validated.
+func startDeployment(app *ct.App, d *ct.Deployment, release *ct.Release, apps *AppRepo, formations *FormationRepo, dr *deployer) error {
+	d.AppID = app.ID
+	d.NewReleaseID = release.ID
+	d.OldReleaseID = ""
+	if old, err := apps.GetRelease(app.ID); err == nil {
+		d.OldReleaseID = old.ID
+	} else if err != ErrNotFound {
+		return err
+	}
+	if d.OldReleaseID == d.NewReleaseID {
+		return ct.ValidationError{Field: "new_release", Message: "is already the current release"}
+	}
+
+	// default to the processes of the current release, dropping any types
+	// that the new release doesn't have
+	procs := d.Processes
+	if procs == nil && d.OldReleaseID != "" {
+		f, err := formations.Get(app.ID, d.OldReleaseID)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if f != nil {
+			procs = f.Processes
+		}
+	}
+	d.Processes = make(map[string]int, len(procs))
+	for typ, n := range procs {
+		if _, ok := release.Processes[typ]; ok && n > 0 {
+			d.Processes[typ] = n
+		}
+	}
+
+	if err := dr.repo.Add(d); err != nil {
+		return err
+	}
+	dr.Start(d)
+	return nil
+}
+
+func rollbackApp(app *ct.App, rb ct.Rollback, repo *DeploymentRepo, r ResponseHelper) {
+	d, err := repo.Rollback(app.ID, rb.ReleaseID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, d)
+}
+
+// promoteApp deploys a copy of the app's current release to the target app.
+// The copy uses the same artifacts and processes, so promoting a release
+// does not rebuild it.
+func promoteApp(app *ct.App, p ct.Promotion, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, dr *deployer, r ResponseHelper) {
+	source, err := apps.GetRelease(app.ID)
+	if err == ErrNotFound {
+		err = ct.ValidationError{Field: "app", Message: "has no release to promote"}
+	}
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	data, err := apps.Get(p.TargetAppID)
+	if err == ErrNotFound {
+		err = ct.ValidationError{Field: "target", Message: "does not exist"}
+	}
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	target := data.(*ct.App)
+	if target.ID == app.ID {
+		r.Error(ct.ValidationError{Field: "target", Message: "must not be the source app"})
+		return
+	}
+	for k := range p.Env {
+		if k == "" || strings.Contains(k, "=") {
+			r.Error(ct.ValidationError{Field: "env", Message: "names must not be empty or contain ="})
+			return
+		}
+	}
+
+	d := &ct.Deployment{
+		Strategy:        p.Strategy,
+		CanaryPercent:   p.CanaryPercent,
+		DeployTimeout:   p.DeployTimeout,
+		ProcessTimeouts: p.ProcessTimeouts,
+		Processes:       p.Processes,
+	}
+	if err := validateDeployStrategy(d); err != nil {
+		r.Error(err)
+		return
+	}
+
+	release := promotedRelease(app, source, &p)
+	if err := releases.Add(release); err != nil {
+		r.Error(err)
+		return
+	}
+	if err := startDeployment(target, d, release, apps, formations, dr); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, d)
+}
+
+// promotedRelease returns a new release for the promotion's target app with
+// the artifacts and processes of the source release.
+func promotedRelease(app *ct.App, source *ct.Release, p *ct.Promotion) *ct.Release {
+	env := make(map[string]string, len(source.Env)+len(p.Env))
+	for k, v := range source.Env {
+		env[k] = v
+	}
+	for _, k := range p.UnsetEnv {
+		delete(env, k)
+	}
+	for k, v := range p.Env {
+		env[k] = v
+	}
+	meta := make(map[string]string, len(source.Meta)+2)
+	for k, v := range source.Meta {
+		meta[k] = v
+	}
+	meta[ct.ReleaseMetaPromotedFrom] = app.ID
+	meta[ct.ReleaseMetaPromotedRelease] = source.ID
+	return &ct.Release{
+		ArtifactID:  source.ArtifactID,
+		ArtifactIDs: source.ArtifactIDs,
+		Env:         env,
+		Processes:   source.Processes,
+		Meta:        meta,
+	}
+}
+
+func getDeploymentMiddleware(c martini.Context, app *ct.App, params martini.Params, repo *DeploymentRepo, r ResponseHelper) {
+	d, err := repo.Get(params["deployments_id"])
+	if err == nil && d.AppID != app.ID {
+		err = ErrNotFound
+	}
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	c.Map(d)
+}
+
+// getDeployment responds with the deployment, or streams its events if the
+// client accepts event streams.
+func getDeployment(req *http.Request, w http.ResponseWriter, d *ct.Deployment, repo *DeploymentRepo, r ResponseHelper) {
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		if err := streamDeployment(req, w, d, repo); err != nil {
+			r.Error(err)
+		}
+		return
+	}
+	r.JSON(200, d)
+}
+
+// streamDeployment sends the deployment's events as server-sent events,
+// starting with the first event, until the deployment finishes.
+func streamDeployment(req *http.Request, w http.ResponseWriter, d *ct.Deployment, repo *DeploymentRepo) (err error) {
+	connected := make(chan struct{})
+	done := make(chan struct{})
+	listenEvent := func(ev pq.ListenerEventType, listenErr error) {
+		switch ev {
+		case pq.ListenerEventConnected:
+			close(connected)
+		case pq.ListenerEventDisconnected:
+			close(done)
+		case pq.ListenerEventConnectionAttemptFailed:
+			err = listenErr
+			close(done)
+		}
+	}
+	listener := pq.NewListener(repo.db.DSN(), 10*time.Second, time.Minute, listenEvent)
+	defer listener.Close()
+	listener.Listen("deployment_events:" + formatUUID(d.ID))
+
+	select {
+	case <-done:
+		return
+	case <-connected:
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	sendKeepAlive := func() error {
+		if _, err := w.Write([]byte(":\n")); err != nil {
+			return err
+		}
+		w.(http.Flusher).Flush()
+		return nil
+	}
+	if err = sendKeepAlive(); err != nil {
+		return
+	}
+
+	var currID int64
+	// sendEvent sends the event, returning false once the deployment has
+	// finished
+	sendEvent := func(e *ct.DeploymentEvent) (bool, error) {
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: ", e.ID); err != nil {
+			return false, err
+		}
+		if err := json.NewEncoder(w).Encode(e); err != nil {
+			return false, err
+		}
+		if _, err := w.Write([]byte("\n")); err != nil {
+			return false, err
+		}
+		w.(http.Flusher).Flush()
+		currID = e.ID
+		return e.Status != ct.DeploymentStatusComplete && e.Status != ct.DeploymentStatusFailed, nil
+	}
+
+	events, err := repo.listEvents(d.ID, 0)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if more, err := sendEvent(e); !more || err != nil {
+			return err
+		}
+	}
+
+	closed := w.(http.CloseNotifier).CloseNotify()
+	for {
+		select {
+		case <-done:
+			return
+		case <-closed:
+			return
+		case <-time.After(30 * time.Second):
+			if err := sendKeepAlive(); err != nil {
+				return err
+			}
+		case n := <-listener.Notify:
+			if n == nil {
+				continue
+			}
+			id, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				return err
+			}
+			if id <= currID {
+				continue
+			}
+			e, err := repo.getEvent(id)
+			if err != nil {
+				return err
+			}
+			if more, err := sendEvent(e); !more || err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func (s *S) createDeployTestApp(c *C, name string) (*ct.App, *ct.Release, *ct.Release) {
+	app := s.createTestApp(c, &ct.App{Name: name})
+	processes := map[string]ct.ProcessType{"web": {Cmd: []string{"start", "web"}}}
+	oldRelease := s.createTestRelease(c, &ct.Release{Processes: processes})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: oldRelease.ID, Processes: map[string]int{"web": 2}})
+	s.setAppRelease(c, app.ID, oldRelease.ID)
+	newRelease := s.createTestRelease(c, &ct.Release{Processes: processes})
+	return app, oldRelease, newRelease
+}
+
+// startDeployJobs acts as the scheduler, starting jobs for the new release
+// each time its formation is scaled up. It runs in its own goroutine so
+// errors are left to be caught by the deployment timing out.
+func (s *S) startDeployJobs(app *ct.App, release *ct.Release, total int) {
+	var started int
+	for i := 0; started < total && i < 100; i++ {
+		f := &ct.Formation{}
+		if res, err := s.Get(formationPath(app.ID, release.ID), f); err == nil && res.StatusCode == 200 {
+			for ; started < f.Processes["web"]; started++ {
+				job := &ct.Job{ID: random.UUID() + "-" + random.UUID(), AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"}
+				s.Put("/apps/"+app.ID+"/jobs/"+job.ID, job, nil)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (s *S) TestDeployment(c *C) {
+	for _, strategy := range []string{ct.DeployStrategyAllAtOnce, ct.DeployStrategyOneByOne, ct.DeployStrategyCanary} {
+		app, oldRelease, newRelease := s.createDeployTestApp(c, "deploy-"+strategy)
+
+		deployment := &ct.Deployment{NewReleaseID: newRelease.ID, Strategy: strategy, CanaryPercent: 50}
+		res, err := s.Post(fmt.Sprintf("/apps/%s/deploy", app.ID), deployment, deployment)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 200)
+		c.Assert(deployment.ID, Not(Equals), "")
+		c.Assert(deployment.OldReleaseID, Equals, oldRelease.ID)
+		c.Assert(deployment.Processes, DeepEquals, map[string]int{"web": 2})
+
+		client, err := controller.NewClient(s.srv.URL, authKey)
+		c.Assert(err, IsNil)
+		events := make(chan *ct.DeploymentEvent)
+		stream, err := client.StreamDeployment(app.ID, deployment.ID, events)
+		c.Assert(err, IsNil)
+
+		go s.startDeployJobs(app, newRelease, 2)
+
+		var last *ct.DeploymentEvent
+		timeout := time.After(10 * time.Second)
+	loop:
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					break loop
+				}
+				last = e
+			case <-timeout:
+				c.Fatalf("timed out waiting for %s deployment", strategy)
+			}
+		}
+		stream.Close()
+		c.Assert(last, NotNil)
+		c.Assert(last.Status, Equals, ct.DeploymentStatusComplete)
+
+		got, err := client.GetDeployment(app.ID, deployment.ID)
+		c.Assert(err, IsNil)
+		c.Assert(got.Status, Equals, ct.DeploymentStatusComplete)
+		c.Assert(got.FinishedAt, NotNil)
+
+		current := &ct.Release{}
+		_, err = s.Get("/apps/"+app.ID+"/release", current)
+		c.Assert(err, IsNil)
+		c.Assert(current.ID, Equals, newRelease.ID)
+		res, err = s.Get(formationPath(app.ID, oldRelease.ID), &ct.Formation{})
+		c.Assert(res.StatusCode, Equals, 404)
+	}
+}
+
+func (s *S) TestDeploymentValidation(c *C) {
+	app, oldRelease, newRelease := s.createDeployTestApp(c, "deploy-validation")
+	path := fmt.Sprintf("/apps/%s/deploy", app.ID)
+
+	for _, d := range []*ct.Deployment{
+		{NewReleaseID: oldRelease.ID},
+		{NewReleaseID: newRelease.ID, Strategy: "blue-green"},
+		{NewReleaseID: newRelease.ID, Strategy: ct.DeployStrategyCanary},
+		{NewReleaseID: newRelease.ID, ProcessTimeouts: map[string]int{"web": -1}},
+		{NewReleaseID: random.UUID()},
+	} {
+		res, err := s.Post(path, d, nil)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+}
+
+func (s *S) TestDeploymentRollback(c *C) {
+	for _, crash := range []bool{false, true} {
+		app, oldRelease, newRelease := s.createDeployTestApp(c, fmt.Sprintf("deploy-rollback-%t", crash))
+
+		deployment := &ct.Deployment{NewReleaseID: newRelease.ID, DeployTimeout: 1}
+		res, err := s.Post(fmt.Sprintf("/apps/%s/deploy", app.ID), deployment, deployment)
+		c.Assert(err, IsNil)
+		c.Assert(res.StatusCode, Equals, 200)
+		c.Assert(deployment.DeployTimeout, Equals, 1)
+
+		client, err := controller.NewClient(s.srv.URL, authKey)
+		c.Assert(err, IsNil)
+		events := make(chan *ct.DeploymentEvent)
+		stream, err := client.StreamDeployment(app.ID, deployment.ID, events)
+		c.Assert(err, IsNil)
+
+		if crash {
+			// wait for the new release to be scaled so the deployer is
+			// watching for job events
+			for i := 0; i < 20; i++ {
+				if res, err := s.Get(formationPath(app.ID, newRelease.ID), &ct.Formation{}); err == nil && res.StatusCode == 200 {
+					break
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			job := &ct.Job{ID: random.UUID() + "-" + random.UUID(), AppID: app.ID, ReleaseID: newRelease.ID, Type: "web", State: "crashed"}
+			s.createTestJob(c, job)
+		}
+
+		var rollingBack bool
+		var last *ct.DeploymentEvent
+		timeout := time.After(10 * time.Second)
+	loop:
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					break loop
+				}
+				if e.Status == ct.DeploymentStatusRollingBack {
+					rollingBack = true
+				}
+				last = e
+			case <-timeout:
+				c.Fatal("timed out waiting for deployment to fail")
+			}
+		}
+		stream.Close()
+		c.Assert(rollingBack, Equals, true)
+		c.Assert(last, NotNil)
+		c.Assert(last.Status, Equals, ct.DeploymentStatusFailed)
+		if crash {
+			c.Assert(last.Error, Matches, "web job .* crashed .*")
+		} else {
+			c.Assert(last.Error, Matches, `timed out .* \(web: 0 of 2 jobs up\) .*`)
+		}
+
+		current := &ct.Release{}
+		_, err = s.Get("/apps/"+app.ID+"/release", current)
+		c.Assert(err, IsNil)
+		c.Assert(current.ID, Equals, oldRelease.ID)
+		formation := &ct.Formation{}
+		_, err = s.Get(formationPath(app.ID, oldRelease.ID), formation)
+		c.Assert(err, IsNil)
+		c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+		res, err = s.Get(formationPath(app.ID, newRelease.ID), &ct.Formation{})
+		c.Assert(res.StatusCode, Equals, 404)
+	}
+}
+
+func (s *S) TestDeploymentProcessTimeout(c *C) {
+	app, oldRelease, newRelease := s.createDeployTestApp(c, "deploy-process-timeout")
+
+	deployment := &ct.Deployment{NewReleaseID: newRelease.ID, DeployTimeout: 60, ProcessTimeouts: map[string]int{"web": 1}}
+	res, err := s.Post(fmt.Sprintf("/apps/%s/deploy", app.ID), deployment, deployment)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(deployment.ProcessTimeouts, DeepEquals, map[string]int{"web": 1})
+
+	client, err := controller.NewClient(s.srv.URL, authKey)
+	c.Assert(err, IsNil)
+	events := make(chan *ct.DeploymentEvent)
+	stream, err := client.StreamDeployment(app.ID, deployment.ID, events)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	// the web timeout applies rather than the deployment wide one
+	var last *ct.DeploymentEvent
+	timeout := time.After(10 * time.Second)
+loop:
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				break loop
+			}
+			last = e
+		case <-timeout:
+			c.Fatal("timed out waiting for deployment to fail")
+		}
+	}
+	c.Assert(last, NotNil)
+	c.Assert(last.Status, Equals, ct.DeploymentStatusFailed)
+	c.Assert(last.Error, Matches, `timed out after 1s .* \(web: 0 of 2 jobs up\) .*`)
+
+	got := &ct.Deployment{}
+	_, err = s.Get(fmt.Sprintf("/apps/%s/deployments/%s", app.ID, deployment.ID), got)
+	c.Assert(err, IsNil)
+	c.Assert(got.ProcessTimeouts, DeepEquals, map[string]int{"web": 1})
+
+	current := &ct.Release{}
+	_, err = s.Get("/apps/"+app.ID+"/release", current)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, oldRelease.ID)
+}
+
+func (s *S) TestDeploymentRecover(c *C) {
+	var dr *deployer
+	s.m.Invoke(func(d *deployer) { dr = d })
+
+	// a deployment interrupted after scaling both releases halfway
+	app, oldRelease, newRelease := s.createDeployTestApp(c, "deploy-recover")
+	deployment := &ct.Deployment{AppID: app.ID, OldReleaseID: oldRelease.ID, NewReleaseID: newRelease.ID, Strategy: ct.DeployStrategyOneByOne, Processes: map[string]int{"web": 2}}
+	c.Assert(dr.repo.Add(deployment), IsNil)
+	c.Assert(dr.repo.SetStatus(deployment, ct.DeploymentStatusRunning, ""), IsNil)
+	c.Assert(dr.repo.setOldProcesses(deployment.ID, map[string]int{"web": 2}), IsNil)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: oldRelease.ID, Processes: map[string]int{"web": 1}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: newRelease.ID, Processes: map[string]int{"web": 1}})
+
+	// a deployment which is still being run by another controller
+	running, _, runningRelease := s.createDeployTestApp(c, "deploy-recover-running")
+	runningDeployment := &ct.Deployment{AppID: running.ID, NewReleaseID: runningRelease.ID, Strategy: ct.DeployStrategyAllAtOnce}
+	c.Assert(dr.repo.Add(runningDeployment), IsNil)
+	lock, _, err := dr.repo.lock(runningDeployment.ID, true)
+	c.Assert(err, IsNil)
+	defer lock.Rollback()
+
+	c.Assert(dr.Recover(), IsNil)
+
+	got, err := dr.repo.Get(deployment.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.Status, Equals, ct.DeploymentStatusFailed)
+	c.Assert(got.FinishedAt, NotNil)
+	events, err := dr.repo.listEvents(deployment.ID, 0)
+	c.Assert(err, IsNil)
+	c.Assert(events[len(events)-1].Error, Equals, fmt.Sprintf("%s (rolled back to release %s)", errDeployInterrupted, oldRelease.ID))
+
+	current := &ct.Release{}
+	_, err = s.Get("/apps/"+app.ID+"/release", current)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, oldRelease.ID)
+	formation := &ct.Formation{}
+	_, err = s.Get(formationPath(app.ID, oldRelease.ID), formation)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 2})
+	res, err := s.Get(formationPath(app.ID, newRelease.ID), &ct.Formation{})
+	c.Assert(res.StatusCode, Equals, 404)
+
+	// the app can be deployed again
+	c.Assert(dr.repo.Add(&ct.Deployment{AppID: app.ID, OldReleaseID: oldRelease.ID, NewReleaseID: newRelease.ID, Strategy: ct.DeployStrategyAllAtOnce}), IsNil)
+
+	got, err = dr.repo.Get(runningDeployment.ID)
+	c.Assert(err, IsNil)
+	c.Assert(got.Status, Equals, ct.DeploymentStatusPending)
+	c.Assert(got.FinishedAt, IsNil)
+}
+
+func (s *S) TestRollback(c *C) {
+	app, oldRelease, newRelease := s.createDeployTestApp(c, "rollback")
+	path := "/apps/" + app.ID + "/rollback"
+
+	// the app has not had a previous release
+	res, _ := s.Post(path, &ct.Rollback{}, &ct.Deployment{})
+	c.Assert(res.StatusCode, Equals, 400)
+
+	s.setAppRelease(c, app.ID, newRelease.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: newRelease.ID, Processes: map[string]int{"web": 3}})
+	_, err := s.Delete(formationPath(app.ID, oldRelease.ID))
+	c.Assert(err, IsNil)
+
+	d := &ct.Deployment{}
+	_, err = s.Post(path, &ct.Rollback{}, d)
+	c.Assert(err, IsNil)
+	c.Assert(d.Strategy, Equals, ct.DeployStrategyRollback)
+	c.Assert(d.Status, Equals, ct.DeploymentStatusComplete)
+	c.Assert(d.OldReleaseID, Equals, newRelease.ID)
+	c.Assert(d.NewReleaseID, Equals, oldRelease.ID)
+	c.Assert(d.Processes, DeepEquals, map[string]int{"web": 3})
+	c.Assert(d.FinishedAt, NotNil)
+
+	current := &ct.Release{}
+	_, err = s.Get("/apps/"+app.ID+"/release", current)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, oldRelease.ID)
+	formation := &ct.Formation{}
+	_, err = s.Get(formationPath(app.ID, oldRelease.ID), formation)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Processes, DeepEquals, map[string]int{"web": 3})
+	res, _ = s.Get(formationPath(app.ID, newRelease.ID), &ct.Formation{})
+	c.Assert(res.StatusCode, Equals, 404)
+
+	// the rollback is recorded as a deployment
+	got := &ct.Deployment{}
+	_, err = s.Get(fmt.Sprintf("/apps/%s/deployments/%s", app.ID, d.ID), got)
+	c.Assert(err, IsNil)
+	c.Assert(got.Strategy, Equals, ct.DeployStrategyRollback)
+
+	// rolling back to a specific release
+	res, _ = s.Post(path, &ct.Rollback{ReleaseID: oldRelease.ID}, &ct.Deployment{})
+	c.Assert(res.StatusCode, Equals, 400)
+	_, err = s.Post(path, &ct.Rollback{ReleaseID: newRelease.ID}, d)
+	c.Assert(err, IsNil)
+	c.Assert(d.NewReleaseID, Equals, newRelease.ID)
+	res, _ = s.Post(path, &ct.Rollback{ReleaseID: random.UUID()}, &ct.Deployment{})
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestPromote(c *C) {
+	staging := s.createTestApp(c, &ct.App{Name: "promote-staging"})
+	production, oldRelease, _ := s.createDeployTestApp(c, "promote-production")
+	path := "/apps/" + staging.ID + "/promote"
+
+	// the source app has no release
+	res, _ := s.Post(path, &ct.Promotion{TargetAppID: production.ID}, &ct.Deployment{})
+	c.Assert(res.StatusCode, Equals, 400)
+
+	release := s.createTestRelease(c, &ct.Release{
+		Env:       map[string]string{"A": "1", "DEBUG": "true"},
+		Processes: map[string]ct.ProcessType{"web": {Cmd: []string{"start", "web"}}},
+		Meta:      map[string]string{ct.ReleaseMetaGitCommit: "f1d2d2f924e986ac86fdf7b36c94bcdf32beec15"},
+	})
+	s.setAppRelease(c, staging.ID, release.ID)
+
+	for _, p := range []*ct.Promotion{
+		{},
+		{TargetAppID: "promote-missing"},
+		{TargetAppID: staging.Name},
+		{TargetAppID: production.ID, Strategy: "blue-green"},
+		{TargetAppID: production.ID, Env: map[string]string{"A=B": "1"}},
+	} {
+		res, _ := s.Post(path, p, &ct.Deployment{})
+		c.Assert(res.StatusCode, Equals, 400, Commentf("%+v", p))
+	}
+
+	d := &ct.Deployment{}
+	_, err := s.Post(path, &ct.Promotion{
+		TargetAppID:   production.Name,
+		Env:           map[string]string{"A": "2"},
+		UnsetEnv:      []string{"DEBUG"},
+		DeployTimeout: 1,
+	}, d)
+	c.Assert(err, IsNil)
+	c.Assert(d.AppID, Equals, production.ID)
+	c.Assert(d.OldReleaseID, Equals, oldRelease.ID)
+	c.Assert(d.Processes, DeepEquals, map[string]int{"web": 2})
+
+	// the promoted release is a copy of the staging release
+	promoted := &ct.Release{}
+	_, err = s.Get("/releases/"+d.NewReleaseID, promoted)
+	c.Assert(err, IsNil)
+	c.Assert(promoted.ID, Not(Equals), release.ID)
+	c.Assert(promoted.ArtifactID, Equals, release.ArtifactID)
+	c.Assert(promoted.Processes, DeepEquals, release.Processes)
+	c.Assert(promoted.Env, DeepEquals, map[string]string{"A": "2"})
+	c.Assert(promoted.Meta[ct.ReleaseMetaGitCommit], Equals, release.Meta[ct.ReleaseMetaGitCommit])
+	c.Assert(promoted.Meta[ct.ReleaseMetaPromotedFrom], Equals, staging.ID)
+	c.Assert(promoted.Meta[ct.ReleaseMetaPromotedRelease], Equals, release.ID)
+
+	// the staging app is unchanged
+	current := &ct.Release{}
+	_, err = s.Get("/apps/"+staging.ID+"/release", current)
+	c.Assert(err, IsNil)
+	c.Assert(current.ID, Equals, release.ID)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// Env returns the app level environment of the app.
+func (r *AppRepo) Env(appID string) (map[string]string, error) {
+	var env hstore.Hstore
+	if err := r.db.QueryRow("SELECT env FROM apps WHERE app_id = $1 AND deleted_at IS NULL", appID).Scan(&env); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	return hstoreStrings(env), nil
+}
+
+// UpdateEnv applies the update to the app level environment of the app and
+// returns the result. The app's formations are touched so that the scheduler
+// starts new jobs with the new environment.
+func (r *AppRepo) UpdateEnv(appID string, u *ct.EnvUpdate) (map[string]string, error) {
+	for k := range u.Set {
+		if k == "" || strings.Contains(k, "=") {
+			return nil, ct.ValidationError{Field: "set", Message: "names must not be empty or contain ="}
+		}
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var h hstore.Hstore
+	if err := tx.QueryRow("SELECT env FROM apps WHERE app_id = $1 AND deleted_at IS NULL FOR UPDATE", appID).Scan(&h); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	env := hstoreStrings(h)
+	if env == nil {
+		env = make(map[string]string, len(u.Set))
+	}
+	for k, v := range u.Set {
+		env[k] = v
+	}
+	for _, k := range u.Unset {
+		delete(env, k)
+	}
+	if _, err := tx.Exec("UPDATE apps SET env = $2, updated_at = now(), version = version + 1 WHERE app_id = $1", appID, stringHstore(env)); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec("UPDATE formations SET updated_at = now() WHERE app_id = $1 AND deleted_at IS NULL", appID); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return env, tx.Commit()
+}
+
+func getAppEnv(app *ct.App, repo *AppRepo, r ResponseHelper) {
+	env, err := repo.Env(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if env == nil {
+		env = map[string]string{}
+	}
+	r.JSON(200, &ct.AppEnv{Env: env})
+}
+
+func updateAppEnv(app *ct.App, u ct.EnvUpdate, apps *AppRepo, releases *ReleaseRepo, formations *FormationRepo, r ResponseHelper) {
+	var release *ct.Release
+	if u.NewRelease {
+		var err error
+		release, err = apps.GetRelease(app.ID)
+		if err == ErrNotFound {
+			err = ct.ValidationError{Field: "new_release", Message: "app has no release to copy"}
+		}
+		if err != nil {
+			r.Error(err)
+			return
+		}
+	}
+
+	env, err := apps.UpdateEnv(app.ID, &u)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	res := &ct.AppEnv{Env: env}
+
+	if release != nil {
+		release.ID = ""
+		release.CreatedAt = nil
+		if err := releases.Add(release); err != nil {
+			r.Error(err)
+			return
+		}
+		if err := apps.SetRelease(app.ID, release.ID); err != nil {
+			r.Error(err)
+			return
+		}
+		if err := moveFormation(formations, app.ID, release.ID); err != nil {
+			r.Error(err)
+			return
+		}
+		res.ReleaseID = release.ID
+	}
+	r.JSON(200, res)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var ErrPreconditionFailed = errors.New("controller: precondition failed")
+
+// ErrConflict is returned when an update includes the version of the object
+// it was based on, and the object has since been modified.
+var ErrConflict = errors.New("controller: version conflict")
+
+// objectETag returns a strong entity tag for the JSON representation of v.
+func objectETag(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf(`"%x"`, sha1.Sum(data))
+}
+
+func setETag(w http.ResponseWriter, v interface{}) {
+	if tag := objectETag(v); tag != "" {
+		w.Header().Set("ETag", tag)
+	}
+}
+
+// checkIfMatch returns ErrPreconditionFailed if the request has an If-Match
+// header that doesn't match the current object, current is nil if the object
+// does not exist.
+func checkIfMatch(req *http.Request, current interface{}) error {
+	match := req.Header.Get("If-Match")
+	if match == "" {
+		return nil
+	}
+	if current == nil {
+		return ErrPreconditionFailed
+	}
+	if match == "*" {
+		return nil
+	}
+	tag := objectETag(current)
+	for _, m := range strings.Split(match, ",") {
+		if strings.TrimSpace(m) == tag {
+			return nil
+		}
+	}
+	return ErrPreconditionFailed
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+type EventRepo struct {
+	db *DB
+}
+
+func NewEventRepo(db *DB) *EventRepo {
+	return &EventRepo{db}
+}
+
+// createEvent records an event for the object, data is stored as JSON.
+func createEvent(db rowQueryer, appID, objectType, objectID string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	var app *string
+	if appID != "" {
+		app = &appID
+	}
+	var id int64
+	return db.QueryRow("INSERT INTO events (app_id, object_type, object_id, data) VALUES ($1, $2, $3, $4) RETURNING event_id", app, objectType, objectID, string(encoded)).Scan(&id)
+}
+
+// eventFilter limits events to those of an app and object types created
+// within a time range, zero fields are not used to filter.
+type eventFilter struct {
+	appID       string
+	objectTypes []string
+	since       time.Time
+	until       time.Time
+}
+
+func (f *eventFilter) match(e *ct.Event) bool {
+	if f.appID != "" && e.AppID != f.appID {
+		return false
+	}
+	if e.CreatedAt != nil {
+		if !f.since.IsZero() && e.CreatedAt.Before(f.since) {
+			return false
+		}
+		if !f.until.IsZero() && !e.CreatedAt.Before(f.until) {
+			return false
+		}
+	}
+	if len(f.objectTypes) == 0 {
+		return true
+	}
+	for _, t := range f.objectTypes {
+		if e.ObjectType == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *EventRepo) ListEvents(filter *eventFilter, sinceID int64, count int) ([]*ct.Event, error) {
+	query := "SELECT event_id, app_id, object_type, object_id, data, created_at FROM events WHERE event_id > $1"
+	args := []interface{}{sinceID}
+	if filter.appID != "" {
+		args = append(args, filter.appID)
+		query += fmt.Sprintf(" AND app_id = $%d", len(args))
+	}
+	if len(filter.objectTypes) > 0 {
+		placeholders := make([]string, len(filter.objectTypes))
+		for i, t := range filter.objectTypes {
+			args = append(args, t)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		query += fmt.Sprintf(" AND object_type IN (%s)", strings.Join(placeholders, ", "))
+	}
+	if !filter.since.IsZero() {
+		args = append(args, filter.since)
+		query += fmt.Sprintf(" AND created_at >= $%d", len(args))
+	}
+	if !filter.until.IsZero() {
+		args = append(args, filter.until)
+		query += fmt.Sprintf(" AND created_at < $%d", len(args))
+	}
+	query += " ORDER BY event_id DESC"
+	if count > 0 {
+		args = append(args, count)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var events []*ct.Event
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// LastEventID returns the ID of the most recent event, or zero if there are
+// no events.
+func (r *EventRepo) LastEventID() (int64, error) {
+	var id int64
+	return id, r.db.QueryRow("SELECT COALESCE(MAX(event_id), 0) FROM events").Scan(&id)
+}
+
+func (r *EventRepo) GetEvent(id int64) (*ct.Event, error) {
+	row := r.db.QueryRow("SELECT event_id, app_id, object_type, object_id, data, created_at FROM events WHERE event_id = $1", id)
+	return scanEvent(row)
+}
+
+func scanEvent(s Scanner) (*ct.Event, error) {
+	event := &ct.Event{}
+	var appID *string
+	var data []byte
+	err := s.Scan(&event.ID, &appID, &event.ObjectType, &event.ObjectID, &data, &event.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	if appID != nil {
+		event.AppID = cleanUUID(*appID)
+	}
+	if len(data) > 0 {
+		event.Data = json.RawMessage(data)
+	}
+	return event, nil
+}
+
+// defaultEventCount is the number of events listed when the count parameter
+// is not set.
+const defaultEventCount = 100
+
+func streamEvents(req *http.Request, w http.ResponseWriter, repo *EventRepo, r ResponseHelper) {
+	if isLongPoll(req) {
+		pollEvents(req, w, repo, r)
+		return
+	}
+	if !strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		listEvents(req, repo, r)
+		return
+	}
+	if err := serveEventStream(req, w, repo); err != nil {
+		r.Error(err)
+	}
+}
+
+// listEvents responds with the events matching the request's parameters,
+// most recent first.
+func listEvents(req *http.Request, repo *EventRepo, r ResponseHelper) {
+	lastID, count, filter, err := parseEventParams(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if count <= 0 {
+		count = defaultEventCount
+	}
+	events, err := repo.ListEvents(filter, lastID, count)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	if events == nil {
+		events = []*ct.Event{}
+	}
+	r.JSON(200, events)
+}
+
+// parseEventParams parses the ID of the last event seen by the client, the
+// number of past events to send and the event filter from the request. The
+// since and until parameters limit events to a time range.
+func parseEventParams(req *http.Request) (lastID int64, count int, filter *eventFilter, err error) {
+	if id := req.Header.Get("Last-Event-Id"); id != "" {
+		lastID, err = strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			err = ct.ValidationError{Field: "Last-Event-Id", Message: "is invalid"}
+			return
+		}
+	} else if id := req.FormValue("since_id"); id != "" {
+		lastID, err = strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			err = ct.ValidationError{Field: "since_id", Message: "is invalid"}
+			return
+		}
+	}
+	if req.FormValue("count") != "" {
+		count, err = strconv.Atoi(req.FormValue("count"))
+		if err != nil {
+			err = ct.ValidationError{Field: "count", Message: "is invalid"}
+			return
+		}
+	}
+	filter = &eventFilter{appID: req.FormValue("app_id")}
+	if types := req.FormValue("object_types"); types != "" {
+		filter.objectTypes = strings.Split(types, ",")
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &filter.since}, {"until", &filter.until}} {
+		v := req.FormValue(p.name)
+		if v == "" {
+			continue
+		}
+		if *p.t, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			err = ct.ValidationError{Field: p.name, Message: "must be an RFC3339 timestamp"}
+			return
+		}
+	}
+	return
+}
+
+func serveEventStream(req *http.Request, w http.ResponseWriter, repo *EventRepo) (err error) {
+	lastID, count, filter, err := parseEventParams(req)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+
+	sendKeepAlive := func() error {
+		if _, err := w.Write([]byte(":\n")); err != nil {
+			return err
+		}
+		w.(http.Flusher).Flush()
+		return nil
+	}
+	if err = sendKeepAlive(); err != nil {
+		return
+	}
+
+	var currID int64
+	sendEvent := func(e *ct.Event) error {
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: ", e.ID, e.ObjectType); err != nil {
+			return err
+		}
+		if err := json.NewEncoder(w).Encode(e); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte("\n")); err != nil {
+			return err
+		}
+		w.(http.Flusher).Flush()
+		currID = e.ID
+		return nil
+	}
+
+	connected := make(chan struct{})
+	done := make(chan struct{})
+	listenEvent := func(ev pq.ListenerEventType, listenErr error) {
+		switch ev {
+		case pq.ListenerEventConnected:
+			close(connected)
+		case pq.ListenerEventDisconnected:
+			close(done)
+		case pq.ListenerEventConnectionAttemptFailed:
+			err = listenErr
+			close(done)
+		}
+	}
+	listener := pq.NewListener(repo.db.DSN(), 10*time.Second, time.Minute, listenEvent)
+	defer listener.Close()
+	listener.Listen("events")
+
+	select {
+	case <-done:
+		return
+	case <-connected:
+	}
+
+	// Send past events after starting to listen so that none are missed,
+	// events that are also notified are skipped using currID.
+	if lastID > 0 || count > 0 {
+		events, err := repo.ListEvents(filter, lastID, count)
+		if err != nil {
+			return err
+		}
+		// events are in ID DESC order, so iterate in reverse
+		for i := len(events) - 1; i >= 0; i-- {
+			if err := sendEvent(events[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	closed := w.(http.CloseNotifier).CloseNotify()
+	for {
+		select {
+		case <-done:
+			return
+		case <-closed:
+			return
+		case <-time.After(30 * time.Second):
+			if err := sendKeepAlive(); err != nil {
+				return err
+			}
+		case n := <-listener.Notify:
+			id, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err != nil {
+				return err
+			}
+			if id <= currID {
+				continue
+			}
+			e, err := repo.GetEvent(id)
+			if err != nil {
+				return err
+			}
+			if !filter.match(e) {
+				continue
+			}
+			if err = sendEvent(e); err != nil {
+				return err
+			}
+		}
+	}
+}
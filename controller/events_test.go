@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func (s *S) TestStreamEvents(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "stream-events"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{ReleaseID: release.ID, AppID: app.ID})
+	jobID := random.UUID() + "-" + random.UUID()
+	s.createTestJob(c, &ct.Job{ID: jobID, AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"})
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/events?app_id=%s&object_types=job&count=10", s.srv.URL, app.ID), nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	r := bufio.NewReader(res.Body)
+	for {
+		line, err := r.ReadBytes('\n')
+		c.Assert(err, IsNil)
+		if !bytes.HasPrefix(line, []byte("data: ")) {
+			continue
+		}
+		var event ct.Event
+		c.Assert(json.Unmarshal(bytes.TrimPrefix(line, []byte("data: ")), &event), IsNil)
+		c.Assert(event.AppID, Equals, app.ID)
+		c.Assert(event.ObjectType, Equals, ct.EventTypeJob)
+		c.Assert(event.ObjectID, Equals, jobID)
+		var job ct.Job
+		c.Assert(json.Unmarshal(event.Data, &job), IsNil)
+		c.Assert(job.State, Equals, "up")
+		break
+	}
+}
+
+func (s *S) TestListEvents(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "list-events"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.setAppRelease(c, app.ID, release.ID)
+
+	var events []*ct.Event
+	res, err := s.Get(fmt.Sprintf("/events?app_id=%s&object_types=%s,%s", app.ID, ct.EventTypeApp, ct.EventTypeAppRelease), &events)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(events, HasLen, 2)
+	c.Assert(events[0].ObjectType, Equals, ct.EventTypeAppRelease)
+	var data ct.AppReleaseEvent
+	c.Assert(json.Unmarshal(events[0].Data, &data), IsNil)
+	c.Assert(data.ReleaseID, Equals, release.ID)
+	c.Assert(events[1].ObjectType, Equals, ct.EventTypeApp)
+	c.Assert(events[1].ObjectID, Equals, app.ID)
+
+	// events created before the app are excluded by the time range
+	until := app.CreatedAt.Add(-time.Second).Format(time.RFC3339Nano)
+	events = nil
+	_, err = s.Get(fmt.Sprintf("/events?app_id=%s&until=%s", app.ID, url.QueryEscape(until)), &events)
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 0)
+
+	res, err = s.Get("/events?since=yesterday", &events)
+	c.Assert(res.StatusCode, Equals, 400)
+}
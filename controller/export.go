@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
+	ct "github.com/flynn/flynn/controller/types"
+	routerc "github.com/flynn/flynn/router/client"
+)
+
+// exportTables are the objects written to an export, each as a JSON array
+// in a file named after the table.
+var exportTables = []struct {
+	name  string
+	query string
+	scan  func(Scanner) (interface{}, error)
+}{
+	{
+		name:  "apps",
+		query: "SELECT " + appColumns + ", release_id, env, quota_max_jobs, quota_max_memory, quota_max_routes FROM apps WHERE deleted_at IS NULL ORDER BY created_at",
+		scan:  scanExportedApp,
+	},
+	{
+		name:  "artifacts",
+		query: "SELECT artifact_id, type, uri, size, sha256, created_at FROM artifacts WHERE deleted_at IS NULL ORDER BY created_at",
+		scan:  func(s Scanner) (interface{}, error) { return scanArtifact(s) },
+	},
+	{
+		name:  "releases",
+		query: "SELECT " + releaseColumns + " FROM releases WHERE deleted_at IS NULL ORDER BY created_at",
+		scan:  func(s Scanner) (interface{}, error) { return scanRelease(s) },
+	},
+	{
+		name:  "formations",
+		query: "SELECT " + formationColumns + " FROM formations WHERE deleted_at IS NULL ORDER BY created_at",
+		scan:  func(s Scanner) (interface{}, error) { return scanFormation(s) },
+	},
+	{
+		name:  "providers",
+		query: "SELECT provider_id, name, url, created_at, updated_at FROM providers WHERE deleted_at IS NULL ORDER BY created_at",
+		scan:  func(s Scanner) (interface{}, error) { return scanProvider(s) },
+	},
+	{
+		name: "resources",
+		query: `SELECT ` + resourceColumns + `
+		        FROM resources r JOIN providers p USING (provider_id)
+		        WHERE r.deleted_at IS NULL ORDER BY r.created_at`,
+		scan: func(s Scanner) (interface{}, error) { return scanResource(s) },
+	},
+}
+
+// extraScanner scans the columns following the ones read by a scan function
+// into extra.
+type extraScanner struct {
+	Scanner
+	extra []interface{}
+}
+
+func (s extraScanner) Scan(dest ...interface{}) error {
+	return s.Scanner.Scan(append(dest, s.extra...)...)
+}
+
+func scanExportedApp(s Scanner) (interface{}, error) {
+	var releaseID *string
+	var env hstore.Hstore
+	quota := &ct.AppQuota{}
+	app, err := scanApp(extraScanner{s, []interface{}{&releaseID, &env, &quota.MaxJobs, &quota.MaxMemory, &quota.MaxRoutes}})
+	if err != nil {
+		return nil, err
+	}
+	res := &ct.ExportedApp{App: app, Env: hstoreStrings(env)}
+	if releaseID != nil {
+		res.ReleaseID = cleanUUID(*releaseID)
+	}
+	if *quota != (ct.AppQuota{}) {
+		res.Quota = quota
+	}
+	return res, nil
+}
+
+// exportObjects reads all the objects in exportTables in a single read only
+// transaction, so that the export is a consistent snapshot of the database.
+func exportObjects(db *DB) (map[string][]interface{}, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY"); err != nil {
+		return nil, err
+	}
+	res := make(map[string][]interface{}, len(exportTables))
+	for _, t := range exportTables {
+		rows, err := tx.Query(t.query)
+		if err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for rows.Next() {
+			v, err := t.scan(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		res[t.name] = list
+	}
+	return res, nil
+}
+
+// exportCluster writes a tar archive of JSON files containing the
+// controller's objects and the cluster's routes. Routes are stored by the
+// router so are read after the database snapshot is taken.
+func exportCluster(w http.ResponseWriter, apps *AppRepo, router routerc.Client, r ResponseHelper) {
+	objects, err := exportObjects(apps.db)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	routes, err := router.ListRoutes("")
+	if err != nil {
+		r.Error(err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="flynn-export.tar"`)
+	w.WriteHeader(200)
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	write := func(name string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name + ".json", Mode: 0644, Size: int64(len(data)), ModTime: now}); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	}
+	for _, t := range exportTables {
+		if err := write(t.name, objects[t.name]); err != nil {
+			log.Println("export: error writing", t.name, err)
+			return
+		}
+	}
+	if err := write("routes", routes); err != nil {
+		log.Println("export: error writing routes", err)
+		return
+	}
+	if err := tw.Close(); err != nil {
+		log.Println("export: error closing archive", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/router/types"
+)
+
+func (s *S) TestExport(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "export"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+	route := s.createTestRoute(c, app.ID, (&router.TCPRoute{Service: "export"}).ToRoute())
+
+	req, err := http.NewRequest("GET", s.srv.URL+"/export", nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "application/x-tar")
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(res.Body)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		files[h.Name], err = ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+	}
+	for _, name := range []string{"apps", "artifacts", "releases", "formations", "providers", "resources", "routes"} {
+		c.Assert(files[name+".json"], NotNil, Commentf("file %s.json", name))
+	}
+
+	var apps []*ct.App
+	c.Assert(json.Unmarshal(files["apps.json"], &apps), IsNil)
+	found := false
+	for _, a := range apps {
+		if a.ID == app.ID {
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+
+	var formations []*ct.Formation
+	c.Assert(json.Unmarshal(files["formations.json"], &formations), IsNil)
+	found = false
+	for _, f := range formations {
+		if f.AppID == app.ID && f.ReleaseID == release.ID {
+			c.Assert(f.Processes, DeepEquals, map[string]int{"web": 1})
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+
+	var routes []*router.Route
+	c.Assert(json.Unmarshal(files["routes.json"], &routes), IsNil)
+	found = false
+	for _, r := range routes {
+		if r.ID == route.ID {
+			found = true
+		}
+	}
+	c.Assert(found, Equals, true)
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
@@ -48,31 +50,292 @@ func procsHstore(m map[string]int) hstore.Hstore {
 
 }
 
+// validateLimits checks that resource limits are within the range the host
+// can enforce.
+func validateLimits(field string, l ct.ResourceLimits) error {
+	switch {
+	case l.Memory < 0 || l.Memory > 0 && l.Memory < 4:
+		return ct.ValidationError{Field: joinField(field, "memory"), Message: "must be at least 4 MiB"}
+	case l.CPU < 0 || l.CPU > 0 && l.CPU < 2 || l.CPU > 262144:
+		return ct.ValidationError{Field: joinField(field, "cpu"), Message: "must be between 2 and 262144"}
+	case l.MaxFD < 0 || l.MaxFD > 0 && l.MaxFD < 16 || l.MaxFD > 1048576:
+		return ct.ValidationError{Field: joinField(field, "max_fd"), Message: "must be between 16 and 1048576"}
+	case l.MaxProcs < 0 || l.MaxProcs > 0 && l.MaxProcs < 16 || l.MaxProcs > 4194304:
+		return ct.ValidationError{Field: joinField(field, "max_procs"), Message: "must be between 16 and 4194304"}
+	case l.MaxCore < 0:
+		return ct.ValidationError{Field: joinField(field, "max_core"), Message: "must not be negative"}
+	case l.Disk < 0 || l.Disk > 0 && l.Disk < 16:
+		return ct.ValidationError{Field: joinField(field, "disk"), Message: "must be at least 16 MiB"}
+	case l.NetworkEgress < 0:
+		return ct.ValidationError{Field: joinField(field, "network_egress"), Message: "must not be negative"}
+	case l.NetworkIngress < 0:
+		return ct.ValidationError{Field: joinField(field, "network_ingress"), Message: "must not be negative"}
+	}
+	return nil
+}
+
+const formationColumns = "app_id, release_id, processes, limits, constraints, created_at, updated_at"
+
+// limitsJSON encodes formation limits for the limits column, which is NULL
+// if there are none.
+func limitsJSON(m map[string]ct.ResourceLimits) (*string, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	return nullableJSON(m)
+}
+
+// constraintsJSON encodes formation constraints for the constraints column,
+// which is NULL if there are none.
+func constraintsJSON(m map[string]ct.PlacementConstraints) (*string, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	return nullableJSON(m)
+}
+
+func nullableJSON(v interface{}) (*string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	s := string(data)
+	return &s, nil
+}
+
+// validateConstraints checks that the constraints of a process type can be
+// matched against host metadata.
+func validateConstraints(field string, c ct.PlacementConstraints) error {
+	for k := range c.HostTags {
+		if k == "" {
+			return ct.ValidationError{Field: joinField(field, "host_tags"), Message: "must not have empty keys"}
+		}
+		if k == ct.HostVolumesMetadata {
+			return ct.ValidationError{Field: joinField(joinField(field, "host_tags"), k), Message: "is reserved, use volumes instead"}
+		}
+	}
+	for _, v := range c.Volumes {
+		if v == "" || strings.ContainsAny(v, ", ") {
+			return ct.ValidationError{Field: joinField(field, "volumes"), Message: "must be names without commas or spaces"}
+		}
+	}
+	return nil
+}
+
 func (r *FormationRepo) Add(f *ct.Formation) error {
+	if f.StateHash != "" {
+		return r.addIfState(f)
+	}
 	// TODO: actually validate
 	procs := procsHstore(f.Processes)
-	err := r.db.QueryRow("INSERT INTO formations (app_id, release_id, processes) VALUES ($1, $2, $3) RETURNING created_at, updated_at",
-		f.AppID, f.ReleaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
+	limits, err := limitsJSON(f.Limits)
+	if err != nil {
+		return err
+	}
+	constraints, err := constraintsJSON(f.Constraints)
+	if err != nil {
+		return err
+	}
+	err = r.db.QueryRow("INSERT INTO formations (app_id, release_id, processes, limits, constraints) VALUES ($1, $2, $3, $4, $5) RETURNING created_at, updated_at",
+		f.AppID, f.ReleaseID, procs, limits, constraints).Scan(&f.CreatedAt, &f.UpdatedAt)
 	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
-		err = r.db.QueryRow("UPDATE formations SET processes = $3, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at",
-			f.AppID, f.ReleaseID, procs).Scan(&f.CreatedAt, &f.UpdatedAt)
+		err = r.db.QueryRow("UPDATE formations SET processes = $3, limits = $4, constraints = $5, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at",
+			f.AppID, f.ReleaseID, procs, limits, constraints).Scan(&f.CreatedAt, &f.UpdatedAt)
 	}
 	if err != nil {
 		return err
 	}
-	return nil
+	f.StateHash = ct.FormationStateHash(f.Processes, f.Limits)
+	return createEvent(r.db, f.AppID, ct.EventTypeFormation, f.AppID+":"+f.ReleaseID, f)
+}
+
+// addIfState is Add for an update based on the state with hash f.StateHash.
+// The formation is locked and ErrConflict returned if its state hash no
+// longer matches, so concurrent scale requests cannot overwrite each other.
+func (r *FormationRepo) addIfState(f *ct.Formation) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	current, err := scanFormation(tx.QueryRow("SELECT "+formationColumns+" FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL FOR UPDATE", f.AppID, f.ReleaseID))
+	if err == ErrNotFound {
+		current = &ct.Formation{StateHash: ct.FormationStateHash(nil, nil)}
+	} else if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if current.StateHash != f.StateHash {
+		tx.Rollback()
+		return ErrConflict
+	}
+	if err := upsertFormation(tx, f); err != nil {
+		tx.Rollback()
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+			// the formation was created by a concurrent request
+			return ErrConflict
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// maxFormationBatch is the largest number of formations UpdateBatch updates
+// at once.
+const maxFormationBatch = 1000
+
+// UpdateBatch applies the process counts of the batch in a single
+// transaction, the updated formations are returned in the order of the
+// batch. Protected apps can only be scaled down to zero if force is set.
+func (r *FormationRepo) UpdateBatch(batch []*ct.FormationScale, force bool) ([]*ct.Formation, error) {
+	if len(batch) > maxFormationBatch {
+		return nil, ct.ValidationError{Field: "formations", Message: fmt.Sprintf("must have at most %d formations", maxFormationBatch)}
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	formations := make([]*ct.Formation, len(batch))
+	seen := make(map[string]struct{}, len(batch))
+	for i, s := range batch {
+		f, err := r.scaleFormation(tx, fmt.Sprintf("formations[%d]", i), s, force, seen)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		formations[i] = f
+	}
+	return formations, tx.Commit()
+}
+
+// scaleFormation updates the formation of s in tx, field is the field of s in
+// the batch. Quotas are checked against the state outside the transaction,
+// which is why an app can only be in a batch once.
+func (r *FormationRepo) scaleFormation(tx *dbTx, field string, s *ct.FormationScale, force bool, seen map[string]struct{}) (*ct.Formation, error) {
+	app, err := selectApp(tx, s.AppID, false)
+	if err == ErrNotFound {
+		return nil, ct.ValidationError{Field: joinField(field, "app"), Message: "app not found"}
+	} else if err != nil {
+		return nil, err
+	}
+	if _, ok := seen[app.ID]; ok {
+		return nil, ct.ValidationError{Field: joinField(field, "app"), Message: "is already in the batch"}
+	}
+	seen[app.ID] = struct{}{}
+
+	data, err := r.releases.Get(s.ReleaseID)
+	if err == ErrNotFound {
+		return nil, ct.ValidationError{Field: joinField(field, "release"), Message: "release not found"}
+	} else if err != nil {
+		return nil, err
+	}
+	release := data.(*ct.Release)
+	for typ := range s.Processes {
+		if _, ok := release.Processes[typ]; !ok {
+			return nil, ct.ValidationError{Field: joinField(field, joinField("processes", typ)), Message: "is not a process type of the release"}
+		}
+	}
+
+	current, err := scanFormation(tx.QueryRow("SELECT "+formationColumns+" FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL FOR UPDATE", app.ID, release.ID))
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	f := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: make(map[string]int)}
+	if current != nil {
+		f.Limits = current.Limits
+		f.Constraints = current.Constraints
+		for typ, n := range current.Processes {
+			f.Processes[typ] = n
+		}
+	}
+	for typ, n := range s.Processes {
+		if n == 0 {
+			delete(f.Processes, typ)
+		} else {
+			f.Processes[typ] = n
+		}
+	}
+
+	if app.Protected && !force {
+		if err := checkProtectedScale(current, f.Processes); err != nil {
+			e := err.(ct.ValidationError)
+			e.Field = joinField(field, e.Field)
+			return nil, e
+		}
+	}
+	if err := r.checkQuota(f, release); err != nil {
+		return nil, err
+	}
+	if err := upsertFormation(tx, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func insertFormation(db rowQueryer, f *ct.Formation) error {
+	limits, err := limitsJSON(f.Limits)
+	if err != nil {
+		return err
+	}
+	constraints, err := constraintsJSON(f.Constraints)
+	if err != nil {
+		return err
+	}
+	err = db.QueryRow("INSERT INTO formations (app_id, release_id, processes, limits, constraints) VALUES ($1, $2, $3, $4, $5) RETURNING created_at, updated_at",
+		f.AppID, f.ReleaseID, procsHstore(f.Processes), limits, constraints).Scan(&f.CreatedAt, &f.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	f.StateHash = ct.FormationStateHash(f.Processes, f.Limits)
+	return createEvent(db, f.AppID, ct.EventTypeFormation, f.AppID+":"+f.ReleaseID, f)
+}
+
+// upsertFormation creates or replaces the formation, it updates an existing
+// row first so that it can be used in a transaction without a unique
+// violation aborting it.
+func upsertFormation(db rowQueryer, f *ct.Formation) error {
+	procs := procsHstore(f.Processes)
+	limits, err := limitsJSON(f.Limits)
+	if err != nil {
+		return err
+	}
+	constraints, err := constraintsJSON(f.Constraints)
+	if err != nil {
+		return err
+	}
+	err = db.QueryRow("UPDATE formations SET processes = $3, limits = $4, constraints = $5, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2 RETURNING created_at, updated_at",
+		f.AppID, f.ReleaseID, procs, limits, constraints).Scan(&f.CreatedAt, &f.UpdatedAt)
+	if err == sql.ErrNoRows {
+		err = db.QueryRow("INSERT INTO formations (app_id, release_id, processes, limits, constraints) VALUES ($1, $2, $3, $4, $5) RETURNING created_at, updated_at",
+			f.AppID, f.ReleaseID, procs, limits, constraints).Scan(&f.CreatedAt, &f.UpdatedAt)
+	}
+	if err != nil {
+		return err
+	}
+	f.StateHash = ct.FormationStateHash(f.Processes, f.Limits)
+	return createEvent(db, f.AppID, ct.EventTypeFormation, f.AppID+":"+f.ReleaseID, f)
 }
 
 func scanFormation(s Scanner) (*ct.Formation, error) {
 	f := &ct.Formation{}
 	var procs hstore.Hstore
-	err := s.Scan(&f.AppID, &f.ReleaseID, &procs, &f.CreatedAt, &f.UpdatedAt)
+	var limits, constraints *string
+	err := s.Scan(&f.AppID, &f.ReleaseID, &procs, &limits, &constraints, &f.CreatedAt, &f.UpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
 		}
 		return nil, err
 	}
+	if limits != nil {
+		if err := json.Unmarshal([]byte(*limits), &f.Limits); err != nil {
+			return nil, err
+		}
+	}
+	if constraints != nil {
+		if err := json.Unmarshal([]byte(*constraints), &f.Constraints); err != nil {
+			return nil, err
+		}
+	}
 	f.Processes = make(map[string]int, len(procs.Map))
 	for k, v := range procs.Map {
 		n, _ := strconv.Atoi(v.String)
@@ -82,16 +345,17 @@ func scanFormation(s Scanner) (*ct.Formation, error) {
 	}
 	f.AppID = cleanUUID(f.AppID)
 	f.ReleaseID = cleanUUID(f.ReleaseID)
+	f.StateHash = ct.FormationStateHash(f.Processes, f.Limits)
 	return f, nil
 }
 
 func (r *FormationRepo) Get(appID, releaseID string) (*ct.Formation, error) {
-	row := r.db.QueryRow("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, releaseID)
+	row := r.db.QueryRow("SELECT "+formationColumns+" FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL", appID, releaseID)
 	return scanFormation(row)
 }
 
 func (r *FormationRepo) List(appID string) ([]*ct.Formation, error) {
-	rows, err := r.db.Query("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC", appID)
+	rows, err := r.db.Query("SELECT "+formationColumns+" FROM formations WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC", appID)
 	if err != nil {
 		return nil, err
 	}
@@ -150,16 +414,29 @@ func (r *FormationRepo) expandFormation(formation *ct.Formation) (*ct.ExpandedFo
 	if err != nil {
 		return nil, err
 	}
-	artifact, err := r.artifacts.Get(release.(*ct.Release).ArtifactID)
+	artifacts, err := r.artifacts.ReleaseArtifacts(release.(*ct.Release))
+	if err != nil {
+		return nil, err
+	}
+	env, err := r.apps.Env(formation.AppID)
+	if err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	drains, err := r.apps.LogDrains(formation.AppID)
 	if err != nil {
 		return nil, err
 	}
 	f := &ct.ExpandedFormation{
-		App:       app.(*ct.App),
-		Release:   release.(*ct.Release),
-		Artifact:  artifact.(*ct.Artifact),
-		Processes: formation.Processes,
-		UpdatedAt: *formation.UpdatedAt,
+		App:         app.(*ct.App),
+		Release:     release.(*ct.Release),
+		Artifact:    artifacts[0],
+		Artifacts:   artifacts,
+		Processes:   formation.Processes,
+		Limits:      formation.Limits,
+		AppEnv:      env,
+		LogDrains:   drains,
+		UpdatedAt:   *formation.UpdatedAt,
+		Constraints: formation.Constraints,
 	}
 	return f, nil
 }
@@ -208,7 +485,7 @@ func (r *FormationRepo) Subscribe(ch chan<- *ct.ExpandedFormation, since time.Ti
 }
 
 func (r *FormationRepo) sendUpdatedSince(ch chan<- *ct.ExpandedFormation, since time.Time) error {
-	rows, err := r.db.Query("SELECT app_id, release_id, processes, created_at, updated_at FROM formations WHERE updated_at >= $1 ORDER BY updated_at DESC", since)
+	rows, err := r.db.Query("SELECT "+formationColumns+" FROM formations WHERE updated_at >= $1 ORDER BY updated_at DESC", since)
 	if err != nil {
 		return err
 	}
@@ -237,3 +514,106 @@ func (r *FormationRepo) Unsubscribe(ch chan<- *ct.ExpandedFormation) {
 		r.stopListener <- struct{}{}
 	}
 }
+
+// streamFormations sends formations updated since the since parameter (an
+// RFC3339 timestamp) as server-sent events, followed by an empty formation
+// once the existing formations have been sent and then each formation as it
+// changes. Deleted formations are sent without processes. Clients that don't
+// accept event streams get a list of the formations updated since the given
+// time.
+func streamFormations(req *http.Request, w http.ResponseWriter, repo *FormationRepo, r ResponseHelper) {
+	var since time.Time
+	if s := req.FormValue("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			r.Error(ct.ValidationError{Field: "since", Message: "must be an RFC3339 timestamp"})
+			return
+		}
+	}
+
+	if !strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		list, err := repo.listUpdatedSince(since)
+		if err != nil {
+			r.Error(err)
+			return
+		}
+		r.JSON(200, list)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.WriteHeader(200)
+	send := func(data []byte) error {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		w.(http.Flusher).Flush()
+		return nil
+	}
+	if err := send([]byte(":\n")); err != nil {
+		return
+	}
+
+	ch := make(chan *ct.ExpandedFormation)
+	done := make(chan struct{})
+	closed := w.(http.CloseNotifier).CloseNotify()
+	go func() {
+		defer func() {
+			close(done)
+			// drain until unsubscribed so that publishing doesn't block
+			for _ = range ch {
+			}
+		}()
+		for {
+			var data []byte
+			select {
+			case f, ok := <-ch:
+				if !ok {
+					return
+				}
+				encoded, err := json.Marshal(f)
+				if err != nil {
+					return
+				}
+				data = append(append([]byte("data: "), encoded...), "\n\n"...)
+			case <-time.After(30 * time.Second):
+				data = []byte(":\n")
+			case <-closed:
+				return
+			}
+			if err := send(data); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := repo.Subscribe(ch, since); err == nil {
+		<-done
+	}
+	repo.Unsubscribe(ch)
+	close(ch)
+}
+
+// listUpdatedSince returns the expanded formations updated at or after since,
+// ordered by the time they were updated.
+func (r *FormationRepo) listUpdatedSince(since time.Time) ([]*ct.ExpandedFormation, error) {
+	rows, err := r.db.Query("SELECT "+formationColumns+" FROM formations WHERE updated_at >= $1 ORDER BY updated_at", since)
+	if err != nil {
+		return nil, err
+	}
+	list := []*ct.ExpandedFormation{}
+	for rows.Next() {
+		formation, err := scanFormation(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ef, err := r.expandFormation(formation)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, ef)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq/hstore"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// defaultGCKeep is the number of an app's most recent releases which are
+// kept by garbage collection if not configured.
+const defaultGCKeep = 10
+
+// defaultGCGrace is how long unused artifacts are kept for by garbage
+// collection if not configured, as artifacts are created before the releases
+// which use them.
+const defaultGCGrace = time.Hour
+
+type gcConfig struct {
+	keep  int
+	grace time.Duration
+}
+
+// appReleasesWhere matches the releases that have been used by the app with
+// ID $1.
+const appReleasesWhere = `deleted_at IS NULL AND (
+    release_id IN (SELECT release_id FROM formations WHERE app_id = $1)
+    OR release_id = (SELECT release_id FROM apps WHERE app_id = $1)
+)`
+
+// appReleaseIDs returns the IDs of the releases that have been used by the
+// app, most recent first.
+func (r *ReleaseRepo) appReleaseIDs(appID string) ([]string, error) {
+	rows, err := r.db.Query("SELECT release_id FROM releases WHERE "+appReleasesWhere+" ORDER BY created_at DESC", appID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, cleanUUID(id))
+	}
+	return ids, rows.Err()
+}
+
+// hasProcesses reports whether any formation of the release has processes
+// scaled up.
+func (r *ReleaseRepo) hasProcesses(releaseID string) (bool, error) {
+	rows, err := r.db.Query("SELECT processes FROM formations WHERE release_id = $1 AND deleted_at IS NULL", releaseID)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var procs hstore.Hstore
+		if err := rows.Scan(&procs); err != nil {
+			return false, err
+		}
+		for _, v := range procs.Map {
+			if n, _ := strconv.Atoi(v.String); n > 0 {
+				return true, nil
+			}
+		}
+	}
+	return false, rows.Err()
+}
+
+// AppGC deletes the releases of the app other than the keep most recent
+// ones, along with their formations and artifacts. Releases which are in use
+// (the current release of an app, or scaled up in any formation) are never
+// deleted.
+func (r *ReleaseRepo) AppGC(appID string, keep int) (*ct.AppGCResult, error) {
+	ids, err := r.appReleaseIDs(appID)
+	if err != nil {
+		return nil, err
+	}
+	res := &ct.AppGCResult{DeletedReleases: []string{}}
+	if len(ids) <= keep {
+		return res, nil
+	}
+	for _, id := range ids[keep:] {
+		inUse, err := r.hasProcesses(id)
+		if err != nil {
+			return nil, err
+		}
+		if inUse {
+			continue
+		}
+		if err := r.RemoveCascade(id); err != nil {
+			if _, ok := err.(ct.ValidationError); ok || err == ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+		res.DeletedReleases = append(res.DeletedReleases, id)
+	}
+	return res, nil
+}
+
+// RemoveUnused deletes the artifacts which are not used by any release and
+// were created longer ago than grace, so that artifacts which are about to be
+// used by a new release are kept. It returns the IDs of the deleted artifacts.
+func (r *ArtifactRepo) RemoveUnused(grace time.Duration) ([]string, error) {
+	rows, err := r.db.Query(`UPDATE artifacts SET deleted_at = now() WHERE deleted_at IS NULL AND created_at < $1
+    AND NOT EXISTS (SELECT 1 FROM release_artifacts ra JOIN releases r USING (release_id) WHERE ra.artifact_id = artifacts.artifact_id AND r.deleted_at IS NULL)
+    RETURNING artifact_id`, time.Now().Add(-grace))
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, cleanUUID(id))
+	}
+	return ids, rows.Err()
+}
+
+// blobQueries find the files of deleted objects. list returns the ID and file
+// URL of the deleted objects whose files have not been collected, inUse
+// checks whether an object which is not deleted has the URL $1, and collect
+// marks the object with ID $1 as collected.
+var blobQueries = []struct {
+	list, inUse, collect string
+}{
+	{
+		list:    "SELECT artifact_id, uri FROM artifacts WHERE deleted_at IS NOT NULL AND collected_at IS NULL",
+		inUse:   "SELECT EXISTS (SELECT 1 FROM artifacts WHERE deleted_at IS NULL AND uri = $1)",
+		collect: "UPDATE artifacts SET collected_at = now() WHERE artifact_id = $1",
+	},
+	{
+		// releases built from source run the slug at SLUG_URL
+		list:    "SELECT release_id, data::json -> 'env' ->> 'SLUG_URL' FROM releases WHERE deleted_at IS NOT NULL AND collected_at IS NULL",
+		inUse:   "SELECT EXISTS (SELECT 1 FROM releases WHERE deleted_at IS NULL AND data::json -> 'env' ->> 'SLUG_URL' = $1)",
+		collect: "UPDATE releases SET collected_at = now() WHERE release_id = $1",
+	},
+}
+
+type deletedBlob struct {
+	id  string
+	url sql.NullString
+}
+
+// garbageCollector deletes old releases of all apps, artifacts which are no
+// longer used and the blobstore files of deleted artifacts and releases.
+type garbageCollector struct {
+	conf      *gcConfig
+	apps      *AppRepo
+	releases  *ReleaseRepo
+	artifacts *ArtifactRepo
+	db        *DB
+
+	// blobs deletes files from the blobstore, if it is nil files are not
+	// collected.
+	blobs blobStore
+}
+
+// Collect runs garbage collection, keeping the keep most recent releases of
+// each app.
+func (g *garbageCollector) Collect(keep int) (*ct.GCResult, error) {
+	res := &ct.GCResult{DeletedReleases: []string{}, DeletedBlobs: []string{}}
+	list, err := g.apps.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, app := range list.([]*ct.App) {
+		appRes, err := g.releases.AppGC(app.ID, keep)
+		if err != nil {
+			return nil, err
+		}
+		res.DeletedReleases = append(res.DeletedReleases, appRes.DeletedReleases...)
+	}
+	if res.DeletedArtifacts, err = g.artifacts.RemoveUnused(g.conf.grace); err != nil {
+		return nil, err
+	}
+	if g.blobs == nil {
+		return res, nil
+	}
+	for _, q := range blobQueries {
+		deleted, err := g.collectBlobs(q.list, q.inUse, q.collect)
+		if err != nil {
+			return nil, err
+		}
+		res.DeletedBlobs = append(res.DeletedBlobs, deleted...)
+	}
+	return res, nil
+}
+
+// collectBlobs deletes the blobstore files of the deleted objects returned by
+// the list query which are not used by another object, and returns their
+// URLs. Objects are marked as collected once their file has been deleted, or
+// if it is used by another object which will collect it when it is deleted.
+func (g *garbageCollector) collectBlobs(list, inUse, collect string) ([]string, error) {
+	rows, err := g.db.Query(list)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []deletedBlob
+	for rows.Next() {
+		var b deletedBlob
+		if err := rows.Scan(&b.id, &b.url); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		blobs = append(blobs, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, b := range blobs {
+		if b.url.Valid && g.blobs.Owns(b.url.String) {
+			var used bool
+			if err := g.db.QueryRow(inUse, b.url.String).Scan(&used); err != nil {
+				return nil, err
+			}
+			if !used {
+				if err := g.blobs.Delete(b.url.String); err != nil {
+					// the object is not marked as collected so
+					// that deleting the file is retried
+					log.Printf("gc: error deleting %s: %s", b.url.String, err)
+					continue
+				}
+				deleted = append(deleted, b.url.String)
+			}
+		}
+		if err := g.db.Exec(collect, b.id); err != nil {
+			return nil, err
+		}
+	}
+	return deleted, nil
+}
+
+// gcKeep returns the number of releases to keep given in the request, or the
+// configured number if there is none.
+func gcKeep(req *http.Request, conf *gcConfig) (int, error) {
+	s := req.FormValue("keep")
+	if s == "" {
+		return conf.keep, nil
+	}
+	keep, err := strconv.Atoi(s)
+	if err != nil || keep < 0 {
+		return 0, ct.ValidationError{Field: "keep", Message: "is invalid"}
+	}
+	return keep, nil
+}
+
+func appGC(app *ct.App, req *http.Request, conf *gcConfig, releases *ReleaseRepo, r ResponseHelper) {
+	keep, err := gcKeep(req, conf)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	res, err := releases.AppGC(app.ID, keep)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, res)
+}
+
+func clusterGC(req *http.Request, gc *garbageCollector, r ResponseHelper) {
+	keep, err := gcKeep(req, gc.conf)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	res, err := gc.Collect(keep)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, res)
+}
+
+// scheduleGC runs garbage collection every interval.
+func scheduleGC(interval time.Duration, gc *garbageCollector) {
+	for range time.Tick(interval) {
+		res, err := gc.Collect(gc.conf.keep)
+		if err != nil {
+			log.Println("gc: error collecting garbage:", err)
+			continue
+		}
+		if n := len(res.DeletedReleases) + len(res.DeletedArtifacts) + len(res.DeletedBlobs); n > 0 {
+			log.Printf("gc: deleted %d releases, %d artifacts and %d files", len(res.DeletedReleases), len(res.DeletedArtifacts), len(res.DeletedBlobs))
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (s *S) TestAppGC(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "gc-test"})
+	var releases []*ct.Release
+	for i := 0; i < 4; i++ {
+		artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: fmt.Sprintf("docker://gc-test-%d", i)})
+		release := s.createTestRelease(c, &ct.Release{ArtifactID: artifact.ID})
+		releases = append(releases, release)
+		processes := map[string]int{"web": 0}
+		if i == 0 {
+			// the oldest release is still running so must be kept
+			processes["web"] = 1
+		}
+		s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: processes})
+	}
+	s.setAppRelease(c, app.ID, releases[3].ID)
+
+	res := &ct.AppGCResult{}
+	_, err := s.Post(fmt.Sprintf("/apps/%s/gc?keep=1", app.ID), nil, res)
+	c.Assert(err, IsNil)
+	c.Assert(res.DeletedReleases, HasLen, 2)
+
+	for i, release := range releases {
+		r, err := s.Get("/releases/"+release.ID, &ct.Release{})
+		c.Assert(err, IsNil)
+		if i == 1 || i == 2 {
+			c.Assert(r.StatusCode, Equals, 404)
+		} else {
+			c.Assert(r.StatusCode, Equals, 200)
+		}
+	}
+}
+
+type fakeBlobStore struct {
+	deleted []string
+}
+
+func (b *fakeBlobStore) Owns(u string) bool {
+	return strings.HasPrefix(u, "http://blobstore/")
+}
+
+func (b *fakeBlobStore) Delete(u string) error {
+	b.deleted = append(b.deleted, u)
+	return nil
+}
+
+func (s *S) TestClusterGC(c *C) {
+	blobs := &fakeBlobStore{}
+	s.m.Invoke(func(gc *garbageCollector) {
+		gc.blobs = blobs
+		gc.conf.grace = 0
+	})
+	defer s.m.Invoke(func(gc *garbageCollector) {
+		gc.blobs = nil
+		gc.conf.grace = defaultGCGrace
+	})
+
+	app := s.createTestApp(c, &ct.App{Name: "cluster-gc-test"})
+	var releases []*ct.Release
+	// the last release shares its slug with the one before it, as it
+	// would if it were created by updating the app's env
+	for i, slug := range []string{"slug-0", "slug-1", "slug-1"} {
+		artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: fmt.Sprintf("docker://cluster-gc-test-%d", i)})
+		release := s.createTestRelease(c, &ct.Release{
+			ArtifactID: artifact.ID,
+			Env:        map[string]string{"SLUG_URL": "http://blobstore/" + slug + ".tgz"},
+		})
+		releases = append(releases, release)
+		s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 0}})
+	}
+	s.setAppRelease(c, app.ID, releases[2].ID)
+	orphan := s.createTestArtifact(c, &ct.Artifact{Type: "file", URI: "http://blobstore/cluster-gc-orphan.tgz"})
+
+	res := &ct.GCResult{}
+	_, err := s.Post("/gc?keep=1", nil, res)
+	c.Assert(err, IsNil)
+	deleted := make(map[string]bool)
+	for _, id := range append(res.DeletedReleases, res.DeletedArtifacts...) {
+		deleted[id] = true
+	}
+	c.Assert(deleted[releases[0].ID], Equals, true)
+	c.Assert(deleted[releases[1].ID], Equals, true)
+	c.Assert(deleted[releases[2].ID], Equals, false)
+	c.Assert(deleted[orphan.ID], Equals, true)
+
+	deletedBlobs := make(map[string]bool)
+	for _, u := range blobs.deleted {
+		deletedBlobs[u] = true
+	}
+	c.Assert(deletedBlobs["http://blobstore/slug-0.tgz"], Equals, true)
+	c.Assert(deletedBlobs["http://blobstore/slug-1.tgz"], Equals, false)
+	c.Assert(deletedBlobs["http://blobstore/cluster-gc-orphan.tgz"], Equals, true)
+	c.Assert(res.DeletedBlobs, DeepEquals, blobs.deleted)
+
+	// collected files are not deleted again
+	blobs.deleted = nil
+	_, err = s.Post("/gc?keep=1", nil, res)
+	c.Assert(err, IsNil)
+	c.Assert(blobs.deleted, HasLen, 0)
+}
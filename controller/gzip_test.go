@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+)
+
+type GzipSuite struct{}
+
+var _ = Suite(&GzipSuite{})
+
+func (GzipSuite) TestGzipHandler(c *C) {
+	srv := httptest.NewServer(gzipHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		c.Assert(err, IsNil)
+		if req.URL.Path == "/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Write(body)
+	})))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	json.NewEncoder(gz).Encode(map[string]string{"foo": "bar"})
+	gz.Close()
+
+	for _, path := range []string{"/json", "/stream"} {
+		req, err := http.NewRequest("POST", srv.URL+path, bytes.NewReader(buf.Bytes()))
+		c.Assert(err, IsNil)
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Accept-Encoding", "gzip")
+		res, err := http.DefaultTransport.RoundTrip(req)
+		c.Assert(err, IsNil)
+
+		body := res.Body
+		if path == "/json" {
+			c.Assert(res.Header.Get("Content-Encoding"), Equals, "gzip")
+			body, err = gzip.NewReader(res.Body)
+			c.Assert(err, IsNil)
+		} else {
+			c.Assert(res.Header.Get("Content-Encoding"), Equals, "")
+		}
+		data, err := ioutil.ReadAll(body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, "{\"foo\":\"bar\"}\n")
+	}
+}
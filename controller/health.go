@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+// healthTimeout is how long a health check can take before it fails.
+const healthTimeout = 5 * time.Second
+
+// maxReplicationLag is how many bytes of WAL the standbys of the database
+// can be behind before the replication check is degraded.
+const maxReplicationLag = 16 << 20
+
+// serviceLister lists the instances of a discoverd service.
+type serviceLister interface {
+	Services(name string, timeout time.Duration) ([]*discoverd.Service, error)
+}
+
+// healthChecker checks the controller's dependencies. The discoverd
+// registration is only checked if dc is set.
+type healthChecker struct {
+	db *DB
+	dc serviceLister
+
+	// service and port are the discoverd service the controller is
+	// registered as and the port it listens on.
+	service string
+	port    string
+}
+
+type healthCheck struct {
+	name string
+	fn   func() (status, message string)
+}
+
+// Check runs the checks concurrently, a check which takes longer than
+// healthTimeout fails.
+func (h *healthChecker) Check() *ct.Health {
+	checks := []healthCheck{
+		{"postgres", h.checkPostgres},
+		{"replication", h.checkReplication},
+		{"schema", h.checkSchema},
+	}
+	if h.dc != nil {
+		checks = append(checks, healthCheck{"discoverd", h.checkDiscoverd})
+	}
+
+	health := &ct.Health{Status: ct.HealthOK, Checks: make([]*ct.HealthCheckResult, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c healthCheck) {
+			defer wg.Done()
+			health.Checks[i] = runHealthCheck(c)
+		}(i, c)
+	}
+	wg.Wait()
+	for _, c := range health.Checks {
+		if healthRank(c.Status) > healthRank(health.Status) {
+			health.Status = c.Status
+		}
+	}
+	return health
+}
+
+func runHealthCheck(c healthCheck) *ct.HealthCheckResult {
+	done := make(chan *ct.HealthCheckResult, 1)
+	go func() {
+		status, message := c.fn()
+		done <- &ct.HealthCheckResult{Name: c.name, Status: status, Message: message}
+	}()
+	select {
+	case res := <-done:
+		return res
+	case <-time.After(healthTimeout):
+		return &ct.HealthCheckResult{Name: c.name, Status: ct.HealthFailed, Message: fmt.Sprintf("timed out after %s", healthTimeout)}
+	}
+}
+
+func healthRank(status string) int {
+	switch status {
+	case ct.HealthOK:
+		return 0
+	case ct.HealthDegraded:
+		return 1
+	}
+	return 2
+}
+
+func (h *healthChecker) checkPostgres() (string, string) {
+	var one int
+	if err := h.db.QueryRow("SELECT 1").Scan(&one); err != nil {
+		return ct.HealthFailed, err.Error()
+	}
+	return ct.HealthOK, ""
+}
+
+// checkReplication checks that the database is the primary and how far
+// behind its standbys are. The lag of standbys is only visible to
+// superusers, so it counts as zero for other users.
+func (h *healthChecker) checkReplication() (string, string) {
+	var standby bool
+	if err := h.db.QueryRow("SELECT pg_is_in_recovery()").Scan(&standby); err != nil {
+		return ct.HealthFailed, err.Error()
+	}
+	if standby {
+		return ct.HealthFailed, "connected to a standby, which cannot accept writes"
+	}
+	var standbys, lag int64
+	if err := h.db.QueryRow("SELECT count(*), coalesce(max(pg_xlog_location_diff(pg_current_xlog_location(), replay_location)), 0)::bigint FROM pg_stat_replication").Scan(&standbys, &lag); err != nil {
+		return ct.HealthFailed, err.Error()
+	}
+	if standbys == 0 {
+		return ct.HealthOK, "no standbys"
+	}
+	message := fmt.Sprintf("%d standbys, up to %d bytes behind", standbys, lag)
+	if lag > maxReplicationLag {
+		return ct.HealthDegraded, message
+	}
+	return ct.HealthOK, message
+}
+
+// checkSchema compares the version of the database schema with the latest
+// migration. A newer schema is expected while a new version of the
+// controller is being deployed, but means that this one is out of date.
+func (h *healthChecker) checkSchema() (string, string) {
+	var version int
+	if err := h.db.QueryRow("SELECT coalesce(max(id), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return ct.HealthFailed, err.Error()
+	}
+	expected := schemaVersion()
+	switch {
+	case version < expected:
+		return ct.HealthFailed, fmt.Sprintf("schema version %d is older than %d", version, expected)
+	case version > expected:
+		return ct.HealthDegraded, fmt.Sprintf("schema version %d is newer than %d", version, expected)
+	}
+	return ct.HealthOK, fmt.Sprintf("schema version %d", version)
+}
+
+// checkDiscoverd checks that an instance of the controller is registered on
+// its port. The address the controller registered is expanded by discoverd,
+// so instances on other hosts with the same port also match.
+func (h *healthChecker) checkDiscoverd() (string, string) {
+	services, err := h.dc.Services(h.service, healthTimeout/2)
+	if err != nil {
+		return ct.HealthFailed, fmt.Sprintf("no instances of %s are registered", h.service)
+	}
+	for _, s := range services {
+		if s.Port == h.port {
+			return ct.HealthOK, fmt.Sprintf("%d instances registered", len(services))
+		}
+	}
+	return ct.HealthFailed, fmt.Sprintf("no instance of %s is registered on port %s", h.service, h.port)
+}
+
+// getHealth responds with the result of the health checks, with a 503 status
+// if any failed so that load balancers can use it.
+func getHealth(h *healthChecker, r ResponseHelper) {
+	health := h.Check()
+	status := 200
+	if health.Status == ct.HealthFailed {
+		status = 503
+	}
+	r.JSON(status, health)
+}
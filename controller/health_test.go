@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+type fakeServiceLister []*discoverd.Service
+
+func (f fakeServiceLister) Services(name string, timeout time.Duration) ([]*discoverd.Service, error) {
+	if len(f) == 0 {
+		return nil, errors.New("discover: timeout exceeded")
+	}
+	return f, nil
+}
+
+type HealthSuite struct{}
+
+var _ = Suite(&HealthSuite{})
+
+func (HealthSuite) TestCheckDiscoverd(c *C) {
+	for _, t := range []struct {
+		services fakeServiceLister
+		status   string
+	}{
+		{nil, ct.HealthFailed},
+		{fakeServiceLister{{Host: "10.0.0.1", Port: "3001"}}, ct.HealthFailed},
+		{fakeServiceLister{{Host: "10.0.0.1", Port: "3001"}, {Host: "10.0.0.2", Port: "3000"}}, ct.HealthOK},
+	} {
+		h := &healthChecker{dc: t.services, service: "flynn-controller", port: "3000"}
+		status, message := h.checkDiscoverd()
+		c.Assert(status, Equals, t.status, Commentf("%s", message))
+	}
+}
+
+func (HealthSuite) TestCheckStatus(c *C) {
+	status := func(s string) func() (string, string) {
+		return func() (string, string) { return s, "" }
+	}
+	c.Assert(runHealthCheck(healthCheck{"ok", status(ct.HealthOK)}).Status, Equals, ct.HealthOK)
+	res := runHealthCheck(healthCheck{"failed", status(ct.HealthFailed)})
+	c.Assert(res.Name, Equals, "failed")
+	c.Assert(res.Status, Equals, ct.HealthFailed)
+	c.Assert(healthRank(ct.HealthDegraded) > healthRank(ct.HealthOK), Equals, true)
+	c.Assert(healthRank("unknown") > healthRank(ct.HealthDegraded), Equals, true)
+}
+
+func (s *S) TestHealth(c *C) {
+	// the health is available without credentials
+	res, err := http.Get(s.srv.URL + "/health")
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	var health ct.Health
+	c.Assert(json.NewDecoder(res.Body).Decode(&health), IsNil)
+	c.Assert(health.Status, Equals, ct.HealthOK)
+	checks := make(map[string]string, len(health.Checks))
+	for _, check := range health.Checks {
+		checks[check.Name] = check.Status
+	}
+	c.Assert(checks, DeepEquals, map[string]string{
+		"postgres":    ct.HealthOK,
+		"replication": ct.HealthOK,
+		"schema":      ct.HealthOK,
+	})
+
+	// other methods still need credentials
+	res, err = http.Post(s.srv.URL+"/health", "application/json", nil)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 401)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+const (
+	// idempotencyKeyHeader is set by clients on create requests which may
+	// be retried, requests with the same key are only handled once.
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// idempotentReplayedHeader is set on responses which are replayed
+	// from an earlier request with the same key.
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	// idempotencyKeyTTL is how long responses are kept for replaying.
+	idempotencyKeyTTL = 24 * time.Hour
+
+	maxIdempotencyKeyLen = 255
+)
+
+// idempotentPaths matches the create endpoints which support idempotency
+// keys.
+var idempotentPaths = regexp.MustCompile(`^/(apps|releases|app_complete)$|^/apps/[^/]+/(jobs|deploy)$`)
+
+type IdempotencyRepo struct {
+	db *DB
+}
+
+func NewIdempotencyRepo(db *DB) *IdempotencyRepo {
+	return &IdempotencyRepo{db}
+}
+
+// idempotentResponse is the stored response to a request, Status is zero if
+// the request is still being handled.
+type idempotentResponse struct {
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Begin claims the key for a request with the given hash. If the key has
+// already been claimed, the request it was claimed by is returned instead.
+// Expired keys are removed first so that they can be reused.
+func (r *IdempotencyRepo) Begin(actor, key, hash string) (*idempotentResponse, error) {
+	if err := r.db.Exec("DELETE FROM idempotency_keys WHERE created_at < $1", time.Now().Add(-idempotencyKeyTTL)); err != nil {
+		return nil, err
+	}
+	err := r.db.Exec("INSERT INTO idempotency_keys (actor, key, request_hash) VALUES ($1, $2, $3)", actor, key, hash)
+	if err == nil {
+		return nil, nil
+	}
+	if e, ok := err.(*pq.Error); !ok || e.Code.Name() != "unique_violation" {
+		return nil, err
+	}
+	res := &idempotentResponse{}
+	var status *int
+	var contentType *string
+	if err := r.db.QueryRow("SELECT request_hash, status, content_type, body FROM idempotency_keys WHERE actor = $1 AND key = $2", actor, key).Scan(&res.RequestHash, &status, &contentType, &res.Body); err != nil {
+		if err == sql.ErrNoRows {
+			// the key expired or its request failed since the insert
+			err = ErrConflict
+		}
+		return nil, err
+	}
+	if status != nil {
+		res.Status = *status
+	}
+	if contentType != nil {
+		res.ContentType = *contentType
+	}
+	return res, nil
+}
+
+// Complete stores the response to the request which claimed the key.
+func (r *IdempotencyRepo) Complete(actor, key string, res *idempotentResponse) error {
+	return r.db.Exec("UPDATE idempotency_keys SET status = $3, content_type = $4, body = $5 WHERE actor = $1 AND key = $2",
+		actor, key, res.Status, res.ContentType, res.Body)
+}
+
+// Release removes the key so that the request can be retried.
+func (r *IdempotencyRepo) Release(actor, key string) error {
+	return r.db.Exec("DELETE FROM idempotency_keys WHERE actor = $1 AND key = $2", actor, key)
+}
+
+func requestHash(req *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(err)
+}
+
+// idempotencyHandler returns a middleware which handles create requests with
+// an Idempotency-Key header once, replaying the stored response to requests
+// which reuse the key. Responses with a server error are not stored so that
+// the request can be retried.
+func idempotencyHandler(repo *IdempotencyRepo) martini.Handler {
+	return func(c martini.Context, res http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(idempotencyKeyHeader)
+		// attached job requests stream their response so cannot be replayed
+		if key == "" || req.Method != "POST" || !idempotentPaths.MatchString(req.URL.Path) ||
+			strings.Contains(req.Header.Get("Accept"), "application/vnd.flynn.attach") {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			writeJSONError(res, 400, ct.ValidationError{Field: idempotencyKeyHeader, Code: ct.ValidationCodeTooLong, Message: "must be at most 255 characters"})
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			res.WriteHeader(400)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := requestHash(req, body)
+		actor := req.Header.Get(actorHeader)
+
+		prev, err := repo.Begin(actor, key, hash)
+		if err == ErrConflict {
+			res.WriteHeader(409)
+			return
+		} else if err != nil {
+			log.Printf("idempotency: error claiming key %q: %s", key, err)
+			res.WriteHeader(500)
+			return
+		}
+		if prev != nil {
+			switch {
+			case prev.RequestHash != hash:
+				writeJSONError(res, 400, ct.ValidationError{Field: idempotencyKeyHeader, Message: "was used for a different request"})
+			case prev.Status == 0:
+				// the first request with the key is still being handled
+				res.WriteHeader(409)
+			default:
+				if prev.ContentType != "" {
+					res.Header().Set("Content-Type", prev.ContentType)
+				}
+				res.Header().Set(idempotentReplayedHeader, "true")
+				res.WriteHeader(prev.Status)
+				res.Write(prev.Body)
+			}
+			return
+		}
+
+		w := &idempotencyResponseWriter{ResponseWriter: res.(martini.ResponseWriter)}
+		c.MapTo(w, (*http.ResponseWriter)(nil))
+		completed := false
+		defer func() {
+			// release the key if the handler panicked or the response
+			// could not be stored
+			if !completed {
+				if err := repo.Release(actor, key); err != nil {
+					log.Printf("idempotency: error releasing key %q: %s", key, err)
+				}
+			}
+		}()
+		c.Next()
+
+		if w.hijacked || w.Status() >= 500 {
+			return
+		}
+		if err := repo.Complete(actor, key, &idempotentResponse{
+			Status:      w.Status(),
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        w.body.Bytes(),
+		}); err != nil {
+			log.Printf("idempotency: error storing response for key %q: %s", key, err)
+			return
+		}
+		completed = true
+	}
+}
+
+// idempotencyResponseWriter keeps a copy of the response body to replay.
+type idempotencyResponseWriter struct {
+	martini.ResponseWriter
+	body     bytes.Buffer
+	hijacked bool
+}
+
+func (w *idempotencyResponseWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *idempotencyResponseWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func (w *idempotencyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+func (s *S) postWithKey(c *C, path, key string, in interface{}) *http.Response {
+	data, err := json.Marshal(in)
+	c.Assert(err, IsNil)
+	req, err := http.NewRequest("POST", s.srv.URL+path, bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	req.SetBasicAuth("", authKey)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	return res
+}
+
+func (s *S) TestIdempotencyKey(c *C) {
+	res := s.postWithKey(c, "/apps", "create-app", &ct.App{Name: "idempotent-app"})
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("Idempotent-Replayed"), Equals, "")
+	first := &ct.App{}
+	c.Assert(json.NewDecoder(res.Body).Decode(first), IsNil)
+	res.Body.Close()
+
+	// retrying returns the same app rather than creating another
+	res = s.postWithKey(c, "/apps", "create-app", &ct.App{Name: "idempotent-app"})
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("Idempotent-Replayed"), Equals, "true")
+	retry := &ct.App{}
+	c.Assert(json.NewDecoder(res.Body).Decode(retry), IsNil)
+	res.Body.Close()
+	c.Assert(retry.ID, Equals, first.ID)
+
+	// the key cannot be reused for a different request
+	res = s.postWithKey(c, "/apps", "create-app", &ct.App{Name: "idempotent-other"})
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+
+	// failed requests are replayed too, they are not server errors
+	res = s.postWithKey(c, "/releases", "create-release", map[string]string{"artifact": "invalid"})
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+	res = s.postWithKey(c, "/releases", "create-release", map[string]string{"artifact": "invalid"})
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+	c.Assert(res.Header.Get("Idempotent-Replayed"), Equals, "true")
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	ct "github.com/flynn/flynn/controller/types"
+	routerc "github.com/flynn/flynn/router/client"
+	"github.com/flynn/flynn/router/types"
+)
+
+// importArchive is the contents of an export archive.
+type importArchive struct {
+	Apps       []*ct.ExportedApp
+	Artifacts  []*ct.Artifact
+	Releases   []*ct.Release
+	Formations []*ct.Formation
+	Providers  []*ct.Provider
+	Resources  []*ct.Resource
+	Routes     []*router.Route
+}
+
+// readImportArchive reads a tar archive in the format written by
+// exportCluster, files which are not part of the format are ignored.
+func readImportArchive(r io.Reader) (*importArchive, error) {
+	a := &importArchive{}
+	files := map[string]interface{}{
+		"apps":       &a.Apps,
+		"artifacts":  &a.Artifacts,
+		"releases":   &a.Releases,
+		"formations": &a.Formations,
+		"providers":  &a.Providers,
+		"resources":  &a.Resources,
+		"routes":     &a.Routes,
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return a, nil
+		} else if err != nil {
+			return nil, ct.ValidationError{Message: fmt.Sprintf("invalid export archive: %s", err)}
+		}
+		name := path.Base(h.Name)
+		dest, ok := files[strings.TrimSuffix(name, ".json")]
+		if !ok || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if err := json.NewDecoder(tr).Decode(dest); err != nil {
+			return nil, ct.ValidationError{Field: name, Code: ct.ValidationCodeInvalidJSON, Message: fmt.Sprintf("is invalid: %s", err)}
+		}
+	}
+}
+
+// importer writes the objects of an archive in a transaction, recording
+// what happened to each of them.
+type importer struct {
+	tx     *dbTx
+	policy string
+	res    *ct.ImportResult
+}
+
+// put creates the object with the given ID if exists returns false, or
+// updates it if it exists and the conflict policy is to overwrite. Objects
+// which conflict with an existing object with a different ID, for example
+// an app with the same name, fail the import.
+func (i *importer) put(kind, id string, exists func() (bool, error), create, update func() error) error {
+	found, err := exists()
+	if err != nil {
+		return err
+	}
+	switch {
+	case !found:
+		err = create()
+		i.res.Created[kind]++
+	case i.policy == ct.ImportConflictOverwrite:
+		err = update()
+		i.res.Updated[kind]++
+	default:
+		i.res.Skipped[kind]++
+	}
+	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+		return ct.ValidationError{Field: kind, Message: fmt.Sprintf("%s conflicts with an existing object: %s", id, e.Detail)}
+	}
+	return err
+}
+
+// rowExists returns a function which reports whether the query returns any
+// rows, including deleted objects so that their IDs are not reused.
+func (i *importer) rowExists(query string, args ...interface{}) func() (bool, error) {
+	return func() (bool, error) {
+		var exists bool
+		err := i.tx.QueryRow("SELECT EXISTS ("+query+")", args...).Scan(&exists)
+		return exists, err
+	}
+}
+
+func (i *importer) exec(query string, args ...interface{}) error {
+	_, err := i.tx.Exec(query, args...)
+	return err
+}
+
+func (i *importer) importProvider(p *ct.Provider) error {
+	return i.put("providers", p.ID,
+		i.rowExists("SELECT 1 FROM providers WHERE provider_id = $1", p.ID),
+		func() error {
+			return i.exec("INSERT INTO providers (provider_id, name, url, created_at) VALUES ($1, $2, $3, COALESCE($4, now()))",
+				p.ID, p.Name, p.URL, p.CreatedAt)
+		},
+		func() error {
+			return i.exec("UPDATE providers SET name = $2, url = $3, updated_at = now(), deleted_at = NULL WHERE provider_id = $1",
+				p.ID, p.Name, p.URL)
+		},
+	)
+}
+
+func (i *importer) importArtifact(a *ct.Artifact) error {
+	if err := validateArtifact(a); err != nil {
+		return err
+	}
+	return i.put("artifacts", a.ID,
+		i.rowExists("SELECT 1 FROM artifacts WHERE artifact_id = $1", a.ID),
+		func() error {
+			return i.exec("INSERT INTO artifacts (artifact_id, type, uri, size, sha256, created_at) VALUES ($1, $2, $3, $4, $5, COALESCE($6, now()))",
+				a.ID, a.Type, a.URI, nullInt64(a.Size), nullString(a.SHA256), a.CreatedAt)
+		},
+		func() error {
+			return i.exec("UPDATE artifacts SET type = $2, uri = $3, size = $4, sha256 = $5, deleted_at = NULL WHERE artifact_id = $1",
+				a.ID, a.Type, a.URI, nullInt64(a.Size), nullString(a.SHA256))
+		},
+	)
+}
+
+func (i *importer) importRelease(r *ct.Release) error {
+	return i.put("releases", r.ID,
+		i.rowExists("SELECT 1 FROM releases WHERE release_id = $1", r.ID),
+		func() error { return insertRelease(i.tx, r) },
+		func() error {
+			if err := validateReleaseArtifacts(r); err != nil {
+				return err
+			}
+			data, err := releaseData(r)
+			if err != nil {
+				return err
+			}
+			if err := i.exec("UPDATE releases SET artifact_id = $2, data = $3, version = version + 1, deleted_at = NULL WHERE release_id = $1",
+				r.ID, r.ArtifactID, data); err != nil {
+				return err
+			}
+			if err := i.exec("DELETE FROM release_artifacts WHERE release_id = $1", r.ID); err != nil {
+				return err
+			}
+			return insertReleaseArtifacts(i.tx, r)
+		},
+	)
+}
+
+func (i *importer) importApp(a *ct.ExportedApp) error {
+	if a.App == nil {
+		return ct.ValidationError{Field: "apps", Message: "must be objects"}
+	}
+	quota := a.Quota
+	if quota == nil {
+		quota = &ct.AppQuota{}
+	}
+	return i.put("apps", a.ID,
+		i.rowExists("SELECT 1 FROM apps WHERE app_id = $1", a.ID),
+		func() error {
+			return i.exec(`INSERT INTO apps (app_id, name, release_id, protected, meta, labels, env, maintenance, quota_max_jobs, quota_max_memory, quota_max_routes, created_at)
+			               VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, COALESCE($12, now()))`,
+				a.ID, a.Name, nullString(a.ReleaseID), a.Protected, stringHstore(a.Meta), stringHstore(a.Labels), stringHstore(a.Env),
+				a.Maintenance, quota.MaxJobs, quota.MaxMemory, quota.MaxRoutes, a.CreatedAt)
+		},
+		func() error {
+			return i.exec(`UPDATE apps SET name = $2, release_id = $3, protected = $4, meta = $5, labels = $6, env = $7, maintenance = $8,
+			               quota_max_jobs = $9, quota_max_memory = $10, quota_max_routes = $11, updated_at = now(), version = version + 1, deleted_at = NULL
+			               WHERE app_id = $1`,
+				a.ID, a.Name, nullString(a.ReleaseID), a.Protected, stringHstore(a.Meta), stringHstore(a.Labels), stringHstore(a.Env),
+				a.Maintenance, quota.MaxJobs, quota.MaxMemory, quota.MaxRoutes)
+		},
+	)
+}
+
+func (i *importer) importFormation(f *ct.Formation) error {
+	limits, err := limitsJSON(f.Limits)
+	if err != nil {
+		return err
+	}
+	constraints, err := constraintsJSON(f.Constraints)
+	if err != nil {
+		return err
+	}
+	return i.put("formations", f.AppID+":"+f.ReleaseID,
+		i.rowExists("SELECT 1 FROM formations WHERE app_id = $1 AND release_id = $2", f.AppID, f.ReleaseID),
+		func() error {
+			return i.exec("INSERT INTO formations (app_id, release_id, processes, limits, constraints) VALUES ($1, $2, $3, $4, $5)",
+				f.AppID, f.ReleaseID, procsHstore(f.Processes), limits, constraints)
+		},
+		func() error {
+			return i.exec("UPDATE formations SET processes = $3, limits = $4, constraints = $5, updated_at = now(), deleted_at = NULL WHERE app_id = $1 AND release_id = $2",
+				f.AppID, f.ReleaseID, procsHstore(f.Processes), limits, constraints)
+		},
+	)
+}
+
+func (i *importer) importResource(r *ct.Resource) error {
+	err := i.put("resources", r.ID,
+		i.rowExists("SELECT 1 FROM resources WHERE resource_id = $1", r.ID),
+		func() error {
+			return i.exec("INSERT INTO resources (resource_id, provider_id, external_id, env, created_at) VALUES ($1, $2, $3, $4, COALESCE($5, now()))",
+				r.ID, r.ProviderID, r.ExternalID, envHstore(r.Env), r.CreatedAt)
+		},
+		func() error {
+			return i.exec("UPDATE resources SET provider_id = $2, external_id = $3, env = $4, version = version + 1, deleted_at = NULL WHERE resource_id = $1",
+				r.ID, r.ProviderID, r.ExternalID, envHstore(r.Env))
+		},
+	)
+	if err != nil {
+		return err
+	}
+	// bindings are added to resources which were skipped too, so that a
+	// skipped resource is still bound to imported apps
+	for _, appID := range r.Apps {
+		var bound bool
+		if err := i.tx.QueryRow("SELECT EXISTS (SELECT 1 FROM app_resources WHERE app_id = $1 AND resource_id = $2)", appID, r.ID).Scan(&bound); err != nil {
+			return err
+		}
+		if bound {
+			err = i.exec("UPDATE app_resources SET deleted_at = NULL WHERE app_id = $1 AND resource_id = $2", appID, r.ID)
+		} else {
+			err = i.exec("INSERT INTO app_resources (app_id, resource_id) VALUES ($1, $2)", appID, r.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importObjects writes the objects of the archive other than routes in a
+// single transaction, in an order which creates objects before the objects
+// which refer to them.
+func importObjects(db *DB, a *importArchive, policy string, res *ct.ImportResult) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	i := &importer{tx: tx, policy: policy, res: res}
+	err = func() error {
+		for _, p := range a.Providers {
+			if err := i.importProvider(p); err != nil {
+				return err
+			}
+		}
+		for _, artifact := range a.Artifacts {
+			if err := i.importArtifact(artifact); err != nil {
+				return err
+			}
+		}
+		for _, r := range a.Releases {
+			if err := i.importRelease(r); err != nil {
+				return err
+			}
+		}
+		for _, app := range a.Apps {
+			if err := i.importApp(app); err != nil {
+				return err
+			}
+		}
+		for _, f := range a.Formations {
+			if err := i.importFormation(f); err != nil {
+				return err
+			}
+		}
+		for _, r := range a.Resources {
+			if err := i.importResource(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// importRoutes adds the archive's routes to the router. Route IDs are
+// derived from the route's domain or port, so setting a route keeps its ID.
+func importRoutes(sc routerc.Client, routes []*router.Route, policy string, res *ct.ImportResult) error {
+	for _, route := range routes {
+		_, err := sc.GetRoute(route.ID)
+		switch {
+		case err == routerc.ErrNotFound:
+			res.Created["routes"]++
+		case err != nil:
+			return err
+		case policy == ct.ImportConflictOverwrite:
+			res.Updated["routes"]++
+		default:
+			res.Skipped["routes"]++
+			continue
+		}
+		if err := sc.SetRoute(route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importCluster recreates the objects of an export archive with their IDs.
+// The conflicts parameter decides whether objects which already exist are
+// skipped (the default) or overwritten. Routes are added once the other
+// objects have been committed, so a failure adding them leaves the rest of
+// the import in place.
+func importCluster(req *http.Request, apps *AppRepo, sc routerc.Client, r ResponseHelper) {
+	policy := req.FormValue("conflicts")
+	switch policy {
+	case "":
+		policy = ct.ImportConflictSkip
+	case ct.ImportConflictSkip, ct.ImportConflictOverwrite:
+	default:
+		r.Error(ct.ValidationError{Field: "conflicts", Message: "must be skip or overwrite"})
+		return
+	}
+	archive, err := readImportArchive(req.Body)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+
+	res := &ct.ImportResult{
+		Created: make(map[string]int),
+		Updated: make(map[string]int),
+		Skipped: make(map[string]int),
+	}
+	if err := importObjects(apps.db, archive, policy, res); err != nil {
+		r.Error(err)
+		return
+	}
+	if err := importRoutes(sc, archive.Routes, policy, res); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, res)
+}
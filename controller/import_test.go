@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/types"
+)
+
+// buildArchive returns a tar archive with each value encoded as JSON in a
+// file named after its key.
+func buildArchive(c *C, files map[string]interface{}) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, v := range files {
+		data, err := json.Marshal(v)
+		c.Assert(err, IsNil)
+		c.Assert(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))}), IsNil)
+		_, err = tw.Write(data)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tw.Close(), IsNil)
+	return &buf
+}
+
+type ImportSuite struct{}
+
+var _ = Suite(&ImportSuite{})
+
+func (ImportSuite) TestReadImportArchive(c *C) {
+	archive := buildArchive(c, map[string]interface{}{
+		"apps.json":   []*ct.ExportedApp{{App: &ct.App{ID: "a", Name: "foo"}, ReleaseID: "r", Env: map[string]string{"A": "1"}}},
+		"routes.json": []*router.Route{(&router.TCPRoute{Service: "foo"}).ToRoute()},
+		"README":      "ignored",
+	})
+	a, err := readImportArchive(archive)
+	c.Assert(err, IsNil)
+	c.Assert(a.Apps, HasLen, 1)
+	c.Assert(a.Apps[0].ID, Equals, "a")
+	c.Assert(a.Apps[0].Name, Equals, "foo")
+	c.Assert(a.Apps[0].ReleaseID, Equals, "r")
+	c.Assert(a.Apps[0].Env, DeepEquals, map[string]string{"A": "1"})
+	c.Assert(a.Routes, HasLen, 1)
+	c.Assert(a.Releases, HasLen, 0)
+
+	_, err = readImportArchive(buildArchive(c, map[string]interface{}{"apps.json": "not a list"}))
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+	_, err = readImportArchive(bytes.NewBufferString("not a tar archive"))
+	c.Assert(err, FitsTypeOf, ct.ValidationError{})
+}
+
+func (s *S) importArchive(c *C, archive io.Reader, conflicts string) (*http.Response, *ct.ImportResult) {
+	req, err := http.NewRequest("POST", s.srv.URL+"/import?conflicts="+conflicts, archive)
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/x-tar")
+	req.SetBasicAuth("", authKey)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	result := &ct.ImportResult{}
+	if res.StatusCode == 200 {
+		c.Assert(json.NewDecoder(res.Body).Decode(result), IsNil)
+	}
+	return res, result
+}
+
+func (s *S) TestImport(c *C) {
+	artifact := &ct.Artifact{ID: random.UUID(), Type: "docker", URI: "docker://import/" + random.String(8)}
+	release := &ct.Release{
+		ID:         random.UUID(),
+		ArtifactID: artifact.ID,
+		Processes:  map[string]ct.ProcessType{"web": {Cmd: []string{"start"}}},
+	}
+	app := &ct.ExportedApp{
+		App:       &ct.App{ID: random.UUID(), Name: "imported", Meta: map[string]string{"env": "staging"}},
+		ReleaseID: release.ID,
+		Env:       map[string]string{"A": "1"},
+		Quota:     &ct.AppQuota{MaxJobs: 5},
+	}
+	formation := &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}}
+	route := (&router.TCPRoute{Service: "imported"}).ToRoute()
+	route.ID = "tcp/" + random.UUID()
+	route.ParentRef = "controller/apps/" + app.ID
+	files := map[string]interface{}{
+		"apps.json":       []*ct.ExportedApp{app},
+		"artifacts.json":  []*ct.Artifact{artifact},
+		"releases.json":   []*ct.Release{release},
+		"formations.json": []*ct.Formation{formation},
+		"routes.json":     []*router.Route{route},
+	}
+
+	res, _ := s.importArchive(c, buildArchive(c, files), "replace")
+	c.Assert(res.StatusCode, Equals, 400)
+
+	res, result := s.importArchive(c, buildArchive(c, files), "")
+	c.Assert(res.StatusCode, Equals, 200)
+	for _, typ := range []string{"apps", "artifacts", "releases", "formations", "routes"} {
+		c.Assert(result.Created[typ], Equals, 1, Commentf("type %s", typ))
+	}
+
+	// objects are created with their IDs
+	gotApp := &ct.App{}
+	_, err := s.Get("/apps/"+app.ID, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Name, Equals, "imported")
+	gotRelease := &ct.Release{}
+	_, err = s.Get("/apps/"+app.ID+"/release", gotRelease)
+	c.Assert(err, IsNil)
+	c.Assert(gotRelease.ID, Equals, release.ID)
+	gotFormation := &ct.Formation{}
+	_, err = s.Get(formationPath(app.ID, release.ID), gotFormation)
+	c.Assert(err, IsNil)
+	c.Assert(gotFormation.Processes, DeepEquals, map[string]int{"web": 2})
+	env := &ct.AppEnv{}
+	_, err = s.Get("/apps/"+app.ID+"/env", env)
+	c.Assert(err, IsNil)
+	c.Assert(env.Env, DeepEquals, map[string]string{"A": "1"})
+	quota := &ct.AppQuota{}
+	_, err = s.Get("/apps/"+app.ID+"/quota", quota)
+	c.Assert(err, IsNil)
+	c.Assert(quota.MaxJobs, Equals, 5)
+
+	// existing objects are skipped by default and replaced with overwrite
+	app.Meta = map[string]string{"env": "production"}
+	res, result = s.importArchive(c, buildArchive(c, files), "skip")
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(result.Skipped["apps"], Equals, 1)
+	c.Assert(result.Created["apps"], Equals, 0)
+	_, err = s.Get("/apps/"+app.ID, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Meta["env"], Equals, "staging")
+
+	res, result = s.importArchive(c, buildArchive(c, files), "overwrite")
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(result.Updated["apps"], Equals, 1)
+	c.Assert(result.Updated["routes"], Equals, 1)
+	_, err = s.Get("/apps/"+app.ID, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Meta["env"], Equals, "production")
+
+	// an app with the name of an existing app fails the whole import
+	other := &ct.ExportedApp{App: &ct.App{ID: random.UUID(), Name: "imported"}}
+	otherArtifact := &ct.Artifact{ID: random.UUID(), Type: "docker", URI: fmt.Sprintf("docker://import/%s", random.String(8))}
+	res, _ = s.importArchive(c, buildArchive(c, map[string]interface{}{
+		"apps.json":      []*ct.ExportedApp{other},
+		"artifacts.json": []*ct.Artifact{otherArtifact},
+	}), "")
+	c.Assert(res.StatusCode, Equals, 400)
+	_, err = s.Get("/artifacts/"+otherArtifact.ID, &ct.Artifact{})
+	c.Assert(err, NotNil)
+}
@@ -5,8 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,6 +18,8 @@ import (
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/host/logbuf"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
 )
@@ -35,21 +39,24 @@ func (r *JobRepo) Add(job *ct.Job) error {
 		return ErrNotFound
 	}
 	// TODO: actually validate
-	err = r.db.QueryRow("INSERT INTO job_cache (job_id, host_id, app_id, release_id, process_type, state) VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at, updated_at",
-		jobID, hostID, job.AppID, job.ReleaseID, job.Type, job.State).Scan(&job.CreatedAt, &job.UpdatedAt)
+	err = r.db.QueryRow("INSERT INTO job_cache (job_id, host_id, app_id, release_id, process_type, state, crash_loop) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created_at, updated_at",
+		jobID, hostID, job.AppID, job.ReleaseID, job.Type, job.State, job.CrashLoop).Scan(&job.CreatedAt, &job.UpdatedAt)
 	if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
-		err = r.db.QueryRow("UPDATE job_cache SET state = $3, updated_at = now() WHERE job_id = $1 AND host_id = $2 RETURNING created_at, updated_at",
-			jobID, hostID, job.State).Scan(&job.CreatedAt, &job.UpdatedAt)
+		err = r.db.QueryRow("UPDATE job_cache SET state = $3, crash_loop = $4, updated_at = now() WHERE job_id = $1 AND host_id = $2 RETURNING created_at, updated_at",
+			jobID, hostID, job.State, job.CrashLoop).Scan(&job.CreatedAt, &job.UpdatedAt)
 	}
 	if err != nil {
 		return err
 	}
-	return r.db.Exec("INSERT INTO job_events (job_id, host_id, app_id, state) VALUES ($1, $2, $3, $4)", jobID, hostID, job.AppID, job.State)
+	if err := r.db.Exec("INSERT INTO job_events (job_id, host_id, app_id, state) VALUES ($1, $2, $3, $4)", jobID, hostID, job.AppID, job.State); err != nil {
+		return err
+	}
+	return createEvent(r.db, job.AppID, ct.EventTypeJob, job.ID, job)
 }
 
 func scanJob(s Scanner) (*ct.Job, error) {
 	job := &ct.Job{}
-	err := s.Scan(&job.ID, &job.AppID, &job.ReleaseID, &job.Type, &job.State, &job.CreatedAt, &job.UpdatedAt)
+	err := s.Scan(&job.ID, &job.AppID, &job.ReleaseID, &job.Type, &job.State, &job.CrashLoop, &job.CreatedAt, &job.UpdatedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
@@ -61,8 +68,26 @@ func scanJob(s Scanner) (*ct.Job, error) {
 	return job, nil
 }
 
+func (r *JobRepo) Get(id string) (*ct.Job, error) {
+	hostID, jobID, err := cluster.ParseJobID(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	row := r.db.QueryRow("SELECT concat(host_id, '-', job_id), app_id, release_id, process_type, state, crash_loop, created_at, updated_at FROM job_cache WHERE job_id = $1 AND host_id = $2", jobID, hostID)
+	return scanJob(row)
+}
+
+// restarts returns the number of jobs of the same release and process type
+// as job that crashed before it was created.
+func (r *JobRepo) restarts(job *ct.Job) (int, error) {
+	var n int
+	err := r.db.QueryRow("SELECT count(*) FROM job_cache WHERE app_id = $1 AND release_id = $2 AND process_type = $3 AND state = 'crashed' AND created_at < $4",
+		job.AppID, job.ReleaseID, job.Type, job.CreatedAt).Scan(&n)
+	return n, err
+}
+
 func (r *JobRepo) List(appID string) ([]*ct.Job, error) {
-	rows, err := r.db.Query("SELECT concat(host_id, '-', job_id), app_id, release_id, process_type, state, created_at, updated_at FROM job_cache WHERE app_id = $1 ORDER BY created_at DESC", appID)
+	rows, err := r.db.Query("SELECT concat(host_id, '-', job_id), app_id, release_id, process_type, state, crash_loop, created_at, updated_at FROM job_cache WHERE app_id = $1 ORDER BY created_at DESC", appID)
 	if err != nil {
 		return nil, err
 	}
@@ -141,6 +166,149 @@ func listJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *JobRe
 	r.JSON(200, list)
 }
 
+// getJob responds with the job's record combined with its state on the
+// host, which is left out if the host can't be reached rather than failing
+// the request.
+func getJob(app *ct.App, params martini.Params, repo *JobRepo, cl clusterClient, r ResponseHelper) {
+	job, err := repo.Get(params["jobs_id"])
+	if err == nil && job.AppID != app.ID {
+		err = ErrNotFound
+	}
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	detail := &ct.JobDetail{Job: *job}
+	if detail.Restarts, err = repo.restarts(job); err != nil {
+		r.Error(err)
+		return
+	}
+
+	hostID, jobID, _ := cluster.ParseJobID(job.ID)
+	detail.HostID = hostID
+	if err := getHostJob(cl, hostID, jobID, detail); err != nil {
+		detail.HostError = err.Error()
+	}
+	r.JSON(200, detail)
+}
+
+// processCrashWindow is how long ago jobs must have crashed to be counted
+// as crashed by getAppProcesses.
+const processCrashWindow = 10 * time.Minute
+
+// stateCounts returns the number of the app's jobs in the state by process
+// type, counting jobs which entered the state after since.
+func (r *JobRepo) stateCounts(appID, state string, since time.Time) (map[string]int, error) {
+	rows, err := r.db.Query("SELECT process_type, count(*) FROM job_cache WHERE app_id = $1 AND state = $2 AND process_type IS NOT NULL AND updated_at > $3 GROUP BY process_type", appID, state, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var typ string
+		var n int
+		if err := rows.Scan(&typ, &n); err != nil {
+			return nil, err
+		}
+		counts[typ] = n
+	}
+	return counts, rows.Err()
+}
+
+// getAppProcesses responds with the desired number of jobs of each of the
+// app's process types along with the number running on hosts, and the
+// number starting or recently crashed as reported by the scheduler.
+func getAppProcesses(app *ct.App, formations *FormationRepo, jobs *JobRepo, cl clusterClient, r ResponseHelper) {
+	statuses := make(map[string]*ct.ProcessStatus)
+	status := func(typ string) *ct.ProcessStatus {
+		s, ok := statuses[typ]
+		if !ok {
+			s = &ct.ProcessStatus{Type: typ}
+			statuses[typ] = s
+		}
+		return s
+	}
+
+	list, err := formations.List(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	for _, f := range list {
+		for typ, n := range f.Processes {
+			status(typ).Desired += n
+		}
+	}
+
+	hosts, err := cl.ListHosts()
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	for _, h := range hosts {
+		for _, job := range h.Jobs {
+			// one-off jobs have no type
+			if job.Metadata["flynn-controller.app"] != app.ID || job.Metadata["flynn-controller.type"] == "" {
+				continue
+			}
+			status(job.Metadata["flynn-controller.type"]).Running++
+		}
+	}
+
+	pending, err := jobs.stateCounts(app.ID, "starting", time.Time{})
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	crashed, err := jobs.stateCounts(app.ID, "crashed", time.Now().Add(-processCrashWindow))
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	for typ, n := range pending {
+		status(typ).Pending = n
+	}
+	for typ, n := range crashed {
+		status(typ).Crashed = n
+	}
+
+	types := make([]string, 0, len(statuses))
+	for typ := range statuses {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	res := make([]*ct.ProcessStatus, len(types))
+	for i, typ := range types {
+		res[i] = statuses[typ]
+	}
+	r.JSON(200, res)
+}
+
+func getHostJob(cl clusterClient, hostID, jobID string, detail *ct.JobDetail) error {
+	h, err := cl.DialHost(hostID)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	active, err := h.GetJob(jobID)
+	if err != nil {
+		return err
+	}
+	detail.HostStatus = active.Status.String()
+	if !active.StartedAt.IsZero() {
+		detail.StartedAt = &active.StartedAt
+	}
+	if !active.EndedAt.IsZero() {
+		detail.EndedAt = &active.EndedAt
+		detail.ExitStatus = &active.ExitStatus
+	}
+	if active.Error != nil {
+		detail.Error = *active.Error
+	}
+	return nil
+}
+
 func putJob(job ct.Job, app *ct.App, repo *JobRepo, r ResponseHelper) {
 	job.AppID = app.ID
 	if err := repo.Add(&job); err != nil {
@@ -150,7 +318,18 @@ func putJob(job ct.Job, app *ct.App, repo *JobRepo, r ResponseHelper) {
 	r.JSON(200, &job)
 }
 
+// jobLog writes the job's output. Requests accepting text/event-stream are
+// handled by jobLogSSE and long-poll requests by pollJobLog, otherwise the
+// raw attach stream is copied to the response for older clients.
 func jobLog(req *http.Request, app *ct.App, params martini.Params, hc cluster.Host, w http.ResponseWriter, r ResponseHelper) {
+	if isLongPoll(req) {
+		pollJobLog(req, params["jobs_id"], hc, r)
+		return
+	}
+	if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+		jobLogSSE(req, params["jobs_id"], hc, w, r)
+		return
+	}
 	attachReq := &host.AttachReq{
 		JobID: params["jobs_id"],
 		Flags: host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagLogs,
@@ -179,33 +358,405 @@ func jobLog(req *http.Request, app *ct.App, params martini.Params, hc cluster.Ho
 		defer attachClient.Close()
 	}
 
-	sse := strings.Contains(req.Header.Get("Accept"), "text/event-stream")
-	if sse {
-		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
-	} else {
-		w.Header().Set("Content-Type", "application/vnd.flynn.attach")
-	}
+	w.Header().Set("Content-Type", "application/vnd.flynn.attach")
 	w.WriteHeader(200)
 	// Send headers right away if tailing
 	if wf, ok := w.(http.Flusher); ok && tail {
 		wf.Flush()
 	}
+	io.Copy(flushWriter{w, tail}, attachClient.Conn())
+}
+
+// logHeartbeatInterval is how often a comment is sent on a quiet log event
+// stream so that proxies do not close the connection.
+const logHeartbeatInterval = 30 * time.Second
+
+// sseLogChunk is the event sent for each line of a job's log unless the
+// log_line format is requested, and is what the dashboard reads.
+type sseLogChunk struct {
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+// jobLogSSE streams the job's log from the host's log buffer as server-sent
+// events, each line being a JSON encoded sseLogChunk, or a ct.AppLogLine if
+// format=log_line is given. The lines parameter limits the number of
+// existing lines sent, and if follow is set (or tail, which older clients
+// send) the stream continues with new output until the job exits. The stream
+// ends with an eof event, or an exit event containing the job's exit status
+// when following.
+func jobLogSSE(req *http.Request, jobID string, hc cluster.Host, w http.ResponseWriter, r ResponseHelper) {
+	lines, err := logLinesParam(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	var logLines bool
+	switch req.FormValue("format") {
+	case "":
+	case "log_line":
+		logLines = true
+	default:
+		r.Error(ct.ValidationError{Field: "format", Message: "is invalid"})
+		return
+	}
+	follow := req.FormValue("follow") == "true" || req.FormValue("tail") != ""
+	wait := req.FormValue("wait") != ""
+	job := &ct.Job{ID: jobID}
 
-	fw := flushWriter{w, tail}
-	if sse {
-		ssew := NewSSELogWriter(w)
-		exit, err := attachClient.Receive(flushWriter{ssew.Stream("stdout"), tail}, flushWriter{ssew.Stream("stderr"), tail})
+	done := make(chan struct{})
+	defer close(done)
+
+	// attach to the live stream before reading the existing log so that no
+	// output is missed, as in appLog
+	type exitStatus struct {
+		status int
+		err    error
+	}
+	var live chan *ct.AppLogLine
+	var exit chan exitStatus
+	if follow {
+		ac, err := attachAppLog(hc, jobID, true, wait)
 		if err != nil {
-			fw.Write([]byte("event: error\ndata: {}\n\n"))
+			if err == cluster.ErrWouldWait {
+				err = ErrNotFound
+			}
+			r.Error(err)
+			return
+		}
+		live = make(chan *ct.AppLogLine)
+		exit = make(chan exitStatus, 1)
+		go func() {
+			defer close(live)
+			status, err := readAppLog(ac, job, done, func(line *ct.AppLogLine) bool {
+				select {
+				case live <- line:
+					return true
+				case <-done:
+					return false
+				}
+			})
+			exit <- exitStatus{status, err}
+		}()
+	}
+
+	ac, err := attachAppLog(hc, jobID, false, wait && !follow)
+	if err != nil {
+		if err == cluster.ErrWouldWait {
+			err = ErrNotFound
+		}
+		r.Error(err)
+		return
+	}
+	var history []*ct.AppLogLine
+	var since time.Time
+	if _, err := readAppLog(ac, job, done, func(line *ct.AppLogLine) bool {
+		history = append(history, line)
+		since = line.Timestamp
+		return true
+	}); err != nil {
+		r.Error(err)
+		return
+	}
+	if lines > 0 && len(history) > lines {
+		history = history[len(history)-lines:]
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flush := func() {
+		if wf, ok := w.(http.Flusher); ok {
+			wf.Flush()
+		}
+	}
+	sendEvent := func(event string, data interface{}) error {
+		if event != "" {
+			if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write([]byte("data: ")); err != nil {
+			return err
+		}
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			return err
+		}
+		_, err := w.Write([]byte("\n"))
+		return err
+	}
+	sendLine := func(line *ct.AppLogLine) error {
+		if logLines {
+			return sendEvent("", line)
+		}
+		return sendEvent("", &sseLogChunk{Stream: line.Stream, Data: line.Message})
+	}
+	for _, line := range history {
+		if err := sendLine(line); err != nil {
 			return
 		}
-		if tail {
-			fmt.Fprintf(fw, "event: exit\ndata: {\"status\": %d}\n\n", exit)
+	}
+	if !follow {
+		sendEvent("eof", struct{}{})
+		return
+	}
+	flush()
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	heartbeat := time.NewTicker(logHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case line, ok := <-live:
+			if !ok {
+				if e := <-exit; e.err != nil {
+					sendEvent("error", struct{}{})
+				} else {
+					fmt.Fprintf(w, "event: exit\ndata: {\"status\": %d}\n\n", e.status)
+				}
+				return
+			}
+			if !line.Timestamp.After(since) {
+				continue
+			}
+			if err := sendLine(line); err != nil {
+				return
+			}
+			flush()
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(":\n")); err != nil {
+				return
+			}
+			flush()
+		case <-closed:
 			return
 		}
-		fw.Write([]byte("event: eof\ndata: {}\n\n"))
+	}
+}
+
+// logLinesParam returns the number of existing log lines requested, zero
+// meaning all of them.
+func logLinesParam(req *http.Request) (int, error) {
+	s := req.FormValue("lines")
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, ct.ValidationError{Field: "lines", Message: "is invalid"}
+	}
+	return n, nil
+}
+
+type appLogLines []*ct.AppLogLine
+
+func (l appLogLines) Len() int           { return len(l) }
+func (l appLogLines) Less(i, j int) bool { return l[i].Timestamp.Before(l[j].Timestamp) }
+func (l appLogLines) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// appLog writes the output of all of the app's active jobs as a stream of
+// JSON encoded ct.AppLogLine values ordered by the time they were written.
+// The lines parameter limits the number of existing lines written, and if
+// follow is set the response continues with new output until all of the jobs
+// exit.
+func appLog(req *http.Request, app *ct.App, repo *JobRepo, cl clusterClient, w http.ResponseWriter, r ResponseHelper) {
+	lines, err := logLinesParam(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	follow := req.FormValue("follow") == "true"
+
+	list, err := repo.List(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	hosts := make(map[string]cluster.Host)
+	defer func() {
+		for _, h := range hosts {
+			h.Close()
+		}
+	}()
+	type logJob struct {
+		job   *ct.Job
+		id    string
+		host  cluster.Host
+		since time.Time
+	}
+	var jobs []*logJob
+	for _, job := range list {
+		if job.State != "up" && job.State != "starting" && job.State != "unhealthy" {
+			continue
+		}
+		hostID, jobID, err := cluster.ParseJobID(job.ID)
+		if err != nil {
+			continue
+		}
+		h, ok := hosts[hostID]
+		if !ok {
+			if h, err = cl.DialHost(hostID); err != nil {
+				log.Printf("appLog: unable to connect to host %s: %s", hostID, err)
+				continue
+			}
+			hosts[hostID] = h
+		}
+		jobs = append(jobs, &logJob{job: job, id: jobID, host: h})
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// When following, attach to the live streams before reading the existing
+	// logs so that no output is missed, lines that are also in the existing
+	// logs are skipped using the timestamp of the last line read from them.
+	var live chan *ct.AppLogLine
+	if follow {
+		live = make(chan *ct.AppLogLine)
+		var wg sync.WaitGroup
+		for _, j := range jobs {
+			ac, err := attachAppLog(j.host, j.id, true, false)
+			if err != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(j *logJob) {
+				defer wg.Done()
+				readAppLog(ac, j.job, done, func(line *ct.AppLogLine) bool {
+					select {
+					case live <- line:
+						return true
+					case <-done:
+						return false
+					}
+				})
+			}(j)
+		}
+		go func() {
+			wg.Wait()
+			close(live)
+		}()
+	}
+
+	var history appLogLines
+	for _, j := range jobs {
+		ac, err := attachAppLog(j.host, j.id, false, false)
+		if err != nil {
+			continue
+		}
+		readAppLog(ac, j.job, done, func(line *ct.AppLogLine) bool {
+			history = append(history, line)
+			j.since = line.Timestamp
+			return true
+		})
+	}
+	sort.Stable(history)
+	if lines > 0 && len(history) > lines {
+		history = history[len(history)-lines:]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	if wf, ok := w.(http.Flusher); ok && follow {
+		wf.Flush()
+	}
+	enc := json.NewEncoder(flushWriter{w, follow})
+	for _, line := range history {
+		if err := enc.Encode(line); err != nil {
+			return
+		}
+	}
+	if !follow {
+		return
+	}
+
+	since := make(map[string]time.Time, len(jobs))
+	for _, j := range jobs {
+		since[j.job.ID] = j.since
+	}
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	for {
+		select {
+		case line, ok := <-live:
+			if !ok {
+				return
+			}
+			if !line.Timestamp.After(since[line.JobID]) {
+				continue
+			}
+			if err := enc.Encode(line); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func attachAppLog(h cluster.Host, jobID string, stream, wait bool) (cluster.AttachClient, error) {
+	flags := host.AttachFlagStdout | host.AttachFlagStderr | host.AttachFlagTimestamps
+	if stream {
+		flags |= host.AttachFlagStream
 	} else {
-		io.Copy(fw, attachClient.Conn())
+		flags |= host.AttachFlagLogs
+	}
+	ac, err := h.Attach(&host.AttachReq{JobID: jobID, Flags: flags}, wait)
+	if err != nil && err != cluster.ErrWouldWait {
+		log.Printf("appLog: unable to attach to job %s: %s", jobID, err)
+	}
+	return ac, err
+}
+
+// readAppLog decodes the timestamped log records sent by the host, calling fn
+// with each one until the log ends, done is closed or fn returns false. The
+// job's exit status is returned if the host sent it at the end of the log.
+func readAppLog(ac cluster.AttachClient, job *ct.Job, done <-chan struct{}, fn func(*ct.AppLogLine) bool) (int, error) {
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-done:
+		case <-finished:
+		}
+		ac.Close()
+	}()
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	exit := make(chan int, 1)
+	go func() {
+		status, err := ac.Receive(pw, ioutil.Discard)
+		exit <- status
+		pw.CloseWithError(err)
+	}()
+
+	dec := json.NewDecoder(pr)
+	for {
+		var data logbuf.Data
+		if err := dec.Decode(&data); err == io.EOF {
+			return <-exit, nil
+		} else if err != nil {
+			return 0, err
+		}
+		line := &ct.AppLogLine{
+			JobID:       job.ID,
+			ProcessType: job.Type,
+			Stream:      "stdout",
+			Timestamp:   data.Timestamp.Time,
+			Message:     data.Message,
+		}
+		if data.Stream == 2 {
+			line.Stream = "stderr"
+		}
+		if !fn(line) {
+			return 0, nil
+		}
 	}
 }
 
@@ -321,54 +872,6 @@ func streamJobs(req *http.Request, w http.ResponseWriter, app *ct.App, repo *Job
 	}
 }
 
-type SSELogWriter interface {
-	Stream(string) io.Writer
-}
-
-func NewSSELogWriter(w io.Writer) SSELogWriter {
-	return &sseLogWriter{Writer: w, Encoder: json.NewEncoder(w)}
-}
-
-type sseLogWriter struct {
-	io.Writer
-	*json.Encoder
-	sync.Mutex
-}
-
-func (w *sseLogWriter) Stream(s string) io.Writer {
-	return &sseLogStreamWriter{w: w, s: s}
-}
-
-type sseLogStreamWriter struct {
-	w *sseLogWriter
-	s string
-}
-
-type sseLogChunk struct {
-	Stream string `json:"stream"`
-	Data   string `json:"data"`
-}
-
-func (w *sseLogStreamWriter) Write(p []byte) (int, error) {
-	w.w.Lock()
-	defer w.w.Unlock()
-
-	if _, err := w.w.Write([]byte("data: ")); err != nil {
-		return 0, err
-	}
-	if err := w.w.Encode(&sseLogChunk{Stream: w.s, Data: string(p)}); err != nil {
-		return 0, err
-	}
-	_, err := w.w.Write([]byte("\n"))
-	return len(p), err
-}
-
-func (w *sseLogStreamWriter) Flush() {
-	if fw, ok := w.w.Writer.(http.Flusher); ok {
-		fw.Flush()
-	}
-}
-
 type flushWriter struct {
 	w  io.Writer
 	ok bool
@@ -409,6 +912,56 @@ func connectHostMiddleware(c martini.Context, params martini.Params, cl clusterC
 	client.Close()
 }
 
+// jobStats returns the resource usage of a running job, read by its host.
+func jobStats(params martini.Params, hc cluster.Host, r ResponseHelper) {
+	stats, err := hc.JobStats(params["jobs_id"])
+	switch err {
+	case nil:
+	case cluster.ErrJobNotFound:
+		r.Error(ErrNotFound)
+		return
+	case cluster.ErrJobNotRunning:
+		r.Error(ErrConflict)
+		return
+	default:
+		r.Error(err)
+		return
+	}
+	r.JSON(200, stats)
+}
+
+// execJob runs a command in the container of a running job and proxies the
+// attach protocol between the client and the job's host, the command's stdin
+// is always attached.
+func execJob(params martini.Params, execReq ct.JobExec, hc cluster.Host, w http.ResponseWriter, r ResponseHelper) {
+	if len(execReq.Cmd) == 0 {
+		r.Error(ct.ValidationError{Field: "cmd", Message: "must be set"})
+		return
+	}
+	attachClient, err := hc.Exec(params["jobs_id"], &host.ExecReq{
+		Cmd:    execReq.Cmd,
+		Env:    execReq.Env,
+		TTY:    execReq.TTY,
+		Stdin:  true,
+		Height: uint16(execReq.Lines),
+		Width:  uint16(execReq.Columns),
+	})
+	switch err {
+	case nil:
+	case cluster.ErrJobNotFound:
+		r.Error(ErrNotFound)
+		return
+	case cluster.ErrJobNotRunning:
+		r.Error(ErrConflict)
+		return
+	default:
+		r.Error(fmt.Errorf("exec failed: %s", err))
+		return
+	}
+	defer attachClient.Close()
+	proxyAttach(w, attachClient)
+}
+
 func killJob(app *ct.App, params martini.Params, client cluster.Host, r ResponseHelper) {
 	if err := client.StopJob(params["jobs_id"]); err != nil {
 		r.Error(err)
@@ -416,27 +969,31 @@ func killJob(app *ct.App, params martini.Params, client cluster.Host, r Response
 	}
 }
 
-func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *ArtifactRepo, cl clusterClient, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
-	data, err := releases.Get(newJob.ReleaseID)
-	if err != nil {
-		r.Error(err)
+func signalJob(app *ct.App, params martini.Params, client cluster.Host, r ResponseHelper) {
+	sig, err := strconv.Atoi(params["signal"])
+	if err != nil || sig <= 0 {
+		r.Error(ct.ValidationError{Field: "signal", Message: "is invalid"})
 		return
 	}
-	release := data.(*ct.Release)
-	data, err = artifacts.Get(release.ArtifactID)
-	if err != nil {
+	if err := client.SignalJob(params["jobs_id"], sig); err != nil {
 		r.Error(err)
 		return
 	}
-	artifact := data.(*ct.Artifact)
-	attach := strings.Contains(req.Header.Get("Accept"), "application/vnd.flynn.attach")
+	r.WriteHeader(200)
+}
 
-	env := make(map[string]string, len(release.Env)+len(newJob.Env))
+// newOneOffJob returns a host job which runs cmd with the artifacts and
+// environment of the app's release, envs are merged over the release
+// environment in order.
+func newOneOffJob(app *ct.App, release *ct.Release, artifacts []*ct.Artifact, entrypoint, cmd []string, envs ...map[string]string) *host.Job {
+	jobEnv := make(map[string]string, len(release.Env))
 	for k, v := range release.Env {
-		env[k] = v
+		jobEnv[k] = v
 	}
-	for k, v := range newJob.Env {
-		env[k] = v
+	for _, env := range envs {
+		for k, v := range env {
+			jobEnv[k] = v
+		}
 	}
 	job := &host.Job{
 		ID: cluster.RandomJobID(""),
@@ -445,33 +1002,55 @@ func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *Art
 			"flynn-controller.app_name": app.Name,
 			"flynn-controller.release":  release.ID,
 		},
-		Artifact: host.Artifact{
-			Type: artifact.Type,
-			URI:  artifact.URI,
-		},
 		Config: host.ContainerConfig{
-			Cmd:   newJob.Cmd,
-			Env:   env,
-			TTY:   newJob.TTY,
-			Stdin: attach,
+			Cmd: cmd,
+			Env: jobEnv,
 		},
 	}
-	if len(newJob.Entrypoint) > 0 {
-		job.Config.Entrypoint = newJob.Entrypoint
+	utils.SetJobArtifacts(job, artifacts)
+	if len(entrypoint) > 0 {
+		job.Config.Entrypoint = entrypoint
 	}
+	return job
+}
 
+func randomHost(cl clusterClient) (string, error) {
 	hosts, err := cl.ListHosts()
+	if err != nil {
+		return "", err
+	}
+	for id := range hosts {
+		return id, nil
+	}
+	return "", errors.New("no hosts found")
+}
+
+func runJob(app *ct.App, newJob ct.NewJob, apps *AppRepo, releases *ReleaseRepo, artifacts *ArtifactRepo, cl clusterClient, req *http.Request, w http.ResponseWriter, r ResponseHelper) {
+	data, err := releases.Get(newJob.ReleaseID)
 	if err != nil {
 		r.Error(err)
 		return
 	}
-	// pick a random host
-	var hostID string
-	for hostID = range hosts {
-		break
+	release := data.(*ct.Release)
+	releaseArtifacts, err := artifacts.ReleaseArtifacts(release)
+	if err != nil {
+		r.Error(err)
+		return
 	}
-	if hostID == "" {
-		r.Error(errors.New("no hosts found"))
+	appEnv, err := apps.Env(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	attach := strings.Contains(req.Header.Get("Accept"), "application/vnd.flynn.attach")
+
+	job := newOneOffJob(app, release, releaseArtifacts, newJob.Entrypoint, newJob.Cmd, appEnv, newJob.Env)
+	job.Config.TTY = newJob.TTY
+	job.Config.Stdin = attach
+
+	hostID, err := randomHost(cl)
+	if err != nil {
+		r.Error(err)
 		return
 	}
 
@@ -508,25 +1087,7 @@ func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *Art
 			r.Error(fmt.Errorf("attach wait failed: %s", err.Error()))
 			return
 		}
-		w.Header().Set("Content-Type", "application/vnd.flynn.attach")
-		w.Header().Set("Content-Length", "0")
-		w.WriteHeader(http.StatusSwitchingProtocols)
-		conn, _, err := w.(http.Hijacker).Hijack()
-		if err != nil {
-			panic(err)
-		}
-		defer conn.Close()
-
-		done := make(chan struct{}, 2)
-		cp := func(to io.Writer, from io.Reader) {
-			io.Copy(to, from)
-			done <- struct{}{}
-		}
-		go cp(conn, attachClient.Conn())
-		go cp(attachClient.Conn(), conn)
-		<-done
-		<-done
-
+		proxyAttach(w, attachClient)
 		return
 	} else {
 		r.JSON(200, &ct.Job{
@@ -536,3 +1097,26 @@ func runJob(app *ct.App, newJob ct.NewJob, releases *ReleaseRepo, artifacts *Art
 		})
 	}
 }
+
+// proxyAttach hijacks the client's connection and copies the attach protocol
+// between it and the host until either side closes.
+func proxyAttach(w http.ResponseWriter, attachClient cluster.AttachClient) {
+	w.Header().Set("Content-Type", "application/vnd.flynn.attach")
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusSwitchingProtocols)
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{}, 2)
+	cp := func(to io.Writer, from io.Reader) {
+		io.Copy(to, from)
+		done <- struct{}{}
+	}
+	go cp(conn, attachClient.Conn())
+	go cp(attachClient.Conn(), conn)
+	<-done
+	<-done
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"bytes"
-	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
 	tu "github.com/flynn/flynn/controller/testutils"
@@ -44,6 +45,38 @@ func (s *S) TestJobList(c *C) {
 	c.Assert(job.ReleaseID, Equals, release.ID)
 }
 
+func (s *S) TestAppProcesses(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-processes"})
+	release := s.createTestRelease(c, &ct.Release{})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2, "worker": 1}})
+
+	hostID := random.UUID()
+	hostJob := func(typ string) *host.Job {
+		return &host.Job{ID: random.UUID(), Metadata: map[string]string{
+			"flynn-controller.app":     app.ID,
+			"flynn-controller.release": release.ID,
+			"flynn-controller.type":    typ,
+		}}
+	}
+	s.cc.SetHosts(map[string]host.Host{hostID: {ID: hostID, Jobs: []*host.Job{
+		hostJob("web"),
+		hostJob("worker"),
+		hostJob(""),
+	}}})
+	s.createTestJob(c, &ct.Job{ID: hostID + "-" + random.UUID(), AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "starting"})
+	s.createTestJob(c, &ct.Job{ID: hostID + "-" + random.UUID(), AppID: app.ID, ReleaseID: release.ID, Type: "worker", State: "crashed"})
+
+	var list []*ct.ProcessStatus
+	_, err := s.Get("/apps/"+app.ID+"/processes", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, DeepEquals, []*ct.ProcessStatus{
+		{Type: "web", Desired: 2, Running: 1, Pending: 1},
+		{Type: "worker", Desired: 1, Running: 1, Crashed: 1},
+	})
+	c.Assert(list[0].Converged(), Equals, false)
+	c.Assert(list[1].Converged(), Equals, true)
+}
+
 func newFakeLog(r io.Reader) *fakeLog {
 	return &fakeLog{r}
 }
@@ -69,6 +102,151 @@ func (s *S) TestKillJob(c *C) {
 	c.Assert(hc.IsStopped(jobID), Equals, true)
 }
 
+func (s *S) TestJobStats(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "jobstats"})
+	hostID, jobID := random.UUID(), random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	s.cc.SetHostClient(hostID, hc)
+	hc.SetJobStats(jobID, &host.JobStats{JobID: jobID, Memory: host.MemoryStats{Usage: 1024}})
+
+	var stats host.JobStats
+	_, err := s.Get("/apps/"+app.ID+"/jobs/"+hostID+"-"+jobID+"/stats", &stats)
+	c.Assert(err, IsNil)
+	c.Assert(stats.JobID, Equals, jobID)
+	c.Assert(stats.Memory.Usage, Equals, uint64(1024))
+
+	res, _ := s.Get("/apps/"+app.ID+"/jobs/"+hostID+"-"+random.UUID()+"/stats", &stats)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestExecJob(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "execjob"})
+	hostID, jobID := random.UUID(), random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	s.cc.SetHostClient(hostID, hc)
+
+	done := make(chan struct{})
+	hc.SetExecFunc(jobID, func(req *host.ExecReq) (cluster.AttachClient, error) {
+		c.Assert(req, DeepEquals, &host.ExecReq{
+			Cmd:    []string{"bash"},
+			Env:    map[string]string{"TERM": "xterm"},
+			TTY:    true,
+			Stdin:  true,
+			Height: 24,
+			Width:  80,
+		})
+		pipeR, pipeW := io.Pipe()
+		go func() {
+			stdin, err := ioutil.ReadAll(pipeR)
+			c.Assert(err, IsNil)
+			c.Assert(string(stdin), Equals, "exit\n")
+			close(done)
+		}()
+		return cluster.NewAttachClient(struct {
+			io.Reader
+			io.WriteCloser
+		}{strings.NewReader("$ "), pipeW}), nil
+	})
+
+	data, _ := json.Marshal(&ct.JobExec{
+		Cmd:     []string{"bash"},
+		Env:     map[string]string{"TERM": "xterm"},
+		TTY:     true,
+		Columns: 80,
+		Lines:   24,
+	})
+	req, err := http.NewRequest("POST", s.srv.URL+"/apps/"+app.ID+"/jobs/"+hostID+"-"+jobID+"/exec", bytes.NewBuffer(data))
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/vnd.flynn.attach")
+	_, rwc, err := utils.HijackRequest(req, nil)
+	c.Assert(err, IsNil)
+
+	_, err = rwc.Write([]byte("exit\n"))
+	c.Assert(err, IsNil)
+	rwc.CloseWrite()
+	stdout, err := ioutil.ReadAll(rwc)
+	c.Assert(err, IsNil)
+	c.Assert(string(stdout), Equals, "$ ")
+	rwc.Close()
+	<-done
+
+	res, _ := s.Post("/apps/"+app.ID+"/jobs/"+hostID+"-"+random.UUID()+"/exec", &ct.JobExec{Cmd: []string{"bash"}}, nil)
+	c.Assert(res.StatusCode, Equals, 404)
+	res, _ = s.Post("/apps/"+app.ID+"/jobs/"+hostID+"-"+jobID+"/exec", &ct.JobExec{}, &ct.ValidationError{})
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestGetJob(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "getjob"})
+	release := s.createTestRelease(c, &ct.Release{})
+	hostID, jobID := random.UUID(), random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	s.cc.SetHostClient(hostID, hc)
+
+	crashed := &ct.Job{ID: hostID + "-" + random.UUID(), AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "crashed"}
+	s.createTestJob(c, crashed)
+	job := &ct.Job{ID: hostID + "-" + jobID, AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "down", CrashLoop: true}
+	s.createTestJob(c, job)
+
+	errMsg := "exit status 1"
+	started := time.Now().Add(-time.Minute).UTC()
+	ended := time.Now().UTC()
+	hc.SetJob(jobID, &host.ActiveJob{
+		Status:     host.StatusCrashed,
+		StartedAt:  started,
+		EndedAt:    ended,
+		ExitStatus: 1,
+		Error:      &errMsg,
+	})
+
+	detail := &ct.JobDetail{}
+	res, err := s.Get("/apps/"+app.ID+"/jobs/"+job.ID, detail)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(detail.ID, Equals, job.ID)
+	c.Assert(detail.Type, Equals, "web")
+	c.Assert(detail.State, Equals, "down")
+	c.Assert(detail.HostID, Equals, hostID)
+	c.Assert(detail.Restarts, Equals, 1)
+	c.Assert(detail.CrashLoop, Equals, true)
+	c.Assert(detail.HostStatus, Equals, "crashed")
+	c.Assert(detail.ExitStatus, NotNil)
+	c.Assert(*detail.ExitStatus, Equals, 1)
+	c.Assert(detail.Error, Equals, errMsg)
+	c.Assert(detail.HostError, Equals, "")
+
+	// the controller's record is returned if the host is unavailable
+	other := &ct.Job{ID: random.UUID() + "-" + random.UUID(), AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"}
+	s.createTestJob(c, other)
+	detail = &ct.JobDetail{}
+	res, err = s.Get("/apps/"+app.ID+"/jobs/"+other.ID, detail)
+	c.Assert(err, IsNil)
+	c.Assert(detail.State, Equals, "up")
+	c.Assert(detail.HostError, Not(Equals), "")
+
+	res, err = s.Get("/apps/"+app.ID+"/jobs/"+random.UUID()+"-"+random.UUID(), detail)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestSignalJob(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "signaljob"})
+	hostID, jobID := random.UUID(), random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	s.cc.SetHostClient(hostID, hc)
+
+	path := "/apps/" + app.ID + "/jobs/" + hostID + "-" + jobID + "/signal/"
+	res, err := s.Post(path+"1", nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(hc.Signals(jobID), DeepEquals, []int{1})
+
+	res, err = s.Post(path+"foo", nil, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
 func (s *S) createLogTestApp(c *C, name string, stream io.Reader) (*ct.App, string, string) {
 	app := s.createTestApp(c, &ct.App{Name: name})
 	hostID, jobID := random.UUID(), random.UUID()
@@ -146,20 +324,119 @@ func (s *S) TestJobLogTail(c *C) {
 	c.Assert(buf, DeepEquals, data)
 }
 
-func (s *S) TestJobLogSSE(c *C) {
-	logData, err := base64.StdEncoding.DecodeString("AwIAAAANaGVsbG8gc3RkZXJyCgMBAAAADWhlbGxvIHN0ZG91dAoDAQAAABNMaXN0ZW5pbmcgb24gNTUwMTIKAwEAAAAAAwIAAAAA")
+func timestampedLog(records ...string) io.Reader {
+	var buf bytes.Buffer
+	for _, r := range records {
+		buf.Write([]byte{host.AttachData, 1})
+		binary.Write(&buf, binary.BigEndian, uint32(len(r)))
+		buf.WriteString(r)
+	}
+	buf.Write([]byte{host.AttachData, 1, 0, 0, 0, 0, host.AttachData, 2, 0, 0, 0, 0})
+	return &buf
+}
+
+func (s *S) TestAppLog(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-log"})
+	release := s.createTestRelease(c, &ct.Release{})
+	hostID, job1, job2 := random.UUID(), random.UUID(), random.UUID()
+	s.createTestJob(c, &ct.Job{ID: hostID + "-" + job1, AppID: app.ID, ReleaseID: release.ID, Type: "web", State: "up"})
+	s.createTestJob(c, &ct.Job{ID: hostID + "-" + job2, AppID: app.ID, ReleaseID: release.ID, Type: "worker", State: "up"})
+
+	hc := tu.NewFakeHostClient(hostID)
+	hc.SetAttach(job1, cluster.NewAttachClient(newFakeLog(timestampedLog(
+		`{"s":1,"t":1000,"m":"one"}`,
+		`{"s":2,"t":3000,"m":"three"}`,
+	))))
+	hc.SetAttach(job2, cluster.NewAttachClient(newFakeLog(timestampedLog(
+		`{"s":1,"t":2000,"m":"two"}`,
+		`{"s":1,"t":4000,"m":"four"}`,
+	))))
+	s.cc.SetHostClient(hostID, hc)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/log?lines=3", s.srv.URL, app.ID), nil)
 	c.Assert(err, IsNil)
-	app, hostID, jobID := s.createLogTestApp(c, "joblog-sse", bytes.NewReader(logData))
+	req.SetBasicAuth("", authKey)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/jobs/%s-%s/log", s.srv.URL, app.ID, hostID, jobID), nil)
+	var lines []ct.AppLogLine
+	dec := json.NewDecoder(res.Body)
+	for {
+		var line ct.AppLogLine
+		if err := dec.Decode(&line); err == io.EOF {
+			break
+		} else {
+			c.Assert(err, IsNil)
+		}
+		lines = append(lines, line)
+	}
+	c.Assert(lines, HasLen, 3)
+	c.Assert(lines[0].Message, Equals, "two")
+	c.Assert(lines[0].JobID, Equals, hostID+"-"+job2)
+	c.Assert(lines[0].ProcessType, Equals, "worker")
+	c.Assert(lines[1].Message, Equals, "three")
+	c.Assert(lines[1].Stream, Equals, "stderr")
+	c.Assert(lines[2].Message, Equals, "four")
+}
+
+type logEvent struct {
+	Event string
+	Data  string
+}
+
+// readLogEvents reads the server-sent events in r, skipping comments.
+func readLogEvents(c *C, r io.Reader) []logEvent {
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	var events []logEvent
+	for _, block := range strings.Split(string(data), "\n\n") {
+		var e logEvent
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				e.Event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.Data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		if e.Data != "" {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func (s *S) getJobLogSSE(c *C, app *ct.App, hostID, jobID, query string) *http.Response {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/jobs/%s-%s/log?%s", s.srv.URL, app.ID, hostID, jobID, query), nil)
 	c.Assert(err, IsNil)
 	req.SetBasicAuth("", authKey)
 	req.Header.Set("Accept", "text/event-stream")
 	res, err := http.DefaultClient.Do(req)
 	c.Assert(err, IsNil)
+	return res
+}
 
+func assertLogLine(c *C, e logEvent, message, stream string) {
+	c.Assert(e.Event, Equals, "")
+	var line ct.AppLogLine
+	c.Assert(json.Unmarshal([]byte(e.Data), &line), IsNil)
+	c.Assert(line.Message, Equals, message)
+	c.Assert(line.Stream, Equals, stream)
+}
+
+// TestJobLogSSE checks the event format read by the dashboard.
+func (s *S) TestJobLogSSE(c *C) {
+	app, hostID, jobID := s.createLogTestApp(c, "joblog-sse", timestampedLog(
+		`{"s":2,"t":1000,"m":"hello stderr\n"}`,
+		`{"s":1,"t":2000,"m":"hello stdout\n"}`,
+		`{"s":1,"t":3000,"m":"Listening on 55012\n"}`,
+	))
+
+	res := s.getJobLogSSE(c, app, hostID, jobID, "")
 	var buf bytes.Buffer
-	_, err = buf.ReadFrom(res.Body)
+	_, err := buf.ReadFrom(res.Body)
 	res.Body.Close()
 	c.Assert(err, IsNil)
 
@@ -168,20 +445,44 @@ func (s *S) TestJobLogSSE(c *C) {
 	c.Assert(buf.String(), Equals, expected)
 }
 
+// createLogFollowTestApp creates an app with a job whose existing log
+// contains the given records and whose live log is read from stream.
+func (s *S) createLogFollowTestApp(c *C, name string, stream io.Reader, records ...string) (*ct.App, string, string) {
+	app := s.createTestApp(c, &ct.App{Name: name})
+	hostID, jobID := random.UUID(), random.UUID()
+	hc := tu.NewFakeHostClient(hostID)
+	hc.SetAttachFunc(jobID, func(req *host.AttachReq, wait bool) (cluster.AttachClient, error) {
+		if req.Flags&host.AttachFlagStream != 0 {
+			return cluster.NewAttachClient(newFakeLog(stream)), nil
+		}
+		return cluster.NewAttachClient(newFakeLog(timestampedLog(records...))), nil
+	})
+	s.cc.SetHostClient(hostID, hc)
+	return app, hostID, jobID
+}
+
+// liveLog encodes records as the host's live log stream, ending with the
+// job's exit status.
+func liveLog(status byte, records ...string) []byte {
+	var buf bytes.Buffer
+	for _, r := range records {
+		buf.Write([]byte{host.AttachData, 1})
+		binary.Write(&buf, binary.BigEndian, uint32(len(r)))
+		buf.WriteString(r)
+	}
+	buf.Write([]byte{host.AttachExit, 0, 0, 0, status})
+	return buf.Bytes()
+}
+
 func (s *S) TestJobLogSSEStream(c *C) {
 	pipeR, pipeW := io.Pipe()
 	defer pipeW.Close()
-	app, hostID, jobID := s.createLogTestApp(c, "joblog-sse-stream", pipeR)
+	app, hostID, jobID := s.createLogFollowTestApp(c, "joblog-sse-stream", pipeR)
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/jobs/%s-%s/log?tail=true", s.srv.URL, app.ID, hostID, jobID), nil)
-	c.Assert(err, IsNil)
-	req.SetBasicAuth("", authKey)
-	req.Header.Set("Accept", "text/event-stream")
-	res, err := http.DefaultClient.Do(req)
-	c.Assert(err, IsNil)
+	res := s.getJobLogSSE(c, app, hostID, jobID, "tail=true")
 	defer res.Body.Close()
 
-	go pipeW.Write([]byte("\x03\x01\x00\x00\x00\x13Listening on 55012\n\x05\x00\x00\x00\x01"))
+	go pipeW.Write(liveLog(1, `{"s":1,"t":1000,"m":"Listening on 55012\n"}`))
 	buf := &bytes.Buffer{}
 	buf.ReadFrom(res.Body)
 
@@ -189,6 +490,76 @@ func (s *S) TestJobLogSSEStream(c *C) {
 	c.Assert(buf.String(), Equals, expected)
 }
 
+func (s *S) TestJobLogSSELogLines(c *C) {
+	app, hostID, jobID := s.createLogTestApp(c, "joblog-sse-log-lines", timestampedLog(
+		`{"s":2,"t":1000,"m":"hello stderr"}`,
+		`{"s":1,"t":2000,"m":"hello stdout"}`,
+		`{"s":1,"t":3000,"m":"Listening on 55012"}`,
+	))
+
+	res := s.getJobLogSSE(c, app, hostID, jobID, "format=log_line&lines=2")
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/event-stream; charset=utf-8")
+
+	events := readLogEvents(c, res.Body)
+	c.Assert(events, HasLen, 3)
+	assertLogLine(c, events[0], "hello stdout", "stdout")
+	assertLogLine(c, events[1], "Listening on 55012", "stdout")
+	c.Assert(events[2], DeepEquals, logEvent{Event: "eof", Data: "{}"})
+
+	res = s.getJobLogSSE(c, app, hostID, jobID, "format=log_line&lines=foo")
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+
+	res = s.getJobLogSSE(c, app, hostID, jobID, "format=foo")
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *S) TestJobLogSSELogLinesFollow(c *C) {
+	pipeR, pipeW := io.Pipe()
+	defer pipeW.Close()
+	app, hostID, jobID := s.createLogFollowTestApp(c, "joblog-sse-follow", pipeR, `{"s":1,"t":1000,"m":"one"}`)
+
+	res := s.getJobLogSSE(c, app, hostID, jobID, "format=log_line&follow=true")
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	// the live stream repeats the line already read from the log, which
+	// should only be sent once
+	go pipeW.Write(liveLog(1, `{"s":1,"t":1000,"m":"one"}`, `{"s":2,"t":2000,"m":"two"}`))
+
+	events := readLogEvents(c, res.Body)
+	c.Assert(events, HasLen, 3)
+	assertLogLine(c, events[0], "one", "stdout")
+	assertLogLine(c, events[1], "two", "stderr")
+	c.Assert(events[2], DeepEquals, logEvent{Event: "exit", Data: `{"status": 1}`})
+}
+
+func (s *S) TestJobLogLongPoll(c *C) {
+	app, hostID, jobID := s.createLogTestApp(c, "joblog-long-poll", timestampedLog(
+		`{"s":1,"t":1000,"m":"one"}`,
+		`{"s":2,"t":2000,"m":"two"}`,
+	))
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/apps/%s/jobs/%s-%s/log?since=%s", s.srv.URL, app.ID, hostID, jobID, time.Unix(1, 0).UTC().Format(time.RFC3339Nano)), nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	req.Header.Set("Accept", ct.LongPollMediaType)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	var poll ct.JobLogPoll
+	c.Assert(json.NewDecoder(res.Body).Decode(&poll), IsNil)
+	c.Assert(poll.EOF, Equals, true)
+	c.Assert(poll.Lines, HasLen, 1)
+	c.Assert(poll.Lines[0].Message, Equals, "two")
+	c.Assert(poll.Lines[0].Stream, Equals, "stderr")
+}
+
 func (s *S) TestRunJobDetached(c *C) {
 	app := s.createTestApp(c, &ct.App{Name: "run-detached"})
 
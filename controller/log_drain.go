@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net"
+	"net/url"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+const logDrainColumns = "log_drain_id, app_id, url, username, password, created_at"
+
+func scanLogDrain(s Scanner) (*ct.LogDrain, error) {
+	d := &ct.LogDrain{}
+	if err := s.Scan(&d.ID, &d.AppID, &d.URL, &d.Username, &d.Password, &d.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	d.ID = cleanUUID(d.ID)
+	d.AppID = cleanUUID(d.AppID)
+	return d, nil
+}
+
+func validateLogDrain(d *ct.LogDrain) error {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return ct.ValidationError{Field: "url", Code: ct.ValidationCodeInvalidFormat, Message: "is not a valid URL"}
+	}
+	switch u.Scheme {
+	case "syslog", "syslog+tls":
+		if _, port, err := net.SplitHostPort(u.Host); err != nil || port == "" {
+			return ct.ValidationError{Field: "url", Code: ct.ValidationCodeInvalidFormat, Message: "must include a host and port"}
+		}
+		if d.Username != "" || d.Password != "" {
+			return ct.ValidationError{Field: "username", Message: "is only supported by https drains"}
+		}
+	case "https":
+		if u.Host == "" {
+			return ct.ValidationError{Field: "url", Code: ct.ValidationCodeInvalidFormat, Message: "must include a host"}
+		}
+	default:
+		return ct.ValidationError{Field: "url", Code: ct.ValidationCodeInvalidFormat, Message: "scheme must be one of syslog, syslog+tls, https"}
+	}
+	return nil
+}
+
+// AddLogDrain adds a log drain to the app. The app's formations are touched
+// so that the scheduler starts new jobs with the drain.
+func (r *AppRepo) AddLogDrain(d *ct.LogDrain) error {
+	if err := validateLogDrain(d); err != nil {
+		return err
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := tx.QueryRow("INSERT INTO log_drains (app_id, url, username, password) VALUES ($1, $2, $3, $4) RETURNING log_drain_id, created_at",
+		d.AppID, d.URL, d.Username, d.Password).Scan(&d.ID, &d.CreatedAt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	d.ID = cleanUUID(d.ID)
+	if _, err := tx.Exec("UPDATE formations SET updated_at = now() WHERE app_id = $1 AND deleted_at IS NULL", d.AppID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *AppRepo) GetLogDrain(id string) (*ct.LogDrain, error) {
+	return scanLogDrain(r.db.QueryRow("SELECT "+logDrainColumns+" FROM log_drains WHERE log_drain_id = $1 AND deleted_at IS NULL", id))
+}
+
+// LogDrains returns the log drains of the app in the order they were added.
+func (r *AppRepo) LogDrains(appID string) ([]*ct.LogDrain, error) {
+	rows, err := r.db.Query("SELECT "+logDrainColumns+" FROM log_drains WHERE app_id = $1 AND deleted_at IS NULL ORDER BY created_at", appID)
+	if err != nil {
+		return nil, err
+	}
+	drains := []*ct.LogDrain{}
+	for rows.Next() {
+		d, err := scanLogDrain(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		drains = append(drains, d)
+	}
+	return drains, rows.Err()
+}
+
+// RemoveLogDrain removes the log drain, jobs which are already running keep
+// forwarding their output to it until they are replaced.
+func (r *AppRepo) RemoveLogDrain(d *ct.LogDrain) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE log_drains SET deleted_at = now() WHERE log_drain_id = $1 AND deleted_at IS NULL", d.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE formations SET updated_at = now() WHERE app_id = $1 AND deleted_at IS NULL", d.AppID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func createLogDrain(app *ct.App, d ct.LogDrain, repo *AppRepo, r ResponseHelper) {
+	d.AppID = app.ID
+	if err := repo.AddLogDrain(&d); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &d)
+}
+
+func listLogDrains(app *ct.App, repo *AppRepo, r ResponseHelper) {
+	drains, err := repo.LogDrains(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, drains)
+}
+
+func getLogDrainMiddleware(c martini.Context, app *ct.App, params martini.Params, repo *AppRepo, r ResponseHelper) {
+	d, err := repo.GetLogDrain(params["log_drains_id"])
+	if err == nil && d.AppID != app.ID {
+		err = ErrNotFound
+	}
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	c.Map(d)
+}
+
+func getLogDrain(d *ct.LogDrain, r ResponseHelper) {
+	r.JSON(200, d)
+}
+
+func deleteLogDrain(d *ct.LogDrain, repo *AppRepo, r ResponseHelper) {
+	if err := repo.RemoveLogDrain(d); err != nil {
+		r.Error(err)
+		return
+	}
+	r.WriteHeader(200)
+}
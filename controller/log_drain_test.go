@@ -0,0 +1,72 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/host/types"
+)
+
+func (s *S) TestLogDrains(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "log-drains"})
+	artifact := s.createTestArtifact(c, &ct.Artifact{Type: "docker", URI: "docker://foo/bar"})
+	release := s.createTestRelease(c, &ct.Release{
+		ArtifactID: artifact.ID,
+		Processes:  map[string]ct.ProcessType{"web": {Cmd: []string{"start"}}},
+	})
+	s.setAppRelease(c, app.ID, release.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+
+	for _, d := range []*ct.LogDrain{
+		{},
+		{URL: "ftp://logs.example.com"},
+		{URL: "syslog://logs.example.com"},
+		{URL: "syslog://logs.example.com:514", Username: "user"},
+	} {
+		res, _ := s.Post("/apps/"+app.ID+"/log_drains", d, &ct.LogDrain{})
+		c.Assert(res.StatusCode, Equals, 400, Commentf("url %q", d.URL))
+	}
+
+	syslog := &ct.LogDrain{}
+	_, err := s.Post("/apps/"+app.ID+"/log_drains", &ct.LogDrain{URL: "syslog+tls://logs.example.com:6514"}, syslog)
+	c.Assert(err, IsNil)
+	c.Assert(syslog.ID, Not(Equals), "")
+	c.Assert(syslog.AppID, Equals, app.ID)
+	https := &ct.LogDrain{}
+	_, err = s.Post("/apps/"+app.ID+"/log_drains", &ct.LogDrain{URL: "https://logs.example.com/drain", Username: "user", Password: "secret"}, https)
+	c.Assert(err, IsNil)
+
+	var list []*ct.LogDrain
+	_, err = s.Get("/apps/"+app.ID+"/log_drains", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[0].ID, Equals, syslog.ID)
+	c.Assert(list[1].Password, Equals, "secret")
+
+	// jobs of the app's formations are started with the drains
+	var f *ct.ExpandedFormation
+	s.m.Invoke(func(repo *FormationRepo) {
+		formation, err := repo.Get(app.ID, release.ID)
+		c.Assert(err, IsNil)
+		f, err = repo.expandFormation(formation)
+		c.Assert(err, IsNil)
+	})
+	c.Assert(utils.JobConfig(f, "web").LogDrains, DeepEquals, []host.LogDrain{
+		{URL: "syslog+tls://logs.example.com:6514"},
+		{URL: "https://logs.example.com/drain", Username: "user", Password: "secret"},
+	})
+
+	_, err = s.Delete("/apps/" + app.ID + "/log_drains/" + syslog.ID)
+	c.Assert(err, IsNil)
+	res, _ := s.Get("/apps/"+app.ID+"/log_drains/"+syslog.ID, &ct.LogDrain{})
+	c.Assert(res.StatusCode, Equals, 404)
+	_, err = s.Get("/apps/"+app.ID+"/log_drains", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, https.ID)
+
+	// drains can only be retrieved through their app
+	other := s.createTestApp(c, &ct.App{Name: "log-drains-other"})
+	res, _ = s.Get("/apps/"+other.ID+"/log_drains/"+https.ID, &ct.LogDrain{})
+	c.Assert(res.StatusCode, Equals, 404)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+const (
+	defaultLongPollTimeout = 30 * time.Second
+	maxLongPollTimeout     = 5 * time.Minute
+
+	// longPollBatchDelay is how long to wait for more log lines after the
+	// first one arrives, so that busy jobs don't result in a request per
+	// line.
+	longPollBatchDelay = 100 * time.Millisecond
+)
+
+// isLongPoll reports whether the client requested a long-poll response
+// rather than a stream.
+func isLongPoll(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), ct.LongPollMediaType)
+}
+
+// longPollTimeout returns the maximum time to wait for new data before
+// responding, which may be set in seconds with the timeout parameter. A
+// timeout of zero responds immediately, which clients use for their first
+// request.
+func longPollTimeout(req *http.Request) (time.Duration, error) {
+	s := req.FormValue("timeout")
+	if s == "" {
+		return defaultLongPollTimeout, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, ct.ValidationError{Field: "timeout", Message: "is invalid"}
+	}
+	if timeout := time.Duration(n) * time.Second; timeout < maxLongPollTimeout {
+		return timeout, nil
+	}
+	return maxLongPollTimeout, nil
+}
+
+// pollEvents responds with the events after the last event seen by the
+// client, waiting until there is at least one or the poll times out. If the
+// client has not seen any events the poll starts from the most recent one.
+// The Last-Event-Id response header is set to the ID the client should send
+// with its next request.
+func pollEvents(req *http.Request, w http.ResponseWriter, repo *EventRepo, r ResponseHelper) {
+	lastID, count, filter, err := parseEventParams(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	timeout, err := longPollTimeout(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+
+	// listen before querying so that an event created between the query
+	// and the wait is not missed
+	connected := make(chan error, 1)
+	listener := pq.NewListener(repo.db.DSN(), 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		var res error
+		switch ev {
+		case pq.ListenerEventConnected:
+		case pq.ListenerEventConnectionAttemptFailed:
+			res = err
+		default:
+			return
+		}
+		select {
+		case connected <- res:
+		default:
+		}
+	})
+	defer listener.Close()
+	listener.Listen("events")
+	if err := <-connected; err != nil {
+		r.Error(err)
+		return
+	}
+
+	if lastID == 0 && count == 0 {
+		if lastID, err = repo.LastEventID(); err != nil {
+			r.Error(err)
+			return
+		}
+	}
+
+	events := []*ct.Event{}
+	expired := time.After(timeout)
+	closed := w.(http.CloseNotifier).CloseNotify()
+	for {
+		list, err := repo.ListEvents(filter, lastID, count)
+		if err != nil {
+			r.Error(err)
+			return
+		}
+		if len(list) > 0 {
+			// events are in ID DESC order
+			for i := len(list) - 1; i >= 0; i-- {
+				events = append(events, list[i])
+			}
+			lastID = list[0].ID
+			break
+		}
+		select {
+		case <-listener.Notify:
+			continue
+		case <-expired:
+		case <-closed:
+			return
+		}
+		break
+	}
+	w.Header().Set("Last-Event-Id", strconv.FormatInt(lastID, 10))
+	r.JSON(200, events)
+}
+
+// pollJobLog responds with the lines of the job's log written after the
+// since parameter (an RFC3339 timestamp). If tail is set and there are no
+// such lines it waits until the job writes more output, exits or the poll
+// times out.
+func pollJobLog(req *http.Request, jobID string, hc cluster.Host, r ResponseHelper) {
+	var since time.Time
+	if s := req.FormValue("since"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			r.Error(ct.ValidationError{Field: "since", Message: "is invalid"})
+			return
+		}
+		since = t
+	}
+	timeout, err := longPollTimeout(req)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	tail := req.FormValue("tail") != ""
+	job := &ct.Job{ID: jobID}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// attach to the live stream before reading the existing log so that
+	// no output is missed
+	var live chan *ct.AppLogLine
+	if tail {
+		if ac, err := attachAppLog(hc, jobID, true, false); err == nil {
+			live = make(chan *ct.AppLogLine)
+			go func() {
+				defer close(live)
+				readAppLog(ac, job, done, func(line *ct.AppLogLine) bool {
+					select {
+					case live <- line:
+						return true
+					case <-done:
+						return false
+					}
+				})
+			}()
+		}
+	}
+
+	ac, err := attachAppLog(hc, jobID, false, false)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	res := &ct.JobLogPoll{Lines: []*ct.AppLogLine{}}
+	readAppLog(ac, job, done, func(line *ct.AppLogLine) bool {
+		if line.Timestamp.After(since) {
+			res.Lines = append(res.Lines, line)
+			since = line.Timestamp
+		}
+		return true
+	})
+	if len(res.Lines) > 0 || live == nil {
+		res.EOF = live == nil
+		r.JSON(200, res)
+		return
+	}
+
+	expired := time.After(timeout)
+	var batch <-chan time.Time
+	for {
+		select {
+		case line, ok := <-live:
+			if !ok {
+				res.EOF = true
+				r.JSON(200, res)
+				return
+			}
+			if !line.Timestamp.After(since) {
+				continue
+			}
+			res.Lines = append(res.Lines, line)
+			if batch == nil {
+				batch = time.After(longPollBatchDelay)
+			}
+			continue
+		case <-batch:
+		case <-expired:
+		}
+		r.JSON(200, res)
+		return
+	}
+}
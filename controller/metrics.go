@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	"github.com/flynn/flynn/pkg/metrics"
+)
+
+// latencyBuckets are the upper bounds in seconds of the request latency
+// histogram buckets.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	handler string
+	method  string
+	code    int
+}
+
+type latencyKey struct {
+	handler string
+	method  string
+}
+
+// controllerMetrics records the requests handled by the controller and writes them
+// along with the state of the database in the Prometheus text format.
+type controllerMetrics struct {
+	mtx       sync.Mutex
+	requests  map[requestKey]uint64
+	latencies map[latencyKey]*metrics.Histogram
+	streams   map[string]int
+
+	db *DB
+}
+
+func newMetrics(db *DB) *controllerMetrics {
+	return &controllerMetrics{
+		requests:  make(map[requestKey]uint64),
+		latencies: make(map[latencyKey]*metrics.Histogram),
+		streams:   make(map[string]int),
+		db:        db,
+	}
+}
+
+func (m *controllerMetrics) observe(handler, method string, code int, d time.Duration, stream bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.requests[requestKey{handler, method, code}]++
+	if stream {
+		// streams last until the client goes away, so their duration
+		// says nothing about how fast the controller is
+		return
+	}
+	k := latencyKey{handler, method}
+	h, ok := m.latencies[k]
+	if !ok {
+		h = metrics.NewHistogram(latencyBuckets)
+		m.latencies[k] = h
+	}
+	h.Observe(d.Seconds())
+}
+
+func (m *controllerMetrics) streamStarted(handler string) {
+	m.mtx.Lock()
+	m.streams[handler]++
+	m.mtx.Unlock()
+}
+
+func (m *controllerMetrics) streamFinished(handler string) {
+	m.mtx.Lock()
+	m.streams[handler]--
+	m.mtx.Unlock()
+}
+
+// metricsHandler returns a middleware which records the count and latency of
+// requests by route. Requests for server-sent event streams are also counted
+// while they are open.
+func metricsHandler(m *controllerMetrics) martini.Handler {
+	return func(c martini.Context, res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		w := res.(martini.ResponseWriter)
+		var stream string
+		if strings.Contains(req.Header.Get("Accept"), "text/event-stream") {
+			// streams write their headers when they are opened, by
+			// which point the request has been routed
+			w.Before(func(martini.ResponseWriter) {
+				stream = requestRoute(c, req)
+				m.streamStarted(stream)
+			})
+		}
+		c.Next()
+
+		if stream != "" {
+			m.streamFinished(stream)
+		}
+		status := w.Status()
+		if status == 0 {
+			status = 200
+		}
+		m.observe(requestRoute(c, req), req.Method, status, time.Since(start), stream != "")
+	}
+}
+
+// requestRoute returns the route matched by the request, with the path
+// segments which are route params replaced by the param names so that the
+// number of routes does not grow with the number of objects. A param which
+// has the same value as a literal segment of the route also replaces it, as
+// the route pattern is not known.
+func requestRoute(c martini.Context, req *http.Request) string {
+	v := c.Get(reflect.TypeOf(martini.Params(nil)))
+	if !v.IsValid() {
+		return "not_found"
+	}
+	params := v.Interface().(martini.Params)
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	for i, part := range parts {
+		for name, value := range params {
+			if value == part {
+				parts[i] = ":" + name
+				break
+			}
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// objectCounts are the queries for the number of objects of each type. Each
+// row of the result is a value of the label, or an empty string if label is
+// not set, and a count.
+var objectCounts = []struct {
+	typ   string
+	label string
+	query string
+}{
+	{"apps", "", "SELECT '', count(*) FROM apps WHERE deleted_at IS NULL"},
+	{"releases", "", "SELECT '', count(*) FROM releases WHERE deleted_at IS NULL"},
+	{"artifacts", "", "SELECT '', count(*) FROM artifacts WHERE deleted_at IS NULL"},
+	{"formations", "", "SELECT '', count(*) FROM formations WHERE deleted_at IS NULL"},
+	{"resources", "", "SELECT '', count(*) FROM resources WHERE deleted_at IS NULL"},
+	{"jobs", "state", "SELECT state::text, count(*) FROM job_cache GROUP BY state"},
+	{"deployments", "status", "SELECT status, count(*) FROM deployments GROUP BY status"},
+}
+
+// writeRequests writes the request metrics.
+func (m *controllerMetrics) writeRequests(w *metrics.Writer) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	requests := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requests = append(requests, k)
+	}
+	sort.Sort(requestKeys(requests))
+	w.Describe("flynn_controller_http_requests_total", "counter", "Count of HTTP requests handled by the controller.")
+	for _, k := range requests {
+		w.Sample("flynn_controller_http_requests_total", []string{"handler", k.handler, "method", k.method, "code", strconv.Itoa(k.code)}, float64(m.requests[k]))
+	}
+
+	latencies := make([]latencyKey, 0, len(m.latencies))
+	for k := range m.latencies {
+		latencies = append(latencies, k)
+	}
+	sort.Sort(latencyKeys(latencies))
+	w.Describe("flynn_controller_http_request_duration_seconds", "histogram", "Latency of HTTP requests handled by the controller, excluding event streams.")
+	for _, k := range latencies {
+		w.Histogram("flynn_controller_http_request_duration_seconds", []string{"handler", k.handler, "method", k.method}, m.latencies[k])
+	}
+
+	streams := make([]string, 0, len(m.streams))
+	for handler := range m.streams {
+		streams = append(streams, handler)
+	}
+	sort.Strings(streams)
+	w.Describe("flynn_controller_sse_listeners", "gauge", "Number of open server-sent event streams.")
+	for _, handler := range streams {
+		w.Sample("flynn_controller_sse_listeners", []string{"handler", handler}, float64(m.streams[handler]))
+	}
+}
+
+// writeDB writes the database connection and object count metrics. The
+// connection pool does not expose its state, so connections are counted by
+// state from pg_stat_activity, which includes those of all controller
+// instances.
+func (m *controllerMetrics) writeDB(w *metrics.Writer) error {
+	m.db.mtx.RLock()
+	stmts := len(m.db.stmts)
+	m.db.mtx.RUnlock()
+	w.Describe("flynn_controller_db_prepared_statements", "gauge", "Number of cached prepared statements.")
+	w.Sample("flynn_controller_db_prepared_statements", nil, float64(stmts))
+
+	w.Describe("flynn_controller_db_connections", "gauge", "Number of connections to the controller database by state.")
+	err := m.counts("SELECT coalesce(state, 'unknown'), count(*) FROM pg_stat_activity WHERE datname = current_database() GROUP BY state", func(state string, n int64) {
+		w.Sample("flynn_controller_db_connections", []string{"state", state}, float64(n))
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Describe("flynn_controller_objects", "gauge", "Number of objects by type.")
+	for _, q := range objectCounts {
+		err := m.counts(q.query, func(value string, n int64) {
+			labels := []string{"type", q.typ}
+			if q.label != "" {
+				labels = append(labels, q.label, value)
+			}
+			w.Sample("flynn_controller_objects", labels, float64(n))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// counts calls fn with each row of the query's result, which must be a
+// value and a count.
+func (m *controllerMetrics) counts(query string, fn func(string, int64)) error {
+	rows, err := m.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value string
+		var n int64
+		if err := rows.Scan(&value, &n); err != nil {
+			return err
+		}
+		fn(value, n)
+	}
+	return rows.Err()
+}
+
+func getMetrics(m *controllerMetrics, w http.ResponseWriter) {
+	var buf bytes.Buffer
+	mw := metrics.NewWriter(&buf)
+	m.writeRequests(mw)
+	if err := m.writeDB(mw); err != nil {
+		log.Println("metrics: error reading database metrics:", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.WriteHeader(200)
+	buf.WriteTo(w)
+}
+
+type requestKeys []requestKey
+
+func (k requestKeys) Len() int      { return len(k) }
+func (k requestKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k requestKeys) Less(i, j int) bool {
+	if k[i].handler != k[j].handler {
+		return k[i].handler < k[j].handler
+	}
+	if k[i].method != k[j].method {
+		return k[i].method < k[j].method
+	}
+	return k[i].code < k[j].code
+}
+
+type latencyKeys []latencyKey
+
+func (k latencyKeys) Len() int      { return len(k) }
+func (k latencyKeys) Swap(i, j int) { k[i], k[j] = k[j], k[i] }
+func (k latencyKeys) Less(i, j int) bool {
+	if k[i].handler != k[j].handler {
+		return k[i].handler < k[j].handler
+	}
+	return k[i].method < k[j].method
+}
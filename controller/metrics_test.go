@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/metrics"
+)
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+func (MetricsSuite) TestRequests(c *C) {
+	cm := newMetrics(nil)
+	var open int
+	r := martini.NewRouter()
+	r.Get("/apps/:apps_id/jobs/:jobs_id", func(w http.ResponseWriter) {
+		w.WriteHeader(404)
+	})
+	r.Get("/apps/:apps_id/log", func(w http.ResponseWriter) {
+		w.WriteHeader(200)
+		cm.mtx.Lock()
+		open = cm.streams["/apps/:apps_id/log"]
+		cm.mtx.Unlock()
+	})
+	m := martini.New()
+	m.Use(metricsHandler(cm))
+	m.Action(r.Handle)
+
+	for _, path := range []string{"/apps/foo/jobs/1", "/apps/bar/jobs/2", "/apps/foo/log", "/missing"} {
+		req, err := http.NewRequest("GET", path, nil)
+		c.Assert(err, IsNil)
+		if strings.HasSuffix(path, "/log") {
+			req.Header.Set("Accept", "text/event-stream")
+		}
+		m.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	c.Assert(open, Equals, 1)
+
+	var buf bytes.Buffer
+	cm.writeRequests(metrics.NewWriter(&buf))
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE flynn_controller_http_requests_total counter",
+		`flynn_controller_http_requests_total{handler="/apps/:apps_id/jobs/:jobs_id",method="GET",code="404"} 2`,
+		`flynn_controller_http_requests_total{handler="/apps/:apps_id/log",method="GET",code="200"} 1`,
+		`flynn_controller_http_requests_total{handler="not_found",method="GET",code="404"} 1`,
+		"# TYPE flynn_controller_http_request_duration_seconds histogram",
+		`flynn_controller_http_request_duration_seconds_bucket{handler="/apps/:apps_id/jobs/:jobs_id",method="GET",le="+Inf"} 2`,
+		`flynn_controller_http_request_duration_seconds_count{handler="/apps/:apps_id/jobs/:jobs_id",method="GET"} 2`,
+		`flynn_controller_sse_listeners{handler="/apps/:apps_id/log"} 0`,
+	} {
+		c.Assert(strings.Contains(out, line+"\n"), Equals, true, Commentf("missing %q in:\n%s", line, out))
+	}
+	// streams are not included in the latency histogram
+	c.Assert(strings.Contains(out, `flynn_controller_http_request_duration_seconds_count{handler="/apps/:apps_id/log"`), Equals, false)
+}
+
+func (s *S) TestMetrics(c *C) {
+	s.createTestApp(c, &ct.App{Name: "metrics"})
+
+	req, err := http.NewRequest("GET", s.srv.URL+"/metrics", nil)
+	c.Assert(err, IsNil)
+	req.SetBasicAuth("", authKey)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/plain; version=0.0.4")
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	out := string(data)
+	for _, s := range []string{
+		`flynn_controller_http_requests_total{handler="/apps",method="POST",code="200"}`,
+		"flynn_controller_db_prepared_statements ",
+		`flynn_controller_db_connections{state="active"}`,
+		`flynn_controller_objects{type="apps"}`,
+	} {
+		c.Assert(strings.Contains(out, s), Equals, true, Commentf("missing %q in:\n%s", s, out))
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	ct "github.com/flynn/flynn/controller/types"
+	routerc "github.com/flynn/flynn/router/client"
+)
+
+// Quota returns the quota of the app.
+func (r *AppRepo) Quota(appID string) (*ct.AppQuota, error) {
+	q := &ct.AppQuota{}
+	if err := r.db.QueryRow("SELECT quota_max_jobs, quota_max_memory, quota_max_routes FROM apps WHERE app_id = $1 AND deleted_at IS NULL", appID).Scan(&q.MaxJobs, &q.MaxMemory, &q.MaxRoutes); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	return q, nil
+}
+
+// SetQuota replaces the quota of the app. Usage over the new quota is not
+// reduced, it only stops the app from growing further.
+func (r *AppRepo) SetQuota(appID string, q *ct.AppQuota) error {
+	var id string
+	err := r.db.QueryRow("UPDATE apps SET quota_max_jobs = $2, quota_max_memory = $3, quota_max_routes = $4, updated_at = now(), version = version + 1 WHERE app_id = $1 AND deleted_at IS NULL RETURNING app_id",
+		appID, q.MaxJobs, q.MaxMemory, q.MaxRoutes).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// quotaUsage is the resources used by the formations of an app.
+type quotaUsage struct {
+	jobs   int
+	memory int
+}
+
+func (u *quotaUsage) add(f *ct.Formation, release *ct.Release) {
+	for typ, n := range f.Processes {
+		if n <= 0 {
+			continue
+		}
+		u.jobs += n
+		u.memory += n * release.Processes[typ].ResourceLimits.Merge(f.Limits[typ]).Memory
+	}
+}
+
+// checkQuota returns a QuotaError if saving f would take its app over the
+// job or memory quota. Formations which reduce usage are always allowed so
+// that an app which is over a lowered quota can be scaled down.
+func (r *FormationRepo) checkQuota(f *ct.Formation, release *ct.Release) error {
+	quota, err := r.apps.Quota(f.AppID)
+	if err != nil {
+		return err
+	}
+	if quota.MaxJobs == 0 && quota.MaxMemory == 0 {
+		return nil
+	}
+	formations, err := r.List(f.AppID)
+	if err != nil {
+		return err
+	}
+
+	var current, proposed quotaUsage
+	var prev *ct.Formation
+	for _, other := range formations {
+		rel := release
+		if other.ReleaseID != release.ID {
+			data, err := r.releases.Get(other.ReleaseID)
+			if err != nil {
+				return err
+			}
+			rel = data.(*ct.Release)
+		}
+		current.add(other, rel)
+		if other.ReleaseID == f.ReleaseID {
+			prev = other
+			continue
+		}
+		proposed.add(other, rel)
+	}
+	proposed.add(f, release)
+
+	if quota.MaxJobs > 0 && proposed.jobs > quota.MaxJobs && proposed.jobs > current.jobs {
+		return ct.QuotaError{
+			Quota:   ct.QuotaJobs,
+			Limit:   quota.MaxJobs,
+			Message: fmt.Sprintf("app would run %d jobs, its quota is %d", proposed.jobs, quota.MaxJobs),
+		}
+	}
+	if quota.MaxMemory == 0 {
+		return nil
+	}
+	// memory can only be accounted for if every process type being scaled
+	// up has a limit
+	for typ, n := range f.Processes {
+		if n <= 0 || prev != nil && n <= prev.Processes[typ] {
+			continue
+		}
+		if release.Processes[typ].ResourceLimits.Merge(f.Limits[typ]).Memory == 0 {
+			return ct.QuotaError{
+				Quota:   ct.QuotaMemory,
+				Limit:   quota.MaxMemory,
+				Message: fmt.Sprintf("process type %q must have a memory limit, the app has a memory quota", typ),
+			}
+		}
+	}
+	if proposed.memory > quota.MaxMemory && proposed.memory > current.memory {
+		return ct.QuotaError{
+			Quota:   ct.QuotaMemory,
+			Limit:   quota.MaxMemory,
+			Message: fmt.Sprintf("app would use %d MiB of memory, its quota is %d MiB", proposed.memory, quota.MaxMemory),
+		}
+	}
+	return nil
+}
+
+// checkRouteQuota returns a QuotaError if the app cannot have another route.
+func checkRouteQuota(app *ct.App, apps *AppRepo, router routerc.Client) error {
+	quota, err := apps.Quota(app.ID)
+	if err != nil || quota.MaxRoutes == 0 {
+		return err
+	}
+	routes, err := router.ListRoutes(routeParentRef(app))
+	if err != nil {
+		return err
+	}
+	if len(routes) >= quota.MaxRoutes {
+		return ct.QuotaError{
+			Quota:   ct.QuotaRoutes,
+			Limit:   quota.MaxRoutes,
+			Message: fmt.Sprintf("app has %d routes, its quota is %d", len(routes), quota.MaxRoutes),
+		}
+	}
+	return nil
+}
+
+func getAppQuota(app *ct.App, repo *AppRepo, r ResponseHelper) {
+	quota, err := repo.Quota(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, quota)
+}
+
+func setAppQuota(app *ct.App, quota ct.AppQuota, repo *AppRepo, r ResponseHelper) {
+	if err := repo.SetQuota(app.ID, &quota); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &quota)
+}
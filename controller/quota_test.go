@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/router/types"
+)
+
+func (s *S) TestAppQuota(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "app-quota"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{
+		"web":    {ResourceLimits: ct.ResourceLimits{Memory: 256}},
+		"worker": {},
+	}})
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}})
+
+	quota := &ct.AppQuota{}
+	_, err := s.Get("/apps/"+app.ID+"/quota", quota)
+	c.Assert(err, IsNil)
+	c.Assert(quota, DeepEquals, &ct.AppQuota{})
+	res, _ := s.Put("/apps/"+app.ID+"/quota", map[string]int{"max_jobs": -1}, quota)
+	c.Assert(res.StatusCode, Equals, 400)
+	_, err = s.Put("/apps/"+app.ID+"/quota", &ct.AppQuota{MaxJobs: 3, MaxMemory: 1024, MaxRoutes: 1}, quota)
+	c.Assert(err, IsNil)
+	_, err = s.Get("/apps/"+app.ID+"/quota", quota)
+	c.Assert(err, IsNil)
+	c.Assert(quota, DeepEquals, &ct.AppQuota{MaxJobs: 3, MaxMemory: 1024, MaxRoutes: 1})
+
+	for _, t := range []struct {
+		processes map[string]int
+		limits    map[string]ct.ResourceLimits
+		quota     string
+	}{
+		{processes: map[string]int{"web": 4}, quota: ct.QuotaJobs},
+		{processes: map[string]int{"web": 2, "worker": 1}, quota: ct.QuotaMemory},
+		{processes: map[string]int{"web": 2}, limits: map[string]ct.ResourceLimits{"web": {Memory: 1024}}, quota: ct.QuotaMemory},
+		{processes: map[string]int{"web": 3}},
+		{processes: map[string]int{"web": 2, "worker": 1}, limits: map[string]ct.ResourceLimits{"worker": {Memory: 128}}},
+	} {
+		f := &ct.Formation{Processes: t.processes, Limits: t.limits}
+		res, err := s.Put(formationPath(app.ID, release.ID), f, f)
+		c.Assert(err, IsNil)
+		if t.quota == "" {
+			c.Assert(res.StatusCode, Equals, 200)
+			continue
+		}
+		c.Assert(res.StatusCode, Equals, 403)
+		var e ct.QuotaError
+		c.Assert(json.NewDecoder(res.Body).Decode(&e), IsNil)
+		res.Body.Close()
+		c.Assert(e.Quota, Equals, t.quota)
+	}
+
+	// an app over a lowered quota can still scale down
+	_, err = s.Put("/apps/"+app.ID+"/quota", &ct.AppQuota{MaxJobs: 1, MaxRoutes: 1}, quota)
+	c.Assert(err, IsNil)
+	f := &ct.Formation{Processes: map[string]int{"web": 2}}
+	res, err = s.Put(formationPath(app.ID, release.ID), f, f)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	s.createTestRoute(c, app.ID, (&router.TCPRoute{Service: "app-quota"}).ToRoute())
+	res, err = s.Post("/apps/"+app.ID+"/routes", (&router.TCPRoute{Service: "app-quota"}).ToRoute(), &router.Route{})
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 403)
+}
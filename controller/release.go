@@ -2,8 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/pkg/random"
 )
@@ -16,10 +22,17 @@ func NewReleaseRepo(db *DB) *ReleaseRepo {
 	return &ReleaseRepo{db}
 }
 
+// releaseColumns are the columns of the releases table read by scanRelease,
+// the last one lists the release's artifacts in order.
+const releaseColumns = `release_id, artifact_id, data, created_at, version,
+    (SELECT string_agg(artifact_id::text, ',' ORDER BY position) FROM release_artifacts WHERE release_artifacts.release_id = releases.release_id)`
+
 func scanRelease(s Scanner) (*ct.Release, error) {
 	release := &ct.Release{}
 	var data []byte
-	err := s.Scan(&release.ID, &release.ArtifactID, &data, &release.CreatedAt)
+	var artifactIDs *string
+	var version int64
+	err := s.Scan(&release.ID, &release.ArtifactID, &data, &release.CreatedAt, &version, &artifactIDs)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			err = ErrNotFound
@@ -28,18 +41,82 @@ func scanRelease(s Scanner) (*ct.Release, error) {
 	}
 	release.ID = cleanUUID(release.ID)
 	release.ArtifactID = cleanUUID(release.ArtifactID)
+	if artifactIDs != nil {
+		for _, id := range strings.Split(*artifactIDs, ",") {
+			release.ArtifactIDs = append(release.ArtifactIDs, cleanUUID(id))
+		}
+	}
 	err = json.Unmarshal(data, release)
+	release.Version = version
 	return release, err
 }
 
+// validateReleaseArtifacts sets the artifacts of the release from its
+// primary artifact or the primary artifact from the list, and checks that
+// process types only select artifacts of the release.
+func validateReleaseArtifacts(release *ct.Release) error {
+	for i, id := range release.ArtifactIDs {
+		release.ArtifactIDs[i] = cleanUUID(id)
+	}
+	release.ArtifactID = cleanUUID(release.ArtifactID)
+	switch {
+	case len(release.ArtifactIDs) == 0:
+		if release.ArtifactID != "" {
+			release.ArtifactIDs = []string{release.ArtifactID}
+		}
+	case release.ArtifactID == "":
+		release.ArtifactID = release.ArtifactIDs[0]
+	case release.ArtifactID != release.ArtifactIDs[0]:
+		return ct.ValidationError{Field: "artifacts", Message: "must start with the release artifact"}
+	}
+	seen := make(map[string]bool, len(release.ArtifactIDs))
+	for _, id := range release.ArtifactIDs {
+		if seen[id] {
+			return ct.ValidationError{Field: "artifacts", Message: fmt.Sprintf("contains %s more than once", id)}
+		}
+		seen[id] = true
+	}
+	for typ, t := range release.Processes {
+		for i, id := range t.Artifacts {
+			id = cleanUUID(id)
+			if !seen[id] {
+				return ct.ValidationError{Field: joinField(joinField("processes", typ), "artifacts"), Message: fmt.Sprintf("%s is not an artifact of the release", id)}
+			}
+			t.Artifacts[i] = id
+		}
+	}
+	return nil
+}
+
 func (r *ReleaseRepo) Add(data interface{}) error {
-	release := data.(*ct.Release)
-	releaseCopy := *release
+	return insertRelease(r.db, data.(*ct.Release))
+}
 
-	releaseCopy.ID = ""
-	releaseCopy.ArtifactID = ""
-	releaseCopy.CreatedAt = nil
-	data, err := json.Marshal(&releaseCopy)
+func insertRelease(db rowQueryer, release *ct.Release) error {
+	for typ, t := range release.Processes {
+		if err := validateLimits(joinField("processes", typ), t.ResourceLimits); err != nil {
+			return err
+		}
+		if err := validateHealthCheck(joinField("processes", typ), t); err != nil {
+			return err
+		}
+		if err := validateRestartPolicy(joinField("processes", typ), t.RestartPolicy); err != nil {
+			return err
+		}
+		if err := validateStopSignal(joinField("processes", typ), t); err != nil {
+			return err
+		}
+		if err := validateLogDriver(joinField("processes", typ), t.LogDriver); err != nil {
+			return err
+		}
+	}
+	if err := validatePorts(release); err != nil {
+		return err
+	}
+	if err := validateReleaseArtifacts(release); err != nil {
+		return err
+	}
+	data, err := releaseData(release)
 	if err != nil {
 		return err
 	}
@@ -47,20 +124,196 @@ func (r *ReleaseRepo) Add(data interface{}) error {
 		release.ID = random.UUID()
 	}
 
-	err = r.db.QueryRow("INSERT INTO releases (release_id, artifact_id, data) VALUES ($1, $2, $3) RETURNING created_at",
-		release.ID, release.ArtifactID, data).Scan(&release.CreatedAt)
+	err = db.QueryRow("INSERT INTO releases (release_id, artifact_id, data) VALUES ($1, $2, $3) RETURNING created_at, version",
+		release.ID, release.ArtifactID, data).Scan(&release.CreatedAt, &release.Version)
 	release.ID = cleanUUID(release.ID)
 	release.ArtifactID = cleanUUID(release.ArtifactID)
-	return err
+	if err != nil {
+		return err
+	}
+	if err := insertReleaseArtifacts(db, release); err != nil {
+		return err
+	}
+	return createEvent(db, "", ct.EventTypeRelease, release.ID, release)
+}
+
+// releaseData returns the contents of the release's data column, which is
+// the release without the fields stored in their own columns.
+func releaseData(release *ct.Release) ([]byte, error) {
+	releaseCopy := *release
+	releaseCopy.ID = ""
+	releaseCopy.ArtifactID = ""
+	releaseCopy.ArtifactIDs = nil
+	releaseCopy.CreatedAt = nil
+	releaseCopy.Version = 0
+	return json.Marshal(&releaseCopy)
+}
+
+func insertReleaseArtifacts(db rowQueryer, release *ct.Release) error {
+	for i, id := range release.ArtifactIDs {
+		var position int
+		if err := db.QueryRow("INSERT INTO release_artifacts (release_id, artifact_id, position) VALUES ($1, $2, $3) RETURNING position",
+			release.ID, id, i).Scan(&position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateHealthCheck checks that the health check of a process type can be
+// run, checks connect to the first port so the process type must have one.
+func validateHealthCheck(field string, t ct.ProcessType) error {
+	h := t.HealthCheck
+	if h == nil {
+		return nil
+	}
+	field = joinField(field, "health_check")
+	switch {
+	case h.Type != ct.HealthCheckTCP && h.Type != ct.HealthCheckHTTP:
+		return ct.ValidationError{Field: joinField(field, "type"), Message: "must be tcp or http"}
+	case h.Path != "" && (h.Type != ct.HealthCheckHTTP || !strings.HasPrefix(h.Path, "/")):
+		return ct.ValidationError{Field: joinField(field, "path"), Message: "must be an absolute path of an http check"}
+	case h.Interval < 0 || h.Interval > 3600:
+		return ct.ValidationError{Field: joinField(field, "interval"), Message: "must be between 0 and 3600"}
+	case h.GracePeriod < 0 || h.GracePeriod > 3600:
+		return ct.ValidationError{Field: joinField(field, "grace_period"), Message: "must be between 0 and 3600"}
+	case h.Failures < 0 || h.Failures > 100:
+		return ct.ValidationError{Field: joinField(field, "failures"), Message: "must be between 0 and 100"}
+	case h.RestartAfter < 0 || h.RestartAfter > 100:
+		return ct.ValidationError{Field: joinField(field, "restart_after"), Message: "must be between 0 and 100"}
+	case len(t.Ports) == 0:
+		return ct.ValidationError{Field: field, Message: "requires the process type to have a port"}
+	}
+	return nil
+}
+
+// validateRestartPolicy checks the restart policy of a process type, only
+// the on-failure policy has a retry limit.
+func validateRestartPolicy(field string, p *ct.RestartPolicy) error {
+	if p == nil {
+		return nil
+	}
+	field = joinField(field, "restart_policy")
+	switch {
+	case p.Name != ct.RestartAlways && p.Name != ct.RestartOnFailure && p.Name != ct.RestartNever:
+		return ct.ValidationError{Field: joinField(field, "name"), Message: "must be always, on-failure or never"}
+	case p.MaxRetries < 0:
+		return ct.ValidationError{Field: joinField(field, "max_retries"), Message: "must not be negative"}
+	case p.MaxRetries > 0 && p.Name != ct.RestartOnFailure:
+		return ct.ValidationError{Field: joinField(field, "max_retries"), Message: "can only be set with on-failure"}
+	}
+	return nil
+}
+
+// validateStopSignal checks that jobs of a process type can be stopped with
+// its stop signal and kill timeout.
+func validateStopSignal(field string, t ct.ProcessType) error {
+	if _, ok := ct.StopSignals[t.StopSignal]; t.StopSignal != "" && !ok {
+		return ct.ValidationError{Field: joinField(field, "stop_signal"), Message: "must be SIGHUP, SIGINT, SIGQUIT, SIGUSR1, SIGUSR2 or SIGTERM"}
+	}
+	if t.KillTimeout < 0 || t.KillTimeout > 3600 {
+		return ct.ValidationError{Field: joinField(field, "kill_timeout"), Message: "must be between 0 and 3600"}
+	}
+	return nil
+}
+
+// validateLogDriver checks that only the remote log driver has a URL, which
+// is validated like the URL of a log drain.
+func validateLogDriver(field string, d *ct.LogDriver) error {
+	if d == nil {
+		return nil
+	}
+	field = joinField(field, "log_driver")
+	if d.Name != "remote" {
+		if d.URL != "" {
+			return ct.ValidationError{Field: joinField(field, "url"), Message: "is only supported by the remote log driver"}
+		}
+		return nil
+	}
+	if d.URL == "" {
+		return ct.ValidationError{Field: joinField(field, "url"), Code: ct.ValidationCodeRequired, Message: "is required by the remote log driver"}
+	}
+	if err := validateLogDrain(&ct.LogDrain{URL: d.URL}); err != nil {
+		e := err.(ct.ValidationError)
+		e.Field = joinField(field, e.Field)
+		return e
+	}
+	return nil
+}
+
+// validatePorts checks the ports of a release's process types, and that no
+// two of them request the same host ports, as jobs requesting a host port
+// which is in use fail to start.
+func validatePorts(release *ct.Release) error {
+	type hostPorts struct {
+		field      string
+		start, end int
+	}
+	requested := make(map[string][]hostPorts)
+	names := make([]string, 0, len(release.Processes))
+	for typ := range release.Processes {
+		names = append(names, typ)
+	}
+	sort.Strings(names)
+	for _, typ := range names {
+		for i, p := range release.Processes[typ].Ports {
+			field := fmt.Sprintf("%s[%d]", joinField(joinField("processes", typ), "ports"), i)
+			switch {
+			case p.Port > 65535:
+				return ct.ValidationError{Field: joinField(field, "port"), Message: "must be between 0 and 65535"}
+			case p.HostPort > 65535:
+				return ct.ValidationError{Field: joinField(field, "host_port"), Message: "must be between 0 and 65535"}
+			case p.RangeEnd > 65535 || p.RangeEnd > 0 && p.RangeEnd < p.Port:
+				return ct.ValidationError{Field: joinField(field, "range_end"), Message: "must be between port and 65535"}
+			case p.HostPort > 0 && p.RangeEnd > p.Port:
+				return ct.ValidationError{Field: joinField(field, "host_port"), Message: "cannot be set for a range of ports"}
+			}
+
+			ports := hostPorts{field: field, start: p.HostPort, end: p.HostPort}
+			if p.HostPort == 0 {
+				if p.Port == 0 {
+					// the host allocates a port
+					continue
+				}
+				ports.start, ports.end = p.Port, p.Port
+				if p.RangeEnd > p.Port {
+					ports.end = p.RangeEnd
+				}
+			}
+			for _, other := range requested[p.Proto] {
+				if ports.start <= other.end && other.start <= ports.end {
+					return ct.ValidationError{Field: field, Message: fmt.Sprintf("requests the same host ports as %s", other.field)}
+				}
+			}
+			requested[p.Proto] = append(requested[p.Proto], ports)
+		}
+	}
+	return nil
 }
 
 func (r *ReleaseRepo) Get(id string) (interface{}, error) {
-	row := r.db.QueryRow("SELECT release_id, artifact_id, data, created_at FROM releases WHERE release_id = $1 AND deleted_at IS NULL", id)
+	row := r.db.QueryRow("SELECT "+releaseColumns+" FROM releases WHERE release_id = $1 AND deleted_at IS NULL", id)
 	return scanRelease(row)
 }
 
 func (r *ReleaseRepo) List() (interface{}, error) {
-	rows, err := r.db.Query("SELECT release_id, artifact_id, data, created_at FROM releases WHERE deleted_at IS NULL ORDER BY created_at DESC")
+	return r.list(&listQuery{sort: "created_at", desc: true})
+}
+
+// ListQuery lists the releases sorted and filtered by the list parameters,
+// releases can only be sorted by created_at.
+func (r *ReleaseRepo) ListQuery(query url.Values) (interface{}, error) {
+	q, err := parseListQuery(query, "created_at")
+	if err != nil {
+		return nil, err
+	}
+	return r.list(q)
+}
+
+func (r *ReleaseRepo) list(q *listQuery) ([]*ct.Release, error) {
+	var args []interface{}
+	where := q.where("", &args)
+	rows, err := r.db.Query("SELECT "+releaseColumns+" FROM releases WHERE deleted_at IS NULL"+where+q.orderBy(), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -75,3 +328,110 @@ func (r *ReleaseRepo) List() (interface{}, error) {
 	}
 	return releases, rows.Err()
 }
+
+// AppList returns the releases that have been used by the app, most recent
+// first.
+func (r *ReleaseRepo) AppList(appID string) ([]*ct.Release, error) {
+	rows, err := r.db.Query("SELECT "+releaseColumns+" FROM releases WHERE "+appReleasesWhere+" ORDER BY created_at DESC", appID)
+	if err != nil {
+		return nil, err
+	}
+	releases := []*ct.Release{}
+	for rows.Next() {
+		release, err := scanRelease(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	return releases, rows.Err()
+}
+
+func listAppReleases(app *ct.App, repo *ReleaseRepo, r ResponseHelper) {
+	releases, err := repo.AppList(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, releases)
+}
+
+// diffAppReleases responds with the differences between two releases, env
+// values are left out if the redact query parameter is true.
+func diffAppReleases(params martini.Params, req *http.Request, repo *ReleaseRepo, r ResponseHelper) {
+	var releases [2]*ct.Release
+	for i, id := range []string{params["from"], params["to"]} {
+		data, err := repo.Get(id)
+		if err != nil {
+			r.Error(err)
+			return
+		}
+		releases[i] = data.(*ct.Release)
+	}
+	r.JSON(200, ct.DiffReleases(releases[0], releases[1], req.FormValue("redact") == "true"))
+}
+
+// Remove deletes the release, it refuses to delete a release which is the
+// current release of an app or has formations.
+func (r *ReleaseRepo) Remove(id string) error {
+	return r.remove(id, false)
+}
+
+// RemoveCascade deletes the release along with its formations and the
+// artifacts which no other release uses. The current release of an app is
+// never deleted.
+func (r *ReleaseRepo) RemoveCascade(id string) error {
+	return r.remove(id, true)
+}
+
+func (r *ReleaseRepo) remove(id string, cascade bool) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	var appID string
+	err = tx.QueryRow("SELECT app_id FROM apps WHERE release_id = $1 AND deleted_at IS NULL LIMIT 1", id).Scan(&appID)
+	if err == nil {
+		tx.Rollback()
+		return ct.ValidationError{Message: fmt.Sprintf("release is the current release of app %s", cleanUUID(appID))}
+	} else if err != sql.ErrNoRows {
+		tx.Rollback()
+		return err
+	}
+	if !cascade {
+		err = tx.QueryRow("SELECT app_id FROM formations WHERE release_id = $1 AND deleted_at IS NULL LIMIT 1", id).Scan(&appID)
+		if err == nil {
+			tx.Rollback()
+			return ct.ValidationError{Message: fmt.Sprintf("release has a formation for app %s, use cascade to delete it", cleanUUID(appID))}
+		} else if err != sql.ErrNoRows {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.QueryRow("UPDATE releases SET deleted_at = now() WHERE release_id = $1 AND deleted_at IS NULL RETURNING release_id", id).Scan(&id); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return err
+	}
+	if !cascade {
+		return tx.Commit()
+	}
+
+	if _, err := tx.Exec("UPDATE formations SET deleted_at = now(), processes = NULL, updated_at = now() WHERE release_id = $1 AND deleted_at IS NULL", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	// the release has been marked as deleted, so this only removes the
+	// artifacts no other release references
+	if _, err := tx.Exec(`UPDATE artifacts SET deleted_at = now() WHERE deleted_at IS NULL
+    AND artifact_id IN (SELECT artifact_id FROM release_artifacts WHERE release_id = $1)
+    AND NOT EXISTS (SELECT 1 FROM release_artifacts ra JOIN releases r USING (release_id) WHERE ra.artifact_id = artifacts.artifact_id AND r.deleted_at IS NULL)`, id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -17,9 +17,22 @@ func NewResourceRepo(db *DB) *ResourceRepo {
 	return &ResourceRepo{db}
 }
 
+// Add creates the resource, or if it already exists updates its external ID
+// and env (app bindings of existing resources are changed with AddApp and
+// RemoveApp).
 func (rr *ResourceRepo) Add(r *ct.Resource) error {
 	if r.ID == "" {
 		r.ID = random.UUID()
+	} else {
+		err := rr.db.QueryRow("UPDATE resources SET external_id = $3, env = $4, version = version + 1 WHERE resource_id = $1 AND provider_id = $2 AND deleted_at IS NULL AND ($5::bigint = 0 OR version = $5) RETURNING created_at, version",
+			r.ID, r.ProviderID, r.ExternalID, envHstore(r.Env), r.Version).Scan(&r.CreatedAt, &r.Version)
+		if err != sql.ErrNoRows {
+			return err
+		}
+		if r.Version != 0 {
+			// the resource has been modified or no longer exists
+			return ErrConflict
+		}
 	}
 	tx, err := rr.db.Begin()
 	if err != nil {
@@ -27,8 +40,8 @@ func (rr *ResourceRepo) Add(r *ct.Resource) error {
 	}
 	err = tx.QueryRow(`INSERT INTO resources (resource_id, provider_id, external_id, env)
 					   VALUES ($1, $2, $3, $4)
-					   RETURNING created_at`,
-		r.ID, r.ProviderID, r.ExternalID, envHstore(r.Env)).Scan(&r.CreatedAt)
+					   RETURNING created_at, version`,
+		r.ID, r.ProviderID, r.ExternalID, envHstore(r.Env)).Scan(&r.CreatedAt, &r.Version)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -55,6 +68,134 @@ func (rr *ResourceRepo) Add(r *ct.Resource) error {
 	return tx.Commit()
 }
 
+// AddApp binds the resource to the app, rebinding it if it was previously
+// removed.
+func (rr *ResourceRepo) AddApp(resourceID, appID string) error {
+	tx, err := rr.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := lockResource(tx, resourceID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	var id string
+	err = tx.QueryRow("UPDATE app_resources SET deleted_at = NULL WHERE app_id = $1 AND resource_id = $2 RETURNING app_id", appID, resourceID).Scan(&id)
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec("INSERT INTO app_resources (app_id, resource_id) VALUES ($1, $2)", appID, resourceID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := bumpVersion(tx, resourceID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveApp unbinds the resource from the app, it returns ErrNotFound if the
+// resource is not bound to the app. When the last app is unbound the resource
+// is deprovisioned and deleted, and it returns true. The app stays bound if
+// deprovision fails, so that the request can be retried.
+func (rr *ResourceRepo) RemoveApp(r *ct.Resource, appID string, deprovision func() error) (bool, error) {
+	tx, err := rr.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	if err := lockResource(tx, r.ID); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	var id string
+	err = tx.QueryRow("UPDATE app_resources SET deleted_at = now() WHERE app_id = $1 AND resource_id = $2 AND deleted_at IS NULL RETURNING app_id", appID, r.ID).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	var bound bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM app_resources WHERE resource_id = $1 AND deleted_at IS NULL)", r.ID).Scan(&bound); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if bound {
+		if err := bumpVersion(tx, r.ID); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+		return false, tx.Commit()
+	}
+
+	if err := deprovision(); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE resources SET deleted_at = now(), version = version + 1 WHERE resource_id = $1", r.ID); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	r.Apps = nil
+	if err := createEvent(tx, appID, ct.EventTypeResourceDeletion, r.ID, r); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// lockResource locks the resource until the end of the transaction, so that
+// its app bindings are changed one at a time.
+func lockResource(tx *dbTx, id string) error {
+	err := tx.QueryRow("SELECT resource_id FROM resources WHERE resource_id = $1 AND deleted_at IS NULL FOR UPDATE", id).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// bumpVersion increments the version of the resource after its app bindings
+// have changed.
+func bumpVersion(tx *dbTx, id string) error {
+	_, err := tx.Exec("UPDATE resources SET version = version + 1 WHERE resource_id = $1", id)
+	return err
+}
+
+// Remove deletes the resource and unbinds it from its apps, emitting a
+// resource deletion event for each app. The caller is responsible for
+// deprovisioning the resource first.
+func (rr *ResourceRepo) Remove(r *ct.Resource) error {
+	tx, err := rr.db.Begin()
+	if err != nil {
+		return err
+	}
+	var id string
+	if err := tx.QueryRow("UPDATE resources SET deleted_at = now() WHERE resource_id = $1 AND deleted_at IS NULL RETURNING resource_id", r.ID).Scan(&id); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return err
+	}
+	if _, err := tx.Exec("UPDATE app_resources SET deleted_at = now() WHERE resource_id = $1 AND deleted_at IS NULL", r.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	events := r.Apps
+	if len(events) == 0 {
+		events = []string{""}
+	}
+	for _, appID := range events {
+		if err := createEvent(tx, appID, ct.EventTypeResourceDeletion, r.ID, r); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func envHstore(m map[string]string) hstore.Hstore {
 	res := hstore.Hstore{Map: make(map[string]sql.NullString, len(m))}
 	for k, v := range m {
@@ -70,11 +211,20 @@ func split(s string, sep string) []string {
 	return strings.Split(s, ",")
 }
 
+// resourceColumns are the columns read by scanResource from resources r
+// joined with providers p.
+const resourceColumns = `r.resource_id, r.provider_id, p.name, r.external_id, r.env, r.version,
+	ARRAY(SELECT a.app_id
+	      FROM app_resources a
+	      WHERE a.resource_id = r.resource_id AND a.deleted_at IS NULL
+	      ORDER BY a.created_at DESC),
+	r.created_at`
+
 func scanResource(s Scanner) (*ct.Resource, error) {
 	r := &ct.Resource{}
 	var env hstore.Hstore
 	var appIDs string
-	err := s.Scan(&r.ID, &r.ProviderID, &r.ExternalID, &env, &appIDs, &r.CreatedAt)
+	err := s.Scan(&r.ID, &r.ProviderID, &r.ProviderName, &r.ExternalID, &env, &r.Version, &appIDs, &r.CreatedAt)
 	if err == sql.ErrNoRows {
 		err = ErrNotFound
 	}
@@ -94,27 +244,17 @@ func scanResource(s Scanner) (*ct.Resource, error) {
 }
 
 func (r *ResourceRepo) Get(id string) (*ct.Resource, error) {
-	row := r.db.QueryRow(`SELECT resource_id, provider_id, external_id, env,
-								 ARRAY(SELECT app_id
-								       FROM app_resources a
-									   WHERE a.resource_id = r.resource_id AND a.deleted_at IS NULL
-									   ORDER BY a.created_at DESC),
-								 created_at
-						  FROM resources r
-						  WHERE resource_id = $1 AND deleted_at IS NULL`, id)
+	row := r.db.QueryRow(`SELECT `+resourceColumns+`
+						  FROM resources r JOIN providers p USING (provider_id)
+						  WHERE r.resource_id = $1 AND r.deleted_at IS NULL`, id)
 	return scanResource(row)
 }
 
 func (r *ResourceRepo) ProviderList(providerID string) ([]*ct.Resource, error) {
-	rows, err := r.db.Query(`SELECT resource_id, provider_id, external_id, env,
-									ARRAY(SELECT a.app_id
-								          FROM app_resources a
-                                          WHERE a.resource_id = r.resource_id AND a.deleted_at IS NULL
-                                          ORDER BY a.created_at DESC),
-									created_at
-							 FROM resources r
-							 WHERE provider_id = $1 AND deleted_at IS NULL
-							 ORDER BY created_at DESC`, providerID)
+	rows, err := r.db.Query(`SELECT `+resourceColumns+`
+							 FROM resources r JOIN providers p USING (provider_id)
+							 WHERE r.provider_id = $1 AND r.deleted_at IS NULL
+							 ORDER BY r.created_at DESC`, providerID)
 	if err != nil {
 		return nil, err
 	}
@@ -134,16 +274,14 @@ func resourceList(rows *sql.Rows) ([]*ct.Resource, error) {
 	return resources, rows.Err()
 }
 
+// AppList returns the resources which are currently bound to the app, most
+// recently created first.
 func (r *ResourceRepo) AppList(appID string) ([]*ct.Resource, error) {
-	rows, err := r.db.Query(`SELECT DISTINCT(r.resource_id), r.provider_id, r.external_id, r.env,
-									ARRAY(SELECT a.app_id
-									      FROM app_resources a 
-										  WHERE a.resource_id = r.resource_id AND a.deleted_at IS NULL
-										  ORDER BY a.created_at DESC),
-									r.created_at
+	rows, err := r.db.Query(`SELECT `+resourceColumns+`
 							 FROM resources r
-							 JOIN app_resources a USING (resource_id)
-							 WHERE a.app_id = $1 AND r.deleted_at IS NULL
+							 JOIN providers p USING (provider_id)
+							 JOIN app_resources b USING (resource_id)
+							 WHERE b.app_id = $1 AND b.deleted_at IS NULL AND r.deleted_at IS NULL
 							 ORDER BY r.created_at DESC`, appID)
 	if err != nil {
 		return nil, err
@@ -7,6 +7,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 
 	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
 	ct "github.com/flynn/flynn/controller/types"
@@ -128,6 +129,32 @@ func (s *S) TestPutResource(c *C) {
 	c.Assert(gotResource, DeepEquals, created)
 }
 
+func (s *S) TestPutResourceVersion(c *C) {
+	app := s.createTestApp(c, &ct.App{Name: "put-resource-version"})
+	provider := s.createTestProvider(c, &ct.Provider{URL: "https://example.ca", Name: "put-resource-version"})
+	path := fmt.Sprintf("/providers/%s/resources/%s", provider.ID, random.UUID())
+
+	created := &ct.Resource{}
+	_, err := s.Put(path, &ct.Resource{Env: map[string]string{"FOO": "BAR"}}, created)
+	c.Assert(err, IsNil)
+	c.Assert(created.Version, Equals, int64(1))
+
+	updated := &ct.Resource{}
+	res, err := s.Put(path, &ct.Resource{Env: map[string]string{"FOO": "BAZ"}, Version: created.Version}, updated)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(updated.Version, Equals, int64(2))
+
+	res, _ = s.Put(path, &ct.Resource{Env: map[string]string{"FOO": "QUX"}, Version: created.Version}, &ct.Resource{})
+	c.Assert(res.StatusCode, Equals, 409)
+
+	// binding an app modifies the resource
+	_, err = s.Put(path+"/apps/"+app.ID, nil, updated)
+	c.Assert(err, IsNil)
+	c.Assert(updated.Version, Equals, int64(3))
+	c.Assert(updated.Env, DeepEquals, map[string]string{"FOO": "BAZ"})
+}
+
 func (s *S) TestResourceLists(c *C) {
 	app1 := s.createTestApp(c, &ct.App{Name: "resource-list1"})
 	app2 := s.createTestApp(c, &ct.App{Name: "resource-list2"})
@@ -151,5 +178,188 @@ func (s *S) TestResourceLists(c *C) {
 		c.Assert(len(list) > 0, Equals, true)
 		c.Assert(list[0].ID, Equals, resource.ID)
 		c.Assert(list[0].Apps, DeepEquals, apps)
+		c.Assert(list[0].ProviderName, Equals, provider.Name)
+		c.Assert(list[0].CreatedAt, NotNil)
 	}
+
+	// resources which have been unbound from the app are not listed
+	res, err := s.Delete(fmt.Sprintf("/providers/%s/resources/%s/apps/%s", provider.ID, resource.ID, app1.ID))
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	var list []*ct.Resource
+	_, err = s.Get(fmt.Sprintf("/apps/%s/resources", app1.ID), &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+}
+
+func (s *S) TestResourceApps(c *C) {
+	app1 := s.createTestApp(c, &ct.App{Name: "resource-apps1"})
+	app2 := s.createTestApp(c, &ct.App{Name: "resource-apps2"})
+
+	resource, provider := s.provisionTestResource(c, "resource-apps", []string{app1.ID})
+	path := fmt.Sprintf("/providers/%s/resources/%s/apps/", provider.ID, resource.ID)
+
+	out := &ct.Resource{}
+	res, err := s.Put(path+app2.Name, nil, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(out.Apps, DeepEquals, []string{app2.ID, app1.ID})
+
+	res, err = s.Delete(path + app1.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	out = &ct.Resource{}
+	_, err = s.Get(fmt.Sprintf("/providers/%s/resources/%s", provider.ID, resource.ID), out)
+	c.Assert(err, IsNil)
+	c.Assert(out.Apps, DeepEquals, []string{app2.ID})
+
+	res, err = s.Delete(path + app1.ID)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestDeleteResource(c *C) {
+	defer func(n int) { resource.DeprovisionAttempts = n }(resource.DeprovisionAttempts)
+	resource.DeprovisionAttempts = 1
+
+	status := int32(500)
+	deprovisioned := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			w.Write([]byte(`{"id":"/things/delete-resource","env":{"foo":"bar"}}`))
+		case "DELETE":
+			deprovisioned <- req.URL.Path
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		}
+	}))
+	defer srv.Close()
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	s.m.MapTo(&resourceDiscoverd{
+		fn: func() []*discoverd.Service {
+			return []*discoverd.Service{{Addr: srv.Listener.Addr().String(), Host: host, Port: port}}
+		},
+	}, (*resource.DiscoverdClient)(nil))
+
+	app := s.createTestApp(c, &ct.App{Name: "delete-resource"})
+	provider := s.createTestProvider(c, &ct.Provider{URL: "discoverd+http://delete-resource/things", Name: "delete-resource"})
+	res := &ct.Resource{}
+	_, err := s.Post("/providers/"+provider.ID+"/resources", &ct.ResourceReq{Apps: []string{app.ID}}, res)
+	c.Assert(err, IsNil)
+	path := fmt.Sprintf("/providers/%s/resources/%s", provider.ID, res.ID)
+
+	// the resource is kept if the provider fails to deprovision it
+	r, err := s.Delete(path)
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, 500)
+	c.Assert(<-deprovisioned, Equals, "/things/delete-resource")
+	r, err = s.Get(path, &ct.Resource{})
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, 200)
+
+	atomic.StoreInt32(&status, 200)
+	r, err = s.Delete(path)
+	c.Assert(err, IsNil)
+	c.Assert(r.StatusCode, Equals, 200)
+	c.Assert(<-deprovisioned, Equals, "/things/delete-resource")
+	r, _ = s.Get(path, &ct.Resource{})
+	c.Assert(r.StatusCode, Equals, 404)
+
+	var list []*ct.Resource
+	_, err = s.Get("/apps/"+app.ID+"/resources", &list)
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0)
+}
+
+func (s *S) TestRemoveLastResourceApp(c *C) {
+	defer func(n int) { resource.DeprovisionAttempts = n }(resource.DeprovisionAttempts)
+	resource.DeprovisionAttempts = 1
+
+	status := int32(500)
+	deprovisioned := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			w.Write([]byte(`{"id":"/things/last-resource-app","env":{"foo":"bar"}}`))
+		case "DELETE":
+			deprovisioned <- req.URL.Path
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		}
+	}))
+	defer srv.Close()
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	s.m.MapTo(&resourceDiscoverd{
+		fn: func() []*discoverd.Service {
+			return []*discoverd.Service{{Addr: srv.Listener.Addr().String(), Host: host, Port: port}}
+		},
+	}, (*resource.DiscoverdClient)(nil))
+
+	app1 := s.createTestApp(c, &ct.App{Name: "last-resource-app1"})
+	app2 := s.createTestApp(c, &ct.App{Name: "last-resource-app2"})
+	provider := s.createTestProvider(c, &ct.Provider{URL: "discoverd+http://last-resource-app/things", Name: "last-resource-app"})
+	created := &ct.Resource{}
+	_, err := s.Post("/providers/"+provider.ID+"/resources", &ct.ResourceReq{Apps: []string{app1.ID, app2.ID}}, created)
+	c.Assert(err, IsNil)
+	path := fmt.Sprintf("/providers/%s/resources/%s", provider.ID, created.ID)
+
+	// unbinding an app which is not the last doesn't deprovision it
+	res, err := s.Delete(path + "/apps/" + app1.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(deprovisioned, HasLen, 0)
+
+	// the last app stays bound if the provider fails to deprovision it
+	res, err = s.Delete(path + "/apps/" + app2.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 500)
+	c.Assert(<-deprovisioned, Equals, "/things/last-resource-app")
+	out := &ct.Resource{}
+	_, err = s.Get(path, out)
+	c.Assert(err, IsNil)
+	c.Assert(out.Apps, DeepEquals, []string{app2.ID})
+
+	atomic.StoreInt32(&status, 200)
+	out = &ct.Resource{}
+	res, err = s.send("DELETE", path+"/apps/"+app2.ID, nil, out)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(<-deprovisioned, Equals, "/things/last-resource-app")
+	c.Assert(out.ID, Equals, created.ID)
+	c.Assert(out.Apps, HasLen, 0)
+	res, _ = s.Get(path, &ct.Resource{})
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *S) TestProviderStatus(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.URL.Path, Equals, "/things")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer srv.Close()
+
+	var services []*discoverd.Service
+	s.m.MapTo(&resourceDiscoverd{
+		fn: func() []*discoverd.Service { return services },
+	}, (*resource.DiscoverdClient)(nil))
+
+	provider := s.createTestProvider(c, &ct.Provider{URL: "discoverd+http://provider-status/things", Name: "provider-status"})
+	path := fmt.Sprintf("/providers/%s/status", provider.ID)
+
+	// no instances
+	status := &ct.ProviderStatus{}
+	res, err := s.Get(path, status)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(status.ProviderID, Equals, provider.ID)
+	c.Assert(status.Reachable, Equals, false)
+	c.Assert(status.Error, Not(Equals), "")
+
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	services = []*discoverd.Service{{Addr: srv.Listener.Addr().String(), Host: host, Port: port}}
+	status = &ct.ProviderStatus{}
+	res, err = s.Get(path, status)
+	c.Assert(err, IsNil)
+	c.Assert(status.Reachable, Equals, true)
+	c.Assert(status.Addr, Equals, srv.Listener.Addr().String())
+	c.Assert(status.Error, Equals, "")
 }
@@ -7,8 +7,17 @@ import (
 	"github.com/flynn/flynn/router/types"
 )
 
-func createRoute(app *ct.App, router routerc.Client, route router.Route, r ResponseHelper) {
+func createRoute(app *ct.App, apps *AppRepo, router routerc.Client, route router.Route, r ResponseHelper) {
+	if err := checkRouteQuota(app, apps, router); err != nil {
+		r.Error(err)
+		return
+	}
 	route.ParentRef = routeParentRef(app)
+	if app.Maintenance && route.Type == "http" {
+		httpRoute := route.HTTPRoute()
+		httpRoute.Maintenance = true
+		route = *httpRoute.ToRoute()
+	}
 	if err := router.CreateRoute(&route); err != nil {
 		r.Error(err)
 		return
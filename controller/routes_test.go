@@ -14,12 +14,13 @@ import (
 )
 
 func newFakeRouter() routerc.Client {
-	return &fakeRouter{routes: make(map[string]*router.Route)}
+	return &fakeRouter{routes: make(map[string]*router.Route), requests: make(map[string]uint64)}
 }
 
 type fakeRouter struct {
-	mtx    sync.RWMutex
-	routes map[string]*router.Route
+	mtx      sync.RWMutex
+	routes   map[string]*router.Route
+	requests map[string]uint64
 }
 
 func (r *fakeRouter) CreateRoute(route *router.Route) error {
@@ -54,7 +55,18 @@ func (r *fakeRouter) GetRoute(id string) (*router.Route, error) {
 	return route, nil
 }
 
-func (r *fakeRouter) SetRoute(*router.Route) error { return nil }
+func (r *fakeRouter) SetRoute(route *router.Route) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	now := time.Now()
+	route.CreatedAt = &now
+	if prev, ok := r.routes[route.ID]; ok {
+		route.CreatedAt = prev.CreatedAt
+	}
+	route.UpdatedAt = &now
+	r.routes[route.ID] = route
+	return nil
+}
 
 type sortedRoutes []*router.Route
 
@@ -77,6 +89,23 @@ func (r *fakeRouter) ListRoutes(parentRef string) ([]*router.Route, error) {
 	return routes, nil
 }
 
+// addRequests adds n to the count of requests routed to the service.
+func (r *fakeRouter) addRequests(service string, n uint64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.requests[service] += n
+}
+
+func (r *fakeRouter) ServiceStats() ([]*router.ServiceStats, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	stats := make([]*router.ServiceStats, 0, len(r.requests))
+	for service, n := range r.requests {
+		stats = append(stats, &router.ServiceStats{Service: service, Requests: n})
+	}
+	return stats, nil
+}
+
 func (r *fakeRouter) Close() error { return nil }
 
 func (s *S) createTestRoute(c *C, appID string, in *router.Route) *router.Route {
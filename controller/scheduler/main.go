@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"math/rand"
 	"os"
 	"sort"
 	"sync"
@@ -16,12 +18,26 @@ import (
 	"github.com/flynn/flynn/pkg/cluster"
 )
 
-var backoffPeriod = 10 * time.Minute
+// Jobs which stop within backoffPeriod of being restarted are crash looping,
+// they are restarted after backoffPeriod * 2 ^ (restarts - 1), which is
+// capped at maxBackoffPeriod.
+var (
+	backoffPeriod    = 10 * time.Minute
+	maxBackoffPeriod = time.Hour
+)
 
 // Allow mocking time.AfterFunc in tests
 var timeAfterFunc = time.AfterFunc
 
+// backoffJitter returns a random delay of up to a tenth of d, which is added
+// to restart backoffs so that the jobs of a bad release which crash together
+// aren't restarted together. It is a variable to allow mocking in tests.
+var backoffJitter = func(d time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(d)/10 + 1))
+}
+
 func main() {
+	rand.Seed(time.Now().UnixNano())
 	grohl.AddContext("app", "controller-scheduler")
 	grohl.Log(grohl.Data{"at": "start"})
 
@@ -126,14 +142,25 @@ func (c *context) syncCluster(events chan<- *host.Event) {
 					releases[release.ID] = release
 				}
 
-				artifact := artifacts[release.ArtifactID]
-				if artifact == nil {
-					artifact, err = c.GetArtifact(release.ArtifactID)
-					if err != nil {
-						gg.Log(grohl.Data{"at": "getArtifact", "status": "error", "err": err})
-						continue
+				artifactIDs := release.ArtifactIDs
+				if len(artifactIDs) == 0 {
+					artifactIDs = []string{release.ArtifactID}
+				}
+				releaseArtifacts := make([]*ct.Artifact, 0, len(artifactIDs))
+				for _, id := range artifactIDs {
+					artifact := artifacts[id]
+					if artifact == nil {
+						artifact, err = c.GetArtifact(id)
+						if err != nil {
+							gg.Log(grohl.Data{"at": "getArtifact", "status": "error", "err": err})
+							break
+						}
+						artifacts[artifact.ID] = artifact
 					}
-					artifacts[artifact.ID] = artifact
+					releaseArtifacts = append(releaseArtifacts, artifact)
+				}
+				if len(releaseArtifacts) < len(artifactIDs) {
+					continue
 				}
 
 				formation, err := c.GetFormation(appID, releaseID)
@@ -145,7 +172,8 @@ func (c *context) syncCluster(events chan<- *host.Event) {
 				f = NewFormation(c, &ct.ExpandedFormation{
 					App:       &ct.App{ID: appID},
 					Release:   release,
-					Artifact:  artifact,
+					Artifact:  releaseArtifacts[0],
+					Artifacts: releaseArtifacts,
 					Processes: formation.Processes,
 				})
 				gg.Log(grohl.Data{"at": "addFormation"})
@@ -171,6 +199,12 @@ func (c *context) syncCluster(events chan<- *host.Event) {
 	for f := range rectify {
 		go f.Rectify()
 	}
+	// hosts which started draining while no scheduler was running
+	for _, h := range hosts {
+		if h.Draining {
+			go c.drainHost(h.ID)
+		}
+	}
 }
 
 func (c *context) watchFormations(events chan<- *FormationEvent, hostEvents chan<- *host.Event) {
@@ -204,7 +238,7 @@ func (c *context) watchFormations(events chan<- *FormationEvent, hostEvents chan
 			f := c.formations.Get(ef.App.ID, ef.Release.ID)
 			if f != nil {
 				g.Log(grohl.Data{"app.id": ef.App.ID, "release.id": ef.Release.ID, "at": "update"})
-				f.SetProcesses(ef.Processes)
+				f.Update(ef)
 			} else {
 				g.Log(grohl.Data{"app.id": ef.App.ID, "release.id": ef.Release.ID, "at": "new"})
 				f = NewFormation(c, ef)
@@ -240,10 +274,14 @@ func (c *context) watchHosts(events chan<- *host.Event) {
 		// TODO: log/handle error
 	}
 
-	go func() { // watch for new hosts
+	go func() { // watch for new and draining hosts
 		ch := make(chan *host.HostEvent)
 		c.StreamHostEvents(ch)
 		for event := range ch {
+			if event.Event == "drain" {
+				go c.drainHost(event.HostID)
+				continue
+			}
 			if event.Event != "add" {
 				continue
 			}
@@ -263,6 +301,57 @@ func (c *context) watchHosts(events chan<- *host.Event) {
 
 }
 
+// drainHost moves the jobs of a draining host to other hosts, starting each
+// replacement before stopping the job it replaces. Jobs with volumes, one-off
+// jobs and jobs which can't be placed on another host are left running.
+func (c *context) drainHost(id string) {
+	g := grohl.NewContext(grohl.Data{"fn": "drainHost", "host.id": id})
+	g.Log(grohl.Data{"at": "start"})
+
+	hosts, err := c.ListHosts()
+	if err != nil {
+		g.Log(grohl.Data{"at": "listHosts", "status": "error", "err": err})
+		return
+	}
+	h, ok := hosts[id]
+	if !ok {
+		return
+	}
+	client := c.hosts.Get(id)
+	if client == nil {
+		if client, err = c.DialHost(id); err != nil {
+			g.Log(grohl.Data{"at": "dialHost", "status": "error", "err": err})
+			return
+		}
+	}
+	for _, hostJob := range h.Jobs {
+		job := c.jobs.Get(id, hostJob.ID)
+		if job == nil || job.Type == "" {
+			continue
+		}
+		gg := g.New(grohl.Data{"job.id": job.ID, "type": job.Type})
+		if hasVolumes(hostJob) {
+			gg.Log(grohl.Data{"at": "skip", "reason": "volumes"})
+			continue
+		}
+		if err := job.Formation.move(job, client); err != nil {
+			gg.Log(grohl.Data{"at": "move", "status": "error", "err": err})
+			continue
+		}
+		gg.Log(grohl.Data{"at": "moved"})
+	}
+	g.Log(grohl.Data{"at": "done"})
+}
+
+func hasVolumes(job *host.Job) bool {
+	for _, m := range job.Config.Mounts {
+		if m.VolumeID != "" {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *context) watchHost(id string, events chan<- *host.Event) {
 	if !c.hosts.Add(id) {
 		return
@@ -293,17 +382,38 @@ func (c *context) watchHost(id string, events chan<- *host.Event) {
 			continue
 		}
 
+		if event.Event == "oom" {
+			// the job either keeps running or the host sends a stop
+			// event once it exits
+			g.Log(grohl.Data{"at": "oom", "job.id": event.JobID, "job.type": job.Type})
+			if events != nil {
+				events <- event
+			}
+			continue
+		}
+
 		j := &ct.Job{ID: id + "-" + event.JobID, AppID: job.Formation.AppID, ReleaseID: job.Formation.Release.ID, Type: job.Type}
 		switch event.Event {
 		case "create":
 			j.State = "starting"
 		case "start":
-			j.State = "up"
+			// jobs with a health check are not up until it passes
+			if event.Job.Job.HealthCheck != nil {
+				j.State = "starting"
+			} else {
+				j.State = "up"
+			}
 			job.startedAt = event.Job.StartedAt
+		case "healthy":
+			j.State = "up"
+		case "unhealthy":
+			j.State = "unhealthy"
 		case "stop":
 			j.State = "down"
+			j.CrashLoop = job.crashLooping()
 		case "error":
 			j.State = "crashed"
+			j.CrashLoop = job.crashLooping()
 		}
 		g.Log(grohl.Data{"at": "event", "job.id": event.JobID, "event": event.Event})
 		if err = c.PutJob(j); err != nil {
@@ -320,9 +430,10 @@ func (c *context) watchHost(id string, events chan<- *host.Event) {
 		g.Log(grohl.Data{"at": "remove", "job.id": event.JobID, "event": event.Event})
 
 		c.jobs.Remove(id, event.JobID)
+		failed := event.Event == "error" || event.Job != nil && event.Job.ExitStatus != 0
 		go func(event *host.Event) {
 			c.mtx.RLock()
-			job.Formation.RestartJob(job.Type, id, event.JobID)
+			job.Formation.RestartJob(job.Type, id, event.JobID, failed)
 			c.mtx.RUnlock()
 			if events != nil {
 				events <- event
@@ -453,9 +564,15 @@ func NewFormation(c *context, ef *ct.ExpandedFormation) *Formation {
 		AppName:   ef.App.Name,
 		Release:   ef.Release,
 		Artifact:  ef.Artifact,
+		Artifacts: ef.Artifacts,
 		Processes: ef.Processes,
+		Limits:    ef.Limits,
+		AppEnv:    ef.AppEnv,
+		LogDrains: ef.LogDrains,
 		jobs:      make(jobTypeMap),
 		c:         c,
+
+		Constraints: ef.Constraints,
 	}
 }
 
@@ -468,6 +585,31 @@ type Job struct {
 	restarts  int
 	timer     *time.Timer
 	startedAt time.Time
+
+	// retries is the number of times the job's predecessors were restarted
+	// after failing, it limits restarts of process types with an
+	// on-failure restart policy.
+	retries int
+}
+
+// crashLooping returns whether the job was restarted and stopped again
+// within backoffPeriod, or before it started, in which case it is restarted
+// after a backoff rather than straight away.
+func (j *Job) crashLooping() bool {
+	return j.restarts > 0 && (j.startedAt.IsZero() || j.startedAt.After(time.Now().Add(-backoffPeriod)))
+}
+
+// restartBackoff returns how long to wait before restarting a crash looping
+// job which has been restarted the given number of times.
+func restartBackoff(restarts int) time.Duration {
+	d := backoffPeriod
+	for i := 1; i < restarts && d < maxBackoffPeriod; i++ {
+		d *= 2
+	}
+	if d > maxBackoffPeriod {
+		d = maxBackoffPeriod
+	}
+	return d + backoffJitter(d)
 }
 
 type jobTypeMap map[string]map[jobKey]*Job
@@ -499,19 +641,59 @@ type Formation struct {
 	AppName   string
 	Release   *ct.Release
 	Artifact  *ct.Artifact
+	Artifacts []*ct.Artifact
 	Processes map[string]int
+	Limits    map[string]ct.ResourceLimits
+	AppEnv    map[string]string
+	LogDrains []*ct.LogDrain
+
+	Constraints map[string]ct.PlacementConstraints
 
 	jobs jobTypeMap
 	c    *context
+
+	// stopped counts the jobs of each process type and host which stopped
+	// and were not restarted because of the type's restart policy, they
+	// count towards the process type's jobs until it is scaled.
+	stopped map[stoppedKey]int
+}
+
+type stoppedKey struct {
+	typ, hostID string
+}
+
+// stoppedJobs returns the number of stopped jobs of the process type on the
+// host, or on all hosts if hostID is empty.
+func (f *Formation) stoppedJobs(typ, hostID string) int {
+	var n int
+	for k, count := range f.stopped {
+		if k.typ == typ && (hostID == "" || k.hostID == hostID) {
+			n += count
+		}
+	}
+	return n
 }
 
 func (f *Formation) key() formationKey {
 	return formationKey{f.AppID, f.Release.ID}
 }
 
-func (f *Formation) SetProcesses(p map[string]int) {
+// Update sets the processes, limits, app environment, log drains and
+// placement constraints of the formation, all but the processes apply to jobs
+// started after the update.
+func (f *Formation) Update(ef *ct.ExpandedFormation) {
 	f.mtx.Lock()
-	f.Processes = p
+	// scaling a process type starts its stopped jobs again
+	for k := range f.stopped {
+		if ef.Processes[k.typ] != f.Processes[k.typ] {
+			delete(f.stopped, k)
+		}
+	}
+	f.Processes = ef.Processes
+	f.Limits = ef.Limits
+	f.AppEnv = ef.AppEnv
+	f.LogDrains = ef.LogDrains
+	f.Constraints = ef.Constraints
 	f.mtx.Unlock()
 }
 
@@ -521,7 +703,9 @@ func (f *Formation) Rectify() {
 	f.rectify()
 }
 
-func (f *Formation) RestartJob(typ, hostID, jobID string) {
+// RestartJob restarts the job, which stopped after failing if failed is set,
+// unless the restart policy of its process type says otherwise.
+func (f *Formation) RestartJob(typ, hostID, jobID string, failed bool) {
 	f.mtx.Lock()
 	defer f.mtx.Unlock()
 
@@ -534,23 +718,27 @@ func (f *Formation) RestartJob(typ, hostID, jobID string) {
 		f.jobs.Remove(job)
 		return
 	}
-	// If the job was started more than backoffPeriod ago, reset it's restart count
-	// so that it will be restarted straight away
-	if job.startedAt.Before(time.Now().Add(-backoffPeriod)) {
-		job.restarts = 0
+	if !f.Release.Processes[job.Type].RestartPolicy.ShouldRestart(failed, job.retries) {
+		f.jobs.Remove(job)
+		if f.stopped == nil {
+			f.stopped = make(map[stoppedKey]int)
+		}
+		f.stopped[stoppedKey{job.Type, job.HostID}]++
+		return
 	}
-	if job.restarts == 0 {
+	if failed {
+		job.retries++
+	}
+	// If the job ran for longer than backoffPeriod, reset its restart
+	// count so that it will be restarted straight away
+	if !job.crashLooping() {
+		job.restarts = 0
 		f.restart(job)
-	} else {
-		// wait backoffPeriod * 2 ^ (restarts - 1) before restarting
-		duration := backoffPeriod
-		for i := 0; i < job.restarts-1; i++ {
-			duration *= 2
-		}
-		job.timer = timeAfterFunc(duration, func() {
-			f.restart(job)
-		})
+		return
 	}
+	job.timer = timeAfterFunc(restartBackoff(job.restarts), func() {
+		f.restart(job)
+	})
 }
 
 func (f *Formation) rectify() {
@@ -572,7 +760,7 @@ func (f *Formation) rectify() {
 		if f.Release.Processes[t].Omni {
 			// get job counts per host
 			hostCounts := make(map[string]int, len(hosts))
-			for _, h := range hosts {
+			for _, h := range f.candidateHosts(t, hosts) {
 				hostCounts[h.ID] = 0
 				for _, job := range h.Jobs {
 					if f.jobType(job) != t {
@@ -580,6 +768,7 @@ func (f *Formation) rectify() {
 					}
 					hostCounts[h.ID]++
 				}
+				hostCounts[h.ID] += f.stoppedJobs(t, h.ID)
 			}
 			// update per host
 			for hostID, actual := range hostCounts {
@@ -592,7 +781,7 @@ func (f *Formation) rectify() {
 				}
 			}
 		} else {
-			actual := len(f.jobs[t])
+			actual := len(f.jobs[t]) + f.stoppedJobs(t, "")
 			diff := expected - actual
 			g.Log(grohl.Data{"at": "update", "type": t, "expected": expected, "actual": actual, "diff": diff})
 			if diff > 0 {
@@ -622,7 +811,7 @@ func (f *Formation) add(n int, name string, hostID string) {
 		job, err := f.start(name, hostID)
 		if err != nil {
 			// TODO: handle error
-			g.Log(grohl.Data{"at": "error", "host.id": job.HostID, "job.id": job.ID, "err": err})
+			g.Log(grohl.Data{"at": "error", "type": name, "host.id": hostID, "err": err})
 			continue
 		}
 		g.Log(grohl.Data{"at": "started", "host.id": job.HostID, "job.id": job.ID})
@@ -644,10 +833,33 @@ func (f *Formation) restart(stoppedJob *Job) error {
 		return err
 	}
 	newJob.restarts = stoppedJob.restarts + 1
+	newJob.retries = stoppedJob.retries
 	g.Log(grohl.Data{"new.host.id": newJob.HostID, "new.job.id": newJob.ID})
 	return nil
 }
 
+// move replaces the job with one on another host, the job is stopped through
+// h, the client of its host, once its replacement has been added to the
+// cluster. Omni jobs are stopped without being replaced, as they already run
+// on every other host.
+func (f *Formation) move(job *Job, h cluster.Host) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.jobs.Get(job.Type, job.HostID, job.ID) == nil {
+		return nil
+	}
+	if !f.Release.Processes[job.Type].Omni {
+		if _, err := f.start(job.Type, ""); err != nil {
+			return err
+		}
+	}
+	// the job is no longer part of the formation, so it isn't restarted
+	// when it stops
+	f.jobs.Remove(job)
+	return h.StopJob(job.ID)
+}
+
 func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 	config := f.jobConfig(typ)
 	config.ID = cluster.RandomJobID("")
@@ -656,15 +868,22 @@ func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 	if err != nil {
 		return nil, err
 	}
+	hosts = f.candidateHosts(typ, hosts)
 	if len(hosts) == 0 {
-		// TODO: log/handle error
+		return nil, fmt.Errorf("scheduler: no hosts satisfy the placement constraints of %s", typ)
 	}
-	var h host.Host
-
+	var candidates []string
 	if hostID != "" {
-		h = hosts[hostID]
+		if _, ok := hosts[hostID]; !ok {
+			return nil, fmt.Errorf("scheduler: host %s does not satisfy the placement constraints of %s", hostID, typ)
+		}
+		candidates = []string{hostID}
 	} else {
+		// jobs are started on the host with the fewest jobs of the type,
+		// preferring hosts in the spread_by domain with the fewest jobs
+		spreadBy := f.Constraints[typ].SpreadBy
 		hostCounts := make(map[string]int, len(hosts))
+		domainCounts := make(map[string]int)
 		for _, h := range hosts {
 			hostCounts[h.ID] = 0
 			for _, job := range h.Jobs {
@@ -672,28 +891,41 @@ func (f *Formation) start(typ string, hostID string) (job *Job, err error) {
 					continue
 				}
 				hostCounts[h.ID]++
+				if spreadBy != "" {
+					domainCounts[h.Metadata[spreadBy]]++
+				}
 			}
 		}
 		sh := make(sortHosts, 0, len(hosts))
 		for id, count := range hostCounts {
-			sh = append(sh, sortHost{id, count})
+			sh = append(sh, sortHost{ID: id, Jobs: count, DomainJobs: domainCounts[hosts[id].Metadata[spreadBy]]})
 		}
 		sh.Sort()
 
-		h = hosts[sh[0].ID]
+		candidates = make([]string, len(sh))
+		for i, h := range sh {
+			candidates[i] = h.ID
+		}
 	}
 
-	job = f.jobs.Add(typ, h.ID, config.ID)
-	job.Formation = f
-	f.c.jobs.Add(job)
+	// hosts whose resources are reserved by the limits of their jobs
+	// reject the job, so it is tried on the next host
+	for _, id := range candidates {
+		job = f.jobs.Add(typ, id, config.ID)
+		job.Formation = f
+		f.c.jobs.Add(job)
 
-	_, err = f.c.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{h.ID: {config}}})
-	if err != nil {
+		_, err = f.c.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{id: {config}}})
+		if err == nil {
+			return job, nil
+		}
 		f.jobs.Remove(job)
-		f.c.jobs.Remove(config.ID, h.ID)
-		return nil, err
+		f.c.jobs.Remove(id, config.ID)
+		if _, ok := err.(*host.ResourceError); !ok {
+			return nil, err
+		}
 	}
-	return job, nil
+	return nil, err
 }
 
 func (f *Formation) jobType(job *host.Job) string {
@@ -726,23 +958,62 @@ func (f *Formation) remove(n int, name string, hostID string) {
 
 func (f *Formation) jobConfig(name string) *host.Job {
 	return utils.JobConfig(&ct.ExpandedFormation{
-		App:      &ct.App{ID: f.AppID, Name: f.AppName},
-		Release:  f.Release,
-		Artifact: f.Artifact,
+		App:       &ct.App{ID: f.AppID, Name: f.AppName},
+		Release:   f.Release,
+		Artifact:  f.Artifact,
+		Artifacts: f.Artifacts,
+		Limits:    f.Limits,
+		AppEnv:    f.AppEnv,
+		LogDrains: f.LogDrains,
 	}, name)
 }
 
+// candidateHosts returns the hosts which are not draining and satisfy the
+// placement constraints of the process type.
+func (f *Formation) candidateHosts(typ string, hosts map[string]host.Host) map[string]host.Host {
+	c, constrained := f.Constraints[typ]
+	res := make(map[string]host.Host, len(hosts))
+	devices := f.Release.Processes[typ].Devices
+	for id, h := range hosts {
+		if h.Draining || constrained && !c.Matches(h.Metadata) || !hasDevices(h, devices) {
+			continue
+		}
+		res[id] = h
+	}
+	return res
+}
+
+// hasDevices returns whether the host has at least as many devices of each
+// class as are requested, regardless of whether its jobs have claimed them.
+func hasDevices(h host.Host, devices []ct.DeviceRequest) bool {
+	for _, d := range devices {
+		if h.Resources.Devices[d.Class] < d.Count {
+			return false
+		}
+	}
+	return true
+}
+
 type sortHost struct {
 	ID   string
 	Jobs int
+
+	// DomainJobs is the number of jobs in the host's spread_by domain.
+	DomainJobs int
 }
 
 type sortHosts []sortHost
 
-func (h sortHosts) Len() int           { return len(h) }
-func (h sortHosts) Less(i, j int) bool { return h[i].Jobs < h[j].Jobs }
-func (h sortHosts) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
-func (h sortHosts) Sort()              { sort.Sort(h) }
+func (h sortHosts) Len() int      { return len(h) }
+func (h sortHosts) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h sortHosts) Sort()         { sort.Sort(h) }
+
+func (h sortHosts) Less(i, j int) bool {
+	if h[i].DomainJobs != h[j].DomainJobs {
+		return h[i].DomainJobs < h[j].DomainJobs
+	}
+	return h[i].Jobs < h[j].Jobs
+}
 
 type FormationEvent struct {
 	Formation *Formation
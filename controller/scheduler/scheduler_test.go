@@ -413,6 +413,40 @@ func (s *S) TestWatchHost(c *C) {
 	c.Assert(len(host2.Jobs), Equals, 0)
 }
 
+func (s *S) TestWatchHostHealthCheck(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 1}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	hostID := "host0"
+	cl := newFakeCluster(hostID, appID, release.ID, processes, nil)
+	hc := tu.NewFakeHostClient(hostID)
+	cl.SetHostClient(hostID, hc)
+
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 4)
+	defer close(events)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+
+	// a job with a health check is starting until it is healthy
+	hc.SetJob("job0", &host.ActiveJob{Job: &host.Job{ID: "job0", HealthCheck: &host.HealthCheck{Type: "tcp"}}})
+	hc.SendEvent("start", "job0")
+	waitForHostEvents(1, events, c)
+	c.Assert(cc.jobs[hostID+"-job0"].State, Equals, "starting")
+
+	hc.SendEvent("healthy", "job0")
+	waitForHostEvents(1, events, c)
+	c.Assert(cc.jobs[hostID+"-job0"].State, Equals, "up")
+
+	hc.SendEvent("unhealthy", "job0")
+	waitForHostEvents(1, events, c)
+	c.Assert(cc.jobs[hostID+"-job0"].State, Equals, "unhealthy")
+	c.Assert(cx.jobs.Len(), Equals, 1)
+}
+
 func (s *S) TestJobRestartBackoffPolicy(c *C) {
 	// Create a fake cluster with an existing running formation
 	appID := "app"
@@ -436,25 +470,31 @@ func (s *S) TestJobRestartBackoffPolicy(c *C) {
 	// Give the watchHost goroutine chance to start
 	waitForWatchHostStart(events, c)
 
+	afterFunc, jitter := timeAfterFunc, backoffJitter
+	defer func() { timeAfterFunc, backoffJitter = afterFunc, jitter }()
 	durations := make([]time.Duration, 0)
 	timeAfterFunc = testAfterFunc(&durations)
+	backoffJitter = func(d time.Duration) time.Duration { return time.Second }
 
 	// First restart: scheduled immediately
 	cl.RemoveJob(hostID, "job0", false)
 	e := waitForJobStartEvent(events, c)
 	c.Assert(len(durations), Equals, 0)
+	c.Assert(cc.jobs[hostID+"-job0"].CrashLoop, Equals, false)
 
-	// Second restart: scheduled for 1 * backoffPeriod
+	// Second restart: scheduled for 1 * backoffPeriod plus jitter
+	stopped := e.JobID
 	cl.RemoveJob(hostID, e.JobID, false)
 	e = waitForJobStartEvent(events, c)
 	c.Assert(len(durations), Equals, 1)
-	c.Assert(durations[0], Equals, backoffPeriod)
+	c.Assert(durations[0], Equals, backoffPeriod+time.Second)
+	c.Assert(cc.jobs[hostID+"-"+stopped].CrashLoop, Equals, true)
 
-	// Third restart: scheduled for 2 * backoffPeriod
+	// Third restart: scheduled for 2 * backoffPeriod plus jitter
 	cl.RemoveJob(hostID, e.JobID, false)
 	e = waitForJobStartEvent(events, c)
 	c.Assert(len(durations), Equals, 2)
-	c.Assert(durations[1], Equals, 2*backoffPeriod)
+	c.Assert(durations[1], Equals, 2*backoffPeriod+time.Second)
 
 	// After backoffPeriod has elapsed: scheduled immediately
 	job := cx.jobs.Get(hostID, e.JobID)
@@ -463,3 +503,236 @@ func (s *S) TestJobRestartBackoffPolicy(c *C) {
 	waitForJobStartEvent(events, c)
 	c.Assert(len(durations), Equals, 2)
 }
+
+func (s *S) TestRestartBackoff(c *C) {
+	jitter := backoffJitter
+	defer func() { backoffJitter = jitter }()
+	backoffJitter = func(d time.Duration) time.Duration { return d / 10 }
+	for restarts, expected := range map[int]time.Duration{
+		1:  backoffPeriod,
+		2:  2 * backoffPeriod,
+		3:  4 * backoffPeriod,
+		10: maxBackoffPeriod,
+	} {
+		c.Assert(restartBackoff(restarts), Equals, expected+expected/10, Commentf("restarts = %d", restarts))
+	}
+}
+
+func (s *S) TestJobRestartPolicy(c *C) {
+	durations := make([]time.Duration, 0)
+	timeAfterFunc = testAfterFunc(&durations)
+
+	for _, t := range []struct {
+		policy   *ct.RestartPolicy
+		errors   []bool
+		restarts int
+	}{
+		{nil, []bool{false, true}, 2},
+		{&ct.RestartPolicy{Name: ct.RestartNever}, []bool{true}, 0},
+		{&ct.RestartPolicy{Name: ct.RestartOnFailure}, []bool{false}, 0},
+		{&ct.RestartPolicy{Name: ct.RestartOnFailure, MaxRetries: 2}, []bool{true, true, true}, 2},
+	} {
+		appID := "app"
+		artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+		processes := map[string]int{"batch": 1}
+		release := newRelease("release", artifact, processes)
+		release.Processes["batch"] = ct.ProcessType{Cmd: []string{"start", "batch"}, RestartPolicy: t.policy}
+		cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+		hostID := "host0"
+		cl := newFakeCluster(hostID, appID, release.ID, processes, nil)
+		hc := tu.NewFakeHostClient(hostID)
+		cl.SetHostClient(hostID, hc)
+
+		cx := newContext(cc, cl)
+		events := make(chan *host.Event, 2)
+		cx.syncCluster(events)
+		waitForWatchHostStart(events, c)
+
+		jobID := "job0"
+		var restarts int
+		for _, errored := range t.errors {
+			cl.RemoveJob(hostID, jobID, errored)
+			// the stop event is sent once the job has been handled
+			waitForHostEvents(1, events, c)
+			if cx.jobs.Len() == 0 {
+				break
+			}
+			restarts++
+			jobID = waitForJobStartEvent(events, c).JobID
+		}
+		c.Assert(restarts, Equals, t.restarts, Commentf("policy %+v", t.policy))
+
+		// stopped jobs are not started again until the formation is scaled
+		f := cx.formations.Get(appID, release.ID)
+		if cx.jobs.Len() == 0 {
+			f.Rectify()
+			c.Assert(cx.jobs.Len(), Equals, 0)
+			f.Update(&ct.ExpandedFormation{Processes: map[string]int{"batch": 2}})
+			f.Rectify()
+			c.Assert(cx.jobs.Len(), Equals, 2)
+		}
+	}
+}
+
+func (s *S) TestPlacementConstraints(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"db": 0, "web": 0}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	cl := tu.NewFakeCluster()
+	cl.SetHosts(map[string]host.Host{
+		"host0": {ID: "host0", Metadata: map[string]string{"disk": "ssd", "zone": "a", ct.HostVolumesMetadata: "pg"}},
+		"host1": {ID: "host1", Metadata: map[string]string{"disk": "ssd", "zone": "a"}},
+		"host2": {ID: "host2", Metadata: map[string]string{"disk": "ssd", "zone": "b"}},
+		"host3": {ID: "host3", Metadata: map[string]string{"disk": "hdd", "zone": "c"}},
+	})
+	cx := newContext(cc, cl)
+	f := NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID, Name: "app"},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+		Constraints: map[string]ct.PlacementConstraints{
+			"db":  {Volumes: []string{"pg"}},
+			"web": {HostTags: map[string]string{"disk": "ssd"}, SpreadBy: "zone"},
+		},
+	})
+
+	// jobs only run on matching hosts, spread across zones first
+	zones := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		job, err := f.start("web", "")
+		c.Assert(err, IsNil)
+		c.Assert(job.HostID, Not(Equals), "host3")
+		zones[cl.GetHost(job.HostID).Metadata["zone"]]++
+	}
+	c.Assert(zones, DeepEquals, map[string]int{"a": 2, "b": 1})
+
+	job, err := f.start("db", "")
+	c.Assert(err, IsNil)
+	c.Assert(job.HostID, Equals, "host0")
+	_, err = f.start("db", "host1")
+	c.Assert(err, NotNil)
+
+	f.Constraints["db"] = ct.PlacementConstraints{Volumes: []string{"backups"}}
+	_, err = f.start("db", "")
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestDrainHost(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 3}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	cl := newFakeCluster("host0", appID, release.ID, processes, nil)
+	for _, job := range cl.GetHost("host0").Jobs {
+		if job.ID == "job2" {
+			job.Config.Mounts = []host.Mount{{Location: "/data", VolumeID: "vol0"}}
+		}
+	}
+	cl.AddHost("host1", host.Host{ID: "host1"})
+	cl.SetHostClient("host1", tu.NewFakeHostClient("host1"))
+
+	cx := newContext(cc, cl)
+	events := make(chan *host.Event, 8)
+	defer close(events)
+	cx.syncCluster(events)
+	waitForWatchHostStart(events, c)
+	waitForWatchHostStart(events, c)
+
+	// jobs are started on host1 and stopped on host0, except the job with
+	// a volume
+	host0 := cl.GetHost("host0")
+	host0.Draining = true
+	cl.AddHost("host0", host0)
+	cx.drainHost("host0")
+	waitForHostEvents(4, events, c)
+	host0 = cl.GetHost("host0")
+	c.Assert(host0.Jobs, HasLen, 1)
+	c.Assert(host0.Jobs[0].ID, Equals, "job2")
+	c.Assert(cl.GetHost("host1").Jobs, HasLen, 2)
+	c.Assert(cx.jobs.Len(), Equals, 3)
+
+	// draining hosts don't get new jobs
+	f := cx.formations.Get(appID, release.ID)
+	job, err := f.start("web", "")
+	c.Assert(err, IsNil)
+	c.Assert(job.HostID, Equals, "host1")
+	waitForHostEvents(1, events, c)
+	_, err = f.start("web", "host0")
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestResourcePlacement(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"web": 0}
+	release := newRelease("release", artifact, processes)
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	// host0 has room for one job, host1 for two
+	cl := tu.NewFakeCluster()
+	cl.SetHosts(map[string]host.Host{
+		"host0": {ID: "host0", Resources: host.HostResources{Memory: 1024 * 1024}},
+		"host1": {ID: "host1", Resources: host.HostResources{Memory: 1024 * 1024, Overcommit: 2}},
+	})
+	cx := newContext(cc, cl)
+	f := NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID, Name: "app"},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+		Limits:    map[string]ct.ResourceLimits{"web": {Memory: 1024}},
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := f.start("web", "")
+		c.Assert(err, IsNil)
+	}
+	c.Assert(cl.GetHost("host0").Jobs, HasLen, 1)
+	c.Assert(cl.GetHost("host1").Jobs, HasLen, 2)
+	c.Assert(cx.jobs.Len(), Equals, 3)
+
+	_, err := f.start("web", "")
+	c.Assert(err, FitsTypeOf, &host.ResourceError{})
+	_, err = f.start("web", "host1")
+	c.Assert(err, FitsTypeOf, &host.ResourceError{})
+	c.Assert(cx.jobs.Len(), Equals, 3)
+}
+
+func (s *S) TestDevicePlacement(c *C) {
+	appID := "app"
+	artifact := &ct.Artifact{ID: "artifact", Type: "docker", URI: "docker://foo/bar"}
+	processes := map[string]int{"train": 0}
+	release := newRelease("release", artifact, processes)
+	release.Processes["train"] = ct.ProcessType{Cmd: []string{"train"}, Devices: []ct.DeviceRequest{{Class: "gpu", Count: 1}}}
+	cc := newFakeControllerClient(appID, release, artifact, processes, nil)
+
+	// only host1 has a gpu
+	cl := tu.NewFakeCluster()
+	cl.SetHosts(map[string]host.Host{
+		"host0": {ID: "host0"},
+		"host1": {ID: "host1", Resources: host.HostResources{Devices: map[string]int{"gpu": 1}}},
+	})
+	cx := newContext(cc, cl)
+	f := NewFormation(cx, &ct.ExpandedFormation{
+		App:       &ct.App{ID: appID, Name: "app"},
+		Release:   release,
+		Artifact:  artifact,
+		Processes: processes,
+	})
+
+	job, err := f.start("train", "")
+	c.Assert(err, IsNil)
+	c.Assert(job.HostID, Equals, "host1")
+
+	// the gpu is claimed, and host0 has none
+	_, err = f.start("train", "")
+	c.Assert(err, NotNil)
+	c.Assert(cl.GetHost("host0").Jobs, HasLen, 0)
+}
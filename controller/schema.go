@@ -6,6 +6,17 @@ import (
 )
 
 func migrateDB(db *sql.DB) error {
+	return migrations().Migrate(db)
+}
+
+// schemaVersion returns the ID of the latest migration, which is the version
+// of a database the controller has migrated.
+func schemaVersion() int {
+	m := *migrations()
+	return m[len(m)-1].ID
+}
+
+func migrations() *migrate.Migrations {
 	m := migrate.NewMigrations()
 	m.Add(1,
 		`CREATE EXTENSION IF NOT EXISTS "uuid-ossp"`,
@@ -135,5 +146,251 @@ $$ LANGUAGE plpgsql`,
 
 		`CREATE SEQUENCE name_ids MAXVALUE 4294967295`,
 	)
-	return m.Migrate(db)
+	m.Add(2,
+		`CREATE SEQUENCE event_ids`,
+		`CREATE TABLE events (
+    event_id bigint PRIMARY KEY DEFAULT nextval('event_ids'),
+    app_id uuid REFERENCES apps (app_id),
+    object_type text NOT NULL,
+    object_id text NOT NULL,
+    data text,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON events (app_id, object_type)`,
+		`CREATE FUNCTION notify_event() RETURNS TRIGGER AS $$
+    BEGIN
+        PERFORM pg_notify('events', NEW.event_id || '');
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+
+		`CREATE TRIGGER notify_event
+    AFTER INSERT ON events
+    FOR EACH ROW EXECUTE PROCEDURE notify_event()`,
+	)
+	m.Add(3,
+		`CREATE TABLE deployments (
+    deployment_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    old_release_id uuid REFERENCES releases (release_id),
+    new_release_id uuid NOT NULL REFERENCES releases (release_id),
+    strategy text NOT NULL,
+    canary_percent integer NOT NULL DEFAULT 0,
+    status text NOT NULL,
+    processes hstore,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    finished_at timestamptz
+)`,
+		`CREATE UNIQUE INDEX ON deployments (app_id) WHERE finished_at IS NULL`,
+		`CREATE SEQUENCE deployment_event_ids`,
+		`CREATE TABLE deployment_events (
+    event_id bigint PRIMARY KEY DEFAULT nextval('deployment_event_ids'),
+    deployment_id uuid NOT NULL REFERENCES deployments (deployment_id),
+    release_id uuid REFERENCES releases (release_id),
+    status text NOT NULL,
+    job_type text,
+    job_state text,
+    error text,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON deployment_events (deployment_id)`,
+		`CREATE FUNCTION notify_deployment_event() RETURNS TRIGGER AS $$
+    BEGIN
+        PERFORM pg_notify('deployment_events:' || NEW.deployment_id, NEW.event_id || '');
+        RETURN NULL;
+    END;
+$$ LANGUAGE plpgsql`,
+
+		`CREATE TRIGGER notify_deployment_event
+    AFTER INSERT ON deployment_events
+    FOR EACH ROW EXECUTE PROCEDURE notify_deployment_event()`,
+	)
+	m.Add(4,
+		`ALTER TABLE deployments ADD COLUMN deploy_timeout integer NOT NULL DEFAULT 120`,
+	)
+	m.Add(5,
+		`CREATE INDEX ON events (created_at)`,
+	)
+	m.Add(6,
+		`ALTER TABLE apps ADD COLUMN labels hstore`,
+		`CREATE INDEX ON apps USING GIN (labels)`,
+	)
+	m.Add(7,
+		`CREATE TABLE cron_jobs (
+    cron_job_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    schedule text NOT NULL,
+    process_type text,
+    cmd text,
+    concurrency_policy text NOT NULL,
+    last_scheduled_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz
+)`,
+		`CREATE INDEX ON cron_jobs (app_id) WHERE deleted_at IS NULL`,
+		`CREATE SEQUENCE cron_job_run_ids`,
+		`CREATE TABLE cron_job_runs (
+    run_id bigint PRIMARY KEY DEFAULT nextval('cron_job_run_ids'),
+    cron_job_id uuid NOT NULL REFERENCES cron_jobs (cron_job_id),
+    scheduled_at timestamptz NOT NULL,
+    job_id text,
+    status text NOT NULL,
+    error text,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (cron_job_id, scheduled_at)
+)`,
+	)
+	m.Add(8,
+		`CREATE TABLE autoscale_policies (
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    process_type text NOT NULL,
+    min_count integer NOT NULL,
+    max_count integer NOT NULL,
+    metric text NOT NULL,
+    target double precision NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (app_id, process_type)
+)`,
+	)
+	m.Add(9,
+		`ALTER TABLE formations ADD COLUMN limits text`,
+	)
+	m.Add(10,
+		`ALTER TABLE apps ADD COLUMN env hstore`,
+	)
+	m.Add(11,
+		`CREATE TABLE audit_log (
+    audit_id bigserial PRIMARY KEY,
+    actor text NOT NULL,
+    method text NOT NULL,
+    path text NOT NULL,
+    status integer NOT NULL,
+    object_type text NOT NULL,
+    object_id text NOT NULL,
+    before text,
+    after text,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE INDEX ON audit_log (object_type, object_id)`,
+		// the audit log is append-only
+		`CREATE RULE audit_log_no_update AS ON UPDATE TO audit_log DO INSTEAD NOTHING`,
+		`CREATE RULE audit_log_no_delete AS ON DELETE TO audit_log DO INSTEAD NOTHING`,
+	)
+	m.Add(12,
+		`CREATE TABLE auth_tokens (
+    token_id uuid PRIMARY KEY,
+    name text NOT NULL,
+    token_hash text NOT NULL UNIQUE,
+    scopes text NOT NULL,
+    app_ids text,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz
+)`,
+	)
+	m.Add(13,
+		`CREATE TABLE webhooks (
+    webhook_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    url text NOT NULL,
+    secret text NOT NULL,
+    events text,
+    app_id uuid REFERENCES apps (app_id),
+    last_event_id bigint NOT NULL,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz
+)`,
+		`CREATE TABLE webhook_deliveries (
+    delivery_id bigserial PRIMARY KEY,
+    webhook_id uuid NOT NULL REFERENCES webhooks (webhook_id),
+    event_id bigint NOT NULL REFERENCES events (event_id),
+    event_type text NOT NULL,
+    status text NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    response_status integer,
+    error text,
+    next_attempt_at timestamptz NOT NULL DEFAULT now(),
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (webhook_id, event_id)
+)`,
+		`CREATE INDEX ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`,
+	)
+	m.Add(14,
+		`ALTER TABLE artifacts ADD COLUMN size bigint`,
+		`ALTER TABLE artifacts ADD COLUMN sha256 text`,
+	)
+	m.Add(15,
+		`CREATE TABLE release_artifacts (
+    release_id uuid NOT NULL REFERENCES releases (release_id),
+    artifact_id uuid NOT NULL REFERENCES artifacts (artifact_id),
+    position integer NOT NULL,
+    PRIMARY KEY (release_id, position)
+)`,
+		`CREATE INDEX ON release_artifacts (artifact_id)`,
+		`INSERT INTO release_artifacts (release_id, artifact_id, position) SELECT release_id, artifact_id, 0 FROM releases`,
+	)
+	m.Add(16,
+		`ALTER TABLE apps ADD COLUMN version bigint NOT NULL DEFAULT 1`,
+		`ALTER TABLE releases ADD COLUMN version bigint NOT NULL DEFAULT 1`,
+		`ALTER TABLE resources ADD COLUMN version bigint NOT NULL DEFAULT 1`,
+	)
+	m.Add(17,
+		`ALTER TABLE apps ADD COLUMN maintenance boolean NOT NULL DEFAULT false`,
+		`ALTER TABLE apps ADD COLUMN maintenance_started_at timestamptz`,
+		`ALTER TABLE apps ADD COLUMN maintenance_ended_at timestamptz`,
+	)
+	m.Add(18,
+		`CREATE TABLE log_drains (
+    log_drain_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+    app_id uuid NOT NULL REFERENCES apps (app_id),
+    url text NOT NULL,
+    username text NOT NULL DEFAULT '',
+    password text NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    deleted_at timestamptz
+)`,
+		`CREATE INDEX ON log_drains (app_id) WHERE deleted_at IS NULL`,
+	)
+	m.Add(19,
+		`ALTER TABLE apps ADD COLUMN quota_max_jobs integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE apps ADD COLUMN quota_max_memory integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE apps ADD COLUMN quota_max_routes integer NOT NULL DEFAULT 0`,
+	)
+	m.Add(20,
+		`CREATE TABLE idempotency_keys (
+    actor text NOT NULL,
+    key text NOT NULL,
+    request_hash text NOT NULL,
+    status integer,
+    content_type text,
+    body bytea,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (actor, key)
+)`,
+		`CREATE INDEX ON idempotency_keys (created_at)`,
+	)
+	m.Add(21,
+		`ALTER TABLE formations ADD COLUMN constraints text`,
+	)
+	m.Add(22,
+		`ALTER TABLE apps ADD COLUMN tombstone text`,
+	)
+	m.Add(23,
+		`ALTER TABLE artifacts ADD COLUMN collected_at timestamptz`,
+		`ALTER TABLE releases ADD COLUMN collected_at timestamptz`,
+	)
+	m.Add(24,
+		`ALTER TABLE apps ADD COLUMN owner_id uuid`,
+		`ALTER TABLE apps ADD COLUMN pending_owner_id uuid`,
+	)
+	m.Add(25,
+		`ALTER TABLE job_cache ADD COLUMN crash_loop boolean NOT NULL DEFAULT false`,
+	)
+	m.Add(26,
+		`ALTER TABLE deployments ADD COLUMN old_processes hstore`,
+	)
+	m.Add(27,
+		`ALTER TABLE deployments ADD COLUMN process_timeouts hstore`,
+	)
+	return m
 }
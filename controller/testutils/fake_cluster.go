@@ -39,7 +39,7 @@ func (c *FakeCluster) GetHost(id string) host.Host {
 	jobs := make([]*host.Job, len(h.Jobs))
 	copy(jobs, h.Jobs)
 
-	return host.Host{ID: h.ID, Jobs: jobs, Metadata: h.Metadata}
+	return host.Host{ID: h.ID, Jobs: jobs, Metadata: h.Metadata, Draining: h.Draining, Resources: h.Resources}
 }
 
 func (c *FakeCluster) DialHost(id string) (cluster.Host, error) {
@@ -58,12 +58,15 @@ func (c *FakeCluster) AddJobs(req *host.AddJobsReq) (*host.AddJobsRes, error) {
 		if !ok {
 			return nil, errors.New("FakeCluster: unknown host")
 		}
+		host.Jobs = append(host.Jobs[:len(host.Jobs):len(host.Jobs)], jobs...)
+		if err := host.CheckResources(); err != nil {
+			return nil, err
+		}
 		if client, ok := c.hostClients[hostID]; ok {
 			for _, job := range jobs {
 				client.SendEvent("start", job.ID)
 			}
 		}
-		host.Jobs = append(host.Jobs, jobs...)
 		c.hosts[hostID] = host
 	}
 	return &host.AddJobsRes{State: c.hosts}, nil
@@ -109,6 +112,17 @@ func (c *FakeCluster) SetHostClient(id string, h *FakeHostClient) {
 	c.hostClients[id] = h
 }
 
+// DrainHost marks the host as draining and sends a "drain" event, like the
+// cluster leader does when a host is drained.
+func (c *FakeCluster) DrainHost(id string) {
+	c.mtx.Lock()
+	h := c.hosts[id]
+	h.Draining = true
+	c.hosts[id] = h
+	c.mtx.Unlock()
+	c.SendEvent(id, "drain")
+}
+
 func (c *FakeCluster) StreamHostEvents(ch chan<- *host.HostEvent) cluster.Stream {
 	c.listenMtx.Lock()
 	defer c.listenMtx.Unlock()
@@ -1,26 +1,42 @@
 package testutils
 
 import (
+	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/flynn/pkg/random"
 )
 
 func NewFakeHostClient(hostID string) *FakeHostClient {
 	return &FakeHostClient{
 		hostID:  hostID,
 		stopped: make(map[string]bool),
+		signals: make(map[string][]int),
 		attach:  make(map[string]attachFunc),
+		exec:    make(map[string]execFunc),
+		jobs:    make(map[string]*host.ActiveJob),
+		volumes: make(map[string]*host.Volume),
+		stats:   make(map[string]*host.JobStats),
 	}
 }
 
 type FakeHostClient struct {
 	hostID    string
 	stopped   map[string]bool
+	signals   map[string][]int
 	attach    map[string]attachFunc
+	exec      map[string]execFunc
+	jobs      map[string]*host.ActiveJob
+	volumes   map[string]*host.Volume
+	stats     map[string]*host.JobStats
+	artifacts []host.Artifact
 	cluster   *FakeCluster
 	listeners []chan<- *host.Event
 	listenMtx sync.RWMutex
@@ -36,7 +52,18 @@ func (c *FakeHostClient) Attach(req *host.AttachReq, wait bool) (cluster.AttachC
 	return f(req, wait)
 }
 
+func (c *FakeHostClient) Exec(jobID string, req *host.ExecReq) (cluster.AttachClient, error) {
+	f, ok := c.exec[jobID]
+	if !ok {
+		return nil, cluster.ErrJobNotFound
+	}
+	return f(req)
+}
+
 func (c *FakeHostClient) GetJob(id string) (*host.ActiveJob, error) {
+	if job, ok := c.jobs[id]; ok {
+		return job, nil
+	}
 	hosts, err := c.cluster.ListHosts()
 	if err != nil {
 		return nil, err
@@ -52,6 +79,11 @@ func (c *FakeHostClient) GetJob(id string) (*host.ActiveJob, error) {
 	return nil, errors.New("job not found")
 }
 
+// SetJob sets the job returned by GetJob for the given ID.
+func (c *FakeHostClient) SetJob(id string, job *host.ActiveJob) {
+	c.jobs[id] = job
+}
+
 func (c *FakeHostClient) StreamEvents(id string, ch chan<- *host.Event) cluster.Stream {
 	c.listenMtx.Lock()
 	defer c.listenMtx.Unlock()
@@ -65,6 +97,140 @@ func (c *FakeHostClient) StopJob(id string) error {
 	return nil
 }
 
+func (c *FakeHostClient) SignalJob(id string, sig int) error {
+	c.signals[id] = append(c.signals[id], sig)
+	return nil
+}
+
+func (c *FakeHostClient) CreateVolume() (*host.Volume, error) {
+	id := random.UUID()
+	v := &host.Volume{ID: id, Type: "dir", Path: "/var/lib/flynn-host/volumes/" + id, CreatedAt: time.Now().UTC()}
+	c.volumes[id] = v
+	return v, nil
+}
+
+func (c *FakeHostClient) ListVolumes() ([]*host.Volume, error) {
+	volumes := make([]*host.Volume, 0, len(c.volumes))
+	for _, v := range c.volumes {
+		volumes = append(volumes, v)
+	}
+	return volumes, nil
+}
+
+func (c *FakeHostClient) DestroyVolume(id string) error {
+	if _, ok := c.volumes[id]; !ok {
+		return cluster.ErrVolumeNotFound
+	}
+	delete(c.volumes, id)
+	return nil
+}
+
+func (c *FakeHostClient) SnapshotVolume(id string) (*host.VolumeSnapshot, error) {
+	v, ok := c.volumes[id]
+	if !ok {
+		return nil, cluster.ErrVolumeNotFound
+	}
+	s := host.VolumeSnapshot{ID: random.UUID(), CreatedAt: time.Now().UTC()}
+	v.Snapshots = append(v.Snapshots, s)
+	return &s, nil
+}
+
+// SendVolume sends the ID of the volume as its data.
+func (c *FakeHostClient) SendVolume(id, snapshotID string) (*cluster.VolumeStream, error) {
+	if _, ok := c.volumes[id]; !ok {
+		return nil, cluster.ErrVolumeNotFound
+	}
+	return &cluster.VolumeStream{ReadCloser: ioutil.NopCloser(strings.NewReader(id)), Type: "dir"}, nil
+}
+
+func (c *FakeHostClient) ReceiveVolume(s *cluster.VolumeStream) (*host.Volume, error) {
+	if _, err := ioutil.ReadAll(s); err != nil {
+		return nil, err
+	}
+	return c.CreateVolume()
+}
+
+// CheckpointJob sends the job as its checkpoint.
+func (c *FakeHostClient) CheckpointJob(id string, leaveRunning bool) (io.ReadCloser, error) {
+	job, ok := c.jobs[id]
+	if !ok {
+		return nil, cluster.ErrJobNotFound
+	}
+	data, err := json.Marshal(job.Job)
+	if err != nil {
+		return nil, err
+	}
+	if !leaveRunning {
+		c.stopped[id] = true
+	}
+	return ioutil.NopCloser(strings.NewReader(string(data))), nil
+}
+
+func (c *FakeHostClient) ReceiveCheckpoint(r io.Reader) (*host.Checkpoint, error) {
+	checkpoint := &host.Checkpoint{ID: random.UUID(), CreatedAt: time.Now().UTC()}
+	if err := json.NewDecoder(r).Decode(&checkpoint.Job); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+func (c *FakeHostClient) JobStats(id string) (*host.JobStats, error) {
+	stats, ok := c.stats[id]
+	if !ok {
+		return nil, cluster.ErrJobNotFound
+	}
+	return stats, nil
+}
+
+func (c *FakeHostClient) StreamJobStats(id string, interval time.Duration, ch chan<- *host.JobStats) (cluster.Stream, error) {
+	stats, err := c.JobStats(id)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		ch <- stats
+		close(ch)
+	}()
+	return fakeStatsStream{}, nil
+}
+
+func (c *FakeHostClient) SetJobStats(id string, stats *host.JobStats) {
+	c.stats[id] = stats
+}
+
+func (c *FakeHostClient) PullArtifact(a host.Artifact) error {
+	c.artifacts = append(c.artifacts, a)
+	return nil
+}
+
+func (c *FakeHostClient) Drain() (*host.DrainStatus, error) {
+	c.cluster.DrainHost(c.hostID)
+	return c.DrainStatus()
+}
+
+func (c *FakeHostClient) DrainStatus() (*host.DrainStatus, error) {
+	h := c.cluster.GetHost(c.hostID)
+	status := &host.DrainStatus{Draining: h.Draining, Jobs: []string{}, VolumeJobs: []string{}}
+	for _, job := range h.Jobs {
+		status.Jobs = append(status.Jobs, job.ID)
+		for _, m := range job.Config.Mounts {
+			if m.VolumeID != "" {
+				status.VolumeJobs = append(status.VolumeJobs, job.ID)
+				break
+			}
+		}
+	}
+	return status, nil
+}
+
+func (c *FakeHostClient) PulledArtifacts() []host.Artifact {
+	return c.artifacts
+}
+
+func (c *FakeHostClient) Signals(id string) []int {
+	return c.signals[id]
+}
+
 func (c *FakeHostClient) IsStopped(id string) bool {
 	return c.stopped[id]
 }
@@ -79,10 +245,18 @@ func (c *FakeHostClient) SetAttachFunc(id string, f attachFunc) {
 	c.attach[id] = f
 }
 
+func (c *FakeHostClient) SetExecFunc(id string, f execFunc) {
+	c.exec[id] = f
+}
+
 func (c *FakeHostClient) SendEvent(event, id string) {
 	c.listenMtx.RLock()
 	defer c.listenMtx.RUnlock()
 	job := &host.ActiveJob{Job: &host.Job{ID: id}}
+	if j, ok := c.jobs[id]; ok {
+		jobCopy := *j
+		job = &jobCopy
+	}
 	if event == "start" {
 		job.StartedAt = time.Now().UTC()
 	}
@@ -94,6 +268,8 @@ func (c *FakeHostClient) SendEvent(event, id string) {
 
 type attachFunc func(req *host.AttachReq, wait bool) (cluster.AttachClient, error)
 
+type execFunc func(req *host.ExecReq) (cluster.AttachClient, error)
+
 type FakeHostEventStream struct {
 	ch chan<- *host.Event
 }
@@ -106,3 +282,8 @@ func (h *FakeHostEventStream) Close() error {
 func (h *FakeHostEventStream) Err() error {
 	return nil
 }
+
+type fakeStatsStream struct{}
+
+func (fakeStatsStream) Close() error { return nil }
+func (fakeStatsStream) Err() error   { return nil }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// checkTokenExists returns a ct.ValidationError for field if there is no
+// auth token with the ID, or it has been revoked.
+func checkTokenExists(db rowQueryer, field, id string) error {
+	if !idPattern.MatchString(id) {
+		return ct.ValidationError{Field: field, Message: "is not an auth token"}
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM auth_tokens WHERE token_id = $1 AND deleted_at IS NULL)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ct.ValidationError{Field: field, Message: "is not an auth token"}
+	}
+	return nil
+}
+
+// updateOwner runs query, which must update the owners of the app with ID
+// $1, and returns the updated app. An event is created for the change.
+func (r *AppRepo) updateOwner(id string, check func(*ct.App) error, query string, args ...interface{}) (*ct.App, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	app, err := selectApp(tx, id, true)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := check(app); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if _, err := tx.Exec(query, append([]interface{}{app.ID}, args...)...); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if app, err = selectApp(tx, app.ID, false); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := createEvent(tx, app.ID, ct.EventTypeApp, app.ID, app); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return app, tx.Commit()
+}
+
+// StartTransfer offers the app to the auth token with the ID to, which owns
+// the app once it accepts. A transfer which has not been accepted is
+// replaced.
+func (r *AppRepo) StartTransfer(id, to string) (*ct.App, error) {
+	return r.updateOwner(id, func(app *ct.App) error {
+		if err := checkTokenExists(r.db, "to", to); err != nil {
+			return err
+		}
+		if app.Owner == cleanUUID(to) {
+			return ct.ValidationError{Field: "to", Message: "already owns the app"}
+		}
+		return nil
+	}, "UPDATE apps SET pending_owner_id = $2, updated_at = now(), version = version + 1 WHERE app_id = $1", to)
+}
+
+// AcceptTransfer makes the pending owner of the app its owner.
+func (r *AppRepo) AcceptTransfer(id string) (*ct.App, error) {
+	return r.updateOwner(id, func(app *ct.App) error {
+		if app.PendingOwner == "" {
+			return ct.ValidationError{Message: "app is not being transferred"}
+		}
+		// the token may have been revoked since the transfer started
+		return checkTokenExists(r.db, "pending_owner", app.PendingOwner)
+	}, "UPDATE apps SET owner_id = pending_owner_id, pending_owner_id = NULL, updated_at = now(), version = version + 1 WHERE app_id = $1")
+}
+
+// CancelTransfer cancels the transfer of the app, ErrNotFound is returned if
+// it is not being transferred.
+func (r *AppRepo) CancelTransfer(id string) (*ct.App, error) {
+	return r.updateOwner(id, func(app *ct.App) error {
+		if app.PendingOwner == "" {
+			return ErrNotFound
+		}
+		return nil
+	}, "UPDATE apps SET pending_owner_id = NULL, updated_at = now(), version = version + 1 WHERE app_id = $1")
+}
+
+// transferAllowed returns whether a token which is not an admin can make the
+// transfer request, which is only allowed for the app's owner, or its
+// pending owner to accept or decline the transfer.
+func (a *authorizer) transferAllowed(t *ct.AuthToken, method string, parts []string) (bool, error) {
+	app, err := selectApp(a.tokens.db, parts[1], false)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	switch {
+	case method == "POST" && len(parts) == 3:
+		return app.Owner == t.ID, nil
+	case method == "POST" && len(parts) == 4 && parts[3] == "accept":
+		return app.PendingOwner == t.ID, nil
+	case method == "DELETE" && len(parts) == 3:
+		return app.Owner == t.ID || app.PendingOwner == t.ID, nil
+	}
+	return false, nil
+}
+
+func startAppTransfer(app *ct.App, transfer ct.AppTransfer, apps *AppRepo, r ResponseHelper) {
+	updated, err := apps.StartTransfer(app.ID, transfer.To)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, updated)
+}
+
+func acceptAppTransfer(app *ct.App, apps *AppRepo, r ResponseHelper) {
+	updated, err := apps.AcceptTransfer(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, updated)
+}
+
+func cancelAppTransfer(app *ct.App, apps *AppRepo, r ResponseHelper) {
+	updated, err := apps.CancelTransfer(app.ID)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, updated)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+func (s *S) TestAppTransfer(c *C) {
+	other := s.createTestApp(c, &ct.App{Name: "transfer-other"})
+	createToken := func(name string, scopes []string, apps []string) *ct.AuthToken {
+		t := &ct.AuthToken{}
+		_, err := s.Post("/auth_tokens", &ct.AuthToken{Name: name, Scopes: scopes, Apps: apps}, t)
+		c.Assert(err, IsNil)
+		return t
+	}
+	admin := createToken("transfer-admin", []string{ct.TokenScopeAdmin}, nil)
+	alice := createToken("transfer-alice", []string{ct.TokenScopeDeploy}, []string{other.ID})
+	bob := createToken("transfer-bob", []string{ct.TokenScopeDeploy}, []string{other.ID})
+
+	// apps created with a token are owned by it
+	data, err := json.Marshal(&ct.App{Name: "transfer-created"})
+	c.Assert(err, IsNil)
+	req, err := http.NewRequest("POST", s.srv.URL+"/apps", bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("", admin.Token)
+	res, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	created := &ct.App{}
+	c.Assert(json.NewDecoder(res.Body).Decode(created), IsNil)
+	res.Body.Close()
+	c.Assert(created.Owner, Equals, admin.ID)
+
+	res, _ = s.Post("/apps", &ct.App{Name: "transfer-bad", Owner: random.UUID()}, &ct.App{})
+	c.Assert(res.StatusCode, Equals, 400)
+	app := s.createTestApp(c, &ct.App{Name: "transfer", Owner: alice.ID})
+	c.Assert(app.Owner, Equals, alice.ID)
+
+	// owners can use the app even if it is not one of their token's apps
+	c.Assert(s.tokenStatus(c, alice.Token, "GET", "/apps/"+app.ID, nil), Equals, 200)
+	c.Assert(s.tokenStatus(c, bob.Token, "GET", "/apps/"+app.ID, nil), Equals, 403)
+
+	// only the owner can start a transfer, and only to a token
+	c.Assert(s.tokenStatus(c, bob.Token, "POST", "/apps/"+app.ID+"/transfer", &ct.AppTransfer{To: bob.ID}), Equals, 403)
+	c.Assert(s.tokenStatus(c, alice.Token, "POST", "/apps/"+app.ID+"/transfer", &ct.AppTransfer{To: random.UUID()}), Equals, 400)
+	c.Assert(s.tokenStatus(c, alice.Token, "POST", "/apps/"+app.ID+"/transfer", &ct.AppTransfer{To: alice.ID}), Equals, 400)
+	c.Assert(s.tokenStatus(c, alice.Token, "POST", "/apps/"+app.ID+"/transfer/accept", nil), Equals, 403)
+
+	// the pending owner can decline the transfer
+	c.Assert(s.tokenStatus(c, alice.Token, "POST", "/apps/"+app.ID+"/transfer", &ct.AppTransfer{To: bob.ID}), Equals, 200)
+	gotApp := &ct.App{}
+	_, err = s.Get("/apps/"+app.ID, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Owner, Equals, alice.ID)
+	c.Assert(gotApp.PendingOwner, Equals, bob.ID)
+	c.Assert(s.tokenStatus(c, bob.Token, "DELETE", "/apps/"+app.ID+"/transfer", nil), Equals, 200)
+	c.Assert(s.tokenStatus(c, bob.Token, "DELETE", "/apps/"+app.ID+"/transfer", nil), Equals, 403)
+	res, err = s.Delete("/apps/" + app.ID + "/transfer")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 404)
+
+	c.Assert(s.tokenStatus(c, alice.Token, "POST", "/apps/"+app.ID+"/transfer", &ct.AppTransfer{To: bob.ID}), Equals, 200)
+	c.Assert(s.tokenStatus(c, bob.Token, "POST", "/apps/"+app.ID+"/transfer/accept", nil), Equals, 200)
+	gotApp = &ct.App{}
+	_, err = s.Get("/apps/"+app.ID, gotApp)
+	c.Assert(err, IsNil)
+	c.Assert(gotApp.Owner, Equals, bob.ID)
+	c.Assert(gotApp.PendingOwner, Equals, "")
+	c.Assert(s.tokenStatus(c, alice.Token, "GET", "/apps/"+app.ID, nil), Equals, 403)
+	c.Assert(s.tokenStatus(c, bob.Token, "GET", "/apps/"+app.ID, nil), Equals, 200)
+
+	res, _ = s.Post("/apps/"+app.ID+"/transfer/accept", nil, &ct.App{})
+	c.Assert(res.StatusCode, Equals, 400)
+}
@@ -0,0 +1,113 @@
+package types
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// LabelKeyPattern matches valid label keys, for example "team" or
+	// "flynn.io/env".
+	LabelKeyPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9._/-]{0,61}[a-z0-9])?$`)
+
+	// LabelValuePattern matches valid label values, which may be empty.
+	LabelValuePattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9._-]{0,61}[A-Za-z0-9])?)?$`)
+)
+
+// Label selector operators.
+const (
+	LabelOpEquals    = "="
+	LabelOpNotEquals = "!="
+	LabelOpExists    = "exists"
+	LabelOpNotExists = "!exists"
+)
+
+// LabelRequirement is a single condition of a LabelSelector.
+type LabelRequirement struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+// Matches reports whether labels satisfy the requirement.
+func (r LabelRequirement) Matches(labels map[string]string) bool {
+	v, ok := labels[r.Key]
+	switch r.Op {
+	case LabelOpEquals:
+		return ok && v == r.Value
+	case LabelOpNotEquals:
+		return !ok || v != r.Value
+	case LabelOpExists:
+		return ok
+	case LabelOpNotExists:
+		return !ok
+	}
+	return false
+}
+
+func (r LabelRequirement) String() string {
+	switch r.Op {
+	case LabelOpExists:
+		return r.Key
+	case LabelOpNotExists:
+		return "!" + r.Key
+	}
+	return r.Key + r.Op + r.Value
+}
+
+// LabelSelector selects objects whose labels satisfy all of its
+// requirements, an empty selector matches everything.
+type LabelSelector []LabelRequirement
+
+// ParseLabelSelector parses a comma separated list of requirements, each of
+// which is one of "key=value", "key!=value", "key" (the label is set) or
+// "!key" (the label is not set).
+func ParseLabelSelector(s string) (LabelSelector, error) {
+	var sel LabelSelector
+	if strings.TrimSpace(s) == "" {
+		return sel, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		var r LabelRequirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			r = LabelRequirement{Key: kv[0], Op: LabelOpNotEquals, Value: kv[1]}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			r = LabelRequirement{Key: kv[0], Op: LabelOpEquals, Value: kv[1]}
+		case strings.HasPrefix(part, "!"):
+			r = LabelRequirement{Key: part[1:], Op: LabelOpNotExists}
+		default:
+			r = LabelRequirement{Key: part, Op: LabelOpExists}
+		}
+		if !LabelKeyPattern.MatchString(r.Key) {
+			return nil, fmt.Errorf("invalid label key %q in selector", r.Key)
+		}
+		if !LabelValuePattern.MatchString(r.Value) {
+			return nil, fmt.Errorf("invalid label value %q in selector", r.Value)
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// Matches reports whether labels satisfy every requirement of the selector.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s LabelSelector) String() string {
+	parts := make([]string, len(s))
+	for i, r := range s {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
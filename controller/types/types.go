@@ -1,17 +1,29 @@
 package types
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 	"time"
 )
 
 type ExpandedFormation struct {
-	App       *App           `json:"app,omitempty"`
-	Release   *Release       `json:"release,omitempty"`
-	Artifact  *Artifact      `json:"artifact,omitempty"`
-	Processes map[string]int `json:"processes,omitempty"`
-	UpdatedAt time.Time      `json:"updated_at,omitempty"`
+	App       *App                      `json:"app,omitempty"`
+	Release   *Release                  `json:"release,omitempty"`
+	Artifact  *Artifact                 `json:"artifact,omitempty"`
+	Artifacts []*Artifact               `json:"artifacts,omitempty"`
+	Processes map[string]int            `json:"processes,omitempty"`
+	Limits    map[string]ResourceLimits `json:"limits,omitempty"`
+	AppEnv    map[string]string         `json:"app_env,omitempty"`
+	LogDrains []*LogDrain               `json:"log_drains,omitempty"`
+	UpdatedAt time.Time                 `json:"updated_at,omitempty"`
+
+	Constraints map[string]PlacementConstraints `json:"constraints,omitempty"`
 }
 
 type App struct {
@@ -19,37 +31,604 @@ type App struct {
 	Name      string            `json:"name,omitempty"`
 	Protected bool              `json:"protected"`
 	Meta      map[string]string `json:"meta,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
 	CreatedAt *time.Time        `json:"created_at,omitempty"`
 	UpdatedAt *time.Time        `json:"updated_at,omitempty"`
+
+	// Version is incremented each time the app is modified. Updates which
+	// include a version fail with a conflict if the app has since been
+	// modified.
+	Version int64 `json:"version,omitempty"`
+
+	// Maintenance is set while the app is in maintenance mode, during which
+	// the router answers requests to its HTTP routes with a 503 maintenance
+	// page. MaintenanceStartedAt and MaintenanceEndedAt record when
+	// maintenance mode was last turned on and off.
+	Maintenance          bool       `json:"maintenance"`
+	MaintenanceStartedAt *time.Time `json:"maintenance_started_at,omitempty"`
+	MaintenanceEndedAt   *time.Time `json:"maintenance_ended_at,omitempty"`
+
+	// Owner is the ID of the auth token which owns the app, tokens limited
+	// to some apps can also access the apps they own. PendingOwner is the
+	// token the app is being transferred to, which becomes the owner once
+	// it accepts the transfer.
+	Owner        string `json:"owner,omitempty"`
+	PendingOwner string `json:"pending_owner,omitempty"`
+
+	// ETag is the entity tag of the app when it was retrieved, it is used by
+	// the client to detect concurrent modifications.
+	ETag string `json:"-"`
+}
+
+// AppTransfer starts the transfer of an app to the auth token with ID To.
+type AppTransfer struct {
+	To string `json:"to"`
+}
+
+// AppQuota limits the resources an app can use, zero values are unlimited.
+// Quotas are checked when formations and routes are created, so an app which
+// is already over a lowered quota keeps running but can only scale down.
+type AppQuota struct {
+	// MaxJobs is the maximum number of jobs of all the app's formations.
+	MaxJobs int `json:"max_jobs,omitempty"`
+
+	// MaxMemory is the maximum memory in MiB of all the app's formations,
+	// which is the memory limit of each process type multiplied by its
+	// count. Process types must have a memory limit if it is set.
+	MaxMemory int `json:"max_memory,omitempty"`
+
+	// MaxRoutes is the maximum number of routes of the app.
+	MaxRoutes int `json:"max_routes,omitempty"`
+}
+
+// Quota names, which are also the fields of AppQuota.
+const (
+	QuotaJobs   = "max_jobs"
+	QuotaMemory = "max_memory"
+	QuotaRoutes = "max_routes"
+)
+
+// QuotaError is returned when a request would take an app over one of its
+// quotas.
+type QuotaError struct {
+	Quota   string `json:"quota"`
+	Limit   int    `json:"limit"`
+	Message string `json:"message"`
+}
+
+func (e QuotaError) Error() string {
+	return e.Message
+}
+
+// ExportedApp is an app in a cluster export, along with its current
+// release, environment and quota which are not part of App.
+type ExportedApp struct {
+	*App
+	ReleaseID string            `json:"release,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Quota     *AppQuota         `json:"quota,omitempty"`
+}
+
+// Conflict policies for imports, which decide what happens to imported
+// objects with the ID of an existing object.
+const (
+	ImportConflictSkip      = "skip"
+	ImportConflictOverwrite = "overwrite"
+)
+
+// ImportResult is the number of objects of each type in an import which
+// were created, overwritten or skipped, keyed by the name of their file in
+// the archive without the extension (for example "apps").
+type ImportResult struct {
+	Created map[string]int `json:"created"`
+	Updated map[string]int `json:"updated"`
+	Skipped map[string]int `json:"skipped"`
+}
+
+// AppEnv is the environment of an app, it is merged over the environment of
+// the app's release when jobs are started so that it can be changed without
+// creating a release.
+type AppEnv struct {
+	Env map[string]string `json:"env"`
+
+	// ReleaseID is the release created by an EnvUpdate with NewRelease set.
+	ReleaseID string `json:"release,omitempty"`
+}
+
+// EnvUpdate sets and unsets variables of an app's environment.
+type EnvUpdate struct {
+	Set   map[string]string `json:"set,omitempty"`
+	Unset []string          `json:"unset,omitempty"`
+
+	// NewRelease creates a copy of the app's current release and makes it
+	// current, which restarts the app's jobs with the new environment.
+	// Otherwise only jobs started after the update use it.
+	NewRelease bool `json:"new_release,omitempty"`
 }
 
+// Release is a version of an app's code and configuration. ArtifactIDs lists
+// all the artifacts of the release and always starts with ArtifactID, the
+// image which process types run in unless they select other artifacts.
 type Release struct {
-	ID         string                 `json:"id,omitempty"`
-	ArtifactID string                 `json:"artifact,omitempty"`
-	Env        map[string]string      `json:"env,omitempty"`
-	Processes  map[string]ProcessType `json:"processes,omitempty"`
-	CreatedAt  *time.Time             `json:"created_at,omitempty"`
+	ID          string                 `json:"id,omitempty"`
+	ArtifactID  string                 `json:"artifact,omitempty"`
+	ArtifactIDs []string               `json:"artifacts,omitempty"`
+	Env         map[string]string      `json:"env,omitempty"`
+	Processes   map[string]ProcessType `json:"processes,omitempty"`
+	Meta        map[string]string      `json:"meta,omitempty"`
+	CreatedAt   *time.Time             `json:"created_at,omitempty"`
+
+	// Version is always 1 as releases cannot be modified, it is included so
+	// that clients can treat apps, releases and resources alike.
+	Version int64 `json:"version,omitempty"`
+}
+
+// Release diff operations.
+const (
+	DiffAdded   = "added"
+	DiffRemoved = "removed"
+	DiffChanged = "changed"
+)
+
+// ReleaseDiff lists the differences between two releases.
+type ReleaseDiff struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// ArtifactsChanged is set if the releases run different artifacts.
+	ArtifactsChanged bool             `json:"artifacts_changed"`
+	Env              []*EnvChange     `json:"env"`
+	Processes        []*ProcessChange `json:"processes"`
+}
+
+// EnvChange is a release env variable which was added, removed or changed.
+// The values are left out if the diff is redacted.
+type EnvChange struct {
+	Key      string `json:"key"`
+	Op       string `json:"op"`
+	OldValue string `json:"old_value,omitempty"`
+	NewValue string `json:"new_value,omitempty"`
+}
+
+// ProcessChange is a process type which was added, removed or changed.
+// Fields are the JSON names of the fields of a changed process type which
+// differ.
+type ProcessChange struct {
+	Type   string   `json:"type"`
+	Op     string   `json:"op"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+// DiffReleases returns the differences between from and to, leaving out env
+// values if redact is set.
+func DiffReleases(from, to *Release, redact bool) *ReleaseDiff {
+	d := &ReleaseDiff{
+		From:             from.ID,
+		To:               to.ID,
+		ArtifactsChanged: !reflect.DeepEqual(releaseArtifacts(from), releaseArtifacts(to)),
+		Env:              []*EnvChange{},
+		Processes:        []*ProcessChange{},
+	}
+	for _, k := range unionKeys(from.Env, to.Env) {
+		oldValue, inFrom := from.Env[k]
+		newValue, inTo := to.Env[k]
+		c := &EnvChange{Key: k}
+		switch {
+		case !inFrom:
+			c.Op = DiffAdded
+		case !inTo:
+			c.Op = DiffRemoved
+		case oldValue != newValue:
+			c.Op = DiffChanged
+		default:
+			continue
+		}
+		if !redact {
+			c.OldValue, c.NewValue = oldValue, newValue
+		}
+		d.Env = append(d.Env, c)
+	}
+
+	names := make(map[string]string, len(from.Processes)+len(to.Processes))
+	for t := range from.Processes {
+		names[t] = ""
+	}
+	for t := range to.Processes {
+		names[t] = ""
+	}
+	for _, t := range unionKeys(names, nil) {
+		oldProc, inFrom := from.Processes[t]
+		newProc, inTo := to.Processes[t]
+		c := &ProcessChange{Type: t}
+		switch {
+		case !inFrom:
+			c.Op = DiffAdded
+		case !inTo:
+			c.Op = DiffRemoved
+		default:
+			c.Fields = changedFields(oldProc, newProc)
+			if len(c.Fields) == 0 {
+				continue
+			}
+			c.Op = DiffChanged
+		}
+		d.Processes = append(d.Processes, c)
+	}
+	return d
+}
+
+func releaseArtifacts(r *Release) []string {
+	if len(r.ArtifactIDs) > 0 {
+		return r.ArtifactIDs
+	}
+	if r.ArtifactID != "" {
+		return []string{r.ArtifactID}
+	}
+	return nil
+}
+
+// unionKeys returns the keys of a and b, sorted.
+func unionKeys(a, b map[string]string) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
 }
 
+// changedFields returns the JSON names of the fields of the process types
+// which differ, with the resource limits compared as one field.
+func changedFields(a, b ProcessType) []string {
+	var fields []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			continue
+		}
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous {
+			name = "limits"
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// Release meta keys recording the provenance of a release, any other keys in
+// Release.Meta are free-form annotations.
+const (
+	ReleaseMetaGitCommit = "git.commit"
+	ReleaseMetaGitRef    = "git.ref"
+	ReleaseMetaBuilder   = "build.builder"
+	ReleaseMetaBuildTime = "build.time"
+	ReleaseMetaBuildUser = "build.user"
+
+	// ReleaseMetaPromotedFrom and ReleaseMetaPromotedRelease record the
+	// app and release that a promoted release was copied from.
+	ReleaseMetaPromotedFrom    = "promote.app"
+	ReleaseMetaPromotedRelease = "promote.release"
+)
+
 type ProcessType struct {
+	ResourceLimits
+
 	Cmd        []string          `json:"cmd,omitempty"`
 	Entrypoint []string          `json:"entrypoint,omitempty"`
 	Env        map[string]string `json:"env,omitempty"`
 	Ports      []Port            `json:"ports,omitempty"`
 	Data       bool              `json:"data,omitempty"`
 	Omni       bool              `json:"omni,omitempty"` // omnipresent - present on all hosts
+
+	// Artifacts selects the release artifacts the process type runs with,
+	// all of them if it is empty. The first is the image the process runs
+	// in and the others are mounted read-only at /artifacts/1,
+	// /artifacts/2 and so on.
+	Artifacts []string `json:"artifacts,omitempty"`
+
+	// HealthCheck is run against each job of the process type by its host,
+	// jobs are not considered up or routed to until the check passes.
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+
+	// RestartPolicy decides whether jobs of the process type which stop
+	// are restarted, they always are if it is not set.
+	RestartPolicy *RestartPolicy `json:"restart_policy,omitempty"`
+
+	// StopSignal is the name of the signal sent to jobs of the process type
+	// to stop them, one of StopSignals, SIGTERM if it is not set. Jobs
+	// which have not exited KillTimeout seconds later (10 if it is not
+	// set) are killed, so they should finish their work before then.
+	StopSignal  string `json:"stop_signal,omitempty"`
+	KillTimeout int    `json:"kill_timeout,omitempty"`
+
+	// Secrets are written by the host to read-only files in /run/secrets,
+	// keyed by file name, rather than being set in the jobs' environment
+	// where child processes inherit them.
+	Secrets map[string]string `json:"secrets,omitempty"`
+
+	// LogDriver selects where hosts write the output of jobs of the process
+	// type, the output is only kept for "flynn log" and log drains if it
+	// is not set or is logbuf.
+	LogDriver *LogDriver `json:"log_driver,omitempty"`
+
+	// RegistryAuth are the credentials hosts pull the process type's
+	// docker images with, it only needs to be set for images in private
+	// registries which the hosts aren't configured with credentials for.
+	RegistryAuth *RegistryAuth `json:"registry_auth,omitempty"`
+
+	// DNS configures name resolution in the process type's jobs, which
+	// use their host's resolv.conf if it is not set.
+	DNS *DNSConfig `json:"dns,omitempty"`
+
+	// Devices are claimed by each job of the process type for its
+	// exclusive use, jobs are only placed on hosts with enough devices of
+	// the requested classes.
+	Devices []DeviceRequest `json:"devices,omitempty"`
+
+	// Security selects the seccomp and AppArmor profiles the process
+	// type's jobs are confined by, they are unconfined if it is not set.
+	Security *SecurityProfiles `json:"security,omitempty"`
+
+	// ReadOnlyRoot mounts the root filesystem of the process type's jobs
+	// read-only, they can only write to their /data volume and Tmpfs.
+	ReadOnlyRoot bool `json:"read_only_root,omitempty"`
+
+	// Tmpfs are in-memory filesystems mounted in each job of the process
+	// type, which count towards its memory limit.
+	Tmpfs []TmpfsMount `json:"tmpfs,omitempty"`
+}
+
+// TmpfsMount is an in-memory filesystem mounted at Location, Size is its
+// maximum size in MiB.
+type TmpfsMount struct {
+	Location string `json:"location"`
+	Size     int    `json:"size,omitempty"`
+}
+
+// SecurityProfiles name a seccomp and an AppArmor profile, "default" for the
+// hosts' default profiles, "unconfined" or a custom profile shipped to hosts.
+type SecurityProfiles struct {
+	Seccomp  string `json:"seccomp,omitempty"`
+	AppArmor string `json:"apparmor,omitempty"`
+}
+
+// DeviceRequest claims Count of a host's devices of Class, such as "gpu".
+type DeviceRequest struct {
+	Class string `json:"class"`
+	Count int    `json:"count"`
+}
+
+// LogDriver is one of the host's log drivers, logbuf, journald, null or
+// remote, which sends each line to URL like a log drain.
+type LogDriver struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+// DNSConfig replaces the nameservers and search domains of a job's
+// resolv.conf, and maps extra hostnames to IP addresses in its /etc/hosts.
+type DNSConfig struct {
+	Servers []string          `json:"servers,omitempty"`
+	Search  []string          `json:"search,omitempty"`
+	Hosts   map[string]string `json:"hosts,omitempty"`
+}
+
+// RegistryAuth are the credentials for a private docker registry, the
+// password is exchanged for a token at TokenURL if it is set.
+type RegistryAuth struct {
+	Registry string `json:"registry,omitempty"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	TokenURL string `json:"token_url,omitempty"`
+}
+
+// StopSignals are the signals which jobs can be stopped with.
+var StopSignals = map[string]int{
+	"SIGHUP":  1,
+	"SIGINT":  2,
+	"SIGQUIT": 3,
+	"SIGUSR1": 10,
+	"SIGUSR2": 12,
+	"SIGTERM": 15,
+}
+
+// Restart policies of process types.
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+type RestartPolicy struct {
+	// Name is RestartAlways, RestartOnFailure or RestartNever.
+	Name string `json:"name"`
+
+	// MaxRetries is how many times a job which fails is restarted with
+	// RestartOnFailure, zero is unlimited.
+	MaxRetries int `json:"max_retries,omitempty"`
+}
+
+// ShouldRestart returns whether a job which stopped, after failing if failed
+// is set, is restarted. retries is the number of times the job has already
+// been restarted after failing.
+func (p *RestartPolicy) ShouldRestart(failed bool, retries int) bool {
+	if p == nil {
+		return true
+	}
+	switch p.Name {
+	case RestartNever:
+		return false
+	case RestartOnFailure:
+		return failed && (p.MaxRetries == 0 || retries < p.MaxRetries)
+	}
+	return true
+}
+
+// Health check types.
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+)
+
+// HealthCheck checks that a job is ready to serve requests on its first
+// port, either by connecting to it or by making an HTTP request.
+type HealthCheck struct {
+	// Type is HealthCheckTCP or HealthCheckHTTP.
+	Type string `json:"type"`
+
+	// Path is the path requested by HTTP checks, which pass if the
+	// response status is 2xx or 3xx. It defaults to /.
+	Path string `json:"path,omitempty"`
+
+	// Interval is the number of seconds between checks.
+	Interval int `json:"interval,omitempty"`
+
+	// GracePeriod is the number of seconds to wait after the job starts
+	// before running the first check.
+	GracePeriod int `json:"grace_period,omitempty"`
+
+	// Failures is the number of checks in a row which must fail before
+	// the job is unhealthy, it defaults to 3.
+	Failures int `json:"failures,omitempty"`
+
+	// RestartAfter, if set, is the number of checks in a row which can
+	// fail before the job is stopped and restarted.
+	RestartAfter int `json:"restart_after,omitempty"`
+}
+
+// ResourceLimits limits the resources used by each job of a process type,
+// the host's defaults are used for limits which are zero.
+type ResourceLimits struct {
+	// Memory is the maximum memory of a job in MiB.
+	Memory int `json:"memory,omitempty"`
+
+	// CPU is the job's share of CPU time relative to other jobs on the
+	// same host, in cgroup CPU shares. Jobs without a limit have 1024
+	// shares.
+	CPU int `json:"cpu,omitempty"`
+
+	// MaxFD is the maximum number of files a job may have open.
+	MaxFD int `json:"max_fd,omitempty"`
+
+	// MaxProcs is the maximum number of processes the job's user may
+	// have, and MaxCore the maximum size in MiB of the core dumps of its
+	// processes.
+	MaxProcs int `json:"max_procs,omitempty"`
+	MaxCore  int `json:"max_core,omitempty"`
+
+	// Disk is the maximum size in MiB of the files a job writes to its
+	// container's filesystem, writes beyond it fail with EDQUOT. Volumes
+	// and mounts are not included.
+	Disk int `json:"disk,omitempty"`
+
+	// NetworkEgress and NetworkIngress limit the bandwidth a job sends and
+	// receives in Mbit/s, so that bulk transfers can't starve the other
+	// jobs on the same host.
+	NetworkEgress  int `json:"network_egress,omitempty"`
+	NetworkIngress int `json:"network_ingress,omitempty"`
+}
+
+// Merge returns the limits with the non-zero limits of o applied on top.
+func (l ResourceLimits) Merge(o ResourceLimits) ResourceLimits {
+	if o.Memory != 0 {
+		l.Memory = o.Memory
+	}
+	if o.CPU != 0 {
+		l.CPU = o.CPU
+	}
+	if o.MaxFD != 0 {
+		l.MaxFD = o.MaxFD
+	}
+	if o.MaxProcs != 0 {
+		l.MaxProcs = o.MaxProcs
+	}
+	if o.MaxCore != 0 {
+		l.MaxCore = o.MaxCore
+	}
+	if o.Disk != 0 {
+		l.Disk = o.Disk
+	}
+	if o.NetworkEgress != 0 {
+		l.NetworkEgress = o.NetworkEgress
+	}
+	if o.NetworkIngress != 0 {
+		l.NetworkIngress = o.NetworkIngress
+	}
+	return l
+}
+
+// HostVolumesMetadata is the host metadata key listing the volumes a host
+// provides, as a comma separated list of names (e.g. flynn-host daemon
+// --meta volumes=ssd,backups).
+const HostVolumesMetadata = "volumes"
+
+// PlacementConstraints restrict the hosts the scheduler runs the jobs of a
+// process type on.
+type PlacementConstraints struct {
+	// HostTags are host metadata values which hosts must have, for
+	// example {"disk": "ssd"}.
+	HostTags map[string]string `json:"host_tags,omitempty"`
+
+	// SpreadBy is a host metadata key, such as a zone or rack, and jobs are
+	// spread evenly across its values so that a failure of hosts sharing a
+	// value affects as few jobs as possible. It is a hint, jobs are still
+	// started if only hosts with one value are available.
+	SpreadBy string `json:"spread_by,omitempty"`
+
+	// Volumes are the names of volumes, listed in the HostVolumesMetadata
+	// metadata of hosts, which hosts must provide.
+	Volumes []string `json:"volumes,omitempty"`
+}
+
+// Matches reports whether a host with the given metadata satisfies the
+// constraints' host tags and volumes.
+func (c PlacementConstraints) Matches(metadata map[string]string) bool {
+	for k, v := range c.HostTags {
+		if metadata[k] != v {
+			return false
+		}
+	}
+	if len(c.Volumes) == 0 {
+		return true
+	}
+	volumes := make(map[string]struct{})
+	for _, v := range strings.Split(metadata[HostVolumesMetadata], ",") {
+		volumes[strings.TrimSpace(v)] = struct{}{}
+	}
+	for _, v := range c.Volumes {
+		if _, ok := volumes[v]; !ok {
+			return false
+		}
+	}
+	return true
 }
 
 type Port struct {
 	Port     int    `json:"port"`
 	Proto    string `json:"proto"`
 	RangeEnd int    `json:"range_end"`
+
+	// HostPort, if set, is the port on the host forwarded to Port, which
+	// defaults to the same port. It can't be set for ranges of ports.
+	HostPort int `json:"host_port,omitempty"`
 }
 
+// Artifact is an image which releases are run from. Size and SHA256 are the
+// size in bytes and hex encoded SHA-256 checksum of the image, for docker
+// images the checksum is the image ID. Hosts refuse to run jobs if the image
+// they pull does not match the checksum.
 type Artifact struct {
 	ID        string     `json:"id,omitempty"`
 	Type      string     `json:"type,omitempty"`
 	URI       string     `json:"uri,omitempty"`
+	Size      int64      `json:"size,omitempty"`
+	SHA256    string     `json:"sha256,omitempty"`
 	CreatedAt *time.Time `json:"created_at,omitempty"`
 }
 
@@ -57,8 +636,58 @@ type Formation struct {
 	AppID     string         `json:"app,omitempty"`
 	ReleaseID string         `json:"release,omitempty"`
 	Processes map[string]int `json:"processes,omitempty"`
-	CreatedAt *time.Time     `json:"created_at,omitempty"`
-	UpdatedAt *time.Time     `json:"updated_at,omitempty"`
+
+	// Limits overrides the resource limits of the release's process types
+	// for this formation.
+	Limits map[string]ResourceLimits `json:"limits,omitempty"`
+
+	// Constraints restricts the hosts the jobs of each process type are
+	// run on.
+	Constraints map[string]PlacementConstraints `json:"constraints,omitempty"`
+
+	// StateHash is a hash of the formation's process counts and limits.
+	// When set in an update it is the hash of the state the update was
+	// based on, and the update fails with a conflict if the formation has
+	// been scaled since.
+	StateHash string `json:"state_hash,omitempty"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	ETag      string     `json:"-"`
+}
+
+// FormationScale sets the counts of some of the process types of the
+// formation of the app (by ID or name) and release. The counts of other
+// process types, limits and constraints are left unchanged.
+type FormationScale struct {
+	AppID     string         `json:"app"`
+	ReleaseID string         `json:"release"`
+	Processes map[string]int `json:"processes"`
+}
+
+// FormationBatch is a set of formation updates which are applied together,
+// either all of them succeed or none are applied. Each app can appear once.
+type FormationBatch struct {
+	Formations []*FormationScale `json:"formations"`
+}
+
+// FormationStateHash returns the StateHash of a formation with the given
+// process counts and limits. Process types scaled to zero are ignored, so a
+// formation which does not exist has the hash of an empty formation.
+func FormationStateHash(processes map[string]int, limits map[string]ResourceLimits) string {
+	state := struct {
+		Processes map[string]int            `json:"processes,omitempty"`
+		Limits    map[string]ResourceLimits `json:"limits,omitempty"`
+	}{Processes: make(map[string]int, len(processes)), Limits: limits}
+	for typ, n := range processes {
+		if n > 0 {
+			state.Processes[typ] = n
+		}
+	}
+	// maps are encoded with sorted keys so the encoding is stable
+	data, _ := json.Marshal(state)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
 type Key struct {
@@ -77,8 +706,333 @@ type Job struct {
 	Cmd       []string   `json:"cmd,omitempty"`
 	CreatedAt *time.Time `json:"created_at,omitempty"`
 	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+
+	// CrashLoop is set by the scheduler on jobs which stopped shortly after
+	// it restarted them, the next job of the process type is started after
+	// a backoff which grows with each restart.
+	CrashLoop bool `json:"crash_loop,omitempty"`
+}
+
+// JobDetail is a job as recorded by the controller combined with its state
+// on the host running it.
+type JobDetail struct {
+	Job
+
+	HostID string `json:"host_id"`
+
+	// Restarts is the number of jobs of the same release and process type
+	// which crashed before this job was created, which is how many times
+	// the scheduler has had to restart the process.
+	Restarts int `json:"restarts"`
+
+	// The following fields are retrieved from the host, HostError is set
+	// if the host could not be queried.
+	HostStatus string     `json:"host_status,omitempty"`
+	ExitStatus *int       `json:"exit_status,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	EndedAt    *time.Time `json:"ended_at,omitempty"`
+	HostError  string     `json:"host_error,omitempty"`
+}
+
+// ProcessStatus compares the number of jobs of a process type the app's
+// formations ask for with the jobs running on hosts.
+type ProcessStatus struct {
+	Type string `json:"type"`
+	// Desired is the sum of the process type's counts in the app's
+	// formations.
+	Desired int `json:"desired"`
+	// Running is the number of jobs of the process type on hosts.
+	Running int `json:"running"`
+	// Pending is the number of jobs which are starting.
+	Pending int `json:"pending"`
+	// Crashed is the number of jobs which crashed recently.
+	Crashed int `json:"crashed"`
+}
+
+// Converged returns whether the desired number of jobs are running, with
+// none starting.
+func (p *ProcessStatus) Converged() bool {
+	return p.Running == p.Desired && p.Pending == 0
+}
+
+// AutoscaleMetricRequests is the rate of HTTP requests routed to a process
+// type, in requests per second per job.
+const AutoscaleMetricRequests = "requests_per_job"
+
+// AutoscalePolicy scales a process type of an app's current release between
+// Min and Max jobs, aiming to keep the value of Metric at Target.
+type AutoscalePolicy struct {
+	AppID       string     `json:"app,omitempty"`
+	ProcessType string     `json:"process_type,omitempty"`
+	Min         int        `json:"min"`
+	Max         int        `json:"max"`
+	Metric      string     `json:"metric,omitempty"`
+	Target      float64    `json:"target"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+}
+
+// Cron job concurrency policies, which control what happens when a cron job
+// is due while the job started by its previous run is still running.
+const (
+	// CronConcurrencyAllow starts a new job regardless.
+	CronConcurrencyAllow = "allow"
+
+	// CronConcurrencyForbid skips the run.
+	CronConcurrencyForbid = "forbid"
+
+	// CronConcurrencyReplace stops the running job before starting a new
+	// one.
+	CronConcurrencyReplace = "replace"
+)
+
+// CronJob runs a one-off job of an app's current release on a schedule.
+// Either ProcessType or Cmd must be set, if both are set Cmd overrides the
+// command of the process type.
+type CronJob struct {
+	ID                string     `json:"id,omitempty"`
+	AppID             string     `json:"app,omitempty"`
+	Schedule          string     `json:"schedule,omitempty"`
+	ProcessType       string     `json:"process_type,omitempty"`
+	Cmd               []string   `json:"cmd,omitempty"`
+	ConcurrencyPolicy string     `json:"concurrency_policy,omitempty"`
+	LastScheduledAt   *time.Time `json:"last_scheduled_at,omitempty"`
+	CreatedAt         *time.Time `json:"created_at,omitempty"`
+}
+
+// LogDrain is a destination which the hosts running an app's jobs forward
+// their output to. URL is a syslog://, syslog+tls:// or https:// URL, the
+// Username and Password are only used by https drains, which are sent them
+// with basic auth.
+type LogDrain struct {
+	ID        string     `json:"id,omitempty"`
+	AppID     string     `json:"app,omitempty"`
+	URL       string     `json:"url,omitempty"`
+	Username  string     `json:"username,omitempty"`
+	Password  string     `json:"password,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// Cron job run statuses.
+const (
+	CronRunPending = "pending"
+	CronRunStarted = "started"
+	CronRunSkipped = "skipped"
+	CronRunFailed  = "failed"
+)
+
+// CronJobRun records a time a cron job was due and the job started for it.
+type CronJobRun struct {
+	ID          int64      `json:"id"`
+	CronJobID   string     `json:"cron_job"`
+	ScheduledAt *time.Time `json:"scheduled_at"`
+	JobID       string     `json:"job,omitempty"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
 }
 
+const (
+	EventTypeApp         = "app"
+	EventTypeAppDeletion = "app_deletion"
+	EventTypeAppRelease  = "app_release"
+	EventTypeRelease     = "release"
+	EventTypeJob         = "job"
+	EventTypeFormation   = "formation"
+	EventTypeDeployment  = "deployment"
+
+	// Events for the objects of an app which are removed when the app is
+	// deleted.
+	EventTypeRouteDeletion    = "route_deletion"
+	EventTypeResourceDeletion = "resource_deletion"
+	EventTypeCronJobDeletion  = "cron_job_deletion"
+)
+
+// AppReleaseEvent is the data of an app_release event, which is created when
+// the current release of an app changes.
+type AppReleaseEvent struct {
+	PrevReleaseID string `json:"prev_release,omitempty"`
+	ReleaseID     string `json:"release"`
+}
+
+// Event is a change to an object observed by the controller, Data contains
+// the JSON encoded object.
+type Event struct {
+	ID         int64           `json:"id"`
+	AppID      string          `json:"app,omitempty"`
+	ObjectType string          `json:"object_type"`
+	ObjectID   string          `json:"object_id"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	CreatedAt  *time.Time      `json:"created_at,omitempty"`
+}
+
+// Auth token scopes, a token may have several scopes and is allowed the
+// requests allowed by any of them.
+const (
+	// TokenScopeAdmin allows all requests, including managing tokens.
+	TokenScopeAdmin = "admin"
+
+	// TokenScopeRead allows requests which do not change anything.
+	TokenScopeRead = "read"
+
+	// TokenScopeDeploy allows read requests and those used to deploy a
+	// release: creating artifacts and releases, setting the app's release,
+	// creating deployments and scaling formations.
+	TokenScopeDeploy = "deploy"
+)
+
+// AuthToken is a named credential for the controller API, which is limited
+// to the requests allowed by its scopes.
+type AuthToken struct {
+	ID     string   `json:"id,omitempty"`
+	Name   string   `json:"name,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Apps limits the token to requests for the given apps, they may be
+	// given by name when the token is created and are returned as IDs.
+	Apps []string `json:"apps,omitempty"`
+
+	// Token is the secret which authenticates requests, it is only
+	// returned when the token is created.
+	Token string `json:"token,omitempty"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// HasScope returns whether the token has the scope.
+func (t *AuthToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditEntry records a request which changed an object in the controller.
+type AuditEntry struct {
+	ID     int64  `json:"id"`
+	Actor  string `json:"actor"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+
+	ObjectType string `json:"object_type,omitempty"`
+	ObjectID   string `json:"object_id,omitempty"`
+
+	// Before is the object as returned by the controller before the
+	// request, After is the response to the request.
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// Webhook event types, which are the events delivered to webhooks.
+const (
+	// WebhookEventDeploy is sent when a deployment changes status or the
+	// release of an app is set.
+	WebhookEventDeploy = "deploy"
+
+	// WebhookEventScale is sent when a formation is created or scaled.
+	WebhookEventScale = "scale"
+
+	// WebhookEventCrash is sent when a job crashes.
+	WebhookEventCrash = "crash"
+)
+
+// WebhookSignatureHeader is the header of webhook requests containing the
+// signature of the body, see SignWebhook.
+const WebhookSignatureHeader = "Flynn-Signature"
+
+// Webhook is a subscription to controller events, which are sent to URL as
+// signed HTTP POST requests.
+type Webhook struct {
+	ID  string `json:"id,omitempty"`
+	URL string `json:"url,omitempty"`
+
+	// Secret is the key used to sign requests, it is generated if not set
+	// and is only returned when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+
+	// Events limits the event types which are sent, all types are sent if
+	// it is empty.
+	Events []string `json:"events,omitempty"`
+
+	// AppID limits the events sent to those of the app, it may be given by
+	// name when the webhook is created.
+	AppID string `json:"app,omitempty"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// Webhook delivery statuses.
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookDelivery is an event sent to a webhook. Deliveries are retried
+// with a backoff until the receiver responds with a 2xx status, and fail
+// after a number of attempts.
+type WebhookDelivery struct {
+	ID        int64  `json:"id"`
+	WebhookID string `json:"webhook"`
+	EventID   int64  `json:"event"`
+	EventType string `json:"event_type"`
+	Status    string `json:"status"`
+	Attempts  int    `json:"attempts"`
+
+	// ResponseStatus and Error are the result of the last attempt.
+	ResponseStatus int    `json:"response_status,omitempty"`
+	Error          string `json:"error,omitempty"`
+
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt     *time.Time `json:"created_at,omitempty"`
+	UpdatedAt     *time.Time `json:"updated_at,omitempty"`
+}
+
+// WebhookPayload is the body of a webhook request.
+type WebhookPayload struct {
+	DeliveryID int64  `json:"delivery"`
+	WebhookID  string `json:"webhook"`
+	EventType  string `json:"event_type"`
+	Event      *Event `json:"event"`
+}
+
+// SignWebhook returns the signature of a webhook request body, which is sent
+// in the WebhookSignatureHeader header so that receivers can check that the
+// request was sent by the controller.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// AppLogLine is a chunk of output written by one of an app's jobs.
+type AppLogLine struct {
+	JobID       string    `json:"job"`
+	ProcessType string    `json:"type,omitempty"`
+	Stream      string    `json:"stream"`
+	Timestamp   time.Time `json:"timestamp"`
+	Message     string    `json:"message"`
+}
+
+// JobLogPoll is the response to a long-poll request for a job's log, EOF is
+// set once the job's output has ended and no more lines will be returned.
+type JobLogPoll struct {
+	Lines []*AppLogLine `json:"lines"`
+	EOF   bool          `json:"eof"`
+}
+
+// LongPollMediaType is sent in the Accept header of requests to streaming
+// endpoints to request a long-poll response, which is a single JSON
+// document sent once there is new data or the poll times out. It is used
+// when streaming responses are buffered by a proxy.
+const LongPollMediaType = "application/vnd.flynn.long-poll+json"
+
 type JobEvent struct {
 	Job
 	ID    int64  `json:"id"`
@@ -95,6 +1049,109 @@ type NewJob struct {
 	Lines      int               `json:"tty_lines,omitempty"`
 }
 
+// JobExec is a request to run a command in the container of a running job,
+// for example a shell to debug it, without restarting the job.
+type JobExec struct {
+	Cmd     []string          `json:"cmd,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	TTY     bool              `json:"tty,omitempty"`
+	Columns int               `json:"tty_columns,omitempty"`
+	Lines   int               `json:"tty_lines,omitempty"`
+}
+
+// Deployment strategies, which control how the jobs of an app's current
+// release are replaced by jobs of the new release.
+const (
+	// DeployStrategyAllAtOnce starts all of the new release's jobs and
+	// stops the old jobs once the new ones are up.
+	DeployStrategyAllAtOnce = "all-at-once"
+
+	// DeployStrategyOneByOne replaces the old jobs one at a time, stopping
+	// an old job each time a new one is up.
+	DeployStrategyOneByOne = "one-by-one"
+
+	// DeployStrategyCanary starts CanaryPercent of the new jobs alongside
+	// the old ones, and once they are up continues as all-at-once.
+	DeployStrategyCanary = "canary"
+
+	// DeployStrategyRollback is the strategy of the deployments recorded
+	// when an app is rolled back, which replace the app's release and
+	// formation in a single step.
+	DeployStrategyRollback = "rollback"
+)
+
+// Rollback is a request to return an app to a previous release.
+type Rollback struct {
+	// ReleaseID is the release to roll back to, it defaults to the release
+	// the app had before its current release.
+	ReleaseID string `json:"release,omitempty"`
+}
+
+// Promotion is a request to deploy a copy of an app's current release to
+// another app, for example to move a build from staging to production.
+type Promotion struct {
+	// TargetAppID is the ID or name of the app to deploy the release to.
+	TargetAppID string `json:"target,omitempty"`
+
+	// Env is merged into the env of the copied release after the names in
+	// UnsetEnv are removed from it. The target app keeps its own app level
+	// environment.
+	Env      map[string]string `json:"env,omitempty"`
+	UnsetEnv []string          `json:"unset_env,omitempty"`
+
+	// Strategy, CanaryPercent, DeployTimeout, ProcessTimeouts and Processes
+	// are used for the deployment to the target app as in Deployment.
+	Strategy        string         `json:"strategy,omitempty"`
+	CanaryPercent   int            `json:"canary_percent,omitempty"`
+	DeployTimeout   int            `json:"deploy_timeout,omitempty"`
+	ProcessTimeouts map[string]int `json:"process_timeouts,omitempty"`
+	Processes       map[string]int `json:"processes,omitempty"`
+}
+
+// Deployment statuses, deployments finish as either complete or failed. A
+// deployment which fails is rolling back while the app's previous release is
+// being restored.
+const (
+	DeploymentStatusPending     = "pending"
+	DeploymentStatusRunning     = "running"
+	DeploymentStatusRollingBack = "rolling_back"
+	DeploymentStatusComplete    = "complete"
+	DeploymentStatusFailed      = "failed"
+)
+
+// DefaultDeployTimeout is the number of seconds a deployment waits for the
+// new jobs of each process type to be up when no timeout is given.
+const DefaultDeployTimeout = 120
+
+// Deployment is a rollout of a new release to an app. DeployTimeout is the
+// number of seconds the new jobs of each process type have to come up,
+// ProcessTimeouts overrides it for individual process types.
+type Deployment struct {
+	ID              string         `json:"id,omitempty"`
+	AppID           string         `json:"app,omitempty"`
+	OldReleaseID    string         `json:"old_release,omitempty"`
+	NewReleaseID    string         `json:"new_release,omitempty"`
+	Strategy        string         `json:"strategy,omitempty"`
+	CanaryPercent   int            `json:"canary_percent,omitempty"`
+	DeployTimeout   int            `json:"deploy_timeout,omitempty"`
+	ProcessTimeouts map[string]int `json:"process_timeouts,omitempty"`
+	Status          string         `json:"status,omitempty"`
+	Processes       map[string]int `json:"processes,omitempty"`
+	CreatedAt       *time.Time     `json:"created_at,omitempty"`
+	FinishedAt      *time.Time     `json:"finished_at,omitempty"`
+}
+
+type DeploymentEvent struct {
+	ID           int64      `json:"id,omitempty"`
+	DeploymentID string     `json:"deployment,omitempty"`
+	ReleaseID    string     `json:"release,omitempty"`
+	Status       string     `json:"status,omitempty"`
+	JobType      string     `json:"job_type,omitempty"`
+	JobState     string     `json:"job_state,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+}
+
 type Frontend struct {
 	Type       string `json:"type,omitempty"`
 	HTTPDomain string `json:"http_domain,omitempty"`
@@ -110,12 +1167,19 @@ type Provider struct {
 }
 
 type Resource struct {
-	ID         string            `json:"id,omitempty"`
-	ProviderID string            `json:"provider_id,omitempty"`
-	ExternalID string            `json:"external_id,omitempty"`
-	Env        map[string]string `json:"env,omitempty"`
-	Apps       []string          `json:"apps,omitempty"`
-	CreatedAt  *time.Time        `json:"created_at,omitempty"`
+	ID           string            `json:"id,omitempty"`
+	ProviderID   string            `json:"provider_id,omitempty"`
+	ProviderName string            `json:"provider_name,omitempty"`
+	ExternalID   string            `json:"external_id,omitempty"`
+	Env          map[string]string `json:"env,omitempty"`
+	Apps         []string          `json:"apps,omitempty"`
+	CreatedAt    *time.Time        `json:"created_at,omitempty"`
+
+	// Version is incremented each time the resource or its app bindings are
+	// modified, PutResource fails with a conflict if it is set and the
+	// resource has since been modified.
+	Version int64  `json:"version,omitempty"`
+	ETag    string `json:"-"`
 }
 
 type ResourceReq struct {
@@ -124,11 +1188,99 @@ type ResourceReq struct {
 	Config     *json.RawMessage `json:"config"`
 }
 
+// ProviderStatus is the result of probing a provider's provisioning URL.
+// Latency is only set if the provider responded, and Error describes why an
+// unreachable provider could not be reached.
+type ProviderStatus struct {
+	ProviderID string        `json:"provider_id"`
+	Reachable  bool          `json:"reachable"`
+	Addr       string        `json:"addr,omitempty"`
+	Latency    time.Duration `json:"latency,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	CheckedAt  time.Time     `json:"checked_at"`
+}
+
+// AppComplete is used to create an app along with its artifact, release and
+// formation in a single transaction. Artifact, Release and Formation are
+// optional, the release and formation are linked to the objects created
+// before them.
+type AppComplete struct {
+	App       *App       `json:"app"`
+	Artifact  *Artifact  `json:"artifact,omitempty"`
+	Release   *Release   `json:"release,omitempty"`
+	Formation *Formation `json:"formation,omitempty"`
+}
+
+// AppGCResult lists the objects deleted by garbage collecting an app.
+type AppGCResult struct {
+	DeletedReleases []string `json:"deleted_releases"`
+}
+
+// GCResult lists the objects deleted by garbage collecting all apps.
+// DeletedBlobs are the URLs of the blobstore files which were deleted.
+type GCResult struct {
+	DeletedReleases  []string `json:"deleted_releases"`
+	DeletedArtifacts []string `json:"deleted_artifacts"`
+	DeletedBlobs     []string `json:"deleted_blobs"`
+}
+
+// ClusterInfo describes the cluster the controller is running in.
+type ClusterInfo struct {
+	Version string `json:"version"`
+	// Domain is the domain that default app routes are created under.
+	Domain string `json:"domain,omitempty"`
+	// Features lists optional controller API features, clients can check
+	// for a feature before using it to support older controllers.
+	Features []string `json:"features"`
+}
+
+// Health check statuses, from best to worst. A degraded controller still
+// serves requests but needs attention.
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthFailed   = "failed"
+)
+
+// Health is the result of the controller's health checks, Status is the worst
+// status of the checks.
+type Health struct {
+	Status string               `json:"status"`
+	Checks []*HealthCheckResult `json:"checks"`
+}
+
+// HealthCheckResult is the result of one of the controller's health checks.
+type HealthCheckResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Message describes the result, for example the reason for a failure.
+	Message string `json:"message,omitempty"`
+}
+
+// Validation error codes, they identify the kind of error independently of
+// the human readable message.
+const (
+	ValidationCodeRequired      = "required"
+	ValidationCodeInvalidType   = "invalid_type"
+	ValidationCodeInvalidFormat = "invalid_format"
+	ValidationCodeTooLong       = "too_long"
+	ValidationCodeOutOfRange    = "out_of_range"
+	ValidationCodeInvalidJSON   = "invalid_json"
+)
+
+// ValidationError is returned by the controller when a request is invalid.
+// Field is the path of the invalid field in the request body (for example
+// "processes.web"), and Code is one of the ValidationCode constants if the
+// error was found by validating the body against its schema.
 type ValidationError struct {
 	Field   string `json:"field,omitempty"`
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message"`
 }
 
 func (v ValidationError) Error() string {
-	return fmt.Sprintf("validation error: %s %s", v.Field, v.Message)
+	if v.Field == "" {
+		return v.Message
+	}
+	return fmt.Sprintf("%s: %s", v.Field, v.Message)
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/pq"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/resource"
+	"github.com/flynn/flynn/router/types"
+)
+
+// defaultAppRetention is how long deleted apps can be restored if not
+// configured.
+const defaultAppRetention = 7 * 24 * time.Hour
+
+// appTombstone is stored with a deleted app so that it can be restored. The
+// formations, resources, cron jobs and log drains deleted with the app keep
+// their rows and are found by their deleted_at time, which is the same as
+// the app's as they are deleted in one transaction, so the tombstone only
+// holds what is lost when they are deleted.
+type appTombstone struct {
+	// Processes are the process counts of the app's formations by release
+	// ID, as they are cleared when the formations are deleted.
+	Processes map[string]map[string]int `json:"processes,omitempty"`
+	// Routes are removed from the router, so are kept here to be created
+	// again.
+	Routes []*router.Route `json:"routes,omitempty"`
+}
+
+func newAppTombstone(d *appDependents) *appTombstone {
+	t := &appTombstone{Processes: make(map[string]map[string]int, len(d.formations)), Routes: d.routes}
+	for _, f := range d.formations {
+		t.Processes[f.ReleaseID] = f.Processes
+	}
+	return t
+}
+
+// deletedAtOfApp matches rows deleted with the app with ID $1.
+const deletedAtOfApp = "deleted_at = (SELECT deleted_at FROM apps WHERE app_id = $1)"
+
+// Undelete restores the app with the given ID or name, along with the
+// objects that were deleted with it. If several deleted apps had the name,
+// the most recently deleted one is restored. Apps deleted longer ago than the
+// retention window cannot be restored.
+func (r *AppRepo) Undelete(id string) (*ct.App, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT app_id, deleted_at, tombstone FROM apps WHERE deleted_at IS NOT NULL AND tombstone IS NOT NULL AND "
+	var row Scanner
+	if idPattern.MatchString(id) {
+		row = tx.QueryRow(query+"(app_id = $1 OR name = $2) ORDER BY deleted_at DESC LIMIT 1 FOR UPDATE", id, id)
+	} else {
+		row = tx.QueryRow(query+"name = $1 ORDER BY deleted_at DESC LIMIT 1 FOR UPDATE", id)
+	}
+	var appID string
+	var deletedAt time.Time
+	var data []byte
+	if err := row.Scan(&appID, &deletedAt, &data); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	if time.Since(deletedAt) > r.retention {
+		tx.Rollback()
+		return nil, ct.ValidationError{Message: fmt.Sprintf("app was deleted more than %s ago and can no longer be restored", r.retention)}
+	}
+	tombstone := &appTombstone{}
+	if err := json.Unmarshal(data, tombstone); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	for releaseID, procs := range tombstone.Processes {
+		f, err := scanFormation(tx.QueryRow("UPDATE formations SET deleted_at = NULL, processes = $3, updated_at = now() WHERE app_id = $1 AND release_id = $2 AND "+deletedAtOfApp+" RETURNING "+formationColumns,
+			appID, releaseID, procsHstore(procs)))
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if err := createEvent(tx, appID, ct.EventTypeFormation, appID+":"+releaseID, f); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	rows, err := tx.Query("UPDATE app_resources SET deleted_at = NULL WHERE app_id = $1 AND "+deletedAtOfApp+" RETURNING resource_id", appID)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var resources []string
+	for rows.Next() {
+		var resourceID string
+		if err := rows.Scan(&resourceID); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		resources = append(resources, resourceID)
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, resourceID := range resources {
+		if _, err := tx.Exec("UPDATE resources SET deleted_at = NULL WHERE resource_id = $2 AND "+deletedAtOfApp, appID, resourceID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	for _, q := range []string{
+		"UPDATE cron_jobs SET deleted_at = NULL WHERE app_id = $1 AND " + deletedAtOfApp,
+		"UPDATE log_drains SET deleted_at = NULL WHERE app_id = $1 AND " + deletedAtOfApp,
+	} {
+		if _, err := tx.Exec(q, appID); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE apps SET deleted_at = NULL, tombstone = NULL, updated_at = now(), version = version + 1 WHERE app_id = $1", appID); err != nil {
+		tx.Rollback()
+		if e, ok := err.(*pq.Error); ok && e.Code.Name() == "unique_violation" {
+			return nil, ct.ValidationError{Field: "name", Message: "is used by another app"}
+		}
+		return nil, err
+	}
+	app, err := selectApp(tx, appID, false)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := createEvent(tx, app.ID, ct.EventTypeApp, app.ID, app); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// routes are restored last so that the transaction is only committed
+	// once they all exist again, they keep their IDs so restoring them
+	// again after a failure does not duplicate them
+	for _, route := range tombstone.Routes {
+		if err := r.router.SetRoute(route); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return app, tx.Commit()
+}
+
+// PurgeTombstones removes the tombstones of apps deleted longer ago than the
+// retention window, after which the apps cannot be restored. The resources
+// which were deleted with an app because no other app used them are
+// deprovisioned with the given function first, and the tombstone is kept if
+// that fails so that it is retried on the next run. It returns the number of
+// apps purged, along with the last error if any could not be.
+func (r *AppRepo) PurgeTombstones(deprovision func(*ct.Resource) error) (int, error) {
+	rows, err := r.db.Query("SELECT app_id FROM apps WHERE tombstone IS NOT NULL AND deleted_at < $1", time.Now().Add(-r.retention))
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, id := range ids {
+		purged, e := r.purgeTombstone(id, deprovision)
+		if e != nil {
+			err = fmt.Errorf("app %s: %s", cleanUUID(id), e)
+			continue
+		}
+		if purged {
+			n++
+		}
+	}
+	return n, err
+}
+
+// purgeTombstone deprovisions the resources deleted with the app and then
+// removes its tombstone, it returns false if the tombstone has already been
+// removed.
+func (r *AppRepo) purgeTombstone(appID string, deprovision func(*ct.Resource) error) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	// lock the app so that it is not restored while its resources are
+	// being deprovisioned
+	if err := tx.QueryRow("SELECT app_id FROM apps WHERE app_id = $1 AND tombstone IS NOT NULL FOR UPDATE", appID).Scan(&appID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// resources which were still used by other apps were not deleted with
+	// the app, so have a different deleted_at time if any
+	rows, err := tx.Query("SELECT resource_id, provider_id, external_id FROM resources WHERE "+deletedAtOfApp+" AND resource_id IN (SELECT resource_id FROM app_resources WHERE app_id = $1 AND "+deletedAtOfApp+")", appID)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	var resources []*ct.Resource
+	for rows.Next() {
+		res := &ct.Resource{Apps: []string{cleanUUID(appID)}}
+		if err := rows.Scan(&res.ID, &res.ProviderID, &res.ExternalID); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return false, err
+		}
+		res.ID = cleanUUID(res.ID)
+		res.ProviderID = cleanUUID(res.ProviderID)
+		resources = append(resources, res)
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	// providers treat deprovisioning a removed resource as success, so the
+	// resources deprovisioned before a failure are just sent again on retry
+	for _, res := range resources {
+		if res.ExternalID == "" {
+			continue
+		}
+		if err := deprovision(res); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE apps SET tombstone = NULL WHERE app_id = $1", appID); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// resourceDeprovisioner returns a function which asks the provider of a
+// resource to deprovision it.
+func resourceDeprovisioner(providers *ProviderRepo, dc resource.DiscoverdClient) func(*ct.Resource) error {
+	return func(res *ct.Resource) error {
+		p, err := providers.Get(res.ProviderID)
+		if err != nil {
+			return err
+		}
+		server, err := resource.NewServerWithDiscoverd(p.(*ct.Provider).URL, dc)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+		return server.Deprovision(res.ExternalID)
+	}
+}
+
+// scheduleTombstoneReaper purges expired app tombstones every interval,
+// deprovisioning the resources deleted with the apps.
+func scheduleTombstoneReaper(interval time.Duration, apps *AppRepo, deprovision func(*ct.Resource) error) {
+	for range time.Tick(interval) {
+		n, err := apps.PurgeTombstones(deprovision)
+		if err != nil {
+			log.Println("reaper: error purging app tombstones:", err)
+		}
+		if n > 0 {
+			log.Printf("reaper: purged the tombstones of %d deleted apps", n)
+		}
+	}
+}
+
+func undeleteApp(params martini.Params, apps *AppRepo, r ResponseHelper) {
+	app, err := apps.Undelete(params["apps_id"])
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, app)
+}
@@ -3,7 +3,9 @@ package utils
 import (
 	"errors"
 	"net/url"
+	"sort"
 	"strings"
+	"time"
 
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/host/types"
@@ -42,15 +44,84 @@ func DockerImage(uri string) (string, error) {
 	return u.Host + u.Path, nil
 }
 
+// HostArtifact returns the artifact in the form jobs are given to hosts.
+func HostArtifact(a *ct.Artifact) host.Artifact {
+	return host.Artifact{Type: a.Type, URI: a.URI, SHA256: a.SHA256}
+}
+
+// HostSecrets returns the secrets of a process type sorted by name, in the
+// form jobs are given to hosts.
+func HostSecrets(secrets map[string]string) []host.Secret {
+	if len(secrets) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]host.Secret, len(names))
+	for i, name := range names {
+		res[i] = host.Secret{Name: name, Data: []byte(secrets[name])}
+	}
+	return res
+}
+
+// HostLogDrains returns the log drains in the form jobs are given to hosts.
+func HostLogDrains(drains []*ct.LogDrain) []host.LogDrain {
+	if len(drains) == 0 {
+		return nil
+	}
+	res := make([]host.LogDrain, len(drains))
+	for i, d := range drains {
+		res[i] = host.LogDrain{URL: d.URL, Username: d.Username, Password: d.Password}
+	}
+	return res
+}
+
+// ProcessArtifacts returns the artifacts of a release which the process type
+// runs with, in the order the process type selects them or all of them if it
+// does not select any of the artifacts.
+func ProcessArtifacts(artifacts []*ct.Artifact, t ct.ProcessType) []*ct.Artifact {
+	if len(t.Artifacts) == 0 {
+		return artifacts
+	}
+	selected := make([]*ct.Artifact, 0, len(t.Artifacts))
+	for _, id := range t.Artifacts {
+		for _, a := range artifacts {
+			if a.ID == id {
+				selected = append(selected, a)
+				break
+			}
+		}
+	}
+	if len(selected) == 0 {
+		return artifacts
+	}
+	return selected
+}
+
+// SetJobArtifacts runs the job in the first artifact and mounts the others.
+func SetJobArtifacts(job *host.Job, artifacts []*ct.Artifact) {
+	job.Artifact = HostArtifact(artifacts[0])
+	job.Artifacts = nil
+	for _, a := range artifacts[1:] {
+		job.Artifacts = append(job.Artifacts, HostArtifact(a))
+	}
+}
+
 func JobConfig(f *ct.ExpandedFormation, name string) *host.Job {
 	t := f.Release.Processes[name]
-	env := make(map[string]string, len(f.Release.Env)+len(t.Env)+2)
+	env := make(map[string]string, len(f.Release.Env)+len(t.Env)+len(f.AppEnv)+2)
 	for k, v := range f.Release.Env {
 		env[k] = v
 	}
 	for k, v := range t.Env {
 		env[k] = v
 	}
+	for k, v := range f.AppEnv {
+		env[k] = v
+	}
 	env["FLYNN_APP_ID"] = f.App.ID
 	env["FLYNN_RELEASE_ID"] = f.Release.ID
 	job := &host.Job{
@@ -60,15 +131,30 @@ func JobConfig(f *ct.ExpandedFormation, name string) *host.Job {
 			"flynn-controller.release":  f.Release.ID,
 			"flynn-controller.type":     name,
 		},
-		Artifact: host.Artifact{
-			Type: f.Artifact.Type,
-			URI:  f.Artifact.URI,
-		},
 		Config: host.ContainerConfig{
-			Cmd: t.Cmd,
-			Env: env,
+			Cmd:         t.Cmd,
+			Env:         env,
+			StopSignal:  ct.StopSignals[t.StopSignal],
+			KillTimeout: time.Duration(t.KillTimeout) * time.Second,
 		},
 	}
+	artifacts := f.Artifacts
+	if len(artifacts) == 0 {
+		artifacts = []*ct.Artifact{f.Artifact}
+	}
+	SetJobArtifacts(job, ProcessArtifacts(artifacts, t))
+	limits := t.ResourceLimits.Merge(f.Limits[name])
+	job.Resources = host.JobResources{
+		Memory:    limits.Memory * 1024,
+		CPUShares: limits.CPU,
+		MaxFD:     limits.MaxFD,
+		MaxProcs:  limits.MaxProcs,
+		MaxCore:   int64(limits.MaxCore) << 20,
+		Disk:      int64(limits.Disk) << 20,
+
+		EgressRate:  int64(limits.NetworkEgress) * 1000000,
+		IngressRate: int64(limits.NetworkIngress) * 1000000,
+	}
 	if len(t.Entrypoint) > 0 {
 		job.Config.Entrypoint = t.Entrypoint
 	}
@@ -77,9 +163,59 @@ func JobConfig(f *ct.ExpandedFormation, name string) *host.Job {
 		job.Config.Ports[i].Proto = p.Proto
 		job.Config.Ports[i].Port = p.Port
 		job.Config.Ports[i].RangeEnd = p.RangeEnd
+		job.Config.Ports[i].HostPort = p.HostPort
 	}
+	job.Config.Secrets = HostSecrets(t.Secrets)
+	if t.LogDriver != nil {
+		job.LogDriver = host.LogDriver{Name: t.LogDriver.Name, URL: t.LogDriver.URL}
+	}
+	if len(t.Devices) > 0 {
+		job.Config.Devices = make([]host.DeviceRequest, len(t.Devices))
+		for i, d := range t.Devices {
+			job.Config.Devices[i] = host.DeviceRequest{Class: d.Class, Count: d.Count}
+		}
+	}
+	if s := t.Security; s != nil {
+		job.Config.Seccomp = s.Seccomp
+		job.Config.AppArmor = s.AppArmor
+	}
+	job.Config.ReadOnlyRoot = t.ReadOnlyRoot
+	if len(t.Tmpfs) > 0 {
+		job.Config.Tmpfs = make([]host.TmpfsMount, len(t.Tmpfs))
+		for i, m := range t.Tmpfs {
+			job.Config.Tmpfs[i] = host.TmpfsMount{Location: m.Location, Size: int64(m.Size) << 20}
+		}
+	}
+	if d := t.DNS; d != nil {
+		job.Config.DNSServers = d.Servers
+		job.Config.DNSSearch = d.Search
+		job.Config.Hosts = d.Hosts
+	}
+	if a := t.RegistryAuth; a != nil {
+		job.RegistryAuth = &host.RegistryAuth{
+			Registry: a.Registry,
+			Username: a.Username,
+			Password: a.Password,
+			TokenURL: a.TokenURL,
+		}
+	}
+	job.LogDrains = HostLogDrains(f.LogDrains)
 	if t.Data {
 		job.Config.Mounts = []host.Mount{{Location: "/data", Writeable: true}}
 	}
+	if c := t.HealthCheck; c != nil {
+		job.HealthCheck = &host.HealthCheck{
+			Type:         c.Type,
+			Path:         c.Path,
+			Interval:     time.Duration(c.Interval) * time.Second,
+			GracePeriod:  time.Duration(c.GracePeriod) * time.Second,
+			Failures:     c.Failures,
+			RestartAfter: c.RestartAfter,
+			Service:      env["SD_NAME"],
+		}
+		// the host registers the job with discoverd once it is healthy,
+		// rather than the job registering itself when it starts
+		delete(env, "SD_NAME")
+	}
 	return job
 }
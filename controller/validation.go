@@ -0,0 +1,571 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+// property describes the allowed values of a field in a JSON request body.
+type property struct {
+	// typ is the JSON type of the value: "string", "integer", "number",
+	// "boolean", "object" or "array".
+	typ       string
+	required  bool
+	pattern   *regexp.Regexp
+	maxLength int
+	// nonNegative is set for integers which must be zero or more.
+	nonNegative bool
+
+	// properties describes the fields of an object with known fields.
+	properties schema
+	// values describes the values of an object used as a map, or the items
+	// of an array.
+	values *property
+	// keys describes the keys of an object used as a map.
+	keys *property
+}
+
+// schema maps field names to their properties, fields that are not in the
+// schema are not validated.
+type schema map[string]*property
+
+var (
+	stringProperty  = &property{typ: "string"}
+	integerProperty = &property{typ: "integer"}
+	countProperty   = &property{typ: "integer", nonNegative: true}
+	stringMap       = &property{typ: "object", values: stringProperty}
+	stringArray     = &property{typ: "array", values: stringProperty}
+	idArray         = &property{typ: "array", values: &property{typ: "string", pattern: idPattern}}
+)
+
+var limitsSchema = schema{
+	"memory": countProperty,
+	"cpu":    countProperty,
+	"max_fd": countProperty,
+	"disk":   countProperty,
+
+	"network_egress":  countProperty,
+	"network_ingress": countProperty,
+
+	"max_procs": countProperty,
+	"max_core":  countProperty,
+}
+
+// secretNamePattern matches the names of the files secrets are written to,
+// which can't be hidden or escape the secrets directory.
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+// profileNamePattern matches the names of the security profiles process
+// types select, which hosts read from files named after them.
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// hostnamePattern matches the DNS search domains and hostnames of process
+// types, and ipPattern their DNS servers and the IPs of their hosts entries.
+var (
+	hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9_])?$`)
+	ipPattern       = regexp.MustCompile(`^([0-9]{1,3}(\.[0-9]{1,3}){3}|[0-9A-Fa-f:.]*:[0-9A-Fa-f:.]*)$`)
+)
+
+var processTypeSchema = &property{typ: "object", properties: schema{
+	"memory":     countProperty,
+	"cpu":        countProperty,
+	"max_fd":     countProperty,
+	"disk":       countProperty,
+	"cmd":        stringArray,
+	"entrypoint": stringArray,
+	"env":        stringMap,
+	"data":       {typ: "boolean"},
+	"omni":       {typ: "boolean"},
+	"artifacts":  idArray,
+	"ports": {typ: "array", values: &property{typ: "object", properties: schema{
+		"port":      countProperty,
+		"proto":     {typ: "string", pattern: regexp.MustCompile(`^(tcp|udp)$`)},
+		"range_end": countProperty,
+		"host_port": countProperty,
+	}}},
+	"health_check": {typ: "object", properties: schema{
+		"type":          {typ: "string", required: true, pattern: regexp.MustCompile(`^(tcp|http)$`)},
+		"path":          stringProperty,
+		"interval":      countProperty,
+		"grace_period":  countProperty,
+		"failures":      countProperty,
+		"restart_after": countProperty,
+	}},
+	"restart_policy": {typ: "object", properties: schema{
+		"name":        {typ: "string", required: true, pattern: regexp.MustCompile(`^(always|on-failure|never)$`)},
+		"max_retries": countProperty,
+	}},
+	"stop_signal":  {typ: "string", pattern: regexp.MustCompile(`^SIG[A-Z0-9]+$`)},
+	"kill_timeout": countProperty,
+	"log_driver": {typ: "object", properties: schema{
+		"name": {typ: "string", required: true, pattern: regexp.MustCompile(`^(logbuf|journald|null|remote)$`)},
+		"url":  stringProperty,
+	}},
+	"dns": {typ: "object", properties: schema{
+		"servers": {typ: "array", values: &property{typ: "string", pattern: ipPattern}},
+		"search":  {typ: "array", values: &property{typ: "string", pattern: hostnamePattern}},
+		"hosts": {
+			typ:    "object",
+			keys:   &property{typ: "string", pattern: hostnamePattern},
+			values: &property{typ: "string", pattern: ipPattern},
+		},
+	}},
+	"devices": {typ: "array", values: &property{typ: "object", properties: schema{
+		"class": {typ: "string", required: true, pattern: regexp.MustCompile(`^[a-z0-9_-]+$`)},
+		"count": countProperty,
+	}}},
+	"registry_auth": {typ: "object", properties: schema{
+		"registry":  stringProperty,
+		"username":  {typ: "string", required: true},
+		"password":  {typ: "string", required: true},
+		"token_url": stringProperty,
+	}},
+	"secrets": {
+		typ:    "object",
+		keys:   &property{typ: "string", pattern: secretNamePattern, maxLength: 255},
+		values: stringProperty,
+	},
+	"network_egress":  countProperty,
+	"network_ingress": countProperty,
+	"security": {typ: "object", properties: schema{
+		"seccomp":  {typ: "string", pattern: profileNamePattern},
+		"apparmor": {typ: "string", pattern: profileNamePattern},
+	}},
+	"max_procs":      countProperty,
+	"max_core":       countProperty,
+	"read_only_root": {typ: "boolean"},
+	"tmpfs": {typ: "array", values: &property{typ: "object", properties: schema{
+		"location": {typ: "string", required: true, pattern: regexp.MustCompile(`^(/[^/]+)+$`)},
+		"size":     countProperty,
+	}}},
+}}
+
+var appSchema = schema{
+	"id":          {typ: "string", pattern: idPattern},
+	"name":        {typ: "string", pattern: appNamePattern, maxLength: 100},
+	"protected":   {typ: "boolean"},
+	"maintenance": {typ: "boolean"},
+	"owner":       {typ: "string", pattern: idPattern},
+	"version":     countProperty,
+	"meta":        stringMap,
+	"labels": {
+		typ:    "object",
+		keys:   &property{typ: "string", pattern: ct.LabelKeyPattern},
+		values: &property{typ: "string", pattern: ct.LabelValuePattern},
+	},
+}
+
+var artifactSchema = schema{
+	"id":     {typ: "string", pattern: idPattern},
+	"type":   stringProperty,
+	"uri":    stringProperty,
+	"size":   countProperty,
+	"sha256": {typ: "string", pattern: regexp.MustCompile(`^[0-9a-f]{64}$`)},
+}
+
+var releaseSchema = schema{
+	"id":        {typ: "string", pattern: idPattern},
+	"artifact":  {typ: "string", pattern: idPattern},
+	"artifacts": idArray,
+	"env":       stringMap,
+	"processes": {typ: "object", values: processTypeSchema},
+	"meta":      stringMap,
+}
+
+var constraintsSchema = schema{
+	"host_tags": stringMap,
+	"spread_by": stringProperty,
+	"volumes":   stringArray,
+}
+
+var formationSchema = schema{
+	"processes":   {typ: "object", values: countProperty},
+	"limits":      {typ: "object", values: &property{typ: "object", properties: limitsSchema}},
+	"constraints": {typ: "object", values: &property{typ: "object", properties: constraintsSchema}},
+	"state_hash":  stringProperty,
+}
+
+// schemas are the schemas of request bodies, keyed by the plural name of the
+// object type.
+var schemas = map[string]schema{
+	"apps":      appSchema,
+	"artifacts": artifactSchema,
+	"releases":  releaseSchema,
+	"providers": {
+		"name": {typ: "string", required: true},
+		"url":  {typ: "string", required: true},
+	},
+	"keys": {
+		"key": {typ: "string", required: true},
+	},
+	"formations": formationSchema,
+	"formation_batches": {
+		"formations": {typ: "array", required: true, values: &property{typ: "object", properties: schema{
+			"app":       {typ: "string", required: true, maxLength: 100},
+			"release":   {typ: "string", required: true, pattern: idPattern},
+			"processes": {typ: "object", required: true, values: countProperty},
+		}}},
+	},
+	"auth_tokens": {
+		"name":   {typ: "string", required: true, maxLength: 100},
+		"scopes": {typ: "array", required: true, values: &property{typ: "string", pattern: regexp.MustCompile(`^(admin|read|deploy)$`)}},
+		"apps":   stringArray,
+	},
+	"app_complete": {
+		"app":       {typ: "object", required: true, properties: appSchema},
+		"artifact":  {typ: "object", properties: artifactSchema},
+		"release":   {typ: "object", properties: releaseSchema},
+		"formation": {typ: "object", properties: formationSchema},
+	},
+	"app_env": {
+		"set":         stringMap,
+		"unset":       stringArray,
+		"new_release": {typ: "boolean"},
+	},
+	"new_jobs": {
+		"release":     {typ: "string", pattern: idPattern},
+		"cmd":         stringArray,
+		"entrypoint":  stringArray,
+		"env":         stringMap,
+		"tty":         {typ: "boolean"},
+		"tty_columns": countProperty,
+		"tty_lines":   countProperty,
+	},
+	"job_execs": {
+		"cmd":         {typ: "array", required: true, values: stringProperty},
+		"env":         stringMap,
+		"tty":         {typ: "boolean"},
+		"tty_columns": countProperty,
+		"tty_lines":   countProperty,
+	},
+	"jobs": {
+		"release": {typ: "string", pattern: idPattern},
+		"type":    stringProperty,
+		"state":   {typ: "string", pattern: regexp.MustCompile(`^(starting|up|unhealthy|down|crashed)$`)},
+	},
+	"resources": {
+		"version":     countProperty,
+		"external_id": stringProperty,
+		"env":         stringMap,
+		"apps":        stringArray,
+	},
+	"resource_reqs": {
+		"apps": stringArray,
+	},
+	"autoscale_policies": {
+		"min":    {typ: "integer", required: true, nonNegative: true},
+		"max":    {typ: "integer", required: true, nonNegative: true},
+		"metric": stringProperty,
+		"target": {typ: "number", required: true},
+	},
+	"cron_jobs": {
+		"schedule":           {typ: "string", required: true},
+		"process_type":       stringProperty,
+		"cmd":                stringArray,
+		"concurrency_policy": stringProperty,
+	},
+	"app_quota": {
+		"max_jobs":   countProperty,
+		"max_memory": countProperty,
+		"max_routes": countProperty,
+	},
+	"log_drains": {
+		"url":      {typ: "string", required: true},
+		"username": stringProperty,
+		"password": stringProperty,
+	},
+	"deployments": {
+		"new_release":      {typ: "string", required: true, pattern: idPattern},
+		"strategy":         stringProperty,
+		"canary_percent":   integerProperty,
+		"deploy_timeout":   countProperty,
+		"process_timeouts": {typ: "object", values: countProperty},
+		"processes":        {typ: "object", values: countProperty},
+	},
+	"rollbacks": {
+		"release": {typ: "string", pattern: idPattern},
+	},
+	"promotions": {
+		"target":           {typ: "string", required: true},
+		"env":              stringMap,
+		"unset_env":        stringArray,
+		"strategy":         stringProperty,
+		"canary_percent":   integerProperty,
+		"deploy_timeout":   countProperty,
+		"process_timeouts": {typ: "object", values: countProperty},
+		"processes":        {typ: "object", values: countProperty},
+	},
+	"app_transfers": {
+		"to": {typ: "string", required: true, pattern: idPattern},
+	},
+	"app_releases": {
+		"id": {typ: "string", required: true, pattern: idPattern},
+	},
+	"routes": {
+		"type": {typ: "string", required: true, pattern: regexp.MustCompile(`^(http|tcp)$`)},
+		"config": {typ: "object", properties: schema{
+			"domain":        stringProperty,
+			"service":       stringProperty,
+			"tls_cert":      stringProperty,
+			"tls_key":       stringProperty,
+			"sticky":        {typ: "boolean"},
+			"port":          countProperty,
+			"drain_timeout": countProperty,
+		}},
+	},
+	"webhooks": {
+		"url":    {typ: "string", required: true, maxLength: 2048},
+		"secret": {typ: "string", maxLength: 256},
+		"events": {typ: "array", values: &property{typ: "string", pattern: regexp.MustCompile(`^(deploy|scale|crash)$`)}},
+		"app":    stringProperty,
+	},
+}
+
+// validate checks that the JSON document data matches the schema, returning
+// a ct.ValidationError for the first invalid field. Required fields are not
+// checked if partial is true, which is used for updates.
+func (s schema) validate(data []byte, partial bool) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return ct.ValidationError{Code: ct.ValidationCodeInvalidJSON, Message: "The provided JSON input is invalid"}
+	}
+	return (&property{typ: "object", properties: s}).validate("", v, partial)
+}
+
+func (p *property) validate(field string, v interface{}, partial bool) error {
+	// null is treated as an absent value
+	if v == nil {
+		return nil
+	}
+	switch p.typ {
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return typeError(field, "a string")
+		}
+		if p.maxLength > 0 && len(s) > p.maxLength {
+			return ct.ValidationError{
+				Field:   field,
+				Code:    ct.ValidationCodeTooLong,
+				Message: fmt.Sprintf("must be at most %d characters", p.maxLength),
+			}
+		}
+		if p.pattern != nil && !p.pattern.MatchString(s) {
+			return ct.ValidationError{
+				Field:   field,
+				Code:    ct.ValidationCodeInvalidFormat,
+				Message: fmt.Sprintf("must match %s", p.pattern),
+			}
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return typeError(field, "an integer")
+		}
+		i, err := n.Int64()
+		if err != nil {
+			return typeError(field, "an integer")
+		}
+		if p.nonNegative && i < 0 {
+			return ct.ValidationError{Field: field, Code: ct.ValidationCodeOutOfRange, Message: "must not be negative"}
+		}
+	case "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			return typeError(field, "a number")
+		}
+		if _, err := n.Float64(); err != nil {
+			return typeError(field, "a number")
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return typeError(field, "a boolean")
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			return typeError(field, "an array")
+		}
+		if p.values == nil {
+			return nil
+		}
+		for i, item := range a {
+			if err := p.values.validate(fmt.Sprintf("%s[%d]", field, i), item, partial); err != nil {
+				return err
+			}
+		}
+	case "object":
+		o, ok := v.(map[string]interface{})
+		if !ok {
+			return typeError(field, "an object")
+		}
+		if p.properties != nil {
+			return p.properties.validateObject(field, o, partial)
+		}
+		for _, k := range sortedKeys(o) {
+			if p.keys != nil {
+				if err := p.keys.validate(joinField(field, k), k, partial); err != nil {
+					return err
+				}
+			}
+			if p.values != nil {
+				if err := p.values.validate(joinField(field, k), o[k], partial); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s schema) validateObject(field string, o map[string]interface{}, partial bool) error {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := s[name]
+		v, ok := o[name]
+		if !ok || v == nil {
+			if p.required && !partial {
+				return ct.ValidationError{Field: joinField(field, name), Code: ct.ValidationCodeRequired, Message: "is required"}
+			}
+			continue
+		}
+		if err := p.validate(joinField(field, name), v, partial); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func typeError(field, typ string) error {
+	return ct.ValidationError{Field: field, Code: ct.ValidationCodeInvalidType, Message: "must be " + typ}
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonSchemaVersion is the JSON Schema draft which the schemas served by
+// GET /schemas conform to.
+const jsonSchemaVersion = "http://json-schema.org/draft-04/schema#"
+
+// jsonSchema returns the JSON Schema document describing the request body
+// of the named schema.
+func (s schema) jsonSchema(name string) map[string]interface{} {
+	doc := (&property{typ: "object", properties: s}).jsonSchema()
+	doc["$schema"] = jsonSchemaVersion
+	doc["id"] = "/schemas/" + name
+	return doc
+}
+
+func (p *property) jsonSchema() map[string]interface{} {
+	doc := map[string]interface{}{"type": p.typ}
+	if p.pattern != nil {
+		doc["pattern"] = p.pattern.String()
+	}
+	if p.maxLength > 0 {
+		doc["maxLength"] = p.maxLength
+	}
+	if p.nonNegative {
+		doc["minimum"] = 0
+	}
+	switch {
+	case p.properties != nil:
+		props := make(map[string]interface{}, len(p.properties))
+		var required []string
+		for name, prop := range p.properties {
+			props[name] = prop.jsonSchema()
+			if prop.required {
+				required = append(required, name)
+			}
+		}
+		doc["properties"] = props
+		if len(required) > 0 {
+			sort.Strings(required)
+			doc["required"] = required
+		}
+	case p.typ == "array" && p.values != nil:
+		doc["items"] = p.values.jsonSchema()
+	case p.keys != nil && p.keys.pattern != nil:
+		values := map[string]interface{}{}
+		if p.values != nil {
+			values = p.values.jsonSchema()
+		}
+		doc["patternProperties"] = map[string]interface{}{p.keys.pattern.String(): values}
+		doc["additionalProperties"] = false
+	case p.values != nil:
+		doc["additionalProperties"] = p.values.jsonSchema()
+	}
+	return doc
+}
+
+// getSchemas responds with the JSON Schemas of all request bodies, keyed by
+// schema name.
+func getSchemas(r ResponseHelper) {
+	docs := make(map[string]interface{}, len(schemas))
+	for name, s := range schemas {
+		docs[name] = s.jsonSchema(name)
+	}
+	r.JSON(200, docs)
+}
+
+func getSchema(params martini.Params, r ResponseHelper) {
+	name := params["schemas_id"]
+	s, ok := schemas[name]
+	if !ok {
+		r.Error(ErrNotFound)
+		return
+	}
+	r.JSON(200, s.jsonSchema(name))
+}
+
+// readValidBody reads the request body and validates it against the named
+// schema, the body is replaced so that it can be decoded by later handlers.
+func readValidBody(req *http.Request, name string, partial bool) ([]byte, error) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	if s, ok := schemas[name]; ok {
+		if err := s.validate(data, partial); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// validateBody returns a handler that responds with a validation error if
+// the request body does not match the named schema.
+func validateBody(name string) func(*http.Request, ResponseHelper) {
+	return func(req *http.Request, r ResponseHelper) {
+		if _, err := readValidBody(req, name, false); err != nil {
+			r.Error(err)
+		}
+	}
+}
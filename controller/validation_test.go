@@ -0,0 +1,260 @@
+package main
+
+import (
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+type ValidationSuite struct{}
+
+var _ = Suite(&ValidationSuite{})
+
+func (ValidationSuite) TestValidate(c *C) {
+	for _, t := range []struct {
+		schema  string
+		body    string
+		partial bool
+		err     *ct.ValidationError
+	}{
+		{schema: "apps", body: `{"name": "foo-bar", "meta": {"a": "b"}}`},
+		{schema: "apps", body: `{"name": "Foo"}`, err: &ct.ValidationError{Field: "name", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "apps", body: `{"protected": "yes"}`, err: &ct.ValidationError{Field: "protected", Code: ct.ValidationCodeInvalidType}},
+		{schema: "apps", body: `{"meta": {"a": 1}}`, err: &ct.ValidationError{Field: "meta.a", Code: ct.ValidationCodeInvalidType}},
+		{schema: "apps", body: `{"labels": {"team": "payments", "flynn.io/env": ""}}`},
+		{schema: "apps", body: `{"labels": {"Team": "payments"}}`, err: &ct.ValidationError{Field: "labels.Team", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "apps", body: `{"labels": {"team": "a b"}}`, err: &ct.ValidationError{Field: "labels.team", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "apps", body: `[]`, err: &ct.ValidationError{Code: ct.ValidationCodeInvalidType}},
+		{schema: "apps", body: `{`, err: &ct.ValidationError{Code: ct.ValidationCodeInvalidJSON}},
+		{schema: "keys", body: `{}`, err: &ct.ValidationError{Field: "key", Code: ct.ValidationCodeRequired}},
+		{schema: "keys", body: `{}`, partial: true},
+		{schema: "formations", body: `{"processes": {"web": 1.5}}`, err: &ct.ValidationError{Field: "processes.web", Code: ct.ValidationCodeInvalidType}},
+		{schema: "formations", body: `{"limits": {"web": {"memory": 256, "cpu": 512}}}`},
+		{schema: "formations", body: `{"limits": {"web": {"max_fd": "1024"}}}`, err: &ct.ValidationError{Field: "limits.web.max_fd", Code: ct.ValidationCodeInvalidType}},
+		{schema: "formations", body: `{"limits": {"web": {"disk": -1}}}`, err: &ct.ValidationError{Field: "limits.web.disk", Code: ct.ValidationCodeOutOfRange}},
+		{schema: "releases", body: `{"processes": {"worker": {"network_egress": 10, "network_ingress": "fast"}}}`, err: &ct.ValidationError{Field: "processes.worker.network_ingress", Code: ct.ValidationCodeInvalidType}},
+		{schema: "autoscale_policies", body: `{"min": 1, "max": 4, "target": 2.5}`},
+		{schema: "autoscale_policies", body: `{"min": 1, "max": 4, "target": "2"}`, err: &ct.ValidationError{Field: "target", Code: ct.ValidationCodeInvalidType}},
+		{schema: "releases", body: `{"processes": {"web": {"cmd": ["a", 1]}}}`, err: &ct.ValidationError{Field: "processes.web.cmd[1]", Code: ct.ValidationCodeInvalidType}},
+		{schema: "releases", body: `{"processes": {"web": {"memory": 1.5}}}`, err: &ct.ValidationError{Field: "processes.web.memory", Code: ct.ValidationCodeInvalidType}},
+		{schema: "releases", body: `{"processes": {"web": {"health_check": {"type": "http", "path": "/status", "interval": 5}}}}`},
+		{schema: "releases", body: `{"processes": {"web": {"health_check": {"type": "udp"}}}}`, err: &ct.ValidationError{Field: "processes.web.health_check.type", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "releases", body: `{"processes": {"web": {"health_check": {"path": "/"}}}}`, err: &ct.ValidationError{Field: "processes.web.health_check.type", Code: ct.ValidationCodeRequired}},
+		{schema: "releases", body: `{"artifacts": ["7c3cbb9a-1f1e-4f2d-9f3a-2a4c5d6e7f80", 1]}`, err: &ct.ValidationError{Field: "artifacts[1]", Code: ct.ValidationCodeInvalidType}},
+		{schema: "releases", body: `{"processes": {"web": {"artifacts": ["foo"]}}}`, err: &ct.ValidationError{Field: "processes.web.artifacts[0]", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "releases", body: `{"processes": {"web": {"secrets": {"db_password": "s3cret", "tls.key": "key"}}}}`},
+		{schema: "releases", body: `{"processes": {"web": {"secrets": {"../passwd": "x"}}}}`, err: &ct.ValidationError{Field: "processes.web.secrets.../passwd", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "releases", body: `{"processes": {"web": {"secrets": {".env": "x"}}}}`, err: &ct.ValidationError{Field: "processes.web.secrets..env", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "releases", body: `{"processes": {"web": {"secrets": {"key": 1}}}}`, err: &ct.ValidationError{Field: "processes.web.secrets.key", Code: ct.ValidationCodeInvalidType}},
+		{schema: "releases", body: `{"processes": {"web": {"log_driver": {"name": "syslog"}}}}`, err: &ct.ValidationError{Field: "processes.web.log_driver.name", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "releases", body: `{"processes": {"web": {"registry_auth": {"registry": "registry.example.com", "username": "deploy", "password": "s3cret"}}}}`},
+		{schema: "releases", body: `{"processes": {"web": {"registry_auth": {"username": "deploy"}}}}`, err: &ct.ValidationError{Field: "processes.web.registry_auth.password", Code: ct.ValidationCodeRequired}},
+		{schema: "releases", body: `{"processes": {"web": {"dns": {"servers": ["10.0.0.1", "2001:db8::1"], "search": ["discoverd"], "hosts": {"db.internal": "10.0.0.5"}}}}}`},
+		{schema: "releases", body: `{"processes": {"web": {"dns": {"servers": ["dns.example.com"]}}}}`, err: &ct.ValidationError{Field: "processes.web.dns.servers[0]", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "releases", body: `{"processes": {"web": {"dns": {"hosts": {"db internal": "10.0.0.5"}}}}}`, err: &ct.ValidationError{Field: "processes.web.dns.hosts.db internal", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "releases", body: `{"processes": {"train": {"devices": [{"class": "gpu", "count": 2}]}}}`},
+		{schema: "releases", body: `{"processes": {"train": {"devices": [{"count": 1}]}}}`, err: &ct.ValidationError{Field: "processes.train.devices[0].class", Code: ct.ValidationCodeRequired}},
+		{schema: "releases", body: `{"processes": {"web": {"security": {"seccomp": "default", "apparmor": "nginx-1.9"}}}}`},
+		{schema: "releases", body: `{"processes": {"web": {"security": {"seccomp": "../etc/x"}}}}`, err: &ct.ValidationError{Field: "processes.web.security.seccomp", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "releases", body: `{"processes": {"web": {"read_only_root": true, "tmpfs": [{"location": "/tmp", "size": 64}, {"location": "/var/run"}]}}}`},
+		{schema: "releases", body: `{"processes": {"web": {"tmpfs": [{"location": "tmp"}]}}}`, err: &ct.ValidationError{Field: "processes.web.tmpfs[0].location", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "releases", body: `{"processes": {"web": {"tmpfs": [{"size": 64}]}}}`, err: &ct.ValidationError{Field: "processes.web.tmpfs[0].location", Code: ct.ValidationCodeRequired}},
+		{schema: "job_execs", body: `{"cmd": ["bash"], "tty": true, "tty_columns": 80, "tty_lines": 24}`},
+		{schema: "job_execs", body: `{"tty": true}`, err: &ct.ValidationError{Field: "cmd", Code: ct.ValidationCodeRequired}},
+		{schema: "app_complete", body: `{"release": {}}`, err: &ct.ValidationError{Field: "app", Code: ct.ValidationCodeRequired}},
+		{schema: "app_complete", body: `{"app": {"name": "a_b"}}`, err: &ct.ValidationError{Field: "app.name", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "formations", body: `{"processes": {"web": -1}}`, err: &ct.ValidationError{Field: "processes.web", Code: ct.ValidationCodeOutOfRange}},
+		{schema: "formations", body: `{"processes": {"web": 0}}`},
+		{schema: "app_releases", body: `{}`, err: &ct.ValidationError{Field: "id", Code: ct.ValidationCodeRequired}},
+		{schema: "routes", body: `{"type": "http", "config": {"domain": "example.com", "service": "foo-web"}}`},
+		{schema: "routes", body: `{"type": "udp"}`, err: &ct.ValidationError{Field: "type", Code: ct.ValidationCodeInvalidFormat}},
+		{schema: "routes", body: `{"type": "tcp", "config": {"port": "80"}}`, err: &ct.ValidationError{Field: "config.port", Code: ct.ValidationCodeInvalidType}},
+	} {
+		err := schemas[t.schema].validate([]byte(t.body), t.partial)
+		if t.err == nil {
+			c.Assert(err, IsNil, Commentf("%s %s", t.schema, t.body))
+			continue
+		}
+		c.Assert(err, FitsTypeOf, ct.ValidationError{}, Commentf("%s %s", t.schema, t.body))
+		e := err.(ct.ValidationError)
+		c.Assert(e.Field, Equals, t.err.Field, Commentf("%s %s", t.schema, t.body))
+		c.Assert(e.Code, Equals, t.err.Code, Commentf("%s %s", t.schema, t.body))
+	}
+}
+
+func (ValidationSuite) TestJSONSchema(c *C) {
+	doc := schemas["apps"].jsonSchema("apps")
+	c.Assert(doc["$schema"], Equals, jsonSchemaVersion)
+	c.Assert(doc["id"], Equals, "/schemas/apps")
+	c.Assert(doc["type"], Equals, "object")
+	props := doc["properties"].(map[string]interface{})
+	name := props["name"].(map[string]interface{})
+	c.Assert(name["type"], Equals, "string")
+	c.Assert(name["pattern"], Equals, appNamePattern.String())
+	c.Assert(name["maxLength"], Equals, 100)
+	labels := props["labels"].(map[string]interface{})
+	c.Assert(labels["additionalProperties"], Equals, false)
+	c.Assert(labels["patternProperties"], HasLen, 1)
+
+	doc = schemas["formations"].jsonSchema("formations")
+	procs := doc["properties"].(map[string]interface{})["processes"].(map[string]interface{})
+	c.Assert(procs["additionalProperties"], DeepEquals, map[string]interface{}{"type": "integer", "minimum": 0})
+
+	doc = schemas["auth_tokens"].jsonSchema("auth_tokens")
+	c.Assert(doc["required"], DeepEquals, []string{"name", "scopes"})
+	scopes := doc["properties"].(map[string]interface{})["scopes"].(map[string]interface{})
+	c.Assert(scopes["items"].(map[string]interface{})["type"], Equals, "string")
+}
+
+func (ValidationSuite) TestErrorMessage(c *C) {
+	err := schemas["apps"].validate([]byte(`{"name": "Foo"}`), false)
+	c.Assert(err, ErrorMatches, `name: must match \^\[a-z\\d\]\+\(-\[a-z\\d\]\+\)\*\$`)
+}
+
+func (ValidationSuite) TestValidateHealthCheck(c *C) {
+	ports := []ct.Port{{Proto: "tcp"}}
+	for _, t := range []struct {
+		check *ct.HealthCheck
+		ports []ct.Port
+		field string
+	}{
+		{nil, nil, ""},
+		{&ct.HealthCheck{Type: "tcp", Interval: 5, GracePeriod: 30}, ports, ""},
+		{&ct.HealthCheck{Type: "http", Path: "/status"}, ports, ""},
+		{&ct.HealthCheck{Type: "tcp"}, nil, "processes.web.health_check"},
+		{&ct.HealthCheck{Type: "tcp", Path: "/"}, ports, "processes.web.health_check.path"},
+		{&ct.HealthCheck{Type: "http", Path: "status"}, ports, "processes.web.health_check.path"},
+		{&ct.HealthCheck{Type: "http", Interval: -1}, ports, "processes.web.health_check.interval"},
+		{&ct.HealthCheck{Type: "http", GracePeriod: 7200}, ports, "processes.web.health_check.grace_period"},
+		{&ct.HealthCheck{Type: "tcp", Failures: 5, RestartAfter: 10}, ports, ""},
+		{&ct.HealthCheck{Type: "tcp", Failures: -1}, ports, "processes.web.health_check.failures"},
+		{&ct.HealthCheck{Type: "tcp", RestartAfter: 1000}, ports, "processes.web.health_check.restart_after"},
+	} {
+		err := validateHealthCheck("processes.web", ct.ProcessType{HealthCheck: t.check, Ports: t.ports})
+		if t.field == "" {
+			c.Assert(err, IsNil, Commentf("%+v", t.check))
+			continue
+		}
+		c.Assert(err, FitsTypeOf, ct.ValidationError{}, Commentf("%+v", t.check))
+		c.Assert(err.(ct.ValidationError).Field, Equals, t.field, Commentf("%+v", t.check))
+	}
+}
+
+func (ValidationSuite) TestValidateRestartPolicy(c *C) {
+	for _, t := range []struct {
+		policy *ct.RestartPolicy
+		field  string
+	}{
+		{nil, ""},
+		{&ct.RestartPolicy{Name: ct.RestartAlways}, ""},
+		{&ct.RestartPolicy{Name: ct.RestartOnFailure, MaxRetries: 3}, ""},
+		{&ct.RestartPolicy{Name: "sometimes"}, "processes.web.restart_policy.name"},
+		{&ct.RestartPolicy{Name: ct.RestartOnFailure, MaxRetries: -1}, "processes.web.restart_policy.max_retries"},
+		{&ct.RestartPolicy{Name: ct.RestartNever, MaxRetries: 3}, "processes.web.restart_policy.max_retries"},
+	} {
+		err := validateRestartPolicy("processes.web", t.policy)
+		if t.field == "" {
+			c.Assert(err, IsNil, Commentf("%+v", t.policy))
+			continue
+		}
+		c.Assert(err, FitsTypeOf, ct.ValidationError{}, Commentf("%+v", t.policy))
+		c.Assert(err.(ct.ValidationError).Field, Equals, t.field, Commentf("%+v", t.policy))
+	}
+}
+
+func (ValidationSuite) TestValidateStopSignal(c *C) {
+	for _, t := range []struct {
+		typ   ct.ProcessType
+		field string
+	}{
+		{ct.ProcessType{}, ""},
+		{ct.ProcessType{StopSignal: "SIGQUIT", KillTimeout: 30}, ""},
+		{ct.ProcessType{StopSignal: "SIGKILL"}, "processes.web.stop_signal"},
+		{ct.ProcessType{StopSignal: "quit"}, "processes.web.stop_signal"},
+		{ct.ProcessType{KillTimeout: -1}, "processes.web.kill_timeout"},
+		{ct.ProcessType{KillTimeout: 7200}, "processes.web.kill_timeout"},
+	} {
+		err := validateStopSignal("processes.web", t.typ)
+		if t.field == "" {
+			c.Assert(err, IsNil, Commentf("%+v", t.typ))
+			continue
+		}
+		c.Assert(err, FitsTypeOf, ct.ValidationError{}, Commentf("%+v", t.typ))
+		c.Assert(err.(ct.ValidationError).Field, Equals, t.field, Commentf("%+v", t.typ))
+	}
+}
+
+func (s *S) TestGetSchemas(c *C) {
+	var docs map[string]map[string]interface{}
+	res, err := s.Get("/schemas", &docs)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(docs, HasLen, len(schemas))
+	c.Assert(docs["releases"]["id"], Equals, "/schemas/releases")
+
+	var doc map[string]interface{}
+	_, err = s.Get("/schemas/webhooks", &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc["required"], DeepEquals, []interface{}{"url"})
+
+	res, _ = s.Get("/schemas/foo", &doc)
+	c.Assert(res.StatusCode, Equals, 404)
+
+	// route bodies are validated before reaching the router
+	app := s.createTestApp(c, &ct.App{Name: "schema-routes"})
+	res, _ = s.Post("/apps/"+app.ID+"/routes", map[string]string{"type": "ftp"}, &ct.ValidationError{})
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (ValidationSuite) TestValidatePorts(c *C) {
+	for _, t := range []struct {
+		processes map[string]ct.ProcessType
+		field     string
+	}{
+		{map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Proto: "tcp"}, {Proto: "tcp"}}}}, ""},
+		{map[string]ct.ProcessType{
+			"web":    {Ports: []ct.Port{{Port: 8080, Proto: "tcp", HostPort: 80}}},
+			"worker": {Ports: []ct.Port{{Port: 80, Proto: "udp"}}},
+		}, ""},
+		{map[string]ct.ProcessType{
+			"web":    {Ports: []ct.Port{{Port: 8080, Proto: "tcp", HostPort: 80}}},
+			"worker": {Ports: []ct.Port{{Port: 80, Proto: "tcp"}}},
+		}, "processes.worker.ports[0]"},
+		{map[string]ct.ProcessType{"web": {Ports: []ct.Port{
+			{Port: 5000, RangeEnd: 5010, Proto: "udp"},
+			{Port: 6000, Proto: "udp", HostPort: 5005},
+		}}}, "processes.web.ports[1]"},
+		{map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Port: 5000, RangeEnd: 5010, Proto: "tcp", HostPort: 6000}}}}, "processes.web.ports[0].host_port"},
+		{map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Port: 5000, RangeEnd: 4000, Proto: "tcp"}}}}, "processes.web.ports[0].range_end"},
+		{map[string]ct.ProcessType{"web": {Ports: []ct.Port{{Proto: "tcp", HostPort: 70000}}}}, "processes.web.ports[0].host_port"},
+	} {
+		err := validatePorts(&ct.Release{Processes: t.processes})
+		if t.field == "" {
+			c.Assert(err, IsNil, Commentf("%+v", t.processes))
+			continue
+		}
+		c.Assert(err, FitsTypeOf, ct.ValidationError{}, Commentf("%+v", t.processes))
+		c.Assert(err.(ct.ValidationError).Field, Equals, t.field, Commentf("%+v", t.processes))
+	}
+}
+
+func (ValidationSuite) TestValidateLogDriver(c *C) {
+	for _, t := range []struct {
+		driver *ct.LogDriver
+		field  string
+	}{
+		{nil, ""},
+		{&ct.LogDriver{Name: "null"}, ""},
+		{&ct.LogDriver{Name: "remote", URL: "syslog+tls://logs.example.com:6514"}, ""},
+		{&ct.LogDriver{Name: "journald", URL: "syslog://logs.example.com:514"}, "processes.web.log_driver.url"},
+		{&ct.LogDriver{Name: "remote"}, "processes.web.log_driver.url"},
+		{&ct.LogDriver{Name: "remote", URL: "syslog://logs.example.com"}, "processes.web.log_driver.url"},
+	} {
+		err := validateLogDriver("processes.web", t.driver)
+		if t.field == "" {
+			c.Assert(err, IsNil, Commentf("%+v", t.driver))
+			continue
+		}
+		c.Assert(err, FitsTypeOf, ct.ValidationError{}, Commentf("%+v", t.driver))
+		c.Assert(err.(ct.ValidationError).Field, Equals, t.field, Commentf("%+v", t.driver))
+	}
+}
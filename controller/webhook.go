@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-sql"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/go-martini/martini"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+const (
+	// webhookTimeout is how long a receiver has to respond to a webhook
+	// request.
+	webhookTimeout = 10 * time.Second
+
+	// maxWebhookAttempts is the number of times a delivery is attempted
+	// before it fails.
+	maxWebhookAttempts = 8
+
+	// webhookRetryDelay is the delay before the first retry of a delivery,
+	// it doubles with each attempt up to maxWebhookRetryDelay.
+	webhookRetryDelay    = 10 * time.Second
+	maxWebhookRetryDelay = time.Hour
+
+	// webhookBatchSize is the maximum number of deliveries sent by each run
+	// of the sender.
+	webhookBatchSize = 100
+)
+
+// webhookObjectTypes are the types of the events which may be delivered to
+// webhooks, see webhookEventType.
+var webhookObjectTypes = []string{
+	ct.EventTypeDeployment,
+	ct.EventTypeAppRelease,
+	ct.EventTypeFormation,
+	ct.EventTypeJob,
+}
+
+// webhookEventType returns the webhook event type of the event, or an empty
+// string if it is not delivered to webhooks.
+func webhookEventType(e *ct.Event) string {
+	switch e.ObjectType {
+	case ct.EventTypeDeployment, ct.EventTypeAppRelease:
+		return ct.WebhookEventDeploy
+	case ct.EventTypeFormation:
+		return ct.WebhookEventScale
+	case ct.EventTypeJob:
+		var job ct.Job
+		if json.Unmarshal(e.Data, &job) == nil && job.State == "crashed" {
+			return ct.WebhookEventCrash
+		}
+	}
+	return ""
+}
+
+// webhookWants returns whether events of the type are sent to the webhook.
+func webhookWants(w *ct.Webhook, typ string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookBackoff returns the delay before retrying a delivery which has
+// been attempted the given number of times.
+func webhookBackoff(attempts int) time.Duration {
+	delay := webhookRetryDelay
+	for i := 1; i < attempts && delay < maxWebhookRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxWebhookRetryDelay {
+		delay = maxWebhookRetryDelay
+	}
+	return delay
+}
+
+type WebhookRepo struct {
+	db     *DB
+	events *EventRepo
+}
+
+func NewWebhookRepo(db *DB, events *EventRepo) *WebhookRepo {
+	return &WebhookRepo{db: db, events: events}
+}
+
+// Add creates the webhook, generating a secret if one is not set. Only
+// events created after the webhook are delivered to it.
+func (r *WebhookRepo) Add(w *ct.Webhook) error {
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ct.ValidationError{Field: "url", Message: "must be an http or https URL"}
+	}
+	for _, e := range w.Events {
+		switch e {
+		case ct.WebhookEventDeploy, ct.WebhookEventScale, ct.WebhookEventCrash:
+		default:
+			return ct.ValidationError{Field: "events", Message: "must be deploy, scale or crash"}
+		}
+	}
+	var appID, events *string
+	if w.AppID != "" {
+		app, err := selectApp(r.db, w.AppID, false)
+		if err == ErrNotFound {
+			return ct.ValidationError{Field: "app", Message: "app " + w.AppID + " does not exist"}
+		} else if err != nil {
+			return err
+		}
+		w.AppID = app.ID
+		appID = &w.AppID
+	}
+	if len(w.Events) > 0 {
+		s := strings.Join(w.Events, ",")
+		events = &s
+	}
+	if w.Secret == "" {
+		w.Secret = random.Hex(20)
+	}
+	err := r.db.QueryRow("INSERT INTO webhooks (url, secret, events, app_id, last_event_id) VALUES ($1, $2, $3, $4, (SELECT COALESCE(MAX(event_id), 0) FROM events)) RETURNING webhook_id, created_at",
+		w.URL, w.Secret, events, appID).Scan(&w.ID, &w.CreatedAt)
+	w.ID = cleanUUID(w.ID)
+	return err
+}
+
+const webhookColumns = "webhook_id, url, secret, events, app_id, created_at"
+
+func scanWebhook(s Scanner) (*ct.Webhook, error) {
+	w := &ct.Webhook{}
+	var events, appID *string
+	if err := s.Scan(&w.ID, &w.URL, &w.Secret, &events, &appID, &w.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	w.ID = cleanUUID(w.ID)
+	w.Events = splitList(events)
+	if appID != nil {
+		w.AppID = cleanUUID(*appID)
+	}
+	return w, nil
+}
+
+// Get returns the webhook including its secret.
+func (r *WebhookRepo) Get(id string) (*ct.Webhook, error) {
+	if !idPattern.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	return scanWebhook(r.db.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE webhook_id = $1 AND deleted_at IS NULL", id))
+}
+
+// List returns the webhooks including their secrets, oldest first.
+func (r *WebhookRepo) List() ([]*ct.Webhook, error) {
+	rows, err := r.db.Query("SELECT " + webhookColumns + " FROM webhooks WHERE deleted_at IS NULL ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	list := []*ct.Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, w)
+	}
+	return list, rows.Err()
+}
+
+// Remove deletes the webhook, its pending deliveries are failed.
+func (r *WebhookRepo) Remove(id string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE webhooks SET deleted_at = now() WHERE webhook_id = $1 AND deleted_at IS NULL", id); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("UPDATE webhook_deliveries SET status = $2, error = 'webhook was deleted', updated_at = now() WHERE webhook_id = $1 AND status = $3",
+		id, ct.WebhookDeliveryFailed, ct.WebhookDeliveryPending); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// queueDeliveries records a pending delivery of each event created since
+// the webhook was last queued which it wants. The webhook is locked while
+// queueing so that each event is only queued once if several controllers
+// are running.
+func (r *WebhookRepo) queueDeliveries(w *ct.Webhook) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	var lastID int64
+	if err := tx.QueryRow("SELECT last_event_id FROM webhooks WHERE webhook_id = $1 AND deleted_at IS NULL FOR UPDATE", w.ID).Scan(&lastID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			// the webhook has been deleted
+			return nil
+		}
+		return err
+	}
+	events, err := r.events.ListEvents(&eventFilter{appID: w.AppID, objectTypes: webhookObjectTypes}, lastID, 0)
+	if err != nil || len(events) == 0 {
+		tx.Rollback()
+		return err
+	}
+	// events are in ID DESC order
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		typ := webhookEventType(e)
+		if typ == "" || !webhookWants(w, typ) {
+			continue
+		}
+		if _, err := tx.Exec("INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, status) VALUES ($1, $2, $3, $4)",
+			w.ID, e.ID, typ, ct.WebhookDeliveryPending); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE webhooks SET last_event_id = $2 WHERE webhook_id = $1", w.ID, events[0].ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+const webhookDeliveryColumns = "delivery_id, webhook_id, event_id, event_type, status, attempts, response_status, error, next_attempt_at, created_at, updated_at"
+
+func scanWebhookDelivery(s Scanner) (*ct.WebhookDelivery, error) {
+	d := &ct.WebhookDelivery{}
+	var status *int
+	var errMsg *string
+	if err := s.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &status, &errMsg, &d.NextAttemptAt, &d.CreatedAt, &d.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	d.WebhookID = cleanUUID(d.WebhookID)
+	if status != nil {
+		d.ResponseStatus = *status
+	}
+	if errMsg != nil {
+		d.Error = *errMsg
+	}
+	if d.Status != ct.WebhookDeliveryPending {
+		d.NextAttemptAt = nil
+	}
+	return d, nil
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]*ct.WebhookDelivery, error) {
+	list := []*ct.WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		list = append(list, d)
+	}
+	return list, rows.Err()
+}
+
+// ListDeliveries returns the webhook's most recent deliveries, newest first.
+func (r *WebhookRepo) ListDeliveries(webhookID string, count int) ([]*ct.WebhookDelivery, error) {
+	rows, err := r.db.Query("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY delivery_id DESC LIMIT $2", webhookID, count)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// claimDeliveries returns up to count pending deliveries which are due at
+// now, oldest first. Their next attempt is moved past the time it takes to
+// send them so that they are not also claimed by another controller.
+func (r *WebhookRepo) claimDeliveries(now time.Time, count int) ([]*ct.WebhookDelivery, error) {
+	rows, err := r.db.Query(`WITH claimed AS (
+    UPDATE webhook_deliveries SET next_attempt_at = $2
+    WHERE status = $3 AND next_attempt_at <= $1 AND delivery_id IN (
+        SELECT delivery_id FROM webhook_deliveries WHERE status = $3 AND next_attempt_at <= $1 ORDER BY delivery_id LIMIT $4
+    ) RETURNING `+webhookDeliveryColumns+`
+) SELECT `+webhookDeliveryColumns+` FROM claimed ORDER BY delivery_id`, now, now.Add(2*webhookTimeout), ct.WebhookDeliveryPending, count)
+	if err != nil {
+		return nil, err
+	}
+	return scanWebhookDeliveries(rows)
+}
+
+// finishDelivery records the result of an attempt to send the delivery.
+func (r *WebhookRepo) finishDelivery(d *ct.WebhookDelivery) error {
+	var status *int
+	var errMsg *string
+	if d.ResponseStatus != 0 {
+		status = &d.ResponseStatus
+	}
+	if d.Error != "" {
+		errMsg = &d.Error
+	}
+	return r.db.QueryRow("UPDATE webhook_deliveries SET status = $2, attempts = $3, response_status = $4, error = $5, next_attempt_at = COALESCE($6, next_attempt_at), updated_at = now() WHERE delivery_id = $1 RETURNING updated_at",
+		d.ID, d.Status, d.Attempts, status, errMsg, d.NextAttemptAt).Scan(&d.UpdatedAt)
+}
+
+// webhookSender queues events for webhooks and sends the deliveries which
+// are due.
+type webhookSender struct {
+	repo   *WebhookRepo
+	client *http.Client
+}
+
+// Run queues and sends deliveries every interval.
+func (s *webhookSender) Run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := s.runOnce(now); err != nil {
+			log.Println("webhooks: error sending deliveries:", err)
+		}
+	}
+}
+
+func (s *webhookSender) runOnce(now time.Time) error {
+	hooks, err := s.repo.List()
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]*ct.Webhook, len(hooks))
+	for _, w := range hooks {
+		byID[w.ID] = w
+		if err := s.repo.queueDeliveries(w); err != nil {
+			log.Printf("webhooks: error queueing deliveries for webhook %s: %s", w.ID, err)
+		}
+	}
+	deliveries, err := s.repo.claimDeliveries(now, webhookBatchSize)
+	if err != nil {
+		return err
+	}
+	for _, d := range deliveries {
+		if w, ok := byID[d.WebhookID]; ok {
+			s.send(w, d, now)
+		} else {
+			d.Status, d.Error = ct.WebhookDeliveryFailed, "webhook was deleted"
+		}
+		if err := s.repo.finishDelivery(d); err != nil {
+			log.Printf("webhooks: error recording delivery %d: %s", d.ID, err)
+		}
+	}
+	return nil
+}
+
+// send attempts the delivery, setting its status and the time of the next
+// attempt if it failed and may be retried.
+func (s *webhookSender) send(w *ct.Webhook, d *ct.WebhookDelivery, now time.Time) {
+	d.Attempts++
+	d.ResponseStatus, d.Error, d.NextAttemptAt = 0, "", nil
+	err := s.post(w, d)
+	switch {
+	case err == nil:
+		d.Status = ct.WebhookDeliverySucceeded
+	case d.Attempts >= maxWebhookAttempts:
+		d.Status, d.Error = ct.WebhookDeliveryFailed, err.Error()
+	default:
+		next := now.Add(webhookBackoff(d.Attempts))
+		d.Status, d.Error, d.NextAttemptAt = ct.WebhookDeliveryPending, err.Error(), &next
+	}
+}
+
+func (s *webhookSender) post(w *ct.Webhook, d *ct.WebhookDelivery) error {
+	event, err := s.repo.events.GetEvent(d.EventID)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(&ct.WebhookPayload{
+		DeliveryID: d.ID,
+		WebhookID:  w.ID,
+		EventType:  d.EventType,
+		Event:      event,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "flynn-controller/"+Version)
+	req.Header.Set(ct.WebhookSignatureHeader, ct.SignWebhook(w.Secret, body))
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+	d.ResponseStatus = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func createWebhook(w ct.Webhook, repo *WebhookRepo, r ResponseHelper) {
+	if err := repo.Add(&w); err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, &w)
+}
+
+func listWebhooks(repo *WebhookRepo, r ResponseHelper) {
+	list, err := repo.List()
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	for _, w := range list {
+		w.Secret = ""
+	}
+	r.JSON(200, list)
+}
+
+func getWebhookMiddleware(c martini.Context, params martini.Params, repo *WebhookRepo, r ResponseHelper) {
+	w, err := repo.Get(params["webhooks_id"])
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	c.Map(w)
+}
+
+func getWebhook(w *ct.Webhook, r ResponseHelper) {
+	w.Secret = ""
+	r.JSON(200, w)
+}
+
+func deleteWebhook(w *ct.Webhook, repo *WebhookRepo, r ResponseHelper) {
+	if err := repo.Remove(w.ID); err != nil {
+		r.Error(err)
+		return
+	}
+	r.WriteHeader(200)
+}
+
+// listWebhookDeliveries responds with the webhook's most recent deliveries,
+// the number of which may be set with the count parameter.
+func listWebhookDeliveries(w *ct.Webhook, req *http.Request, repo *WebhookRepo, r ResponseHelper) {
+	count := 100
+	if v := req.FormValue("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			r.Error(ct.ValidationError{Field: "count", Message: "is invalid"})
+			return
+		}
+		count = n
+	}
+	list, err := repo.ListDeliveries(w.ID, count)
+	if err != nil {
+		r.Error(err)
+		return
+	}
+	r.JSON(200, list)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+type webhookRequest struct {
+	body      []byte
+	signature string
+	payload   ct.WebhookPayload
+}
+
+func (s *S) TestWebhooks(c *C) {
+	requests := make(chan *webhookRequest, 10)
+	status := int32(200)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r := &webhookRequest{signature: req.Header.Get(ct.WebhookSignatureHeader)}
+		r.body, _ = ioutil.ReadAll(req.Body)
+		json.Unmarshal(r.body, &r.payload)
+		requests <- r
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+	nextRequest := func() *webhookRequest {
+		select {
+		case r := <-requests:
+			return r
+		default:
+			c.Fatal("expected a webhook request")
+			return nil
+		}
+	}
+
+	app := s.createTestApp(c, &ct.App{Name: "webhooks"})
+	release := s.createTestRelease(c, &ct.Release{Processes: map[string]ct.ProcessType{"web": {}}})
+
+	res, _ := s.Post("/webhooks", &ct.Webhook{URL: "ftp://example.com"}, &ct.Webhook{})
+	c.Assert(res.StatusCode, Equals, 400)
+	res, _ = s.Post("/webhooks", &ct.Webhook{URL: srv.URL, Events: []string{"release"}}, &ct.Webhook{})
+	c.Assert(res.StatusCode, Equals, 400)
+
+	hook := &ct.Webhook{}
+	_, err := s.Post("/webhooks", &ct.Webhook{URL: srv.URL, Events: []string{ct.WebhookEventScale}, AppID: app.Name}, hook)
+	c.Assert(err, IsNil)
+	c.Assert(hook.Secret, Not(Equals), "")
+	c.Assert(hook.AppID, Equals, app.ID)
+
+	var sender *webhookSender
+	s.m.Invoke(func(w *webhookSender) { sender = w })
+
+	// setting the release is a deploy event, which the webhook does not want
+	s.setAppRelease(c, app.ID, release.ID)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 1}})
+	c.Assert(sender.runOnce(time.Now()), IsNil)
+	r := nextRequest()
+	c.Assert(requests, HasLen, 0)
+	c.Assert(r.signature, Equals, ct.SignWebhook(hook.Secret, r.body))
+	c.Assert(r.payload.WebhookID, Equals, hook.ID)
+	c.Assert(r.payload.EventType, Equals, ct.WebhookEventScale)
+	c.Assert(r.payload.Event.ObjectType, Equals, ct.EventTypeFormation)
+	c.Assert(r.payload.Event.AppID, Equals, app.ID)
+
+	// failed deliveries are retried after a delay
+	atomic.StoreInt32(&status, 500)
+	s.createTestFormation(c, &ct.Formation{AppID: app.ID, ReleaseID: release.ID, Processes: map[string]int{"web": 2}})
+	now := time.Now()
+	c.Assert(sender.runOnce(now), IsNil)
+	nextRequest()
+
+	var deliveries []*ct.WebhookDelivery
+	_, err = s.Get("/webhooks/"+hook.ID+"/deliveries", &deliveries)
+	c.Assert(err, IsNil)
+	c.Assert(deliveries, HasLen, 2)
+	c.Assert(deliveries[0].Status, Equals, ct.WebhookDeliveryPending)
+	c.Assert(deliveries[0].Attempts, Equals, 1)
+	c.Assert(deliveries[0].ResponseStatus, Equals, 500)
+	c.Assert(deliveries[0].NextAttemptAt, NotNil)
+	c.Assert(deliveries[1].Status, Equals, ct.WebhookDeliverySucceeded)
+
+	c.Assert(sender.runOnce(now.Add(time.Second)), IsNil)
+	c.Assert(requests, HasLen, 0)
+
+	atomic.StoreInt32(&status, 200)
+	c.Assert(sender.runOnce(now.Add(webhookBackoff(1))), IsNil)
+	r = nextRequest()
+	c.Assert(r.payload.DeliveryID, Equals, deliveries[0].ID)
+	_, err = s.Get("/webhooks/"+hook.ID+"/deliveries?count=1", &deliveries)
+	c.Assert(err, IsNil)
+	c.Assert(deliveries, HasLen, 1)
+	c.Assert(deliveries[0].Status, Equals, ct.WebhookDeliverySucceeded)
+	c.Assert(deliveries[0].Attempts, Equals, 2)
+	c.Assert(deliveries[0].Error, Equals, "")
+
+	var list []*ct.Webhook
+	_, err = s.Get("/webhooks", &list)
+	c.Assert(err, IsNil)
+	for _, w := range list {
+		c.Assert(w.Secret, Equals, "")
+	}
+
+	res, err = s.Delete("/webhooks/" + hook.ID)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	res, _ = s.Get("/webhooks/"+hook.ID, &ct.Webhook{})
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+type WebhookSuite struct{}
+
+var _ = Suite(&WebhookSuite{})
+
+func (WebhookSuite) TestWebhookEventType(c *C) {
+	for _, t := range []struct {
+		event *ct.Event
+		typ   string
+	}{
+		{&ct.Event{ObjectType: ct.EventTypeDeployment}, ct.WebhookEventDeploy},
+		{&ct.Event{ObjectType: ct.EventTypeAppRelease}, ct.WebhookEventDeploy},
+		{&ct.Event{ObjectType: ct.EventTypeFormation}, ct.WebhookEventScale},
+		{&ct.Event{ObjectType: ct.EventTypeJob, Data: json.RawMessage(`{"state": "crashed"}`)}, ct.WebhookEventCrash},
+		{&ct.Event{ObjectType: ct.EventTypeJob, Data: json.RawMessage(`{"state": "up"}`)}, ""},
+		{&ct.Event{ObjectType: ct.EventTypeApp}, ""},
+	} {
+		c.Assert(webhookEventType(t.event), Equals, t.typ, Commentf("%s", t.event.Data))
+	}
+}
+
+func (WebhookSuite) TestWebhookBackoff(c *C) {
+	c.Assert(webhookBackoff(1), Equals, webhookRetryDelay)
+	c.Assert(webhookBackoff(3), Equals, 4*webhookRetryDelay)
+	c.Assert(webhookBackoff(maxWebhookAttempts*10), Equals, maxWebhookRetryDelay)
+}
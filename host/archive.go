@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// tarDir writes the contents of dir to w as a tar stream, with paths relative
+// to dir.
+func tarDir(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil || name == "." {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			hdr.Uid = int(stat.Uid)
+			hdr.Gid = int(stat.Gid)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// untarDir extracts the tar stream r, written by tarDir, into dir. Paths
+// which would be outside of dir, including through symlinks in the stream,
+// are rejected.
+func untarDir(dir string, r io.Reader) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if !isWithin(".", name) {
+			return fmt.Errorf("archive: invalid path %q", hdr.Name)
+		}
+		path := filepath.Join(root, name)
+		parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if !isWithin(root, parent) {
+			return fmt.Errorf("archive: invalid path %q", hdr.Name)
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, mode); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			// replace symlinks rather than writing to their targets
+			if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		default:
+			// devices and fifos are not expected in volumes
+			continue
+		}
+		// the owner can only be set when running as root
+		if os.Getuid() == 0 {
+			if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+}
+
+// isWithin reports whether the cleaned path is root or inside it.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && !filepath.IsAbs(rel) && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarDir(t *testing.T) {
+	src, err := ioutil.TempDir("", "flynn-host-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	if err := os.MkdirAll(filepath.Join(src, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "a", "b", "file"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b/file", filepath.Join(src, "a", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := tarDir(src, &buf); err != nil {
+		t.Fatal(err)
+	}
+	dst, err := ioutil.TempDir("", "flynn-host-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	if err := untarDir(dst, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dst, "a", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "data" {
+		t.Errorf("expected data, got %q", data)
+	}
+	info, err := os.Stat(filepath.Join(dst, "a", "b", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %s", info.Mode())
+	}
+}
+
+func TestUntarDirInvalidPaths(t *testing.T) {
+	for _, headers := range [][]*tar.Header{
+		{{Name: "../file", Typeflag: tar.TypeReg}},
+		{{Name: "/etc/file", Typeflag: tar.TypeReg}},
+		{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/tmp"}, {Name: "link/file", Typeflag: tar.TypeReg}},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range headers {
+			hdr.Mode = 0644
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tw.Close()
+
+		dir, err := ioutil.TempDir("", "flynn-host-archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := untarDir(dir, &buf); err == nil {
+			t.Errorf("expected an error extracting %s", headers[len(headers)-1].Name)
+		}
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// verifyArtifact checks that the ID of the image pulled for an artifact
+// matches the artifact's checksum, artifacts without a checksum are not
+// verified.
+func verifyArtifact(a host.Artifact, imageID string) error {
+	if a.SHA256 == "" {
+		return nil
+	}
+	if id := strings.TrimPrefix(imageID, "sha256:"); id != a.SHA256 {
+		return fmt.Errorf("artifact checksum mismatch: expected sha256 %s, got %s", a.SHA256, id)
+	}
+	return nil
+}
+
+// artifactLocation returns where the i'th of a job's additional artifacts is
+// mounted in its container.
+func artifactLocation(i int) string {
+	return path.Join("/artifacts", strconv.Itoa(i+1))
+}
+
+// artifactHandler pulls the image of the artifact in the body of
+// POST /artifacts/pull, so that a deploy can warm the hosts it is about to
+// start jobs on.
+type artifactHandler struct {
+	backend Backend
+}
+
+func (h *artifactHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/artifacts/pull" || req.Method != "POST" {
+		http.NotFound(w, req)
+		return
+	}
+	var a host.Artifact
+	if err := json.NewDecoder(req.Body).Decode(&a); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if a.URI == "" {
+		http.Error(w, "artifact uri must be set", 400)
+		return
+	}
+	p, ok := h.backend.(ArtifactPuller)
+	if !ok {
+		http.Error(w, "backend does not support pulling artifacts", 501)
+		return
+	}
+	if err := p.PullArtifact(a); err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(200)
+}
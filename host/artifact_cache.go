@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/pinkerton"
+	"github.com/flynn/flynn/host/types"
+)
+
+// layerStore pulls and deletes image layers, it is implemented by pinkerton.
+type layerStore interface {
+	Pull(uri string) ([]pinkerton.LayerPullInfo, error)
+	Delete(layerID string) error
+}
+
+type pinkertonStore struct{}
+
+func (pinkertonStore) Pull(uri string) ([]pinkerton.LayerPullInfo, error) { return pinkerton.Pull(uri) }
+func (pinkertonStore) Delete(layerID string) error                        { return pinkerton.Delete(layerID) }
+
+// artifactCache tracks the images pulled for artifacts, so that they can be
+// pulled before jobs which use them are started, and evicts the least
+// recently used images which no job is using once their layers take up more
+// than the cache's disk budget. Layers pulled before the host kept track of
+// them are never evicted.
+type artifactCache struct {
+	store  layerStore
+	budget int64 // in bytes, images are not evicted if it is zero
+	file   string
+
+	mtx     sync.Mutex
+	images  map[string]*cachedImage
+	pulling int
+
+	metrics *hostMetrics
+}
+
+type cachedImage struct {
+	ID string
+	// Layers are the image's layers, starting with the base layer.
+	Layers   []cachedLayer
+	LastUsed time.Time
+
+	// refs is the number of jobs using the image, they are acquired again
+	// by the backend when the host restarts.
+	refs int
+}
+
+type cachedLayer struct {
+	ID   string
+	Size int64
+}
+
+func newArtifactCache(file string, store layerStore, budget int64) (*artifactCache, error) {
+	c := &artifactCache{
+		store:  store,
+		budget: budget,
+		file:   file,
+		images: make(map[string]*cachedImage),
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.images); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Pull pulls the image of an artifact for a job with the registry credentials
+// creds, which can be nil, checking it against the artifact's checksum, and
+// returns its ID. The image is not evicted until it is released.
+func (c *artifactCache) Pull(a host.Artifact, creds *host.RegistryAuth) (string, error) {
+	return c.pull(a, creds, true)
+}
+
+// Prefetch pulls the image of an artifact before a job using it is started.
+func (c *artifactCache) Prefetch(a host.Artifact, creds *host.RegistryAuth) error {
+	_, err := c.pull(a, creds, false)
+	return err
+}
+
+func (c *artifactCache) pull(a host.Artifact, creds *host.RegistryAuth, acquire bool) (string, error) {
+	g := grohl.NewContext(grohl.Data{"fn": "pull_artifact", "artifact": a.URI})
+
+	// layers are not evicted while images are being pulled, as they
+	// could be layers of the images
+	c.mtx.Lock()
+	c.pulling++
+	c.mtx.Unlock()
+
+	imageID, layers, err := c.fetch(g, a, creds)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.pulling--
+	if err != nil {
+		return "", err
+	}
+	img, ok := c.images[imageID]
+	if !ok {
+		img = &cachedImage{ID: imageID}
+		c.images[imageID] = img
+	}
+	// pinkerton only reports the top layer of images which were already
+	// pulled, so the layers are kept from the first pull
+	if !ok || len(layers) > len(img.Layers) {
+		img.Layers = make([]cachedLayer, len(layers))
+		for i, l := range layers {
+			img.Layers[i] = cachedLayer{ID: l.ID, Size: l.Size}
+		}
+	}
+	img.LastUsed = time.Now().UTC()
+	if acquire {
+		img.refs++
+	}
+	c.evict(imageID)
+	if err := c.persist(); err != nil {
+		g.Log(grohl.Data{"at": "persist", "status": "error", "err": err})
+	}
+	return imageID, nil
+}
+
+// fetch pulls the image of an artifact and checks it against the artifact's
+// checksum.
+func (c *artifactCache) fetch(g *grohl.Context, a host.Artifact, creds *host.RegistryAuth) (string, []pinkerton.LayerPullInfo, error) {
+	g.Log(grohl.Data{"at": "pull_image"})
+	start := time.Now()
+	layers, err := c.store.Pull(credentialURI(a.URI, creds))
+	c.metrics.pulled(time.Since(start), err)
+	if err != nil {
+		g.Log(grohl.Data{"at": "pull_image", "status": "error", "err": err})
+		return "", nil, err
+	}
+	imageID, err := pinkerton.ImageID(a.URI)
+	if err == pinkerton.ErrNoImageID && len(layers) > 0 {
+		imageID = layers[len(layers)-1].ID
+	} else if err != nil {
+		g.Log(grohl.Data{"at": "image_id", "status": "error", "err": err})
+		return "", nil, err
+	}
+	// the top pulled layer is the image, the ID in the URI is only what
+	// was asked for
+	pulledID := imageID
+	if len(layers) > 0 {
+		pulledID = layers[len(layers)-1].ID
+	}
+	if err := verifyArtifact(a, pulledID); err != nil {
+		g.Log(grohl.Data{"at": "verify_image", "status": "error", "err": err})
+		return "", nil, err
+	}
+	return imageID, layers, nil
+}
+
+// Acquire marks the images as in use by a job, so that they are not evicted.
+func (c *artifactCache) Acquire(imageIDs ...string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, id := range imageIDs {
+		if img, ok := c.images[id]; ok {
+			img.refs++
+		}
+	}
+}
+
+// Release marks the images as no longer in use by a job, evicting images if
+// the cache is over its budget.
+func (c *artifactCache) Release(imageIDs ...string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now().UTC()
+	for _, id := range imageIDs {
+		if img, ok := c.images[id]; ok && img.refs > 0 {
+			img.refs--
+			img.LastUsed = now
+		}
+	}
+	c.evict("")
+	c.persist()
+}
+
+// size returns the total size of the layers of the cached images.
+func (c *artifactCache) size() (size int64) {
+	for _, s := range c.layers() {
+		size += s
+	}
+	return
+}
+
+// layers returns the sizes of the layers of the cached images, keyed by ID.
+func (c *artifactCache) layers() map[string]int64 {
+	layers := make(map[string]int64)
+	for _, img := range c.images {
+		for _, l := range img.Layers {
+			layers[l.ID] = l.Size
+		}
+	}
+	return layers
+}
+
+// evict deletes the least recently used images which are not in use, other
+// than keep, until the cache is within its budget. Layers which are shared
+// with other cached images are kept. It must be called with mtx held.
+func (c *artifactCache) evict(keep string) {
+	if c.budget <= 0 || c.pulling > 0 {
+		return
+	}
+	for c.size() > c.budget {
+		var lru *cachedImage
+		for _, img := range c.images {
+			if img.refs > 0 || img.ID == keep {
+				continue
+			}
+			if lru == nil || img.LastUsed.Before(lru.LastUsed) {
+				lru = img
+			}
+		}
+		if lru == nil {
+			return
+		}
+		g := grohl.NewContext(grohl.Data{"fn": "evict_image", "image.id": lru.ID})
+		delete(c.images, lru.ID)
+		shared := c.layers()
+		// layers are deleted before their parents, and the parents of
+		// shared layers are also shared
+		for i := len(lru.Layers) - 1; i >= 0; i-- {
+			id := lru.Layers[i].ID
+			if _, ok := shared[id]; ok {
+				continue
+			}
+			g.Log(grohl.Data{"at": "delete_layer", "layer.id": id})
+			if err := c.store.Delete(id); err != nil {
+				g.Log(grohl.Data{"at": "delete_layer", "status": "error", "err": err})
+				break
+			}
+		}
+	}
+}
+
+// persist writes the cached images to a temporary file which is renamed over
+// the old one. It must be called with mtx held.
+func (c *artifactCache) persist() error {
+	data, err := json.Marshal(c.images)
+	if err != nil {
+		return err
+	}
+	tmp := c.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.file)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/pinkerton"
+	"github.com/flynn/flynn/host/types"
+)
+
+// fakeLayerStore pulls images whose layers are given by URI and records the
+// layers which are deleted.
+type fakeLayerStore struct {
+	images  map[string][]pinkerton.LayerPullInfo
+	deleted []string
+}
+
+func (s *fakeLayerStore) Pull(uri string) ([]pinkerton.LayerPullInfo, error) {
+	return s.images[uri], nil
+}
+
+func (s *fakeLayerStore) Delete(id string) error {
+	s.deleted = append(s.deleted, id)
+	return nil
+}
+
+func TestArtifactCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layer := func(id string, size int64) pinkerton.LayerPullInfo {
+		return pinkerton.LayerPullInfo{ID: id, Size: size}
+	}
+	store := &fakeLayerStore{images: map[string][]pinkerton.LayerPullInfo{
+		"https://registry.local/a?id=a1": {layer("base", 100), layer("a1", 100)},
+		"https://registry.local/b?id=b1": {layer("base", 100), layer("b1", 100)},
+		"https://registry.local/c?id=c1": {layer("c1", 50)},
+		"https://registry.local/d?id=d1": {layer("d1", 150)},
+	}}
+	file := filepath.Join(dir, "artifacts.json")
+	cache, err := newArtifactCache(file, store, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefetch := func(uri string) {
+		if err := cache.Prefetch(host.Artifact{URI: uri}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the least recently used image is evicted, keeping the base layer it
+	// shares with b
+	prefetch("https://registry.local/a?id=a1")
+	prefetch("https://registry.local/b?id=b1")
+	cache.images["a1"].LastUsed = time.Now().Add(-time.Minute)
+	prefetch("https://registry.local/c?id=c1")
+	if !reflect.DeepEqual(store.deleted, []string{"a1"}) {
+		t.Errorf("expected layer a1 to be deleted, got %v", store.deleted)
+	}
+	if size := cache.size(); size != 250 {
+		t.Errorf("expected cache size 250, got %d", size)
+	}
+
+	// images which are in use are not evicted until they are released
+	store.deleted = nil
+	cache.images["b1"].LastUsed = time.Now().Add(-time.Minute)
+	cache.Acquire("b1")
+	prefetch("https://registry.local/d?id=d1")
+	if _, ok := cache.images["b1"]; !ok {
+		t.Error("expected image b1 in use not to be evicted")
+	}
+	if !reflect.DeepEqual(store.deleted, []string{"c1"}) {
+		t.Errorf("expected layer c1 to be deleted, got %v", store.deleted)
+	}
+	if size := cache.size(); size != 350 {
+		t.Errorf("expected cache size 350, got %d", size)
+	}
+
+	// releasing an image brings the cache back within its budget, b1 was
+	// used last so d1 is evicted
+	cache.Release("b1")
+	if _, ok := cache.images["d1"]; ok {
+		t.Error("expected image d1 to be evicted")
+	}
+	if !reflect.DeepEqual(store.deleted, []string{"c1", "d1"}) {
+		t.Errorf("expected layers c1 and d1 to be deleted, got %v", store.deleted)
+	}
+
+	// images which don't match the artifact's checksum are not cached
+	_, err = cache.Pull(host.Artifact{URI: "https://registry.local/a?id=a1", SHA256: "a2"}, nil)
+	if err == nil {
+		t.Error("expected checksum mismatch error")
+	}
+	if _, ok := cache.images["a1"]; ok {
+		t.Error("expected image a1 not to be cached")
+	}
+
+	// the cached images are restored from the file
+	restored, err := newArtifactCache(file, store, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.images) != 1 || restored.images["b1"] == nil {
+		t.Errorf("expected image b1 to be restored, got %v", restored.images)
+	}
+	if size := restored.size(); size != 200 {
+		t.Errorf("expected restored cache size 200, got %d", size)
+	}
+}
@@ -69,18 +69,19 @@ func (h *attachHandler) attach(req *host.AttachReq, conn io.ReadWriteCloser) {
 	attached := make(chan struct{})
 	failed := make(chan struct{})
 	opts := &AttachRequest{
-		Job:      job,
-		Logs:     req.Flags&host.AttachFlagLogs != 0,
-		Stream:   req.Flags&host.AttachFlagStream != 0,
-		Height:   req.Height,
-		Width:    req.Width,
-		Attached: attached,
+		Job:        job,
+		Logs:       req.Flags&host.AttachFlagLogs != 0,
+		Stream:     req.Flags&host.AttachFlagStream != 0,
+		Timestamps: req.Flags&host.AttachFlagTimestamps != 0,
+		Height:     req.Height,
+		Width:      req.Width,
+		Attached:   attached,
 	}
 	var stdinW *io.PipeWriter
 	if req.Flags&host.AttachFlagStdin != 0 {
 		opts.Stdin, stdinW = io.Pipe()
 	}
-	if req.Flags&host.AttachFlagStdout != 0 {
+	if req.Flags&host.AttachFlagStdout != 0 || opts.Timestamps {
 		opts.Stdout = newFrameWriter(1, w, writeMtx)
 	}
 	if req.Flags&host.AttachFlagStderr != 0 {
@@ -133,6 +134,9 @@ func (h *attachHandler) attach(req *host.AttachReq, conn io.ReadWriteCloser) {
 				if _, err := io.CopyN(stdinW, r, length); err != nil {
 					return
 				}
+			// signals and resizes which fail, for example because the
+			// job is exiting, don't end the session so that stdin is
+			// still forwarded
 			case host.AttachSignal:
 				if _, err := io.ReadFull(r, buf[:]); err != nil {
 					return
@@ -141,21 +145,19 @@ func (h *attachHandler) attach(req *host.AttachReq, conn io.ReadWriteCloser) {
 				g.Log(grohl.Data{"at": "signal", "signal": signal})
 				if err := h.backend.Signal(req.JobID, signal); err != nil {
 					g.Log(grohl.Data{"at": "signal", "status": "error", "err": err})
-					return
 				}
 			case host.AttachResize:
-				if !job.Job.Config.TTY {
-					return
-				}
 				if _, err := io.ReadFull(r, buf[:]); err != nil {
 					return
 				}
+				if !job.Job.Config.TTY {
+					continue
+				}
 				height := binary.BigEndian.Uint16(buf[:])
 				width := binary.BigEndian.Uint16(buf[2:])
 				g.Log(grohl.Data{"at": "tty_resize", "height": height, "width": width})
 				if err := h.backend.ResizeTTY(req.JobID, height, width); err != nil {
 					g.Log(grohl.Data{"at": "tty_resize", "status": "error", "err": err})
-					return
 				}
 			default:
 				return
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+// ttyBackend echoes stdin to stdout and records the signals and TTY resizes
+// it is sent, failing to send SIGINT.
+type ttyBackend struct {
+	Backend
+
+	mtx     sync.Mutex
+	signals []int
+	resizes [][2]uint16
+}
+
+func (b *ttyBackend) Attach(req *AttachRequest) error {
+	req.Attached <- struct{}{}
+	if _, err := io.Copy(req.Stdout, req.Stdin); err != nil {
+		return err
+	}
+	return ExitError(0)
+}
+
+func (b *ttyBackend) Signal(id string, sig int) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.signals = append(b.signals, sig)
+	if sig == 2 {
+		return errors.New("signal failed")
+	}
+	return nil
+}
+
+func (b *ttyBackend) ResizeTTY(id string, height, width uint16) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.resizes = append(b.resizes, [2]uint16{height, width})
+	return nil
+}
+
+func TestAttachSignalResize(t *testing.T) {
+	state := NewState("host0")
+	backend := &ttyBackend{}
+	srv := httptest.NewServer(&attachHandler{state: state, backend: backend})
+	defer srv.Close()
+	client := cluster.NewHostClient(srv.Listener.Addr().String(), nil, nil)
+
+	attach := func(id string, fn func(cluster.AttachClient)) {
+		ac, err := client.Attach(&host.AttachReq{
+			JobID: id,
+			Flags: host.AttachFlagStdin | host.AttachFlagStdout | host.AttachFlagStream,
+		}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ac.Close()
+		fn(ac)
+		if _, err := ac.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := ac.CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		var stdout bytes.Buffer
+		exit, err := ac.Receive(&stdout, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exit != 0 || stdout.String() != "data" {
+			t.Errorf("expected exit status 0 and stdout %q, got %d and %q", "data", exit, stdout.String())
+		}
+	}
+
+	// failed signals and resizes of jobs without a TTY don't end the
+	// session
+	state.AddJob(&host.Job{ID: "a"})
+	attach("a", func(ac cluster.AttachClient) {
+		ac.ResizeTTY(24, 80)
+		ac.Signal(2)
+		ac.Signal(28)
+	})
+	if !reflect.DeepEqual(backend.signals, []int{2, 28}) {
+		t.Errorf("expected signals 2 and 28, got %v", backend.signals)
+	}
+	if len(backend.resizes) != 0 {
+		t.Errorf("expected jobs without a TTY not to be resized, got %v", backend.resizes)
+	}
+
+	state.AddJob(&host.Job{ID: "b", Config: host.ContainerConfig{TTY: true}})
+	attach("b", func(ac cluster.AttachClient) {
+		ac.ResizeTTY(24, 80)
+		ac.ResizeTTY(50, 120)
+	})
+	if expected := [][2]uint16{{24, 80}, {50, 120}}; !reflect.DeepEqual(backend.resizes, expected) {
+		t.Errorf("expected resizes %v, got %v", expected, backend.resizes)
+	}
+}
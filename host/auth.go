@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// authHandler requires requests to the host's API to be made with the token
+// the host was started with, as the password of basic auth, if it has one.
+type authHandler struct {
+	token   string
+	handler http.Handler
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if h.token != "" {
+		_, password, _ := req.BasicAuth()
+		if subtle.ConstantTimeCompare([]byte(password), []byte(h.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="flynn-host"`)
+			http.Error(w, "host: invalid or missing token", 401)
+			return
+		}
+	}
+	h.handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	for _, test := range []struct {
+		token    string
+		password string
+		status   int
+	}{
+		{"", "", 200},
+		{"s3cret", "s3cret", 200},
+		{"s3cret", "", 401},
+		{"s3cret", "s3cre", 401},
+		{"s3cret", "s3cret!", 401},
+	} {
+		req, _ := http.NewRequest("GET", "/host/jobs/1/stats", nil)
+		if test.password != "" {
+			req.SetBasicAuth("", test.password)
+		}
+		w := httptest.NewRecorder()
+		(&authHandler{token: test.token, handler: ok}).ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("token %q, password %q: expected %d, got %d", test.token, test.password, test.status, w.Code)
+		}
+	}
+}
@@ -2,17 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
+	"sort"
 
+	"github.com/flynn/flynn/host/ports"
 	"github.com/flynn/flynn/host/types"
 )
 
 type AttachRequest struct {
-	Job    *host.ActiveJob
-	Logs   bool
-	Stream bool
-	Height uint16
-	Width  uint16
+	Job        *host.ActiveJob
+	Logs       bool
+	Stream     bool
+	Timestamps bool
+	Height     uint16
+	Width      uint16
 
 	Attached chan struct{}
 
@@ -31,6 +35,99 @@ type Backend interface {
 	RestoreState(map[string]*host.ActiveJob, *json.Decoder) error
 }
 
+// BackendConfig is the configuration of the host which backends are created
+// with. Backends use the fields they support and ignore the others.
+type BackendConfig struct {
+	State    *State
+	Ports    map[string]*ports.Allocator
+	VolPath  string
+	LogPath  string
+	InitPath string
+	BindAddr string
+	Registry *registryAuth
+	Metrics  *hostMetrics
+
+	// ArtifactCacheSize is the disk budget in bytes of backends which
+	// cache pulled images.
+	ArtifactCacheSize int64
+
+	Checkpoints *checkpointManager
+	Profiles    *securityProfiles
+}
+
+// BackendFunc creates a backend from the host's configuration.
+type BackendFunc func(*BackendConfig) (Backend, error)
+
+// backends are the runtimes jobs can be run with by name. Each backend
+// registers itself from its own file, so the daemon only refers to them by the
+// name it is configured with.
+var backends = make(map[string]BackendFunc)
+
+func registerBackend(name string, fn BackendFunc) {
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("host: backend %q registered twice", name))
+	}
+	backends[name] = fn
+}
+
+// backendNames returns the names of the registered backends in order.
+func backendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newBackend creates the backend registered with the given name.
+func newBackend(name string, c *BackendConfig) (Backend, error) {
+	fn, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("host: unknown backend %q, the backends are %v", name, backendNames())
+	}
+	return fn(c)
+}
+
 type StateSaver interface {
 	SaveState(*json.Encoder) error
 }
+
+// StatsReader is implemented by backends which can read the resource usage of
+// running jobs.
+type StatsReader interface {
+	JobStats(id string) (*host.JobStats, error)
+}
+
+// ArtifactPuller is implemented by backends which can pull the image of an
+// artifact before a job using it is started.
+type ArtifactPuller interface {
+	PullArtifact(host.Artifact) error
+}
+
+// Execer is implemented by backends which can run additional commands in the
+// container of a running job.
+type Execer interface {
+	Exec(jobID string, req *host.ExecReq) (ExecProcess, error)
+}
+
+// ExecProcess is a command started by Exec. The streams which weren't
+// requested are nil, as is stderr for commands with a TTY, which write all
+// output to stdout.
+type ExecProcess interface {
+	Streams() (stdin io.WriteCloser, stdout, stderr io.ReadCloser)
+	Signal(sig int) error
+	ResizeTTY(height, width uint16) error
+	Wait() (int, error)
+}
+
+// Checkpointer is implemented by backends which can checkpoint the processes
+// of running jobs with CRIU and restore them, possibly on another host.
+type Checkpointer interface {
+	// Checkpoint dumps the job's processes into a new directory, which it
+	// returns, stopping them unless leaveRunning is set.
+	Checkpoint(jobID string, leaveRunning bool) (string, error)
+	// Restore runs the job by restoring its processes from the checkpoint
+	// in dir, which is removed once the job stops.
+	Restore(job *host.Job, dir string) error
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNewBackend(t *testing.T) {
+	for _, name := range []string{"docker", "libvirt-lxc"} {
+		if _, ok := backends[name]; !ok {
+			t.Errorf("backend %q is not registered", name)
+		}
+	}
+
+	errTest := errors.New("test backend")
+	var config *BackendConfig
+	registerBackend("test", func(c *BackendConfig) (Backend, error) {
+		config = c
+		return nil, errTest
+	})
+	defer delete(backends, "test")
+
+	c := &BackendConfig{VolPath: "/tmp"}
+	if _, err := newBackend("test", c); err != errTest {
+		t.Errorf("expected the test backend's error, got %v", err)
+	}
+	if config != c {
+		t.Errorf("the test backend was not created with the config")
+	}
+
+	_, err := newBackend("runc", c)
+	if err == nil || !strings.Contains(err.Error(), `unknown backend "runc"`) || !strings.Contains(err.Error(), "docker libvirt-lxc test") {
+		t.Errorf("unexpected error for an unknown backend: %v", err)
+	}
+}
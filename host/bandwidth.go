@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// shapeBandwidth applies the job's network bandwidth limits to iface, the
+// host's end of the job's veth pair. Traffic the host sends to the veth is
+// received by the job, so its ingress limit is a token bucket on the veth's
+// egress, and its egress limit polices the packets the veth receives, which
+// are dropped above the rate so that TCP senders back off.
+func shapeBandwidth(iface string, r *host.JobResources) error {
+	for _, args := range tcCommands(iface, r) {
+		if err := tc(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tcCommands(iface string, r *host.JobResources) [][]string {
+	var cmds [][]string
+	if r.IngressRate > 0 {
+		cmds = append(cmds, []string{
+			"qdisc", "add", "dev", iface, "root", "tbf",
+			"rate", rate(r.IngressRate),
+			"burst", burst(r.IngressRate),
+			"latency", "50ms",
+		})
+	}
+	if r.EgressRate > 0 {
+		cmds = append(cmds,
+			[]string{"qdisc", "add", "dev", iface, "handle", "ffff:", "ingress"},
+			[]string{
+				"filter", "add", "dev", iface, "parent", "ffff:",
+				"protocol", "all", "u32", "match", "u32", "0", "0",
+				"police", "rate", rate(r.EgressRate), "burst", burst(r.EgressRate),
+				"drop", "flowid", ":1",
+			},
+		)
+	}
+	return cmds
+}
+
+func rate(bits int64) string {
+	return strconv.FormatInt(bits, 10) + "bit"
+}
+
+// burst returns the bucket size for a rate, which is the bytes sent at the
+// rate in 10ms but at least 32 KiB so that the bucket holds several full
+// sized packets at low rates.
+func burst(bits int64) string {
+	size := bits / 8 / 100
+	if size < 32<<10 {
+		size = 32 << 10
+	}
+	return strconv.FormatInt(size, 10) + "b"
+}
+
+// tc runs tc, including its error output in the error.
+func tc(args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command("tc", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("tc %s: %s: %s", strings.Join(args[:2], " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+func TestTCCommands(t *testing.T) {
+	if cmds := tcCommands("veth0", &host.JobResources{}); len(cmds) != 0 {
+		t.Errorf("expected no commands without limits, got %v", cmds)
+	}
+
+	cmds := tcCommands("veth0", &host.JobResources{EgressRate: 1000000, IngressRate: 100000000})
+	expected := [][]string{
+		{"qdisc", "add", "dev", "veth0", "root", "tbf", "rate", "100000000bit", "burst", "125000b", "latency", "50ms"},
+		{"qdisc", "add", "dev", "veth0", "handle", "ffff:", "ingress"},
+		{"filter", "add", "dev", "veth0", "parent", "ffff:", "protocol", "all", "u32", "match", "u32", "0", "0", "police", "rate", "1000000bit", "burst", "32768b", "drop", "flowid", ":1"},
+	}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("expected %v, got %v", expected, cmds)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+// memoryCgroup returns the path of the memory cgroup of the process with the
+// given pid.
+func memoryCgroup(pid int) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return parseMemoryCgroup(f)
+}
+
+// parseMemoryCgroup finds the memory cgroup in the contents of a
+// /proc/<pid>/cgroup file.
+func parseMemoryCgroup(r io.Reader) (string, error) {
+	paths, err := parseCgroups(r)
+	if err != nil {
+		return "", err
+	}
+	path, ok := paths["memory"]
+	if !ok {
+		return "", errors.New("cgroup: memory cgroup not found")
+	}
+	return path, nil
+}
+
+// cgroups returns the paths of the cgroups of the process with the given pid,
+// keyed by subsystem.
+func cgroups(pid int) (map[string]string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseCgroups(f)
+}
+
+// parseCgroups parses the contents of a /proc/<pid>/cgroup file, which has
+// lines like "4:memory:/machine/foo". Subsystems which are mounted together
+// are each mapped to their own path under cgroupRoot.
+func parseCgroups(r io.Reader) (map[string]string, error) {
+	paths := make(map[string]string)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, subsystem := range strings.Split(parts[1], ",") {
+			if subsystem == "" || strings.HasPrefix(subsystem, "name=") {
+				continue
+			}
+			paths[subsystem] = filepath.Join(cgroupRoot, subsystem, parts[2])
+		}
+	}
+	return paths, s.Err()
+}
+
+// notifyOOM calls fn each time the processes in the memory cgroup at path
+// run out of memory and the kernel's OOM killer runs. It returns once the
+// notification is registered, and stops notifying when the cgroup is
+// removed.
+func notifyOOM(path string, fn func()) error {
+	oomControl, err := os.Open(filepath.Join(path, "memory.oom_control"))
+	if err != nil {
+		return err
+	}
+	defer oomControl.Close()
+	fd, _, errno := syscall.RawSyscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC, 0)
+	if errno != 0 {
+		return errno
+	}
+	eventfd := os.NewFile(fd, "eventfd")
+	control := fmt.Sprintf("%d %d", fd, oomControl.Fd())
+	if err := ioutil.WriteFile(filepath.Join(path, "cgroup.event_control"), []byte(control), 0); err != nil {
+		eventfd.Close()
+		return err
+	}
+	go func() {
+		defer eventfd.Close()
+		buf := make([]byte, 8)
+		for {
+			if _, err := eventfd.Read(buf); err != nil {
+				return
+			}
+			// the eventfd is also signalled when the cgroup is removed
+			if _, err := os.Stat(filepath.Join(path, "cgroup.event_control")); os.IsNotExist(err) {
+				return
+			}
+			fn()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMemoryCgroup(t *testing.T) {
+	for _, test := range []struct {
+		cgroups string
+		path    string
+	}{
+		{"4:memory:/machine/job1.libvirt-lxc\n3:cpuacct,cpu:/machine/job1.libvirt-lxc\n", "/sys/fs/cgroup/memory/machine/job1.libvirt-lxc"},
+		{"2:cpu,memory:/lxc/job1\n", "/sys/fs/cgroup/memory/lxc/job1"},
+		{"3:cpuacct,cpu:/\n", ""},
+	} {
+		path, err := parseMemoryCgroup(strings.NewReader(test.cgroups))
+		if test.path == "" {
+			if err == nil {
+				t.Errorf("expected an error for %q, got %s", test.cgroups, path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", test.cgroups, err)
+		} else if path != test.path {
+			t.Errorf("expected path %s for %q, got %s", test.path, test.cgroups, path)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+var (
+	errCheckpointDisabled = errors.New("host: checkpoint/restore is disabled, start the daemon with --experimental-checkpoint to enable it")
+	errNoCheckpoint       = errors.New("host: the backend does not support checkpoint/restore")
+	errUnknownCheckpoint  = errors.New("host: unknown checkpoint")
+)
+
+// checkpointJobFile is the file in a checkpoint with the checkpointed job.
+const checkpointJobFile = "job.json"
+
+var checkpointIDPattern = regexp.MustCompile(`^[a-f0-9-]+$`)
+
+// checkpointManager checkpoints running jobs with CRIU and keeps the
+// checkpoints received from other hosts until jobs are restored from them.
+// It is nil when checkpoint/restore is disabled.
+type checkpointManager struct {
+	// dir contains the received checkpoints, and the directory of each job
+	// started while checkpointing is enabled in jobs/ID, which is mounted
+	// into the job's container for criu to write checkpoints to.
+	dir string
+	// criu is the path of the criu binary, which is mounted into the
+	// containers of jobs.
+	criu string
+
+	state   *State
+	backend Backend
+}
+
+func newCheckpointManager(dir, criu string, state *State) (*checkpointManager, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "jobs"), 0700); err != nil {
+		return nil, err
+	}
+	return &checkpointManager{dir: dir, criu: criu, state: state}, nil
+}
+
+// JobDir returns the checkpoint directory of the job.
+func (m *checkpointManager) JobDir(jobID string) string {
+	return filepath.Join(m.dir, "jobs", jobID)
+}
+
+func (m *checkpointManager) checkpointer() (Checkpointer, error) {
+	if m == nil {
+		return nil, errCheckpointDisabled
+	}
+	c, ok := m.backend.(Checkpointer)
+	if !ok {
+		return nil, errNoCheckpoint
+	}
+	return c, nil
+}
+
+// Checkpoint checkpoints the running job with the given ID and returns the
+// directory of the checkpoint, which the caller removes once it has been
+// sent. The job is stopped unless leaveRunning is set.
+func (m *checkpointManager) Checkpoint(id string, leaveRunning bool) (string, error) {
+	c, err := m.checkpointer()
+	if err != nil {
+		return "", err
+	}
+	job := m.state.GetJob(id)
+	if job == nil {
+		return "", errJobNotFound
+	}
+	if job.Status != host.StatusRunning {
+		return "", errJobNotRunning
+	}
+	dir, err := c.Checkpoint(id, leaveRunning)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(job.Job)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, checkpointJobFile), data, 0600)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// Receive stores a checkpoint sent by another host.
+func (m *checkpointManager) Receive(r io.Reader) (*host.Checkpoint, error) {
+	if _, err := m.checkpointer(); err != nil {
+		return nil, err
+	}
+	checkpoint := &host.Checkpoint{ID: random.UUID(), CreatedAt: time.Now().UTC()}
+	dir := filepath.Join(m.dir, checkpoint.ID)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return nil, err
+	}
+	err := untarDir(dir, r)
+	if err == nil {
+		var data []byte
+		if data, err = ioutil.ReadFile(filepath.Join(dir, checkpointJobFile)); err == nil {
+			err = json.Unmarshal(data, &checkpoint.Job)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// Restore runs the job by restoring its processes from the checkpoint given
+// by job.Checkpoint, which is removed once the job stops.
+func (m *checkpointManager) Restore(job *host.Job) error {
+	c, err := m.checkpointer()
+	if err != nil {
+		return err
+	}
+	if !checkpointIDPattern.MatchString(job.Checkpoint) {
+		return errUnknownCheckpoint
+	}
+	dir := filepath.Join(m.dir, job.Checkpoint)
+	if _, err := os.Stat(dir); err != nil {
+		return errUnknownCheckpoint
+	}
+	return c.Restore(job, dir)
+}
+
+// checkpointHandler serves POST /host/jobs/:id/checkpoint, which checkpoints
+// a running job and responds with the checkpoint as a tar stream (the job is
+// stopped unless ?leave_running=true), and POST /host/checkpoints, which
+// receives a checkpoint from another host.
+type checkpointHandler struct {
+	checkpoints *checkpointManager
+}
+
+func (h *checkpointHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.NotFound(w, req)
+		return
+	}
+	if req.URL.Path == "/host/checkpoints" {
+		checkpoint, err := h.checkpoints.Receive(req.Body)
+		if err != nil {
+			writeJobError(w, err)
+			return
+		}
+		writeJSON(w, 200, checkpoint)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/host/jobs"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "checkpoint" {
+		http.NotFound(w, req)
+		return
+	}
+	id := parts[0]
+	g := grohl.NewContext(grohl.Data{"fn": "checkpoint", "job.id": id})
+	g.Log(grohl.Data{"at": "start"})
+	dir, err := h.checkpoints.Checkpoint(id, req.FormValue("leave_running") == "true")
+	if err != nil {
+		g.Log(grohl.Data{"at": "checkpoint", "status": "error", "err": err})
+		writeJobError(w, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.WriteHeader(200)
+	if err := tarDir(dir, w); err != nil {
+		g.Log(grohl.Data{"at": "send", "status": "error", "err": err})
+		return
+	}
+	g.Log(grohl.Data{"at": "finish"})
+}
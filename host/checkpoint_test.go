@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+// checkpointBackend writes the ID of the job to a file in its checkpoints.
+type checkpointBackend struct {
+	Backend
+
+	dir      string
+	restored map[string]string
+}
+
+func (b *checkpointBackend) Checkpoint(id string, leaveRunning bool) (string, error) {
+	dir, err := ioutil.TempDir(b.dir, "dump-")
+	if err != nil {
+		return "", err
+	}
+	return dir, ioutil.WriteFile(filepath.Join(dir, "pages.img"), []byte(id), 0600)
+}
+
+func (b *checkpointBackend) Restore(job *host.Job, dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "pages.img"))
+	if err != nil {
+		return err
+	}
+	b.restored[job.ID] = string(data)
+	return nil
+}
+
+func newCheckpointServer(t *testing.T, dir string, backend Backend) (*State, *checkpointManager, cluster.Host, func()) {
+	state := NewState("host0")
+	state.AddJob(&host.Job{ID: "a", Config: host.ContainerConfig{Cmd: []string{"redis-server"}}})
+	state.SetStatusRunning("a")
+	state.AddJob(&host.Job{ID: "b"})
+
+	var checkpoints *checkpointManager
+	if dir != "" {
+		var err error
+		checkpoints, err = newCheckpointManager(dir, "/usr/sbin/criu", state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkpoints.backend = backend
+	}
+	handler := &checkpointHandler{checkpoints: checkpoints}
+	mux := http.NewServeMux()
+	mux.Handle("/host/jobs/", handler)
+	mux.Handle("/host/checkpoints", handler)
+	srv := httptest.NewServer(mux)
+	return state, checkpoints, cluster.NewHostClient(srv.Listener.Addr().String(), nil, nil), srv.Close
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := &checkpointBackend{dir: dir, restored: make(map[string]string)}
+	_, _, src, cleanup := newCheckpointServer(t, filepath.Join(dir, "src"), backend)
+	defer cleanup()
+	_, dstCheckpoints, dst, cleanup := newCheckpointServer(t, filepath.Join(dir, "dst"), backend)
+	defer cleanup()
+
+	stream, err := src.CheckpointJob("a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, err := dst.ReceiveCheckpoint(stream)
+	stream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.Job == nil || checkpoint.Job.ID != "a" || len(checkpoint.Job.Config.Cmd) != 1 {
+		t.Fatalf("expected the checkpoint of job a, got %+v", checkpoint.Job)
+	}
+	// the checkpoint is removed from the source host once it is sent
+	if dumps, _ := filepath.Glob(filepath.Join(dir, "dump-*")); len(dumps) != 0 {
+		t.Errorf("expected the sent checkpoint to be removed, got %v", dumps)
+	}
+
+	job := &host.Job{ID: "c", Checkpoint: checkpoint.ID}
+	if err := dstCheckpoints.Restore(job); err != nil {
+		t.Fatal(err)
+	}
+	if backend.restored["c"] != "a" {
+		t.Errorf("expected job c to be restored from the checkpoint of job a, got %q", backend.restored["c"])
+	}
+
+	for _, id := range []string{"unknown", "../jobs"} {
+		if err := dstCheckpoints.Restore(&host.Job{ID: "d", Checkpoint: id}); err != errUnknownCheckpoint {
+			t.Errorf("expected errUnknownCheckpoint restoring %q, got %v", id, err)
+		}
+	}
+}
+
+func TestCheckpointErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, _, client, cleanup := newCheckpointServer(t, dir, &checkpointBackend{dir: dir})
+	defer cleanup()
+	if _, err := client.CheckpointJob("b", false); err != cluster.ErrJobNotRunning {
+		t.Errorf("expected ErrJobNotRunning, got %v", err)
+	}
+	if _, err := client.CheckpointJob("c", false); err != cluster.ErrJobNotFound {
+		t.Errorf("expected ErrJobNotFound, got %v", err)
+	}
+
+	_, _, client, cleanup = newCheckpointServer(t, dir, struct{ Backend }{})
+	defer cleanup()
+	if _, err := client.CheckpointJob("a", false); err == nil || !strings.Contains(err.Error(), "501") {
+		t.Errorf("expected a 501 error from a backend without checkpoint/restore, got %v", err)
+	}
+
+	_, _, client, cleanup = newCheckpointServer(t, "", nil)
+	defer cleanup()
+	if _, err := client.CheckpointJob("a", false); err == nil || !strings.Contains(err.Error(), "--experimental-checkpoint") {
+		t.Errorf("expected an error when checkpoint/restore is disabled, got %v", err)
+	}
+	if _, err := client.ReceiveCheckpoint(strings.NewReader("")); err == nil || !strings.Contains(err.Error(), "501") {
+		t.Errorf("expected a 501 error receiving a checkpoint when it is disabled, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+func init() {
+	Register("drain", runDrain, `
+usage: flynn-host drain [--wait] [--timeout=DURATION] HOST
+
+Stop a host accepting new jobs and move its jobs to other hosts, for example
+before rebooting it. Jobs with volumes are not moved and must be stopped once
+their data has been moved.
+
+options:
+  --wait                wait until every job which can be moved has stopped
+  --timeout=DURATION    how long to wait [default: 10m]`)
+}
+
+func runDrain(args *docopt.Args, client *cluster.Client) error {
+	timeout, err := time.ParseDuration(args.String["--timeout"])
+	if err != nil {
+		return fmt.Errorf("invalid --timeout %q", args.String["--timeout"])
+	}
+	hostID := args.String["HOST"]
+	h, err := client.DialHost(hostID)
+	if err != nil {
+		return fmt.Errorf("could not connect to host %s: %s", hostID, err)
+	}
+	defer h.Close()
+
+	status, err := h.Drain()
+	if err != nil {
+		return err
+	}
+	fmt.Println(hostID, "draining")
+	if args.Bool["--wait"] {
+		deadline := time.Now().Add(timeout)
+		left := -1
+		for movableJobs(status) > 0 {
+			if n := movableJobs(status); n != left {
+				fmt.Printf("%d jobs left\n", n)
+				left = n
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out with %d jobs left", left)
+			}
+			time.Sleep(time.Second)
+			if status, err = h.DrainStatus(); err != nil {
+				return err
+			}
+		}
+		fmt.Println(hostID, "drained")
+	}
+	if len(status.VolumeJobs) > 0 {
+		fmt.Println("jobs with volumes left running:", strings.Join(status.VolumeJobs, " "))
+	}
+	return nil
+}
+
+// movableJobs returns the number of jobs on a draining host which the
+// scheduler moves to other hosts.
+func movableJobs(status *host.DrainStatus) int {
+	return len(status.Jobs) - len(status.VolumeJobs)
+}
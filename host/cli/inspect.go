@@ -41,6 +41,8 @@ func printJobDesc(job *host.ActiveJob, out io.Writer) {
 	fmt.Fprintln(w, "StartedAt\t", job.StartedAt)
 	fmt.Fprintln(w, "EndedAt\t", job.EndedAt)
 	fmt.Fprintln(w, "ExitStatus\t", job.ExitStatus)
+	fmt.Fprintln(w, "OOMKilled\t", job.OOMKilled)
+	fmt.Fprintln(w, "ForceKilled\t", job.ForceKilled)
 	fmt.Fprintln(w, "IP Address\t", job.InternalIP)
 	for k, v := range job.Job.Metadata {
 		fmt.Fprintln(w, k, "\t", v)
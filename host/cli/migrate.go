@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+func init() {
+	Register("migrate", runMigrate, `
+usage: flynn-host migrate [--leave-running] ID TARGET
+
+Checkpoint a running job with CRIU and restore it on the host TARGET,
+printing the ID of the restored job. This is experimental and both hosts must
+be started with --experimental-checkpoint.
+
+Jobs with a TTY or mounts can't be migrated, and the restored job has a new
+IP address so its established TCP connections are closed.
+
+options:
+  --leave-running  keep the job running on its host after checkpointing it`)
+}
+
+func runMigrate(args *docopt.Args, client *cluster.Client) error {
+	hostID, jobID, err := cluster.ParseJobID(args.String["ID"])
+	if err != nil {
+		return err
+	}
+	h, err := client.DialHost(hostID)
+	if err != nil {
+		return fmt.Errorf("could not dial host %s: %s", hostID, err)
+	}
+	defer h.Close()
+	job, err := client.MigrateJob(h, args.String["TARGET"], jobID, args.Bool["--leave-running"])
+	if err != nil {
+		return err
+	}
+	fmt.Println(args.String["TARGET"] + "-" + job.ID)
+	return nil
+}
@@ -0,0 +1,84 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+func init() {
+	Register("pull", runPull, `
+usage: flynn-host pull [--sha256=SUM] [--parallel=N] URI [HOST...]
+
+Pull the image of an artifact on the given hosts, or on every host, before
+jobs using it are started.
+
+options:
+  --sha256=SUM   checksum the pulled image must match
+  --parallel=N   number of hosts which pull at the same time [default: 4]`)
+}
+
+func runPull(args *docopt.Args, client *cluster.Client) error {
+	artifact := host.Artifact{URI: args.String["URI"], SHA256: args.String["--sha256"]}
+	parallel, err := strconv.Atoi(args.String["--parallel"])
+	if err != nil || parallel < 1 {
+		return fmt.Errorf("invalid --parallel %q", args.String["--parallel"])
+	}
+
+	hostIDs := args.All["HOST"].([]string)
+	if len(hostIDs) == 0 {
+		hosts, err := client.ListHosts()
+		if err != nil {
+			return err
+		}
+		for id := range hosts {
+			hostIDs = append(hostIDs, id)
+		}
+		sort.Strings(hostIDs)
+	}
+
+	// hosts pull in batches so that they don't all hit the registry at once
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	success := true
+	sem := make(chan struct{}, parallel)
+	for _, id := range hostIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(id string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := pullArtifact(client, id, artifact)
+			mtx.Lock()
+			defer mtx.Unlock()
+			if err != nil {
+				fmt.Printf("could not pull on host %s: %s\n", id, err)
+				success = false
+				return
+			}
+			fmt.Println(id, "pulled")
+		}(id)
+	}
+	wg.Wait()
+	if !success {
+		return errors.New("could not pull on all hosts")
+	}
+	return nil
+}
+
+func pullArtifact(client *cluster.Client, hostID string, a host.Artifact) error {
+	h, err := client.DialHost(hostID)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	return h.PullArtifact(a)
+}
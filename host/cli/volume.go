@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/pkg/units"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/go-docopt"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+func init() {
+	Register("volume", runVolume, `
+usage: flynn-host volume list [HOST...]
+       flynn-host volume create HOST
+       flynn-host volume destroy HOST ID
+       flynn-host volume snapshot HOST ID
+       flynn-host volume migrate HOST ID TARGET`)
+}
+
+func runVolume(args *docopt.Args, client *cluster.Client) error {
+	// HOST is a list as it is repeated in the list command
+	hostIDs := args.All["HOST"].([]string)
+	if args.Bool["list"] {
+		return listVolumes(client, hostIDs)
+	}
+
+	h, err := client.DialHost(hostIDs[0])
+	if err != nil {
+		return fmt.Errorf("could not dial host %s: %s", hostIDs[0], err)
+	}
+	defer h.Close()
+	switch {
+	case args.Bool["create"]:
+		v, err := h.CreateVolume()
+		if err != nil {
+			return err
+		}
+		fmt.Println(v.ID)
+	case args.Bool["destroy"]:
+		return h.DestroyVolume(args.String["ID"])
+	case args.Bool["snapshot"]:
+		s, err := h.SnapshotVolume(args.String["ID"])
+		if err != nil {
+			return err
+		}
+		fmt.Println(s.ID)
+	case args.Bool["migrate"]:
+		target, err := client.DialHost(args.String["TARGET"])
+		if err != nil {
+			return fmt.Errorf("could not dial host %s: %s", args.String["TARGET"], err)
+		}
+		defer target.Close()
+		v, err := cluster.MigrateVolume(h, target, args.String["ID"])
+		if err != nil {
+			return err
+		}
+		fmt.Println(v.ID)
+	}
+	return nil
+}
+
+func listVolumes(client *cluster.Client, hostIDs []string) error {
+	if len(hostIDs) == 0 {
+		hosts, err := client.ListHosts()
+		if err != nil {
+			return fmt.Errorf("could not list hosts: %s", err)
+		}
+		for id := range hosts {
+			hostIDs = append(hostIDs, id)
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 1, 2, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "HOST\tID\tTYPE\tSNAPSHOTS\tCREATED\tPATH")
+	for _, id := range hostIDs {
+		h, err := client.DialHost(id)
+		if err != nil {
+			return fmt.Errorf("could not dial host %s: %s", id, err)
+		}
+		volumes, err := h.ListVolumes()
+		h.Close()
+		if err != nil {
+			return fmt.Errorf("could not list volumes of host %s: %s", id, err)
+		}
+		for _, v := range volumes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s ago\t%s\n", id, v.ID, v.Type, len(v.Snapshots), units.HumanDuration(time.Now().UTC().Sub(v.CreatedAt)), v.Path)
+		}
+	}
+	return nil
+}
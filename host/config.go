@@ -8,7 +8,7 @@ import (
 	"github.com/flynn/flynn/host/types"
 )
 
-func openConfig(file string) (*host.Host, error) {
+func openConfig(file string) (*Config, error) {
 	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
@@ -17,16 +17,20 @@ func openConfig(file string) (*host.Host, error) {
 	return parseConfig(f)
 }
 
-func parseConfig(r io.Reader) (*host.Host, error) {
-	var conf Config
-	if err := json.NewDecoder(r).Decode(&conf); err != nil {
+func parseConfig(r io.Reader) (*Config, error) {
+	conf := &Config{}
+	if err := json.NewDecoder(r).Decode(conf); err != nil {
 		return nil, err
 	}
-	return conf.hostConfig()
+	return conf, nil
 }
 
 type Config struct {
 	Metadata map[string]string `json:"metadata"`
+
+	// Backend is the name of the backend jobs are run with, the --backend
+	// flag takes precedence over it.
+	Backend string `json:"backend"`
 }
 
 func (c *Config) hostConfig() (*host.Host, error) {
@@ -9,7 +9,14 @@ import (
 )
 
 func TestConfig(t *testing.T) {
-	actual, err := parseConfig(bytes.NewBuffer([]byte(`{ "metadata": { "foo": "bar" } }`)))
+	conf, err := parseConfig(bytes.NewBuffer([]byte(`{ "metadata": { "foo": "bar" }, "backend": "docker" }`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Backend != "docker" {
+		t.Errorf("incorrect backend: got %q, want %q", conf.Backend, "docker")
+	}
+	actual, err := conf.hostConfig()
 	if err != nil {
 		t.Error(err)
 	}
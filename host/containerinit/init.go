@@ -26,6 +26,7 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -47,13 +48,28 @@ type ContainerInitArgs struct {
 	privileged bool
 	tty        bool
 	openStdin  bool
+	maxFD      uint64
+	maxProcs   uint64
+	maxCore    uint64
 	child      bool
+	restore    string
+	apparmor   string
+	seccomp    string
 	env        []string
 	args       []string
 }
 
 const SharedPath = "/.container-shared"
 
+// CRIUPath is where the host mounts the criu binary in containers when
+// checkpoint/restore is enabled.
+const CRIUPath = "/.criu"
+
+// stdioFile is the file in a checkpoint which records the pipes the job's
+// stdin, stdout and stderr were connected to, so that new pipes can replace
+// them when it is restored.
+const stdioFile = "stdio.json"
+
 type State byte
 
 const (
@@ -147,12 +163,89 @@ func (c *Client) Signal(signal int) error {
 	return err
 }
 
+// ExecReq is a request to run an additional command in the container, which
+// is identified by ID in the other Exec calls.
+type ExecReq struct {
+	ID    string
+	Args  []string
+	Env   []string
+	TTY   bool
+	Stdin bool
+}
+
+// Exec starts a command in the container alongside the job's process, with
+// the container's environment and working directory.
+func (c *Client) Exec(req *ExecReq) error {
+	return c.c.Call("ContainerInit.Exec", req, &struct{}{})
+}
+
+// ExecFD returns the host's end of stream 0, 1 or 2 of the command started by
+// Exec, each of which can be fetched once. Commands with a TTY only have
+// stream 1, the pty master.
+func (c *Client) ExecFD(id string, stream int) (*os.File, error) {
+	var fd fdrpc.FD
+	if err := c.c.Call("ContainerInit.ExecFD", &ExecFDReq{ID: id, Stream: stream}, &fd); err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd.FD), fmt.Sprintf("exec%d", stream)), nil
+}
+
+// ExecWait waits for the command started by Exec to exit and returns its exit
+// status.
+func (c *Client) ExecWait(id string) (int, error) {
+	var status int
+	return status, c.c.Call("ContainerInit.ExecWait", id, &status)
+}
+
+func (c *Client) ExecSignal(id string, signal int) error {
+	return c.c.Call("ContainerInit.ExecSignal", &ExecSignalReq{ID: id, Signal: signal}, &struct{}{})
+}
+
+// CheckpointReq is a request to checkpoint the job's process into Dir.
+type CheckpointReq struct {
+	Dir          string
+	LeaveRunning bool
+}
+
+// Checkpoint dumps the job's process tree into a directory using criu, the
+// processes are killed once dumped unless LeaveRunning is set.
+func (c *Client) Checkpoint(req *CheckpointReq) error {
+	return c.c.Call("ContainerInit.Checkpoint", req, &struct{}{})
+}
+
+type ExecFDReq struct {
+	ID     string
+	Stream int
+}
+
+type ExecSignalReq struct {
+	ID     string
+	Signal int
+}
+
 func newContainerInit(args *ContainerInitArgs) *ContainerInit {
 	return &ContainerInit{
 		resume:    make(chan struct{}),
 		streams:   make(map[chan StateChange]struct{}),
 		openStdin: args.openStdin,
+		env:       args.env,
+		workDir:   args.workDir,
+		apparmor:  args.apparmor,
+		seccomp:   args.seccomp,
+		execs:     make(map[string]*execProcess),
+	}
+}
+
+// confine makes cmd run through containerinit with -confine, which applies
+// the job's AppArmor profile and seccomp filter before executing it. It
+// does nothing if the job has neither.
+func (c *ContainerInit) confine(cmd *exec.Cmd) {
+	if c.apparmor == "" && c.seccomp == "" {
+		return
 	}
+	args := []string{"/.containerinit", "-confine", "-apparmor", c.apparmor, "-seccomp", c.seccomp, cmd.Path}
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = "/.containerinit"
 }
 
 type ContainerInit struct {
@@ -170,6 +263,27 @@ type ContainerInit struct {
 
 	streams    map[chan StateChange]struct{}
 	streamsMtx sync.RWMutex
+
+	env     []string
+	workDir string
+
+	// apparmor and seccomp are the profiles commands are confined with
+	apparmor string
+	seccomp  string
+
+	// execs are the commands started by Exec which haven't been waited for,
+	// execMtx is held while starting a command so that it is recorded before
+	// babySit can reap it.
+	execs   map[string]*execProcess
+	execMtx sync.Mutex
+}
+
+type execProcess struct {
+	process *os.Process
+	streams [3]*os.File
+
+	done       chan struct{}
+	exitStatus int
 }
 
 func (c *ContainerInit) GetState(arg *struct{}, status *State) error {
@@ -234,6 +348,237 @@ func (c *ContainerInit) GetStdin(arg struct{}, fd *fdrpc.ClosingFD) error {
 	return nil
 }
 
+func (c *ContainerInit) Exec(req *ExecReq, res *struct{}) error {
+	c.mtx.Lock()
+	state := c.state
+	c.mtx.Unlock()
+	if state != StateRunning {
+		return fmt.Errorf("container is %s", state)
+	}
+	if len(req.Args) == 0 {
+		return errors.New("no command given")
+	}
+
+	cmd := exec.Command(req.Args[0], req.Args[1:]...)
+	cmd.Dir = c.workDir
+	cmd.Env = append(append([]string{}, c.env...), req.Env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	c.confine(cmd)
+
+	e := &execProcess{done: make(chan struct{})}
+	var childFiles []*os.File
+	defer func() {
+		for _, f := range childFiles {
+			f.Close()
+		}
+	}()
+	if req.TTY {
+		ptyMaster, ptySlave, err := pty.Open()
+		if err != nil {
+			return err
+		}
+		childFiles = append(childFiles, ptySlave)
+		e.streams[1] = ptyMaster
+		cmd.Stdin = ptySlave
+		cmd.Stdout = ptySlave
+		cmd.Stderr = ptySlave
+		cmd.SysProcAttr.Setctty = true
+	} else {
+		var stdio [3]*os.File
+		for i := range stdio {
+			if i == 0 && !req.Stdin {
+				continue
+			}
+			r, w, err := os.Pipe()
+			if err != nil {
+				e.closeStreams()
+				return err
+			}
+			// the child reads stdin and writes stdout and stderr
+			if i == 0 {
+				stdio[i], e.streams[i] = r, w
+			} else {
+				stdio[i], e.streams[i] = w, r
+			}
+			childFiles = append(childFiles, stdio[i])
+		}
+		if stdio[0] != nil {
+			cmd.Stdin = stdio[0]
+		}
+		cmd.Stdout = stdio[1]
+		cmd.Stderr = stdio[2]
+	}
+
+	c.execMtx.Lock()
+	defer c.execMtx.Unlock()
+	if _, ok := c.execs[req.ID]; ok {
+		e.closeStreams()
+		return fmt.Errorf("exec %s already exists", req.ID)
+	}
+	if err := cmd.Start(); err != nil {
+		e.closeStreams()
+		return err
+	}
+	e.process = cmd.Process
+	c.execs[req.ID] = e
+	return nil
+}
+
+func (c *ContainerInit) ExecFD(req *ExecFDReq, fd *fdrpc.ClosingFD) error {
+	c.execMtx.Lock()
+	defer c.execMtx.Unlock()
+	e, ok := c.execs[req.ID]
+	if !ok {
+		return fmt.Errorf("unknown exec %s", req.ID)
+	}
+	if req.Stream < 0 || req.Stream >= len(e.streams) || e.streams[req.Stream] == nil {
+		return fmt.Errorf("exec %s has no stream %d", req.ID, req.Stream)
+	}
+	// the fd is closed once it has been sent, so it is duplicated to
+	// leave the file's own fd to be closed here
+	f := e.streams[req.Stream]
+	e.streams[req.Stream] = nil
+	defer f.Close()
+	dup, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return err
+	}
+	fd.FD = dup
+	return nil
+}
+
+func (c *ContainerInit) ExecWait(id string, status *int) error {
+	c.execMtx.Lock()
+	e, ok := c.execs[id]
+	c.execMtx.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown exec %s", id)
+	}
+	<-e.done
+	c.execMtx.Lock()
+	delete(c.execs, id)
+	c.execMtx.Unlock()
+	e.closeStreams()
+	*status = e.exitStatus
+	return nil
+}
+
+func (c *ContainerInit) ExecSignal(req *ExecSignalReq, res *struct{}) error {
+	c.execMtx.Lock()
+	defer c.execMtx.Unlock()
+	e, ok := c.execs[req.ID]
+	if !ok {
+		return fmt.Errorf("unknown exec %s", req.ID)
+	}
+	select {
+	case <-e.done:
+		return fmt.Errorf("exec %s has exited", req.ID)
+	default:
+	}
+	return e.process.Signal(syscall.Signal(req.Signal))
+}
+
+// execReaped records the exit of a process reaped by babySit if it was
+// started by Exec. Processes killed by a signal exit with 128 plus the signal
+// number, as they do in a shell.
+func (c *ContainerInit) execReaped(pid int, wstatus syscall.WaitStatus) {
+	c.execMtx.Lock()
+	defer c.execMtx.Unlock()
+	for _, e := range c.execs {
+		if e.process.Pid != pid {
+			continue
+		}
+		if wstatus.Signaled() {
+			e.exitStatus = 128 + int(wstatus.Signal())
+		} else {
+			e.exitStatus = wstatus.ExitStatus()
+		}
+		close(e.done)
+		return
+	}
+}
+
+func (e *execProcess) closeStreams() {
+	for i, f := range e.streams {
+		if f != nil {
+			f.Close()
+			e.streams[i] = nil
+		}
+	}
+}
+
+func (c *ContainerInit) Checkpoint(req *CheckpointReq, res *struct{}) error {
+	c.mtx.Lock()
+	if c.state != StateRunning {
+		c.mtx.Unlock()
+		return fmt.Errorf("container is %s", c.state)
+	}
+	if c.ptyMaster != nil {
+		c.mtx.Unlock()
+		return errors.New("jobs with a TTY can't be checkpointed")
+	}
+	pid := c.process.Pid
+	c.mtx.Unlock()
+
+	if err := os.MkdirAll(req.Dir, 0700); err != nil {
+		return err
+	}
+	// the other ends of the job's pipes are held by containerinit and are
+	// not dumped, so they are recorded to be replaced on restore
+	stdio := make(map[int]string)
+	for fd := 0; fd < 3; fd++ {
+		link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", pid, fd))
+		if err == nil && strings.HasPrefix(link, "pipe:") {
+			stdio[fd] = link
+		}
+	}
+	data, err := json.Marshal(stdio)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(req.Dir, stdioFile), data, 0600); err != nil {
+		return err
+	}
+
+	args := []string{"dump",
+		"--tree", strconv.Itoa(pid),
+		"--images-dir", req.Dir,
+		"--log-file", "dump.log",
+		"--tcp-established",
+		"--file-locks",
+	}
+	if req.LeaveRunning {
+		args = append(args, "--leave-running")
+	}
+	status, err := c.run(exec.Command(CRIUPath, args...))
+	if err != nil {
+		return err
+	}
+	if status != 0 {
+		return fmt.Errorf("criu dump failed with exit status %d, see dump.log in the checkpoint", status)
+	}
+	return nil
+}
+
+// run runs a command and returns its exit status once babySit reaps it.
+func (c *ContainerInit) run(cmd *exec.Cmd) (int, error) {
+	c.execMtx.Lock()
+	if err := cmd.Start(); err != nil {
+		c.execMtx.Unlock()
+		return 0, err
+	}
+	id := fmt.Sprintf("run-%d", cmd.Process.Pid)
+	e := &execProcess{process: cmd.Process, done: make(chan struct{})}
+	c.execs[id] = e
+	c.execMtx.Unlock()
+
+	<-e.done
+	c.execMtx.Lock()
+	delete(c.execs, id)
+	c.execMtx.Unlock()
+	return e.exitStatus, nil
+}
+
 func (c *ContainerInit) StreamState(arg struct{}, stream rpcplus.Stream) error {
 	ch := make(chan StateChange)
 	c.streamsMtx.Lock()
@@ -352,6 +697,32 @@ func getCredential(args *ContainerInitArgs) (*syscall.Credential, error) {
 	return &syscall.Credential{Uid: uint32(users[0].Uid), Gid: uint32(users[0].Gid)}, nil
 }
 
+// setupLimits sets the open file, process and core dump size limits which
+// are not zero, they are inherited by the command.
+func setupLimits(args *ContainerInitArgs) error {
+	for _, l := range []struct {
+		resource int
+		value    uint64
+		name     string
+	}{
+		{syscall.RLIMIT_NOFILE, args.maxFD, "open file"},
+		{rlimitNproc, args.maxProcs, "process"},
+		{syscall.RLIMIT_CORE, args.maxCore, "core dump size"},
+	} {
+		if l.value == 0 {
+			continue
+		}
+		limit := &syscall.Rlimit{Cur: l.value, Max: l.value}
+		if err := syscall.Setrlimit(l.resource, limit); err != nil {
+			return fmt.Errorf("Unable to set %s limit: %v", l.name, err)
+		}
+	}
+	return nil
+}
+
+// rlimitNproc is RLIMIT_NPROC, which the syscall package doesn't define.
+const rlimitNproc = 6
+
 func setupCommon(args *ContainerInitArgs) error {
 	if err := setupHostname(args); err != nil {
 		return err
@@ -361,6 +732,10 @@ func setupCommon(args *ContainerInitArgs) error {
 		return err
 	}
 
+	if err := setupLimits(args); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -394,7 +769,9 @@ func getCmdPath(args *ContainerInitArgs) (string, error) {
 	return cmdPath, nil
 }
 
-func babySit(process *os.Process) int {
+// babySit waits for process to exit and returns its exit status, any other
+// processes which exit in the meantime are passed to reaped.
+func babySit(process *os.Process, reaped func(int, syscall.WaitStatus)) int {
 	// Forward all signals to the app
 	sigchan := make(chan os.Signal, 1)
 	sigutil.CatchAll(sigchan)
@@ -412,9 +789,13 @@ func babySit(process *os.Process) int {
 	var wstatus syscall.WaitStatus
 	for {
 		pid, err := syscall.Wait4(-1, &wstatus, 0, nil)
-		if err == nil && pid == process.Pid {
+		if err != nil {
+			continue
+		}
+		if pid == process.Pid {
 			break
 		}
+		reaped(pid, wstatus)
 	}
 
 	if wstatus.Signaled() {
@@ -423,6 +804,64 @@ func babySit(process *os.Process) int {
 	return wstatus.ExitStatus()
 }
 
+// restoreCheckpoint restores the job's process from the checkpoint in dir
+// instead of starting cmd. The stdio of cmd replaces the pipes the process
+// was connected to, and the restored process is a child of containerinit.
+func restoreCheckpoint(cmd *exec.Cmd, dir string) (*os.Process, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, stdioFile))
+	if err != nil {
+		return nil, err
+	}
+	var stdio map[int]string
+	if err := json.Unmarshal(data, &stdio); err != nil {
+		return nil, err
+	}
+
+	pidFile := filepath.Join(dir, "restore.pid")
+	criu := exec.Command(CRIUPath, "restore",
+		"--images-dir", dir,
+		"--log-file", "restore.log",
+		"--pidfile", pidFile,
+		"--restore-detached",
+		"--restore-sibling",
+		"--tcp-close",
+		"--file-locks",
+	)
+	var files []*os.File
+	for fd, stream := range []interface{}{cmd.Stdin, cmd.Stdout, cmd.Stderr} {
+		f, ok := stream.(*os.File)
+		if !ok || stdio[fd] == "" {
+			continue
+		}
+		files = append(files, f)
+		criu.ExtraFiles = append(criu.ExtraFiles, f)
+		criu.Args = append(criu.Args, "--inherit-fd", fmt.Sprintf("fd[%d]:%s", 2+len(criu.ExtraFiles), stdio[fd]))
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	// the restored processes keep their pids, so criu is started with a
+	// higher pid than the job's processes are likely to have
+	if err := ioutil.WriteFile("/proc/sys/kernel/ns_last_pid", []byte("10000"), 0644); err != nil {
+		return nil, fmt.Errorf("Unable to reserve pids for the restore: %v", err)
+	}
+	if out, err := criu.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("criu restore failed: %v, see restore.log in the checkpoint: %s", err, out)
+	}
+	data, err = ioutil.ReadFile(pidFile)
+	if err != nil {
+		return nil, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	return os.FindProcess(pid)
+}
+
 // Run as pid 1 and monitor the contained process to return its exit code.
 func containerInitApp(args *ContainerInitArgs) error {
 	init := newContainerInit(args)
@@ -438,6 +877,9 @@ func containerInitApp(args *ContainerInitArgs) error {
 	cmd := exec.Command(cmdPath, args.args[1:]...)
 	cmd.Dir = args.workDir
 	cmd.Env = args.env
+	if cmdErr == nil {
+		init.confine(cmd)
+	}
 
 	// App runs in its own session
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
@@ -492,7 +934,7 @@ func containerInitApp(args *ContainerInitArgs) error {
 
 	exitCode := 1
 
-	if cmdErr != nil {
+	if cmdErr != nil && args.restore == "" {
 		init.changeState(StateFailed, cmdErr.Error(), -1)
 		return cmdErr
 	}
@@ -500,15 +942,24 @@ func containerInitApp(args *ContainerInitArgs) error {
 	if err := setupCommon(args); err != nil {
 		init.changeState(StateFailed, err.Error(), -1)
 	}
-	// Start the app
-	if err := cmd.Start(); err != nil {
-		init.changeState(StateFailed, err.Error(), -1)
+	// Start or restore the app
+	if args.restore != "" {
+		process, err := restoreCheckpoint(cmd, args.restore)
+		if err != nil {
+			init.changeState(StateFailed, err.Error(), -1)
+			return err
+		}
+		init.process = process
+	} else {
+		if err := cmd.Start(); err != nil {
+			init.changeState(StateFailed, err.Error(), -1)
+		}
+		init.process = cmd.Process
 	}
-	init.process = cmd.Process
 	init.changeState(StateRunning, "", -1)
 
 	init.mtx.Unlock() // Allow calls
-	exitCode = babySit(init.process)
+	exitCode = babySit(init.process, init.execReaped)
 	init.mtx.Lock()
 	init.changeState(StateExited, "", exitCode)
 
@@ -545,8 +996,22 @@ func Main() {
 	privileged := flag.Bool("privileged", false, "privileged mode")
 	tty := flag.Bool("tty", false, "use pseudo-tty")
 	openStdin := flag.Bool("stdin", false, "open stdin")
+	maxFD := flag.Uint64("max-fd", 0, "open file limit")
+	maxProcs := flag.Uint64("max-procs", 0, "process limit of the user")
+	maxCore := flag.Uint64("max-core", 0, "core dump size limit in bytes")
+	restore := flag.String("restore", "", "checkpoint to restore instead of running the command")
+	apparmor := flag.String("apparmor", "", "AppArmor profile to run the command with")
+	seccomp := flag.String("seccomp", "", "JSON seccomp profile to run the command with")
+	confine := flag.Bool("confine", false, "apply -apparmor and -seccomp and execute the arguments")
 	flag.Parse()
 
+	if *confine {
+		if err := confineExec(*apparmor, *seccomp, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Get env
 	var env []string
 	content, err := ioutil.ReadFile("/.containerenv")
@@ -568,6 +1033,12 @@ func Main() {
 		privileged: *privileged,
 		tty:        *tty,
 		openStdin:  *openStdin,
+		maxFD:      *maxFD,
+		maxProcs:   *maxProcs,
+		maxCore:    *maxCore,
+		restore:    *restore,
+		apparmor:   *apparmor,
+		seccomp:    *seccomp,
 		env:        env,
 		args:       flag.Args(),
 	}
@@ -0,0 +1,150 @@
+package containerinit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// SeccompProfile is a seccomp filter of the system calls a job can make.
+type SeccompProfile struct {
+	// DefaultAction is the action taken for system calls which no rule
+	// matches, "allow", "errno" (which fails them with EPERM) or "kill".
+	DefaultAction string        `json:"defaultAction"`
+	Syscalls      []SeccompRule `json:"syscalls"`
+}
+
+// SeccompRule is the action taken for the system calls with the given names.
+type SeccompRule struct {
+	Names  []string `json:"names"`
+	Action string   `json:"action"`
+}
+
+var seccompActions = map[string]uint32{
+	"allow": 0x7fff0000,                         // SECCOMP_RET_ALLOW
+	"errno": 0x00050000 | uint32(syscall.EPERM), // SECCOMP_RET_ERRNO
+	"kill":  0,                                  // SECCOMP_RET_KILL
+}
+
+const auditArchX86_64 = 0xc000003e
+
+// ParseSeccompProfile decodes a JSON seccomp profile, checking that its
+// actions and system calls are known.
+func ParseSeccompProfile(data []byte) (*SeccompProfile, error) {
+	p := &SeccompProfile{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile: %s", err)
+	}
+	if _, err := p.filter(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// filter compiles the profile into a BPF program, which kills processes
+// making system calls of other architectures and fails x32 system calls.
+func (p *SeccompProfile) filter() ([]syscall.SockFilter, error) {
+	def, ok := seccompActions[p.DefaultAction]
+	if !ok {
+		return nil, fmt.Errorf("invalid seccomp default action %q", p.DefaultAction)
+	}
+	stmt := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	const (
+		load    = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+		jeq     = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+		jge     = syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K
+		ret     = syscall.BPF_RET | syscall.BPF_K
+		nrOff   = 0 // offsets in struct seccomp_data
+		archOff = 4
+	)
+	prog := []syscall.SockFilter{
+		stmt(load, archOff),
+		jump(jeq, auditArchX86_64, 1, 0),
+		stmt(ret, seccompActions["kill"]),
+		stmt(load, nrOff),
+		jump(jge, 0x40000000, 0, 1), // __X32_SYSCALL_BIT
+		stmt(ret, seccompActions["errno"]),
+	}
+	for _, rule := range p.Syscalls {
+		action, ok := seccompActions[rule.Action]
+		if !ok {
+			return nil, fmt.Errorf("invalid seccomp action %q", rule.Action)
+		}
+		for _, name := range rule.Names {
+			nr, ok := syscalls[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown system call %q in seccomp profile", name)
+			}
+			prog = append(prog, jump(jeq, nr, 0, 1), stmt(ret, action))
+		}
+	}
+	return append(prog, stmt(ret, def)), nil
+}
+
+// applySeccomp installs the profile's filter on the calling thread, which is
+// inherited by the programs it executes.
+func applySeccomp(p *SeccompProfile) error {
+	filter, err := p.filter()
+	if err != nil {
+		return err
+	}
+	// processes without CAP_SYS_ADMIN can only install a filter once they
+	// can't gain privileges, root keeps the ability to run setuid programs
+	if os.Geteuid() != 0 {
+		if err := prctl(38, 1); err != nil { // PR_SET_NO_NEW_PRIVS
+			return fmt.Errorf("Unable to set no_new_privs: %v", err)
+		}
+	}
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := prctl(22, 2, uintptr(unsafe.Pointer(&prog))); err != nil { // PR_SET_SECCOMP, SECCOMP_MODE_FILTER
+		return fmt.Errorf("Unable to install seccomp filter: %v", err)
+	}
+	return nil
+}
+
+func prctl(option uintptr, args ...uintptr) error {
+	var a [2]uintptr
+	copy(a[:], args)
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, option, a[0], a[1]); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// confineExec applies the job's AppArmor profile and seccomp filter and then
+// executes args[0] with the remaining args as its argv. containerinit runs
+// commands in the job's container through itself with -confine so that the
+// profiles are applied between fork and exec.
+func confineExec(apparmor, seccomp string, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("confine requires a path and arguments")
+	}
+	// the AppArmor exec transition and the seccomp filter apply to the
+	// thread which sets them, so it must be the one which calls exec
+	runtime.LockOSThread()
+	if apparmor != "" {
+		attr := fmt.Sprintf("/proc/self/task/%d/attr/exec", syscall.Gettid())
+		if err := ioutil.WriteFile(attr, []byte("exec "+apparmor), 0); err != nil {
+			return fmt.Errorf("Unable to set AppArmor profile %s: %v", apparmor, err)
+		}
+	}
+	if seccomp != "" {
+		p, err := ParseSeccompProfile([]byte(seccomp))
+		if err != nil {
+			return err
+		}
+		if err := applySeccomp(p); err != nil {
+			return err
+		}
+	}
+	return syscall.Exec(args[0], args[1:], os.Environ())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// deviceManager allocates the host's devices to the jobs which request them.
+// Each device is used by at most one starting or running job, which is worked
+// out from the state so that allocations survive a restart of the daemon.
+type deviceManager struct {
+	state *State
+
+	// devices are the paths of the devices of each class which are claimed
+	// by one job, and shared the paths of those passed to every job which
+	// claims devices of the class, like /dev/nvidiactl.
+	devices map[string][]string
+	shared  map[string][]string
+
+	mtx sync.Mutex
+}
+
+// newDeviceManager returns a deviceManager for the devices and shared devices
+// given as CLASS=PATH pairs.
+func newDeviceManager(state *State, devices, shared []string) (*deviceManager, error) {
+	m := &deviceManager{state: state}
+	var err error
+	if m.devices, err = parseDevices(devices); err != nil {
+		return nil, err
+	}
+	if m.shared, err = parseDevices(shared); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseDevices(pairs []string) (map[string][]string, error) {
+	res := make(map[string][]string)
+	for _, s := range pairs {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || !strings.HasPrefix(kv[1], "/dev/") {
+			return nil, fmt.Errorf("host: invalid device %q, expected CLASS=/dev/PATH", s)
+		}
+		res[kv[0]] = append(res[kv[0]], kv[1])
+	}
+	return res, nil
+}
+
+// Counts returns the number of devices of each class which jobs can claim.
+func (m *deviceManager) Counts() map[string]int {
+	counts := make(map[string]int, len(m.devices))
+	for class, paths := range m.devices {
+		counts[class] = len(paths)
+	}
+	return counts
+}
+
+// Allocate fills in the paths of the job's device requests with devices which
+// no other job is using, it fails without allocating any if there aren't
+// enough.
+func (m *deviceManager) Allocate(job *host.Job) error {
+	if len(job.Config.Devices) == 0 {
+		return nil
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	used := m.used(job.ID)
+	paths := make([][]string, len(job.Config.Devices))
+	for i, d := range job.Config.Devices {
+		for _, path := range m.devices[d.Class] {
+			if len(paths[i]) == d.Count {
+				break
+			}
+			if !used[path] {
+				paths[i] = append(paths[i], path)
+				used[path] = true
+			}
+		}
+		if len(paths[i]) < d.Count {
+			return fmt.Errorf("host: %d %s devices requested, %d available", d.Count, d.Class, len(paths[i]))
+		}
+	}
+	for i := range job.Config.Devices {
+		d := &job.Config.Devices[i]
+		d.Paths = append(paths[i], m.shared[d.Class]...)
+	}
+	return nil
+}
+
+// used returns the devices allocated to the starting and running jobs other
+// than the job with ID except.
+func (m *deviceManager) used(except string) map[string]bool {
+	used := make(map[string]bool)
+	for id, job := range m.state.Get() {
+		if id == except || job.Job == nil || job.Status != host.StatusStarting && job.Status != host.StatusRunning {
+			continue
+		}
+		for _, d := range job.Job.Config.Devices {
+			for _, path := range d.Paths {
+				used[path] = true
+			}
+		}
+	}
+	return used
+}
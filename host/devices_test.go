@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+func TestDeviceManager(t *testing.T) {
+	state := NewState("")
+	m, err := newDeviceManager(state, []string{"gpu=/dev/nvidia0", "gpu=/dev/nvidia1"}, []string{"gpu=/dev/nvidiactl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts := m.Counts(); !reflect.DeepEqual(counts, map[string]int{"gpu": 2}) {
+		t.Errorf("unexpected device counts %v", counts)
+	}
+
+	gpuJob := func(id string, n int) *host.Job {
+		return &host.Job{ID: id, Config: host.ContainerConfig{Devices: []host.DeviceRequest{{Class: "gpu", Count: n}}}}
+	}
+
+	a := gpuJob("a", 1)
+	if err := m.Allocate(a); err != nil {
+		t.Fatal(err)
+	}
+	if paths := a.Config.Devices[0].Paths; !reflect.DeepEqual(paths, []string{"/dev/nvidia0", "/dev/nvidiactl"}) {
+		t.Errorf("unexpected paths %v", paths)
+	}
+	state.AddJob(a)
+	state.SetStatusRunning(a.ID)
+
+	// devices of running jobs are not allocated again
+	if err := m.Allocate(gpuJob("b", 2)); err == nil {
+		t.Error("expected an error allocating more devices than are free")
+	}
+	b := gpuJob("b", 1)
+	if err := m.Allocate(b); err != nil {
+		t.Fatal(err)
+	}
+	if paths := b.Config.Devices[0].Paths; !reflect.DeepEqual(paths, []string{"/dev/nvidia1", "/dev/nvidiactl"}) {
+		t.Errorf("unexpected paths %v", paths)
+	}
+
+	// devices of stopped jobs are free
+	state.SetStatusDone(a.ID, 0)
+	if err := m.Allocate(gpuJob("c", 1)); err != nil {
+		t.Error(err)
+	}
+
+	if err := m.Allocate(&host.Job{ID: "d", Config: host.ContainerConfig{Devices: []host.DeviceRequest{{Class: "fpga", Count: 1}}}}); err == nil {
+		t.Error("expected an error allocating an unknown device class")
+	}
+}
+
+func TestParseDevices(t *testing.T) {
+	for _, s := range []string{"gpu", "=/dev/nvidia0", "gpu=/tmp/nvidia0"} {
+		if _, err := parseDevices([]string{s}); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// hostnamePattern matches the search domains and hostnames jobs can
+// configure, which are written to the container's resolv.conf and hosts
+// files so must not contain whitespace.
+var hostnamePattern = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9_])?$`)
+
+// customResolvConf returns whether the job's container gets its own
+// resolv.conf rather than the host's.
+func customResolvConf(c *host.ContainerConfig) bool {
+	return len(c.DNSServers) > 0 || len(c.DNSSearch) > 0
+}
+
+// validateDNS checks the DNS servers, search domains and hosts entries of the
+// job's config.
+func validateDNS(c *host.ContainerConfig) error {
+	for _, s := range c.DNSServers {
+		if net.ParseIP(s) == nil {
+			return fmt.Errorf("invalid DNS server %q", s)
+		}
+	}
+	for _, d := range c.DNSSearch {
+		if !hostnamePattern.MatchString(d) {
+			return fmt.Errorf("invalid DNS search domain %q", d)
+		}
+	}
+	for name, ip := range c.Hosts {
+		if !hostnamePattern.MatchString(name) {
+			return fmt.Errorf("invalid hostname %q", name)
+		}
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid IP %q for hostname %s", ip, name)
+		}
+	}
+	return nil
+}
+
+// resolvConf returns hostConf, the contents of the host's resolv.conf, with
+// its nameservers replaced by servers and its search domains replaced by
+// search when they are set.
+func resolvConf(hostConf []byte, servers, search []string) []byte {
+	var buf bytes.Buffer
+	s := bufio.NewScanner(bytes.NewReader(hostConf))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 0 {
+			switch fields[0] {
+			case "nameserver":
+				if len(servers) > 0 {
+					continue
+				}
+			case "search", "domain":
+				if len(search) > 0 {
+					continue
+				}
+			}
+		}
+		fmt.Fprintln(&buf, s.Text())
+	}
+	for _, server := range servers {
+		fmt.Fprintf(&buf, "nameserver %s\n", server)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&buf, "search %s\n", strings.Join(search, " "))
+	}
+	return buf.Bytes()
+}
+
+// writeResolvConf writes the job's resolv.conf to path, based on the host's
+// at hostPath. Any existing file at path is removed first, so that a symlink
+// in the image can't redirect the write.
+func writeResolvConf(path, hostPath string, c *host.ContainerConfig) error {
+	if err := validateDNS(c); err != nil {
+		return err
+	}
+	hostConf, err := ioutil.ReadFile(hostPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(resolvConf(hostConf, c.DNSServers, c.DNSSearch))
+	return err
+}
+
+// appendHosts adds the job's hosts entries to the hosts file at path, sorted
+// by hostname.
+func appendHosts(path string, c *host.ContainerConfig) error {
+	if err := validateDNS(c); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(c.Hosts))
+	for name := range c.Hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, name := range names {
+		if _, err := fmt.Fprintf(f, "%s %s\n", c.Hosts[name], name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+const testHostResolvConf = `# generated by resolvconf
+domain example.com
+search example.com
+nameserver 10.0.0.1
+nameserver 10.0.0.2
+options ndots:2
+`
+
+func TestResolvConf(t *testing.T) {
+	for _, test := range []struct {
+		servers  []string
+		search   []string
+		expected string
+	}{
+		{
+			servers:  []string{"192.0.2.53"},
+			expected: "# generated by resolvconf\ndomain example.com\nsearch example.com\noptions ndots:2\nnameserver 192.0.2.53\n",
+		},
+		{
+			search:   []string{"discoverd", "internal"},
+			expected: "# generated by resolvconf\nnameserver 10.0.0.1\nnameserver 10.0.0.2\noptions ndots:2\nsearch discoverd internal\n",
+		},
+		{
+			servers:  []string{"192.0.2.53", "192.0.2.54"},
+			search:   []string{"discoverd"},
+			expected: "# generated by resolvconf\noptions ndots:2\nnameserver 192.0.2.53\nnameserver 192.0.2.54\nsearch discoverd\n",
+		},
+	} {
+		if conf := string(resolvConf([]byte(testHostResolvConf), test.servers, test.search)); conf != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, conf)
+		}
+	}
+}
+
+func TestWriteResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostPath := filepath.Join(dir, "host-resolv.conf")
+	if err := ioutil.WriteFile(hostPath, []byte(testHostResolvConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a symlink in the image must not be followed
+	target := filepath.Join(dir, "target")
+	path := filepath.Join(dir, "resolv.conf")
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &host.ContainerConfig{DNSServers: []string{"192.0.2.53"}}
+	if err := writeResolvConf(path, hostPath, config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Error("expected the symlink not to be followed")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := string(resolvConf([]byte(testHostResolvConf), config.DNSServers, nil)); string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+
+	config.DNSServers = []string{"192.0.2.53\nnameserver 10.0.0.1"}
+	if err := writeResolvConf(path, hostPath, config); err == nil {
+		t.Error("expected an error writing an invalid DNS server")
+	}
+}
+
+func TestAppendHosts(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("127.0.0.1 localhost\n")
+	f.Close()
+
+	config := &host.ContainerConfig{Hosts: map[string]string{"db.internal": "10.0.0.5", "cache": "10.0.0.6"}}
+	if err := appendHosts(f.Name(), config); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "127.0.0.1 localhost\n10.0.0.6 cache\n10.0.0.5 db.internal\n"; string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, data)
+	}
+}
+
+func TestValidateDNS(t *testing.T) {
+	for _, test := range []struct {
+		config *host.ContainerConfig
+		valid  bool
+	}{
+		{&host.ContainerConfig{DNSServers: []string{"10.0.0.1", "2001:db8::1"}, DNSSearch: []string{"discoverd"}}, true},
+		{&host.ContainerConfig{Hosts: map[string]string{"db.internal": "10.0.0.5"}}, true},
+		{&host.ContainerConfig{DNSServers: []string{"dns.example.com"}}, false},
+		{&host.ContainerConfig{DNSSearch: []string{"a b"}}, false},
+		{&host.ContainerConfig{Hosts: map[string]string{"db": "10.0.0.5 evil"}}, false},
+		{&host.ContainerConfig{Hosts: map[string]string{"db\n10.0.0.1 x": "10.0.0.5"}}, false},
+	} {
+		if err := validateDNS(test.config); (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid to be %t, got %v", test.config, test.valid, err)
+		}
+	}
+}
@@ -11,15 +11,24 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/fsouza/go-dockerclient"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/logbuf"
 	"github.com/flynn/flynn/host/ports"
 	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/attempt"
 	"github.com/flynn/flynn/pkg/demultiplex"
 )
 
-func NewDockerBackend(state *State, portAlloc map[string]*ports.Allocator, bindAddr string) (Backend, error) {
+func init() {
+	registerBackend("docker", func(c *BackendConfig) (Backend, error) {
+		return NewDockerBackend(c.State, c.Ports, c.BindAddr, c.Registry)
+	})
+}
+
+func NewDockerBackend(state *State, portAlloc map[string]*ports.Allocator, bindAddr string, registry *registryAuth) (Backend, error) {
 	dockerc, err := docker.NewClient("unix:///var/run/docker.sock")
 	if err != nil {
 		return nil, err
@@ -29,6 +38,7 @@ func NewDockerBackend(state *State, portAlloc map[string]*ports.Allocator, bindA
 		ports:    portAlloc,
 		docker:   dockerc,
 		bindAddr: bindAddr,
+		registry: registry,
 	}
 	go d.handleEvents()
 	return d, nil
@@ -40,6 +50,7 @@ type DockerBackend struct {
 	ports  map[string]*ports.Allocator
 
 	bindAddr string
+	registry *registryAuth
 }
 
 type dockerClient interface {
@@ -47,24 +58,73 @@ type dockerClient interface {
 	CreateContainer(docker.CreateContainerOptions) (*docker.Container, error)
 	StartContainer(string, *docker.HostConfig) error
 	InspectContainer(string) (*docker.Container, error)
+	InspectImage(string) (*docker.Image, error)
 	AddEventListener(chan<- *docker.APIEvents) error
 	RemoveEventListener(chan *docker.APIEvents) error
-	StopContainer(string, uint) error
 	ResizeContainerTTY(string, int, int) error
 	AttachToContainer(docker.AttachToContainerOptions) error
 	KillContainer(docker.KillContainerOptions) error
 	ListContainers(docker.ListContainersOptions) ([]docker.APIContainers, error)
 }
 
-func (d *DockerBackend) Run(job *host.Job) error {
+func (d *DockerBackend) Run(job *host.Job) (err error) {
 	g := grohl.NewContext(grohl.Data{"backend": "docker", "fn": "run", "job.id": job.ID})
 	g.Log(grohl.Data{"at": "start", "job.artifact.uri": job.Artifact.URI, "job.cmd": job.Config.Cmd})
 
+	if len(job.Artifacts) > 0 {
+		// docker can't mount one image inside another's container
+		return errors.New("docker backend: jobs with more than one artifact are not supported")
+	}
+	if name := job.LogDriver.Name; name != "" && name != host.LogDriverLogbuf {
+		// the output of docker containers is logged by docker
+		return fmt.Errorf("docker backend: the %s log driver is not supported", name)
+	}
+	if len(job.Config.Secrets) > 0 {
+		// docker can't mount a tmpfs into a container
+		return errors.New("docker backend: jobs with secrets are not supported")
+	}
+	if len(job.Config.Devices) > 0 {
+		// the docker API doesn't support passing devices through
+		return errors.New("docker backend: jobs with devices are not supported")
+	}
+	if len(job.Config.Hosts) > 0 {
+		// the docker API doesn't support adding entries to /etc/hosts
+		return errors.New("docker backend: jobs with hosts entries are not supported")
+	}
+	if confined(job.Config.Seccomp) || confined(job.Config.AppArmor) {
+		// containers are confined by docker's own profiles
+		return errors.New("docker backend: jobs with security profiles are not supported")
+	}
+	if job.Config.ReadOnlyRoot || len(job.Config.Tmpfs) > 0 {
+		// the docker API doesn't support read-only root filesystems or
+		// tmpfs mounts
+		return errors.New("docker backend: jobs with a read-only root or tmpfs mounts are not supported")
+	}
+	if job.Resources.Disk > 0 {
+		// docker doesn't support storage quotas
+		return errors.New("docker backend: jobs with a disk quota are not supported")
+	}
+	if job.Resources.EgressRate > 0 || job.Resources.IngressRate > 0 {
+		// the host can't find the veth of a docker container to shape
+		return errors.New("docker backend: jobs with bandwidth limits are not supported")
+	}
+	if r := job.Resources; r.MaxFD > 0 || r.MaxProcs > 0 || r.MaxCore > 0 {
+		// the docker API doesn't support setting ulimits
+		return errors.New("docker backend: jobs with file, process or core dump limits are not supported")
+	}
+	if err := validateDNS(&job.Config); err != nil {
+		return err
+	}
 	image, pullOpts, err := parseDockerImageURI(job.Artifact.URI)
 	if err != nil {
 		g.Log(grohl.Data{"at": "parse_artifact_uri", "status": "error", "err": err})
 		return err
 	}
+	auth, err := d.pullAuth(job.Artifact.URI, job.RegistryAuth)
+	if err != nil {
+		g.Log(grohl.Data{"at": "registry_auth", "status": "error", "err": err})
+		return err
+	}
 
 	config := &docker.Config{
 		Image:        image,
@@ -79,23 +139,30 @@ func (d *DockerBackend) Run(job *host.Job) error {
 		ExposedPorts: make(map[docker.Port]struct{}, len(job.Config.Ports)),
 		Env:          make([]string, 0, len(job.Config.Env)+len(job.Config.Ports)+1),
 		Volumes:      make(map[string]struct{}, len(job.Config.Mounts)),
+		Memory:       int64(job.Resources.Memory) * 1024,
+		MemorySwap:   int64(job.Resources.Memory) * 1024,
+		CpuShares:    int64(job.Resources.CPUShares),
 	}
 	opts := docker.CreateContainerOptions{Config: config}
 	hostConfig := &docker.HostConfig{
 		PortBindings: make(map[docker.Port][]docker.PortBinding, len(job.Config.Ports)),
+		Dns:          job.Config.DNSServers,
+		DnsSearch:    job.Config.DNSSearch,
 	}
 	for k, v := range job.Config.Env {
 		config.Env = append(config.Env, k+"="+v)
 	}
 
-	for i, p := range job.Config.Ports {
-		if p.Port == 0 {
-			port, err := d.ports[p.Proto].Get()
-			if err != nil {
-				return err
-			}
-			p.Port = int(port)
+	if err := allocatePorts(d.ports, job.Config.Ports); err != nil {
+		g.Log(grohl.Data{"at": "alloc_ports", "status": "error", "err": err})
+		return err
+	}
+	defer func() {
+		if err != nil {
+			releasePorts(d.ports, job.Config.Ports)
 		}
+	}()
+	for i, p := range job.Config.Ports {
 		port := strconv.Itoa(p.Port)
 
 		if i == 0 {
@@ -103,7 +170,7 @@ func (d *DockerBackend) Run(job *host.Job) error {
 		}
 		config.Env = append(config.Env, fmt.Sprintf("PORT_%d=%s", i, port))
 		config.ExposedPorts[docker.Port(port+"/"+p.Proto)] = struct{}{}
-		hostConfig.PortBindings[docker.Port(port+"/"+p.Proto)] = []docker.PortBinding{{HostPort: port, HostIp: d.bindAddr}}
+		hostConfig.PortBindings[docker.Port(port+"/"+p.Proto)] = []docker.PortBinding{{HostPort: strconv.Itoa(p.HostPort), HostIp: d.bindAddr}}
 	}
 
 	hostConfig.Binds = make([]string, 0, len(job.Config.Mounts))
@@ -127,14 +194,15 @@ func (d *DockerBackend) Run(job *host.Job) error {
 	}
 
 	d.state.AddJob(job)
+	if job.Artifact.SHA256 != "" {
+		if err := d.verifyImage(g, image, pullOpts, auth, job.Artifact); err != nil {
+			return err
+		}
+	}
 	g.Log(grohl.Data{"at": "create_container"})
 	container, err := d.docker.CreateContainer(opts)
 	if err == docker.ErrNoSuchImage {
-		g.Log(grohl.Data{"at": "pull_image"})
-		pullOpts.OutputStream = os.Stdout
-		err = d.docker.PullImage(*pullOpts, docker.AuthConfiguration{})
-		if err != nil {
-			g.Log(grohl.Data{"at": "pull_image", "status": "error", "err": err})
+		if err := d.pullImage(g, pullOpts, auth); err != nil {
 			return err
 		}
 		container, err = d.docker.CreateContainer(opts)
@@ -162,8 +230,26 @@ func (d *DockerBackend) Run(job *host.Job) error {
 }
 
 func (d *DockerBackend) Stop(id string) error {
-	const stopTimeout = 10
-	return d.docker.StopContainer(d.state.GetJob(id).ContainerID, stopTimeout)
+	job := d.state.GetJob(id)
+	if job == nil {
+		return errors.New("unknown job")
+	}
+	signal := func(sig int) error {
+		return d.docker.KillContainer(docker.KillContainerOptions{ID: job.ContainerID, Signal: docker.Signal(sig)})
+	}
+	wait := func(timeout time.Duration) error {
+		return attempt.Strategy{Total: timeout, Delay: 100 * time.Millisecond}.Run(func() error {
+			container, err := d.docker.InspectContainer(job.ContainerID)
+			if err != nil {
+				return err
+			}
+			if container.State.Running {
+				return errors.New("container is running")
+			}
+			return nil
+		})
+	}
+	return stopJob(d.state, job.Job, signal, wait)
 }
 
 func (d *DockerBackend) RestoreState(jobs map[string]*host.ActiveJob, dec *json.Decoder) error {
@@ -171,16 +257,42 @@ func (d *DockerBackend) RestoreState(jobs map[string]*host.ActiveJob, dec *json.
 		container, err := d.docker.InspectContainer(job.ContainerID)
 		if _, ok := err.(*docker.NoSuchContainer); ok {
 			delete(jobs, id)
+			continue
 		} else if err != nil {
 			return err
 		}
 		if !container.State.Running {
 			delete(jobs, id)
+			continue
 		}
+		reservePorts(d.ports, job.Job.Config.Ports)
 	}
 	return nil
 }
 
+func (d *DockerBackend) JobStats(id string) (*host.JobStats, error) {
+	job := d.state.GetJob(id)
+	if job == nil {
+		return nil, errors.New("unknown job")
+	}
+	container, err := d.docker.InspectContainer(job.ContainerID)
+	if err != nil {
+		return nil, err
+	}
+	if !container.State.Running {
+		return nil, errJobNotRunning
+	}
+	// the container's first process is in its cgroups and network namespace
+	stats := &host.JobStats{}
+	if err := readCgroupStats(container.State.Pid, stats); err != nil {
+		return nil, err
+	}
+	if stats.Network, err = readNetDevStats(container.State.Pid); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
 func (d *DockerBackend) ResizeTTY(id string, height, width uint16) error {
 	job := d.state.GetJob(id)
 	if job == nil {
@@ -215,6 +327,16 @@ func (d *DockerBackend) Attach(req *AttachRequest) error {
 			io.Copy(req.Stdout, outR)
 			req.Stdout.Close()
 		}()
+	} else if req.Timestamps {
+		go func() {
+			mtx := &sync.Mutex{}
+			enc := json.NewEncoder(req.Stdout)
+			demultiplex.Copy(&timestampWriter{1, enc, mtx}, &timestampWriter{2, enc, mtx}, outR)
+			req.Stdout.Close()
+			if req.Stderr != nil {
+				req.Stderr.Close()
+			}
+		}()
 	} else if req.Stdout != nil || req.Stderr != nil {
 		go func() {
 			demultiplex.Copy(req.Stdout, req.Stderr, outR)
@@ -293,6 +415,10 @@ func (d *DockerBackend) handleEvents() {
 	}
 	defer d.docker.RemoveEventListener(stream)
 	for event := range stream {
+		if event.Status == "oom" {
+			d.state.SetContainerOOMKilled(event.ID)
+			continue
+		}
 		if event.Status != "die" {
 			continue
 		}
@@ -302,7 +428,9 @@ func (d *DockerBackend) handleEvents() {
 			// TODO: set job status anyway?
 			continue
 		}
-		// TODO: return ports to pool
+		if job := d.state.GetContainerJob(event.ID); job != nil {
+			releasePorts(d.ports, job.Job.Config.Ports)
+		}
 		d.state.SetContainerStatusDone(event.ID, container.State.ExitCode)
 	}
 }
@@ -344,6 +472,67 @@ outer:
 	return s
 }
 
+// PullArtifact pulls the image of an artifact, checking it against the
+// artifact's checksum if it has one.
+func (d *DockerBackend) PullArtifact(a host.Artifact) error {
+	g := grohl.NewContext(grohl.Data{"backend": "docker", "fn": "pull_artifact", "artifact": a.URI})
+	image, pullOpts, err := parseDockerImageURI(a.URI)
+	if err != nil {
+		g.Log(grohl.Data{"at": "parse_uri", "status": "error", "err": err})
+		return err
+	}
+	auth, err := d.pullAuth(a.URI, nil)
+	if err != nil {
+		g.Log(grohl.Data{"at": "registry_auth", "status": "error", "err": err})
+		return err
+	}
+	if err := d.pullImage(g, pullOpts, auth); err != nil {
+		return err
+	}
+	return d.verifyImage(g, image, pullOpts, auth, a)
+}
+
+// pullAuth returns the credentials docker pulls the image at uri with, which
+// are empty for anonymous pulls.
+func (d *DockerBackend) pullAuth(uri string, job *host.RegistryAuth) (docker.AuthConfiguration, error) {
+	creds, err := d.registry.Credentials(uri, job)
+	if err != nil || creds == nil {
+		return docker.AuthConfiguration{}, err
+	}
+	return docker.AuthConfiguration{Username: creds.Username, Password: creds.Password}, nil
+}
+
+func (d *DockerBackend) pullImage(g *grohl.Context, opts *docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	g.Log(grohl.Data{"at": "pull_image"})
+	opts.OutputStream = os.Stdout
+	if err := d.docker.PullImage(*opts, auth); err != nil {
+		g.Log(grohl.Data{"at": "pull_image", "status": "error", "err": err})
+		return err
+	}
+	return nil
+}
+
+// verifyImage pulls the image if it is not present and checks its ID against
+// the checksum of the artifact.
+func (d *DockerBackend) verifyImage(g *grohl.Context, name string, opts *docker.PullImageOptions, auth docker.AuthConfiguration, a host.Artifact) error {
+	image, err := d.docker.InspectImage(name)
+	if err == docker.ErrNoSuchImage {
+		if err := d.pullImage(g, opts, auth); err != nil {
+			return err
+		}
+		image, err = d.docker.InspectImage(name)
+	}
+	if err != nil {
+		g.Log(grohl.Data{"at": "inspect_image", "status": "error", "err": err})
+		return err
+	}
+	if err := verifyArtifact(a, image.ID); err != nil {
+		g.Log(grohl.Data{"at": "verify_image", "status": "error", "err": err})
+		return err
+	}
+	return nil
+}
+
 func parseDockerImageURI(s string) (name string, opts *docker.PullImageOptions, err error) {
 	uri, err := url.Parse(s)
 	if err != nil {
@@ -369,3 +558,21 @@ func parseDockerImageURI(s string) (name string, opts *docker.PullImageOptions,
 	}
 	return
 }
+
+// timestampWriter encodes each write as a logbuf.Data record, docker does not
+// record when output was written so the time of the write is used.
+type timestampWriter struct {
+	stream int
+	enc    *json.Encoder
+	mtx    *sync.Mutex
+}
+
+func (w *timestampWriter) Write(p []byte) (int, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	data := &logbuf.Data{Stream: w.stream, Timestamp: logbuf.UnixTime{Time: time.Now()}, Message: string(p)}
+	if err := w.enc.Encode(data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -30,6 +30,8 @@ type fakeDockerClient struct {
 	pullErr     error
 	created     docker.CreateContainerOptions
 	pulled      string
+	pullAuth    docker.AuthConfiguration
+	imageID     string
 	started     bool
 	hostConf    *docker.HostConfig
 	listeners   map[chan<- *docker.APIEvents]struct{}
@@ -70,11 +72,19 @@ func (c *fakeDockerClient) InspectContainer(id string) (*docker.Container, error
 	return container, nil
 }
 
+func (c *fakeDockerClient) InspectImage(name string) (*docker.Image, error) {
+	if c.pulled == "" {
+		return nil, docker.ErrNoSuchImage
+	}
+	return &docker.Image{ID: c.imageID}, nil
+}
+
 func (c *fakeDockerClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
 	if c.pullErr != nil {
 		return c.pullErr
 	}
 	c.pulled = opts.Repository
+	c.pullAuth = auth
 	return nil
 }
 
@@ -111,10 +121,6 @@ func (c *fakeDockerClient) closeListeners() {
 	}
 }
 
-func (c *fakeDockerClient) StopContainer(string, uint) error {
-	return nil
-}
-
 func (c *fakeDockerClient) ResizeContainerTTY(string, int, int) error {
 	return nil
 }
@@ -258,6 +264,29 @@ func TestProcessWithPull(t *testing.T) {
 	}
 }
 
+func TestProcessWithPullAuth(t *testing.T) {
+	job := &host.Job{ID: "a", RegistryAuth: &host.RegistryAuth{Username: "deploy", Password: "s3cret"}}
+	client := NewFakeDockerClient()
+	client.createErr = docker.ErrNoSuchImage
+	testDockerRunWithOpts(job, "", client, t)
+
+	if client.pullAuth.Username != "deploy" || client.pullAuth.Password != "s3cret" {
+		t.Errorf("expected the job's credentials to be used, got %+v", client.pullAuth)
+	}
+}
+
+func TestProcessWithDNS(t *testing.T) {
+	job := &host.Job{ID: "a", Config: host.ContainerConfig{DNSServers: []string{"10.0.0.1"}, DNSSearch: []string{"discoverd"}}}
+	_, client := testDockerRun(job, t)
+
+	if len(client.hostConf.Dns) != 1 || client.hostConf.Dns[0] != "10.0.0.1" {
+		t.Errorf("expected DNS servers to be set, got %v", client.hostConf.Dns)
+	}
+	if len(client.hostConf.DnsSearch) != 1 || client.hostConf.DnsSearch[0] != "discoverd" {
+		t.Errorf("expected DNS search domains to be set, got %v", client.hostConf.DnsSearch)
+	}
+}
+
 func TestProcessWithCreateFailure(t *testing.T) {
 	job := &host.Job{ID: "a"}
 	err := errors.New("undefined failure")
@@ -344,3 +373,60 @@ func TestStreamEvents(t *testing.T) {
 		t.Error("incorrect exit status")
 	}
 }
+
+func TestProcessJobChecksum(t *testing.T) {
+	sum := strings.Repeat("a", 64)
+	job := &host.Job{ID: "a", Artifact: host.Artifact{Type: "docker", URI: "https://registry.hub.docker.com/test/foo", SHA256: sum}}
+	client := NewFakeDockerClient()
+	client.imageID = sum
+	testDockerRunWithOpts(job, "", client, t)
+	if client.pulled != "test/foo" {
+		t.Errorf("expected image to be pulled, got %q", client.pulled)
+	}
+
+	client = NewFakeDockerClient()
+	client.imageID = strings.Repeat("b", 64)
+	state, err := dockerRunWithOpts(job, "", client)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if client.started {
+		t.Error("expected container not to be started")
+	}
+	if state.GetJob("a") == nil {
+		t.Error("expected job to be added to the state")
+	}
+}
+
+func TestProcessJobWithArtifacts(t *testing.T) {
+	job := &host.Job{ID: "a", Artifacts: []host.Artifact{{Type: "docker", URI: "https://registry.hub.docker.com/test/bar"}}}
+	job.Artifact = host.Artifact{Type: "docker", URI: "https://registry.hub.docker.com/test/foo"}
+	client := NewFakeDockerClient()
+	if _, err := dockerRunWithOpts(job, "", client); err == nil {
+		t.Error("expected an error running a job with more than one artifact")
+	}
+	if client.created.Config != nil {
+		t.Error("expected container not to be created")
+	}
+}
+
+func TestProcessJobWithUnsupportedResources(t *testing.T) {
+	for name, resources := range map[string]host.JobResources{
+		"disk quota":   {Disk: 1 << 30},
+		"egress rate":  {EgressRate: 1000000},
+		"ingress rate": {IngressRate: 1000000},
+		"max fd":       {MaxFD: 1024},
+		"max procs":    {MaxProcs: 256},
+		"max core":     {MaxCore: 1 << 20},
+	} {
+		job := &host.Job{ID: "a", Resources: resources}
+		job.Artifact = host.Artifact{Type: "docker", URI: "https://registry.hub.docker.com/test/foo"}
+		client := NewFakeDockerClient()
+		if _, err := dockerRunWithOpts(job, "", client); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if client.created.Config != nil {
+			t.Errorf("%s: expected container not to be created", name)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// drainHandler serves /host/drain, PUT starts draining the host and GET
+// reports how many jobs are left. A draining host rejects new jobs, and the
+// cluster leader is told so that the scheduler moves the host's jobs
+// elsewhere. Draining lasts until the daemon restarts.
+type drainHandler struct {
+	state *State
+
+	mtx      sync.Mutex
+	draining bool
+	started  chan struct{}
+}
+
+func newDrainHandler(state *State) *drainHandler {
+	return &drainHandler{state: state, started: make(chan struct{})}
+}
+
+func (h *drainHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "PUT":
+		h.drain()
+	case "GET":
+	default:
+		http.Error(w, "host: method not allowed", 405)
+		return
+	}
+	writeJSON(w, 200, h.status())
+}
+
+func (h *drainHandler) drain() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if !h.draining {
+		h.draining = true
+		close(h.started)
+	}
+}
+
+// Draining reports whether the host has started draining.
+func (h *drainHandler) Draining() bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.draining
+}
+
+// Started returns a channel which is closed when the host starts draining.
+func (h *drainHandler) Started() <-chan struct{} {
+	return h.started
+}
+
+func (h *drainHandler) status() *host.DrainStatus {
+	status := &host.DrainStatus{
+		Draining:   h.Draining(),
+		Jobs:       []string{},
+		VolumeJobs: []string{},
+	}
+	for id, job := range h.state.Get() {
+		if job.Status != host.StatusStarting && job.Status != host.StatusRunning {
+			continue
+		}
+		status.Jobs = append(status.Jobs, id)
+		if hasVolumes(job.Job) {
+			status.VolumeJobs = append(status.VolumeJobs, id)
+		}
+	}
+	sort.Strings(status.Jobs)
+	sort.Strings(status.VolumeJobs)
+	return status
+}
+
+func hasVolumes(job *host.Job) bool {
+	for _, m := range job.Config.Mounts {
+		if m.VolumeID != "" {
+			return true
+		}
+	}
+	return false
+}
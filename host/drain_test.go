@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+func TestDrainAPI(t *testing.T) {
+	state := NewState("host0")
+	state.AddJob(&host.Job{ID: "a"})
+	state.SetStatusRunning("a")
+	state.AddJob(&host.Job{ID: "b", Config: host.ContainerConfig{Mounts: []host.Mount{{Location: "/data", VolumeID: "vol0"}}}})
+	state.SetStatusRunning("b")
+	state.AddJob(&host.Job{ID: "c"})
+	state.SetStatusRunning("c")
+	state.SetStatusDone("c", 0)
+
+	drain := newDrainHandler(state)
+	mux := http.NewServeMux()
+	mux.Handle("/host/drain", drain)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client := cluster.NewHostClient(srv.Listener.Addr().String(), nil, nil)
+
+	status, err := client.DrainStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Draining || drain.Draining() {
+		t.Error("expected the host not to be draining")
+	}
+	select {
+	case <-drain.Started():
+		t.Error("expected the drain not to have started")
+	default:
+	}
+
+	for i := 0; i < 2; i++ {
+		if status, err = client.Drain(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := &host.DrainStatus{Draining: true, Jobs: []string{"a", "b"}, VolumeJobs: []string{"b"}}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("expected %+v, got %+v", expected, status)
+	}
+	select {
+	case <-drain.Started():
+	default:
+		t.Error("expected the drain to have started")
+	}
+
+	state.SetStatusDone("a", 0)
+	if status, err = client.DrainStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(status.Jobs, []string{"b"}) {
+		t.Errorf("expected job b to be left, got %v", status.Jobs)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// eventsKeepAlive is how often a comment is written to an idle event stream so
+// that intermediate proxies don't time out the connection.
+const eventsKeepAlive = 30 * time.Second
+
+// eventsHandler streams job lifecycle events as server-sent events from
+// GET /host/events. The stream contains the events of every job unless a
+// job_id is given. Each SSE event is named after the host event (create,
+// start, stop, oom, error, ...) and its data is the JSON encoded host.Event,
+// so a crashed job is a stop event whose job has a crashed status and exit
+// status.
+type eventsHandler struct {
+	state *State
+}
+
+func (h *eventsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "host: method not allowed", 405)
+		return
+	}
+	id := req.FormValue("job_id")
+	if id == "" {
+		id = "all"
+	}
+	ch := h.state.AddListener(id)
+	defer h.state.RemoveListener(id, ch)
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	flush()
+
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-ch:
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, data); err != nil {
+				return
+			}
+			flush()
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(":\n\n")); err != nil {
+				return
+			}
+			flush()
+		case <-closed:
+			return
+		}
+	}
+}
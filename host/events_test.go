@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+func TestEventsAPI(t *testing.T) {
+	state := NewState("host0")
+	mux := http.NewServeMux()
+	mux.Handle("/host/events", &eventsHandler{state: state})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client := cluster.NewHostClient(srv.Listener.Addr().String(), nil, nil)
+
+	all := make(chan *host.Event)
+	allStream := client.StreamEvents("all", all)
+	defer allStream.Close()
+	jobEvents := make(chan *host.Event)
+	jobStream := client.StreamEvents("b", jobEvents)
+	defer jobStream.Close()
+
+	expect := func(ch chan *host.Event, jobID, event string) *host.Event {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				t.Fatalf("stream closed waiting for %s event of job %s", event, jobID)
+			}
+			if e.JobID != jobID || e.Event != event {
+				t.Fatalf("expected %s event of job %s, got %s event of job %s", event, jobID, e.Event, e.JobID)
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s event of job %s", event, jobID)
+		}
+		return nil
+	}
+
+	state.AddJob(&host.Job{ID: "a"})
+	expect(all, "a", "create")
+	state.SetStatusRunning("a")
+	expect(all, "a", "start")
+	state.SetStatusDone("a", 2)
+	e := expect(all, "a", "stop")
+	if e.Job == nil || e.Job.Status != host.StatusCrashed || e.Job.ExitStatus != 2 {
+		t.Errorf("expected a crashed job with exit status 2, got %+v", e.Job)
+	}
+
+	state.AddJob(&host.Job{ID: "b"})
+	expect(all, "b", "create")
+	expect(jobEvents, "b", "create")
+	state.SetStatusRunning("b")
+	expect(all, "b", "start")
+	expect(jobEvents, "b", "start")
+	state.SetOOMKilled("b")
+	expect(all, "b", "oom")
+	expect(jobEvents, "b", "oom")
+
+	if err := jobStream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range jobEvents {
+	}
+	if err := jobStream.Err(); err != nil {
+		t.Errorf("unexpected stream error after close: %s", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/types"
+)
+
+var errNoExec = errors.New("host: the backend does not support exec")
+
+// execHandler runs commands in the containers of running jobs at
+// POST /host/jobs/:id/exec. The request body is a JSON host.ExecReq, and once
+// the command has started the connection is hijacked and speaks the attach
+// protocol, ending with the command's exit status. The command is killed if
+// the client disconnects before it exits.
+type execHandler struct {
+	state   *State
+	backend Backend
+}
+
+func (h *execHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/host/jobs"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "exec" || req.Method != "POST" {
+		http.NotFound(w, req)
+		return
+	}
+	id := parts[0]
+
+	var execReq host.ExecReq
+	if err := json.NewDecoder(req.Body).Decode(&execReq); err != nil {
+		http.Error(w, "invalid JSON", 400)
+		return
+	}
+	if len(execReq.Cmd) == 0 {
+		http.Error(w, "host: exec requires a command", 400)
+		return
+	}
+	job := h.state.GetJob(id)
+	if job == nil {
+		writeJobError(w, errJobNotFound)
+		return
+	}
+	if job.Status != host.StatusRunning {
+		writeJobError(w, errJobNotRunning)
+		return
+	}
+	execer, ok := h.backend.(Execer)
+	if !ok {
+		writeJobError(w, errNoExec)
+		return
+	}
+
+	g := grohl.NewContext(grohl.Data{"fn": "exec", "job.id": id})
+	g.Log(grohl.Data{"at": "start", "cmd": strings.Join(execReq.Cmd, " ")})
+	proc, err := execer.Exec(id, &execReq)
+	if err != nil {
+		g.Log(grohl.Data{"at": "start", "status": "error", "err": err})
+		writeJobError(w, err)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		proc.Signal(int(syscall.SIGKILL))
+		proc.Wait()
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/vnd.flynn.attach-hijack\r\n\r\n"))
+	h.exec(g, proc, conn)
+}
+
+func (h *execHandler) exec(g *grohl.Context, proc ExecProcess, conn io.ReadWriteCloser) {
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	writeMtx := &sync.Mutex{}
+	if _, err := conn.Write([]byte{host.AttachSuccess}); err != nil {
+		proc.Signal(int(syscall.SIGKILL))
+		proc.Wait()
+		return
+	}
+
+	stdin, stdout, stderr := proc.Streams()
+	var output sync.WaitGroup
+	copyOutput := func(stream byte, r io.ReadCloser) {
+		if r == nil {
+			return
+		}
+		output.Add(1)
+		go func() {
+			defer output.Done()
+			fw := newFrameWriter(stream, w, writeMtx)
+			io.Copy(fw, r)
+			r.Close()
+			fw.Close()
+		}()
+	}
+	copyOutput(1, stdout)
+	copyOutput(2, stderr)
+
+	exited := make(chan struct{})
+	go func() {
+		defer func() {
+			if stdin != nil {
+				stdin.Close()
+			}
+		}()
+		r := bufio.NewReader(conn)
+		var buf [4]byte
+		for {
+			frameType, err := r.ReadByte()
+			if err != nil {
+				select {
+				case <-exited:
+				default:
+					g.Log(grohl.Data{"at": "disconnect"})
+					proc.Signal(int(syscall.SIGKILL))
+				}
+				return
+			}
+			switch frameType {
+			case host.AttachData:
+				stream, err := r.ReadByte()
+				if err != nil || stream != 0 || stdin == nil {
+					return
+				}
+				if _, err := io.ReadFull(r, buf[:]); err != nil {
+					return
+				}
+				length := int64(binary.BigEndian.Uint32(buf[:]))
+				if length == 0 {
+					stdin.Close()
+					stdin = nil
+					continue
+				}
+				if _, err := io.CopyN(stdin, r, length); err != nil {
+					return
+				}
+			case host.AttachSignal:
+				if _, err := io.ReadFull(r, buf[:]); err != nil {
+					return
+				}
+				signal := int(binary.BigEndian.Uint32(buf[:]))
+				g.Log(grohl.Data{"at": "signal", "signal": signal})
+				if err := proc.Signal(signal); err != nil {
+					g.Log(grohl.Data{"at": "signal", "status": "error", "err": err})
+				}
+			case host.AttachResize:
+				if _, err := io.ReadFull(r, buf[:]); err != nil {
+					return
+				}
+				height := binary.BigEndian.Uint16(buf[:])
+				width := binary.BigEndian.Uint16(buf[2:])
+				if err := proc.ResizeTTY(height, width); err != nil {
+					g.Log(grohl.Data{"at": "tty_resize", "status": "error", "err": err})
+				}
+			default:
+				return
+			}
+		}
+	}()
+
+	status, err := proc.Wait()
+	close(exited)
+	output.Wait()
+	if err != nil {
+		g.Log(grohl.Data{"at": "wait", "status": "error", "err": err})
+		return
+	}
+	g.Log(grohl.Data{"at": "finish", "exit_status": status})
+	writeMtx.Lock()
+	defer writeMtx.Unlock()
+	w.WriteByte(host.AttachExit)
+	binary.Write(w, binary.BigEndian, uint32(status))
+	w.Flush()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+// execBackend starts catProcesses, which copy stdin to stdout.
+type execBackend struct {
+	Backend
+
+	mtx   sync.Mutex
+	reqs  []*host.ExecReq
+	procs []*catProcess
+}
+
+func (b *execBackend) Exec(id string, req *host.ExecReq) (ExecProcess, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	p := newCatProcess()
+	b.reqs = append(b.reqs, req)
+	b.procs = append(b.procs, p)
+	return p, nil
+}
+
+// catProcess copies stdin to stdout and writes "done" to stderr, exiting with
+// status 3 when stdin is closed or 137 when it is sent SIGKILL.
+type catProcess struct {
+	stdinR, stdoutR, stderrR *io.PipeReader
+	stdinW, stdoutW, stderrW *io.PipeWriter
+
+	mtx     sync.Mutex
+	signals []int
+	resizes [][2]uint16
+	killed  bool
+
+	done   chan struct{}
+	status int
+}
+
+func newCatProcess() *catProcess {
+	p := &catProcess{done: make(chan struct{})}
+	p.stdinR, p.stdinW = io.Pipe()
+	p.stdoutR, p.stdoutW = io.Pipe()
+	p.stderrR, p.stderrW = io.Pipe()
+	go func() {
+		io.Copy(p.stdoutW, p.stdinR)
+		p.stdoutW.Close()
+		p.stderrW.Write([]byte("done"))
+		p.stderrW.Close()
+		p.mtx.Lock()
+		p.status = 3
+		if p.killed {
+			p.status = 137
+		}
+		p.mtx.Unlock()
+		close(p.done)
+	}()
+	return p
+}
+
+func (p *catProcess) Streams() (io.WriteCloser, io.ReadCloser, io.ReadCloser) {
+	return p.stdinW, p.stdoutR, p.stderrR
+}
+
+func (p *catProcess) Signal(sig int) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.signals = append(p.signals, sig)
+	if sig == int(syscall.SIGKILL) {
+		p.killed = true
+		p.stdinR.Close()
+	}
+	return nil
+}
+
+func (p *catProcess) ResizeTTY(height, width uint16) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.resizes = append(p.resizes, [2]uint16{height, width})
+	return nil
+}
+
+func (p *catProcess) Wait() (int, error) {
+	<-p.done
+	return p.status, nil
+}
+
+func newExecServer(backend Backend) (*State, cluster.Host, func()) {
+	state := NewState("host0")
+	state.AddJob(&host.Job{ID: "a"})
+	state.SetStatusRunning("a")
+	state.AddJob(&host.Job{ID: "b"})
+
+	mux := http.NewServeMux()
+	mux.Handle("/host/jobs/", &execHandler{state: state, backend: backend})
+	srv := httptest.NewServer(mux)
+	return state, cluster.NewHostClient(srv.Listener.Addr().String(), nil, nil), srv.Close
+}
+
+func TestExec(t *testing.T) {
+	backend := &execBackend{}
+	_, client, cleanup := newExecServer(backend)
+	defer cleanup()
+
+	req := &host.ExecReq{Cmd: []string{"cat"}, Stdin: true}
+	ac, err := client.Exec("a", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	if err := ac.Signal(int(syscall.SIGTERM)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.ResizeTTY(24, 80); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ac.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	exit, err := ac.Receive(&stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exit != 3 || stdout.String() != "data" || stderr.String() != "done" {
+		t.Errorf("expected exit status 3, stdout %q and stderr %q, got %d, %q and %q", "data", "done", exit, stdout.String(), stderr.String())
+	}
+
+	if len(backend.reqs) != 1 || !reflect.DeepEqual(backend.reqs[0], req) {
+		t.Errorf("expected exec request %+v, got %+v", req, backend.reqs)
+	}
+	p := backend.procs[0]
+	if !reflect.DeepEqual(p.signals, []int{int(syscall.SIGTERM)}) {
+		t.Errorf("expected signals [15], got %v", p.signals)
+	}
+	if !reflect.DeepEqual(p.resizes, [][2]uint16{{24, 80}}) {
+		t.Errorf("expected resizes [[24 80]], got %v", p.resizes)
+	}
+}
+
+func TestExecDisconnect(t *testing.T) {
+	backend := &execBackend{}
+	_, client, cleanup := newExecServer(backend)
+	defer cleanup()
+
+	ac, err := client.Exec("a", &host.ExecReq{Cmd: []string{"cat"}, Stdin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ac.Close()
+
+	backend.mtx.Lock()
+	p := backend.procs[0]
+	backend.mtx.Unlock()
+	select {
+	case <-p.done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the command to be killed")
+	}
+	if status, _ := p.Wait(); status != 137 {
+		t.Errorf("expected the command to be killed, got exit status %d", status)
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	_, client, cleanup := newExecServer(&execBackend{})
+	defer cleanup()
+
+	if _, err := client.Exec("b", &host.ExecReq{Cmd: []string{"sh"}}); err != cluster.ErrJobNotRunning {
+		t.Errorf("expected ErrJobNotRunning, got %v", err)
+	}
+	if _, err := client.Exec("c", &host.ExecReq{Cmd: []string{"sh"}}); err != cluster.ErrJobNotFound {
+		t.Errorf("expected ErrJobNotFound, got %v", err)
+	}
+	if _, err := client.Exec("a", &host.ExecReq{}); err == nil || !strings.Contains(err.Error(), "requires a command") {
+		t.Errorf("expected an error without a command, got %v", err)
+	}
+
+	_, client, cleanup = newExecServer(struct{ Backend }{})
+	defer cleanup()
+	if _, err := client.Exec("a", &host.ExecReq{Cmd: []string{"sh"}}); err == nil || !strings.Contains(err.Error(), "501") {
+		t.Errorf("expected a 501 error from a backend without exec, got %v", err)
+	}
+}
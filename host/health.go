@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/types"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	healthCheckTimeout         = 5 * time.Second
+
+	// defaultHealthCheckFailures is the number of consecutive checks which
+	// must fail before a healthy job is marked unhealthy.
+	defaultHealthCheckFailures = 3
+)
+
+// healthCheckTransport is used for HTTP checks, which do not follow
+// redirects or reuse connections.
+var healthCheckTransport = &http.Transport{
+	Dial: func(network, addr string) (net.Conn, error) {
+		return net.DialTimeout(network, addr, healthCheckTimeout)
+	},
+	ResponseHeaderTimeout: healthCheckTimeout,
+	DisableKeepAlives:     true,
+}
+
+// runHealthCheck checks the job listening on addr.
+func runHealthCheck(c *host.HealthCheck, addr string) error {
+	if c.Type != "http" {
+		conn, err := net.DialTimeout("tcp", addr, healthCheckTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	path := c.Path
+	if path == "" {
+		path = "/"
+	}
+	req, err := http.NewRequest("GET", "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "flynn-host health check")
+	res, err := healthCheckTransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// healthCheckAddr returns the address of the job's first port, which is
+// empty until the job has an IP.
+func healthCheckAddr(job *host.ActiveJob) string {
+	if job.InternalIP == "" || len(job.Job.Config.Ports) == 0 {
+		return ""
+	}
+	return net.JoinHostPort(job.InternalIP, strconv.Itoa(job.Job.Config.Ports[0].Port))
+}
+
+type serviceRegistrar interface {
+	Register(name, addr string) error
+	Unregister(name, addr string) error
+}
+
+// healthMonitor runs the health checks of running jobs, recording their
+// health in the state and registering healthy jobs with discoverd. Jobs
+// which fail too many checks are stopped using the backend.
+type healthMonitor struct {
+	state   *State
+	disc    serviceRegistrar
+	backend Backend
+	metrics *hostMetrics
+
+	mtx    sync.Mutex
+	checks map[string]chan struct{}
+}
+
+func newHealthMonitor(state *State, disc serviceRegistrar, backend Backend, metrics *hostMetrics) *healthMonitor {
+	return &healthMonitor{
+		state:   state,
+		disc:    disc,
+		backend: backend,
+		metrics: metrics,
+		checks:  make(map[string]chan struct{}),
+	}
+}
+
+// Run starts and stops health checks as jobs start and stop. Jobs which are
+// already running are checked immediately.
+func (m *healthMonitor) Run(events <-chan host.Event) {
+	for _, job := range m.state.Get() {
+		if job.Status == host.StatusRunning && job.Job.HealthCheck != nil {
+			m.start(job.Job)
+		}
+	}
+	for event := range events {
+		switch event.Event {
+		case "start":
+			if event.Job.Job.HealthCheck != nil {
+				m.start(event.Job.Job)
+			}
+		case "stop", "error":
+			m.stop(event.JobID)
+		}
+	}
+}
+
+func (m *healthMonitor) start(job *host.Job) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if _, ok := m.checks[job.ID]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	m.checks[job.ID] = stop
+	go m.check(job.ID, job.HealthCheck, stop)
+}
+
+func (m *healthMonitor) stop(jobID string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if stop, ok := m.checks[jobID]; ok {
+		close(stop)
+		delete(m.checks, jobID)
+	}
+}
+
+// check runs the health check of a job until stop is closed. The job is
+// marked healthy as soon as a check passes, unhealthy after c.Failures
+// checks in a row fail, and is stopped after c.RestartAfter checks in a row
+// fail. Stopped jobs are failed when they exit so that the scheduler
+// restarts them.
+func (m *healthMonitor) check(jobID string, c *host.HealthCheck, stop chan struct{}) {
+	g := grohl.NewContext(grohl.Data{"fn": "health_check", "job.id": jobID})
+	interval := c.Interval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	maxFailures := c.Failures
+	if maxFailures <= 0 {
+		maxFailures = defaultHealthCheckFailures
+	}
+
+	var healthy bool
+	if job := m.state.GetJob(jobID); job != nil {
+		healthy = job.Healthy
+	}
+	var registered string
+	var failures int
+	defer func() {
+		if registered != "" {
+			m.unregister(g, c.Service, registered)
+		}
+	}()
+
+	wait := c.GracePeriod
+	for {
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+		wait = interval
+
+		job := m.state.GetJob(jobID)
+		if job == nil {
+			return
+		}
+		addr := healthCheckAddr(job)
+		err := fmt.Errorf("job has no address")
+		if addr != "" {
+			err = runHealthCheck(c, addr)
+		}
+		if err != nil {
+			failures++
+			if healthy && failures >= maxFailures {
+				g.Log(grohl.Data{"at": "unhealthy", "addr": addr, "err": err})
+				healthy = false
+				m.state.SetHealthy(jobID, false)
+				if registered != "" {
+					m.unregister(g, c.Service, registered)
+					registered = ""
+				}
+			}
+			if c.RestartAfter > 0 && failures >= c.RestartAfter {
+				g.Log(grohl.Data{"at": "stop", "failures": failures, "err": err})
+				m.state.SetHealthKilled(jobID)
+				if err := m.backend.Stop(jobID); err != nil {
+					g.Log(grohl.Data{"at": "stop", "status": "error", "err": err})
+					continue
+				}
+				m.metrics.healthRestart()
+				return
+			}
+			continue
+		}
+
+		failures = 0
+		if !healthy {
+			g.Log(grohl.Data{"at": "healthy", "addr": addr})
+			healthy = true
+			m.state.SetHealthy(jobID, true)
+		}
+		if registered == "" && c.Service != "" && m.disc != nil {
+			if err := m.disc.Register(c.Service, addr); err != nil {
+				g.Log(grohl.Data{"at": "register", "status": "error", "service": c.Service, "err": err})
+			} else {
+				registered = addr
+			}
+		}
+	}
+}
+
+func (m *healthMonitor) unregister(g *grohl.Context, service, addr string) {
+	if err := m.disc.Unregister(service, addr); err != nil {
+		g.Log(grohl.Data{"at": "unregister", "status": "error", "service": service, "err": err})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+func TestRunHealthCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ok":
+		case "/redirect":
+			http.Redirect(w, req, "/missing", http.StatusFound)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	addr := srv.Listener.Addr().String()
+
+	for _, test := range []struct {
+		check *host.HealthCheck
+		ok    bool
+	}{
+		{&host.HealthCheck{Type: "tcp"}, true},
+		{&host.HealthCheck{Type: "http", Path: "/ok"}, true},
+		{&host.HealthCheck{Type: "http", Path: "/redirect"}, true},
+		{&host.HealthCheck{Type: "http", Path: "/missing"}, false},
+		{&host.HealthCheck{Type: "http"}, false},
+	} {
+		err := runHealthCheck(test.check, addr)
+		if test.ok && err != nil {
+			t.Errorf("%+v: unexpected error: %s", test.check, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%+v: expected an error", test.check)
+		}
+	}
+
+	srv.Close()
+	if err := runHealthCheck(&host.HealthCheck{Type: "tcp"}, addr); err == nil {
+		t.Error("expected an error checking a closed port")
+	}
+}
+
+type fakeRegistrar struct {
+	registered chan string
+}
+
+func (r *fakeRegistrar) Register(name, addr string) error {
+	r.registered <- name + " " + addr
+	return nil
+}
+
+func (r *fakeRegistrar) Unregister(name, addr string) error {
+	r.registered <- "-" + name + " " + addr
+	return nil
+}
+
+func TestHealthMonitor(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	state := NewState("host0")
+	disc := &fakeRegistrar{registered: make(chan string, 2)}
+	m := newHealthMonitor(state, disc, nil, nil)
+	events := state.AddListener("all")
+	monitorEvents := state.AddListener("all")
+	go m.Run(monitorEvents)
+	defer state.RemoveListener("all", monitorEvents)
+
+	job := &host.Job{
+		ID:          "a",
+		Config:      host.ContainerConfig{Ports: []host.Port{{Proto: "tcp"}}},
+		HealthCheck: &host.HealthCheck{Type: "tcp", Interval: 10 * time.Millisecond, Service: "app-web"},
+	}
+	job.Config.Ports[0].Port, _ = strconv.Atoi(port)
+	state.AddJob(job)
+	state.SetInternalIP("a", "127.0.0.1")
+	state.SetStatusRunning("a")
+
+	waitForEvent := func(name string) {
+		for {
+			select {
+			case e := <-events:
+				if e.Event == name {
+					return
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for %s event", name)
+			}
+		}
+	}
+	waitForEvent("healthy")
+	if !state.GetJob("a").Healthy {
+		t.Error("expected job to be healthy")
+	}
+	select {
+	case r := <-disc.registered:
+		if r != "app-web "+l.Addr().String() {
+			t.Errorf("unexpected registration %q", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for registration")
+	}
+
+	l.Close()
+	waitForEvent("unhealthy")
+	select {
+	case r := <-disc.registered:
+		if !strings.HasPrefix(r, "-app-web") {
+			t.Errorf("unexpected registration %q", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for unregistration")
+	}
+}
+
+// stopBackend records the jobs it is asked to stop.
+type stopBackend struct {
+	Backend
+	stopped chan string
+}
+
+func (b *stopBackend) Stop(id string) error {
+	b.stopped <- id
+	return nil
+}
+
+func TestHealthMonitorRestart(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	state := NewState("host0")
+	backend := &stopBackend{stopped: make(chan string, 1)}
+	m := newHealthMonitor(state, nil, backend, nil)
+	events := state.AddListener("all")
+	go m.Run(events)
+	defer state.RemoveListener("all", events)
+
+	// the job never becomes healthy, so it is stopped after the third
+	// failed check
+	job := &host.Job{
+		ID:          "a",
+		Config:      host.ContainerConfig{Ports: []host.Port{{Proto: "tcp"}}},
+		HealthCheck: &host.HealthCheck{Type: "tcp", Interval: 10 * time.Millisecond, RestartAfter: 3},
+	}
+	job.Config.Ports[0].Port, _ = strconv.Atoi(port)
+	state.AddJob(job)
+	state.SetInternalIP("a", "127.0.0.1")
+	start := time.Now()
+	state.SetStatusRunning("a")
+
+	select {
+	case id := <-backend.stopped:
+		if id != "a" {
+			t.Errorf("expected job a to be stopped, got %s", id)
+		}
+		if time.Since(start) < 20*time.Millisecond {
+			t.Error("expected the job to be stopped after three checks")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the job to be stopped")
+	}
+
+	// the job exits gracefully when it is stopped, but is failed so that
+	// the scheduler restarts it
+	jobEvents := state.AddListener("a")
+	defer state.RemoveListener("a", jobEvents)
+	state.SetStatusDone("a", 0)
+	select {
+	case e := <-jobEvents:
+		if e.Event != "error" {
+			t.Errorf("expected an error event, got %s", e.Event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the job to exit")
+	}
+	if j := state.GetJob("a"); j.Status != host.StatusFailed || j.Error == nil || *j.Error != errHealthKilled.Error() || !j.HealthKilled {
+		t.Errorf("expected the job to be failed by the health check, got %+v", j)
+	}
+}
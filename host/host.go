@@ -7,6 +7,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -35,7 +37,12 @@ func init() {
 	log.SetFlags(log.Lshortfile | log.Lmicroseconds)
 
 	cli.Register("daemon", runDaemon, `
-usage: flynn-host daemon [options] [--meta=<KEY=VAL>...]
+usage: flynn-host daemon [options] [--meta=<KEY=VAL>...] [--device=<CLASS=PATH>...] [--shared-device=<CLASS=PATH>...]
+
+The API requires the token in FLYNN_HOST_TOKEN if it is set, and is served
+over TLS with the PEM certificate and key in FLYNN_HOST_TLS_CERT and
+FLYNN_HOST_TLS_KEY if FLYNN_HOST_TLS_CA is set, clients must then present a
+certificate signed by the CA. Clients read the same variables.
 
 options:
   --external=IP          external IP of host
@@ -45,10 +52,21 @@ options:
   --id=ID                host id
   --force                kill all containers booted by flynn-host before starting
   --volpath=PATH         directory to create volumes in [default: /var/lib/flynn-host]
-  --backend=BACKEND      runner backend (docker or libvirt-lxc) [default: libvirt-lxc]
+  --artifact-cache=MB    disk budget for pulled artifact images, least recently used images are evicted above it [default: 0]
+  --zpool=DATASET        ZFS dataset to create persistent volumes in, they are directories in volpath if not set
+  --backend=BACKEND      runner backend (docker or libvirt-lxc), the config file's backend or libvirt-lxc if not set
   --meta=<KEY=VAL>...    key=value pair to add as metadata
+  --device=<CLASS=PATH>...         device which jobs can claim for their exclusive use, e.g. gpu=/dev/nvidia0
+  --shared-device=<CLASS=PATH>...  device passed to every job which claims devices of the class, e.g. gpu=/dev/nvidiactl
+  --registry-auth=PATH   JSON file of credentials for pulling images from private registries
+  --overcommit=RATIO     how many times the host's memory and cpu can be reserved by job limits [default: 1]
   --bind=IP              bind containers to IP
+  --tcp-ports=RANGE      tcp ports allocated to jobs which don't request one [default: 55000-65535]
+  --udp-ports=RANGE      udp ports allocated to jobs which don't request one [default: 55000-65535]
   --flynn-init=PATH      path to flynn-init binary [default: /usr/bin/flynn-init]
+  --experimental-checkpoint  enable checkpointing jobs with CRIU and restoring them on other hosts (libvirt-lxc only)
+  --criu=PATH            path to criu binary [default: /usr/sbin/criu]
+  --security-profiles=DIR  directory of the custom seccomp (seccomp/NAME.json) and AppArmor (apparmor/NAME) profiles jobs can select [default: /etc/flynn-host/profiles]
 	`)
 }
 
@@ -75,7 +93,19 @@ func runDaemon(args *docopt.Args) {
 	hostID := args.String["--id"]
 	force := args.Bool["--force"]
 	volPath := args.String["--volpath"]
-	backendName := args.String["--backend"]
+	zpool := args.String["--zpool"]
+	artifactCacheMB, err := strconv.ParseInt(args.String["--artifact-cache"], 10, 64)
+	if err != nil {
+		log.Fatalf("invalid --artifact-cache %q", args.String["--artifact-cache"])
+	}
+	overcommit, err := strconv.ParseFloat(args.String["--overcommit"], 64)
+	if err != nil || overcommit <= 0 {
+		log.Fatalf("invalid --overcommit %q", args.String["--overcommit"])
+	}
+	registry, err := openRegistryAuth(args.String["--registry-auth"])
+	if err != nil {
+		log.Fatal(err)
+	}
 	flynnInit := args.String["--flynn-init"]
 	metadata := args.All["--meta"].([]string)
 
@@ -83,6 +113,21 @@ func runDaemon(args *docopt.Args) {
 	grohl.Log(grohl.Data{"at": "start"})
 	g := grohl.NewContext(grohl.Data{"fn": "main"})
 
+	conf := &Config{}
+	if configFile != "" {
+		conf, err = openConfig(configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	backendName := args.String["--backend"]
+	if backendName == "" {
+		backendName = conf.Backend
+	}
+	if backendName == "" {
+		backendName = "libvirt-lxc"
+	}
+
 	if hostID == "" {
 		hostID = strings.Replace(hostname, "-", "", -1)
 	}
@@ -90,29 +135,83 @@ func runDaemon(args *docopt.Args) {
 		log.Fatal("host id must not contain dashes")
 	}
 
-	portAlloc := map[string]*ports.Allocator{
-		"tcp": ports.NewAllocator(55000, 65535),
-		"udp": ports.NewAllocator(55000, 65535),
+	portAlloc := make(map[string]*ports.Allocator, 2)
+	for _, proto := range []string{"tcp", "udp"} {
+		start, end, err := ports.ParseRange(args.String["--"+proto+"-ports"])
+		if err != nil {
+			log.Fatalf("invalid --%s-ports: %s", proto, err)
+		}
+		portAlloc[proto] = ports.NewAllocator(start, end)
 	}
 
 	sh := newShutdownHandler()
 	state := NewState(hostID)
-	var backend Backend
-	var err error
+	devices, err := newDeviceManager(state, args.All["--device"].([]string), args.All["--shared-device"].([]string))
+	if err != nil {
+		log.Fatal(err)
+	}
+	resources, err := hostResources(overcommit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resources.Devices = devices.Counts()
+	metrics := newHostMetrics(state, resources)
+	go metrics.Run(state.AddListener("all"))
+	var checkpoints *checkpointManager
+	if args.Bool["--experimental-checkpoint"] {
+		checkpoints, err = newCheckpointManager(filepath.Join(volPath, "checkpoints"), args.String["--criu"], state)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	backend, err := newBackend(backendName, &BackendConfig{
+		State:             state,
+		Ports:             portAlloc,
+		VolPath:           volPath,
+		LogPath:           "/tmp/flynn-host-logs",
+		InitPath:          flynnInit,
+		BindAddr:          bindAddr,
+		Registry:          registry,
+		Metrics:           metrics,
+		ArtifactCacheSize: artifactCacheMB << 20,
+		Checkpoints:       checkpoints,
+		Profiles:          newSecurityProfiles(args.String["--security-profiles"]),
+	})
+	if err != nil {
+		sh.Fatal(err)
+	}
+	if checkpoints != nil {
+		checkpoints.backend = backend
+	}
 
-	switch backendName {
-	case "libvirt-lxc":
-		backend, err = NewLibvirtLXCBackend(state, portAlloc, volPath, "/tmp/flynn-host-logs", flynnInit)
-	case "docker":
-		backend, err = NewDockerBackend(state, portAlloc, bindAddr)
-	default:
-		log.Fatalf("unknown backend %q", backendName)
+	var provider volumeProvider = &dirVolumes{root: filepath.Join(volPath, "volumes")}
+	if zpool != "" {
+		provider = &zfsVolumes{dataset: zpool, root: filepath.Join(volPath, "volumes")}
 	}
+	volumes, err := newVolumeManager(filepath.Join(volPath, "volumes.json"), provider, state)
 	if err != nil {
 		sh.Fatal(err)
 	}
 
-	if err := serveHTTP(&Host{state: state, backend: backend}, &attachHandler{state: state, backend: backend}, sh); err != nil {
+	// the host's cluster client reads the same credentials
+	creds, err := cluster.EnvCredentials()
+	if err != nil {
+		sh.Fatal(err)
+	}
+
+	drain := newDrainHandler(state)
+	api := &httpAPI{
+		attach:      &attachHandler{state: state, backend: backend},
+		volumes:     &volumeHandler{volumes: volumes},
+		stats:       &statsHandler{state: state, backend: backend},
+		exec:        &execHandler{state: state, backend: backend},
+		checkpoints: &checkpointHandler{checkpoints: checkpoints},
+		artifacts:   &artifactHandler{backend: backend},
+		events:      &eventsHandler{state: state},
+		drain:       drain,
+		metrics:     metrics,
+	}
+	if err := serveHTTP(&Host{state: state, backend: backend}, api, creds, sh); err != nil {
 		sh.Fatal(err)
 	}
 
@@ -192,6 +291,8 @@ func runDaemon(args *docopt.Args) {
 		}
 	}
 	sh.BeforeExit(func() { disc.UnregisterAll() })
+	go newHealthMonitor(state, disc, backend, metrics).Run(state.AddListener("all"))
+	go newLogDrainer(state, backend).Run(state.AddListener("all"))
 	sampiStandby, err := disc.RegisterAndStandby("flynn-host", externalAddr+":1113", map[string]string{"id": hostID})
 	if err != nil {
 		sh.Fatal(err)
@@ -221,12 +322,17 @@ func runDaemon(args *docopt.Args) {
 	events := state.AddListener("all")
 	go syncScheduler(cluster, events)
 
-	h := &host.Host{}
-	if configFile != "" {
-		h, err = openConfig(configFile)
-		if err != nil {
-			sh.Fatal(err)
+	go func() {
+		<-drain.Started()
+		g.Log(grohl.Data{"at": "drain"})
+		if err := cluster.DrainHost(); err != nil {
+			g.Log(grohl.Data{"at": "drain", "status": "error", "err": err})
 		}
+	}()
+
+	h, err := conf.hostConfig()
+	if err != nil {
+		sh.Fatal(err)
 	}
 	if h.Metadata == nil {
 		h.Metadata = make(map[string]string)
@@ -236,15 +342,23 @@ func runDaemon(args *docopt.Args) {
 		h.Metadata[kv[0]] = kv[1]
 	}
 	h.ID = hostID
+	h.Resources = resources
 
 	for {
 		newLeader := cluster.NewLeaderSignal()
 
 		h.Jobs = state.ClusterJobs()
+		h.Draining = drain.Draining()
 		jobs := make(chan *host.Job)
 		jobStream = cluster.RegisterHost(h, jobs)
 		g.Log(grohl.Data{"at": "host_registered"})
 		for job := range jobs {
+			// a job which was restored after the daemon restarted may
+			// be sent again by the scheduler, it must not start twice
+			if j := state.GetJob(job.ID); j != nil && jobActive(j) {
+				g.Log(grohl.Data{"at": "skip_job", "job.id": job.ID, "status": j.Status.String()})
+				continue
+			}
 			if externalAddr != "" {
 				if job.Config.Env == nil {
 					job.Config.Env = make(map[string]string)
@@ -252,7 +366,25 @@ func runDaemon(args *docopt.Args) {
 				job.Config.Env["EXTERNAL_IP"] = externalAddr
 				job.Config.Env["DISCOVERD"] = discAddr
 			}
-			if err := backend.Run(job); err != nil {
+			var err error
+			if drain.Draining() {
+				err = errors.New("host: host is draining")
+			} else if err = volumes.Attach(job); err == nil {
+				if err = devices.Allocate(job); err == nil {
+					if job.Checkpoint != "" {
+						err = checkpoints.Restore(job)
+					} else {
+						err = backend.Run(job)
+					}
+				}
+			}
+			if err != nil {
+				// jobs which fail before the backend adds them to
+				// the state, for example when the image can't be
+				// pulled, are added so that the failure is reported
+				if state.GetJob(job.ID) == nil {
+					state.AddJob(job)
+				}
 				state.SetStatusFailed(job.ID, err)
 			}
 		}
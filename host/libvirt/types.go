@@ -13,8 +13,10 @@ type Domain struct {
 	OS    OS     `xml:"os"`
 	IDMap *IDMap `xml:"idmap,omitempty"`
 
-	Memory UnitInt `xml:"memory"`
-	VCPU   int     `xml:"vcpu"`
+	Memory  UnitInt  `xml:"memory"`
+	MemTune *MemTune `xml:"memtune,omitempty"`
+	VCPU    int      `xml:"vcpu"`
+	CPUTune *CPUTune `xml:"cputune,omitempty"`
 
 	OnPoweroff string `xml:"on_poweroff,omitempty"`
 	OnReboot   string `xml:"on_reboot,omitempty"`
@@ -28,6 +30,17 @@ func (d *Domain) XML() []byte {
 	return data
 }
 
+// MemTune sets the memory cgroup limits of a domain, SwapHardLimit is the
+// limit of memory and swap together.
+type MemTune struct {
+	HardLimit     *UnitInt `xml:"hard_limit,omitempty"`
+	SwapHardLimit *UnitInt `xml:"swap_hard_limit,omitempty"`
+}
+
+type CPUTune struct {
+	Shares int `xml:"shares,omitempty"`
+}
+
 type OS struct {
 	Type     OSType   `xml:"type"`
 	Init     string   `xml:"init"`
@@ -65,12 +78,16 @@ type Devices struct {
 }
 
 type Filesystem struct {
-	Type   string    `xml:"type,attr,omitempty"`
-	Driver *FSDriver `xml:"driver,omitempty"`
-	Source FSRef     `xml:"source"`
-	Target FSRef     `xml:"target"`
+	Type     string    `xml:"type,attr,omitempty"`
+	Driver   *FSDriver `xml:"driver,omitempty"`
+	Source   FSRef     `xml:"source"`
+	Target   FSRef     `xml:"target"`
+	ReadOnly *ReadOnly `xml:"readonly"`
 }
 
+// ReadOnly is the empty element which makes a filesystem read-only.
+type ReadOnly struct{}
+
 type FSDriver struct {
 	Name   string `xml:"name,attr,omitempty"`
 	Type   string `xml:"type,attr,omitempty"`
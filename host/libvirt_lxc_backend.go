@@ -22,11 +22,9 @@ import (
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/daemon/networkdriver/ipallocator"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/pkg/term"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/libcontainer/netlink"
-	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/lumberjack"
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
 	"github.com/flynn/flynn/host/containerinit"
 	lt "github.com/flynn/flynn/host/libvirt"
-	"github.com/flynn/flynn/host/logbuf"
 	"github.com/flynn/flynn/host/pinkerton"
 	"github.com/flynn/flynn/host/ports"
 	"github.com/flynn/flynn/host/types"
@@ -44,7 +42,18 @@ const (
 // TODO: read these from a configurable libvirt network
 var bridgeAddr, bridgeNet, _ = net.ParseCIDR("192.168.200.1/24")
 
-func NewLibvirtLXCBackend(state *State, portAlloc map[string]*ports.Allocator, volPath, logPath, initPath string) (Backend, error) {
+func init() {
+	registerBackend("libvirt-lxc", func(c *BackendConfig) (Backend, error) {
+		artifacts, err := newArtifactCache(filepath.Join(c.VolPath, "artifacts.json"), pinkertonStore{}, c.ArtifactCacheSize)
+		if err != nil {
+			return nil, err
+		}
+		artifacts.metrics = c.Metrics
+		return NewLibvirtLXCBackend(c.State, c.Ports, c.VolPath, c.LogPath, c.InitPath, artifacts, c.Registry, c.Checkpoints, c.Profiles)
+	})
+}
+
+func NewLibvirtLXCBackend(state *State, portAlloc map[string]*ports.Allocator, volPath, logPath, initPath string, artifacts *artifactCache, registry *registryAuth, checkpoints *checkpointManager, profiles *securityProfiles) (Backend, error) {
 	libvirtc, err := libvirt.NewVirConnection("lxc:///")
 	if err != nil {
 		return nil, err
@@ -90,15 +99,19 @@ func NewLibvirtLXCBackend(state *State, portAlloc map[string]*ports.Allocator, v
 		return nil, err
 	}
 	return &LibvirtLXCBackend{
-		LogPath:    logPath,
-		VolPath:    volPath,
-		InitPath:   initPath,
-		libvirt:    libvirtc,
-		state:      state,
-		ports:      portAlloc,
-		forwarder:  ports.NewForwarder(net.ParseIP("0.0.0.0"), chain),
-		logs:       make(map[string]*logbuf.Log),
-		containers: make(map[string]*libvirtContainer),
+		LogPath:     logPath,
+		VolPath:     volPath,
+		InitPath:    initPath,
+		libvirt:     libvirtc,
+		state:       state,
+		ports:       portAlloc,
+		forwarder:   ports.NewForwarder(net.ParseIP("0.0.0.0"), chain),
+		artifacts:   artifacts,
+		registry:    registry,
+		checkpoints: checkpoints,
+		profiles:    profiles,
+		logs:        make(map[string]LogDriver),
+		containers:  make(map[string]*libvirtContainer),
 	}, nil
 }
 
@@ -110,9 +123,14 @@ type LibvirtLXCBackend struct {
 	state     *State
 	ports     map[string]*ports.Allocator
 	forwarder *ports.Forwarder
+	artifacts *artifactCache
+	registry  *registryAuth
+	// checkpoints is nil unless checkpoint/restore is enabled
+	checkpoints *checkpointManager
+	profiles    *securityProfiles
 
 	logsMtx sync.Mutex
-	logs    map[string]*logbuf.Log
+	logs    map[string]LogDriver
 
 	containersMtx sync.RWMutex
 	containers    map[string]*libvirtContainer
@@ -121,9 +139,16 @@ type LibvirtLXCBackend struct {
 type libvirtContainer struct {
 	RootPath string
 	IP       net.IP
-	job      *host.Job
-	l        *LibvirtLXCBackend
-	done     chan struct{}
+	PID      int      // pid of the domain's controller, which is in its cgroups
+	Veth     string   // the host's end of the container's network interface
+	ImageIDs []string // artifact images which are released by cleanup
+	// CheckpointDir is the host directory mounted at /.checkpoint when
+	// checkpoint/restore is enabled, it is removed by cleanup
+	CheckpointDir string
+	job           *host.Job
+	ports         bool // whether the job's host ports are reserved
+	l             *LibvirtLXCBackend
+	done          chan struct{}
 	*containerinit.Client
 }
 
@@ -192,9 +217,27 @@ func readDockerImageConfig(id string) (*dockerImageConfig, error) {
 	return &res.Config, nil
 }
 
-func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
+func (l *LibvirtLXCBackend) Run(job *host.Job) error {
+	return l.run(job, "")
+}
+
+// Restore runs the job by restoring the processes checkpointed in dir, which
+// is moved into the job's checkpoint directory.
+func (l *LibvirtLXCBackend) Restore(job *host.Job, dir string) error {
+	if l.checkpoints == nil {
+		return errCheckpointDisabled
+	}
+	if job.Config.TTY {
+		return errors.New("host: jobs with a TTY can't be restored")
+	}
+	return l.run(job, dir)
+}
+
+// run starts the job, restoring its processes from the checkpoint in restore
+// if it is set.
+func (l *LibvirtLXCBackend) run(job *host.Job, restore string) (err error) {
 	g := grohl.NewContext(grohl.Data{"backend": "libvirt-lxc", "fn": "run", "job.id": job.ID})
-	g.Log(grohl.Data{"at": "start", "job.artifact.uri": job.Artifact.URI, "job.cmd": job.Config.Cmd})
+	g.Log(grohl.Data{"at": "start", "job.artifact.uri": job.Artifact.URI, "job.cmd": job.Config.Cmd, "restore": restore != ""})
 
 	ip, err := ipallocator.RequestIP(bridgeNet, nil)
 	if err != nil {
@@ -213,17 +256,13 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		}
 	}()
 
-	g.Log(grohl.Data{"at": "pull_image"})
-	layers, err := pinkerton.Pull(job.Artifact.URI)
-	if err != nil {
-		g.Log(grohl.Data{"at": "pull_image", "status": "error", "err": err})
+	if err := validateTmpfs(&job.Config); err != nil {
+		g.Log(grohl.Data{"at": "validate_tmpfs", "status": "error", "err": err})
 		return err
 	}
-	imageID, err := pinkerton.ImageID(job.Artifact.URI)
-	if err == pinkerton.ErrNoImageID && len(layers) > 0 {
-		imageID = layers[len(layers)-1].ID
-	} else if err != nil {
-		g.Log(grohl.Data{"at": "image_id", "status": "error", "err": err})
+
+	imageID, err := l.pullArtifact(container, job.Artifact)
+	if err != nil {
 		return err
 	}
 
@@ -235,7 +274,7 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 	}
 
 	g.Log(grohl.Data{"at": "checkout"})
-	rootPath, err := pinkerton.Checkout(job.ID, imageID)
+	rootPath, err := pinkerton.Checkout(job.ID, imageID, job.Resources.Disk)
 	if err != nil {
 		g.Log(grohl.Data{"at": "checkout", "status": "error", "err": err})
 		return err
@@ -247,11 +286,21 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		g.Log(grohl.Data{"at": "mount", "file": ".containerinit", "status": "error", "err": err})
 		return err
 	}
+	if l.checkpoints != nil {
+		if err := l.mountCheckpoint(g, container, restore); err != nil {
+			return err
+		}
+	}
 	if err := os.MkdirAll(filepath.Join(rootPath, "etc"), 0755); err != nil {
 		g.Log(grohl.Data{"at": "mkdir", "dir": "etc", "status": "error", "err": err})
 		return err
 	}
-	if err := bindMount("/etc/resolv.conf", filepath.Join(rootPath, "etc/resolv.conf"), false, true); err != nil {
+	if customResolvConf(&job.Config) {
+		if err := writeResolvConf(filepath.Join(rootPath, "etc/resolv.conf"), "/etc/resolv.conf", &job.Config); err != nil {
+			g.Log(grohl.Data{"at": "write_resolv_conf", "status": "error", "err": err})
+			return err
+		}
+	} else if err := bindMount("/etc/resolv.conf", filepath.Join(rootPath, "etc/resolv.conf"), false, true); err != nil {
 		g.Log(grohl.Data{"at": "mount", "file": "resolv.conf", "status": "error", "err": err})
 		return err
 	}
@@ -259,10 +308,29 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		g.Log(grohl.Data{"at": "write_hosts", "status": "error", "err": err})
 		return err
 	}
+	if len(job.Config.Hosts) > 0 {
+		if err := appendHosts(filepath.Join(rootPath, "etc/hosts"), &job.Config); err != nil {
+			g.Log(grohl.Data{"at": "write_hosts", "status": "error", "err": err})
+			return err
+		}
+	}
+	if len(job.Config.Secrets) > 0 {
+		if err := writeSecrets(filepath.Join(rootPath, secretsPath), job.Config.Secrets, job.Config.Uid); err != nil {
+			g.Log(grohl.Data{"at": "write_secrets", "status": "error", "err": err})
+			return err
+		}
+	}
 	if err := os.MkdirAll(filepath.Join(rootPath, ".container-shared"), 0700); err != nil {
 		g.Log(grohl.Data{"at": "mkdir", "dir": ".container-shared", "status": "error", "err": err})
 		return err
 	}
+	if job.Config.ReadOnlyRoot {
+		// containerinit creates its socket in the shared directory
+		if err := mountTmpfs(filepath.Join(rootPath, containerinit.SharedPath), 1<<20, 0700); err != nil {
+			g.Log(grohl.Data{"at": "mount", "location": containerinit.SharedPath, "status": "error", "err": err})
+			return err
+		}
+	}
 	for i, m := range job.Config.Mounts {
 		if err := os.MkdirAll(filepath.Join(rootPath, m.Location), 0755); err != nil {
 			g.Log(grohl.Data{"at": "mkdir_mount", "dir": m.Location, "status": "error", "err": err})
@@ -282,45 +350,42 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		}
 	}
 
-	if job.Config.Env == nil {
-		job.Config.Env = make(map[string]string)
-	}
-	for i, p := range job.Config.Ports {
-		if p.Proto != "tcp" && p.Proto != "udp" {
-			return fmt.Errorf("unknown port proto %q", p.Proto)
+	for _, t := range job.Config.Tmpfs {
+		if err := mountTmpfs(filepath.Join(rootPath, t.Location), t.Size, 01777); err != nil {
+			g.Log(grohl.Data{"at": "mount_tmpfs", "location": t.Location, "status": "error", "err": err})
+			return err
 		}
+	}
 
-		if 0 < p.RangeEnd && p.RangeEnd < p.Port {
-			return fmt.Errorf("port range end %d cannot be less than port %d", p.RangeEnd, p.Port)
+	for i, a := range job.Artifacts {
+		if err := l.mountArtifact(g, container, i, a); err != nil {
+			return err
 		}
+	}
 
-		var port uint16
-		if p.Port <= 0 {
-			job.Config.Ports[i].RangeEnd = 0
-			port, err = l.ports[p.Proto].Get()
-		} else if p.RangeEnd > p.Port {
-			for j := p.RangeEnd; j >= p.Port; j-- {
-				port, err = l.ports[p.Proto].GetPort(uint16(j))
-				if err != nil {
-					break
-				}
-			}
-		} else {
-			port, err = l.ports[p.Proto].GetPort(uint16(p.Port))
-		}
-		if err != nil {
-			g.Log(grohl.Data{"at": "alloc_port", "status": "error", "err": err})
+	if job.Config.Env == nil {
+		job.Config.Env = make(map[string]string)
+	}
+	if !job.Config.TTY {
+		// the log is opened before the job starts so that jobs whose log
+		// driver fails aren't started
+		g.Log(grohl.Data{"at": "open_log"})
+		if _, err := l.openLog(job); err != nil {
+			g.Log(grohl.Data{"at": "open_log", "status": "error", "err": err})
 			return err
 		}
-		job.Config.Ports[i].Port = int(port)
-		if job.Config.Ports[i].RangeEnd == 0 {
-			job.Config.Ports[i].RangeEnd = int(port)
-		}
-
+	}
+	g.Log(grohl.Data{"at": "alloc_ports"})
+	if err := allocatePorts(l.ports, job.Config.Ports); err != nil {
+		g.Log(grohl.Data{"at": "alloc_ports", "status": "error", "err": err})
+		return err
+	}
+	container.ports = true
+	for i, p := range job.Config.Ports {
 		if i == 0 {
-			job.Config.Env["PORT"] = strconv.Itoa(int(port))
+			job.Config.Env["PORT"] = strconv.Itoa(p.Port)
 		}
-		job.Config.Env[fmt.Sprintf("PORT_%d", i)] = strconv.Itoa(int(port))
+		job.Config.Env[fmt.Sprintf("PORT_%d", i)] = strconv.Itoa(p.Port)
 	}
 
 	g.Log(grohl.Data{"at": "write_env"})
@@ -340,10 +405,27 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		return err
 	}
 
+	seccomp, err := l.profiles.Seccomp(job.Config.Seccomp)
+	if err != nil {
+		g.Log(grohl.Data{"at": "seccomp", "status": "error", "err": err})
+		return err
+	}
+	apparmor, err := l.profiles.AppArmor(job.Config.AppArmor)
+	if err != nil {
+		g.Log(grohl.Data{"at": "apparmor", "status": "error", "err": err})
+		return err
+	}
+
 	args := []string{
 		"-i", ip.String() + "/24",
 		"-g", bridgeAddr.String(),
 	}
+	if seccomp != "" {
+		args = append(args, "-seccomp", seccomp)
+	}
+	if apparmor != "" {
+		args = append(args, "-apparmor", apparmor)
+	}
 	if job.Config.TTY {
 		args = append(args, "-tty")
 	}
@@ -355,6 +437,18 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 	} else if imageConfig.WorkingDir != "" {
 		args = append(args, "-w", imageConfig.WorkingDir)
 	}
+	if job.Resources.MaxFD > 0 {
+		args = append(args, "-max-fd", strconv.Itoa(job.Resources.MaxFD))
+	}
+	if job.Resources.MaxProcs > 0 {
+		args = append(args, "-max-procs", strconv.Itoa(job.Resources.MaxProcs))
+	}
+	if job.Resources.MaxCore > 0 {
+		args = append(args, "-max-core", strconv.FormatInt(job.Resources.MaxCore, 10))
+	}
+	if restore != "" {
+		args = append(args, "-restore", filepath.Join(checkpointMountPath, "restore"))
+	}
 	if job.Config.Uid > 0 {
 		args = append(args, "-u", strconv.Itoa(job.Config.Uid))
 	} else if imageConfig.User != "" {
@@ -395,10 +489,23 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 				Source: lt.InterfaceSrc{Network: libvirtNetName},
 			}},
 			Consoles: []lt.Console{{Type: "pty"}},
+			HostDevs: hostDevs(job.Config.Devices),
 		},
 		OnPoweroff: "preserve",
 		OnCrash:    "preserve",
 	}
+	if job.Resources.Memory > 0 {
+		memory := lt.UnitInt{Value: job.Resources.Memory, Unit: "KiB"}
+		domain.Memory = memory
+		domain.MemTune = &lt.MemTune{HardLimit: &memory, SwapHardLimit: &memory}
+	}
+	if job.Config.ReadOnlyRoot {
+		// the host's mounts in the root filesystem stay writable
+		domain.Devices.Filesystems[0].ReadOnly = &lt.ReadOnly{}
+	}
+	if job.Resources.CPUShares > 0 {
+		domain.CPUTune = &lt.CPUTune{Shares: job.Resources.CPUShares}
+	}
 
 	g.Log(grohl.Data{"at": "define_domain"})
 	vd, err := l.libvirt.DomainDefineXML(string(domain.XML()))
@@ -438,13 +545,28 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 		return err
 	}
 	iface := domain.Devices.Interfaces[0].Target.Dev
+	container.Veth = iface
 	if err := enableHairpinMode(iface); err != nil {
 		g.Log(grohl.Data{"at": "enable_hairpin", "status": "error", "err": err})
 		return err
 	}
+	if err := shapeBandwidth(iface, &job.Resources); err != nil {
+		g.Log(grohl.Data{"at": "shape_bandwidth", "status": "error", "err": err})
+		return err
+	}
+
+	// the ID of a running LXC domain is the pid of its controller, which
+	// is in the domain's cgroups
+	container.PID = domain.ID
+	g.Log(grohl.Data{"at": "notify_oom"})
+	if err := l.notifyOOM(job.ID, domain.ID); err != nil {
+		// the limits are still enforced, so only the reporting is lost
+		g.Log(grohl.Data{"at": "notify_oom", "status": "error", "err": err})
+	}
 
 	for _, p := range job.Config.Ports {
-		if err := l.forwarder.Add(&net.TCPAddr{IP: *ip, Port: p.Port}, p.RangeEnd, p.Proto); err != nil {
+		start, end := hostPorts(p)
+		if err := l.forwarder.Add(start, end, &net.TCPAddr{IP: *ip, Port: p.Port}, p.Proto); err != nil {
 			g.Log(grohl.Data{"at": "forward_port", "port": p.Port, "status": "error", "err": err})
 			return err
 		}
@@ -456,19 +578,30 @@ func (l *LibvirtLXCBackend) Run(job *host.Job) (err error) {
 	return nil
 }
 
+func (l *LibvirtLXCBackend) notifyOOM(jobID string, pid int) error {
+	cgroup, err := memoryCgroup(pid)
+	if err != nil {
+		return err
+	}
+	return notifyOOM(cgroup, func() { l.state.SetOOMKilled(jobID) })
+}
+
 func enableHairpinMode(iface string) error {
 	return ioutil.WriteFile("/sys/class/net/"+iface+"/brport/hairpin_mode", []byte("1"), 0666)
 }
 
-func (l *LibvirtLXCBackend) openLog(id string) *logbuf.Log {
+func (l *LibvirtLXCBackend) openLog(job *host.Job) (LogDriver, error) {
 	l.logsMtx.Lock()
 	defer l.logsMtx.Unlock()
-	if _, ok := l.logs[id]; !ok {
-		// TODO: configure retention and log size
-		l.logs[id] = logbuf.NewLog(&lumberjack.Logger{Dir: filepath.Join(l.LogPath, id)})
+	if _, ok := l.logs[job.ID]; !ok {
+		log, err := newLogDriver(job, l.LogPath)
+		if err != nil {
+			return nil, err
+		}
+		l.logs[job.ID] = log
 	}
 	// TODO: do reference counting and remove logs that are not in use from memory
-	return l.logs[id]
+	return l.logs[job.ID], nil
 }
 
 func (c *libvirtContainer) watch(ready chan<- error) error {
@@ -526,7 +659,13 @@ func (c *libvirtContainer) watch(ready chan<- error) error {
 			g.Log(grohl.Data{"at": "get_stdout", "status": "error", "err": err.Error()})
 			return err
 		}
-		log := c.l.openLog(c.job.ID)
+		log, err := c.l.openLog(c.job)
+		if err != nil {
+			// the output must still be read so that the job doesn't
+			// block writing it
+			g.Log(grohl.Data{"at": "open_log", "status": "error", "err": err})
+			log = nullLog{}
+		}
 		defer log.Close()
 		// TODO: log errors from these
 		go log.ReadFrom(1, stdout)
@@ -576,8 +715,35 @@ func (c *libvirtContainer) cleanup() error {
 	if err := syscall.Unmount(filepath.Join(c.RootPath, ".containerinit"), 0); err != nil {
 		g.Log(grohl.Data{"at": "unmount", "file": ".containerinit", "status": "error", "err": err})
 	}
-	if err := syscall.Unmount(filepath.Join(c.RootPath, "etc/resolv.conf"), 0); err != nil {
-		g.Log(grohl.Data{"at": "unmount", "file": "resolv.conf", "status": "error", "err": err})
+	if !customResolvConf(&c.job.Config) {
+		if err := syscall.Unmount(filepath.Join(c.RootPath, "etc/resolv.conf"), 0); err != nil {
+			g.Log(grohl.Data{"at": "unmount", "file": "resolv.conf", "status": "error", "err": err})
+		}
+	}
+	if len(c.job.Config.Secrets) > 0 {
+		if err := syscall.Unmount(filepath.Join(c.RootPath, secretsPath), 0); err != nil {
+			g.Log(grohl.Data{"at": "unmount", "location": secretsPath, "status": "error", "err": err})
+		}
+	}
+	for _, t := range c.job.Config.Tmpfs {
+		if err := syscall.Unmount(filepath.Join(c.RootPath, t.Location), 0); err != nil {
+			g.Log(grohl.Data{"at": "unmount", "location": t.Location, "status": "error", "err": err})
+		}
+	}
+	if c.job.Config.ReadOnlyRoot {
+		if err := syscall.Unmount(filepath.Join(c.RootPath, containerinit.SharedPath), 0); err != nil {
+			g.Log(grohl.Data{"at": "unmount", "location": containerinit.SharedPath, "status": "error", "err": err})
+		}
+	}
+	if c.CheckpointDir != "" {
+		for _, location := range []string{criuMountPath, checkpointMountPath} {
+			if err := syscall.Unmount(filepath.Join(c.RootPath, location), 0); err != nil {
+				g.Log(grohl.Data{"at": "unmount", "location": location, "status": "error", "err": err})
+			}
+		}
+		if err := os.RemoveAll(c.CheckpointDir); err != nil {
+			g.Log(grohl.Data{"at": "remove_checkpoints", "status": "error", "err": err})
+		}
 	}
 	if err := pinkerton.Cleanup(c.job.ID); err != nil {
 		g.Log(grohl.Data{"at": "pinkerton", "status": "error", "err": err})
@@ -587,16 +753,25 @@ func (c *libvirtContainer) cleanup() error {
 			g.Log(grohl.Data{"at": "unmount", "location": m.Location, "status": "error", "err": err})
 		}
 	}
-	for _, p := range c.job.Config.Ports {
-		if err := c.l.forwarder.Remove(&net.TCPAddr{IP: c.IP, Port: p.Port}, p.RangeEnd, p.Proto); err != nil {
-			g.Log(grohl.Data{"at": "iptables", "status": "error", "err": err, "port": p.Port})
+	c.l.artifacts.Release(c.ImageIDs...)
+	for i, a := range c.job.Artifacts {
+		location := artifactLocation(i)
+		if err := syscall.Unmount(filepath.Join(c.RootPath, location), 0); err != nil {
+			g.Log(grohl.Data{"at": "unmount", "location": location, "status": "error", "err": err})
 		}
-		if p.RangeEnd == 0 {
-			p.RangeEnd = p.Port
+		if err := pinkerton.Cleanup(artifactCheckoutID(c.job.ID, i)); err != nil {
+			g.Log(grohl.Data{"at": "pinkerton", "artifact": a.URI, "status": "error", "err": err})
 		}
-		for i := p.Port; i <= p.RangeEnd; i++ {
-			c.l.ports[p.Proto].Put(uint16(i))
+	}
+	// the ports of jobs which failed to reserve them belong to other jobs
+	if c.ports {
+		for _, p := range c.job.Config.Ports {
+			start, end := hostPorts(p)
+			if err := c.l.forwarder.Remove(start, end, &net.TCPAddr{IP: c.IP, Port: p.Port}, p.Proto); err != nil {
+				g.Log(grohl.Data{"at": "iptables", "status": "error", "err": err, "port": start})
+			}
 		}
+		releasePorts(c.l.ports, c.job.Config.Ports)
 	}
 	ipallocator.ReleaseIP(bridgeNet, &c.IP)
 	g.Log(grohl.Data{"at": "finish"})
@@ -617,13 +792,7 @@ func (c *libvirtContainer) WaitStop(timeout time.Duration) error {
 }
 
 func (c *libvirtContainer) Stop() error {
-	if err := c.Signal(int(syscall.SIGTERM)); err != nil {
-		return err
-	}
-	if err := c.WaitStop(10 * time.Second); err != nil {
-		return c.Signal(int(syscall.SIGKILL))
-	}
-	return nil
+	return stopJob(c.l.state, c.job, c.Signal, c.WaitStop)
 }
 
 func (l *LibvirtLXCBackend) Stop(id string) error {
@@ -634,6 +803,27 @@ func (l *LibvirtLXCBackend) Stop(id string) error {
 	return c.Stop()
 }
 
+func (l *LibvirtLXCBackend) JobStats(id string) (*host.JobStats, error) {
+	c, err := l.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	stats := &host.JobStats{}
+	if err := readCgroupStats(c.PID, stats); err != nil {
+		return nil, err
+	}
+	// the controller is not in the container's network namespace
+	if stats.Network, err = readVethStats(c.Veth); err != nil {
+		return nil, err
+	}
+	if c.job.Resources.Disk > 0 {
+		if stats.Disk.Usage, stats.Disk.Limit, err = pinkerton.DiskUsage(c.job.ID); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
 func (l *LibvirtLXCBackend) getContainer(id string) (*libvirtContainer, error) {
 	l.containersMtx.RLock()
 	defer l.containersMtx.RUnlock()
@@ -719,8 +909,24 @@ func (l *LibvirtLXCBackend) Attach(req *AttachRequest) (err error) {
 		}()
 	}
 
-	log := l.openLog(req.Job.Job.ID)
-	r := log.NewReader()
+	log, err := l.openLog(req.Job.Job)
+	if err != nil {
+		return err
+	}
+	follower, ok := log.(LogFollower)
+	if !ok {
+		// the output isn't kept, so only the job's exit can be waited for
+		if req.Stream && client == nil {
+			if client, err = l.getContainer(req.Job.Job.ID); err != nil {
+				return err
+			}
+		}
+		if req.Attached != nil {
+			req.Attached <- struct{}{}
+		}
+		return io.EOF
+	}
+	r := follower.NewReader()
 	defer r.Close()
 	if !req.Logs {
 		if err := r.SeekToEnd(); err != nil {
@@ -732,11 +938,22 @@ func (l *LibvirtLXCBackend) Attach(req *AttachRequest) (err error) {
 		req.Attached <- struct{}{}
 	}
 
+	var enc *json.Encoder
+	if req.Timestamps {
+		enc = json.NewEncoder(req.Stdout)
+	}
+
 	for {
 		data, err := r.ReadData(req.Stream)
 		if err != nil {
 			return err
 		}
+		if enc != nil {
+			if err := enc.Encode(data); err != nil {
+				return nil
+			}
+			continue
+		}
 		switch data.Stream {
 		case 1:
 			if req.Stdout == nil {
@@ -756,6 +973,141 @@ func (l *LibvirtLXCBackend) Attach(req *AttachRequest) (err error) {
 	}
 }
 
+// Exec runs a command in the job's container using its containerinit, which
+// starts it in the container's namespaces and cgroups.
+func (l *LibvirtLXCBackend) Exec(id string, req *host.ExecReq) (ExecProcess, error) {
+	c, err := l.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	env := make([]string, 0, len(req.Env))
+	for k, v := range req.Env {
+		env = append(env, k+"="+v)
+	}
+	e := &libvirtExec{client: c.Client, id: random.UUID()}
+	if err := c.Exec(&containerinit.ExecReq{
+		ID:    e.id,
+		Args:  req.Cmd,
+		Env:   env,
+		TTY:   req.TTY,
+		Stdin: req.Stdin,
+	}); err != nil {
+		return nil, err
+	}
+	if err := e.openStreams(req); err != nil {
+		e.close()
+		e.Signal(int(syscall.SIGKILL))
+		go e.Wait()
+		return nil, err
+	}
+	return e, nil
+}
+
+// Checkpoint dumps the job's processes with criu into a new directory in the
+// job's checkpoint directory, which criu writes to through its mount at
+// /.checkpoint in the container.
+func (l *LibvirtLXCBackend) Checkpoint(id string, leaveRunning bool) (string, error) {
+	if l.checkpoints == nil {
+		return "", errCheckpointDisabled
+	}
+	c, err := l.getContainer(id)
+	if err != nil {
+		return "", err
+	}
+	if c.CheckpointDir == "" {
+		return "", errors.New("host: the job was started before checkpoint/restore was enabled")
+	}
+	if c.job.Config.TTY {
+		return "", errors.New("host: jobs with a TTY can't be checkpointed")
+	}
+	name := "dump-" + random.UUID()
+	if err := c.Client.Checkpoint(&containerinit.CheckpointReq{
+		Dir:          filepath.Join(checkpointMountPath, name),
+		LeaveRunning: leaveRunning,
+	}); err != nil {
+		return "", err
+	}
+	return filepath.Join(c.CheckpointDir, name), nil
+}
+
+type libvirtExec struct {
+	client *containerinit.Client
+	id     string
+	files  []*os.File
+	pty    *os.File
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+}
+
+func (e *libvirtExec) openStreams(req *host.ExecReq) error {
+	open := func(stream int) (*os.File, error) {
+		f, err := e.client.ExecFD(e.id, stream)
+		if err != nil {
+			return nil, err
+		}
+		e.files = append(e.files, f)
+		return f, nil
+	}
+	if req.TTY {
+		pty, err := open(1)
+		if err != nil {
+			return err
+		}
+		e.pty, e.stdout = pty, pty
+		if req.Stdin {
+			// closing stdin leaves the pty open for the output
+			e.stdin = nopWriteCloser{pty}
+		}
+		if req.Height > 0 && req.Width > 0 {
+			return e.ResizeTTY(req.Height, req.Width)
+		}
+		return nil
+	}
+	if req.Stdin {
+		stdin, err := open(0)
+		if err != nil {
+			return err
+		}
+		e.stdin = stdin
+	}
+	stdout, err := open(1)
+	if err != nil {
+		return err
+	}
+	stderr, err := open(2)
+	if err != nil {
+		return err
+	}
+	e.stdout, e.stderr = stdout, stderr
+	return nil
+}
+
+func (e *libvirtExec) close() {
+	for _, f := range e.files {
+		f.Close()
+	}
+}
+
+func (e *libvirtExec) Streams() (io.WriteCloser, io.ReadCloser, io.ReadCloser) {
+	return e.stdin, e.stdout, e.stderr
+}
+
+func (e *libvirtExec) Signal(sig int) error {
+	return e.client.ExecSignal(e.id, sig)
+}
+
+func (e *libvirtExec) ResizeTTY(height, width uint16) error {
+	if e.pty == nil {
+		return errors.New("exec doesn't have a TTY")
+	}
+	return term.SetWinsize(e.pty.Fd(), &term.Winsize{Height: height, Width: width})
+}
+
+func (e *libvirtExec) Wait() (int, error) {
+	return e.client.ExecWait(e.id)
+}
+
 func (l *LibvirtLXCBackend) Cleanup() error {
 	g := grohl.NewContext(grohl.Data{"backend": "libvirt-lxc", "fn": "Cleanup"})
 	l.containersMtx.Lock()
@@ -792,30 +1144,29 @@ func (l *LibvirtLXCBackend) RestoreState(jobs map[string]*host.ActiveJob, dec *j
 	if err := dec.Decode(&containers); err != nil {
 		return err
 	}
-	for _, j := range jobs {
+	for id, j := range jobs {
 		container, ok := containers[j.Job.ID]
 		if !ok {
+			if jobActive(j) {
+				delete(jobs, id)
+			}
 			continue
 		}
 		container.l = l
 		container.job = j.Job
+		l.artifacts.Acquire(container.ImageIDs...)
+		reservePorts(l.ports, j.Job.Config.Ports)
+		container.ports = true
 		container.done = make(chan struct{})
 		status := make(chan error)
 		go container.watch(status)
 		if err := <-status; err != nil {
-			// log error
-			l.state.RemoveJob(j.Job.ID)
-			container.cleanup()
+			// the container has stopped or containerinit is not
+			// responding, watch cleans the container up
+			delete(jobs, id)
 			continue
 		}
 		l.containers[j.Job.ID] = container
-
-		for _, p := range j.Job.Config.Ports {
-			for i := p.Port; i <= p.RangeEnd; i++ {
-				l.ports[p.Proto].GetPort(uint16(i))
-			}
-		}
-
 	}
 	return nil
 }
@@ -826,6 +1177,102 @@ func (l *LibvirtLXCBackend) SaveState(e *json.Encoder) error {
 	return e.Encode(l.containers)
 }
 
+// hostDevs returns the libvirt devices which pass the job's allocated devices
+// through to its container.
+func hostDevs(devices []host.DeviceRequest) []lt.HostDev {
+	var res []lt.HostDev
+	for _, d := range devices {
+		for _, path := range d.Paths {
+			res = append(res, lt.HostDev{Mode: "capabilities", Type: "misc", SrcChar: path})
+		}
+	}
+	return res
+}
+
+// artifactCheckoutID returns the pinkerton checkout ID of the i'th of a job's
+// additional artifacts.
+func artifactCheckoutID(jobID string, i int) string {
+	return fmt.Sprintf("%s-artifact%d", jobID, i+1)
+}
+
+// pullArtifact pulls the image of an artifact, checks it against the
+// artifact's checksum and returns its ID. The image is kept in the artifact
+// cache until the container is cleaned up.
+func (l *LibvirtLXCBackend) pullArtifact(c *libvirtContainer, a host.Artifact) (string, error) {
+	creds, err := l.registry.Credentials(a.URI, c.job.RegistryAuth)
+	if err != nil {
+		return "", err
+	}
+	imageID, err := l.artifacts.Pull(a, creds)
+	if err != nil {
+		return "", err
+	}
+	c.ImageIDs = append(c.ImageIDs, imageID)
+	return imageID, nil
+}
+
+// PullArtifact pulls the image of an artifact so that jobs using it start
+// without waiting for it to be pulled.
+func (l *LibvirtLXCBackend) PullArtifact(a host.Artifact) error {
+	creds, err := l.registry.Credentials(a.URI, nil)
+	if err != nil {
+		return err
+	}
+	return l.artifacts.Prefetch(a, creds)
+}
+
+// mountArtifact pulls and checks out the i'th of a job's additional artifacts
+// and mounts it read-only in the container's root.
+func (l *LibvirtLXCBackend) mountArtifact(g *grohl.Context, c *libvirtContainer, i int, a host.Artifact) error {
+	imageID, err := l.pullArtifact(c, a)
+	if err != nil {
+		return err
+	}
+	path, err := pinkerton.Checkout(artifactCheckoutID(c.job.ID, i), imageID, 0)
+	if err != nil {
+		g.Log(grohl.Data{"at": "checkout_artifact", "status": "error", "err": err})
+		return err
+	}
+	location := artifactLocation(i)
+	if err := bindMount(path, filepath.Join(c.RootPath, location), false, true); err != nil {
+		g.Log(grohl.Data{"at": "mount_artifact", "location": location, "status": "error", "err": err})
+		return err
+	}
+	return nil
+}
+
+const (
+	criuMountPath       = containerinit.CRIUPath
+	checkpointMountPath = "/.checkpoint"
+)
+
+// mountCheckpoint mounts the criu binary and the job's checkpoint directory
+// into the container, moving the checkpoint in restore into the directory
+// first if it is set.
+func (l *LibvirtLXCBackend) mountCheckpoint(g *grohl.Context, c *libvirtContainer, restore string) error {
+	dir := l.checkpoints.JobDir(c.job.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		g.Log(grohl.Data{"at": "mkdir", "dir": dir, "status": "error", "err": err})
+		return err
+	}
+	c.CheckpointDir = dir
+	if restore != "" {
+		if err := os.Rename(restore, filepath.Join(dir, "restore")); err != nil {
+			g.Log(grohl.Data{"at": "move_checkpoint", "status": "error", "err": err})
+			return err
+		}
+	}
+	if err := bindMount(l.checkpoints.criu, filepath.Join(c.RootPath, criuMountPath), false, true); err != nil {
+		g.Log(grohl.Data{"at": "mount", "file": criuMountPath, "status": "error", "err": err})
+		return err
+	}
+	if err := bindMount(dir, filepath.Join(c.RootPath, checkpointMountPath), true, true); err != nil {
+		g.Log(grohl.Data{"at": "mount", "location": checkpointMountPath, "status": "error", "err": err})
+		return err
+	}
+	return nil
+}
+
 func bindMount(src, dest string, writeable, private bool) error {
 	srcStat, err := os.Stat(src)
 	if err != nil {
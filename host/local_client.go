@@ -60,3 +60,7 @@ func (c *localClient) RegisterHost(h *host.Host, jobs chan *host.Job) cluster.St
 func (c *localClient) RemoveJobs(jobs []string) error {
 	return c.c.RemoveJobs(&c.host, jobs, nil)
 }
+
+func (c *localClient) DrainHost() error {
+	return c.c.DrainHost(&c.host, struct{}{}, nil)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/logbuf"
+	"github.com/flynn/flynn/host/types"
+)
+
+const (
+	logDrainTimeout = 5 * time.Second
+
+	// logDrainRetryInterval is how long messages are dropped for after
+	// sending to a drain fails, rather than holding up the other drains.
+	logDrainRetryInterval = 10 * time.Second
+)
+
+// logDrainClient sends messages to https drains.
+var logDrainClient = &http.Client{Timeout: logDrainTimeout}
+
+// syslogMessage formats a line of output from a job as an RFC 5424 syslog
+// message, framed with its length as in RFC 6587. The app name is used as the
+// hostname and the process type as the app-name so drains can tell the
+// processes of an app apart.
+func syslogMessage(job *host.Job, data *logbuf.Data, line string) []byte {
+	// facility user, severity info for stdout and error for stderr
+	pri := 8 + 6
+	if data.Stream == 2 {
+		pri = 8 + 3
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s %s - - %s",
+		pri,
+		data.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogField(job.Metadata["flynn-controller.app_name"]),
+		syslogField(job.Metadata["flynn-controller.type"]),
+		syslogField(job.ID),
+		line,
+	)
+	return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+}
+
+// syslogField returns s with the characters not allowed in a syslog header
+// field removed, or "-" if it is empty.
+func syslogField(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < '!' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+type logDrain interface {
+	Send(msg []byte) error
+	Close() error
+}
+
+func newLogDrain(d host.LogDrain) (logDrain, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "syslog":
+		return &syslogDrain{addr: u.Host}, nil
+	case "syslog+tls":
+		return &syslogDrain{addr: u.Host, tls: true}, nil
+	case "https":
+		return &httpsDrain{url: d.URL, username: d.Username, password: d.Password}, nil
+	default:
+		return nil, fmt.Errorf("unsupported log drain scheme %q", u.Scheme)
+	}
+}
+
+// syslogDrain sends messages over a TCP connection, which is reopened by the
+// next message if sending fails.
+type syslogDrain struct {
+	addr string
+	tls  bool
+	conn net.Conn
+}
+
+func (d *syslogDrain) Send(msg []byte) error {
+	if d.conn == nil {
+		dialer := &net.Dialer{Timeout: logDrainTimeout}
+		var err error
+		if d.tls {
+			d.conn, err = tls.DialWithDialer(dialer, "tcp", d.addr, nil)
+		} else {
+			d.conn, err = dialer.Dial("tcp", d.addr)
+		}
+		if err != nil {
+			d.conn = nil
+			return err
+		}
+	}
+	d.conn.SetWriteDeadline(time.Now().Add(logDrainTimeout))
+	if _, err := d.conn.Write(msg); err != nil {
+		d.Close()
+		return err
+	}
+	return nil
+}
+
+func (d *syslogDrain) Close() error {
+	if d.conn == nil {
+		return nil
+	}
+	err := d.conn.Close()
+	d.conn = nil
+	return err
+}
+
+// httpsDrain posts each message in the logplex format used by Heroku drains.
+type httpsDrain struct {
+	url      string
+	username string
+	password string
+}
+
+func (d *httpsDrain) Send(msg []byte) error {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/logplex-1")
+	req.Header.Set("Logplex-Msg-Count", "1")
+	if d.username != "" || d.password != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+	res, err := logDrainClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (d *httpsDrain) Close() error { return nil }
+
+// logDrainer forwards the output of jobs which have log drains.
+type logDrainer struct {
+	state   *State
+	backend Backend
+}
+
+func newLogDrainer(state *State, backend Backend) *logDrainer {
+	return &logDrainer{state: state, backend: backend}
+}
+
+// Run forwards the output of jobs as they start. Jobs which are already
+// running are forwarded the output written from now on.
+func (d *logDrainer) Run(events <-chan host.Event) {
+	for _, job := range d.state.Get() {
+		if job.Status == host.StatusRunning && hasLogDrains(job.Job) {
+			job := job
+			go d.forward(&job, false)
+		}
+	}
+	for event := range events {
+		if event.Event == "start" && hasLogDrains(event.Job.Job) {
+			go d.forward(event.Job, true)
+		}
+	}
+}
+
+// hasLogDrains returns whether the job's output should be forwarded, it can
+// only be if the host keeps it.
+func hasLogDrains(job *host.Job) bool {
+	return len(job.LogDrains) > 0 && keepsOutput(job)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// forward sends the output of a job to its drains until the job stops,
+// starting from the beginning of its log if logs is set.
+func (d *logDrainer) forward(job *host.ActiveJob, logs bool) {
+	g := grohl.NewContext(grohl.Data{"fn": "log_drain", "job.id": job.Job.ID})
+
+	drains := make([]logDrain, 0, len(job.Job.LogDrains))
+	for _, ld := range job.Job.LogDrains {
+		drain, err := newLogDrain(ld)
+		if err != nil {
+			g.Log(grohl.Data{"at": "open", "status": "error", "err": err})
+			continue
+		}
+		defer drain.Close()
+		drains = append(drains, drain)
+	}
+	if len(drains) == 0 {
+		return
+	}
+	retryAt := make([]time.Time, len(drains))
+
+	r, w := io.Pipe()
+	go func() {
+		// with timestamps both streams are written to stdout as logbuf
+		// records, stderr must be set for them to be included
+		err := d.backend.Attach(&AttachRequest{
+			Job:        job,
+			Logs:       logs,
+			Stream:     true,
+			Timestamps: true,
+			Stdout:     w,
+			Stderr:     nopWriteCloser{ioutil.Discard},
+		})
+		if _, ok := err.(ExitError); ok {
+			err = nil
+		}
+		w.CloseWithError(err)
+	}()
+	defer r.Close()
+
+	dec := json.NewDecoder(r)
+	for {
+		var data logbuf.Data
+		if err := dec.Decode(&data); err != nil {
+			if err != io.EOF {
+				g.Log(grohl.Data{"at": "read", "status": "error", "err": err})
+			}
+			return
+		}
+		for _, line := range strings.Split(data.Message, "\n") {
+			if line == "" {
+				continue
+			}
+			msg := syslogMessage(job.Job, &data, line)
+			for i, drain := range drains {
+				if time.Now().Before(retryAt[i]) {
+					continue
+				}
+				if err := drain.Send(msg); err != nil {
+					g.Log(grohl.Data{"at": "send", "status": "error", "drain": i, "err": err})
+					retryAt[i] = time.Now().Add(logDrainRetryInterval)
+				}
+			}
+		}
+	}
+}
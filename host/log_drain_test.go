@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/logbuf"
+	"github.com/flynn/flynn/host/types"
+)
+
+func TestSyslogMessage(t *testing.T) {
+	job := &host.Job{
+		ID:       "job1",
+		Metadata: map[string]string{"flynn-controller.app_name": "my-app", "flynn-controller.type": "web"},
+	}
+	ts := logbuf.UnixTime{Time: time.Date(2014, 10, 1, 12, 0, 0, 5000000, time.UTC)}
+	for _, test := range []struct {
+		data *logbuf.Data
+		job  *host.Job
+		msg  string
+	}{
+		{&logbuf.Data{Stream: 1, Timestamp: ts}, job, "<14>1 2014-10-01T12:00:00.005000Z my-app web job1 - - hello"},
+		{&logbuf.Data{Stream: 2, Timestamp: ts}, job, "<11>1 2014-10-01T12:00:00.005000Z my-app web job1 - - hello"},
+		{&logbuf.Data{Stream: 1, Timestamp: ts}, &host.Job{ID: "job2"}, "<14>1 2014-10-01T12:00:00.005000Z - - job2 - - hello"},
+	} {
+		expected := strconv.Itoa(len(test.msg)) + " " + test.msg
+		if msg := string(syslogMessage(test.job, test.data, "hello")); msg != expected {
+			t.Errorf("expected %q, got %q", expected, msg)
+		}
+	}
+}
+
+// readSyslog reads an RFC 6587 octet counted message.
+func readSyslog(r *bufio.Reader) (string, error) {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+	return string(msg), err
+}
+
+func TestSyslogDrain(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	drain, err := newLogDrain(host.LogDrain{URL: "syslog://" + l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer drain.Close()
+	if err := drain.Send([]byte("5 hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg, err := readSyslog(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != "hello" {
+		t.Errorf("expected hello, got %q", msg)
+	}
+
+	if _, err := newLogDrain(host.LogDrain{URL: "ftp://example.com"}); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+}
+
+func TestHTTPSDrain(t *testing.T) {
+	msgs := make(chan string, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, pass, _ := req.BasicAuth(); user != "user" || pass != "pass" {
+			w.WriteHeader(401)
+			return
+		}
+		if req.Header.Get("Content-Type") != "application/logplex-1" {
+			w.WriteHeader(400)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		msgs <- string(body)
+	}))
+	defer srv.Close()
+
+	prev := logDrainClient
+	logDrainClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	defer func() { logDrainClient = prev }()
+
+	drain, err := newLogDrain(host.LogDrain{URL: srv.URL, Username: "user", Password: "pass"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := drain.Send([]byte("5 hello")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-msgs; msg != "5 hello" {
+		t.Errorf("expected %q, got %q", "5 hello", msg)
+	}
+
+	drain, _ = newLogDrain(host.LogDrain{URL: srv.URL, Username: "user", Password: "wrong"})
+	if err := drain.Send([]byte("5 hello")); err == nil {
+		t.Error("expected an error for a rejected message")
+	}
+}
+
+// attachBackend writes the records it is created with to attach requests.
+type attachBackend struct {
+	Backend
+	data []*logbuf.Data
+}
+
+func (b *attachBackend) Attach(req *AttachRequest) error {
+	enc := json.NewEncoder(req.Stdout)
+	for _, d := range b.data {
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	return ExitError(0)
+}
+
+func TestLogDrainerForward(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// records are sent with millisecond timestamps
+	now := logbuf.UnixTime{Time: time.Now().Truncate(time.Millisecond)}
+	backend := &attachBackend{data: []*logbuf.Data{
+		{Stream: 1, Timestamp: now, Message: "one\ntwo\n"},
+		{Stream: 2, Timestamp: now, Message: "three\n"},
+	}}
+	job := &host.ActiveJob{Job: &host.Job{
+		ID:        "a",
+		Metadata:  map[string]string{"flynn-controller.app_name": "app", "flynn-controller.type": "web"},
+		LogDrains: []host.LogDrain{{URL: "syslog://" + l.Addr().String()}},
+	}}
+	done := make(chan struct{})
+	go func() {
+		newLogDrainer(NewState("host0"), backend).forward(job, true)
+		close(done)
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	ts := now.UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+	for _, expected := range []string{
+		"<14>1 " + ts + " app web a - - one",
+		"<14>1 " + ts + " app web a - - two",
+		"<11>1 " + ts + " app web a - - three",
+	} {
+		msg, err := readSyslog(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != expected {
+			t.Errorf("expected %q, got %q", expected, msg)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for forwarding to finish")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/lumberjack"
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/logbuf"
+	"github.com/flynn/flynn/host/types"
+)
+
+// LogDriver writes the output of a job, ReadFrom is called with the job's
+// stdout (stream 1) and stderr (stream 2) and returns once they are closed.
+type LogDriver interface {
+	ReadFrom(stream int, r io.Reader) error
+	Close() error
+}
+
+// LogFollower is implemented by log drivers which keep the output of jobs, so
+// that it can be read by attach requests.
+type LogFollower interface {
+	NewReader() *logbuf.Reader
+}
+
+func newLogDriver(job *host.Job, logPath string) (LogDriver, error) {
+	switch job.LogDriver.Name {
+	case "", host.LogDriverLogbuf:
+		// TODO: configure retention and log size
+		return logbuf.NewLog(&lumberjack.Logger{Dir: filepath.Join(logPath, job.ID)}), nil
+	case host.LogDriverJournald:
+		return newJournaldLog(job)
+	case host.LogDriverNull:
+		return nullLog{}, nil
+	case host.LogDriverRemote:
+		drain, err := newLogDrain(host.LogDrain{URL: job.LogDriver.URL})
+		if err != nil {
+			return nil, err
+		}
+		return &remoteLog{job: job, drain: drain}, nil
+	default:
+		return nil, fmt.Errorf("unknown log driver %q", job.LogDriver.Name)
+	}
+}
+
+// keepsOutput returns whether the host keeps the output of a job, the output
+// of TTY jobs is not logged and other log drivers don't keep it.
+func keepsOutput(job *host.Job) bool {
+	return !job.Config.TTY && (job.LogDriver.Name == "" || job.LogDriver.Name == host.LogDriverLogbuf)
+}
+
+// maxLogLine is the length lines of output are split at by the drivers which
+// write lines.
+const maxLogLine = 32 * 1024
+
+// readLines calls fn with each line read from r, without its newline, until r
+// is closed.
+func readLines(r io.Reader, fn func(line string)) error {
+	br := bufio.NewReaderSize(r, maxLogLine)
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			fn(strings.TrimSuffix(string(line), "\n"))
+		}
+		switch err {
+		case nil, bufio.ErrBufferFull:
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+type nullLog struct{}
+
+func (nullLog) ReadFrom(stream int, r io.Reader) error {
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+func (nullLog) Close() error { return nil }
+
+// remoteLog sends each line of a job's output to a log drain as it is
+// written. Lines are dropped while the drain is failing, so that the job is
+// not blocked writing its output.
+type remoteLog struct {
+	job *host.Job
+
+	mtx     sync.Mutex
+	drain   logDrain
+	retryAt time.Time
+}
+
+func (l *remoteLog) ReadFrom(stream int, r io.Reader) error {
+	return readLines(r, func(line string) {
+		if line == "" {
+			return
+		}
+		data := &logbuf.Data{Stream: stream, Timestamp: logbuf.UnixTime{Time: time.Now()}}
+		l.send(syslogMessage(l.job, data, line))
+	})
+}
+
+func (l *remoteLog) send(msg []byte) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if time.Now().Before(l.retryAt) {
+		return
+	}
+	if err := l.drain.Send(msg); err != nil {
+		grohl.Log(grohl.Data{"fn": "remote_log", "at": "send", "job.id": l.job.ID, "status": "error", "err": err})
+		l.retryAt = time.Now().Add(logDrainRetryInterval)
+	}
+}
+
+func (l *remoteLog) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.drain.Close()
+}
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldLog writes each line of a job's output to the systemd journal with
+// its native protocol, with the job's ID and app as fields.
+type journaldLog struct {
+	conn   net.Conn
+	fields []byte
+}
+
+func newJournaldLog(job *host.Job) (*journaldLog, error) {
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return nil, err
+	}
+	identifier := job.Metadata["flynn-controller.app_name"]
+	if typ := job.Metadata["flynn-controller.type"]; identifier != "" && typ != "" {
+		identifier += "." + typ
+	}
+	if identifier == "" {
+		identifier = "flynn-job"
+	}
+	var fields []byte
+	fields = appendJournalField(fields, "SYSLOG_IDENTIFIER", identifier)
+	fields = appendJournalField(fields, "FLYNN_JOB_ID", job.ID)
+	if app := job.Metadata["flynn-controller.app"]; app != "" {
+		fields = appendJournalField(fields, "FLYNN_APP_ID", app)
+	}
+	return &journaldLog{conn: conn, fields: fields}, nil
+}
+
+func (l *journaldLog) ReadFrom(stream int, r io.Reader) error {
+	// info for stdout and error for stderr, as for log drains
+	priority := "6"
+	if stream == 2 {
+		priority = "3"
+	}
+	return readLines(r, func(line string) {
+		msg := make([]byte, len(l.fields), len(l.fields)+len(line)+32)
+		copy(msg, l.fields)
+		msg = appendJournalField(msg, "PRIORITY", priority)
+		msg = appendJournalField(msg, "MESSAGE", line)
+		// the journal may drop messages when it is overloaded, the job
+		// is not held up by it
+		l.conn.Write(msg)
+	})
+}
+
+func (l *journaldLog) Close() error {
+	return l.conn.Close()
+}
+
+// appendJournalField appends a field in the journal's native format, values
+// which contain newlines are prefixed with their length.
+func appendJournalField(b []byte, key, value string) []byte {
+	if !strings.Contains(value, "\n") {
+		return append(append(append(append(b, key...), '='), value...), '\n')
+	}
+	b = append(append(b, key...), '\n')
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	b = append(b, size[:]...)
+	return append(append(b, value...), '\n')
+}
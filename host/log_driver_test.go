@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+func TestReadLines(t *testing.T) {
+	long := strings.Repeat("a", maxLogLine+10)
+	var lines []string
+	err := readLines(strings.NewReader("one\n\ntwo\n"+long+"\nlast"), func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"one", "", "two", long[:maxLogLine], long[maxLogLine:], "last"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected %d lines, got %d: %q", len(expected), len(lines), lines)
+	}
+}
+
+func TestJournalField(t *testing.T) {
+	if f := string(appendJournalField(nil, "MESSAGE", "hello")); f != "MESSAGE=hello\n" {
+		t.Errorf("unexpected field %q", f)
+	}
+	var expected bytes.Buffer
+	expected.WriteString("MESSAGE\n")
+	binary.Write(&expected, binary.LittleEndian, uint64(3))
+	expected.WriteString("a\nb\n")
+	if f := appendJournalField(nil, "MESSAGE", "a\nb"); !bytes.Equal(f, expected.Bytes()) {
+		t.Errorf("expected %q, got %q", expected.Bytes(), f)
+	}
+}
+
+func TestNewLogDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log-driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		driver host.LogDriver
+		keeps  bool
+	}{
+		{host.LogDriver{}, true},
+		{host.LogDriver{Name: host.LogDriverLogbuf}, true},
+		{host.LogDriver{Name: host.LogDriverNull}, false},
+	} {
+		job := &host.Job{ID: "a", LogDriver: test.driver}
+		log, err := newLogDriver(job, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := log.(LogFollower); ok != test.keeps {
+			t.Errorf("expected the %q driver to keep output: %t", test.driver.Name, test.keeps)
+		}
+		if keepsOutput(job) != test.keeps {
+			t.Errorf("expected keepsOutput for the %q driver to be %t", test.driver.Name, test.keeps)
+		}
+		log.Close()
+	}
+	if _, err := newLogDriver(&host.Job{LogDriver: host.LogDriver{Name: "file"}}, ""); err == nil {
+		t.Error("expected an error for an unknown driver")
+	}
+	if keepsOutput(&host.Job{Config: host.ContainerConfig{TTY: true}}) {
+		t.Error("expected the output of TTY jobs not to be kept")
+	}
+}
+
+func TestRemoteLog(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	job := &host.Job{
+		ID:        "job1",
+		Metadata:  map[string]string{"flynn-controller.app_name": "my-app", "flynn-controller.type": "web"},
+		LogDriver: host.LogDriver{Name: host.LogDriverRemote, URL: "syslog://" + l.Addr().String()},
+	}
+	log, err := newLogDriver(job, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	go log.ReadFrom(2, strings.NewReader("first\n\nsecond\n"))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, line := range []string{"first", "second"} {
+		msg, err := readSyslog(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(msg, "<11>1 ") || !strings.HasSuffix(msg, " my-app web job1 - - "+line) {
+			t.Errorf("unexpected message %q", msg)
+		}
+	}
+}
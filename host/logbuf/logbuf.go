@@ -4,10 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/flynn/lumberjack"
@@ -23,9 +25,54 @@ func NewLog(l *lumberjack.Logger) *Log {
 	}
 	log := &Log{l: l, files: make(map[string]*file)}
 	log.changed.L = log.mtx.RLocker()
+	log.resume()
+	atomic.AddInt64(&totals.Open, 1)
 	return log
 }
 
+// resume continues a log whose directory has output written by a previous
+// Log, for example before the host daemon restarted. Readers read the most
+// recent file of it before the new output, which is written to a new file as
+// the logger would not count the size of the file it appended to.
+func (l *Log) resume() {
+	if l.l.Dir == "" {
+		return
+	}
+	files, err := ioutil.ReadDir(l.l.Dir)
+	if err != nil {
+		return
+	}
+	var newest os.FileInfo
+	for _, fi := range files {
+		if !fi.IsDir() && (newest == nil || fi.ModTime().After(newest.ModTime())) {
+			newest = fi
+		}
+	}
+	if newest == nil {
+		return
+	}
+	l.name, l.size = filepath.Join(l.l.Dir, newest.Name()), newest.Size()
+	l.resumed = true
+}
+
+// Stats are the totals of the logs of the process.
+type Stats struct {
+	Open     int64  // logs which have not been closed
+	Messages uint64 // messages written, each is a read from a job's output
+	Bytes    uint64 // bytes of output written, before encoding
+}
+
+var totals Stats
+
+// TotalStats returns the totals of the logs of the process.
+func TotalStats() Stats {
+	return Stats{
+		Open:     atomic.LoadInt64(&totals.Open),
+		Messages: atomic.LoadUint64(&totals.Messages),
+		Bytes:    atomic.LoadUint64(&totals.Bytes),
+	}
+}
+
 type Log struct {
 	l *lumberjack.Logger
 
@@ -35,6 +82,9 @@ type Log struct {
 	size    int64
 	closed  bool
 
+	resumed bool
+	rotate  sync.Once
+
 	filesMtx sync.Mutex
 	files    map[string]*file
 }
@@ -61,6 +111,16 @@ func (t *UnixTime) UnmarshalJSON(data []byte) error {
 }
 
 func (l *Log) ReadFrom(stream int, r io.Reader) error {
+	var err error
+	l.rotate.Do(func() {
+		if l.resumed {
+			err = l.l.Rotate()
+		}
+	})
+	if err != nil {
+		return err
+	}
+
 	j := json.NewEncoder(l.l)
 	data := &Data{Stream: stream}
 
@@ -73,6 +133,8 @@ func (l *Log) ReadFrom(stream int, r io.Reader) error {
 			if err := j.Encode(data); err != nil {
 				return err
 			}
+			atomic.AddUint64(&totals.Messages, 1)
+			atomic.AddUint64(&totals.Bytes, uint64(n))
 			l.mtx.Lock()
 			l.name, l.size = l.l.File()
 			l.changed.Broadcast()
@@ -89,6 +151,9 @@ func (l *Log) ReadFrom(stream int, r io.Reader) error {
 
 func (l *Log) Close() error {
 	l.mtx.Lock()
+	if !l.closed {
+		atomic.AddInt64(&totals.Open, -1)
+	}
 	l.closed = true
 	l.changed.Broadcast()
 	l.mtx.Unlock()
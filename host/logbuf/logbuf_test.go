@@ -180,3 +180,35 @@ func (s *S) TestSeekToEnd(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(data.Message, Equals, "3")
 }
+
+func (s *S) TestResume(c *C) {
+	dir := c.MkDir()
+	l := NewLog(&lumberjack.Logger{Dir: dir})
+	l.ReadFrom(0, strings.NewReader("1"))
+	l.Close()
+
+	// a log of the same directory reads the output of the previous one
+	l = NewLog(&lumberjack.Logger{Dir: dir})
+	defer l.Close()
+	r := l.NewReader()
+	defer r.Close()
+	data, err := r.ReadData(false)
+	c.Assert(err, IsNil)
+	c.Assert(data.Message, Equals, "1")
+	_, err = r.ReadData(false)
+	c.Assert(err, Equals, io.EOF)
+
+	l.ReadFrom(0, strings.NewReader("2"))
+	data, err = r.ReadData(false)
+	c.Assert(err, IsNil)
+	c.Assert(data.Message, Equals, "2")
+
+	// new readers seek to the end of the new output
+	r2 := l.NewReader()
+	defer r2.Close()
+	c.Assert(r2.SeekToEnd(), IsNil)
+	l.ReadFrom(0, strings.NewReader("3"))
+	data, err = r2.ReadData(false)
+	c.Assert(err, IsNil)
+	c.Assert(data.Message, Equals, "3")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/host/logbuf"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/metrics"
+)
+
+// pullBuckets are the upper bounds in seconds of the image pull duration
+// histogram buckets.
+var pullBuckets = []float64{.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// hostMetrics counts the events on the host which can't be worked out from
+// its state, and serves them along with the host's jobs and reservations in
+// the Prometheus text format at GET /metrics. The methods which count events
+// can be called on a nil *hostMetrics.
+type hostMetrics struct {
+	state     *State
+	resources host.HostResources
+
+	mtx            sync.Mutex
+	exits          map[string]uint64 // by status
+	ooms           uint64
+	healthRestarts uint64
+	pulls          map[string]*metrics.Histogram // by status, ok or error
+}
+
+func newHostMetrics(state *State, resources host.HostResources) *hostMetrics {
+	return &hostMetrics{
+		state:     state,
+		resources: resources,
+		exits:     make(map[string]uint64),
+		pulls:     make(map[string]*metrics.Histogram),
+	}
+}
+
+// Run counts the jobs which stop or are killed for running out of memory.
+func (m *hostMetrics) Run(events <-chan host.Event) {
+	for e := range events {
+		m.mtx.Lock()
+		switch e.Event {
+		case "stop", "error":
+			m.exits[e.Job.Status.String()]++
+		case "oom":
+			m.ooms++
+		}
+		m.mtx.Unlock()
+	}
+}
+
+// healthRestart counts a job stopped for failing its health checks, which
+// the scheduler then restarts.
+func (m *hostMetrics) healthRestart() {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	m.healthRestarts++
+	m.mtx.Unlock()
+}
+
+// pulled records the duration of an image pull.
+func (m *hostMetrics) pulled(d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	h, ok := m.pulls[status]
+	if !ok {
+		h = metrics.NewHistogram(pullBuckets)
+		m.pulls[status] = h
+	}
+	h.Observe(d.Seconds())
+}
+
+func (m *hostMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var buf bytes.Buffer
+	m.write(metrics.NewWriter(&buf))
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.WriteHeader(200)
+	buf.WriteTo(w)
+}
+
+func (m *hostMetrics) write(w *metrics.Writer) {
+	// jobs only reserve resources while they are starting or running
+	counts := make(map[string]int)
+	active := &host.Host{Resources: m.resources}
+	for _, job := range m.state.Get() {
+		counts[job.Status.String()]++
+		if job.Job != nil && (job.Status == host.StatusStarting || job.Status == host.StatusRunning) {
+			active.Jobs = append(active.Jobs, job.Job)
+		}
+	}
+	w.Describe("flynn_host_jobs", "gauge", "Number of jobs known to the host by state.")
+	for _, status := range []host.JobStatus{host.StatusStarting, host.StatusRunning, host.StatusDone, host.StatusCrashed, host.StatusFailed} {
+		w.Sample("flynn_host_jobs", []string{"state", status.String()}, float64(counts[status.String()]))
+	}
+
+	reserved := active.Reserved()
+	w.Describe("flynn_host_memory_capacity_bytes", "gauge", "Memory job limits can reserve, including overcommit.")
+	w.Sample("flynn_host_memory_capacity_bytes", nil, float64(m.resources.Available(m.resources.Memory))*1024)
+	w.Describe("flynn_host_memory_reserved_bytes", "gauge", "Memory reserved by the limits of starting and running jobs.")
+	w.Sample("flynn_host_memory_reserved_bytes", nil, float64(reserved.Memory)*1024)
+	w.Describe("flynn_host_cpu_shares_capacity", "gauge", "CPU shares job limits can reserve, including overcommit.")
+	w.Sample("flynn_host_cpu_shares_capacity", nil, float64(m.resources.Available(m.resources.CPUShares)))
+	w.Describe("flynn_host_cpu_shares_reserved", "gauge", "CPU shares reserved by the limits of starting and running jobs.")
+	w.Sample("flynn_host_cpu_shares_reserved", nil, float64(reserved.CPUShares))
+
+	devices := active.ReservedDevices()
+	classes := make([]string, 0, len(m.resources.Devices))
+	for class := range m.resources.Devices {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	w.Describe("flynn_host_devices_capacity", "gauge", "Devices jobs can claim by class.")
+	for _, class := range classes {
+		w.Sample("flynn_host_devices_capacity", []string{"class", class}, float64(m.resources.Devices[class]))
+	}
+	w.Describe("flynn_host_devices_reserved", "gauge", "Devices claimed by starting and running jobs by class.")
+	for _, class := range classes {
+		w.Sample("flynn_host_devices_reserved", []string{"class", class}, float64(devices[class]))
+	}
+
+	m.mtx.Lock()
+	w.Describe("flynn_host_job_exits_total", "counter", "Count of jobs which stopped by status.")
+	for _, status := range []host.JobStatus{host.StatusDone, host.StatusCrashed, host.StatusFailed} {
+		w.Sample("flynn_host_job_exits_total", []string{"status", status.String()}, float64(m.exits[status.String()]))
+	}
+	w.Describe("flynn_host_job_oom_kills_total", "counter", "Count of jobs killed for running out of memory.")
+	w.Sample("flynn_host_job_oom_kills_total", nil, float64(m.ooms))
+	w.Describe("flynn_host_health_check_restarts_total", "counter", "Count of jobs stopped for failing their health checks so that they are restarted.")
+	w.Sample("flynn_host_health_check_restarts_total", nil, float64(m.healthRestarts))
+
+	w.Describe("flynn_host_image_pull_duration_seconds", "histogram", "Duration of image pulls by status.")
+	for _, status := range []string{"error", "ok"} {
+		if h, ok := m.pulls[status]; ok {
+			w.Histogram("flynn_host_image_pull_duration_seconds", []string{"status", status}, h)
+		}
+	}
+	m.mtx.Unlock()
+
+	logs := logbuf.TotalStats()
+	w.Describe("flynn_host_logbuf_logs", "gauge", "Number of open logbuf job logs.")
+	w.Sample("flynn_host_logbuf_logs", nil, float64(logs.Open))
+	w.Describe("flynn_host_logbuf_messages_total", "counter", "Count of messages of job output written to logbuf logs.")
+	w.Sample("flynn_host_logbuf_messages_total", nil, float64(logs.Messages))
+	w.Describe("flynn_host_logbuf_bytes_total", "counter", "Bytes of job output written to logbuf logs.")
+	w.Sample("flynn_host_logbuf_bytes_total", nil, float64(logs.Bytes))
+}
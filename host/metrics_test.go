@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/metrics"
+)
+
+func TestMetrics(t *testing.T) {
+	state := NewState("host0")
+	resources := host.HostResources{Memory: 1 << 20, CPUShares: 2048, Overcommit: 1.5, Devices: map[string]int{"gpu": 2}}
+	m := newHostMetrics(state, resources)
+	go m.Run(state.AddListener("all"))
+
+	for _, job := range []*host.Job{
+		{ID: "a", Resources: host.JobResources{Memory: 1024, CPUShares: 512}, Config: host.ContainerConfig{Devices: []host.DeviceRequest{{Class: "gpu", Count: 1}}}},
+		{ID: "b", Resources: host.JobResources{Memory: 2048, CPUShares: 256}},
+		{ID: "c", Resources: host.JobResources{Memory: 4096}},
+	} {
+		state.AddJob(job)
+	}
+	state.SetStatusRunning("a")
+	state.SetStatusRunning("c")
+	state.SetStatusDone("c", 1)
+
+	m.healthRestart()
+	m.pulled(3*time.Second, nil)
+	m.pulled(time.Second, errors.New("timeout"))
+
+	// events are sent to listeners asynchronously
+	var out string
+	for i := 0; i < 100; i++ {
+		var buf bytes.Buffer
+		m.write(metrics.NewWriter(&buf))
+		if out = buf.String(); strings.Contains(out, `flynn_host_job_exits_total{status="crashed"} 1`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range []string{
+		"# TYPE flynn_host_jobs gauge",
+		`flynn_host_jobs{state="starting"} 1`,
+		`flynn_host_jobs{state="running"} 1`,
+		`flynn_host_jobs{state="crashed"} 1`,
+		"flynn_host_memory_capacity_bytes 1.610612736e+09",
+		"flynn_host_memory_reserved_bytes 3.145728e+06",
+		"flynn_host_cpu_shares_capacity 3072",
+		"flynn_host_cpu_shares_reserved 768",
+		`flynn_host_devices_capacity{class="gpu"} 2`,
+		`flynn_host_devices_reserved{class="gpu"} 1`,
+		`flynn_host_job_exits_total{status="crashed"} 1`,
+		`flynn_host_job_exits_total{status="done"} 0`,
+		"flynn_host_health_check_restarts_total 1",
+		"# TYPE flynn_host_image_pull_duration_seconds histogram",
+		`flynn_host_image_pull_duration_seconds_bucket{status="ok",le="2.5"} 0`,
+		`flynn_host_image_pull_duration_seconds_bucket{status="ok",le="5"} 1`,
+		`flynn_host_image_pull_duration_seconds_count{status="error"} 1`,
+		"# TYPE flynn_host_logbuf_bytes_total counter",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+}
@@ -8,11 +8,13 @@ import (
 	"io"
 	"net/url"
 	"os/exec"
+	"strconv"
 )
 
 type LayerPullInfo struct {
 	ID     string
 	Status string
+	Size   int64
 }
 
 func Pull(url string) ([]LayerPullInfo, error) {
@@ -51,9 +53,11 @@ func (e *Error) Error() string {
 	return fmt.Sprintf("pinkerton: %s - %q", e.Err, e.Output)
 }
 
-func Checkout(id, image string) (string, error) {
+// Checkout creates a working copy of an image, limiting the size of the files
+// written to it to quota bytes if it is not zero.
+func Checkout(id, image string, quota int64) (string, error) {
 	var errBuf bytes.Buffer
-	cmd := exec.Command("pinkerton", "checkout", id, image)
+	cmd := exec.Command("pinkerton", "checkout", "--quota="+strconv.FormatInt(quota, 10), id, image)
 	cmd.Stderr = &errBuf
 	path, err := cmd.Output()
 	if err != nil {
@@ -72,6 +76,34 @@ func Cleanup(id string) error {
 	return nil
 }
 
+// DiskUsage returns the bytes written to a working copy with a quota, and the
+// quota.
+func DiskUsage(id string) (usage, quota uint64, err error) {
+	var errBuf bytes.Buffer
+	cmd := exec.Command("pinkerton", "usage", id)
+	cmd.Stderr = &errBuf
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, 0, &Error{Output: errBuf.String(), Err: err}
+	}
+	if _, err := fmt.Sscan(string(out), &usage, &quota); err != nil {
+		return 0, 0, err
+	}
+	return usage, quota, nil
+}
+
+// Delete deletes a pulled image layer, which must not be the parent of other
+// layers or checkouts.
+func Delete(imageID string) error {
+	var errBuf bytes.Buffer
+	cmd := exec.Command("pinkerton", "delete", imageID)
+	cmd.Stderr = &errBuf
+	if err := cmd.Run(); err != nil {
+		return &Error{Output: errBuf.String(), Err: err}
+	}
+	return nil
+}
+
 var ErrNoImageID = errors.New("pinkerton: missing image id")
 
 func ImageID(s string) (string, error) {
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/flynn/flynn/host/ports"
+	"github.com/flynn/flynn/host/types"
+)
+
+// allocatePorts reserves the host ports of a job, allocating ports from the
+// range of those which don't request one, and fills in the ports, range ends
+// and host ports. Nothing is reserved if a requested port is already in use.
+func allocatePorts(allocs map[string]*ports.Allocator, ps []host.Port) (err error) {
+	for i := range ps {
+		p := &ps[i]
+		alloc, ok := allocs[p.Proto]
+		if !ok {
+			err = fmt.Errorf("unknown port proto %q", p.Proto)
+		} else if 0 < p.RangeEnd && p.RangeEnd < p.Port {
+			err = fmt.Errorf("port range end %d cannot be less than port %d", p.RangeEnd, p.Port)
+		} else if p.HostPort > 0 && p.RangeEnd > p.Port {
+			err = fmt.Errorf("host port %d cannot be mapped to port range %d-%d", p.HostPort, p.Port, p.RangeEnd)
+		} else {
+			err = allocatePort(alloc, p)
+		}
+		if err != nil {
+			releasePorts(allocs, ps[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+func allocatePort(alloc *ports.Allocator, p *host.Port) error {
+	switch {
+	case p.HostPort > 0:
+		// the job listens on the host port unless it asks for another
+		if p.Port <= 0 {
+			p.Port = p.HostPort
+		}
+		p.RangeEnd = p.Port
+	case p.Port > 0:
+		p.HostPort = p.Port
+		if p.RangeEnd == 0 {
+			p.RangeEnd = p.Port
+		}
+	default:
+		port, err := alloc.Get()
+		if err != nil {
+			return err
+		}
+		p.Port, p.HostPort, p.RangeEnd = int(port), int(port), int(port)
+		return nil
+	}
+	start, end := hostPorts(*p)
+	if end > 65535 {
+		return fmt.Errorf("port %d is out of range", end)
+	}
+	return alloc.GetRange(uint16(start), uint16(end))
+}
+
+// releasePorts returns the host ports of a job to their allocators.
+func releasePorts(allocs map[string]*ports.Allocator, ps []host.Port) {
+	for _, p := range ps {
+		if alloc, ok := allocs[p.Proto]; ok {
+			start, end := hostPorts(p)
+			alloc.PutRange(uint16(start), uint16(end))
+		}
+	}
+}
+
+// reservePorts reserves the host ports of a job which is already running,
+// when the host's state is restored.
+func reservePorts(allocs map[string]*ports.Allocator, ps []host.Port) {
+	for _, p := range ps {
+		if alloc, ok := allocs[p.Proto]; ok {
+			start, end := hostPorts(p)
+			alloc.GetRange(uint16(start), uint16(end))
+		}
+	}
+}
+
+// hostPorts returns the range of host ports forwarded to a job's port, jobs
+// started before host ports could be mapped use the same ports as the job.
+func hostPorts(p host.Port) (start, end int) {
+	start = p.HostPort
+	if start == 0 {
+		start = p.Port
+	}
+	end = start
+	if p.RangeEnd > p.Port {
+		end += p.RangeEnd - p.Port
+	}
+	return start, end
+}
@@ -3,6 +3,8 @@ package ports
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -10,6 +12,28 @@ func NewAllocator(start, end uint16) *Allocator {
 	return &Allocator{start: start, end: end, ports: make(map[uint16]struct{})}
 }
 
+// ParseRange parses a range of ports in the form START-END.
+func ParseRange(s string) (start, end uint16, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("ports: invalid range %q, expected START-END", s)
+	}
+	for i, p := range []*uint16{&start, &end} {
+		n, err := strconv.ParseUint(parts[i], 10, 16)
+		if err != nil || n == 0 {
+			return 0, 0, fmt.Errorf("ports: invalid port %q in range %q", parts[i], s)
+		}
+		*p = uint16(n)
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("ports: invalid range %q, end is before start", s)
+	}
+	return start, end, nil
+}
+
+// Allocator allocates ports from its range to jobs which don't request a
+// port, and reserves the ports jobs do request whether or not they are in the
+// range, so that two jobs are never given the same port.
 type Allocator struct {
 	start, end uint16
 	ports      map[uint16]struct{}
@@ -27,18 +51,17 @@ func (e InUseError) Error() string {
 var ErrNoPorts = errors.New("ports: all ports are allocated")
 
 func (a *Allocator) Get() (uint16, error) {
-	port := a.start
-	for {
-		if _, allocated := a.ports[port]; !allocated {
-			break
-		}
-		port++
-		if port > a.end {
-			return 0, ErrNoPorts
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	// the port is an int so that it doesn't wrap around at the top of the
+	// port space
+	for port := int(a.start); port <= int(a.end); port++ {
+		if _, allocated := a.ports[uint16(port)]; !allocated {
+			a.ports[uint16(port)] = struct{}{}
+			return uint16(port), nil
 		}
 	}
-	a.ports[port] = struct{}{}
-	return port, nil
+	return 0, ErrNoPorts
 }
 
 func (a *Allocator) GetPort(port uint16) (uint16, error) {
@@ -51,8 +74,33 @@ func (a *Allocator) GetPort(port uint16) (uint16, error) {
 	return port, nil
 }
 
+// GetRange reserves the ports from start to end, none of them are reserved if
+// any is already in use.
+func (a *Allocator) GetRange(start, end uint16) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for port := int(start); port <= int(end); port++ {
+		if _, allocated := a.ports[uint16(port)]; allocated {
+			return InUseError{uint16(port)}
+		}
+	}
+	for port := int(start); port <= int(end); port++ {
+		a.ports[uint16(port)] = struct{}{}
+	}
+	return nil
+}
+
 func (a *Allocator) Put(port uint16) {
 	a.mtx.Lock()
 	delete(a.ports, port)
 	a.mtx.Unlock()
 }
+
+// PutRange releases the ports from start to end.
+func (a *Allocator) PutRange(start, end uint16) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for port := int(start); port <= int(end); port++ {
+		delete(a.ports, uint16(port))
+	}
+}
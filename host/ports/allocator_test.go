@@ -0,0 +1,41 @@
+package ports
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	start, end, err := ParseRange("1000-2000")
+	if err != nil || start != 1000 || end != 2000 {
+		t.Errorf("expected 1000-2000, got %d-%d, %v", start, end, err)
+	}
+	for _, s := range []string{"1000", "2000-1000", "0-100", "1-70000", "a-b"} {
+		if _, _, err := ParseRange(s); err == nil {
+			t.Errorf("expected an error parsing %q", s)
+		}
+	}
+}
+
+func TestAllocator(t *testing.T) {
+	a := NewAllocator(65534, 65535)
+	for _, expected := range []uint16{65534, 65535} {
+		if port, err := a.Get(); err != nil || port != expected {
+			t.Errorf("expected port %d, got %d, %v", expected, port, err)
+		}
+	}
+	if _, err := a.Get(); err != ErrNoPorts {
+		t.Errorf("expected ErrNoPorts, got %v", err)
+	}
+
+	if err := a.GetRange(100, 110); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.GetRange(110, 120); err != (InUseError{110}) {
+		t.Errorf("expected port 110 to be in use, got %v", err)
+	}
+	if _, err := a.GetPort(115); err != nil {
+		t.Errorf("expected port 115 not to be reserved by the failed range, got %v", err)
+	}
+	a.PutRange(100, 110)
+	if err := a.GetRange(100, 110); err != nil {
+		t.Errorf("expected released range to be reserved, got %v", err)
+	}
+}
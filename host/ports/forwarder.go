@@ -18,14 +18,16 @@ func NewForwarder(host net.IP, c *iptables.Chain) *Forwarder {
 	return &Forwarder{c: c, host: host}
 }
 
-func (f *Forwarder) Add(dest net.Addr, rangeEnd int, proto string) error {
-	ip, port := ipAndPort(dest)
-	return f.c.Forward(iptables.Add, f.host, port, rangeEnd, proto, ip.String())
+// Add forwards the host ports from port to rangeEnd to dest, starting at
+// dest's port.
+func (f *Forwarder) Add(port, rangeEnd int, dest net.Addr, proto string) error {
+	ip, destPort := ipAndPort(dest)
+	return f.c.Forward(iptables.Add, f.host, port, rangeEnd, proto, ip.String(), destPort)
 }
 
-func (f *Forwarder) Remove(dest net.Addr, rangeEnd int, proto string) error {
-	ip, port := ipAndPort(dest)
-	return f.c.Forward(iptables.Delete, f.host, port, rangeEnd, proto, ip.String())
+func (f *Forwarder) Remove(port, rangeEnd int, dest net.Addr, proto string) error {
+	ip, destPort := ipAndPort(dest)
+	return f.c.Forward(iptables.Delete, f.host, port, rangeEnd, proto, ip.String(), destPort)
 }
 
 func ipAndPort(a net.Addr) (net.IP, int) {
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/flynn/flynn/host/ports"
+	"github.com/flynn/flynn/host/types"
+)
+
+func TestAllocatePorts(t *testing.T) {
+	allocs := map[string]*ports.Allocator{
+		"tcp": ports.NewAllocator(500, 501),
+		"udp": ports.NewAllocator(500, 501),
+	}
+
+	a := []host.Port{
+		{Proto: "tcp"},
+		{Proto: "tcp", Port: 8080, HostPort: 80},
+		{Proto: "udp", Port: 600, RangeEnd: 602},
+	}
+	if err := allocatePorts(allocs, a); err != nil {
+		t.Fatal(err)
+	}
+	expected := []host.Port{
+		{Proto: "tcp", Port: 500, RangeEnd: 500, HostPort: 500},
+		{Proto: "tcp", Port: 8080, RangeEnd: 8080, HostPort: 80},
+		{Proto: "udp", Port: 600, RangeEnd: 602, HostPort: 600},
+	}
+	if !reflect.DeepEqual(a, expected) {
+		t.Errorf("expected ports %+v, got %+v", expected, a)
+	}
+
+	// a job requesting a host port in use gets none of its ports, and the
+	// other job keeps its ports
+	b := []host.Port{{Proto: "tcp"}, {Proto: "udp", Port: 601}}
+	err := allocatePorts(allocs, b)
+	if _, ok := err.(ports.InUseError); !ok {
+		t.Fatalf("expected InUseError, got %v", err)
+	}
+	if port, err := allocs["tcp"].Get(); err != nil || port != 501 {
+		t.Errorf("expected tcp port 501 to have been released, got %d, %v", port, err)
+	}
+	if _, err := allocs["udp"].GetPort(601); err == nil {
+		t.Error("expected udp port 601 to still be in use")
+	}
+
+	if err := allocatePorts(allocs, []host.Port{{Proto: "tcp", Port: 700, RangeEnd: 710, HostPort: 80}}); err == nil {
+		t.Error("expected an error mapping a host port to a range")
+	}
+	if err := allocatePorts(allocs, []host.Port{{Proto: "sctp"}}); err == nil {
+		t.Error("expected an error allocating an unknown proto")
+	}
+
+	releasePorts(allocs, a)
+	if err := allocatePorts(allocs, []host.Port{{Proto: "tcp", HostPort: 80}, {Proto: "udp", Port: 600, RangeEnd: 602}}); err != nil {
+		t.Errorf("expected released ports to be allocated, got %s", err)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// registryTokenExpiry is how long registry tokens are used for when the token
+// server doesn't say, and registryTokenMargin is how long before a token
+// expires it is requested again, so that it doesn't expire during a pull.
+const (
+	registryTokenExpiry = time.Minute
+	registryTokenMargin = 10 * time.Second
+)
+
+// registryAuth finds the credentials used to pull an artifact, from the job
+// or the host's configuration, and exchanges them for tokens when the
+// registry requires it. It can be nil, in which case only job credentials are
+// used and tokens are not cached.
+type registryAuth struct {
+	auths  []host.RegistryAuth
+	client *http.Client
+	now    func() time.Time
+
+	mtx    sync.Mutex
+	tokens map[host.RegistryAuth]*registryToken
+}
+
+type registryToken struct {
+	token   string
+	expires time.Time
+}
+
+func newRegistryAuth(auths []host.RegistryAuth) *registryAuth {
+	return &registryAuth{
+		auths:  auths,
+		client: http.DefaultClient,
+		now:    time.Now,
+		tokens: make(map[host.RegistryAuth]*registryToken),
+	}
+}
+
+// openRegistryAuth reads the host's registry credentials from a JSON file
+// containing an array of host.RegistryAuth.
+func openRegistryAuth(path string) (*registryAuth, error) {
+	var auths []host.RegistryAuth
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&auths); err != nil {
+			return nil, fmt.Errorf("registry auth: %s: %s", path, err)
+		}
+	}
+	return newRegistryAuth(auths), nil
+}
+
+// Credentials returns the username and password to pull the image at uri
+// with, or nil if the image is pulled anonymously. The job's credentials are
+// used before the host's.
+func (r *registryAuth) Credentials(uri string, job *host.RegistryAuth) (*host.RegistryAuth, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	auth := job
+	if auth != nil && auth.Registry != "" && auth.Registry != u.Host {
+		auth = nil
+	}
+	if auth == nil && r != nil {
+		for i, a := range r.auths {
+			if a.Registry == "" || a.Registry == u.Host {
+				auth = &r.auths[i]
+				break
+			}
+		}
+	}
+	if auth == nil {
+		return nil, nil
+	}
+	creds := &host.RegistryAuth{Registry: u.Host, Username: auth.Username, Password: auth.Password}
+	if auth.TokenURL != "" {
+		if creds.Password, err = r.token(*auth); err != nil {
+			return nil, err
+		}
+	}
+	return creds, nil
+}
+
+// token returns a token for the credentials, which is cached until shortly
+// before it expires.
+func (r *registryAuth) token(auth host.RegistryAuth) (string, error) {
+	client, now := http.DefaultClient, time.Now
+	if r != nil {
+		client, now = r.client, r.now
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+		if t, ok := r.tokens[auth]; ok && now().Add(registryTokenMargin).Before(t.expires) {
+			return t.token, nil
+		}
+	}
+
+	req, err := http.NewRequest("GET", auth.TokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(auth.Username, auth.Password)
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("registry auth: unexpected status %d requesting a token from %s", res.StatusCode, auth.TokenURL)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("registry auth: invalid token response from %s: %s", auth.TokenURL, err)
+	}
+	token := body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	if token == "" {
+		return "", fmt.Errorf("registry auth: no token in response from %s", auth.TokenURL)
+	}
+	expiry := registryTokenExpiry
+	if body.ExpiresIn > 0 {
+		expiry = time.Duration(body.ExpiresIn) * time.Second
+	}
+	if r != nil {
+		r.tokens[auth] = &registryToken{token: token, expires: now().Add(expiry)}
+	}
+	return token, nil
+}
+
+// credentialURI returns uri with the credentials as its user info, which is
+// how they are passed to pinkerton.
+func credentialURI(uri string, creds *host.RegistryAuth) string {
+	if creds == nil {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	u.User = url.UserPassword(creds.Username, creds.Password)
+	return u.String()
+}
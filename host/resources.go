@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// hostResources returns the memory and CPU of the host, which the cluster
+// leader lets job limits reserve overcommit times.
+func hostResources(overcommit float64) (host.HostResources, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return host.HostResources{}, err
+	}
+	defer f.Close()
+	memory, err := parseMemTotal(f)
+	if err != nil {
+		return host.HostResources{}, err
+	}
+	return host.HostResources{
+		Memory:     memory,
+		CPUShares:  runtime.NumCPU() * 1024,
+		Overcommit: overcommit,
+	}, nil
+}
+
+// parseMemTotal returns the total memory in KiB from the contents of
+// /proc/meminfo.
+func parseMemTotal(r io.Reader) (int, error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 3 && fields[0] == "MemTotal:" && fields[2] == "kB" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("host: MemTotal missing from meminfo")
+}
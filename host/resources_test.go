@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMemTotal(t *testing.T) {
+	meminfo := `MemTotal:       16318000 kB
+MemFree:         1024000 kB
+HugePages_Total:       0
+`
+	memory, err := parseMemTotal(strings.NewReader(meminfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory != 16318000 {
+		t.Errorf("expected 16318000 KiB, got %d", memory)
+	}
+	if _, err := parseMemTotal(strings.NewReader("MemFree: 1024 kB\n")); err == nil {
+		t.Error("expected an error without MemTotal")
+	}
+}
@@ -1,28 +1,70 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
 	"net/http"
+	"strings"
 
 	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
 	"github.com/flynn/flynn/pkg/rpcplus"
 	rpc "github.com/flynn/flynn/pkg/rpcplus/comborpc"
 )
 
-func serveHTTP(host *Host, attach *attachHandler, sh *shutdownHandler) error {
+// httpAPI is the set of handlers of the host's HTTP API, which is served
+// alongside its RPC API.
+type httpAPI struct {
+	attach      *attachHandler
+	volumes     *volumeHandler
+	stats       *statsHandler
+	exec        *execHandler
+	checkpoints *checkpointHandler
+	artifacts   *artifactHandler
+	events      *eventsHandler
+	drain       *drainHandler
+	metrics     *hostMetrics
+}
+
+// register adds the handlers to mux.
+func (a *httpAPI) register(mux *http.ServeMux) {
+	mux.Handle("/attach", a.attach)
+	mux.Handle("/volumes", a.volumes)
+	mux.Handle("/volumes/", a.volumes)
+	mux.HandleFunc("/host/jobs/", func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/exec"):
+			a.exec.ServeHTTP(w, req)
+		case strings.HasSuffix(req.URL.Path, "/checkpoint"):
+			a.checkpoints.ServeHTTP(w, req)
+		default:
+			a.stats.ServeHTTP(w, req)
+		}
+	})
+	mux.Handle("/host/checkpoints", a.checkpoints)
+	mux.Handle("/artifacts/pull", a.artifacts)
+	mux.Handle("/host/events", a.events)
+	mux.Handle("/host/drain", a.drain)
+	mux.Handle("/metrics", a.metrics)
+}
+
+func serveHTTP(host *Host, api *httpAPI, creds *cluster.Credentials, sh *shutdownHandler) error {
 	if err := rpc.Register(host); err != nil {
 		return err
 	}
 	rpc.HandleHTTP()
-	http.Handle("/attach", attach)
+	api.register(http.DefaultServeMux)
 
 	l, err := net.Listen("tcp", ":1113")
 	if err != nil {
 		return err
 	}
+	if config := creds.ServerTLS(); config != nil {
+		l = tls.NewListener(l, config)
+	}
 	sh.BeforeExit(func() { l.Close() })
-	go http.Serve(l, nil)
+	go http.Serve(l, &authHandler{token: creds.Token, handler: http.DefaultServeMux})
 	return nil
 }
 
@@ -55,6 +97,17 @@ func (h *Host) StopJob(id string, res *struct{}) error {
 	return h.backend.Stop(id)
 }
 
+func (h *Host) SignalJob(req *host.SignalReq, res *struct{}) error {
+	job := h.state.GetJob(req.JobID)
+	if job == nil {
+		return errors.New("host: unknown job")
+	}
+	if job.Status != host.StatusRunning {
+		return errors.New("host: job is not running")
+	}
+	return h.backend.Signal(req.JobID, req.Signal)
+}
+
 func (h *Host) StreamEvents(id string, stream rpcplus.Stream) error {
 	ch := h.state.AddListener(id)
 	defer h.state.RemoveListener(id, ch)
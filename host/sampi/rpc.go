@@ -61,7 +61,14 @@ func (s *Cluster) RegisterHost(hostID *string, h *host.Host, stream rpcplus.Stre
 	jobs := make(chan *host.Job)
 	s.state.AddHost(h, jobs)
 	s.state.Commit()
-	go s.state.sendEvent(h.ID, "add")
+	go func() {
+		s.state.sendEvent(h.ID, "add")
+		// a host which was draining when it registered with the
+		// previous leader is still draining
+		if h.Draining {
+			s.state.sendEvent(h.ID, "drain")
+		}
+	}()
 
 	var err error
 outer:
@@ -96,6 +103,19 @@ func (s *Cluster) RemoveJobs(hostID *string, jobIDs []string, res *struct{}) err
 	return nil
 }
 
+// DrainHost marks the host as draining and sends a "drain" event, which
+// schedulers handle by moving the host's jobs elsewhere.
+func (s *Cluster) DrainHost(hostID *string, arg struct{}, res *struct{}) error {
+	s.state.Begin()
+	if err := s.state.SetDraining(*hostID); err != nil {
+		s.state.Rollback()
+		return err
+	}
+	s.state.Commit()
+	go s.state.sendEvent(*hostID, "drain")
+	return nil
+}
+
 func (s *Cluster) StreamHostEvents(arg struct{}, stream rpcplus.Stream) error {
 	ch := make(chan host.HostEvent)
 	s.state.AddListener(ch)
@@ -80,6 +80,9 @@ func (s *State) AddJobs(hostID string, jobs []*host.Job) error {
 	copy(newJobs, h.Jobs)
 	newJobs = append(newJobs, jobs...)
 	h.Jobs = newJobs
+	if err := h.CheckResources(); err != nil {
+		return err
+	}
 
 	(*s.next)[hostID] = h
 	s.nextModified = true
@@ -120,6 +123,19 @@ outer:
 	s.nextModified = true
 }
 
+// SetDraining marks the host as draining, so that schedulers stop placing
+// jobs on it.
+func (s *State) SetDraining(id string) error {
+	h, ok := s.host(id)
+	if !ok {
+		return fmt.Errorf("sampi: Unknown host %s", id)
+	}
+	h.Draining = true
+	(*s.next)[id] = h
+	s.nextModified = true
+	return nil
+}
+
 func (s *State) HostExists(id string) bool {
 	_, exists := (*s.next)[id]
 	return exists
@@ -45,3 +45,92 @@ func TestStateRace(t *testing.T) {
 		t.Log("Got '2'")
 	}
 }
+
+func TestStateSetDraining(t *testing.T) {
+	state := NewState()
+	addHost("foo", state)
+
+	state.Begin()
+	if err := state.SetDraining("bar"); err == nil {
+		t.Error("Expected an error draining an unknown host")
+	}
+	if err := state.SetDraining("foo"); err != nil {
+		t.Fatal(err)
+	}
+	state.Commit()
+
+	if !state.Get()["foo"].Draining {
+		t.Error("Expected 'foo' to be draining")
+	}
+}
+
+func TestStateAddJobsResources(t *testing.T) {
+	state := NewState()
+	state.Begin()
+	state.AddHost(&host.Host{ID: "foo", Resources: host.HostResources{Memory: 1024, CPUShares: 2048, Overcommit: 1.5}}, nil)
+	state.AddHost(&host.Host{ID: "bar"}, nil)
+	state.Commit()
+
+	job := func(id string, memory, cpu int) *host.Job {
+		return &host.Job{ID: id, Resources: host.JobResources{Memory: memory, CPUShares: cpu}}
+	}
+
+	state.Begin()
+	if err := state.AddJobs("foo", []*host.Job{job("a", 1024, 1024), job("b", 512, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	state.Commit()
+
+	state.Begin()
+	err := state.AddJobs("foo", []*host.Job{job("c", 1, 0)})
+	state.Rollback()
+	e, ok := err.(*host.ResourceError)
+	if !ok {
+		t.Fatalf("expected a resource error, got %v", err)
+	}
+	if expected := (host.ResourceError{HostID: "foo", Resource: "memory", Requested: 1537, Available: 1536}); *e != expected {
+		t.Errorf("expected %+v, got %+v", expected, *e)
+	}
+	if parsed, ok := host.ParseResourceError(e.Error()); !ok || *parsed != *e {
+		t.Errorf("expected %q to parse as %+v, got %+v", e.Error(), *e, parsed)
+	}
+
+	state.Begin()
+	err = state.AddJobs("foo", []*host.Job{job("c", 0, 3072)})
+	state.Rollback()
+	if e, ok := err.(*host.ResourceError); !ok || e.Resource != "cpu" {
+		t.Errorf("expected a cpu resource error, got %v", err)
+	}
+
+	// hosts without resources accept any limits
+	state.Begin()
+	if err := state.AddJobs("bar", []*host.Job{job("c", 1<<30, 1<<30)}); err != nil {
+		t.Error(err)
+	}
+	state.Commit()
+
+	// devices are claimed even from hosts without memory or cpu limits
+	gpu := func(id string, n int) *host.Job {
+		return &host.Job{ID: id, Config: host.ContainerConfig{Devices: []host.DeviceRequest{{Class: "gpu", Count: n}}}}
+	}
+	state.Begin()
+	err = state.AddJobs("bar", []*host.Job{gpu("d", 1)})
+	state.Rollback()
+	if e, ok := err.(*host.ResourceError); !ok || e.Resource != "gpu" || e.Available != 0 {
+		t.Errorf("expected a gpu resource error, got %v", err)
+	}
+	state.Begin()
+	state.AddHost(&host.Host{ID: "baz", Resources: host.HostResources{Devices: map[string]int{"gpu": 2}}}, nil)
+	if err := state.AddJobs("baz", []*host.Job{gpu("d", 1), gpu("e", 1)}); err != nil {
+		t.Error(err)
+	}
+	err = state.AddJobs("baz", []*host.Job{gpu("f", 1)})
+	state.Rollback()
+	if e, ok := err.(*host.ResourceError); !ok || e.Requested != 3 || e.Available != 2 {
+		t.Errorf("expected a gpu resource error, got %v", err)
+	}
+
+	if _, ok := host.ParseResourceError("sampi: Unknown host foo"); ok {
+		t.Error("expected other errors not to parse as resource errors")
+	}
+}
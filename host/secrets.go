@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// secretsPath is where a job's secrets are mounted in its container.
+const secretsPath = "/run/secrets"
+
+const secretsMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC
+
+// writeSecrets mounts a tmpfs at dir, writes each secret to a file in it which
+// only uid can read, then remounts it read-only. The tmpfs is unmounted if
+// the secrets can't be written.
+func writeSecrets(dir string, secrets []host.Secret, uid int) (err error) {
+	size := 0
+	for _, s := range secrets {
+		if !validSecretName(s.Name) {
+			return fmt.Errorf("invalid secret name %q", s.Name)
+		}
+		// each file takes up at least one page
+		size += len(s.Data) + os.Getpagesize()
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	opts := fmt.Sprintf("mode=0500,uid=%d,size=%d", uid, size)
+	if err := syscall.Mount("tmpfs", dir, "tmpfs", secretsMountFlags, opts); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			syscall.Unmount(dir, 0)
+		}
+	}()
+	if err := syscall.Mount("", dir, "none", syscall.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	for _, s := range secrets {
+		path := filepath.Join(dir, s.Name)
+		if err := ioutil.WriteFile(path, s.Data, 0400); err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, -1); err != nil {
+			return err
+		}
+	}
+	return syscall.Mount("", dir, "none", syscall.MS_REMOUNT|syscall.MS_RDONLY|secretsMountFlags, "")
+}
+
+func validSecretName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.Contains(name, "/")
+}
+
+// withoutSecrets returns the jobs with the data of their secrets and their
+// registry credentials removed, so that it is not written to the state file. Running jobs keep their secrets
+// in their tmpfs, so the data isn't needed when the state is restored.
+func withoutSecrets(jobs map[string]*host.ActiveJob) map[string]*host.ActiveJob {
+	res := make(map[string]*host.ActiveJob, len(jobs))
+	for id, j := range jobs {
+		if j.Job == nil || len(j.Job.Config.Secrets) == 0 && j.Job.RegistryAuth == nil {
+			res[id] = j
+			continue
+		}
+		job := *j
+		job.Job = j.Job.Dup()
+		for i := range job.Job.Config.Secrets {
+			job.Job.Config.Secrets[i].Data = nil
+		}
+		job.Job.RegistryAuth = nil
+		res[id] = &job
+	}
+	return res
+}
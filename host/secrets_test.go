@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+func TestValidSecretName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"db_password": true,
+		"tls.key":     true,
+		"":            false,
+		".env":        false,
+		"..":          false,
+		"a/b":         false,
+	} {
+		if validSecretName(name) != valid {
+			t.Errorf("expected validSecretName(%q) to be %t", name, valid)
+		}
+	}
+}
+
+func TestWithoutSecrets(t *testing.T) {
+	job := &host.Job{ID: "a", Config: host.ContainerConfig{Secrets: []host.Secret{{Name: "key", Data: []byte("s3cret")}}}}
+	jobs := map[string]*host.ActiveJob{
+		"a": {Job: job},
+		"b": {Job: &host.Job{ID: "b"}},
+	}
+	res := withoutSecrets(jobs)
+	if s := res["a"].Job.Config.Secrets; len(s) != 1 || s[0].Name != "key" || s[0].Data != nil {
+		t.Errorf("expected the secret's data to be removed, got %+v", s)
+	}
+	if string(job.Config.Secrets[0].Data) != "s3cret" {
+		t.Error("expected the running job to keep its secret")
+	}
+	if res["b"] != jobs["b"] {
+		t.Error("expected jobs without secrets to be unchanged")
+	}
+}
+
+func TestWithoutRegistryAuth(t *testing.T) {
+	job := &host.Job{ID: "a", RegistryAuth: &host.RegistryAuth{Username: "deploy", Password: "s3cret"}}
+	res := withoutSecrets(map[string]*host.ActiveJob{"a": {Job: job}})
+	if res["a"].Job.RegistryAuth != nil {
+		t.Error("expected the registry credentials to be removed")
+	}
+	if job.RegistryAuth == nil {
+		t.Error("expected the running job to keep its registry credentials")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/flynn/flynn/host/containerinit"
+)
+
+// Profile names which are not custom profiles.
+const (
+	profileDefault    = "default"
+	profileUnconfined = "unconfined"
+)
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// securityProfiles resolves the seccomp and AppArmor profiles jobs select by
+// name. Custom profiles are shipped to hosts as files in dir, seccomp/NAME.json
+// and apparmor/NAME (which must define the profile NAME), and AppArmor
+// profiles are loaded into the kernel when a job first uses them.
+type securityProfiles struct {
+	dir string
+
+	// apparmorFS is the securityfs directory of AppArmor, which lists the
+	// loaded profiles
+	apparmorFS string
+
+	mtx sync.Mutex
+}
+
+func newSecurityProfiles(dir string) *securityProfiles {
+	return &securityProfiles{dir: dir, apparmorFS: "/sys/kernel/security/apparmor"}
+}
+
+// defaultSeccompProfile fails the system calls which administer the host or
+// the kernel, or could escape the container's namespaces, with EPERM.
+var defaultSeccompProfile = &containerinit.SeccompProfile{
+	DefaultAction: "allow",
+	Syscalls: []containerinit.SeccompRule{{
+		Action: "errno",
+		Names: []string{
+			"acct", "add_key", "bpf", "clock_adjtime", "clock_settime",
+			"create_module", "delete_module", "finit_module", "get_kernel_syms",
+			"init_module", "ioperm", "iopl", "kcmp", "kexec_file_load",
+			"kexec_load", "keyctl", "lookup_dcookie", "mount",
+			"name_to_handle_at", "nfsservctl", "open_by_handle_at",
+			"perf_event_open", "pivot_root", "process_vm_readv",
+			"process_vm_writev", "query_module", "quotactl", "reboot",
+			"request_key", "setns", "settimeofday", "swapoff", "swapon",
+			"syslog", "sysfs", "_sysctl", "umount2", "unshare", "uselib",
+			"userfaultfd", "ustat", "vhangup",
+		},
+	}},
+}
+
+// defaultAppArmorProfile denies jobs mounting filesystems, writing to the
+// kernel's settings in /proc and /sys and reading its memory.
+const defaultAppArmorProfile = `#include <tunables/global>
+
+profile flynn-default flags=(attach_disconnected,mediate_deleted) {
+  #include <abstractions/base>
+
+  network,
+  capability,
+  file,
+  umount,
+
+  deny mount,
+  deny @{PROC}/sys/kernel/{?,??,[^s][^h][^m]**} w,
+  deny @{PROC}/sysrq-trigger rwklx,
+  deny @{PROC}/kcore rwklx,
+  deny @{PROC}/mem rwklx,
+  deny /sys/[^f]*/** wklx,
+  deny /sys/f[^s]*/** wklx,
+  deny /sys/fs/[^c]*/** wklx,
+  deny /sys/fs/c[^g]*/** wklx,
+  deny /sys/fs/cg[^r]*/** wklx,
+  deny /sys/firmware/** rwklx,
+  deny /sys/kernel/security/** rwklx,
+
+  ptrace (trace,read) peer=flynn-default,
+}
+`
+
+const defaultAppArmorProfileName = "flynn-default"
+
+// confined returns whether jobs selecting the named profile are confined.
+func confined(name string) bool {
+	return name != "" && name != profileUnconfined
+}
+
+// Seccomp returns the JSON seccomp profile with the given name, or an empty
+// string if jobs with the name are not filtered.
+func (p *securityProfiles) Seccomp(name string) (string, error) {
+	var profile *containerinit.SeccompProfile
+	switch name {
+	case "", profileUnconfined:
+		return "", nil
+	case profileDefault:
+		profile = defaultSeccompProfile
+	default:
+		if !profileNamePattern.MatchString(name) {
+			return "", fmt.Errorf("host: invalid seccomp profile name %q", name)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(p.dir, "seccomp", name+".json"))
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("host: unknown seccomp profile %q", name)
+		} else if err != nil {
+			return "", err
+		}
+		if profile, err = containerinit.ParseSeccompProfile(data); err != nil {
+			return "", fmt.Errorf("host: seccomp profile %s: %s", name, err)
+		}
+	}
+	data, err := json.Marshal(profile)
+	return string(data), err
+}
+
+// AppArmor returns the name of the AppArmor profile jobs with the given
+// profile name are confined by, loading it if it is not loaded, or an empty
+// string if they are not confined.
+func (p *securityProfiles) AppArmor(name string) (string, error) {
+	switch name {
+	case "", profileUnconfined:
+		return "", nil
+	case profileDefault:
+		return defaultAppArmorProfileName, p.loadAppArmor(defaultAppArmorProfileName, func() ([]byte, error) {
+			return []byte(defaultAppArmorProfile), nil
+		})
+	}
+	if !profileNamePattern.MatchString(name) {
+		return "", fmt.Errorf("host: invalid AppArmor profile name %q", name)
+	}
+	return name, p.loadAppArmor(name, func() ([]byte, error) {
+		data, err := ioutil.ReadFile(filepath.Join(p.dir, "apparmor", name))
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("host: AppArmor profile %q is neither loaded nor in %s", name, filepath.Join(p.dir, "apparmor"))
+		}
+		return data, err
+	})
+}
+
+// loadAppArmor loads the profile returned by source with apparmor_parser if
+// no profile with the name is loaded.
+func (p *securityProfiles) loadAppArmor(name string, source func() ([]byte, error)) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	f, err := os.Open(filepath.Join(p.apparmorFS, "profiles"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("host: AppArmor is not enabled on the host")
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	// lines are "NAME (MODE)"
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.LastIndex(line, " ("); i > 0 && line[:i] == name {
+			return nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	data, err := source()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("apparmor_parser", "--replace")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("host: error loading AppArmor profile %s: %s: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
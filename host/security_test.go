@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flynn/flynn/host/containerinit"
+)
+
+func TestSeccompProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "seccomp"), 0755)
+	custom := `{"defaultAction": "errno", "syscalls": [{"names": ["read", "write", "exit_group"], "action": "allow"}]}`
+	ioutil.WriteFile(filepath.Join(dir, "seccomp", "strict.json"), []byte(custom), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "seccomp", "bad.json"), []byte(`{"defaultAction": "allow", "syscalls": [{"names": ["nope"], "action": "errno"}]}`), 0644)
+	p := newSecurityProfiles(dir)
+
+	for _, name := range []string{"", "unconfined"} {
+		if s, err := p.Seccomp(name); err != nil || s != "" {
+			t.Errorf("%q: expected no profile, got %q, %v", name, s, err)
+		}
+	}
+
+	s, err := p.Seccomp("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := containerinit.ParseSeccompProfile([]byte(s)); err != nil {
+		t.Errorf("default: %s", err)
+	}
+
+	s, err = p.Seccomp("strict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var profile containerinit.SeccompProfile
+	json.Unmarshal([]byte(s), &profile)
+	if profile.DefaultAction != "errno" || len(profile.Syscalls) != 1 || len(profile.Syscalls[0].Names) != 3 {
+		t.Errorf("unexpected custom profile %s", s)
+	}
+
+	for _, name := range []string{"../strict", "missing", "bad"} {
+		if _, err := p.Seccomp(name); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+}
+
+func TestAppArmorProfiles(t *testing.T) {
+	fs, err := ioutil.TempDir("", "apparmorfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(fs)
+	p := newSecurityProfiles(fs)
+	p.apparmorFS = fs
+
+	if name, err := p.AppArmor("unconfined"); err != nil || name != "" {
+		t.Errorf("expected no profile, got %q, %v", name, err)
+	}
+	if _, err := p.AppArmor("default"); err == nil {
+		t.Error("expected an error without AppArmor")
+	}
+
+	ioutil.WriteFile(filepath.Join(fs, "profiles"), []byte("flynn-default (enforce)\nnginx (complain)\n"), 0644)
+	for _, name := range []string{"default", "nginx"} {
+		if _, err := p.AppArmor(name); err != nil {
+			t.Errorf("%q: %s", name, err)
+		}
+	}
+	for _, name := range []string{".hidden", "missing"} {
+		if _, err := p.AppArmor(name); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -39,6 +40,23 @@ func NewState(id string) *State {
 	}
 }
 
+// errJobLost is the error of jobs which were running when the host daemon
+// stopped, but which the backend could not reattach to when it restarted.
+var errJobLost = errors.New("host: job was lost while the host daemon was restarting")
+
+// errHealthKilled is the error of jobs which exited after being stopped for
+// failing their health checks.
+var errHealthKilled = errors.New("host: job was stopped after failing its health check")
+
+// jobActive returns whether the job is starting or running.
+func jobActive(job *host.ActiveJob) bool {
+	return job.Status == host.StatusStarting || job.Status == host.StatusRunning
+}
+
+// Restore reads the jobs from the state file and has the backend reattach to
+// the containers of those which are still running. Backends remove the jobs
+// they can't reattach to from the jobs they are given, the ones which were
+// running are kept as failed so that the scheduler restarts them.
 func (s *State) Restore(file string, backend Backend) error {
 	s.stateFileMtx.Lock()
 	defer s.stateFileMtx.Unlock()
@@ -55,12 +73,34 @@ func (s *State) Restore(file string, backend Backend) error {
 		}
 		return err
 	}
-	for _, job := range s.jobs {
+	// the backend is given a copy of the jobs, as the containers it
+	// reattaches to update the state while it restores the others
+	restored := make(map[string]*host.ActiveJob, len(s.jobs))
+	for id, job := range s.jobs {
 		if job.ContainerID != "" {
 			s.containers[job.ContainerID] = job
 		}
+		restored[id] = job
+	}
+	if err := backend.RestoreState(restored, d); err != nil {
+		return err
 	}
-	return backend.RestoreState(s.jobs, d)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for id, job := range s.jobs {
+		if _, ok := restored[id]; ok {
+			continue
+		}
+		if jobActive(job) {
+			s.setStatusFailed(job, errJobLost)
+			continue
+		}
+		delete(s.jobs, id)
+		if job.ContainerID != "" {
+			delete(s.containers, job.ContainerID)
+		}
+	}
+	return nil
 }
 
 func (s *State) persist() {
@@ -73,7 +113,7 @@ func (s *State) persist() {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 	enc := json.NewEncoder(s.stateFile)
-	if err := enc.Encode(s.jobs); err != nil {
+	if err := enc.Encode(withoutSecrets(s.jobs)); err != nil {
 		// log error
 		return
 	}
@@ -83,6 +123,10 @@ func (s *State) persist() {
 			return
 		}
 	}
+	// remove what is left of a longer previous state
+	if offset, err := s.stateFile.Seek(0, 1); err == nil {
+		s.stateFile.Truncate(offset)
+	}
 	if err := s.stateFile.Sync(); err != nil {
 		// log error
 	}
@@ -108,6 +152,18 @@ func (s *State) GetJob(id string) *host.ActiveJob {
 	return &jobCopy
 }
 
+// GetContainerJob returns a copy of the job running in a container.
+func (s *State) GetContainerJob(containerID string) *host.ActiveJob {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	job := s.containers[containerID]
+	if job == nil {
+		return nil
+	}
+	jobCopy := *job
+	return &jobCopy
+}
+
 func (s *State) RemoveJob(id string) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
@@ -125,13 +181,17 @@ func (s *State) Get() map[string]host.ActiveJob {
 	return res
 }
 
+// ClusterJobs returns the starting and running jobs, which the host registers
+// with the scheduler as the jobs it runs.
 func (s *State) ClusterJobs() []*host.Job {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
 
 	res := make([]*host.Job, 0, len(s.jobs))
 	for _, j := range s.jobs {
-		res = append(res, j.Job)
+		if jobActive(j) {
+			res = append(res, j.Job)
+		}
 	}
 	return res
 }
@@ -173,6 +233,77 @@ func (s *State) SetStatusRunning(jobID string) {
 	go s.persist()
 }
 
+// SetHealthy records the result of the job's health check, sending a
+// "healthy" or "unhealthy" event if its health changed.
+func (s *State) SetHealthy(jobID string, healthy bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	job, ok := s.jobs[jobID]
+	if !ok || job.Status != host.StatusRunning || job.Healthy == healthy {
+		return
+	}
+	job.Healthy = healthy
+	if healthy {
+		s.sendEvent(job, "healthy")
+	} else {
+		s.sendEvent(job, "unhealthy")
+	}
+	go s.persist()
+}
+
+// SetOOMKilled records that the job ran out of memory, sending an "oom" event.
+func (s *State) SetOOMKilled(jobID string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if job, ok := s.jobs[jobID]; ok {
+		s.setOOMKilled(job)
+	}
+}
+
+func (s *State) SetContainerOOMKilled(containerID string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if job, ok := s.containers[containerID]; ok {
+		s.setOOMKilled(job)
+	}
+}
+
+func (s *State) setOOMKilled(job *host.ActiveJob) {
+	if job.Status != host.StatusStarting && job.Status != host.StatusRunning {
+		return
+	}
+	job.OOMKilled = true
+	s.sendEvent(job, "oom")
+	go s.persist()
+}
+
+// SetForceKilled records that the job was killed because it did not stop
+// gracefully, before it is sent SIGKILL so that the "stop" event includes it.
+func (s *State) SetForceKilled(jobID string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	job, ok := s.jobs[jobID]
+	if !ok || job.Status != host.StatusRunning {
+		return
+	}
+	job.ForceKilled = true
+	go s.persist()
+}
+
+// SetHealthKilled records that the job is being stopped because it failed its
+// health checks, before it is stopped so that it is failed when it exits.
+func (s *State) SetHealthKilled(jobID string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	job, ok := s.jobs[jobID]
+	if !ok || job.Status != host.StatusRunning {
+		return
+	}
+	job.HealthKilled = true
+	go s.persist()
+}
+
 func (s *State) SetContainerStatusDone(containerID string, exitCode int) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
@@ -198,6 +329,12 @@ func (s *State) setStatusDone(job *host.ActiveJob, exitStatus int) {
 	if job.Status == host.StatusDone || job.Status == host.StatusCrashed || job.Status == host.StatusFailed {
 		return
 	}
+	if job.HealthKilled {
+		// the job most likely exited gracefully when it was stopped
+		job.ExitStatus = exitStatus
+		s.setStatusFailed(job, errHealthKilled)
+		return
+	}
 	job.EndedAt = time.Now().UTC()
 	job.ExitStatus = exitStatus
 	if exitStatus == 0 {
@@ -214,7 +351,14 @@ func (s *State) SetStatusFailed(jobID string, err error) {
 	defer s.mtx.Unlock()
 
 	job, ok := s.jobs[jobID]
-	if !ok || job.Status == host.StatusDone || job.Status == host.StatusCrashed || job.Status == host.StatusFailed {
+	if !ok {
+		return
+	}
+	s.setStatusFailed(job, err)
+}
+
+func (s *State) setStatusFailed(job *host.ActiveJob, err error) {
+	if job.Status == host.StatusDone || job.Status == host.StatusCrashed || job.Status == host.StatusFailed {
 		return
 	}
 	job.Status = host.StatusFailed
@@ -223,7 +367,7 @@ func (s *State) SetStatusFailed(jobID string, err error) {
 	job.Error = &errStr
 	s.sendEvent(job, "error")
 	go s.persist()
-	go s.WaitAttach(jobID)
+	go s.WaitAttach(job.Job.ID)
 }
 
 func (s *State) AddAttacher(jobID string, ch chan struct{}) *host.ActiveJob {
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/flynn/flynn/host/types"
@@ -15,3 +19,93 @@ func TestStateHostID(t *testing.T) {
 		t.Errorf("expected job.HostID to equal %s, got %s", hostID, job.HostID)
 	}
 }
+
+func TestStateOOMKilled(t *testing.T) {
+	state := NewState("abc123")
+	events := state.AddListener("a")
+	defer state.RemoveListener("a", events)
+	state.AddJob(&host.Job{ID: "a"})
+	if e := <-events; e.Event != "create" {
+		t.Fatalf("expected a create event, got %s", e.Event)
+	}
+
+	state.SetStatusRunning("a")
+	<-events
+	state.SetOOMKilled("a")
+	e := <-events
+	if e.Event != "oom" || !e.Job.OOMKilled {
+		t.Fatalf("expected an oom event with OOMKilled set, got %s %+v", e.Event, e.Job)
+	}
+	if !state.GetJob("a").OOMKilled {
+		t.Error("expected the job to be OOMKilled")
+	}
+
+	// jobs which have exited are not marked
+	state.AddJob(&host.Job{ID: "b"})
+	state.SetStatusDone("b", 137)
+	state.SetOOMKilled("b")
+	if state.GetJob("b").OOMKilled {
+		t.Error("expected an exited job not to be OOMKilled")
+	}
+}
+
+// restoreBackend reattaches to the containers of all jobs except lost ones.
+type restoreBackend struct {
+	Backend
+	lost []string
+}
+
+func (b *restoreBackend) RestoreState(jobs map[string]*host.ActiveJob, dec *json.Decoder) error {
+	for _, id := range b.lost {
+		delete(jobs, id)
+	}
+	return nil
+}
+
+func TestStateRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flynn-host-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+
+	// a and b were running, c and d had stopped
+	prev := NewState("host0")
+	for _, id := range []string{"a", "b", "c", "d"} {
+		prev.AddJob(&host.Job{ID: id})
+		prev.SetStatusRunning(id)
+	}
+	prev.SetStatusDone("c", 0)
+	prev.SetStatusDone("d", 0)
+	data, err := json.Marshal(prev.jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	state := NewState("host0")
+	if err := state.Restore(file, &restoreBackend{lost: []string{"b", "d"}}); err != nil {
+		t.Fatal(err)
+	}
+	if job := state.GetJob("a"); job == nil || job.Status != host.StatusRunning {
+		t.Errorf("expected job a to be running, got %+v", job)
+	}
+	if job := state.GetJob("b"); job == nil || job.Status != host.StatusFailed || job.Error == nil || *job.Error != errJobLost.Error() {
+		t.Errorf("expected job b to have failed as lost, got %+v", job)
+	}
+	if job := state.GetJob("c"); job == nil || job.Status != host.StatusDone {
+		t.Errorf("expected job c to be done, got %+v", job)
+	}
+	if job := state.GetJob("d"); job != nil {
+		t.Errorf("expected job d to be removed, got %+v", job)
+	}
+
+	// only the running job is registered with the scheduler
+	jobs := state.ClusterJobs()
+	if len(jobs) != 1 || jobs[0].ID != "a" {
+		t.Errorf("expected the cluster jobs to be [a], got %v", jobs)
+	}
+}
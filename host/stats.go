@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// clockTicks is the kernel's USER_HZ, the unit of the times in cpuacct.stat.
+const clockTicks = 100
+
+var (
+	errJobNotFound   = errors.New("host: unknown job")
+	errJobNotRunning = errors.New("host: job is not running")
+	errNoStats       = errors.New("host: the backend does not support job stats")
+)
+
+// readCgroupStats reads the CPU, memory and block IO usage of the cgroups of
+// the process with the given pid into stats. Subsystems which are not mounted
+// are skipped.
+func readCgroupStats(pid int, stats *host.JobStats) error {
+	paths, err := cgroups(pid)
+	if err != nil {
+		return err
+	}
+
+	if dir, ok := paths["cpuacct"]; ok {
+		if stats.CPU.UsageNanoseconds, err = readUint(filepath.Join(dir, "cpuacct.usage")); err != nil {
+			return err
+		}
+		cpu, err := readFlatKeyed(filepath.Join(dir, "cpuacct.stat"))
+		if err != nil {
+			return err
+		}
+		stats.CPU.UserNanoseconds = cpu["user"] * (1e9 / clockTicks)
+		stats.CPU.SystemNanoseconds = cpu["system"] * (1e9 / clockTicks)
+	}
+
+	if dir, ok := paths["memory"]; ok {
+		for file, v := range map[string]*uint64{
+			"memory.usage_in_bytes":     &stats.Memory.Usage,
+			"memory.max_usage_in_bytes": &stats.Memory.MaxUsage,
+			"memory.limit_in_bytes":     &stats.Memory.Limit,
+		} {
+			if *v, err = readUint(filepath.Join(dir, file)); err != nil {
+				return err
+			}
+		}
+		mem, err := readFlatKeyed(filepath.Join(dir, "memory.stat"))
+		if err != nil {
+			return err
+		}
+		stats.Memory.RSS = mem["rss"]
+		stats.Memory.Cache = mem["cache"]
+	}
+
+	if dir, ok := paths["blkio"]; ok {
+		f, err := os.Open(filepath.Join(dir, "blkio.throttle.io_service_bytes"))
+		if err != nil {
+			return err
+		}
+		stats.BlockIO.ReadBytes, stats.BlockIO.WriteBytes, err = parseBlkioStats(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if f, err = os.Open(filepath.Join(dir, "blkio.throttle.io_serviced")); err != nil {
+			return err
+		}
+		stats.BlockIO.ReadOps, stats.BlockIO.WriteOps, err = parseBlkioStats(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readNetDevStats reads the network usage of the network namespace of the
+// process with the given pid, excluding the loopback interface.
+func readNetDevStats(pid int) (host.NetworkStats, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/net/dev", pid))
+	if err != nil {
+		return host.NetworkStats{}, err
+	}
+	defer f.Close()
+	return parseNetDev(f)
+}
+
+// readVethStats reads the network usage of a container from the host's end
+// of its veth pair, what the host receives was sent by the container.
+func readVethStats(iface string) (stats host.NetworkStats, err error) {
+	dir := filepath.Join("/sys/class/net", iface, "statistics")
+	for file, v := range map[string]*uint64{
+		"rx_bytes":   &stats.TxBytes,
+		"rx_packets": &stats.TxPackets,
+		"tx_bytes":   &stats.RxBytes,
+		"tx_packets": &stats.RxPackets,
+	} {
+		if *v, err = readUint(filepath.Join(dir, file)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func readUint(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readFlatKeyed reads a cgroup file with "key value" lines, like memory.stat.
+func readFlatKeyed(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseFlatKeyed(f)
+}
+
+func parseFlatKeyed(r io.Reader) (map[string]uint64, error) {
+	values := make(map[string]uint64)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cgroup: invalid value for %s: %s", fields[0], err)
+		}
+		values[fields[0]] = v
+	}
+	return values, s.Err()
+}
+
+// parseBlkioStats sums the reads and writes of each device in a blkio file
+// with lines like "8:0 Read 4096".
+func parseBlkioStats(r io.Reader) (read, write uint64, err error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 3 {
+			// the last line is the total of all devices
+			continue
+		}
+		v, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("cgroup: invalid blkio value %q", s.Text())
+		}
+		switch fields[1] {
+		case "Read":
+			read += v
+		case "Write":
+			write += v
+		}
+	}
+	return read, write, s.Err()
+}
+
+// parseNetDev sums the counters of the interfaces in a /proc/<pid>/net/dev
+// file, other than the loopback interface.
+func parseNetDev(r io.Reader) (stats host.NetworkStats, err error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), ":", 2)
+		// the first two lines are headers without a colon
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "lo" {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) < 10 {
+			return stats, fmt.Errorf("net/dev: invalid line %q", s.Text())
+		}
+		var v [4]uint64
+		for i, field := range []int{0, 1, 8, 9} {
+			if v[i], err = strconv.ParseUint(fields[field], 10, 64); err != nil {
+				return stats, fmt.Errorf("net/dev: invalid line %q", s.Text())
+			}
+		}
+		stats.RxBytes += v[0]
+		stats.RxPackets += v[1]
+		stats.TxBytes += v[2]
+		stats.TxPackets += v[3]
+	}
+	return stats, s.Err()
+}
+
+// statsHandler serves the resource usage of running jobs at
+// /host/jobs/:id/stats. With ?stream=true the stats are written as a stream of
+// JSON objects each interval (?interval=5s, one second by default) until the
+// job stops or the client disconnects.
+type statsHandler struct {
+	state   *State
+	backend Backend
+}
+
+func (h *statsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/host/jobs"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "stats" || req.Method != "GET" {
+		http.NotFound(w, req)
+		return
+	}
+	id := parts[0]
+
+	if req.FormValue("stream") != "true" {
+		stats, err := h.jobStats(id)
+		if err != nil {
+			writeJobError(w, err)
+			return
+		}
+		writeJSON(w, 200, stats)
+		return
+	}
+
+	interval := time.Second
+	if s := req.FormValue("interval"); s != "" {
+		var err error
+		if interval, err = time.ParseDuration(s); err != nil || interval <= 0 {
+			http.Error(w, fmt.Sprintf("host: invalid interval %q", s), 400)
+			return
+		}
+	}
+	stats, err := h.jobStats(id)
+	if err != nil {
+		writeJobError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	enc := json.NewEncoder(w)
+	for {
+		if err := enc.Encode(stats); err != nil {
+			return
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		time.Sleep(interval)
+		if stats, err = h.jobStats(id); err != nil {
+			return
+		}
+	}
+}
+
+func (h *statsHandler) jobStats(id string) (*host.JobStats, error) {
+	job := h.state.GetJob(id)
+	if job == nil {
+		return nil, errJobNotFound
+	}
+	if job.Status != host.StatusRunning {
+		return nil, errJobNotRunning
+	}
+	r, ok := h.backend.(StatsReader)
+	if !ok {
+		return nil, errNoStats
+	}
+	stats, err := r.JobStats(id)
+	if err != nil {
+		return nil, err
+	}
+	stats.JobID = id
+	stats.Time = time.Now().UTC()
+	return stats, nil
+}
+
+// writeJobError writes the HTTP error of the stats, exec and checkpoint
+// handlers.
+func writeJobError(w http.ResponseWriter, err error) {
+	switch err {
+	case errJobNotFound:
+		http.Error(w, err.Error(), 404)
+	case errJobNotRunning:
+		http.Error(w, err.Error(), 409)
+	case errNoStats, errNoExec, errNoCheckpoint, errCheckpointDisabled:
+		http.Error(w, err.Error(), 501)
+	default:
+		http.Error(w, err.Error(), 500)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+func TestParseStats(t *testing.T) {
+	blkio := `8:0 Read 4096
+8:0 Write 1024
+8:0 Sync 0
+8:16 Read 100
+8:16 Write 0
+Total 5220
+`
+	read, write, err := parseBlkioStats(strings.NewReader(blkio))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != 4196 || write != 1024 {
+		t.Errorf("expected 4196 bytes read and 1024 written, got %d and %d", read, write)
+	}
+
+	netDev := `Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo:    1000      10    0    0    0     0          0         0     1000      10    0    0    0     0       0          0
+  eth0:    2048      16    0    0    0     0          0         0      512       4    0    0    0     0       0          0
+`
+	net, err := parseNetDev(strings.NewReader(netDev))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (host.NetworkStats{RxBytes: 2048, RxPackets: 16, TxBytes: 512, TxPackets: 4}); net != expected {
+		t.Errorf("expected %+v, got %+v", expected, net)
+	}
+
+	mem, err := parseFlatKeyed(strings.NewReader("cache 4096\nrss 8192\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mem["cache"] != 4096 || mem["rss"] != 8192 {
+		t.Errorf("unexpected memory stats %v", mem)
+	}
+	if _, err := parseFlatKeyed(strings.NewReader("rss -1\n")); err == nil {
+		t.Error("expected an error parsing an invalid value")
+	}
+}
+
+// statsBackend returns stats whose CPU usage is the number of times it has
+// been called.
+type statsBackend struct {
+	Backend
+	calls int
+}
+
+func (b *statsBackend) JobStats(id string) (*host.JobStats, error) {
+	b.calls++
+	return &host.JobStats{CPU: host.CPUStats{UsageNanoseconds: uint64(b.calls)}}, nil
+}
+
+func TestStatsAPI(t *testing.T) {
+	state := NewState("host0")
+	state.AddJob(&host.Job{ID: "a"})
+	state.SetStatusRunning("a")
+	state.AddJob(&host.Job{ID: "b"})
+
+	mux := http.NewServeMux()
+	mux.Handle("/host/jobs/", &statsHandler{state: state, backend: &statsBackend{}})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	client := cluster.NewHostClient(srv.Listener.Addr().String(), nil, nil)
+
+	stats, err := client.JobStats("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.JobID != "a" || stats.CPU.UsageNanoseconds != 1 || stats.Time.IsZero() {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if _, err := client.JobStats("b"); err != cluster.ErrJobNotRunning {
+		t.Errorf("expected ErrJobNotRunning, got %v", err)
+	}
+	if _, err := client.JobStats("c"); err != cluster.ErrJobNotFound {
+		t.Errorf("expected ErrJobNotFound, got %v", err)
+	}
+
+	ch := make(chan *host.JobStats)
+	stream, err := client.StreamJobStats("a", time.Millisecond, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(2); i < 5; i++ {
+		select {
+		case stats := <-ch:
+			if stats.CPU.UsageNanoseconds != i {
+				t.Errorf("expected usage %d, got %d", i, stats.CPU.UsageNanoseconds)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for stats")
+		}
+	}
+
+	// the stream ends when the job stops
+	state.SetStatusDone("a", 0)
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				if err := stream.Err(); err != nil {
+					t.Errorf("unexpected stream error %s", err)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the stream to end")
+		}
+	}
+}
+
+func TestStatsAPIUnsupported(t *testing.T) {
+	state := NewState("host0")
+	state.AddJob(&host.Job{ID: "a"})
+	state.SetStatusRunning("a")
+	h := &statsHandler{state: state, backend: struct{ Backend }{}}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/host/jobs/a/stats", nil)
+	h.ServeHTTP(w, req)
+	if w.Code != 501 {
+		t.Errorf("expected status 501, got %d", w.Code)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/types"
+)
+
+const defaultKillTimeout = 10 * time.Second
+
+// stopJob sends the job its stop signal and waits for it to exit, killing it
+// with SIGKILL if it has not exited within its kill timeout. wait returns nil
+// once the job has exited, or an error if it has not within the timeout.
+func stopJob(state *State, job *host.Job, signal func(int) error, wait func(time.Duration) error) error {
+	sig := job.Config.StopSignal
+	if sig == 0 {
+		sig = int(syscall.SIGTERM)
+	}
+	timeout := job.Config.KillTimeout
+	if timeout == 0 {
+		timeout = defaultKillTimeout
+	}
+	g := grohl.NewContext(grohl.Data{"fn": "stop_job", "job.id": job.ID})
+	g.Log(grohl.Data{"at": "signal", "signal": sig, "timeout": timeout})
+	if err := signal(sig); err != nil {
+		return err
+	}
+	if err := wait(timeout); err == nil {
+		return nil
+	}
+	g.Log(grohl.Data{"at": "kill"})
+	state.SetForceKilled(job.ID)
+	return signal(int(syscall.SIGKILL))
+}
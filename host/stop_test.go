@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+func TestStopJob(t *testing.T) {
+	for _, test := range []struct {
+		config  host.ContainerConfig
+		exits   bool
+		signals []int
+		timeout time.Duration
+	}{
+		{host.ContainerConfig{}, true, []int{int(syscall.SIGTERM)}, defaultKillTimeout},
+		{host.ContainerConfig{StopSignal: int(syscall.SIGQUIT), KillTimeout: time.Minute}, true, []int{int(syscall.SIGQUIT)}, time.Minute},
+		{host.ContainerConfig{}, false, []int{int(syscall.SIGTERM), int(syscall.SIGKILL)}, defaultKillTimeout},
+	} {
+		state := NewState("host0")
+		job := &host.Job{ID: "a", Config: test.config}
+		state.AddJob(job)
+		state.SetStatusRunning(job.ID)
+
+		var signals []int
+		var timeout time.Duration
+		signal := func(sig int) error {
+			signals = append(signals, sig)
+			return nil
+		}
+		wait := func(d time.Duration) error {
+			timeout = d
+			if !test.exits {
+				return errors.New("timed out")
+			}
+			return nil
+		}
+		if err := stopJob(state, job, signal, wait); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(signals, test.signals) {
+			t.Errorf("expected signals %v, got %v", test.signals, signals)
+		}
+		if timeout != test.timeout {
+			t.Errorf("expected a timeout of %s, got %s", test.timeout, timeout)
+		}
+		if killed := state.GetJob(job.ID).ForceKilled; killed == test.exits {
+			t.Errorf("expected ForceKilled to be %t, got %t", !test.exits, killed)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/flynn/flynn/host/containerinit"
+	"github.com/flynn/flynn/host/types"
+)
+
+const tmpfsMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV
+
+// validateTmpfs checks that the tmpfs mounts of a job are at absolute paths
+// which the host doesn't mount anything else at.
+func validateTmpfs(c *host.ContainerConfig) error {
+	for _, t := range c.Tmpfs {
+		if !path.IsAbs(t.Location) || path.Clean(t.Location) != t.Location || t.Location == "/" {
+			return fmt.Errorf("invalid tmpfs location %q", t.Location)
+		}
+		for _, reserved := range []string{"/.containerinit", containerinit.SharedPath, secretsPath} {
+			if t.Location == reserved || strings.HasPrefix(t.Location, reserved+"/") {
+				return fmt.Errorf("tmpfs location %s is reserved", t.Location)
+			}
+		}
+		if t.Size < 0 {
+			return fmt.Errorf("invalid size %d for tmpfs %s", t.Size, t.Location)
+		}
+	}
+	return nil
+}
+
+// mountTmpfs mounts a private tmpfs at dir, creating dir if necessary.
+func mountTmpfs(dir string, size int64, mode uint32) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	opts := fmt.Sprintf("mode=%o", mode)
+	if size > 0 {
+		opts += fmt.Sprintf(",size=%d", size)
+	}
+	if err := syscall.Mount("tmpfs", dir, "tmpfs", tmpfsMountFlags, opts); err != nil {
+		return err
+	}
+	if err := syscall.Mount("", dir, "none", syscall.MS_PRIVATE, ""); err != nil {
+		syscall.Unmount(dir, 0)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+func TestValidateTmpfs(t *testing.T) {
+	for _, test := range []struct {
+		tmpfs host.TmpfsMount
+		valid bool
+	}{
+		{host.TmpfsMount{Location: "/tmp", Size: 64 << 20}, true},
+		{host.TmpfsMount{Location: "/var/run"}, true},
+		{host.TmpfsMount{Location: "tmp"}, false},
+		{host.TmpfsMount{Location: "/"}, false},
+		{host.TmpfsMount{Location: "/tmp/../etc"}, false},
+		{host.TmpfsMount{Location: "/run/secrets"}, false},
+		{host.TmpfsMount{Location: "/.container-shared/x"}, false},
+		{host.TmpfsMount{Location: "/tmp", Size: -1}, false},
+	} {
+		config := &host.ContainerConfig{Tmpfs: []host.TmpfsMount{test.tmpfs}}
+		if err := validateTmpfs(config); (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid to be %t, got %v", test.tmpfs, test.valid, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package host
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -9,10 +10,34 @@ type Job struct {
 
 	Metadata map[string]string
 
-	Artifact  Artifact
+	Artifact Artifact
+	// Artifacts are mounted read-only into the job at /artifacts/1,
+	// /artifacts/2 and so on.
+	Artifacts []Artifact
+
 	Resources JobResources
 
 	Config ContainerConfig
+
+	// HealthCheck, if set, is run by the host once the job is running, and
+	// the job's health is reported with "healthy" and "unhealthy" events.
+	HealthCheck *HealthCheck
+
+	// LogDrains are forwarded the job's output by the host.
+	LogDrains []LogDrain
+
+	// LogDriver selects where the host writes the job's output, it is
+	// kept in log files on the host if it is not set.
+	LogDriver LogDriver
+
+	// RegistryAuth, if set, is used to pull the job's artifacts from a
+	// private registry instead of the host's credentials.
+	RegistryAuth *RegistryAuth
+
+	// Checkpoint, if set, is the ID of a checkpoint received by the host
+	// which the job's processes are restored from instead of being started.
+	// Checkpoint/restore is experimental and must be enabled on the host.
+	Checkpoint string
 }
 
 func (j *Job) Dup() *Job {
@@ -40,6 +65,9 @@ func (j *Job) Dup() *Job {
 	job.Config.Entrypoint = dupSlice(j.Config.Entrypoint)
 	job.Config.Cmd = dupSlice(j.Config.Cmd)
 	job.Config.Env = dupMap(j.Config.Env)
+	job.Config.DNSServers = dupSlice(j.Config.DNSServers)
+	job.Config.DNSSearch = dupSlice(j.Config.DNSSearch)
+	job.Config.Hosts = dupMap(j.Config.Hosts)
 	if j.Config.Ports != nil {
 		job.Config.Ports = make([]Port, len(j.Config.Ports))
 		for i, p := range j.Config.Ports {
@@ -52,12 +80,61 @@ func (j *Job) Dup() *Job {
 			job.Config.Mounts[i] = m
 		}
 	}
+	if j.Config.Devices != nil {
+		job.Config.Devices = make([]DeviceRequest, len(j.Config.Devices))
+		for i, d := range j.Config.Devices {
+			job.Config.Devices[i] = DeviceRequest{Class: d.Class, Count: d.Count, Paths: dupSlice(d.Paths)}
+		}
+	}
+	if j.Config.Tmpfs != nil {
+		job.Config.Tmpfs = make([]TmpfsMount, len(j.Config.Tmpfs))
+		copy(job.Config.Tmpfs, j.Config.Tmpfs)
+	}
+	if j.Config.Secrets != nil {
+		job.Config.Secrets = make([]Secret, len(j.Config.Secrets))
+		for i, s := range j.Config.Secrets {
+			job.Config.Secrets[i] = Secret{Name: s.Name, Data: append([]byte(nil), s.Data...)}
+		}
+	}
+	if j.Artifacts != nil {
+		job.Artifacts = make([]Artifact, len(j.Artifacts))
+		copy(job.Artifacts, j.Artifacts)
+	}
+	if j.HealthCheck != nil {
+		check := *j.HealthCheck
+		job.HealthCheck = &check
+	}
+	if j.LogDrains != nil {
+		job.LogDrains = make([]LogDrain, len(j.LogDrains))
+		copy(job.LogDrains, j.LogDrains)
+	}
+	if j.RegistryAuth != nil {
+		auth := *j.RegistryAuth
+		job.RegistryAuth = &auth
+	}
 
 	return &job
 }
 
+// JobResources are enforced by the host with cgroups, jobs cannot use swap to
+// exceed their memory limit.
 type JobResources struct {
-	Memory int // in KiB
+	Memory    int // in KiB
+	CPUShares int // relative to 1024 for jobs without a limit
+	MaxFD     int
+	// MaxProcs and MaxCore (in bytes) are the RLIMIT_NPROC and RLIMIT_CORE
+	// of the job's processes, which inherit the host's if they are zero.
+	// RLIMIT_NPROC counts all processes of the job's user on the host and
+	// doesn't apply to root.
+	MaxProcs int
+	MaxCore  int64
+	// Disk is the quota in bytes of the job's writes to its container's
+	// filesystem, which are unlimited if it is zero.
+	Disk int64
+	// EgressRate and IngressRate limit the bits per second the job sends
+	// and receives over its network interface, they are unlimited if zero.
+	EgressRate  int64
+	IngressRate int64
 }
 
 type ContainerConfig struct {
@@ -71,23 +148,192 @@ type ContainerConfig struct {
 	Ports      []Port
 	WorkingDir string
 	Uid        int
+
+	// StopSignal is sent to the job to stop it, SIGTERM if it is zero. The
+	// job is killed with SIGKILL if it has not exited after KillTimeout,
+	// 10 seconds if it is zero.
+	StopSignal  int
+	KillTimeout time.Duration
+
+	// Secrets are written by the host to files in an in-memory filesystem
+	// mounted read-only at /run/secrets, so unlike Env they are not
+	// visible in /proc/<pid>/environ or inherited by child processes.
+	Secrets []Secret
+
+	// DNSServers and DNSSearch replace the nameservers and search domains
+	// of the host's resolv.conf in the job's container, and Hosts maps
+	// extra hostnames to IP addresses in its /etc/hosts.
+	DNSServers []string
+	DNSSearch  []string
+	Hosts      map[string]string
+
+	// Devices are claimed from the host for the job's exclusive use and
+	// passed through to its container.
+	Devices []DeviceRequest
+
+	// Seccomp and AppArmor select the profiles the job's processes are
+	// confined by, "default" for the host's default profiles, "unconfined"
+	// or the name of a custom profile shipped to the host. Jobs are
+	// unconfined if they are not set.
+	Seccomp  string
+	AppArmor string
+
+	// ReadOnlyRoot mounts the job's root filesystem read-only, so it can
+	// only write to its mounts and Tmpfs.
+	ReadOnlyRoot bool
+
+	// Tmpfs are in-memory filesystems mounted in the job's container.
+	Tmpfs []TmpfsMount
+}
+
+// TmpfsMount is an in-memory filesystem mounted at Location which any user
+// can write to. Its pages count towards the job's memory limit, and it can
+// grow to half of the host's memory if Size (in bytes) is zero.
+type TmpfsMount struct {
+	Location string
+	Size     int64
+}
+
+// DeviceRequest claims Count of the host's devices of Class, for example
+// "gpu". The host fills in Paths with the device files it passes through to
+// the job, which include the devices of the class shared by all jobs.
+type DeviceRequest struct {
+	Class string
+	Count int
+	Paths []string
+}
+
+// Secret is written to /run/secrets/<Name> in the job's container, readable
+// only by the job's user. Name must not contain slashes or start with a dot.
+type Secret struct {
+	Name string
+	Data []byte
 }
 
 type Port struct {
 	Port     int
 	Proto    string
 	RangeEnd int
+
+	// HostPort, if set, is the port on the host which is forwarded to Port
+	// in the job, rather than the same port. It can't be set for ranges
+	// of ports. Hosts fill it in with the first port they forward.
+	HostPort int
+}
+
+// LogDrain is a syslog://, syslog+tls:// or https:// URL which the output of
+// a job is sent to as RFC 5424 syslog messages. Username and Password are
+// sent as the basic auth of https drains.
+type LogDrain struct {
+	URL      string
+	Username string
+	Password string
+}
+
+// Log drivers, only the output of jobs using the logbuf driver is kept on the
+// host, so it is the only driver whose output can be attached to and
+// forwarded to log drains.
+const (
+	LogDriverLogbuf   = "logbuf"
+	LogDriverJournald = "journald"
+	LogDriverNull     = "null"
+	LogDriverRemote   = "remote"
+)
+
+// LogDriver is where a host writes the output of a job. The remote driver
+// sends each line to URL as a syslog message, like a log drain.
+type LogDriver struct {
+	Name string
+	URL  string
+}
+
+// HealthCheck checks a job by connecting to its first port.
+type HealthCheck struct {
+	// Type is "tcp" or "http".
+	Type string
+	// Path is the path requested by http checks.
+	Path string
+
+	Interval    time.Duration
+	GracePeriod time.Duration
+
+	// Failures is the number of checks in a row which must fail before a
+	// healthy job is marked unhealthy, the host's default is used if it
+	// is zero.
+	Failures int
+	// RestartAfter, if set, is the number of checks in a row which can
+	// fail before the host stops the job so that it is restarted.
+	RestartAfter int
+
+	// Service, if set, is the discoverd service the job is registered
+	// with by the host while it is healthy.
+	Service string
 }
 
 type Mount struct {
 	Location  string
 	Target    string
 	Writeable bool
+
+	// VolumeID, if set, is the ID of a volume on the host which is
+	// mounted at Location, Target is set to its path by the host.
+	VolumeID string
+}
+
+// Volume is storage on a host which is kept when the jobs it is mounted into
+// stop, so that it can be mounted into the jobs which replace them.
+type Volume struct {
+	ID string
+	// Type is "zfs" for ZFS datasets and "dir" for plain directories.
+	Type      string
+	Path      string
+	CreatedAt time.Time
+
+	Snapshots []VolumeSnapshot
+}
+
+// VolumeTypeHeader is the HTTP header with the type of the volume data sent
+// by a host, which can only be received by hosts with the same type of
+// volumes.
+const VolumeTypeHeader = "Flynn-Volume-Type"
+
+// VolumeSnapshot is a read-only copy of the data of a volume at a point in
+// time, which can be sent to other hosts.
+type VolumeSnapshot struct {
+	ID        string
+	CreatedAt time.Time
+}
+
+// Checkpoint is a checkpoint of a job's processes received by a host, the job
+// is restored by running it on the host with Job.Checkpoint set to the ID.
+type Checkpoint struct {
+	ID        string
+	Job       *Job
+	CreatedAt time.Time
+}
+
+// RegistryAuth are the credentials used to pull docker images from a private
+// registry.
+type RegistryAuth struct {
+	// Registry is the host of the registry in artifact URIs, credentials
+	// without a registry are used for every registry.
+	Registry string
+	Username string
+	Password string
+
+	// TokenURL, if set, is where the username and password are exchanged
+	// for a short lived token, which images are pulled with instead of
+	// the password. The token is requested again when it expires.
+	TokenURL string
 }
 
 type Artifact struct {
 	URI  string
 	Type string
+
+	// SHA256 is the expected ID of the pulled image, it is not verified if
+	// empty.
+	SHA256 string
 }
 
 type Host struct {
@@ -95,6 +341,125 @@ type Host struct {
 
 	Jobs     []*Job
 	Metadata map[string]string
+
+	// Draining hosts don't accept new jobs, schedulers move their jobs to
+	// other hosts.
+	Draining bool
+
+	// Resources are reserved by the limits of the host's jobs, the cluster
+	// leader doesn't add jobs to a host whose resources are reserved.
+	Resources HostResources
+}
+
+// HostResources are the memory and CPU of a host. Resources which are zero
+// are not accounted for.
+type HostResources struct {
+	Memory    int // in KiB
+	CPUShares int // 1024 per CPU
+
+	// Overcommit is how many times the resources can be reserved by job
+	// limits, 1 if it is zero.
+	Overcommit float64
+
+	// Devices is the number of devices of each class the host can pass
+	// through to jobs, which are never overcommitted.
+	Devices map[string]int
+}
+
+// Available returns how much of a resource of which the host has total can
+// be reserved.
+func (r HostResources) Available(total int) int {
+	overcommit := r.Overcommit
+	if overcommit <= 0 {
+		overcommit = 1
+	}
+	return int(float64(total) * overcommit)
+}
+
+// Reserved returns the resources reserved by the limits of the host's jobs.
+func (h *Host) Reserved() JobResources {
+	var r JobResources
+	for _, job := range h.Jobs {
+		r.Memory += job.Resources.Memory
+		r.CPUShares += job.Resources.CPUShares
+	}
+	return r
+}
+
+// ReservedDevices returns the number of devices of each class claimed by the
+// host's jobs.
+func (h *Host) ReservedDevices() map[string]int {
+	r := make(map[string]int)
+	for _, job := range h.Jobs {
+		for _, d := range job.Config.Devices {
+			r[d.Class] += d.Count
+		}
+	}
+	return r
+}
+
+// CheckResources returns a ResourceError if the limits of the host's jobs
+// reserve more memory or CPU than the host has available, or its jobs claim
+// more devices of a class than it has.
+func (h *Host) CheckResources() error {
+	reserved := h.Reserved()
+	if h.Resources.Memory > 0 {
+		if available := h.Resources.Available(h.Resources.Memory); reserved.Memory > available {
+			return &ResourceError{HostID: h.ID, Resource: "memory", Requested: reserved.Memory, Available: available}
+		}
+	}
+	if h.Resources.CPUShares > 0 {
+		if available := h.Resources.Available(h.Resources.CPUShares); reserved.CPUShares > available {
+			return &ResourceError{HostID: h.ID, Resource: "cpu", Requested: reserved.CPUShares, Available: available}
+		}
+	}
+	for class, n := range h.ReservedDevices() {
+		if available := h.Resources.Devices[class]; n > available {
+			return &ResourceError{HostID: h.ID, Resource: class, Requested: n, Available: available}
+		}
+	}
+	return nil
+}
+
+// ResourceError is returned when adding jobs to a host would reserve more of
+// a resource than the host has available.
+type ResourceError struct {
+	HostID   string
+	Resource string // "memory", "cpu" or a device class
+	// Requested is the amount reserved by the host's jobs including the
+	// jobs being added, in KiB for memory, shares for CPU and a count for
+	// devices.
+	Requested int
+	Available int
+}
+
+func (e *ResourceError) Error() string {
+	return fmt.Sprintf(resourceErrorFormat, e.HostID, e.Resource, e.Requested, e.Available)
+}
+
+const resourceErrorFormat = "host %s has insufficient %s (%d requested, %d available)"
+
+// ParseResourceError returns the ResourceError which has msg as its message,
+// so that it can be recovered from errors returned over RPC.
+func ParseResourceError(msg string) (*ResourceError, bool) {
+	e := &ResourceError{}
+	if n, _ := fmt.Sscanf(msg, resourceErrorFormat, &e.HostID, &e.Resource, &e.Requested, &e.Available); n != 4 {
+		return nil, false
+	}
+	return e, true
+}
+
+// DrainStatus is the progress of draining a host, which is complete once
+// Jobs is empty.
+type DrainStatus struct {
+	Draining bool
+
+	// Jobs are the IDs of the jobs still running on the host.
+	Jobs []string
+	// VolumeJobs are the IDs of the running jobs with volumes, they are
+	// not moved to other hosts so must be stopped once their data has
+	// been moved.
+	VolumeJobs []string
 }
 
 type AddJobsReq struct {
@@ -129,6 +494,83 @@ type ActiveJob struct {
 	ExitStatus  int
 	Error       *string
 	ManifestID  string
+
+	// Healthy is set when the job's health check passes, and cleared when
+	// it fails.
+	Healthy bool
+
+	// OOMKilled is set when the job runs out of memory and the kernel kills
+	// one of its processes, which is reported with an "oom" event.
+	OOMKilled bool
+
+	// ForceKilled is set when the job is stopped but does not exit within
+	// its KillTimeout of being sent its StopSignal, so it is killed with
+	// SIGKILL rather than shutting down gracefully.
+	ForceKilled bool
+
+	// HealthKilled is set when the job is stopped because it failed too
+	// many health checks, it is then failed when it exits so that it is
+	// restarted like a job which crashed.
+	HealthKilled bool
+}
+
+// JobStats is the resource usage of a running job, read from its cgroups.
+// The counters are totals since the job started, so rates are calculated
+// from the difference between two JobStats.
+type JobStats struct {
+	JobID string
+	Time  time.Time
+
+	CPU     CPUStats
+	Memory  MemoryStats
+	Network NetworkStats
+	BlockIO BlockIOStats
+	Disk    DiskStats
+}
+
+type CPUStats struct {
+	// UsageNanoseconds is the CPU time used by the job, which is split
+	// between user and kernel time in UserNanoseconds and
+	// SystemNanoseconds at a lower resolution.
+	UsageNanoseconds  uint64
+	UserNanoseconds   uint64
+	SystemNanoseconds uint64
+}
+
+type MemoryStats struct {
+	// Usage includes the page cache, which the kernel reclaims before the
+	// job runs out of memory, RSS does not.
+	Usage    uint64
+	MaxUsage uint64
+	Limit    uint64
+	RSS      uint64
+	Cache    uint64
+}
+
+type NetworkStats struct {
+	RxBytes   uint64
+	RxPackets uint64
+	TxBytes   uint64
+	TxPackets uint64
+}
+
+// DiskStats are the bytes written to the job's container's filesystem, they
+// are only reported for jobs with a disk quota.
+type DiskStats struct {
+	Usage uint64
+	Limit uint64
+}
+
+type BlockIOStats struct {
+	ReadBytes  uint64
+	WriteBytes uint64
+	ReadOps    uint64
+	WriteOps   uint64
+}
+
+type SignalReq struct {
+	JobID  string
+	Signal int
 }
 
 type AttachReq struct {
@@ -138,6 +580,17 @@ type AttachReq struct {
 	Width  uint16
 }
 
+// ExecReq is a request to run a command in the container of a running job,
+// the command's streams are attached using the attach protocol.
+type ExecReq struct {
+	Cmd    []string
+	Env    map[string]string
+	TTY    bool
+	Stdin  bool
+	Height uint16
+	Width  uint16
+}
+
 type AttachFlag uint8
 
 const (
@@ -146,6 +599,11 @@ const (
 	AttachFlagStdin
 	AttachFlagLogs
 	AttachFlagStream
+
+	// AttachFlagTimestamps requests that output from both stdout and stderr
+	// is sent on the stdout stream as JSON encoded logbuf.Data records, which
+	// carry the stream and time of each write.
+	AttachFlagTimestamps
 )
 
 type JobStatus uint8
@@ -168,6 +626,16 @@ const (
 	StatusFailed
 )
 
+// The attach protocol starts with a byte from the host which is one of
+// AttachSuccess, AttachWaiting (followed by another state byte once the job
+// starts) or AttachError (followed by a uint32 length and the error). Then
+// frames are sent in both directions, with big-endian integers:
+//
+//	AttachData:   stream byte (0 stdin, 1 stdout, 2 stderr), uint32 length,
+//	              data; a zero length closes the stream
+//	AttachSignal: uint32 signal for the host to send to the job
+//	AttachResize: uint16 height, uint16 width of the job's TTY
+//	AttachExit:   uint32 exit status, sent by the host when the job exits
 const (
 	AttachSuccess byte = iota
 	AttachWaiting
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/technoweenie/grohl"
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/random"
+)
+
+var (
+	errVolumeNotFound   = errors.New("volume: not found")
+	errVolumeInUse      = errors.New("volume: in use by a running job")
+	errSnapshotNotFound = errors.New("volume: snapshot not found")
+)
+
+// volumeProvider creates and destroys the storage of volumes, and copies
+// their data between hosts. Data written by Send can be read by Receive on
+// hosts with the same type of provider.
+type volumeProvider interface {
+	Type() string
+	Create(id string) (path string, err error)
+	Destroy(v *host.Volume) error
+	Snapshot(v *host.Volume, snapshotID string) error
+	// Send writes the data of a snapshot of the volume to w, or of the
+	// volume itself if snapshotID is empty.
+	Send(v *host.Volume, snapshotID string, w io.Writer) error
+	Receive(id string, r io.Reader) (path string, err error)
+}
+
+// dirVolumes are directories in root, which are sent as tar streams. Their
+// snapshots are tar files.
+type dirVolumes struct {
+	root string
+}
+
+func (p *dirVolumes) Type() string { return "dir" }
+
+func (p *dirVolumes) Create(id string) (string, error) {
+	path := filepath.Join(p.root, id)
+	if err := os.MkdirAll(p.root, 0755); err != nil {
+		return "", err
+	}
+	return path, os.Mkdir(path, 0755)
+}
+
+func (p *dirVolumes) Destroy(v *host.Volume) error {
+	if err := os.RemoveAll(p.snapshotDir(v)); err != nil {
+		return err
+	}
+	return os.RemoveAll(v.Path)
+}
+
+func (p *dirVolumes) snapshotDir(v *host.Volume) string {
+	return filepath.Join(p.root, ".snapshots", v.ID)
+}
+
+func (p *dirVolumes) Snapshot(v *host.Volume, snapshotID string) error {
+	dir := p.snapshotDir(v)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, snapshotID+".tar")
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = tarDir(v.Path, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (p *dirVolumes) Send(v *host.Volume, snapshotID string, w io.Writer) error {
+	if snapshotID == "" {
+		return tarDir(v.Path, w)
+	}
+	f, err := os.Open(filepath.Join(p.snapshotDir(v), snapshotID+".tar"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (p *dirVolumes) Receive(id string, r io.Reader) (string, error) {
+	path, err := p.Create(id)
+	if err != nil {
+		return "", err
+	}
+	if err := untarDir(path, r); err != nil {
+		os.RemoveAll(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// zfsVolumes are ZFS datasets which are children of dataset, mounted in
+// root.
+type zfsVolumes struct {
+	dataset string
+	root    string
+}
+
+func (p *zfsVolumes) Type() string { return "zfs" }
+
+func (p *zfsVolumes) Create(id string) (string, error) {
+	path := filepath.Join(p.root, id)
+	return path, zfs("create", "-o", "mountpoint="+path, p.dataset+"/"+id)
+}
+
+func (p *zfsVolumes) Destroy(v *host.Volume) error {
+	return zfs("destroy", "-r", p.dataset+"/"+v.ID)
+}
+
+func (p *zfsVolumes) Snapshot(v *host.Volume, snapshotID string) error {
+	return zfs("snapshot", p.dataset+"/"+v.ID+"@"+snapshotID)
+}
+
+// Send sends a ZFS stream of the snapshot, volumes are sent by sending a
+// temporary snapshot.
+func (p *zfsVolumes) Send(v *host.Volume, snapshotID string, w io.Writer) error {
+	if snapshotID == "" {
+		snapshotID = "send-" + random.UUID()
+		if err := p.Snapshot(v, snapshotID); err != nil {
+			return err
+		}
+		defer zfs("destroy", p.dataset+"/"+v.ID+"@"+snapshotID)
+	}
+	cmd := exec.Command("zfs", "send", p.dataset+"/"+v.ID+"@"+snapshotID)
+	cmd.Stdout = w
+	return runZFS(cmd)
+}
+
+func (p *zfsVolumes) Receive(id string, r io.Reader) (string, error) {
+	path := filepath.Join(p.root, id)
+	cmd := exec.Command("zfs", "receive", p.dataset+"/"+id)
+	cmd.Stdin = r
+	if err := runZFS(cmd); err != nil {
+		return "", err
+	}
+	if err := zfs("set", "mountpoint="+path, p.dataset+"/"+id); err != nil {
+		zfs("destroy", "-r", p.dataset+"/"+id)
+		return "", err
+	}
+	return path, nil
+}
+
+func zfs(args ...string) error {
+	return runZFS(exec.Command("zfs", args...))
+}
+
+// runZFS runs a zfs command, including its error output in the error.
+func runZFS(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	if cmd.Stdout == nil {
+		cmd.Stdout = &stderr
+	}
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("zfs %s: %s: %s", cmd.Args[1], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// volumeManager keeps track of the volumes on the host, which are saved to
+// file so that they are known after the host restarts.
+type volumeManager struct {
+	provider volumeProvider
+	state    *State
+	file     string
+
+	mtx     sync.RWMutex
+	volumes map[string]*host.Volume
+}
+
+func newVolumeManager(file string, provider volumeProvider, state *State) (*volumeManager, error) {
+	m := &volumeManager{
+		provider: provider,
+		state:    state,
+		file:     file,
+		volumes:  make(map[string]*host.Volume),
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m.volumes); err != nil {
+		return nil, fmt.Errorf("volume: could not read %s: %s", file, err)
+	}
+	return m, nil
+}
+
+func (m *volumeManager) Create() (*host.Volume, error) {
+	id := random.UUID()
+	path, err := m.provider.Create(id)
+	if err != nil {
+		return nil, err
+	}
+	v := &host.Volume{ID: id, Type: m.provider.Type(), Path: path, CreatedAt: time.Now().UTC()}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.volumes[id] = v
+	if err := m.persist(); err != nil {
+		delete(m.volumes, id)
+		m.provider.Destroy(v)
+		return nil, err
+	}
+	return copyVolume(v), nil
+}
+
+func (m *volumeManager) Get(id string) (*host.Volume, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	v, ok := m.volumes[id]
+	if !ok {
+		return nil, errVolumeNotFound
+	}
+	return copyVolume(v), nil
+}
+
+// copyVolume copies a volume so that it can be used without holding mtx.
+func copyVolume(v *host.Volume) *host.Volume {
+	volume := *v
+	volume.Snapshots = append([]host.VolumeSnapshot(nil), v.Snapshots...)
+	return &volume
+}
+
+type sortVolumes []*host.Volume
+
+func (s sortVolumes) Len() int           { return len(s) }
+func (s sortVolumes) Less(i, j int) bool { return s[i].CreatedAt.Before(s[j].CreatedAt) }
+func (s sortVolumes) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// List returns the volumes, oldest first.
+func (m *volumeManager) List() []*host.Volume {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	volumes := make(sortVolumes, 0, len(m.volumes))
+	for _, v := range m.volumes {
+		volumes = append(volumes, copyVolume(v))
+	}
+	sort.Sort(volumes)
+	return volumes
+}
+
+// Snapshot copies the current data of a volume into a new snapshot.
+func (m *volumeManager) Snapshot(id string) (*host.VolumeSnapshot, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	v, ok := m.volumes[id]
+	if !ok {
+		return nil, errVolumeNotFound
+	}
+	snapshot := host.VolumeSnapshot{ID: random.UUID(), CreatedAt: time.Now().UTC()}
+	if err := m.provider.Snapshot(v, snapshot.ID); err != nil {
+		return nil, err
+	}
+	v.Snapshots = append(v.Snapshots, snapshot)
+	if err := m.persist(); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// Send writes the data of a snapshot of a volume, or of the volume itself
+// if snapshotID is empty, to w.
+func (m *volumeManager) Send(id, snapshotID string, w io.Writer) error {
+	v, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	if snapshotID != "" && !hasSnapshot(v, snapshotID) {
+		return errSnapshotNotFound
+	}
+	return m.provider.Send(v, snapshotID, w)
+}
+
+func hasSnapshot(v *host.Volume, snapshotID string) bool {
+	for _, s := range v.Snapshots {
+		if s.ID == snapshotID {
+			return true
+		}
+	}
+	return false
+}
+
+// Receive creates a volume from the data sent by another host, which must
+// have the same type of volumes.
+func (m *volumeManager) Receive(typ string, r io.Reader) (*host.Volume, error) {
+	if typ != m.provider.Type() {
+		return nil, volumeTypeError{typ, m.provider.Type()}
+	}
+	id := random.UUID()
+	path, err := m.provider.Receive(id, r)
+	if err != nil {
+		return nil, err
+	}
+	v := &host.Volume{ID: id, Type: typ, Path: path, CreatedAt: time.Now().UTC()}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.volumes[id] = v
+	if err := m.persist(); err != nil {
+		delete(m.volumes, id)
+		m.provider.Destroy(v)
+		return nil, err
+	}
+	return copyVolume(v), nil
+}
+
+type volumeTypeError struct {
+	typ, expected string
+}
+
+func (e volumeTypeError) Error() string {
+	return fmt.Sprintf("volume: cannot receive a %q volume on a host with %q volumes", e.typ, e.expected)
+}
+
+// Destroy deletes a volume and its data, volumes which are mounted into a
+// running job cannot be destroyed.
+func (m *volumeManager) Destroy(id string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	v, ok := m.volumes[id]
+	if !ok {
+		return errVolumeNotFound
+	}
+	for _, job := range m.state.Get() {
+		if job.Status != host.StatusStarting && job.Status != host.StatusRunning {
+			continue
+		}
+		for _, mount := range job.Job.Config.Mounts {
+			if mount.VolumeID == id {
+				return errVolumeInUse
+			}
+		}
+	}
+	if err := m.provider.Destroy(v); err != nil {
+		return err
+	}
+	delete(m.volumes, id)
+	return m.persist()
+}
+
+// Attach sets the target of the job's volume mounts to the paths of their
+// volumes.
+func (m *volumeManager) Attach(job *host.Job) error {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	for i, mount := range job.Config.Mounts {
+		if mount.VolumeID == "" {
+			continue
+		}
+		v, ok := m.volumes[mount.VolumeID]
+		if !ok {
+			return fmt.Errorf("volume: unknown volume %s mounted at %s", mount.VolumeID, mount.Location)
+		}
+		job.Config.Mounts[i].Target = v.Path
+	}
+	return nil
+}
+
+// persist writes the volumes to a temporary file which is renamed over the
+// old one, so that the file is never partially written. It must be called
+// with mtx held.
+func (m *volumeManager) persist() error {
+	data, err := json.Marshal(m.volumes)
+	if err != nil {
+		return err
+	}
+	tmp := m.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.file)
+}
+
+// volumeHandler serves the volume API:
+//
+//	GET    /volumes                    lists the volumes
+//	POST   /volumes                    creates a volume
+//	POST   /volumes/receive            creates a volume from sent data
+//	GET    /volumes/:id                gets a volume
+//	DELETE /volumes/:id                destroys a volume
+//	POST   /volumes/:id/snapshots      snapshots a volume
+//	GET    /volumes/:id/send?snapshot= sends the data of a volume or snapshot
+type volumeHandler struct {
+	volumes *volumeManager
+}
+
+func (h *volumeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/volumes"), "/")
+	var id, action string
+	if parts := strings.SplitN(path, "/", 2); len(parts) == 2 {
+		id, action = parts[0], parts[1]
+	} else {
+		id = parts[0]
+	}
+
+	switch {
+	case id == "" && req.Method == "GET":
+		writeJSON(w, 200, h.volumes.List())
+	case id == "" && req.Method == "POST":
+		v, err := h.volumes.Create()
+		if err != nil {
+			writeVolumeError(w, err)
+			return
+		}
+		writeJSON(w, 200, v)
+	case id == "receive" && action == "" && req.Method == "POST":
+		v, err := h.volumes.Receive(req.Header.Get(host.VolumeTypeHeader), req.Body)
+		if err != nil {
+			writeVolumeError(w, err)
+			return
+		}
+		writeJSON(w, 200, v)
+	case action == "" && req.Method == "GET":
+		v, err := h.volumes.Get(id)
+		if err != nil {
+			writeVolumeError(w, err)
+			return
+		}
+		writeJSON(w, 200, v)
+	case action == "" && req.Method == "DELETE":
+		if err := h.volumes.Destroy(id); err != nil {
+			writeVolumeError(w, err)
+			return
+		}
+		w.WriteHeader(200)
+	case action == "snapshots" && req.Method == "POST":
+		snapshot, err := h.volumes.Snapshot(id)
+		if err != nil {
+			writeVolumeError(w, err)
+			return
+		}
+		writeJSON(w, 200, snapshot)
+	case action == "send" && req.Method == "GET":
+		h.send(w, id, req.FormValue("snapshot"))
+	default:
+		http.Error(w, "not found", 404)
+	}
+}
+
+// send streams the data of a volume. Errors after the data has started are
+// reported by closing the connection, so that the receiver sees a
+// truncated stream.
+func (h *volumeHandler) send(w http.ResponseWriter, id, snapshotID string) {
+	v, err := h.volumes.Get(id)
+	if err == nil && snapshotID != "" && !hasSnapshot(v, snapshotID) {
+		err = errSnapshotNotFound
+	}
+	if err != nil {
+		writeVolumeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(host.VolumeTypeHeader, v.Type)
+	w.WriteHeader(200)
+	if err := h.volumes.Send(id, snapshotID, w); err != nil {
+		grohl.Log(grohl.Data{"fn": "send_volume", "volume.id": id, "status": "error", "err": err})
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+			}
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeVolumeError(w http.ResponseWriter, err error) {
+	switch err {
+	case errVolumeNotFound, errSnapshotNotFound:
+		http.Error(w, err.Error(), 404)
+	case errVolumeInUse:
+		http.Error(w, err.Error(), 409)
+	default:
+		if _, ok := err.(volumeTypeError); ok {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		http.Error(w, err.Error(), 500)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+)
+
+func TestVolumeManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flynn-host-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "volumes.json")
+	state := NewState("host0")
+	m, err := newVolumeManager(file, &dirVolumes{root: filepath.Join(dir, "volumes")}, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := m.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Type != "dir" {
+		t.Errorf("expected a dir volume, got %s", v.Type)
+	}
+	if err := ioutil.WriteFile(filepath.Join(v.Path, "data"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the volume's path is mounted into jobs
+	job := &host.Job{ID: "a", Config: host.ContainerConfig{Mounts: []host.Mount{
+		{Location: "/data", VolumeID: v.ID, Writeable: true},
+		{Location: "/tmp"},
+	}}}
+	if err := m.Attach(job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Config.Mounts[0].Target != v.Path || job.Config.Mounts[1].Target != "" {
+		t.Errorf("unexpected mounts %+v", job.Config.Mounts)
+	}
+	if err := m.Attach(&host.Job{Config: host.ContainerConfig{Mounts: []host.Mount{{VolumeID: "b"}}}}); err == nil {
+		t.Error("expected an error attaching an unknown volume")
+	}
+
+	// the volumes are loaded when the host restarts
+	m, err = newVolumeManager(file, m.provider, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if volumes := m.List(); len(volumes) != 1 || volumes[0].ID != v.ID {
+		t.Fatalf("expected the volume to be listed, got %+v", volumes)
+	}
+
+	// volumes can't be destroyed while a job is using them
+	state.AddJob(job)
+	if err := m.Destroy(v.ID); err != errVolumeInUse {
+		t.Errorf("expected errVolumeInUse, got %v", err)
+	}
+	state.SetStatusDone(job.ID, 0)
+	if err := m.Destroy(v.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(v.Path); !os.IsNotExist(err) {
+		t.Errorf("expected the volume's data to be deleted, got %v", err)
+	}
+	if _, err := m.Get(v.ID); err != errVolumeNotFound {
+		t.Errorf("expected errVolumeNotFound, got %v", err)
+	}
+}
+
+func TestVolumeAPI(t *testing.T) {
+	client, cleanup := newTestVolumeHost(t, nil)
+	defer cleanup()
+
+	v, err := client.CreateVolume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumes, err := client.ListVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 || volumes[0].ID != v.ID || volumes[0].Path != v.Path {
+		t.Errorf("unexpected volumes %+v", volumes)
+	}
+	if err := client.DestroyVolume(v.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.DestroyVolume(v.ID); err != cluster.ErrVolumeNotFound {
+		t.Errorf("expected ErrVolumeNotFound, got %v", err)
+	}
+}
+
+func newTestVolumeHost(t *testing.T, provider volumeProvider) (cluster.Host, func()) {
+	dir, err := ioutil.TempDir("", "flynn-host-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider == nil {
+		provider = &dirVolumes{root: filepath.Join(dir, "volumes")}
+	}
+	m, err := newVolumeManager(filepath.Join(dir, "volumes.json"), provider, NewState("host0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	h := &volumeHandler{volumes: m}
+	mux.Handle("/volumes", h)
+	mux.Handle("/volumes/", h)
+	srv := httptest.NewServer(mux)
+	return cluster.NewHostClient(srv.Listener.Addr().String(), nil, nil), func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// zfsTypeVolumes are directories which claim to be zfs volumes.
+type zfsTypeVolumes struct {
+	dirVolumes
+}
+
+func (zfsTypeVolumes) Type() string { return "zfs" }
+
+func TestVolumeMigrate(t *testing.T) {
+	src, cleanup := newTestVolumeHost(t, nil)
+	defer cleanup()
+	dst, cleanup := newTestVolumeHost(t, nil)
+	defer cleanup()
+
+	v, err := src.CreateVolume()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(v.Path, "data"), []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := cluster.MigrateVolume(src, dst, v.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated.ID == v.ID || migrated.Type != "dir" {
+		t.Errorf("unexpected volume %+v", migrated)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(migrated.Path, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "1" {
+		t.Errorf("expected the data to be migrated, got %q", data)
+	}
+
+	// snapshots are not changed by later writes
+	snapshot, err := src.SnapshotVolume(v.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(v.Path, "data"), []byte("2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := src.SendVolume(v.ID, snapshot.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := dst.ReceiveVolume(stream)
+	stream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(received.Path, "data")); string(data) != "1" {
+		t.Errorf("expected the snapshot's data, got %q", data)
+	}
+	if _, err := src.SendVolume(v.ID, "missing"); err != cluster.ErrVolumeNotFound {
+		t.Errorf("expected ErrVolumeNotFound sending a missing snapshot, got %v", err)
+	}
+
+	// volumes can only be received by hosts with the same type of volumes
+	zfsDir, err := ioutil.TempDir("", "flynn-host-volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(zfsDir)
+	zfsHost, cleanup := newTestVolumeHost(t, &zfsTypeVolumes{dirVolumes{root: zfsDir}})
+	defer cleanup()
+	if _, err := cluster.MigrateVolume(src, zfsHost, v.ID); err == nil {
+		t.Error("expected an error migrating a dir volume to a zfs host")
+	}
+}
@@ -14,6 +14,7 @@ import (
 type Context struct {
 	*store.Store
 	driver graphdriver.Driver
+	root   string
 	json   bool
 }
 
@@ -24,7 +25,7 @@ func (c *Context) Pull(url string) {
 	}
 
 	if id := ref.ImageID(); id != "" && c.Exists(id) {
-		c.writeLayerInfo(id, "exists")
+		c.writeLayerInfo(id, "exists", c.layerSize(id))
 		return
 	}
 
@@ -41,7 +42,7 @@ func (c *Context) Pull(url string) {
 	for i := len(layers) - 1; i >= 0; i-- {
 		layer := layers[i]
 		if c.Exists(layer.ID) {
-			c.writeLayerInfo(layer.ID, "exists")
+			c.writeLayerInfo(layer.ID, "exists", c.layerSize(layer.ID))
 			continue
 		}
 
@@ -56,28 +57,45 @@ func (c *Context) Pull(url string) {
 				log.Fatal(err)
 			}
 		}
-		c.writeLayerInfo(layer.ID, status)
+		c.writeLayerInfo(layer.ID, status, layer.Size)
 	}
 
 	// TODO: update sizes
 }
 
-func (c *Context) writeLayerInfo(id, status string) {
+func (c *Context) writeLayerInfo(id, status string, size int64) {
 	if c.json {
 		json.NewEncoder(os.Stdout).Encode(struct {
 			ID     string `json:"id"`
 			Status string `json:"status"`
-		}{id, status})
+			Size   int64  `json:"size"`
+		}{id, status, size})
 	} else {
 		fmt.Println(id, status)
 	}
 }
 
-func (c *Context) Checkout(id, imageID string) {
+// layerSize returns the size of a pulled layer as reported by the registry,
+// or zero if it is unknown.
+func (c *Context) layerSize(id string) int64 {
+	img, err := c.Get(id)
+	if err != nil {
+		return 0
+	}
+	return img.Size
+}
+
+func (c *Context) Checkout(id, imageID string, quota int64) {
 	id = "tmp-" + id
 	if err := c.driver.Create(id, imageID); err != nil {
 		log.Fatal(err)
 	}
+	if quota > 0 {
+		if err := c.setQuota(id, quota); err != nil {
+			c.driver.Remove(id)
+			log.Fatal(err)
+		}
+	}
 	path, err := c.driver.Get(id, "")
 	if err != nil {
 		log.Fatal(err)
@@ -86,7 +104,27 @@ func (c *Context) Checkout(id, imageID string) {
 }
 
 func (c *Context) Cleanup(id string) {
-	if err := c.driver.Remove("tmp-" + id); err != nil {
+	id = "tmp-" + id
+	if err := c.clearQuota(id); err != nil {
+		// a stale quota doesn't limit anything once the checkout's files
+		// are removed, so the checkout is removed regardless
+		log.Print(err)
+	}
+	if err := c.driver.Remove(id); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (c *Context) Usage(id string) {
+	usage, limit, err := c.diskUsage("tmp-" + id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(usage, limit)
+}
+
+func (c *Context) Delete(imageID string) {
+	if err := c.Remove(imageID); err != nil {
 		log.Fatal(err)
 	}
 }
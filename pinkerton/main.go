@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"strconv"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/daemon/graphdriver"
 	_ "github.com/flynn/flynn/Godeps/_workspace/src/github.com/docker/docker/daemon/graphdriver/aufs"
@@ -21,27 +22,35 @@ func main() {
 
 Usage:
   pinkerton pull [options] <image-url>
-  pinkerton checkout [options] <id> <image-id>
+  pinkerton checkout [options] [--quota=<bytes>] <id> <image-id>
   pinkerton cleanup [options] <id>
+  pinkerton usage [options] <id>
+  pinkerton delete [options] <image-id>
   pinkerton -h | --help
 
 Commands:
   pull      Download a Docker image
   checkout  Create a working copy of an image
   cleanup   Destroy a working copy of an image
+  usage     Print the bytes written to a working copy with a quota, and the quota
+  delete    Delete a downloaded image layer which no other layer is based on
 
 Examples:
   pinkerton pull https://registry.hub.docker.com/redis
   pinkerton pull https://registry.hub.docker.com/ubuntu?tag=trusty
   pinkerton pull https://registry.hub.docker.com/flynn/slugrunner?id=1443bd6a675b959693a1a4021d660bebbdbff688d00c65ff057c46702e4b8933
   pinkerton checkout slugrunner-test 1443bd6a675b959693a1a4021d660bebbdbff688d00c65ff057c46702e4b8933
+  pinkerton checkout --quota=1073741824 slugrunner-test 1443bd6a675b959693a1a4021d660bebbdbff688d00c65ff057c46702e4b8933
   pinkerton cleanup slugrunner-test
+  pinkerton delete 1443bd6a675b959693a1a4021d660bebbdbff688d00c65ff057c46702e4b8933
 
 Options:
   -h, --help       show this message and exit
   --driver=<name>  storage driver [default: aufs]
   --root=<path>    storage root [default: /var/lib/docker]
   --json           emit json-formatted output
+  --quota=<bytes>  limit the size of the files written to the working copy,
+                   using btrfs qgroups or XFS project quotas [default: 0]
 `
 
 	args, _ := docopt.Parse(usage, nil, true, "", false)
@@ -56,14 +65,22 @@ Options:
 	if err != nil {
 		log.Fatal(err)
 	}
-	ctx := &Context{Store: s, driver: driver, json: args.Bool["--json"]}
+	ctx := &Context{Store: s, driver: driver, root: root, json: args.Bool["--json"]}
 
 	switch {
 	case args.Bool["pull"]:
 		ctx.Pull(args.String["<image-url>"])
 	case args.Bool["checkout"]:
-		ctx.Checkout(args.String["<id>"], args.String["<image-id>"])
+		quota, err := strconv.ParseInt(args.String["--quota"], 10, 64)
+		if err != nil {
+			log.Fatalf("invalid --quota %q", args.String["--quota"])
+		}
+		ctx.Checkout(args.String["<id>"], args.String["<image-id>"], quota)
 	case args.Bool["cleanup"]:
 		ctx.Cleanup(args.String["<id>"])
+	case args.Bool["usage"]:
+		ctx.Usage(args.String["<id>"])
+	case args.Bool["delete"]:
+		ctx.Delete(args.String["<image-id>"])
 	}
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// layerDir returns the directory of the writable layer of a checkout, which
+// quotas are set on. The vfs driver copies the image into the directory, so
+// its quotas include the size of the image.
+func (c *Context) layerDir(id string) (string, error) {
+	switch name := c.driver.String(); name {
+	case "btrfs":
+		return path.Join(c.root, "btrfs", "subvolumes", id), nil
+	case "aufs":
+		return path.Join(c.root, "aufs", "diff", id), nil
+	case "vfs":
+		return path.Join(c.root, "vfs", "dir", id), nil
+	default:
+		return "", fmt.Errorf("disk quotas are not supported by the %s driver", name)
+	}
+}
+
+// setQuota limits the size of the files written to the writable layer of a
+// checkout, using a btrfs qgroup limit on its subvolume or an XFS project
+// quota on its directory, so that writes past it fail with EDQUOT.
+func (c *Context) setQuota(id string, size int64) error {
+	dir, err := c.layerDir(id)
+	if err != nil {
+		return err
+	}
+	if c.driver.String() == "btrfs" {
+		if err := run("btrfs", "quota", "enable", dir); err != nil {
+			return err
+		}
+		// only data which is not shared with the image counts
+		return run("btrfs", "qgroup", "limit", "-e", strconv.FormatInt(size, 10), dir)
+	}
+	mnt, err := xfsMount(dir)
+	if err != nil {
+		return err
+	}
+	project := strconv.FormatUint(uint64(projectID(id)), 10)
+	if err := run("xfs_quota", "-x", "-c", fmt.Sprintf("project -s -p %s %s", dir, project), mnt); err != nil {
+		return err
+	}
+	kib := (size + 1023) / 1024
+	return run("xfs_quota", "-x", "-c", fmt.Sprintf("limit -p bhard=%dk %s", kib, project), mnt)
+}
+
+// clearQuota removes the XFS project quota of a checkout, which is kept by
+// the filesystem after the checkout's directory is removed. Btrfs qgroup
+// limits are set on the checkout's subvolume, which is deleted with it.
+func (c *Context) clearQuota(id string) error {
+	dir, err := c.layerDir(id)
+	if err != nil || c.driver.String() == "btrfs" {
+		return nil
+	}
+	mnt, err := xfsMount(dir)
+	if err != nil {
+		// quotas can only have been set on XFS filesystems
+		return nil
+	}
+	project := strconv.FormatUint(uint64(projectID(id)), 10)
+	return run("xfs_quota", "-x", "-c", "limit -p bhard=0 "+project, mnt)
+}
+
+// diskUsage returns the size of the files written to the writable layer of a
+// checkout with a quota, and the quota.
+func (c *Context) diskUsage(id string) (usage, limit uint64, err error) {
+	dir, err := c.layerDir(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	if c.driver.String() == "btrfs" {
+		out, err := output("btrfs", "inspect-internal", "rootid", dir)
+		if err != nil {
+			return 0, 0, err
+		}
+		qgroup := "0/" + strings.TrimSpace(string(out))
+		if out, err = output("btrfs", "qgroup", "show", "--raw", "-e", dir); err != nil {
+			return 0, 0, err
+		}
+		// qgroupid rfer excl max_excl
+		return parseQuota(out, qgroup, 2, 3, 1)
+	}
+	mnt, err := xfsMount(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	project := strconv.FormatUint(uint64(projectID(id)), 10)
+	out, err := output("xfs_quota", "-x", "-c", "quota -p -N -b "+project, mnt)
+	if err != nil {
+		return 0, 0, err
+	}
+	// device blocks quota limit warn/grace, in KiB
+	return parseQuota(out, "", 1, 3, 1024)
+}
+
+// parseQuota reads the usage and limit columns of the line of quota command
+// output whose first column is key, or of the first line if key is empty,
+// multiplying them by unit.
+func parseQuota(out []byte, key string, usageCol, limitCol int, unit uint64) (usage, limit uint64, err error) {
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) <= limitCol || key != "" && fields[0] != key {
+			continue
+		}
+		if usage, err = strconv.ParseUint(fields[usageCol], 10, 64); err != nil {
+			return 0, 0, err
+		}
+		// btrfs shows a limit of "none" when there isn't one
+		limit, _ = strconv.ParseUint(fields[limitCol], 10, 64)
+		return usage * unit, limit * unit, nil
+	}
+	return 0, 0, fmt.Errorf("no quota found in %q", out)
+}
+
+// projectID returns the XFS project of a checkout, which is derived from its
+// ID so that no state needs to be kept to find it. Checkouts whose IDs
+// collide would share a quota, which is unlikely with random job IDs.
+func projectID(id string) uint32 {
+	// project 0 is the default project of all files
+	return crc32.ChecksumIEEE([]byte(id))&0x7fffffff | 1
+}
+
+// xfsMount returns the mount point of the XFS filesystem containing dir.
+func xfsMount(dir string) (string, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	mnt, fstype, err := findMount(f, dir)
+	if err != nil {
+		return "", err
+	}
+	if fstype != "xfs" {
+		return "", fmt.Errorf("disk quotas require %s to be on an XFS filesystem mounted with prjquota, not %s", dir, fstype)
+	}
+	return mnt, nil
+}
+
+// findMount returns the mount point and filesystem type of the innermost
+// mount in mounts, in the format of /proc/mounts, which contains dir.
+func findMount(mounts io.Reader, dir string) (mnt, fstype string, err error) {
+	s := bufio.NewScanner(mounts)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		if rel, err := filepath.Rel(fields[1], dir); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") && len(fields[1]) >= len(mnt) {
+			mnt, fstype = fields[1], fields[2]
+		}
+	}
+	return mnt, fstype, s.Err()
+}
+
+func run(name string, args ...string) error {
+	_, err := output(name, args...)
+	return err
+}
+
+// output runs a command, including its error output in the error.
+func output(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %s: %s", name, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseQuota(t *testing.T) {
+	btrfs := `qgroupid         rfer         excl     max_excl
+--------         ----         ----     --------
+0/5             16384        16384         none
+0/258         1048576       524288     10485760
+`
+	xfs := "/dev/sdb1 2048 0 4096 00 [--------]\n"
+	for _, test := range []struct {
+		name                         string
+		out                          string
+		key                          string
+		usageCol, limitCol           int
+		unit                         uint64
+		expectedUsage, expectedLimit uint64
+		err                          bool
+	}{
+		{name: "btrfs", out: btrfs, key: "0/258", usageCol: 2, limitCol: 3, unit: 1, expectedUsage: 524288, expectedLimit: 10485760},
+		{name: "btrfs without limit", out: btrfs, key: "0/5", usageCol: 2, limitCol: 3, unit: 1, expectedUsage: 16384},
+		{name: "btrfs missing qgroup", out: btrfs, key: "0/259", usageCol: 2, limitCol: 3, unit: 1, err: true},
+		{name: "xfs", out: xfs, usageCol: 1, limitCol: 3, unit: 1024, expectedUsage: 2048 * 1024, expectedLimit: 4096 * 1024},
+		{name: "xfs short line", out: "/dev/sdb1 2048\n", usageCol: 1, limitCol: 3, unit: 1024, err: true},
+		{name: "invalid usage", out: "/dev/sdb1 - 0 4096\n", usageCol: 1, limitCol: 3, unit: 1024, err: true},
+		{name: "empty", usageCol: 1, limitCol: 3, unit: 1024, err: true},
+	} {
+		usage, limit, err := parseQuota([]byte(test.out), test.key, test.usageCol, test.limitCol, test.unit)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if usage != test.expectedUsage || limit != test.expectedLimit {
+			t.Errorf("%s: expected usage %d and limit %d, got %d and %d", test.name, test.expectedUsage, test.expectedLimit, usage, limit)
+		}
+	}
+}
+
+func TestProjectID(t *testing.T) {
+	for _, test := range []struct {
+		id       string
+		expected uint32
+	}{
+		{"tmp-a", 1297284541},
+		{"tmp-flynn-1234", 1037417785},
+		// the checksum of tmp-job4 has the high bit set and the low bit
+		// unset, which are cleared and set to keep the ID positive and
+		// non-zero
+		{"tmp-job4", 1950739897},
+		{"", 1},
+	} {
+		if id := projectID(test.id); id != test.expected {
+			t.Errorf("%q: expected project %d, got %d", test.id, test.expected, id)
+		}
+	}
+}
+
+func TestFindMount(t *testing.T) {
+	mounts := `rootfs / rootfs rw 0 0
+/dev/sda1 / ext4 rw,relatime 0 0
+proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+/dev/sdb1 /var/lib/docker xfs rw,relatime,prjquota 0 0
+/dev/sdc1 /var/lib/docker/aufs/mnt/foo aufs rw 0 0
+/dev/sdd1 /var/lib/dockerfoo ext4 rw 0 0
+`
+	for _, test := range []struct {
+		dir            string
+		expectedMount  string
+		expectedFSType string
+	}{
+		{"/var/lib/docker/vfs/dir/tmp-a", "/var/lib/docker", "xfs"},
+		{"/var/lib/docker", "/var/lib/docker", "xfs"},
+		{"/var/lib/docker/aufs/mnt/foo/bar", "/var/lib/docker/aufs/mnt/foo", "aufs"},
+		{"/var/lib/dockerfoo/vfs", "/var/lib/dockerfoo", "ext4"},
+		{"/var/lib/docker/..tmp", "/var/lib/docker", "xfs"},
+		{"/tmp", "/", "ext4"},
+	} {
+		mnt, fstype, err := findMount(strings.NewReader(mounts), test.dir)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.dir, err)
+			continue
+		}
+		if mnt != test.expectedMount || fstype != test.expectedFSType {
+			t.Errorf("%s: expected %s (%s), got %s (%s)", test.dir, test.expectedMount, test.expectedFSType, mnt, fstype)
+		}
+	}
+}
@@ -96,6 +96,34 @@ func (s *Store) Add(img *registry.Image) (err error) {
 	return os.Rename(tmp, s.root(img.ID))
 }
 
+// Get returns the metadata of the image layer with the given ID.
+func (s *Store) Get(id string) (*registry.Image, error) {
+	f, err := os.Open(filepath.Join(s.root(id), "json"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img := &registry.Image{}
+	return img, json.NewDecoder(f).Decode(img)
+}
+
+// Remove deletes the image layer with the given ID, which must not be the
+// parent of other layers or checkouts.
+func (s *Store) Remove(id string) error {
+	if err := s.lock(id); err != nil {
+		return err
+	}
+	defer s.unlock(id)
+
+	if !s.Exists(id) {
+		return nil
+	}
+	if err := s.driver.Remove(id); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.root(id))
+}
+
 func (s *Store) Exists(id string) bool {
 	_, err := os.Stat(s.root(id))
 	return err == nil
@@ -0,0 +1,29 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// PullArtifact pulls the image of an artifact on the host so that jobs using
+// it start without waiting for it to be pulled. It returns once the image has
+// been pulled and checked against the artifact's checksum.
+func (c *hostClient) PullArtifact(a host.Artifact) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", "/artifacts/pull", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.httpDo(req, nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
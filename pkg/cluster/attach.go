@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"strings"
 	"sync"
 
 	"github.com/flynn/flynn/host/types"
@@ -27,30 +28,10 @@ func (c *hostClient) Attach(req *host.AttachReq, wait bool) (AttachClient, error
 	if err != nil {
 		return nil, err
 	}
-	conn, err := c.dial("tcp", c.addr)
+	rwc, err := c.hijack(httpReq, nil)
 	if err != nil {
 		return nil, err
 	}
-	clientconn := httputil.NewClientConn(conn, nil)
-	res, err := clientconn.Do(httpReq)
-	if err != nil && err != httputil.ErrPersistEOF {
-		return nil, err
-	}
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("cluster: unexpected status %d", res.StatusCode)
-	}
-	var rwc io.ReadWriteCloser
-	var buf *bufio.Reader
-	rwc, buf = clientconn.Hijack()
-	if buf.Buffered() > 0 {
-		rwc = struct {
-			io.Reader
-			io.WriteCloser
-		}{
-			io.MultiReader(io.LimitReader(buf, int64(buf.Buffered())), rwc),
-			rwc,
-		}
-	}
 
 	attachState := make([]byte, 1)
 	if _, err := rwc.Read(attachState); err != nil {
@@ -58,26 +39,6 @@ func (c *hostClient) Attach(req *host.AttachReq, wait bool) (AttachClient, error
 		return nil, err
 	}
 
-	handleState := func() error {
-		switch attachState[0] {
-		case host.AttachSuccess:
-			return nil
-		case host.AttachError:
-			errBytes, err := ioutil.ReadAll(rwc)
-			rwc.Close()
-			if err != nil {
-				return err
-			}
-			if len(errBytes) >= 4 {
-				errBytes = errBytes[4:]
-			}
-			return errors.New(string(errBytes))
-		default:
-			rwc.Close()
-			return fmt.Errorf("cluster: unknown attach state: %d", attachState)
-		}
-	}
-
 	if attachState[0] == host.AttachWaiting {
 		if !wait {
 			rwc.Close()
@@ -88,7 +49,7 @@ func (c *hostClient) Attach(req *host.AttachReq, wait bool) (AttachClient, error
 				rwc.Close()
 				return err
 			}
-			return handleState()
+			return handleAttachState(rwc, attachState[0])
 		}
 		c := &attachClient{
 			conn: rwc,
@@ -99,7 +60,93 @@ func (c *hostClient) Attach(req *host.AttachReq, wait bool) (AttachClient, error
 		return c, nil
 	}
 
-	return NewAttachClient(rwc), handleState()
+	return NewAttachClient(rwc), handleAttachState(rwc, attachState[0])
+}
+
+// Exec runs a command in the container of a running job, the returned client
+// is attached to the command's streams and receives its exit status.
+func (c *hostClient) Exec(jobID string, req *host.ExecReq) (AttachClient, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest("POST", "/host/jobs/"+jobID+"/exec", bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	rwc, err := c.hijack(httpReq, jobErrors)
+	if err != nil {
+		return nil, err
+	}
+	attachState := make([]byte, 1)
+	if _, err := rwc.Read(attachState); err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	if err := handleAttachState(rwc, attachState[0]); err != nil {
+		return nil, err
+	}
+	return NewAttachClient(rwc), nil
+}
+
+// hijack makes a request to the host's HTTP API and returns the connection
+// once the host has responded. Responses with a status in errs return the
+// matching error.
+func (c *hostClient) hijack(req *http.Request, errs map[int]error) (io.ReadWriteCloser, error) {
+	c.authorize(req)
+	conn, err := c.dial("tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	clientconn := httputil.NewClientConn(conn, nil)
+	res, err := clientconn.Do(req)
+	if err != nil && err != httputil.ErrPersistEOF {
+		clientconn.Close()
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		defer clientconn.Close()
+		if err, ok := errs[res.StatusCode]; ok {
+			return nil, err
+		}
+		msg, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("cluster: unexpected status %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var rwc io.ReadWriteCloser
+	var buf *bufio.Reader
+	rwc, buf = clientconn.Hijack()
+	if buf.Buffered() > 0 {
+		rwc = struct {
+			io.Reader
+			io.WriteCloser
+		}{
+			io.MultiReader(io.LimitReader(buf, int64(buf.Buffered())), rwc),
+			rwc,
+		}
+	}
+	return rwc, nil
+}
+
+// handleAttachState returns the error sent by the host if the attach state is
+// not AttachSuccess, closing the connection.
+func handleAttachState(rwc io.ReadWriteCloser, state byte) error {
+	switch state {
+	case host.AttachSuccess:
+		return nil
+	case host.AttachError:
+		errBytes, err := ioutil.ReadAll(rwc)
+		rwc.Close()
+		if err != nil {
+			return err
+		}
+		if len(errBytes) >= 4 {
+			errBytes = errBytes[4:]
+		}
+		return errors.New(string(errBytes))
+	default:
+		rwc.Close()
+		return fmt.Errorf("cluster: unknown attach state: %d", state)
+	}
 }
 
 func NewAttachClient(conn io.ReadWriteCloser) AttachClient {
@@ -0,0 +1,131 @@
+package cluster
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/flynn/flynn/pkg/rpcplus"
+)
+
+// Hosts started with FLYNN_HOST_TOKEN set require clients to send the token
+// with every request, and hosts started with FLYNN_HOST_TLS_CA set serve their
+// API over TLS and require clients to present a certificate signed by the CA.
+// Clients read their credentials from the same variables, so the hosts and
+// the system apps which run jobs are given the same environment.
+const (
+	TokenEnv   = "FLYNN_HOST_TOKEN"
+	TLSCAEnv   = "FLYNN_HOST_TLS_CA"   // PEM CA certificate
+	TLSCertEnv = "FLYNN_HOST_TLS_CERT" // PEM certificate, used as both client and server certificate
+	TLSKeyEnv  = "FLYNN_HOST_TLS_KEY"  // PEM private key of the certificate
+)
+
+// Credentials authenticate requests to the hosts' API.
+type Credentials struct {
+	Token string
+
+	// CA and Certificate are set if the API is served over TLS, hosts are
+	// dialled by IP so their certificates must include their IPs.
+	CA          *x509.CertPool
+	Certificate *tls.Certificate
+}
+
+var (
+	envCredentials     *Credentials
+	envCredentialsErr  error
+	envCredentialsOnce sync.Once
+)
+
+// EnvCredentials returns the credentials set in the environment, which are
+// read once.
+func EnvCredentials() (*Credentials, error) {
+	envCredentialsOnce.Do(func() {
+		envCredentials, envCredentialsErr = credentialsFromEnv()
+	})
+	return envCredentials, envCredentialsErr
+}
+
+func credentialsFromEnv() (*Credentials, error) {
+	c := &Credentials{Token: os.Getenv(TokenEnv)}
+	ca := os.Getenv(TLSCAEnv)
+	if ca == "" {
+		return c, nil
+	}
+	c.CA = x509.NewCertPool()
+	if !c.CA.AppendCertsFromPEM([]byte(ca)) {
+		return nil, errors.New("cluster: invalid CA certificate in " + TLSCAEnv)
+	}
+	cert, err := tls.X509KeyPair([]byte(os.Getenv(TLSCertEnv)), []byte(os.Getenv(TLSKeyEnv)))
+	if err != nil {
+		return nil, errors.New("cluster: invalid TLS certificate in " + TLSCertEnv + " and " + TLSKeyEnv + ": " + err.Error())
+	}
+	c.Certificate = &cert
+	return c, nil
+}
+
+// ClientTLS returns the TLS configuration clients dial hosts with, or nil if
+// the API is not served over TLS.
+func (c *Credentials) ClientTLS() *tls.Config {
+	if c.CA == nil {
+		return nil
+	}
+	return &tls.Config{RootCAs: c.CA, Certificates: []tls.Certificate{*c.Certificate}}
+}
+
+// ServerTLS returns the TLS configuration hosts serve their API with, or nil
+// if it is not served over TLS.
+func (c *Credentials) ServerTLS() *tls.Config {
+	if c.CA == nil {
+		return nil
+	}
+	return &tls.Config{
+		ClientCAs:    c.CA,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		Certificates: []tls.Certificate{*c.Certificate},
+	}
+}
+
+// Authorize adds the token to a request to a host.
+func (c *Credentials) Authorize(req *http.Request) {
+	if c.Token != "" {
+		req.SetBasicAuth("", c.Token)
+	}
+}
+
+// defaultDial dials hosts over TLS if the environment's credentials require
+// it, returning the error reading them if they are invalid.
+func defaultDial(network, addr string) (net.Conn, error) {
+	creds, err := EnvCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if config := creds.ClientTLS(); config != nil {
+		return tls.Dial(network, addr, config)
+	}
+	return net.Dial(network, addr)
+}
+
+// dialRPC connects to the RPC API of the host or cluster leader at addr.
+func dialRPC(addr string, dial rpcplus.DialFunc) (*rpcplus.Client, error) {
+	creds, err := EnvCredentials()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// the RPC client writes its CONNECT request without net/http
+	req := &http.Request{Header: make(http.Header)}
+	creds.Authorize(req)
+	client, err := rpcplus.NewHTTPClient(conn, rpcplus.DefaultRPCPath, req.Header)
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial-http", Net: "tcp " + addr, Err: err}
+	}
+	return client, nil
+}
@@ -0,0 +1,90 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// CheckpointJob checkpoints the processes of a running job, stopping it unless
+// leaveRunning is set, and streams the checkpoint, which is received by
+// another host with ReceiveCheckpoint. The stream must be closed.
+// Checkpoint/restore is experimental and must be enabled on both hosts.
+func (c *hostClient) CheckpointJob(id string, leaveRunning bool) (io.ReadCloser, error) {
+	path := "/host/jobs/" + id + "/checkpoint"
+	if leaveRunning {
+		path += "?leave_running=true"
+	}
+	req, err := http.NewRequest("POST", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpDo(req, jobErrors)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// ReceiveCheckpoint stores a checkpoint sent by another host, the job is
+// restored by adding it to the host with Job.Checkpoint set to the ID of the
+// returned checkpoint.
+func (c *hostClient) ReceiveCheckpoint(r io.Reader) (*host.Checkpoint, error) {
+	req, err := http.NewRequest("POST", "/host/checkpoints", r)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpDo(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var checkpoint host.Checkpoint
+	if err := json.NewDecoder(res.Body).Decode(&checkpoint); err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+// ErrJobHasMounts is returned when migrating a job with mounts, whose data
+// is kept on the host rather than being part of the job's checkpoint.
+var ErrJobHasMounts = errors.New("cluster: jobs with mounts can't be migrated")
+
+// MigrateJob moves a running job from the host src to the host dst by
+// checkpointing it and restoring it on dst as a new job, which is returned.
+// The job is stopped on src unless leaveRunning is set, which leaves two
+// copies running. The restored job has a new IP address, so its established
+// TCP connections are closed.
+func (c *Client) MigrateJob(src Host, dstID, jobID string, leaveRunning bool) (*host.Job, error) {
+	dst, err := c.DialHost(dstID)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Close()
+	job, err := src.GetJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	if job.Job != nil && len(job.Job.Config.Mounts) > 0 {
+		return nil, ErrJobHasMounts
+	}
+	stream, err := src.CheckpointJob(jobID, leaveRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	checkpoint, err := dst.ReceiveCheckpoint(stream)
+	if err != nil {
+		return nil, err
+	}
+	restored := checkpoint.Job.Dup()
+	restored.ID = RandomJobID("")
+	restored.Checkpoint = checkpoint.ID
+	if _, err := c.AddJobs(&host.AddJobsReq{HostJobs: map[string][]*host.Job{dstID: {restored}}}); err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
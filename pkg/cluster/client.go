@@ -34,7 +34,9 @@ func NewClientWithDial(dial rpcplus.DialFunc, services ServiceSetFunc) (*Client,
 	if err != nil {
 		return nil, err
 	}
-	client.dial = dial
+	if dial != nil {
+		client.dial = dial
+	}
 	return client, client.start()
 }
 
@@ -46,7 +48,7 @@ func newClient(services ServiceSetFunc) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{service: ss, leaderChange: make(chan struct{})}, nil
+	return &Client{service: ss, dial: defaultDial, leaderChange: make(chan struct{})}, nil
 }
 
 type LocalClient interface {
@@ -54,6 +56,7 @@ type LocalClient interface {
 	AddJobs(*host.AddJobsReq) (*host.AddJobsRes, error)
 	RegisterHost(*host.Host, chan *host.Job) Stream
 	RemoveJobs([]string) error
+	DrainHost() error
 }
 
 func NewClientWithSelf(id string, self LocalClient) (*Client, error) {
@@ -105,7 +108,7 @@ func (c *Client) followLeader(firstErr chan<- error) {
 		c.leaderID = update.Attrs["id"]
 		if c.leaderID != c.selfID {
 			c.err = Attempts.Run(func() (err error) {
-				c.c, err = rpcplus.DialHTTPPath("tcp", update.Addr, rpcplus.DefaultRPCPath, c.dial)
+				c.c, err = dialRPC(update.Addr, c.dial)
 				return
 			})
 		}
@@ -172,6 +175,8 @@ func (c *Client) ListHosts() (map[string]host.Host, error) {
 	return state, client.Call("Cluster.ListHosts", struct{}{}, &state)
 }
 
+// AddJobs adds jobs to hosts, it returns a *host.ResourceError if a host
+// doesn't have the resources for the limits of its new jobs.
 func (c *Client) AddJobs(req *host.AddJobsReq) (*host.AddJobsRes, error) {
 	if c := c.local(); c != nil {
 		return c.AddJobs(req)
@@ -181,7 +186,13 @@ func (c *Client) AddJobs(req *host.AddJobsReq) (*host.AddJobsRes, error) {
 		return nil, err
 	}
 	var res host.AddJobsRes
-	return &res, client.Call("Cluster.AddJobs", req, &res)
+	err = client.Call("Cluster.AddJobs", req, &res)
+	if e, ok := err.(rpcplus.ServerError); ok {
+		if re, ok := host.ParseResourceError(string(e)); ok {
+			err = re
+		}
+	}
+	return &res, err
 }
 
 func (c *Client) DialHost(id string) (Host, error) {
@@ -191,7 +202,7 @@ func (c *Client) DialHost(id string) (Host, error) {
 		return nil, ErrNoServers
 	}
 	addr := services[0].Addr
-	rc, err := rpcplus.DialHTTPPath("tcp", addr, rpcplus.DefaultRPCPath, c.dial)
+	rc, err := dialRPC(addr, c.dial)
 	return NewHostClient(addr, rc, c.dial), err
 }
 
@@ -222,6 +233,20 @@ func (c *Client) RemoveJobs(jobIDs []string) error {
 	return client.Call("Cluster.RemoveJobs", jobIDs, &struct{}{})
 }
 
+// DrainHost is used by flynn-host to mark itself as draining so that
+// schedulers move its jobs to other hosts. Clients drain a host with
+// Host.Drain.
+func (c *Client) DrainHost() error {
+	if c := c.local(); c != nil {
+		return c.DrainHost()
+	}
+	client, err := c.RPCClient()
+	if err != nil {
+		return err
+	}
+	return client.Call("Cluster.DrainHost", struct{}{}, &struct{}{})
+}
+
 func (c *Client) StreamHostEvents(ch chan<- *host.HostEvent) Stream {
 	return rpcStream{c.c.StreamGo("Cluster.StreamHostEvents", struct{}{}, ch)}
 }
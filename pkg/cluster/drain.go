@@ -0,0 +1,34 @@
+package cluster
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// Drain stops the host accepting new jobs and has the scheduler move the jobs
+// running on it to other hosts. It returns straight away, DrainStatus reports
+// the progress of the drain.
+func (c *hostClient) Drain() (*host.DrainStatus, error) {
+	return c.drainRequest("PUT")
+}
+
+// DrainStatus returns the progress of draining the host.
+func (c *hostClient) DrainStatus() (*host.DrainStatus, error) {
+	return c.drainRequest("GET")
+}
+
+func (c *hostClient) drainRequest(method string) (*host.DrainStatus, error) {
+	req, err := http.NewRequest(method, "/host/drain", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpDo(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	status := &host.DrainStatus{}
+	return status, json.NewDecoder(res.Body).Decode(status)
+}
@@ -0,0 +1,108 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+// StreamEvents sends the job events of the host to ch, read from the
+// server-sent event stream at /host/events. id is either a job ID or "all"
+// for the events of every job. ch is closed when the stream ends, Err then
+// returns the error which ended it, if any.
+func (c *hostClient) StreamEvents(id string, ch chan<- *host.Event) Stream {
+	path := "/host/events"
+	if id != "all" {
+		path += "?job_id=" + url.QueryEscape(id)
+	}
+	s := &eventStream{}
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		s.fail(ch, err)
+		return s
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := c.httpDo(req, nil)
+	if err != nil {
+		s.fail(ch, err)
+		return s
+	}
+	s.body = res.Body
+	go s.stream(ch)
+	return s
+}
+
+type eventStream struct {
+	body io.ReadCloser
+
+	mtx    sync.Mutex
+	err    error
+	closed bool
+}
+
+func (s *eventStream) fail(ch chan<- *host.Event, err error) {
+	s.err = err
+	close(ch)
+}
+
+func (s *eventStream) stream(ch chan<- *host.Event) {
+	defer close(ch)
+	r := bufio.NewReader(s.body)
+	var data []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			s.mtx.Lock()
+			if err != io.EOF && !s.closed {
+				s.err = err
+			}
+			s.mtx.Unlock()
+			return
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			// a blank line dispatches the event, if it had any data
+			if len(data) == 0 {
+				continue
+			}
+			event := &host.Event{}
+			err := json.Unmarshal(data, event)
+			data = data[:0]
+			if err != nil {
+				s.mtx.Lock()
+				s.err = err
+				s.mtx.Unlock()
+				return
+			}
+			ch <- event
+		case bytes.HasPrefix(line, []byte("data:")):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" "))...)
+		}
+	}
+}
+
+func (s *eventStream) Close() error {
+	s.mtx.Lock()
+	s.closed = true
+	s.mtx.Unlock()
+	if s.body == nil {
+		return nil
+	}
+	return s.body.Close()
+}
+
+func (s *eventStream) Err() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.err
+}
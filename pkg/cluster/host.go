@@ -1,7 +1,8 @@
 package cluster
 
 import (
-	"net"
+	"io"
+	"time"
 
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/rpcplus"
@@ -11,22 +12,40 @@ type Host interface {
 	ListJobs() (map[string]host.ActiveJob, error)
 	GetJob(id string) (*host.ActiveJob, error)
 	StopJob(id string) error
+	SignalJob(id string, sig int) error
 	StreamEvents(id string, ch chan<- *host.Event) Stream
 	Attach(req *host.AttachReq, wait bool) (AttachClient, error)
+	Exec(jobID string, req *host.ExecReq) (AttachClient, error)
+	CreateVolume() (*host.Volume, error)
+	ListVolumes() ([]*host.Volume, error)
+	DestroyVolume(id string) error
+	SnapshotVolume(id string) (*host.VolumeSnapshot, error)
+	SendVolume(id, snapshotID string) (*VolumeStream, error)
+	ReceiveVolume(s *VolumeStream) (*host.Volume, error)
+	CheckpointJob(id string, leaveRunning bool) (io.ReadCloser, error)
+	ReceiveCheckpoint(r io.Reader) (*host.Checkpoint, error)
+	JobStats(id string) (*host.JobStats, error)
+	StreamJobStats(id string, interval time.Duration, ch chan<- *host.JobStats) (Stream, error)
+	PullArtifact(a host.Artifact) error
+	Drain() (*host.DrainStatus, error)
+	DrainStatus() (*host.DrainStatus, error)
 	Close() error
 }
 
 type hostClient struct {
-	addr string
-	dial rpcplus.DialFunc
-	c    RPCClient
+	addr  string
+	dial  rpcplus.DialFunc
+	c     RPCClient
+	creds *Credentials
 }
 
 func NewHostClient(addr string, client RPCClient, dial rpcplus.DialFunc) Host {
 	c := &hostClient{addr: addr, dial: dial, c: client}
 	if dial == nil {
-		c.dial = net.Dial
+		c.dial = defaultDial
 	}
+	// an error reading the credentials is returned by defaultDial
+	c.creds, _ = EnvCredentials()
 	return c
 }
 
@@ -46,8 +65,8 @@ func (c *hostClient) StopJob(id string) error {
 	return c.c.Call("Host.StopJob", id, &struct{}{})
 }
 
-func (c *hostClient) StreamEvents(id string, ch chan<- *host.Event) Stream {
-	return rpcStream{c.c.StreamGo("Host.StreamEvents", id, ch)}
+func (c *hostClient) SignalJob(id string, sig int) error {
+	return c.c.Call("Host.SignalJob", &host.SignalReq{JobID: id, Signal: sig}, &struct{}{})
 }
 
 func (c *hostClient) Close() error {
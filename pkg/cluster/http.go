@@ -0,0 +1,58 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// httpDo makes a request to the host's HTTP API on a new connection, which is
+// closed when the response body is closed. Responses with a status in errs
+// return the matching error.
+func (c *hostClient) httpDo(req *http.Request, errs map[int]error) (*http.Response, error) {
+	c.authorize(req)
+	conn, err := c.dial("tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	clientconn := httputil.NewClientConn(conn, nil)
+	res, err := clientconn.Do(req)
+	if err != nil && err != httputil.ErrPersistEOF {
+		clientconn.Close()
+		return nil, err
+	}
+	res.Body = &connBody{ReadCloser: res.Body, conn: clientconn}
+	if res.StatusCode == 200 {
+		return res, nil
+	}
+	err, ok := errs[res.StatusCode]
+	if !ok {
+		msg, _ := ioutil.ReadAll(res.Body)
+		err = fmt.Errorf("cluster: unexpected status %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	res.Body.Close()
+	return nil, err
+}
+
+// authorize adds the client's token to a request.
+func (c *hostClient) authorize(req *http.Request) {
+	if c.creds != nil {
+		c.creds.Authorize(req)
+	}
+}
+
+type connBody struct {
+	io.ReadCloser
+	conn io.Closer
+}
+
+// Close closes the connection before the body so that closing a body which is
+// still streaming doesn't block trying to drain it.
+func (b *connBody) Close() error {
+	err := b.conn.Close()
+	b.ReadCloser.Close()
+	return err
+}
@@ -0,0 +1,97 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+var (
+	ErrJobNotFound   = errors.New("cluster: job not found")
+	ErrJobNotRunning = errors.New("cluster: job is not running")
+)
+
+var jobErrors = map[int]error{
+	404: ErrJobNotFound,
+	409: ErrJobNotRunning,
+}
+
+// JobStats returns the current resource usage of a running job.
+func (c *hostClient) JobStats(id string) (*host.JobStats, error) {
+	req, err := http.NewRequest("GET", "/host/jobs/"+id+"/stats", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpDo(req, jobErrors)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var stats host.JobStats
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// StreamJobStats sends the resource usage of a running job to ch each
+// interval. ch is closed when the job stops or the stream is closed.
+func (c *hostClient) StreamJobStats(id string, interval time.Duration, ch chan<- *host.JobStats) (Stream, error) {
+	path := fmt.Sprintf("/host/jobs/%s/stats?stream=true&interval=%s", id, url.QueryEscape(interval.String()))
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpDo(req, jobErrors)
+	if err != nil {
+		return nil, err
+	}
+	s := &statsStream{body: res.Body}
+	go s.stream(ch)
+	return s, nil
+}
+
+type statsStream struct {
+	body io.ReadCloser
+
+	mtx    sync.Mutex
+	err    error
+	closed bool
+}
+
+func (s *statsStream) stream(ch chan<- *host.JobStats) {
+	defer close(ch)
+	dec := json.NewDecoder(s.body)
+	for {
+		stats := &host.JobStats{}
+		if err := dec.Decode(stats); err != nil {
+			s.mtx.Lock()
+			if err != io.EOF && !s.closed {
+				s.err = err
+			}
+			s.mtx.Unlock()
+			return
+		}
+		ch <- stats
+	}
+}
+
+func (s *statsStream) Close() error {
+	s.mtx.Lock()
+	s.closed = true
+	s.mtx.Unlock()
+	return s.body.Close()
+}
+
+func (s *statsStream) Err() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.err
+}
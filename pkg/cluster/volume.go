@@ -0,0 +1,124 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/flynn/flynn/host/types"
+)
+
+var (
+	ErrVolumeNotFound = errors.New("cluster: volume not found")
+
+	// ErrVolumeInUse is returned when destroying a volume which is
+	// mounted into a running job.
+	ErrVolumeInUse = errors.New("cluster: volume is in use")
+)
+
+var volumeErrors = map[int]error{
+	404: ErrVolumeNotFound,
+	409: ErrVolumeInUse,
+}
+
+// VolumeStream is the data of a volume sent by a host, which can only be
+// received by hosts whose volumes have the same Type.
+type VolumeStream struct {
+	io.ReadCloser
+	Type string
+}
+
+func (c *hostClient) CreateVolume() (*host.Volume, error) {
+	var v host.Volume
+	if err := c.volumeRequest("POST", "/volumes", &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (c *hostClient) ListVolumes() ([]*host.Volume, error) {
+	var volumes []*host.Volume
+	return volumes, c.volumeRequest("GET", "/volumes", &volumes)
+}
+
+func (c *hostClient) DestroyVolume(id string) error {
+	return c.volumeRequest("DELETE", "/volumes/"+id, nil)
+}
+
+func (c *hostClient) SnapshotVolume(id string) (*host.VolumeSnapshot, error) {
+	var s host.VolumeSnapshot
+	if err := c.volumeRequest("POST", "/volumes/"+id+"/snapshots", &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// SendVolume streams the data of a snapshot of a volume, or of the volume
+// itself if snapshotID is empty. The stream must be closed.
+func (c *hostClient) SendVolume(id, snapshotID string) (*VolumeStream, error) {
+	req, err := http.NewRequest("GET", "/volumes/"+id+"/send?snapshot="+url.QueryEscape(snapshotID), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpDo(req, volumeErrors)
+	if err != nil {
+		return nil, err
+	}
+	return &VolumeStream{ReadCloser: res.Body, Type: res.Header.Get(host.VolumeTypeHeader)}, nil
+}
+
+// ReceiveVolume creates a volume from data sent by another host.
+func (c *hostClient) ReceiveVolume(s *VolumeStream) (*host.Volume, error) {
+	req, err := http.NewRequest("POST", "/volumes/receive", s)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(host.VolumeTypeHeader, s.Type)
+	res, err := c.httpDo(req, volumeErrors)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var v host.Volume
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// MigrateVolume copies the data of a volume from the host src to the host
+// dst, returning the new volume on dst. The data is copied from a snapshot so
+// that it is consistent, but jobs which write to the volume should be
+// stopped first so that no writes are lost. The volume on src is kept.
+func MigrateVolume(src, dst Host, id string) (*host.Volume, error) {
+	snapshot, err := src.SnapshotVolume(id)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := src.SendVolume(id, snapshot.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return dst.ReceiveVolume(stream)
+}
+
+// volumeRequest makes a request to the host's volume API, decoding the
+// response into out if it is not nil.
+func (c *hostClient) volumeRequest(method, path string, out interface{}) error {
+	req, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.httpDo(req, volumeErrors)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
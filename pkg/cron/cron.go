@@ -0,0 +1,162 @@
+// Package cron parses cron schedule expressions and calculates the times
+// they are due.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression. Times are matched at minute
+// granularity in the location of the time passed to Next.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// domAny and dowAny record whether the day fields are unrestricted,
+	// if both are restricted a day matches if either field matches.
+	domAny, dowAny bool
+}
+
+var aliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+type bounds struct {
+	name     string
+	min, max int
+}
+
+var fieldBounds = []bounds{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Parse parses a standard five field cron expression (minute, hour, day of
+// month, month and day of week) or one of the aliases @yearly, @monthly,
+// @weekly, @daily and @hourly. Fields may contain *, numbers, ranges (1-5),
+// steps (*/15, 1-30/2) and comma separated lists of these. Both 0 and 7 are
+// Sunday in the day of week field.
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if alias, ok := aliases[expr]; ok {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron: expected 5 fields, got %d", len(fields))
+	}
+	var bits [5]uint64
+	for i, f := range fields {
+		b, err := parseField(f, fieldBounds[i])
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = b
+	}
+	// treat Sunday as 0
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = bits[4]&^(1<<7) | 1
+	}
+	return &Schedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}, nil
+}
+
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("cron: invalid step in %s field %q", b.name, part)
+			}
+		}
+		start, end := b.min, b.max
+		if rng != "*" {
+			var err error
+			if i := strings.Index(rng, "-"); i >= 0 {
+				start, err = strconv.Atoi(rng[:i])
+				if err == nil {
+					end, err = strconv.Atoi(rng[i+1:])
+				}
+			} else {
+				start, err = strconv.Atoi(rng)
+				end = start
+				if step > 1 {
+					// "5/15" means every 15 starting at 5
+					end = b.max
+				}
+			}
+			if err != nil {
+				return 0, fmt.Errorf("cron: invalid %s field %q", b.name, part)
+			}
+		}
+		if start < b.min || end > b.max || start > end {
+			return 0, fmt.Errorf("cron: %s field %q out of range %d-%d", b.name, part, b.min, b.max)
+		}
+		for n := start; n <= end; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first time after t which matches the schedule, or the
+// zero time if there is none within five years (for example "0 0 30 2 *").
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
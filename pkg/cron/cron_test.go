@@ -0,0 +1,61 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/flynn/flynn/pkg/cron"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func (S) TestNext(c *C) {
+	// Wednesday
+	now := time.Date(2015, 1, 14, 10, 30, 20, 0, time.UTC)
+	for _, t := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2015, 1, 14, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2015, 1, 14, 10, 45, 0, 0, time.UTC)},
+		{"5/15 * * * *", time.Date(2015, 1, 14, 10, 35, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2015, 1, 14, 13, 0, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2015, 1, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2015, 1, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2015, 1, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * 5", time.Date(2015, 1, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2015, 1, 14, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2015, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := cron.Parse(t.expr)
+		c.Assert(err, IsNil, Commentf("%s", t.expr))
+		c.Assert(s.Next(now), Equals, t.next, Commentf("%s", t.expr))
+	}
+}
+
+func (S) TestParseErrors(c *C) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		_, err := cron.Parse(expr)
+		c.Assert(err, NotNil, Commentf("%q", expr))
+	}
+}
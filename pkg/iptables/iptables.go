@@ -66,7 +66,18 @@ func RemoveExistingChain(name, bridge string) error {
 	return chain.Remove()
 }
 
-func (c *Chain) Forward(action Action, ip net.IP, port, rangeEnd int, proto, destAddr string) error {
+// Forward forwards the ports from port to rangeEnd on ip to destAddr, starting
+// at destPort. DNAT can't translate a range of ports one to one, so destPort
+// must be port if rangeEnd is not.
+func (c *Chain) Forward(action Action, ip net.IP, port, rangeEnd int, proto, destAddr string, destPort int) error {
+	if destPort != port && rangeEnd != port {
+		return fmt.Errorf("iptables: can't forward ports %d-%d to port %d", port, rangeEnd, destPort)
+	}
+	dest := destAddr
+	if destPort != port {
+		dest = fmt.Sprintf("%s:%d", destAddr, destPort)
+	}
+	destEnd := destPort + rangeEnd - port
 	daddr := ip.String()
 	if ip.IsUnspecified() {
 		// iptables interprets "0.0.0.0" as "0.0.0.0/32", whereas we
@@ -79,7 +90,7 @@ func (c *Chain) Forward(action Action, ip net.IP, port, rangeEnd int, proto, des
 		"-d", daddr,
 		"--dport", fmt.Sprintf("%d:%d", port, rangeEnd),
 		"-j", "DNAT",
-		"--to-destination", destAddr); err != nil && action != Delete {
+		"--to-destination", dest); err != nil && action != Delete {
 		return err
 	} else if len(output) != 0 && action != Delete {
 		return fmt.Errorf("Error iptables forward: %s", output)
@@ -94,7 +105,7 @@ func (c *Chain) Forward(action Action, ip net.IP, port, rangeEnd int, proto, des
 		"-o", c.Bridge,
 		"-p", proto,
 		"-d", destAddr,
-		"--dport", fmt.Sprintf("%d:%d", port, rangeEnd),
+		"--dport", fmt.Sprintf("%d:%d", destPort, destEnd),
 		"-j", "ACCEPT"); err != nil && action != Delete {
 		return err
 	} else if len(output) != 0 && action != Delete {
@@ -105,7 +116,7 @@ func (c *Chain) Forward(action Action, ip net.IP, port, rangeEnd int, proto, des
 		"-p", proto,
 		"-s", destAddr,
 		"-d", destAddr,
-		"--dport", fmt.Sprintf("%d:%d", port, rangeEnd),
+		"--dport", fmt.Sprintf("%d:%d", destPort, destEnd),
 		"-j", "MASQUERADE"); err != nil && action != Delete {
 		return err
 	} else if len(output) != 0 && action != Delete {
@@ -175,7 +186,7 @@ func Raw(args ...string) ([]byte, error) {
 	}
 
 	if os.Getenv("DEBUG") != "" {
-		fmt.Fprintf(os.Stderr, fmt.Sprintf("[debug] %s, %v\n", path, args))
+		fmt.Fprintf(os.Stderr, "[debug] %s, %v\n", path, args)
 	}
 
 	output, err := exec.Command(path, args...).CombinedOutput()
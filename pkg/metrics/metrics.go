@@ -0,0 +1,84 @@
+// Package metrics writes metrics in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ContentType is the content type of the text format written by Writer.
+const ContentType = "text/plain; version=0.0.4"
+
+// Histogram counts observations in buckets with the given upper bounds. It
+// is not safe for concurrent use.
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Writer writes samples of metrics, each of which is described once before
+// its first sample.
+type Writer struct {
+	io.Writer
+	described map[string]bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{Writer: w, described: make(map[string]bool)}
+}
+
+// Describe writes the help text and type of the metric unless it has already
+// been described.
+func (w *Writer) Describe(name, typ, help string) {
+	if w.described[name] {
+		return
+	}
+	w.described[name] = true
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Sample writes a value of the metric, labels are pairs of names and values.
+func (w *Writer) Sample(name string, labels []string, value float64) {
+	fmt.Fprint(w, name)
+	if len(labels) > 0 {
+		w.Write([]byte{'{'})
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				w.Write([]byte{','})
+			}
+			fmt.Fprintf(w, "%s=%s", labels[i], strconv.Quote(labels[i+1]))
+		}
+		w.Write([]byte{'}'})
+	}
+	fmt.Fprintf(w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// Histogram writes the bucket, sum and count samples of the histogram.
+func (w *Writer) Histogram(name string, labels []string, h *Histogram) {
+	bucket := func(le string) []string {
+		return append(labels[:len(labels):len(labels)], "le", le)
+	}
+	for i, b := range h.buckets {
+		w.Sample(name+"_bucket", bucket(strconv.FormatFloat(b, 'g', -1, 64)), float64(h.counts[i]))
+	}
+	w.Sample(name+"_bucket", bucket("+Inf"), float64(h.count))
+	w.Sample(name+"_sum", labels, h.sum)
+	w.Sample(name+"_count", labels, float64(h.count))
+}
@@ -0,0 +1,50 @@
+package metrics_test
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/flynn/flynn/Godeps/_workspace/src/gopkg.in/check.v1"
+	"github.com/flynn/flynn/pkg/metrics"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+func (S) TestWriter(c *C) {
+	var buf bytes.Buffer
+	w := metrics.NewWriter(&buf)
+	w.Describe("jobs", "gauge", "Number of jobs.")
+	w.Sample("jobs", []string{"state", "up", "type", `a "b"`}, 2)
+	w.Describe("jobs", "gauge", "Number of jobs.")
+	w.Sample("jobs", nil, 0.5)
+	c.Assert(buf.String(), Equals, `# HELP jobs Number of jobs.
+# TYPE jobs gauge
+jobs{state="up",type="a \"b\""} 2
+jobs 0.5
+`)
+}
+
+func (S) TestHistogram(c *C) {
+	h := metrics.NewHistogram([]float64{.5, 1})
+	for _, v := range []float64{.25, .5, .75, 2} {
+		h.Observe(v)
+	}
+	var buf bytes.Buffer
+	labels := make([]string, 2, 4)
+	copy(labels, []string{"status", "ok"})
+	metrics.NewWriter(&buf).Histogram("pulls", labels, h)
+	c.Assert(buf.String(), Equals, `pulls_bucket{status="ok",le="0.5"} 2
+pulls_bucket{status="ok",le="1"} 3
+pulls_bucket{status="ok",le="+Inf"} 4
+pulls_sum{status="ok"} 3.5
+pulls_count{status="ok"} 4
+`)
+	// the labels passed in are not modified
+	c.Assert(labels[:cap(labels)], DeepEquals, []string{"status", "ok", "", ""})
+}
@@ -20,6 +20,9 @@ type Config struct {
 
 	// Config is used as the base TLS configuration, if set.
 	Config *tls.Config
+
+	// Dialer is used to establish the underlying connection, if set.
+	Dialer *net.Dialer
 }
 
 var ErrPinFailure = errors.New("pinned: the peer leaf certificate did not match the provided pin")
@@ -34,7 +37,11 @@ func (c *Config) Dial(network, addr string) (net.Conn, error) {
 	}
 	conf.InsecureSkipVerify = true
 
-	cn, err := net.Dial(network, addr)
+	dial := net.Dial
+	if c.Dialer != nil {
+		dial = c.Dialer.Dial
+	}
+	cn, err := dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
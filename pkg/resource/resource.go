@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/discoverd/client/balancer"
@@ -77,6 +79,95 @@ func (s *Server) Provision(config []byte) (*Resource, error) {
 	return resource, nil
 }
 
+// DeprovisionAttempts is the number of times Deprovision sends the request
+// before giving up, and DeprovisionRetryDelay is the delay before the first
+// retry, which doubles after each failed attempt.
+var (
+	DeprovisionAttempts   = 5
+	DeprovisionRetryDelay = time.Second
+)
+
+// Deprovision asks the provider to tear down the resource by sending a DELETE
+// request to its ID, which providers return as a path on their API.
+// Connection errors and server errors are retried with backoff, a 404 is
+// treated as the resource already having been removed.
+func (s *Server) Deprovision(id string) error {
+	if !strings.HasPrefix(id, "/") {
+		return fmt.Errorf("resource: cannot deprovision resource with id %q", id)
+	}
+	delay := DeprovisionRetryDelay
+	var err error
+	for i := 0; i < DeprovisionAttempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var retry bool
+		if retry, err = s.deprovision(id); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *Server) deprovision(id string) (retry bool, err error) {
+	server, err := s.lb.Next()
+	if err != nil {
+		return true, err
+	}
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s%s", server.Addr, id), nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == 200 || res.StatusCode == 204 || res.StatusCode == 404:
+		return false, nil
+	case res.StatusCode >= 500:
+		return true, fmt.Errorf("resource: unexpected status code %d", res.StatusCode)
+	default:
+		return false, fmt.Errorf("resource: unexpected status code %d", res.StatusCode)
+	}
+}
+
+// StatusTimeout is the maximum time that Status waits for a provider to
+// respond.
+var StatusTimeout = 5 * time.Second
+
+// Status describes the result of probing a provider.
+type Status struct {
+	Addr    string
+	Latency time.Duration
+}
+
+// Status checks that an instance of the provider is reachable by sending a
+// GET request to the provisioning URL. Providers only accept POST requests
+// at that URL, so any response which is not a server error is treated as
+// healthy.
+func (s *Server) Status() (*Status, error) {
+	server, err := s.lb.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: StatusTimeout}
+	start := time.Now()
+	res, err := client.Get(fmt.Sprintf("http://%s%s", server.Addr, s.path))
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	status := &Status{Addr: server.Addr, Latency: time.Since(start)}
+	if res.StatusCode >= 500 {
+		return status, fmt.Errorf("resource: unexpected status code %d", res.StatusCode)
+	}
+	return status, nil
+}
+
 func (s *Server) Close() error {
 	return s.set.Close()
 }
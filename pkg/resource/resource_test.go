@@ -0,0 +1,65 @@
+package resource
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+)
+
+type fakeBalancer struct {
+	addr string
+}
+
+func (b fakeBalancer) Next() (*discoverd.Service, error) {
+	return &discoverd.Service{Addr: b.addr}, nil
+}
+
+func TestDeprovision(t *testing.T) {
+	defer func(d time.Duration) { DeprovisionRetryDelay = d }(DeprovisionRetryDelay)
+	DeprovisionRetryDelay = time.Millisecond
+
+	var requests int32
+	status := map[string][]int{
+		"/things/retry":   {500, 503, 200},
+		"/things/missing": {404},
+		"/things/invalid": {400},
+		"/things/down":    {500, 500, 500, 500, 500, 500},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "DELETE" {
+			t.Errorf("unexpected method %s", req.Method)
+		}
+		n := atomic.AddInt32(&requests, 1)
+		codes := status[req.URL.Path]
+		w.WriteHeader(codes[int(n)-1])
+	}))
+	defer srv.Close()
+	s := &Server{path: "/things", lb: fakeBalancer{srv.Listener.Addr().String()}}
+
+	for _, test := range []struct {
+		id       string
+		ok       bool
+		requests int32
+	}{
+		{"/things/retry", true, 3},
+		{"/things/missing", true, 1},
+		{"/things/invalid", false, 1},
+		{"/things/down", false, int32(DeprovisionAttempts)},
+		{"things", false, 0},
+	} {
+		atomic.StoreInt32(&requests, 0)
+		err := s.Deprovision(test.id)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.id, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: expected an error", test.id)
+		}
+		if n := atomic.LoadInt32(&requests); n != test.requests {
+			t.Errorf("%s: expected %d requests, got %d", test.id, test.requests, n)
+		}
+	}
+}
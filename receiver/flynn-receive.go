@@ -62,6 +62,7 @@ func main() {
 	}
 
 	fmt.Printf("-----> Building %s...\n", app.Name)
+	buildTime := time.Now().UTC()
 
 	var output bytes.Buffer
 	slugURL := fmt.Sprintf("http://%s/%s.tgz", blobstoreHost, random.UUID())
@@ -100,6 +101,7 @@ func main() {
 	release := &ct.Release{
 		ArtifactID: artifact.ID,
 		Env:        prevRelease.Env,
+		Meta:       releaseMeta(buildTime),
 	}
 	procs := make(map[string]ct.ProcessType)
 	for _, t := range types {
@@ -123,8 +125,12 @@ func main() {
 	if err := client.CreateRelease(release); err != nil {
 		log.Fatalln("Error creating release:", err)
 	}
-	if err := client.SetAppRelease(app.Name, release.ID); err != nil {
-		log.Fatalln("Error setting app release:", err)
+	if prevRelease.ID == "" {
+		if err := client.SetAppRelease(app.Name, release.ID); err != nil {
+			log.Fatalln("Error setting app release:", err)
+		}
+	} else if err := deploy(client, app.ID, release.ID); err != nil {
+		log.Fatalln("Error deploying release:", err)
 	}
 
 	fmt.Println("=====> Application deployed")
@@ -145,6 +151,52 @@ func main() {
 	}
 }
 
+// releaseMeta returns the provenance of the release being built, the commit
+// and ref are passed as arguments by gitreceived.
+func releaseMeta(buildTime time.Time) map[string]string {
+	meta := map[string]string{
+		ct.ReleaseMetaBuilder:   "slugbuilder",
+		ct.ReleaseMetaBuildTime: buildTime.Format(time.RFC3339),
+	}
+	if len(os.Args) > 2 {
+		meta[ct.ReleaseMetaGitCommit] = os.Args[2]
+	}
+	if len(os.Args) > 3 {
+		meta[ct.ReleaseMetaGitRef] = os.Args[3]
+	}
+	if user := os.Getenv("RECEIVE_USER"); user != "" {
+		meta[ct.ReleaseMetaBuildUser] = user
+	}
+	return meta
+}
+
+// deploy replaces the app's current release with the given release using a
+// deployment, so that the old jobs keep running until the new ones are up.
+func deploy(client *controller.Client, appID, releaseID string) error {
+	d := &ct.Deployment{AppID: appID, NewReleaseID: releaseID}
+	if err := client.CreateDeployment(d); err != nil {
+		return err
+	}
+	events := make(chan *ct.DeploymentEvent)
+	stream, err := client.StreamDeployment(appID, d.ID, events)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	for e := range events {
+		switch e.Status {
+		case ct.DeploymentStatusComplete:
+			return nil
+		case ct.DeploymentStatusFailed:
+			return fmt.Errorf("deployment failed: %s", e.Error)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("deployment stream closed unexpectedly")
+}
+
 func appendEnvDir(stdin io.Reader, pipe io.WriteCloser, env map[string]string) {
 	defer pipe.Close()
 	tr := tar.NewReader(stdin)
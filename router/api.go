@@ -30,9 +30,25 @@ func apiHandler(rtr *Router) http.Handler {
 	r.Get("/routes", getRoutes)
 	r.Get("/routes/:route_type/:route_id", getRoute)
 	r.Delete("/routes/:route_type/:route_id", deleteRoute)
+	r.Get("/stats", getStats)
 	return m
 }
 
+// serviceStatser is implemented by listeners which count the requests they
+// route to each service.
+type serviceStatser interface {
+	ServiceStats() []*router.ServiceStats
+}
+
+func getStats(router *Router, r render.Render) {
+	stats, ok := router.HTTP.(serviceStatser)
+	if !ok {
+		r.JSON(404, struct{}{})
+		return
+	}
+	r.JSON(200, stats.ServiceStats())
+}
+
 func createRoute(req *http.Request, route router.Route, router *Router, r render.Render) {
 	now := time.Now()
 	route.CreatedAt = &now
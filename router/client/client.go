@@ -38,6 +38,7 @@ type Client interface {
 	DeleteRoute(id string) error
 	GetRoute(id string) (*router.Route, error)
 	ListRoutes(parentRef string) ([]*router.Route, error)
+	ServiceStats() ([]*router.ServiceStats, error)
 	Close() error
 }
 
@@ -150,6 +151,14 @@ func (c *client) ListRoutes(parentRef string) ([]*router.Route, error) {
 	return res, err
 }
 
+// ServiceStats returns the number of HTTP requests the router has routed to
+// each service.
+func (c *client) ServiceStats() ([]*router.ServiceStats, error) {
+	var res []*router.ServiceStats
+	err := c.get("/stats", &res)
+	return res, err
+}
+
 func (c *client) Close() error {
 	return c.dialer.Close()
 }
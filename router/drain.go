@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultDrainTimeout is how long the connections of a removed route are
+// given to finish their requests if the route does not set a drain timeout.
+const defaultDrainTimeout = 30 * time.Second
+
+// drainTimeout returns the drain timeout set by a route in seconds, or def
+// if it is not set.
+func drainTimeout(seconds int, def time.Duration) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return def
+}
+
+// connTracker tracks the client connections of a route and whether they are
+// serving a request, so that when the route is removed or replaced the
+// requests in flight can finish before the connections are closed.
+type connTracker struct {
+	mtx sync.Mutex
+	// conns maps connections to whether they are serving a request.
+	conns    map[net.Conn]bool
+	active   int
+	draining bool
+	drained  chan struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns:   make(map[net.Conn]bool),
+		drained: make(chan struct{}),
+	}
+}
+
+// begin marks conn as serving a request, adding it to the tracked
+// connections. It returns false if the route is draining, in which case the
+// request must not be routed.
+func (t *connTracker) begin(conn net.Conn) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.draining {
+		return false
+	}
+	if !t.conns[conn] {
+		t.conns[conn] = true
+		t.active++
+	}
+	return true
+}
+
+// end marks the request being served by conn as finished, the connection
+// stays tracked until it is removed.
+func (t *connTracker) end(conn net.Conn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if active, ok := t.conns[conn]; ok && active {
+		t.conns[conn] = false
+		t.done()
+	}
+}
+
+// remove stops tracking conn, which has been closed or is being used for
+// another route.
+func (t *connTracker) remove(conn net.Conn) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if active, ok := t.conns[conn]; ok {
+		delete(t.conns, conn)
+		if active {
+			t.done()
+		}
+	}
+}
+
+// done must be called with t.mtx held when a request finishes.
+func (t *connTracker) done() {
+	t.active--
+	if t.draining && t.active == 0 {
+		close(t.drained)
+	}
+}
+
+// drain stops new requests from being routed and waits up to timeout for
+// the requests in flight to finish, then closes all tracked connections.
+func (t *connTracker) drain(timeout time.Duration) {
+	t.mtx.Lock()
+	if t.draining {
+		t.mtx.Unlock()
+		return
+	}
+	t.draining = true
+	if t.active == 0 {
+		close(t.drained)
+	}
+	t.mtx.Unlock()
+
+	select {
+	case <-t.drained:
+	case <-time.After(timeout):
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
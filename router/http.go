@@ -17,6 +17,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/flynn/flynn/Godeps/_workspace/src/code.google.com/p/go.crypto/nacl/secretbox"
@@ -34,6 +35,13 @@ type HTTPListener struct {
 	TLSAddr   string
 	TLSConfig *tls.Config
 
+	// DrainTimeout is used for routes which do not set a drain timeout.
+	DrainTimeout time.Duration
+
+	// MaintenancePage is the HTML body served with a 503 for requests to
+	// routes in maintenance mode.
+	MaintenancePage []byte
+
 	mtx      sync.RWMutex
 	domains  map[string]*httpRoute
 	routes   map[string]*httpRoute
@@ -55,15 +63,16 @@ type DiscoverdClient interface {
 
 func NewHTTPListener(addr, tlsAddr string, cookieKey *[32]byte, ds DataStore, discoverdc DiscoverdClient) *HTTPListener {
 	l := &HTTPListener{
-		Addr:      addr,
-		TLSAddr:   tlsAddr,
-		ds:        ds,
-		discoverd: discoverdc,
-		routes:    make(map[string]*httpRoute),
-		domains:   make(map[string]*httpRoute),
-		services:  make(map[string]*httpService),
-		wm:        NewWatchManager(),
-		cookieKey: cookieKey,
+		Addr:         addr,
+		TLSAddr:      tlsAddr,
+		DrainTimeout: defaultDrainTimeout,
+		ds:           ds,
+		discoverd:    discoverdc,
+		routes:       make(map[string]*httpRoute),
+		domains:      make(map[string]*httpRoute),
+		services:     make(map[string]*httpService),
+		wm:           NewWatchManager(),
+		cookieKey:    cookieKey,
 	}
 	if cookieKey == nil {
 		var k [32]byte
@@ -135,6 +144,22 @@ func (s *HTTPListener) SetRoute(r *router.Route) error {
 	return s.ds.Set(r)
 }
 
+// ServiceStats returns the number of requests routed to each service which
+// has routes. The counts start from zero when a service's first route is
+// added.
+func (s *HTTPListener) ServiceStats() []*router.ServiceStats {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	stats := make([]*router.ServiceStats, 0, len(s.services))
+	for name, service := range s.services {
+		stats = append(stats, &router.ServiceStats{
+			Service:  name,
+			Requests: atomic.LoadUint64(&service.requests),
+		})
+	}
+	return stats
+}
+
 func md5sum(data string) string {
 	digest := md5.Sum([]byte(data))
 	return hex.EncodeToString(digest[:])
@@ -161,6 +186,8 @@ func (h *httpSyncHandler) Set(data *router.Route) error {
 		TLSCert: route.TLSCert,
 		TLSKey:  route.TLSKey,
 		Sticky:  route.Sticky,
+
+		Maintenance: route.Maintenance,
 	}
 
 	if r.TLSCert != "" && r.TLSKey != "" {
@@ -180,14 +207,6 @@ func (h *httpSyncHandler) Set(data *router.Route) error {
 	}
 
 	service := h.l.services[r.Service]
-	if service != nil && service.name != r.Service {
-		service.refs--
-		if service.refs <= 0 {
-			service.ss.Close()
-			delete(h.l.services, service.name)
-		}
-		service = nil
-	}
 	if service == nil {
 		ss, err := h.l.discoverd.NewServiceSet(r.Service)
 		if err != nil {
@@ -198,6 +217,14 @@ func (h *httpSyncHandler) Set(data *router.Route) error {
 	}
 	service.refs++
 	r.service = service
+	r.drainTimeout = drainTimeout(route.DrainTimeout, h.l.DrainTimeout)
+	r.conns = newConnTracker()
+
+	// requests are routed to the new route from now on, those in flight on
+	// the route it replaces are drained
+	if prev, ok := h.l.routes[data.ID]; ok {
+		go h.l.drain(prev)
+	}
 	h.l.routes[data.ID] = r
 	h.l.domains[r.Domain] = r
 
@@ -216,18 +243,27 @@ func (h *httpSyncHandler) Remove(id string) error {
 		return ErrNotFound
 	}
 
-	r.service.refs--
-	if r.service.refs <= 0 {
-		r.service.ss.Close()
-		delete(h.l.services, r.service.name)
-	}
-
 	delete(h.l.routes, id)
 	delete(h.l.domains, r.Domain)
+	go h.l.drain(r)
 	go h.l.wm.Send(&router.Event{Event: "remove", ID: id})
 	return nil
 }
 
+// drain waits for the requests in flight on a route which has been removed
+// or replaced to finish, then releases the route's service.
+func (s *HTTPListener) drain(r *httpRoute) {
+	r.conns.drain(r.drainTimeout)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	r.service.refs--
+	if r.service.refs <= 0 && !s.closed {
+		r.service.ss.Close()
+		delete(s.services, r.service.name)
+	}
+}
+
 func (s *HTTPListener) serve(started chan<- error) {
 	var err error
 	s.listener, err = net.Listen("tcp", s.Addr)
@@ -282,6 +318,35 @@ func fail(sc *httputil.ServerConn, req *http.Request, code int, msg string) {
 	sc.Write(req, resp)
 }
 
+// defaultMaintenancePage is served for routes in maintenance mode if the
+// listener does not set a maintenance page.
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><title>Down for maintenance</title></head>
+<body>
+<h1>Down for maintenance</h1>
+<p>This app is undergoing maintenance, please try again shortly.</p>
+</body>
+</html>
+`
+
+func (s *HTTPListener) maintenance(sc *httputil.ServerConn, req *http.Request) {
+	page := s.MaintenancePage
+	if page == nil {
+		page = []byte(defaultMaintenancePage)
+	}
+	resp := &http.Response{
+		StatusCode:    503,
+		ProtoMajor:    1,
+		ProtoMinor:    0,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(page)),
+		ContentLength: int64(len(page)),
+	}
+	sc.Write(req, resp)
+}
+
 func (s *HTTPListener) handle(conn net.Conn, isTLS bool) {
 	defer conn.Close()
 
@@ -314,6 +379,15 @@ func (s *HTTPListener) handle(conn net.Conn, isTLS bool) {
 		conn = tls.Server(vhostConn, tlscfg)
 	}
 
+	// cur is the route tracking the connection, a connection is tracked by
+	// the route of its last request
+	var cur *httpRoute
+	defer func() {
+		if cur != nil {
+			cur.conns.remove(conn)
+		}
+	}()
+
 	sc := httputil.NewServerConn(conn, nil)
 	for {
 		req, err := sc.Read()
@@ -332,8 +406,31 @@ func (s *HTTPListener) handle(conn net.Conn, isTLS bool) {
 			}
 		}
 
+		if r.Maintenance {
+			s.maintenance(sc, req)
+			continue
+		}
+
+		if r != cur {
+			if cur != nil {
+				cur.conns.remove(conn)
+			}
+			cur = r
+		}
+		if !r.conns.begin(conn) {
+			// the route is draining, so it has been removed or
+			// replaced since it was looked up
+			fail(sc, req, 503, "Service Unavailable")
+			if isTLS {
+				return
+			}
+			continue
+		}
+
 		req.RemoteAddr = conn.RemoteAddr().String()
-		if r.service.handle(req, sc, isTLS, r.Sticky) {
+		done := r.service.handle(req, sc, isTLS, r.Sticky)
+		r.conns.end(conn)
+		if done {
 			return
 		}
 	}
@@ -348,12 +445,22 @@ type httpRoute struct {
 	TLSKey  string
 	Sticky  bool
 
+	Maintenance bool
+
 	keypair *tls.Certificate
 	service *httpService
+
+	conns        *connTracker
+	drainTimeout time.Duration
 }
 
 // A service definition: name, and set of backends.
 type httpService struct {
+	// requests is the number of requests routed to the service, it is
+	// updated atomically and must be the first field so it is 64-bit
+	// aligned.
+	requests uint64
+
 	name string
 	ss   discoverd.ServiceSet
 	refs int
@@ -443,6 +550,7 @@ func (s *httpService) getBackendSticky(req *http.Request) (*httputil.ClientConn,
 }
 
 func (s *httpService) handle(req *http.Request, sc *httputil.ServerConn, tls, sticky bool) (done bool) {
+	atomic.AddUint64(&s.requests, 1)
 	req.Header.Set("X-Request-Start", strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
 	req.Header.Set("X-Request-Id", random.UUID())
 
@@ -145,6 +145,61 @@ func (s *S) TestAddHTTPRoute(c *C) {
 	res.Body.Close()
 }
 
+func (s *S) TestHTTPRouteDrain(c *C) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("1"))
+	}))
+	defer srv.Close()
+
+	l, discoverd := newHTTPListener(c)
+	defer l.Close()
+
+	r := addHTTPRoute(c, l)
+
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+	defer discoverd.UnregisterAll()
+
+	type result struct {
+		body string
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		res, err := httpClient.Do(newReq("http://"+l.Addr+"/slow", "example.com"))
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		done <- result{string(data), err}
+	}()
+	<-started
+
+	wait := waitForEvent(c, l, "remove", r.ID)
+	err := l.RemoveRoute(r.ID)
+	c.Assert(err, IsNil)
+	wait()
+
+	// new requests are not routed once the route is removed
+	res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 404)
+	res.Body.Close()
+
+	// but the request in flight finishes
+	close(release)
+	slow := <-done
+	c.Assert(slow.err, IsNil)
+	c.Assert(slow.body, Equals, "1")
+}
+
 func newReq(url, host string) *http.Request {
 	req, _ := http.NewRequest("GET", url, nil)
 	req.Host = host
@@ -233,6 +288,24 @@ func (s *S) TestHTTPServiceHandlerBackendConnectionClosed(c *C) {
 	assertGet(c, "http://"+l.Addr, "example.com", "1")
 }
 
+func (s *S) TestHTTPServiceStats(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l, discoverd := newHTTPListener(c)
+	defer l.Close()
+
+	addHTTPRoute(c, l)
+	c.Assert(l.ServiceStats(), DeepEquals, []*router.ServiceStats{{Service: "test"}})
+
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+	defer discoverd.UnregisterAll()
+
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+	assertGet(c, "https://"+l.TLSAddr, "example.com", "1")
+	c.Assert(l.ServiceStats(), DeepEquals, []*router.ServiceStats{{Service: "test", Requests: 2}})
+}
+
 // Act as an app to test HTTP headers
 func httpHeaderTestHandler(c *C, ip string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -345,6 +418,44 @@ func (s *S) TestStickyHTTPRoute(c *C) {
 	}
 }
 
+func (s *S) TestHTTPRouteMaintenance(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l, discoverd := newHTTPListener(c)
+	defer l.Close()
+	l.MaintenancePage = []byte("<h1>maintenance</h1>")
+
+	r := addHTTPRoute(c, l)
+
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+	defer discoverd.UnregisterAll()
+
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+
+	setMaintenance := func(on bool) {
+		route := r.HTTPRoute()
+		route.Maintenance = on
+		wait := waitForEvent(c, l, "set", "")
+		err := l.SetRoute(route.ToRoute())
+		c.Assert(err, IsNil)
+		wait()
+	}
+
+	setMaintenance(true)
+	res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 503)
+	c.Assert(res.Header.Get("Content-Type"), Equals, "text/html; charset=utf-8")
+	c.Assert(string(data), Equals, "<h1>maintenance</h1>")
+
+	setMaintenance(false)
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+}
+
 // issue #152
 func (s *S) TestKeepaliveHostname(c *C) {
 	srv1 := httptest.NewServer(httpTestHandler("1"))
@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -66,6 +67,8 @@ func main() {
 	tcpRangeStart := flag.Int("tcp-range-start", 3000, "tcp port range start")
 	tcpRangeEnd := flag.Int("tcp-range-end", 3500, "tcp port range end")
 	apiAddr := flag.String("apiaddr", ":"+apiPort, "api listen address")
+	drainTimeout := flag.Duration("drain-timeout", defaultDrainTimeout, "time given to requests in flight when a route is removed")
+	maintenancePage := flag.String("maintenance-page", "", "path to the HTML page served for apps in maintenance mode")
 	flag.Parse()
 
 	// Will use DISCOVERD environment variable
@@ -98,9 +101,20 @@ func main() {
 	if prefix == "" {
 		prefix = "/router"
 	}
+	tcpListener := NewTCPListener(*tcpIP, *tcpRangeStart, *tcpRangeEnd, NewEtcdDataStore(etcdc, path.Join(prefix, "tcp/")), d)
+	tcpListener.DrainTimeout = *drainTimeout
+	httpListener := NewHTTPListener(*httpAddr, *httpsAddr, cookieKey, NewEtcdDataStore(etcdc, path.Join(prefix, "http/")), d)
+	httpListener.DrainTimeout = *drainTimeout
+	if *maintenancePage != "" {
+		page, err := ioutil.ReadFile(*maintenancePage)
+		if err != nil {
+			log.Fatal("error reading maintenance page:", err)
+		}
+		httpListener.MaintenancePage = page
+	}
 	var r Router
-	r.TCP = NewTCPListener(*tcpIP, *tcpRangeStart, *tcpRangeEnd, NewEtcdDataStore(etcdc, path.Join(prefix, "tcp/")), d)
-	r.HTTP = NewHTTPListener(*httpAddr, *httpsAddr, cookieKey, NewEtcdDataStore(etcdc, path.Join(prefix, "http/")), d)
+	r.TCP = tcpListener
+	r.HTTP = httpListener
 
 	go func() { log.Fatal(r.ListenAndServe(nil)) }()
 	log.Fatal(http.ListenAndServe(*apiAddr, apiHandler(&r)))
@@ -8,6 +8,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/router/types"
@@ -15,15 +16,16 @@ import (
 
 func NewTCPListener(ip string, startPort, endPort int, ds DataStore, dc DiscoverdClient) *TCPListener {
 	l := &TCPListener{
-		IP:         ip,
-		ds:         ds,
-		wm:         NewWatchManager(),
-		discoverd:  dc,
-		services:   make(map[int]*tcpService),
-		serviceIDs: make(map[string]*tcpService),
-		listeners:  make(map[int]net.Listener),
-		startPort:  startPort,
-		endPort:    endPort,
+		IP:           ip,
+		DrainTimeout: defaultDrainTimeout,
+		ds:           ds,
+		wm:           NewWatchManager(),
+		discoverd:    dc,
+		services:     make(map[int]*tcpService),
+		serviceIDs:   make(map[string]*tcpService),
+		listeners:    make(map[int]net.Listener),
+		startPort:    startPort,
+		endPort:      endPort,
 	}
 	l.Watcher = l.wm
 	l.DataStoreReader = l.ds
@@ -36,6 +38,9 @@ type TCPListener struct {
 
 	IP string
 
+	// DrainTimeout is used for routes which do not set a drain timeout.
+	DrainTimeout time.Duration
+
 	discoverd DiscoverdClient
 	ds        DataStore
 	wm        *WatchManager
@@ -153,9 +158,11 @@ func (h *tcpSyncHandler) Set(data *router.Route) error {
 	}
 
 	s := &tcpService{
-		addr:   h.l.IP + ":" + strconv.Itoa(r.Port),
-		port:   r.Port,
-		parent: h.l,
+		addr:         h.l.IP + ":" + strconv.Itoa(r.Port),
+		port:         r.Port,
+		parent:       h.l,
+		conns:        newConnTracker(),
+		drainTimeout: drainTimeout(r.DrainTimeout, h.l.DrainTimeout),
 	}
 	var err error
 	s.ss, err = h.l.discoverd.NewServiceSet(r.Service)
@@ -194,7 +201,10 @@ func (h *tcpSyncHandler) Remove(id string) error {
 	if !ok {
 		return ErrNotFound
 	}
+	// stop accepting connections, those which are open are given the drain
+	// timeout to finish
 	service.Close()
+	go service.conns.drain(service.drainTimeout)
 	delete(h.l.services, service.port)
 	delete(h.l.serviceIDs, id)
 	go h.l.wm.Send(&router.Event{Event: "remove", ID: id})
@@ -207,6 +217,9 @@ type tcpService struct {
 	port   int
 	l      net.Listener
 	ss     discoverd.ServiceSet
+
+	conns        *connTracker
+	drainTimeout time.Duration
 }
 
 func (s *tcpService) Close() {
@@ -270,6 +283,10 @@ func (s *tcpService) getBackend() (conn net.Conn) {
 
 func (s *tcpService) handle(conn net.Conn) {
 	defer conn.Close()
+	if !s.conns.begin(conn) {
+		return
+	}
+	defer s.conns.remove(conn)
 	backend := s.getBackend()
 	if backend == nil {
 		return
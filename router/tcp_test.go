@@ -119,6 +119,43 @@ func (s *S) TestAddTCPRoute(c *C) {
 	c.Assert(err, Not(IsNil))
 }
 
+func (s *S) TestTCPRouteDrain(c *C) {
+	const addr, portInt = "127.0.0.1:45001", 45001
+	srv := NewTCPTestServer("1")
+	defer srv.Close()
+
+	l, discoverd := newTCPListener(c)
+	defer l.Close()
+
+	r := addTCPRoute(c, l, portInt)
+
+	discoverdRegisterTCP(c, l, portInt, srv.Addr)
+	defer discoverd.UnregisterAll()
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	// read the prefix so that the connection is known to be proxied
+	prefix := make([]byte, 1)
+	_, err = io.ReadFull(conn, prefix)
+	c.Assert(err, IsNil)
+
+	wait := waitForEvent(c, l, "remove", r.Route.ID)
+	err = l.RemoveRoute(r.Route.ID)
+	c.Assert(err, IsNil)
+	wait()
+
+	_, err = net.Dial("tcp", addr)
+	c.Assert(err, Not(IsNil))
+
+	// the open connection keeps working until it is closed
+	conn.Write([]byte("asdf"))
+	conn.(*net.TCPConn).CloseWrite()
+	res, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(res), Equals, "asdf")
+}
+
 func addTCPRoute(c *C, l *tcpListener, port int) *router.TCPRoute {
 	wait := waitForEvent(c, l, "set", "")
 	r := (&router.TCPRoute{
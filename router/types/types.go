@@ -51,6 +51,16 @@ type HTTPRoute struct {
 	TLSCert string `json:"tls_cert,omitempty"`
 	TLSKey  string `json:"tls_key,omitempty"`
 	Sticky  bool   `json:"sticky,omitempty"`
+
+	// DrainTimeout is how many seconds requests in flight are given to
+	// finish when the route is removed or replaced, the router's default
+	// is used if it is zero.
+	DrainTimeout int `json:"drain_timeout,omitempty"`
+
+	// Maintenance is set while the route's app is in maintenance mode, in
+	// which case requests are answered with the router's maintenance page
+	// rather than being routed to the service.
+	Maintenance bool `json:"maintenance,omitempty"`
 }
 
 func (r *HTTPRoute) ToRoute() *Route {
@@ -70,6 +80,11 @@ type TCPRoute struct {
 	*Route  `json:"-"`
 	Port    int    `json:"port"`
 	Service string `json:"service"`
+
+	// DrainTimeout is how many seconds open connections are given to
+	// finish when the route is removed, the router's default is used if it
+	// is zero.
+	DrainTimeout int `json:"drain_timeout,omitempty"`
 }
 
 func (r *TCPRoute) ToRoute() *Route {
@@ -90,3 +105,10 @@ type Event struct {
 	ID    string
 	Error error
 }
+
+// ServiceStats is the number of HTTP requests a router has routed to a
+// service.
+type ServiceStats struct {
+	Service  string `json:"service"`
+	Requests uint64 `json:"requests"`
+}